@@ -0,0 +1,21 @@
+// Package ballotstudio holds the web assets that are built into the ballotstudio server binary.
+package ballotstudio
+
+import (
+	"embed"
+)
+
+// Templates holds gotemplates/*.html
+//
+//go:embed gotemplates/*.html
+var Templates embed.FS
+
+// Static holds static/, served at /static/
+//
+//go:embed static
+var Static embed.FS
+
+// Demo holds demo/*.json, example elections loaded with -demo
+//
+//go:embed demo/*.json
+var Demo embed.FS
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Accounts. The login library's sign-in records only know a user by
+// number and login name; the display name and email people see are kept
+// here, in account_profiles.
+//
+//	GET /account         the user's profile, quota and usage
+//	PUT /account         {"display_name": ..., "email": ...}, fields left out keep their value
+//	GET /account/export  everything stored about the user, as one JSON download
+//	DELETE /account?confirm={login name}
+//
+// A new email also goes to the user's digest and notification settings.
+// The display name is what review comments are signed with.
+//
+// Deleting an account removes its webhooks, digest and notification
+// settings and quota override, and unlinks its staff record so the address
+// can be invited again. Its elections are purged with everything stored
+// about them, or with -account-delete-elections={user} given to that user.
+// The sign-in record stays, so the login name stays taken, but is treated
+// as logged out from then on. Review comments left on other people's
+// elections stay under the name they were signed with.
+
+// largest PUT /account body
+const maxAccountBody = 10000
+
+// longest display name, bytes
+const maxDisplayName = 200
+
+// a user's profile
+type accountRecord struct {
+	UserId      int64  `json:"user"`
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+	Updated     int64  `json:"updated"`           // unix seconds
+	Deleted     int64  `json:"deleted,omitempty"` // unix seconds, 0 for a live account
+
+	// Disabled is when an operator turned sign in off for the account,
+	// unix seconds, see admincmd.go
+	Disabled int64 `json:"disabled,omitempty"`
+}
+
+// GET /account response
+type accountJSON struct {
+	UserId      int64       `json:"user"`
+	Username    string      `json:"username"`
+	DisplayName string      `json:"display_name"`
+	Email       string      `json:"email"`
+	Limits      quotaLimits `json:"limits"`
+	Unlimited   bool        `json:"unlimited,omitempty"`
+	Usage       quotaUsage  `json:"usage"`
+}
+
+// PUT /account body
+type accountRequest struct {
+	DisplayName *string `json:"display_name"`
+	Email       *string `json:"email"`
+}
+
+// liveUser is nil for a deleted or disabled account's user
+func (sh *StudioHandler) liveUser(user *login.User) *login.User {
+	return liveUser(sh.edb, user)
+}
+
+func liveUser(edb electionAppDB, user *login.User) *login.User {
+	if user == nil {
+		return nil
+	}
+	ar, err := edb.GetAccount(user.Guid)
+	if err != nil {
+		log.Printf("%d: account, %v", user.Guid, err)
+		return nil
+	}
+	if ar != nil && (ar.Deleted != 0 || ar.Disabled != 0) {
+		return nil
+	}
+	return user
+}
+
+// httpUser is who r is signed in as, nil if nobody or a deleted or
+// disabled account. Every handler that checks who is asking goes through it.
+func httpUser(w http.ResponseWriter, r *http.Request, udb login.UserDB, edb electionAppDB) *login.User {
+	user, _ := login.GetHttpUser(w, r, udb)
+	return liveUser(edb, user)
+}
+
+// profile is user's account record, made up from the sign-in record if they've never set one
+func (sh *StudioHandler) profile(user *login.User) (accountRecord, error) {
+	ar, err := sh.edb.GetAccount(user.Guid)
+	if err != nil || ar == nil {
+		return accountRecord{UserId: user.Guid, DisplayName: user.Username, Email: user.Email}, err
+	}
+	return *ar, nil
+}
+
+// displayName is what user signs review comments with
+func (sh *StudioHandler) displayName(user *login.User) string {
+	ar, err := sh.profile(user)
+	if err != nil || ar.DisplayName == "" {
+		return user.Username
+	}
+	return ar.DisplayName
+}
+
+func (sh *StudioHandler) accountJSON(user *login.User, ar accountRecord) (aj accountJSON, err error) {
+	aj = accountJSON{UserId: user.Guid, Username: user.Username, DisplayName: ar.DisplayName, Email: ar.Email}
+	aj.Limits, aj.Unlimited, err = sh.userQuota(user)
+	if err != nil {
+		return aj, err
+	}
+	aj.Usage, err = sh.edb.UserUsage(user.Guid)
+	return aj, err
+}
+
+func (sh *StudioHandler) handleAccount(w http.ResponseWriter, r *http.Request, user *login.User, export bool) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	if export {
+		if r.Method != "GET" {
+			texterr(w, http.StatusMethodNotAllowed, "GET only")
+			return
+		}
+		sh.handleAccountExport(w, r, user)
+		return
+	}
+	ar, err := sh.profile(user)
+	if maybeerr(w, err, 500, "db account") {
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAccountBody))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		var req accountRequest
+		err = json.Unmarshal(body, &req)
+		if maybeerr(w, err, 400, "want json {\"display_name\": ..., \"email\": ...}") {
+			return
+		}
+		if req.DisplayName != nil {
+			name := strings.TrimSpace(*req.DisplayName)
+			if name == "" || len(name) > maxDisplayName || !headerSafe(name) {
+				texterr(w, 400, "display name should be 1 to %d bytes on one line", maxDisplayName)
+				return
+			}
+			ar.DisplayName = name
+		}
+		emailChanged := false
+		if req.Email != nil {
+			email := strings.TrimSpace(*req.Email)
+			if !strings.Contains(email, "@") || !headerSafe(email) {
+				texterr(w, 400, "bad email %q", email)
+				return
+			}
+			emailChanged = email != ar.Email
+			ar.Email = email
+		}
+		ar.Updated = time.Now().Unix()
+		err = sh.edb.PutAccount(ar)
+		if maybeerr(w, err, 500, "db account put") {
+			return
+		}
+		if emailChanged {
+			err = sh.updateNoticeEmail(user.Guid, ar.Email)
+			if maybeerr(w, err, 500, "db account email") {
+				return
+			}
+		}
+	case "DELETE":
+		if r.URL.Query().Get("confirm") != user.Username {
+			texterr(w, 400, "confirm with ?confirm=%s", user.Username)
+			return
+		}
+		if sh.deletedElectionsTo == user.Guid {
+			texterr(w, http.StatusConflict, "this account takes deleted accounts' elections")
+			return
+		}
+		// the login record first, so a store that can't drop it leaves the account as it was
+		err := sh.scrubLoginUser(user.Guid)
+		if maybeerr(w, err, 500, "login user delete") {
+			return
+		}
+		purged, err := sh.edb.DeleteAccount(user.Guid, sh.deletedElectionsTo)
+		if maybeerr(w, err, 500, "db account delete") {
+			return
+		}
+		if sh.deletedElectionsTo != 0 {
+			log.Printf("%d: account deleted, elections given to %d", user.Guid, sh.deletedElectionsTo)
+		} else {
+			log.Printf("%d: account deleted, %d elections purged", user.Guid, purged)
+		}
+		texterr(w, 200, "account deleted")
+		return
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET, PUT or DELETE")
+		return
+	}
+	aj, err := sh.accountJSON(user, ar)
+	if maybeerr(w, err, 500, "db account usage") {
+		return
+	}
+	writeJSON(w, aj)
+}
+
+// login databases that can rewrite or delete a user
+type userSetter interface {
+	SetUser(user *login.User) error
+}
+type userDeleter interface {
+	DeleteUser(guid int64) error
+}
+
+// scrubLoginUser blanks a deleted account's login record: no email, and a
+// password nobody knows. The login name stays taken so the guid is never
+// handed out again. A login database that can't rewrite users deletes it.
+func (sh *StudioHandler) scrubLoginUser(guid int64) error {
+	if sh.udb == nil {
+		return nil
+	}
+	ug, _ := sh.udb.(userGetter)
+	us, _ := sh.udb.(userSetter)
+	if ug != nil && us != nil {
+		lu, err := ug.GetUser(guid)
+		if err != nil || lu == nil {
+			return err
+		}
+		lu.Email = ""
+		lu.SetPassword(randomInviteToken(5))
+		return us.SetUser(lu)
+	}
+	if ud, ok := sh.udb.(userDeleter); ok {
+		return ud.DeleteUser(guid)
+	}
+	return errors.New("login database can't rewrite or delete users")
+}
+
+// updateNoticeEmail sends the user's digests and notifications to email
+func (sh *StudioHandler) updateNoticeEmail(uid int64, email string) error {
+	ds, err := sh.edb.GetDigestSchedule(uid)
+	if err != nil {
+		return err
+	}
+	if ds != nil {
+		ds.Email = email
+		if err = sh.edb.PutDigestSchedule(*ds); err != nil {
+			return err
+		}
+	}
+	np, err := sh.edb.GetNotifyPrefs(uid)
+	if err != nil {
+		return err
+	}
+	if np != nil {
+		np.Email = email
+		err = sh.edb.PutNotifyPrefs(*np)
+	}
+	return err
+}
+
+// GET /account/export
+type accountExport struct {
+	Exported      int64              `json:"exported"` // unix seconds
+	Account       accountJSON        `json:"account"`
+	Elections     []exportedElection `json:"elections"`
+	Webhooks      []webhookRecord    `json:"webhooks"`
+	Notifications *notifyPrefs       `json:"notifications"`
+	Digest        *digestSchedule    `json:"digest"`
+	Staff         *staffRecord       `json:"staff"`
+}
+
+type exportedElection struct {
+	Id          int64              `json:"itemid"`
+	State       string             `json:"state"`
+	Trashed     int64              `json:"trashed,omitempty"`
+	Tags        []string           `json:"tags"`
+	Meta        json.RawMessage    `json:"meta"`
+	Data        json.RawMessage    `json:"data"`
+	Revisions   []revisionRecord   `json:"revisions"`
+	Annotations []annotationRecord `json:"annotations"`
+	Scans       []exportedScan     `json:"scans"`
+	Bundle      string             `json:"bundle"` // zip with the scan images and media, see bundle.go
+}
+
+// a scan without its image
+type exportedScan struct {
+	Id          int64           `json:"id"`
+	ContentType string          `json:"content_type"`
+	Size        int             `json:"size"`
+	Interpreter string          `json:"interpreter"`
+	Result      json.RawMessage `json:"result"`
+	Created     int64           `json:"created"`
+	Custody     scanCustody     `json:"custody"`
+}
+
+// rawJSON is null for ""
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+func (sh *StudioHandler) handleAccountExport(w http.ResponseWriter, r *http.Request, user *login.User) {
+	edb := sh.edb.WithContext(r.Context())
+	ar, err := sh.profile(user)
+	if maybeerr(w, err, 500, "db account") {
+		return
+	}
+	out := accountExport{Exported: time.Now().Unix(), Elections: []exportedElection{}}
+	out.Account, err = sh.accountJSON(user, ar)
+	if maybeerr(w, err, 500, "db account usage") {
+		return
+	}
+	live, err := edb.ElectionsForUser(user.Guid)
+	if maybeerr(w, err, 500, "db elections") {
+		return
+	}
+	trashed, err := edb.TrashedForUser(user.Guid)
+	if maybeerr(w, err, 500, "db trash") {
+		return
+	}
+	for _, eid := range append(live, trashed...) {
+		ee, err := sh.exportElection(r, eid)
+		if maybeerr(w, err, 500, "db election %d", eid) {
+			return
+		}
+		out.Elections = append(out.Elections, ee)
+	}
+	out.Webhooks, err = edb.WebhooksForUser(user.Guid)
+	if maybeerr(w, err, 500, "db webhooks") {
+		return
+	}
+	out.Notifications, err = edb.GetNotifyPrefs(user.Guid)
+	if maybeerr(w, err, 500, "db notifications") {
+		return
+	}
+	out.Digest, err = edb.GetDigestSchedule(user.Guid)
+	if maybeerr(w, err, 500, "db digest") {
+		return
+	}
+	out.Staff, err = edb.StaffForUser(user.Guid)
+	if maybeerr(w, err, 500, "db staff") {
+		return
+	}
+	if out.Staff != nil {
+		out.Staff.Invite = ""
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"account_%d.json\"", user.Guid))
+	writeJSON(w, out)
+}
+
+func (sh *StudioHandler) exportElection(r *http.Request, eid int64) (ee exportedElection, err error) {
+	edb := sh.edb.WithContext(r.Context())
+	er, err := edb.GetElection(eid)
+	if err != nil {
+		return
+	}
+	ee = exportedElection{Id: eid, Trashed: er.Trashed, Meta: rawJSON(er.Meta), Data: rawJSON(er.Data), Scans: []exportedScan{}}
+	ee.Bundle = "/election/" + electionRef(r, eid) + "/export"
+	if ee.State, err = edb.GetElectionState(eid); err != nil {
+		return
+	}
+	if ee.Tags, err = edb.ElectionTags(eid); err != nil {
+		return
+	}
+	if ee.Revisions, err = edb.ElectionRevisions(eid); err != nil {
+		return
+	}
+	if ee.Annotations, err = edb.AnnotationsForElection(eid); err != nil {
+		return
+	}
+	scanids, err := edb.ScansForElection(eid)
+	if err != nil {
+		return
+	}
+	for _, sid := range scanids {
+		var sr *scanRecord
+		sr, err = edb.GetScan(sid)
+		if err != nil {
+			return
+		}
+		if sr == nil {
+			continue
+		}
+		ee.Scans = append(ee.Scans, exportedScan{sr.Id, sr.ContentType, len(sr.Image), sr.Interpreter, rawJSON(sr.Result), sr.Created, sr.Custody})
+	}
+	return ee, nil
+}
+
+// account queries common to all backends. param is "$" for numbered
+// placeholders or "?", idcol is the elections id column.
+
+func getAccount(db sqlDB, param string, uid int64) (*accountRecord, error) {
+	ph := "?"
+	if param != "?" {
+		ph = "$1"
+	}
+	ar := accountRecord{UserId: uid}
+	var name, email sql.NullString
+	var deleted, disabled sql.NullInt64
+	err := db.QueryRow(`SELECT display_name, email, updated, deleted, disabled FROM account_profiles WHERE user_id = `+ph, uid).Scan(&name, &email, &ar.Updated, &deleted, &disabled)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("account get, %v", err)
+	}
+	ar.DisplayName, ar.Email, ar.Deleted, ar.Disabled = name.String, email.String, deleted.Int64, disabled.Int64
+	return &ar, nil
+}
+
+func putAccount(db sqlDB, param string, ar accountRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("account tx, %v", err)
+	}
+	defer tx.Rollback()
+	err = putAccountTx(tx, param, ar)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("account commit, %v", err)
+	}
+	return nil
+}
+
+func putAccountTx(tx *sql.Tx, param string, ar accountRecord) error {
+	ph := func(i int) string {
+		if param == "?" {
+			return "?"
+		}
+		return fmt.Sprintf("$%d", i)
+	}
+	_, err := tx.Exec(`DELETE FROM account_profiles WHERE user_id = `+ph(1), ar.UserId)
+	if err != nil {
+		return fmt.Errorf("account delete, %v", err)
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO account_profiles (user_id, display_name, email, updated, deleted, disabled) VALUES (%s, %s, %s, %s, %s, %s)`, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6)), ar.UserId, ar.DisplayName, ar.Email, ar.Updated, ar.Deleted, ar.Disabled)
+	if err != nil {
+		return fmt.Errorf("account insert, %v", err)
+	}
+	return nil
+}
+
+// deleteAccount purges uid's elections, or gives them to electionsTo if
+// that isn't 0, drops uid's settings and marks the account deleted
+func deleteAccount(db sqlDB, param, idcol string, uid, electionsTo int64) (purged int64, err error) {
+	ph := func(i int) string {
+		if param == "?" {
+			return "?"
+		}
+		return fmt.Sprintf("$%d", i)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("account tx, %v", err)
+	}
+	defer tx.Rollback()
+	if electionsTo != 0 {
+		_, err = tx.Exec(fmt.Sprintf(`UPDATE elections SET owner = %s WHERE owner = %s`, ph(1), ph(2)), electionsTo, uid)
+		if err != nil {
+			return 0, fmt.Errorf("account elections transfer, %v", err)
+		}
+	} else {
+		purged, err = purgeElections(tx, idcol, "owner = "+ph(1), uid)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, q := range []string{
+		`DELETE FROM webhook_deliveries WHERE webhook IN (SELECT ` + idcol + ` FROM webhooks WHERE owner = ` + ph(1) + `)`,
+		`DELETE FROM webhooks WHERE owner = ` + ph(1),
+		`DELETE FROM digest_schedules WHERE user_id = ` + ph(1),
+		`DELETE FROM notify_prefs WHERE user_id = ` + ph(1),
+		`DELETE FROM user_quotas WHERE owner = ` + ph(1),
+		`UPDATE staff SET user_id = 0 WHERE user_id = ` + ph(1),
+	} {
+		_, err = tx.Exec(q, uid)
+		if err != nil {
+			return 0, fmt.Errorf("account delete, %v", err)
+		}
+	}
+	now := time.Now().Unix()
+	err = putAccountTx(tx, param, accountRecord{UserId: uid, Updated: now, Deleted: now})
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("account delete commit, %v", err)
+	}
+	return purged, nil
+}
+
+// a user ballotstudio has a record of, for `ballotstudio admin user list`
+type accountSummary struct {
+	UserId      int64  `json:"user"`
+	Username    string `json:"username,omitempty"` // if the login database can say
+	DisplayName string `json:"display_name,omitempty"`
+	Email       string `json:"email,omitempty"`
+	StaffRole   string `json:"staff_role,omitempty"`
+	Elections   int64  `json:"elections"`
+	Disabled    int64  `json:"disabled,omitempty"`
+	Deleted     int64  `json:"deleted,omitempty"`
+}
+
+// listAccounts is every user who owns an election, has a profile, is
+// linked staff or signed in through OpenID Connect, by number. The demo
+// elections' owner 0 isn't a user. The login library's own tables aren't
+// ours to read.
+func listAccounts(db sqlDB) (out []accountSummary, err error) {
+	rows, err := db.Query(`SELECT u.user_id, a.display_name, a.email, s.role, a.disabled, a.deleted, (SELECT COUNT(*) FROM elections e WHERE e.owner = u.user_id)
+FROM (SELECT owner AS user_id FROM elections WHERE owner <> 0 UNION SELECT user_id FROM account_profiles UNION SELECT user_id FROM staff WHERE user_id <> 0 UNION SELECT user_id FROM oidc_identities) u
+LEFT JOIN account_profiles a ON a.user_id = u.user_id
+LEFT JOIN staff s ON s.user_id = u.user_id
+ORDER BY u.user_id`)
+	if err != nil {
+		return nil, fmt.Errorf("accounts, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var as accountSummary
+		var name, email, role sql.NullString
+		var disabled, deleted sql.NullInt64
+		err = rows.Scan(&as.UserId, &name, &email, &role, &disabled, &deleted, &as.Elections)
+		if err != nil {
+			return nil, fmt.Errorf("account row, %v", err)
+		}
+		as.DisplayName, as.Email, as.StaffRole = name.String, email.String, role.String
+		as.Disabled, as.Deleted = disabled.Int64, deleted.Int64
+		out = append(out, as)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/login/login"
+)
+
+// a login database that keeps its users in a map
+type memUserDB struct {
+	login.UserDB
+	users map[int64]login.User
+}
+
+func (m *memUserDB) GetUser(guid int64) (*login.User, error) {
+	u, ok := m.users[guid]
+	if !ok {
+		return nil, nil
+	}
+	return &u, nil
+}
+
+func (m *memUserDB) SetUser(u *login.User) error {
+	m.users[u.Guid] = *u
+	return nil
+}
+
+func TestAccount(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	ann := &login.User{Guid: 7, Username: "ann", Email: "ann@example.com"}
+	ann.SetPassword("hunter2")
+	udb := &memUserDB{users: map[int64]login.User{7: *ann}}
+	sh := StudioHandler{edb: edb, udb: udb}
+	do := func(user *login.User, method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sh.handleAccount(rec, httptest.NewRequest(method, path, strings.NewReader(body)), user, strings.HasPrefix(path, "/account/export"))
+		return rec
+	}
+
+	var aj accountJSON
+	rec := do(ann, "GET", "/account", "")
+	json.Unmarshal(rec.Body.Bytes(), &aj)
+	if rec.Code != 200 || aj.DisplayName != "ann" || aj.Email != "ann@example.com" {
+		t.Errorf("default profile %d %#v", rec.Code, aj)
+	}
+	if rec := do(nil, "GET", "/account", ""); rec.Code != 401 {
+		t.Errorf("anonymous %d", rec.Code)
+	}
+
+	err := edb.PutNotifyPrefs(notifyPrefs{UserId: 7, Username: "ann", Email: "ann@example.com", Mentions: true})
+	mtfail(t, err, "notify put, %v", err)
+	rec = do(ann, "PUT", "/account", `{"display_name": " Ann Clerk ", "email": "clerk@example.com"}`)
+	aj = accountJSON{}
+	json.Unmarshal(rec.Body.Bytes(), &aj)
+	if rec.Code != 200 || aj.DisplayName != "Ann Clerk" || aj.Email != "clerk@example.com" {
+		t.Errorf("put %d %#v", rec.Code, aj)
+	}
+	np, _ := edb.GetNotifyPrefs(7)
+	if np == nil || np.Email != "clerk@example.com" {
+		t.Errorf("notify email not updated %#v", np)
+	}
+	if sh.displayName(ann) != "Ann Clerk" {
+		t.Errorf("display name %q", sh.displayName(ann))
+	}
+	for _, body := range []string{`{"email": "nope"}`, `{"display_name": ""}`, `{"display_name": "a\nb"}`} {
+		if rec := do(ann, "PUT", "/account", body); rec.Code != 400 {
+			t.Errorf("%s: %d", body, rec.Code)
+		}
+	}
+
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: `{"Election": [{"Name": "Spring"}]}`})
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.PutScan(scanRecord{ElectionId: eid, Image: make([]byte, 10), ContentType: "image/png", Result: `{"ok": true}`})
+	mtfail(t, err, "put scan, %v", err)
+	_, err = edb.PutWebhook(webhookRecord{Owner: 7, URL: "https://example.com/hook", Secret: "s", Events: []string{webhookPing}})
+	mtfail(t, err, "put webhook, %v", err)
+	rec = do(ann, "GET", "/account/export", "")
+	var ex accountExport
+	err = json.Unmarshal(rec.Body.Bytes(), &ex)
+	mtfail(t, err, "export json, %v", err)
+	if rec.Code != 200 || len(ex.Elections) != 1 || ex.Elections[0].Id != eid || len(ex.Elections[0].Scans) != 1 || ex.Elections[0].Scans[0].Size != 10 || len(ex.Webhooks) != 1 || ex.Notifications == nil {
+		t.Errorf("export %d %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(string(ex.Elections[0].Data), "Spring") || ex.Elections[0].Bundle != "/election/1/export" {
+		t.Errorf("export election %#v", ex.Elections[0])
+	}
+
+	if rec := do(ann, "DELETE", "/account", ""); rec.Code != 400 {
+		t.Errorf("unconfirmed delete %d", rec.Code)
+	}
+	if rec := do(ann, "DELETE", "/account?confirm=ann", ""); rec.Code != 200 {
+		t.Fatalf("delete %d %s", rec.Code, rec.Body.String())
+	}
+	if sh.liveUser(ann) != nil {
+		t.Errorf("deleted account still live")
+	}
+	if lu := udb.users[7]; lu.Username != "ann" || lu.Email != "" || lu.Password == ann.Password {
+		t.Errorf("login record not scrubbed %#v", lu)
+	}
+	if er, _ := edb.GetElection(eid); er != nil {
+		t.Errorf("election not purged %#v", er)
+	}
+	if ids, _ := edb.ScansForElection(eid); len(ids) != 0 {
+		t.Errorf("scans not purged %v", ids)
+	}
+	if whs, _ := edb.WebhooksForUser(7); len(whs) != 0 {
+		t.Errorf("webhooks left %#v", whs)
+	}
+	if np, _ := edb.GetNotifyPrefs(7); np != nil {
+		t.Errorf("notifications left %#v", np)
+	}
+
+	// with a user to take them, elections are given away
+	sh.deletedElectionsTo = 9
+	bo := &login.User{Guid: 8, Username: "bo"}
+	eid, err = edb.PutElection(electionRecord{Owner: 8, Data: `{}`})
+	mtfail(t, err, "put election, %v", err)
+	if rec := do(bo, "DELETE", "/account?confirm=bo", ""); rec.Code != 200 {
+		t.Fatalf("delete bo %d %s", rec.Code, rec.Body.String())
+	}
+	if er, _ := edb.GetElection(eid); er == nil || er.Owner != 9 {
+		t.Errorf("election not transferred %#v", er)
+	}
+	if rec := do(&login.User{Guid: 9, Username: "cy"}, "DELETE", "/account?confirm=cy", ""); rec.Code != 409 {
+		t.Errorf("delete the taker %d", rec.Code)
+	}
+
+	// a login database that can't forget a user keeps the account
+	sh.udb = struct{ login.UserDB }{}
+	dee := &login.User{Guid: 10, Username: "dee"}
+	if rec := do(dee, "DELETE", "/account?confirm=dee", ""); rec.Code != 500 || sh.liveUser(dee) == nil {
+		t.Errorf("delete without login support %d", rec.Code)
+	}
+}
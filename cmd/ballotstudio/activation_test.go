@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestActivatedListeners(t *testing.T) {
+	// a socket as systemd would pass it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	mtfail(t, err, "listen, %v", err)
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	mtfail(t, err, "listener file, %v", err)
+	// activatedListeners closes the fd it's given, so give it one of its own
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	mtfail(t, err, "dup, %v", err)
+	env := map[string]string{"LISTEN_PID": "123", "LISTEN_FDS": "1"}
+	getenv := func(name string) string { return env[name] }
+	lns, err := activatedListeners(getenv, 456, fd)
+	if err != nil || lns != nil {
+		t.Errorf("another process's sockets taken, %v %v", lns, err)
+	}
+	lns, err = activatedListeners(getenv, 123, fd)
+	mtfail(t, err, "activated listeners, %v", err)
+	defer closeListeners(lns)
+	if len(lns) != 1 || lns[0].Addr().String() != ln.Addr().String() {
+		t.Errorf("activated %v, wanted %s", lns, ln.Addr())
+	}
+}
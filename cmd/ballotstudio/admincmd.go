@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// `ballotstudio admin ...` manages users and invites in the configured
+// databases, with the usual database flags, while a server runs or not:
+//
+//	admin user list                 users with records here, a line of JSON each
+//	admin user promote {user}       make a user a staff admin; -email if they have no address on file
+//	admin user disable {user}       turn sign in off, as if the account were deleted but keeping everything
+//	admin user enable {user}        turn it back on
+//	admin invite create             a signup link good for -expires (default 24h)
+//
+// {user} is a user number, or a login name if the login database can look
+// one up. Changes take effect on running servers at the user's next request.
+
+// adminOptions are the admin command's flags
+type adminOptions struct {
+	Email   string
+	Expires time.Duration
+	BaseURL string // signup links start with this
+}
+
+// login databases that can look users up; the login library's sql one can
+type userGetter interface {
+	GetUser(guid int64) (*login.User, error)
+}
+type localUserGetter interface {
+	GetLocalUser(username string) (*login.User, error)
+}
+
+// signupBase is where invite links point: -base-url if it names a host,
+// otherwise the first -http port on localhost under -base-url's path
+func signupBase(listenAddr string, baseURL *url.URL) string {
+	base := fmt.Sprintf("http://localhost:%d", addrGetPort(strings.Split(listenAddr, ",")[0]))
+	if baseURL == nil {
+		return base
+	}
+	if baseURL.Host != "" {
+		return baseURL.Scheme + "://" + baseURL.Host + baseURL.Path
+	}
+	return base + baseURL.Path
+}
+
+// adminUser finds the user number of arg, a number or login name
+func adminUser(udb login.UserDB, arg string) (int64, error) {
+	if uid, err := strconv.ParseInt(arg, 10, 64); err == nil && uid > 0 {
+		return uid, nil
+	}
+	lug, ok := udb.(localUserGetter)
+	if !ok {
+		return 0, fmt.Errorf("%#v is not a user number, and the login database can't look up names", arg)
+	}
+	user, err := lug.GetLocalUser(arg)
+	if err != nil || user == nil {
+		return 0, fmt.Errorf("no user %#v, %v", arg, err)
+	}
+	return user.Guid, nil
+}
+
+func runAdminCommand(args []string, edb electionAppDB, udb login.UserDB, opts adminOptions, out io.Writer) error {
+	usage := fmt.Errorf("want admin user list|promote|disable|enable, or admin invite create")
+	if len(args) < 2 {
+		return usage
+	}
+	now := time.Now()
+	switch args[0] + " " + args[1] {
+	case "user list":
+		accounts, err := edb.ListAccounts()
+		if err != nil {
+			return err
+		}
+		ug, _ := udb.(userGetter)
+		enc := json.NewEncoder(out)
+		for _, as := range accounts {
+			if ug != nil {
+				if user, err := ug.GetUser(as.UserId); err == nil && user != nil {
+					as.Username = user.Username
+				}
+			}
+			err = enc.Encode(as)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "user promote", "user disable", "user enable":
+		if len(args) != 3 {
+			return fmt.Errorf("admin %s %s needs a user", args[0], args[1])
+		}
+		uid, err := adminUser(udb, args[2])
+		if err != nil {
+			return err
+		}
+		ar, err := edb.GetAccount(uid)
+		if err != nil {
+			return err
+		}
+		if ar == nil {
+			ar = &accountRecord{UserId: uid}
+		}
+		if args[1] == "promote" {
+			return promoteUser(edb, udb, ar, opts.Email, now, out)
+		}
+		if args[1] == "disable" {
+			ar.Disabled = now.Unix()
+		} else {
+			ar.Disabled = 0
+		}
+		err = edb.PutAccount(*ar)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "user %d %sd\n", uid, args[1])
+		return nil
+	case "invite create":
+		if opts.Expires <= 0 {
+			return fmt.Errorf("-expires must be positive")
+		}
+		token := randomInviteToken(2)
+		err := edb.MakeInviteToken(token, now.Add(opts.Expires))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s/signup/%s\n", opts.BaseURL, token)
+		return nil
+	}
+	return usage
+}
+
+// promoteUser makes ar's user a staff admin, keeping any staff record they
+// have. A new staff record is keyed by email, email or else the one on file.
+func promoteUser(edb electionAppDB, udb login.UserDB, ar *accountRecord, email string, now time.Time, out io.Writer) error {
+	uid := ar.UserId
+	sr, err := edb.StaffForUser(uid)
+	if err != nil {
+		return err
+	}
+	if sr == nil {
+		if email == "" {
+			email = ar.Email
+		}
+		if ug, ok := udb.(userGetter); ok && email == "" {
+			if user, err := ug.GetUser(uid); err == nil && user != nil {
+				email = user.Email
+			}
+		}
+		if email == "" {
+			return fmt.Errorf("user %d has no email address, give one with -email", uid)
+		}
+		sr, err = edb.GetStaff(email)
+		if err != nil {
+			return err
+		}
+		if sr != nil && sr.UserId != 0 && sr.UserId != uid {
+			return fmt.Errorf("%s is already staff for user %d", email, sr.UserId)
+		}
+		if sr == nil {
+			sr = &staffRecord{Email: email, Provisioned: now.Unix()}
+		}
+		sr.UserId = uid
+		sr.Invite = ""
+	}
+	sr.Role = StaffAdmin
+	err = edb.PutStaff(*sr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "user %d is an admin, as staff %s\n", uid, sr.Email)
+	return nil
+}
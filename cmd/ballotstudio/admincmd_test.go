@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestAdminCommand(t *testing.T) {
+	edb, db := testSqliteEDB(t)
+	udb := login.NewSqlUserDB(db)
+	err := udb.Setup()
+	mtfail(t, err, "udb setup, %v", err)
+	_, err = edb.PutElection(electionRecord{Owner: 7, Data: `{}`})
+	mtfail(t, err, "put election, %v", err)
+	alice, err := udb.PutNewUser(&login.User{Username: "alice", Email: "alice@example.com"})
+	mtfail(t, err, "new user, %v", err)
+	opts := adminOptions{Expires: time.Hour, BaseURL: "https://ballots.example.com"}
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runAdminCommand(args, edb, udb, opts, &out)
+		return out.String(), err
+	}
+
+	out, err := run("user", "list")
+	mtfail(t, err, "list, %v", err)
+	var as accountSummary
+	err = json.Unmarshal([]byte(out), &as)
+	if err != nil || as.UserId != 7 || as.Elections != 1 {
+		t.Errorf("list got %s", out)
+	}
+
+	sh := StudioHandler{edb: edb}
+	_, err = run("user", "disable", "7")
+	mtfail(t, err, "disable, %v", err)
+	if sh.liveUser(&login.User{Guid: 7}) != nil {
+		t.Errorf("disabled user still signed in")
+	}
+	_, err = run("user", "enable", "7")
+	mtfail(t, err, "enable, %v", err)
+	if sh.liveUser(&login.User{Guid: 7}) == nil {
+		t.Errorf("enabled user not signed in")
+	}
+
+	if _, err = run("user", "promote", "7"); err == nil {
+		t.Errorf("promoted a user with no email")
+	}
+	opts.Email = "seven@example.com"
+	_, err = run("user", "promote", "7")
+	mtfail(t, err, "promote, %v", err)
+	if admin, _ := sh.isAdmin(&login.User{Guid: 7}); !admin {
+		t.Errorf("promoted user not admin")
+	}
+	opts.Email = ""
+	_, err = run("user", "promote", "alice")
+	mtfail(t, err, "promote by name, %v", err)
+	if sr, _ := edb.StaffForUser(alice.Guid); sr == nil || sr.Email != "alice@example.com" || sr.Role != StaffAdmin {
+		t.Errorf("alice staff %#v", sr)
+	}
+
+	out, err = run("invite", "create")
+	mtfail(t, err, "invite, %v", err)
+	if !strings.HasPrefix(out, "https://ballots.example.com/signup/") {
+		t.Fatalf("invite %q", out)
+	}
+	ok, expires, err := edb.PeekInviteToken(strings.TrimSpace(strings.TrimPrefix(out, "https://ballots.example.com/signup/")))
+	if !ok || err != nil || time.Until(expires) > time.Hour {
+		t.Errorf("invite token ok=%v expires %v, %v", ok, expires, err)
+	}
+
+	if _, err = run("user", "frobnicate", "7"); err == nil {
+		t.Errorf("no error for unknown command")
+	}
+	prefix, _ := url.Parse("/ballots")
+	if got := signupBase(":8180,127.0.0.1:9000", prefix); got != "http://localhost:8180/ballots" {
+		t.Errorf("signup base %s", got)
+	}
+}
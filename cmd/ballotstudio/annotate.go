@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+// Reviewer annotations: pins on a rendered page with a comment, so feedback
+// points at a spot on the ballot rather than a path in the JSON.
+//
+//	GET /election/{id}/annotations              list
+//	POST /election/{id}/annotations             {"page":0,"x":0.5,"y":0.25,"comment":"..."}, any logged in user, @name emails them (notify.go)
+//	DELETE /election/{id}/annotations/{aid}     by its author or the election owner, returns the rest
+//	GET /election/{id}/review.pdf               the ballot with numbered pins and PDF sticky notes, then a page listing the comments
+//
+// x and y are fractions of the page from the top left, so they hold for any
+// rendering of the page (the PNGs, the PDF, an editor overlay).
+
+const maxAnnotationComment = 4000
+
+// pdftoppm's default resolution, pixels per inch of the page PNGs
+const pngDPI = 150
+
+// POST body
+type annotationJSON struct {
+	Page    int     `json:"page"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Comment string  `json:"comment"`
+}
+
+// GET|POST /election/{id}/annotations, DELETE /election/{id}/annotations/{aid}
+func (sh *StudioHandler) handleElectionAnnotations(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64, annotationid int64) {
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	if (annotationid != 0 || r.Method == "POST") && sh.checkElectionState(w, electionid, actionAnnotate) {
+		return
+	}
+	if annotationid != 0 {
+		if r.Method != "DELETE" {
+			texterr(w, http.StatusMethodNotAllowed, "DELETE only")
+			return
+		}
+		sh.deleteAnnotation(w, user, er, annotationid)
+		return
+	}
+	if r.Method == "POST" {
+		if user == nil {
+			texterr(w, http.StatusUnauthorized, "nope")
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 2*maxAnnotationComment+1000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		var aj annotationJSON
+		err = json.Unmarshal(body, &aj)
+		if maybeerr(w, err, 400, "bad annotation json") {
+			return
+		}
+		aj.Comment = strings.TrimSpace(aj.Comment)
+		if aj.Page < 0 || aj.X < 0 || aj.X > 1 || aj.Y < 0 || aj.Y > 1 {
+			texterr(w, 400, "page must be >= 0, x and y between 0 and 1")
+			return
+		}
+		if aj.Comment == "" || len(aj.Comment) > maxAnnotationComment {
+			texterr(w, 400, "comment must be 1 to %d bytes", maxAnnotationComment)
+			return
+		}
+		ar := annotationRecord{
+			ElectionId: electionid,
+			Page:       aj.Page,
+			X:          aj.X,
+			Y:          aj.Y,
+			Comment:    aj.Comment,
+			Author:     user.Guid,
+			AuthorName: sh.displayName(user),
+			Created:    time.Now().Unix(),
+		}
+		ar.Id, err = sh.edb.PutAnnotation(ar)
+		if maybeerr(w, err, 500, "db annotation put") {
+			return
+		}
+		sh.notifyMentions(r, ar)
+		writeJSON(w, ar)
+		return
+	}
+	annotations, err := sh.edb.AnnotationsForElection(electionid)
+	if maybeerr(w, err, 500, "db annotations") {
+		return
+	}
+	if annotations == nil {
+		annotations = []annotationRecord{}
+	}
+	writeJSON(w, annotations)
+}
+
+func (sh *StudioHandler) deleteAnnotation(w http.ResponseWriter, user *login.User, er *electionRecord, annotationid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	annotations, err := sh.edb.AnnotationsForElection(er.Id)
+	if maybeerr(w, err, 500, "db annotations") {
+		return
+	}
+	for _, ar := range annotations {
+		if ar.Id != annotationid {
+			continue
+		}
+		if ar.Author != user.Guid && er.Owner != user.Guid {
+			texterr(w, http.StatusForbidden, "nope")
+			return
+		}
+		err = sh.edb.DeleteAnnotation(er.Id, annotationid)
+		if maybeerr(w, err, 500, "db annotation delete") {
+			return
+		}
+		remaining := []annotationRecord{}
+		for _, other := range annotations {
+			if other.Id != annotationid {
+				remaining = append(remaining, other)
+			}
+		}
+		writeJSON(w, remaining)
+		return
+	}
+	texterr(w, 404, "no annotation %d", annotationid)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if maybeerr(w, err, 500, "json ret prep") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(out)
+}
+
+// GET /election/{id}/review.pdf
+func (sh *StudioHandler) handleElectionReviewPdf(w http.ResponseWriter, r *http.Request, electionid int64) {
+	ctx, note := withStaleNote(r.Context())
+	pngbytes, err := sh.getPng(ctx, strconv.FormatInt(electionid, 10), draw.RenderOptions{}, false)
+	if err != nil {
+		he := err.(*httpError)
+		maybeerr(w, he.err, he.code, he.msg)
+		return
+	}
+	annotations, err := sh.edb.AnnotationsForElection(electionid)
+	if maybeerr(w, err, 500, "db annotations") {
+		return
+	}
+	pdf, err := reviewPdf(electionid, pngbytes, annotations)
+	if maybeerr(w, err, 500, "review pdf") {
+		return
+	}
+	note.setHeader(w)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"election-%d-review.pdf\"", electionid))
+	w.WriteHeader(200)
+	w.Write(pdf)
+}
+
+// reviewPdf lays the page PNGs out as a PDF with a numbered pin and a Text
+// annotation for each comment, then lists all the comments on pages after.
+func reviewPdf(electionid int64, pngPages [][]byte, annotations []annotationRecord) ([]byte, error) {
+	var pw draw.PdfWriter
+	catalog := pw.Alloc()
+	pages := pw.Alloc()
+	font := pw.Alloc()
+	pw.Set(font, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	var kids []int
+	resources := func(extra string) string {
+		return fmt.Sprintf("<< /Font << /F1 %d 0 R >>%s >>", font, extra)
+	}
+
+	for pagei, pngb := range pngPages {
+		im, _, err := image.Decode(bytes.NewReader(pngb))
+		if err != nil {
+			return nil, fmt.Errorf("page %d png, %v", pagei, err)
+		}
+		var jb bytes.Buffer
+		err = jpeg.Encode(&jb, im, &jpeg.Options{Quality: 85})
+		if err != nil {
+			return nil, fmt.Errorf("page %d jpeg, %v", pagei, err)
+		}
+		bounds := im.Bounds()
+		pxw, pxh := bounds.Dx(), bounds.Dy()
+		width := float64(pxw) * 72 / pngDPI
+		height := float64(pxh) * 72 / pngDPI
+
+		colorspace := "/DeviceRGB"
+		if _, ok := im.(*image.Gray); ok {
+			// jpeg.Encode writes one channel for these
+			colorspace = "/DeviceGray"
+		}
+		imobj := pw.Stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode", pxw, pxh, colorspace), jb.Bytes())
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q\n", width, height)
+		var annots []string
+		for n, ar := range annotations {
+			if ar.Page != pagei {
+				continue
+			}
+			x := ar.X * width
+			y := height - ar.Y*height
+			pdfPin(&content, x, y, n+1)
+			annot := pw.Add(fmt.Sprintf("<< /Type /Annot /Subtype /Text /Rect [%.2f %.2f %.2f %.2f] /Contents %s /T %s /Name /Comment /C [1 0 0] /Open false >>",
+				x+10, y-10, x+30, y+10, pdfTextString(ar.Comment), pdfTextString(fmt.Sprintf("%d. %s", n+1, ar.AuthorName))))
+			annots = append(annots, fmt.Sprintf("%d 0 R", annot))
+		}
+		contentObj := pw.Stream("", content.Bytes())
+		page := pw.Add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources %s /Contents %d 0 R /Annots [%s] >>",
+			pages, width, height, resources(fmt.Sprintf(" /XObject << /Im0 %d 0 R >>", imobj)), contentObj, strings.Join(annots, " ")))
+		kids = append(kids, page)
+	}
+
+	// comment listing, US Letter
+	lines := []string{fmt.Sprintf("Review comments, election %d, %s", electionid, time.Now().UTC().Format("2006-01-02 15:04 MST")), ""}
+	if len(annotations) == 0 {
+		lines = append(lines, "No comments.")
+	}
+	for n, ar := range annotations {
+		where := fmt.Sprintf("page %d", ar.Page+1)
+		if ar.Page >= len(pngPages) {
+			where += " (no longer in the ballot)"
+		}
+		head := fmt.Sprintf("%d. %s, %s, %s:", n+1, where, ar.AuthorName, time.Unix(ar.Created, 0).UTC().Format("2006-01-02"))
+		lines = append(lines, head)
+		for _, line := range wrapText(ar.Comment, 90) {
+			lines = append(lines, "    "+line)
+		}
+		lines = append(lines, "")
+	}
+	const linesPerPage = 50
+	for len(lines) > 0 {
+		pagelines := lines
+		if len(pagelines) > linesPerPage {
+			pagelines = pagelines[:linesPerPage]
+		}
+		lines = lines[len(pagelines):]
+		var content bytes.Buffer
+		content.WriteString("BT /F1 10 Tf 14 TL 50 750 Td\n")
+		for _, line := range pagelines {
+			fmt.Fprintf(&content, "%s Tj T*\n", draw.PdfLatin1String(line))
+		}
+		content.WriteString("ET\n")
+		contentObj := pw.Stream("", content.Bytes())
+		page := pw.Add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 612 792] /Resources %s /Contents %d 0 R >>", pages, resources(""), contentObj))
+		kids = append(kids, page)
+	}
+
+	kidrefs := make([]string, len(kids))
+	for i, k := range kids {
+		kidrefs[i] = fmt.Sprintf("%d 0 R", k)
+	}
+	pw.Set(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kidrefs, " "), len(kids)))
+	pw.Set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	return pw.Bytes(catalog), nil
+}
+
+// pdfPin draws a red numbered circle centered on x,y
+func pdfPin(content *bytes.Buffer, x, y float64, n int) {
+	const r = 8
+	const k = r * 0.5523 // bezier control distance for a quarter circle
+	fmt.Fprintf(content, "q 0.85 0 0 rg %.2f %.2f m %.2f %.2f %.2f %.2f %.2f %.2f c %.2f %.2f %.2f %.2f %.2f %.2f c %.2f %.2f %.2f %.2f %.2f %.2f c %.2f %.2f %.2f %.2f %.2f %.2f c f\n",
+		x+r, y,
+		x+r, y+k, x+k, y+r, x, y+r,
+		x-k, y+r, x-r, y+k, x-r, y,
+		x-r, y-k, x-k, y-r, x, y-r,
+		x+k, y-r, x+r, y-k, x+r, y)
+	label := strconv.Itoa(n)
+	// Helvetica digits are 0.556 em wide
+	tw := float64(len(label)) * 0.556 * 9
+	fmt.Fprintf(content, "1 1 1 rg BT /F1 9 Tf %.2f %.2f Td (%s) Tj ET Q\n", x-tw/2, y-3.2, label)
+}
+
+// wrapText breaks s into lines of at most width bytes at spaces where it can
+func wrapText(s string, width int) (lines []string) {
+	for _, para := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			for len(word) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, word[:width])
+				word = word[width:]
+			}
+			if line == "" {
+				line = word
+			} else if len(line)+1+len(word) <= width {
+				line += " " + word
+			} else {
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+// pdfTextString is a PDF text string, UTF-16BE hex with a byte order mark
+func pdfTextString(s string) string {
+	var sb strings.Builder
+	sb.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&sb, "%04X", u)
+	}
+	sb.WriteString(">")
+	return sb.String()
+}
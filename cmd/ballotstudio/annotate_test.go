@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+var pdfXrefEntryRe = regexp.MustCompile(`(\d{10}) 00000 n `)
+
+func TestReviewPdf(t *testing.T) {
+	pages := [][]byte{testPng(t, 300, 400), testPng(t, 300, 400)}
+	annotations := []annotationRecord{
+		{Id: 1, Page: 0, X: 0.5, Y: 0.25, Comment: "name is misspelled (Smyth)", AuthorName: "ann"},
+		{Id: 2, Page: 1, X: 0.1, Y: 0.9, Comment: "déjà vu ✓", AuthorName: "bob"},
+		{Id: 3, Page: 5, X: 0.1, Y: 0.1, Comment: "old page", AuthorName: "bob"},
+	}
+	pdf, err := reviewPdf(12, pages, annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Errorf("not a pdf")
+	}
+	// two ballot pages and a comment page
+	if n := bytes.Count(pdf, []byte("/Type /Page /Parent")); n != 3 {
+		t.Errorf("%d pages, wanted 3", n)
+	}
+	if n := bytes.Count(pdf, []byte("/Subtype /Text")); n != 2 {
+		t.Errorf("%d text annotations, wanted 2", n)
+	}
+	// 300x400 px at 150 dpi
+	if !bytes.Contains(pdf, []byte("/MediaBox [0 0 144.00 192.00]")) {
+		t.Errorf("page size wrong")
+	}
+	if !bytes.Contains(pdf, []byte(`name is misspelled \(Smyth\)) Tj`)) || !bytes.Contains(pdf, []byte("no longer in the ballot")) {
+		t.Errorf("comment page missing comments")
+	}
+	for i, m := range pdfXrefEntryRe.FindAllSubmatch(pdf, -1) {
+		off, _ := strconv.Atoi(string(m[1]))
+		want := fmt.Sprintf("%d 0 obj", i+1)
+		if !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Errorf("xref %d points at %q", i+1, pdf[off:off+10])
+		}
+	}
+}
+
+func TestPdfStrings(t *testing.T) {
+	if got := pdfTextString("é"); got != "<FEFF00E9>" {
+		t.Errorf("text string got %s", got)
+	}
+	if got := draw.PdfLatin1String(`a(b)\é✓`); got != `(a\(b\)\\\351?)` {
+		t.Errorf("latin1 string got %s", got)
+	}
+	lines := wrapText("one two three "+strings.Repeat("x", 25), 10)
+	if strings.Join(lines, "|") != "one two|three|xxxxxxxxxx|xxxxxxxxxx|xxxxx" {
+		t.Errorf("wrap got %q", lines)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/brianolson/login/login"
+)
+
+// Risk-limiting audit helper for audit pilots, working from the stored scans as
+// cast vote records (CVRs).
+//
+// Initial sample size is the ballot-level comparison audit "super-simple" no-error
+// figure, n = ceil(-2 * gamma * ln(risk limit) / diluted margin), gamma = 1.03905,
+// where the diluted margin is (reported winner votes - reported runner-up votes) / ballots.
+// For VotesAllowed = k the margin is between the k-th and (k+1)-th selection.
+// The audit's sample size is the largest over the contests audited.
+//
+// Ballots are numbered 1..N in scan id order and drawn with replacement by
+// the SHA-256 consistent sampler: draw i is int(sha256(seed + "," + i)) mod N + 1,
+// so anyone with the seed and the ballot manifest can reproduce the sample.
+
+const auditGamma = 1.03905
+const defaultRiskLimit = 0.05
+
+type auditContest struct {
+	ContestId     string  `json:"id"`
+	Name          string  `json:"name"`
+	Winner        string  `json:"winner,omitempty"`
+	RunnerUp      string  `json:"runner_up,omitempty"`
+	WinnerVotes   int     `json:"winner_votes"`
+	RunnerUpVotes int     `json:"runner_up_votes"`
+	DilutedMargin float64 `json:"diluted_margin"`
+	SampleSize    int     `json:"sample_size"`
+	// FullHandCount if the margin is zero or there's nothing to compare
+	FullHandCount bool `json:"full_hand_count,omitempty"`
+}
+
+type auditDraw struct {
+	Draw     int   `json:"draw"`
+	Position int   `json:"position"` // 1..ballots
+	ScanId   int64 `json:"scan_id"`
+}
+
+type auditPlan struct {
+	ElectionId int64          `json:"itemid"`
+	RiskLimit  float64        `json:"risk_limit"`
+	Seed       string         `json:"seed"`
+	Ballots    int            `json:"ballots"`
+	Contests   []auditContest `json:"contests"`
+	SampleSize int            `json:"sample_size"`
+	Sample     []auditDraw    `json:"sample"`
+	// UniqueBallots is how many different ballots the sample pulls
+	UniqueBallots int `json:"unique_ballots"`
+}
+
+// reported totals, contest id -> selection id -> votes
+type reportedTotals map[string]map[string]int
+
+// auditSampleSize is the initial comparison audit sample size, 0 if margin is 0
+func auditSampleSize(riskLimit, dilutedMargin float64) int {
+	if dilutedMargin <= 0 {
+		return 0
+	}
+	return int(math.Ceil(-2 * auditGamma * math.Log(riskLimit) / dilutedMargin))
+}
+
+// auditContestPlan finds the winner/runner-up margin for one contest.
+// reported overrides the CVR tally if it has an entry for this contest.
+func auditContestPlan(ct contestTally, votesAllowed int, ballots int, riskLimit float64, reported map[string]int) auditContest {
+	ac := auditContest{ContestId: ct.ContestId, Name: ct.Name}
+	type sv struct {
+		id    string
+		name  string
+		votes int
+	}
+	var svs []sv
+	for _, st := range ct.Selections {
+		votes := st.Votes
+		if reported != nil {
+			votes = reported[st.SelectionId]
+		}
+		svs = append(svs, sv{st.SelectionId, st.Name, votes})
+	}
+	sort.SliceStable(svs, func(i, j int) bool { return svs[i].votes > svs[j].votes })
+	if len(svs) <= votesAllowed || ballots == 0 {
+		ac.FullHandCount = true
+		ac.SampleSize = ballots
+		return ac
+	}
+	w, l := svs[votesAllowed-1], svs[votesAllowed]
+	ac.Winner, ac.WinnerVotes = w.name, w.votes
+	ac.RunnerUp, ac.RunnerUpVotes = l.name, l.votes
+	ac.DilutedMargin = float64(w.votes-l.votes) / float64(ballots)
+	ac.SampleSize = auditSampleSize(riskLimit, ac.DilutedMargin)
+	if ac.SampleSize == 0 || ac.SampleSize > ballots {
+		ac.FullHandCount = ac.SampleSize == 0
+		ac.SampleSize = ballots
+	}
+	return ac
+}
+
+// auditSample draws n ballot positions in 1..ballots with the SHA-256 consistent sampler
+func auditSample(seed string, ballots, n int) []int {
+	out := make([]int, n)
+	bn := big.NewInt(int64(ballots))
+	for i := 1; i <= n; i++ {
+		sum := sha256.Sum256([]byte(seed + "," + strconv.Itoa(i)))
+		v := new(big.Int).SetBytes(sum[:])
+		v.Mod(v, bn)
+		out[i-1] = int(v.Int64()) + 1
+	}
+	return out
+}
+
+func randomAuditSeed() string {
+	// 20 decimal digits, as if from dice
+	v, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(20), nil))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%020s", v.String())
+}
+
+func (sh *StudioHandler) auditPlan(electionid int64, riskLimit float64, seed string, contestIds []string, reported reportedTotals) (*auditPlan, error) {
+	er, err := sh.edb.GetElection(electionid)
+	if err != nil {
+		return nil, &httpError{404, "no item", err}
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if err != nil {
+		return nil, &httpError{500, "bad election json", err}
+	}
+	ids, err := sh.edb.ScansForElection(electionid)
+	if err != nil {
+		return nil, &httpError{500, "db scans", err}
+	}
+	scanIds := make([]int64, 0, len(ids))
+	results := make([]map[string]map[string]bool, 0, len(ids))
+	for _, id := range ids {
+		sr, err := sh.edb.GetScan(id)
+		if err != nil {
+			return nil, &httpError{500, "db scan", err}
+		}
+		var result map[string]map[string]bool
+		if json.Unmarshal([]byte(sr.Result), &result) == nil {
+			scanIds = append(scanIds, id)
+			results = append(results, result)
+		}
+	}
+	tally := tallyResults(doc, results)
+	votesAllowed := make(map[string]int)
+	for _, el := range mapList(doc["Election"]) {
+		for _, co := range mapList(el["Contest"]) {
+			cid, _ := co["@id"].(string)
+			votesAllowed[cid] = 1
+			if va, ok := co["VotesAllowed"].(float64); ok && va >= 1 {
+				votesAllowed[cid] = int(va)
+			}
+		}
+	}
+	want := make(map[string]bool, len(contestIds))
+	for _, cid := range contestIds {
+		if _, ok := votesAllowed[cid]; !ok {
+			return nil, &httpError{400, "no contest " + cid, nil}
+		}
+		want[cid] = true
+	}
+	plan := &auditPlan{ElectionId: electionid, RiskLimit: riskLimit, Seed: seed, Ballots: len(results)}
+	for _, ct := range tally.Contests {
+		if len(want) != 0 && !want[ct.ContestId] {
+			continue
+		}
+		ac := auditContestPlan(ct, votesAllowed[ct.ContestId], len(results), riskLimit, reported[ct.ContestId])
+		plan.Contests = append(plan.Contests, ac)
+		if ac.SampleSize > plan.SampleSize {
+			plan.SampleSize = ac.SampleSize
+		}
+	}
+	unique := make(map[int]bool)
+	if plan.Ballots > 0 {
+		for i, pos := range auditSample(seed, plan.Ballots, plan.SampleSize) {
+			plan.Sample = append(plan.Sample, auditDraw{Draw: i + 1, Position: pos, ScanId: scanIds[pos-1]})
+			unique[pos] = true
+		}
+	}
+	plan.UniqueBallots = len(unique)
+	return plan, nil
+}
+
+// GET|POST /election/{id}/audit?risk=0.05&seed=...&contest=...
+// POST body {"contest id": {"selection id": votes}} gives reported totals instead of the scan tally.
+// Owner only, the sample points at individual scans.
+func (sh *StudioHandler) handleElectionAudit(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	query := r.URL.Query()
+	riskLimit := defaultRiskLimit
+	if rs := query.Get("risk"); rs != "" {
+		riskLimit, err = strconv.ParseFloat(rs, 64)
+		if err != nil || riskLimit <= 0 || riskLimit >= 1 {
+			texterr(w, 400, "risk wants a number between 0 and 1")
+			return
+		}
+	}
+	seed := query.Get("seed")
+	if seed == "" {
+		seed = randomAuditSeed()
+	}
+	var reported reportedTotals
+	if r.Method == "POST" {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, sh.maxDocBytes()))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		err = json.Unmarshal(body, &reported)
+		if maybeerr(w, err, 400, "bad reported totals json") {
+			return
+		}
+	}
+	plan, err := sh.auditPlan(electionid, riskLimit, seed, query["contest"], reported)
+	if err != nil {
+		he := err.(*httpError)
+		if he.err != nil {
+			maybeerr(w, he.err, he.code, he.msg)
+		} else {
+			texterr(w, he.code, "%s", he.msg)
+		}
+		return
+	}
+	out, err := json.Marshal(plan)
+	if maybeerr(w, err, 500, "json ret prep") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(out)
+}
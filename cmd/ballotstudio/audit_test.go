@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuditSample(t *testing.T) {
+	// same as sha256 of "seed,i" as an integer, mod 1000, + 1
+	got := auditSample("12345678901234567890", 1000, 5)
+	want := []int{426, 921, 929, 56, 438}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sample got %v want %v", got, want)
+	}
+	if s := randomAuditSeed(); len(s) != 20 {
+		t.Errorf("seed %q", s)
+	}
+}
+
+func TestAuditSampleSize(t *testing.T) {
+	if n := auditSampleSize(0.05, 0.1); n != 63 {
+		t.Errorf("sample size got %d want 63", n)
+	}
+	if n := auditSampleSize(0.05, 0); n != 0 {
+		t.Errorf("no margin sample size got %d", n)
+	}
+	ct := contestTally{ContestId: "c1", Selections: []selectionTally{{"s1", "A", 40}, {"s2", "B", 50}, {"s3", "C", 10}}}
+	ac := auditContestPlan(ct, 1, 100, 0.05, nil)
+	if ac.Winner != "B" || ac.RunnerUp != "A" || ac.DilutedMargin != 0.1 || ac.SampleSize != 63 {
+		t.Errorf("got %#v", ac)
+	}
+	ac = auditContestPlan(ct, 2, 100, 0.05, nil)
+	if ac.Winner != "A" || ac.RunnerUp != "C" || ac.SampleSize != 21 {
+		t.Errorf("vote for 2 got %#v", ac)
+	}
+	ac = auditContestPlan(ct, 1, 100, 0.05, map[string]int{"s1": 30, "s2": 30})
+	if !ac.FullHandCount || ac.SampleSize != 100 {
+		t.Errorf("tie got %#v", ac)
+	}
+}
@@ -0,0 +1,810 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// `ballotstudio backup -out f.tar.gz` and `ballotstudio restore -in f.tar.gz`,
+// with the usual database flags. The backup is a tar.gz of JSON and raw files,
+// so it can be restored into a different kind of database than it came from:
+//
+//	backup.json           backupManifest, always first
+//	elections/{id}.json   backupElection
+//	scans/{id}.image      uploaded image
+//	scans/{id}.json       backupScan
+//	staff.json            []staffRecord
+//	tables/{table}.json   backupTable, election database tables not saved through electionAppDB
+//	users/{table}.json    backupTable, every other table of the login database
+//	imarchive/...         files from -im-archive-dir
+//
+// Invite tokens are not saved, they expire in minutes anyway. Staff who
+// hadn't signed up get a new invite when their CSV row is uploaded again.
+
+const backupFormat = "ballotstudio-backup"
+
+// 2 added tables/; version 1 put those tables in users/ when the login database was the same
+const backupVersion = 2
+
+type backupManifest struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type backupElection struct {
+	Id    int64  `json:"id"`
+	Owner int64  `json:"owner"`
+	State string `json:"state"`
+	Data  string `json:"data"`
+	Meta  string `json:"meta"`
+
+	Trashed int64 `json:"trashed,omitempty"`
+
+	Annotations []annotationRecord `json:"annotations,omitempty"`
+	Tags        []string           `json:"tags,omitempty"`
+	Revisions   []backupRevision   `json:"revisions,omitempty"`
+}
+
+// backupRevision is one saved version of an election document
+type backupRevision struct {
+	Rev     int    `json:"rev"`
+	Created int64  `json:"created"`
+	Data    string `json:"data"`
+}
+
+// electionRevisionsWithData lists eid's revisions, oldest first, with their documents
+func electionRevisionsWithData(edb electionAppDB, eid int64) ([]backupRevision, error) {
+	revs, err := edb.ElectionRevisions(eid)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]backupRevision, 0, len(revs))
+	for _, rr := range revs {
+		full, err := edb.GetElectionRevision(eid, rr.Rev)
+		if err != nil {
+			return nil, err
+		}
+		if full == nil {
+			// pruned since the list
+			continue
+		}
+		out = append(out, backupRevision{rr.Rev, full.Created, full.Data})
+	}
+	return out, nil
+}
+
+// revisionRecords are revs as eid's, for RestoreRevisions
+func revisionRecords(eid int64, revs []backupRevision) []revisionRecord {
+	out := make([]revisionRecord, len(revs))
+	for i, br := range revs {
+		out[i] = revisionRecord{ElectionId: eid, Rev: br.Rev, Data: br.Data, Size: len(br.Data), Created: br.Created}
+	}
+	return out
+}
+
+type backupScan struct {
+	Id          int64       `json:"id"`
+	ElectionId  int64       `json:"election"`
+	Owner       int64       `json:"owner"`
+	ContentType string      `json:"content_type"`
+	Interpreter string      `json:"interpreter"`
+	Result      string      `json:"result"`
+	Created     int64       `json:"created"`
+	Custody     scanCustody `json:"custody"`
+	Rev         int         `json:"rev,omitempty"`
+}
+
+// backupTable is a generic dump of one table.
+// Values in Binary columns are base64, everything else is as the driver returned it.
+type backupTable struct {
+	Table   string          `json:"table"`
+	Columns []string        `json:"columns"`
+	Binary  []string        `json:"binary,omitempty"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// sqlTableDB is a database/sql connection and its driver name, for dumping
+// and loading tables generically: the login package's, and election
+// database tables that electionAppDB has no backup methods for.
+type sqlTableDB struct {
+	db     *sql.DB
+	driver string // sqlite3, postgres, mysql
+}
+
+// tables belonging to electionAppDB, backed up through it rather than as tables
+var electionTables = map[string]bool{
+	"elections":          true,
+	"metastate":          true,
+	"invites":            true,
+	"scans":              true,
+	"election_state":     true,
+	"annotations":        true,
+	"digest_schedules":   true,
+	"staff":              true,
+	"election_revisions": true,
+	"election_search":    true,
+	"election_tags":      true,
+	"notify_prefs":       true,
+	"schema_migrations":  true,
+}
+
+func (st sqlTableDB) quote(name string) string {
+	if st.driver == "mysql" {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (st sqlTableDB) param(i int) string {
+	if st.driver == "mysql" {
+		return "?"
+	}
+	return "$" + strconv.Itoa(i)
+}
+
+var createTableRe = regexp.MustCompile(`(?i)^CREATE TABLE (?:IF NOT EXISTS )?(\w+)`)
+
+// electionSchemaTables are the tables the election database migrations make
+func electionSchemaTables() map[string]bool {
+	out := make(map[string]bool)
+	for _, m := range sqliteMigrations {
+		for _, stmt := range m.Up {
+			if match := createTableRe.FindStringSubmatch(stmt); match != nil {
+				out[match[1]] = true
+			}
+		}
+	}
+	return out
+}
+
+// tables lists the database's tables, but not election_fts and its FTS5
+// shadow tables, which are rebuilt from election_search
+func (st sqlTableDB) tables() (names []string, err error) {
+	var query string
+	switch st.driver {
+	case "sqlite3":
+		query = `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`
+	case "postgres":
+		query = `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name`
+	case "mysql":
+		query = `SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE' ORDER BY table_name`
+	default:
+		return nil, fmt.Errorf("don't know how to list tables of %#v", st.driver)
+	}
+	rows, err := st.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("list tables, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("list tables row, %v", err)
+		}
+		if !strings.HasPrefix(name, "election_fts") {
+			names = append(names, name)
+		}
+	}
+	return names, rows.Err()
+}
+
+// electionDataTables lists election database tables that aren't electionAppDB's to back up
+func (st sqlTableDB) electionDataTables() (names []string, err error) {
+	all, err := st.tables()
+	if err != nil {
+		return nil, err
+	}
+	schema := electionSchemaTables()
+	for _, name := range all {
+		if schema[name] && !electionTables[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// userTables lists tables that aren't the election database's. With no
+// -login-db that is the same database, and these are the login package's.
+func (st sqlTableDB) userTables() (names []string, err error) {
+	all, err := st.tables()
+	if err != nil {
+		return nil, err
+	}
+	schema := electionSchemaTables()
+	for _, name := range all {
+		if !schema[name] && !electionTables[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func isBinaryColumnType(typeName string) bool {
+	typeName = strings.ToUpper(typeName)
+	return strings.Contains(typeName, "BLOB") || strings.Contains(typeName, "BYTEA") || strings.Contains(typeName, "BINARY")
+}
+
+// sqliteRowidAlias is true if table has an INTEGER PRIMARY KEY, which SELECT *
+// returns as the table's ROWID. Other sqlite tables are keyed by a ROWID that
+// SELECT * leaves out.
+func (st sqlTableDB) sqliteRowidAlias(table string) (bool, error) {
+	rows, err := st.db.Query("SELECT type, pk FROM pragma_table_info($1)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	pks := 0
+	integer := false
+	for rows.Next() {
+		var ctype string
+		var pk int
+		err = rows.Scan(&ctype, &pk)
+		if err != nil {
+			return false, err
+		}
+		if pk > 0 {
+			pks++
+			integer = strings.EqualFold(ctype, "INTEGER")
+		}
+	}
+	return pks == 1 && integer, rows.Err()
+}
+
+func (st sqlTableDB) dumpTable(name string) (bt backupTable, err error) {
+	query := "SELECT * FROM " + st.quote(name)
+	if st.driver == "sqlite3" {
+		alias, err := st.sqliteRowidAlias(name)
+		if err != nil {
+			return bt, fmt.Errorf("%s: table info, %v", name, err)
+		}
+		if !alias {
+			// webhook deliveries, print jobs and others refer to rows by ROWID
+			query = "SELECT rowid, * FROM " + st.quote(name)
+		}
+	}
+	rows, err := st.db.Query(query)
+	if err != nil {
+		err = fmt.Errorf("%s: select, %v", name, err)
+		return
+	}
+	defer rows.Close()
+	bt.Table = name
+	bt.Columns, err = rows.Columns()
+	if err != nil {
+		return
+	}
+	binary := make([]bool, len(bt.Columns))
+	if ctypes, err := rows.ColumnTypes(); err == nil {
+		for i, ct := range ctypes {
+			binary[i] = isBinaryColumnType(ct.DatabaseTypeName())
+		}
+	}
+	bt.Rows = [][]interface{}{}
+	for rows.Next() {
+		row := make([]interface{}, len(bt.Columns))
+		ptrs := make([]interface{}, len(row))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			err = fmt.Errorf("%s: row, %v", name, err)
+			return
+		}
+		bt.Rows = append(bt.Rows, row)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for ci := range bt.Columns {
+		for _, row := range bt.Rows {
+			// drivers that don't report column types hand back []byte for blobs
+			if b, ok := row[ci].([]byte); ok && !utf8.Valid(b) {
+				binary[ci] = true
+			}
+		}
+		if binary[ci] {
+			bt.Binary = append(bt.Binary, bt.Columns[ci])
+		}
+		for _, row := range bt.Rows {
+			b, ok := row[ci].([]byte)
+			if !ok {
+				continue
+			}
+			if binary[ci] {
+				row[ci] = base64.StdEncoding.EncodeToString(b)
+			} else {
+				row[ci] = string(b)
+			}
+		}
+	}
+	return bt, nil
+}
+
+func (st sqlTableDB) loadTable(bt backupTable) error {
+	binary := make(map[string]bool, len(bt.Binary))
+	for _, col := range bt.Binary {
+		binary[col] = true
+	}
+	cols := make([]string, len(bt.Columns))
+	params := make([]string, len(bt.Columns))
+	for i, col := range bt.Columns {
+		cols[i] = st.quote(col)
+		params[i] = st.param(i + 1)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", st.quote(bt.Table), strings.Join(cols, ", "), strings.Join(params, ", "))
+	for ri, row := range bt.Rows {
+		if len(row) != len(bt.Columns) {
+			return fmt.Errorf("%s row %d: %d values for %d columns", bt.Table, ri, len(row), len(bt.Columns))
+		}
+		args := make([]interface{}, len(row))
+		for i, v := range row {
+			switch x := v.(type) {
+			case json.Number:
+				if iv, err := x.Int64(); err == nil {
+					args[i] = iv
+				} else {
+					args[i], _ = x.Float64()
+				}
+			case string:
+				if binary[bt.Columns[i]] {
+					b, err := base64.StdEncoding.DecodeString(x)
+					if err != nil {
+						return fmt.Errorf("%s row %d %s: %v", bt.Table, ri, bt.Columns[i], err)
+					}
+					args[i] = b
+				} else {
+					args[i] = x
+				}
+			default:
+				args[i] = v
+			}
+		}
+		_, err := st.db.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("%s row %d: %v", bt.Table, ri, err)
+		}
+	}
+	if st.driver == "postgres" {
+		return st.pgResetSequences(bt.Table, bt.Columns)
+	}
+	return nil
+}
+
+// serial columns loaded with explicit values need their sequences moved past them
+func (st sqlTableDB) pgResetSequences(table string, columns []string) error {
+	for _, col := range columns {
+		var seq sql.NullString
+		err := st.db.QueryRow(`SELECT pg_get_serial_sequence($1, $2)`, table, col).Scan(&seq)
+		if err != nil {
+			return fmt.Errorf("%s.%s sequence, %v", table, col, err)
+		}
+		if !seq.Valid {
+			continue
+		}
+		_, err = st.db.Exec(fmt.Sprintf(`SELECT setval($1, (SELECT MAX(%s) FROM %s))`, st.quote(col), st.quote(table)), seq.String)
+		if err != nil {
+			return fmt.Errorf("%s.%s setval, %v", table, col, err)
+		}
+	}
+	return nil
+}
+
+func tarFile(tw *tar.Writer, name string, data []byte, mtime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func tarJSON(tw *tar.Writer, name string, v interface{}, mtime time.Time) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return tarFile(tw, name, b, mtime)
+}
+
+// writeBackup writes everything to out as tar.gz. elections is edb's
+// database, users the login database, which may be the same one or have a
+// nil db if user accounts aren't kept in sql; imdir may be "".
+func writeBackup(out io.Writer, edb electionAppDB, elections, users sqlTableDB, imdir string) (err error) {
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	now := time.Now().UTC()
+	err = tarJSON(tw, "backup.json", backupManifest{backupFormat, backupVersion, now}, now)
+	if err != nil {
+		return
+	}
+	eids, err := edb.ElectionIds()
+	if err != nil {
+		return
+	}
+	nscans := 0
+	for _, eid := range eids {
+		er, err := edb.GetElection(eid)
+		if err != nil {
+			return fmt.Errorf("election %d, %v", eid, err)
+		}
+		state, err := edb.GetElectionState(eid)
+		if err != nil {
+			return fmt.Errorf("election %d, %v", eid, err)
+		}
+		annotations, err := edb.AnnotationsForElection(eid)
+		if err != nil {
+			return fmt.Errorf("election %d annotations, %v", eid, err)
+		}
+		tags, err := edb.ElectionTags(eid)
+		if err != nil {
+			return fmt.Errorf("election %d tags, %v", eid, err)
+		}
+		revisions, err := electionRevisionsWithData(edb, eid)
+		if err != nil {
+			return fmt.Errorf("election %d revisions, %v", eid, err)
+		}
+		be := backupElection{er.Id, er.Owner, state, er.Data, er.Meta, er.Trashed, annotations, tags, revisions}
+		err = tarJSON(tw, fmt.Sprintf("elections/%d.json", eid), be, now)
+		if err != nil {
+			return err
+		}
+		sids, err := edb.ScansForElection(eid)
+		if err != nil {
+			return fmt.Errorf("election %d scans, %v", eid, err)
+		}
+		for _, sid := range sids {
+			sr, err := edb.GetScan(sid)
+			if err != nil {
+				return fmt.Errorf("scan %d, %v", sid, err)
+			}
+			mtime := time.Unix(sr.Created, 0)
+			err = tarFile(tw, fmt.Sprintf("scans/%d.image", sid), sr.Image, mtime)
+			if err != nil {
+				return err
+			}
+			bs := backupScan{sr.Id, sr.ElectionId, sr.Owner, sr.ContentType, sr.Interpreter, sr.Result, sr.Created, sr.Custody, sr.Rev}
+			err = tarJSON(tw, fmt.Sprintf("scans/%d.json", sid), bs, mtime)
+			if err != nil {
+				return err
+			}
+			nscans++
+		}
+	}
+	digests, err := edb.DigestSchedules()
+	if err != nil {
+		return err
+	}
+	err = tarJSON(tw, "digests.json", digests, now)
+	if err != nil {
+		return err
+	}
+	notifications, err := edb.AllNotifyPrefs()
+	if err != nil {
+		return err
+	}
+	err = tarJSON(tw, "notifications.json", notifications, now)
+	if err != nil {
+		return err
+	}
+	staff, err := edb.StaffList()
+	if err != nil {
+		return err
+	}
+	err = tarJSON(tw, "staff.json", staff, now)
+	if err != nil {
+		return err
+	}
+	etables, err := elections.electionDataTables()
+	if err != nil {
+		return fmt.Errorf("election tables, %v", err)
+	}
+	for _, table := range etables {
+		bt, err := elections.dumpTable(table)
+		if err != nil {
+			return fmt.Errorf("election tables, %v", err)
+		}
+		err = tarJSON(tw, "tables/"+table+".json", bt, now)
+		if err != nil {
+			return err
+		}
+	}
+	var tables []string
+	if users.db != nil {
+		tables, err = users.userTables()
+		if err != nil {
+			return fmt.Errorf("users, %v", err)
+		}
+		for _, table := range tables {
+			bt, err := users.dumpTable(table)
+			if err != nil {
+				return fmt.Errorf("users, %v", err)
+			}
+			err = tarJSON(tw, "users/"+table+".json", bt, now)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		log.Print("backup: login database is not sql, users not saved")
+	}
+	nimfiles := 0
+	if imdir != "" {
+		err = filepath.Walk(imdir, func(fpath string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(imdir, fpath)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				return err
+			}
+			nimfiles++
+			return tarFile(tw, "imarchive/"+filepath.ToSlash(rel), data, info.ModTime())
+		})
+		if err != nil {
+			return fmt.Errorf("image archive, %v", err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+	err = gz.Close()
+	if err != nil {
+		return
+	}
+	log.Printf("backup: %d elections, %d scans, election tables %v, user tables %v, %d image archive files", len(eids), nscans, etables, tables, nimfiles)
+	return nil
+}
+
+// readBackup restores into an empty election database, edb's, which is elections.
+// Login tables must already exist (udb.Setup()) and be empty.
+func readBackup(in io.Reader, edb electionAppDB, elections, users sqlTableDB, imdir string) (err error) {
+	eids, err := edb.ElectionIds()
+	if err != nil {
+		return
+	}
+	if len(eids) != 0 {
+		return fmt.Errorf("election database already has %d elections, restore wants an empty one", len(eids))
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return
+	}
+	tr := tar.NewReader(gz)
+	images := make(map[int64][]byte)
+	var nelections, nscans, nimfiles int
+	var etables, tables []string
+	schema := electionSchemaTables()
+	first := true
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		name := path.Clean(hdr.Name)
+		if first {
+			var bm backupManifest
+			json.Unmarshal(data, &bm)
+			if name != "backup.json" || bm.Format != backupFormat {
+				return fmt.Errorf("not a ballotstudio backup")
+			}
+			if bm.Version > backupVersion {
+				return fmt.Errorf("backup version %d is newer than this ballotstudio (%d)", bm.Version, backupVersion)
+			}
+			first = false
+			continue
+		}
+		dir, base := path.Split(name)
+		switch {
+		case dir == "elections/" && strings.HasSuffix(base, ".json"):
+			var be backupElection
+			err = json.Unmarshal(data, &be)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			err = edb.RestoreElection(electionRecord{Id: be.Id, Owner: be.Owner, Data: be.Data, Meta: be.Meta, Trashed: be.Trashed})
+			if err != nil {
+				return err
+			}
+			// backups from before revisions were saved start over at the current version
+			if len(be.Revisions) != 0 {
+				err = edb.RestoreRevisions(be.Id, revisionRecords(be.Id, be.Revisions))
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			if be.State != "" && be.State != StateDraft {
+				_, err = edb.SetElectionState(be.Id, StateDraft, be.State)
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			// annotation ids aren't linked to, new ones are fine
+			for _, ar := range be.Annotations {
+				ar.ElectionId = be.Id
+				_, err = edb.PutAnnotation(ar)
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			if len(be.Tags) != 0 {
+				err = edb.SetElectionTags(be.Id, be.Tags)
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			nelections++
+		case dir == "scans/" && strings.HasSuffix(base, ".image"):
+			sid, err := strconv.ParseInt(strings.TrimSuffix(base, ".image"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: bad scan id", name)
+			}
+			images[sid] = data
+		case dir == "scans/" && strings.HasSuffix(base, ".json"):
+			var bs backupScan
+			err = json.Unmarshal(data, &bs)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			sr := scanRecord{bs.Id, bs.ElectionId, bs.Owner, images[bs.Id], bs.ContentType, bs.Interpreter, bs.Result, bs.Created, bs.Custody, bs.Rev}
+			delete(images, bs.Id)
+			err = edb.RestoreScan(sr)
+			if err != nil {
+				return err
+			}
+			nscans++
+		case name == "digests.json":
+			var digests []digestSchedule
+			err = json.Unmarshal(data, &digests)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			for _, ds := range digests {
+				err = edb.PutDigestSchedule(ds)
+				if err != nil {
+					return err
+				}
+			}
+		case name == "notifications.json":
+			var notifications []notifyPrefs
+			err = json.Unmarshal(data, &notifications)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			for _, np := range notifications {
+				err = edb.PutNotifyPrefs(np)
+				if err != nil {
+					return err
+				}
+			}
+		case name == "staff.json":
+			var staff []staffRecord
+			err = json.Unmarshal(data, &staff)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			for _, sr := range staff {
+				err = edb.PutStaff(sr)
+				if err != nil {
+					return err
+				}
+			}
+		case (dir == "tables/" || dir == "users/") && strings.HasSuffix(base, ".json"):
+			var bt backupTable
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.UseNumber()
+			err = dec.Decode(&bt)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			// version 1 backups have election tables in users/
+			if dir == "tables/" || schema[bt.Table] {
+				err = elections.loadTable(bt)
+				if err != nil {
+					return fmt.Errorf("election tables, %v", err)
+				}
+				etables = append(etables, bt.Table)
+				continue
+			}
+			if users.db == nil {
+				log.Printf("restore: login database is not sql, skipping %s", name)
+				continue
+			}
+			err = users.loadTable(bt)
+			if err != nil {
+				return fmt.Errorf("users, %v", err)
+			}
+			tables = append(tables, bt.Table)
+		case strings.HasPrefix(name, "imarchive/"):
+			if imdir == "" {
+				continue
+			}
+			fpath := filepath.Join(imdir, filepath.FromSlash(strings.TrimPrefix(name, "imarchive/")))
+			err = os.MkdirAll(filepath.Dir(fpath), 0755)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(fpath, data, 0644)
+			if err != nil {
+				return err
+			}
+			nimfiles++
+		default:
+			log.Printf("restore: unknown file in backup %s", name)
+		}
+	}
+	if first {
+		return fmt.Errorf("empty backup")
+	}
+	log.Printf("restore: %d elections, %d scans, election tables %v, user tables %v, %d image archive files", nelections, nscans, etables, tables, nimfiles)
+	return nil
+}
+
+// runBackupCommand does `backup` or `restore` with fname, "-" for stdout/stdin
+func runBackupCommand(cmd, fname string, edb electionAppDB, elections, users sqlTableDB, imdir string) error {
+	if fname == "" {
+		return fmt.Errorf("%s needs a file name", cmd)
+	}
+	if cmd == "backup" {
+		if fname == "-" {
+			return writeBackup(os.Stdout, edb, elections, users, imdir)
+		}
+		fout, err := os.Create(fname)
+		if err != nil {
+			return err
+		}
+		err = writeBackup(fout, edb, elections, users, imdir)
+		if err != nil {
+			fout.Close()
+			return err
+		}
+		return fout.Close()
+	}
+	if fname == "-" {
+		return readBackup(os.Stdin, edb, elections, users, imdir)
+	}
+	fin, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	return readBackup(fin, edb, elections, users, imdir)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openBackupTestDB(t *testing.T) (*sql.DB, electionAppDB) {
+	edb, db := testSqliteEDB(t)
+	// stand in for the login package's tables
+	_, err := db.Exec(`CREATE TABLE users (guid INTEGER PRIMARY KEY, username TEXT, pwhash BLOB)`)
+	mtfail(t, err, "users table, %v", err)
+	return db, edb
+}
+
+func TestBackupRestore(t *testing.T) {
+	db, edb := openBackupTestDB(t)
+	er := electionRecord{Owner: 7, Data: `{"Election": []}`, Meta: `{"public_results":true}`}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: `{"Election": [{"Name": "first"}]}`})
+	mtfail(t, err, "put election, %v", err)
+	er.Id = eid
+	_, err = edb.PutElection(er)
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.SetElectionState(eid, StateDraft, StateProofing)
+	mtfail(t, err, "state, %v", err)
+	err = edb.SetElectionTags(eid, []string{"2024-general", "king county"})
+	mtfail(t, err, "tags, %v", err)
+	np := notifyPrefs{7, "bob", "bob@example.com", true, false, true}
+	err = edb.PutNotifyPrefs(np)
+	mtfail(t, err, "notify prefs, %v", err)
+	sr := scanRecord{ElectionId: eid, Owner: 7, Image: []byte{0xff, 0xd8, 0, 1}, ContentType: "image/jpeg", Interpreter: "v1", Result: `{"c1":{"s1":true}}`, Created: 1600000000,
+		Custody: scanCustody{"scanner-3", "pat", "12", "Ward 4"}}
+	sr.Id, err = edb.PutScan(sr)
+	mtfail(t, err, "put scan, %v", err)
+	_, err = db.Exec(`INSERT INTO users (guid, username, pwhash) VALUES ($1, $2, $3)`, 7, "bob", []byte{0, 0xfe, 3})
+	mtfail(t, err, "put user, %v", err)
+	// a deleted webhook first, so ids have to be kept for deliveries to find theirs
+	gone, err := edb.PutWebhook(webhookRecord{Owner: 7, URL: "https://example.com/gone", Events: []string{"save"}, Created: 1600000000})
+	mtfail(t, err, "put webhook, %v", err)
+	wh := webhookRecord{Owner: 7, ElectionId: eid, URL: "https://example.com/hook", Secret: "s3cret", Events: []string{"publish"}, Created: 1600000000}
+	wh.Id, err = edb.PutWebhook(wh)
+	mtfail(t, err, "put webhook, %v", err)
+	err = edb.DeleteWebhook(gone)
+	mtfail(t, err, "delete webhook, %v", err)
+	wd := webhookDelivery{WebhookId: wh.Id, Event: "publish", Payload: `{"event":"publish"}`, Status: "failed", Attempts: 3, LastError: "404 Not Found", Created: 1600000000}
+	wd.Id, err = edb.PutWebhookDelivery(wd)
+	mtfail(t, err, "put delivery, %v", err)
+
+	imdir := t.TempDir()
+	err = os.MkdirAll(filepath.Join(imdir, "sub"), 0755)
+	mtfail(t, err, "mkdir, %v", err)
+	err = ioutil.WriteFile(filepath.Join(imdir, "sub", "ima_1.cbor"), []byte("cbor"), 0644)
+	mtfail(t, err, "im file, %v", err)
+
+	var buf bytes.Buffer
+	err = writeBackup(&buf, edb, sqlTableDB{db, "sqlite3"}, sqlTableDB{db, "sqlite3"}, imdir)
+	mtfail(t, err, "backup, %v", err)
+	backup := buf.Bytes()
+
+	db2, edb2 := openBackupTestDB(t)
+	imdir2 := t.TempDir()
+	err = readBackup(bytes.NewReader(backup), edb2, sqlTableDB{db2, "sqlite3"}, sqlTableDB{db2, "sqlite3"}, imdir2)
+	mtfail(t, err, "restore, %v", err)
+
+	xe, err := edb2.GetElection(eid)
+	mtfail(t, err, "get restored election, %v", err)
+	if *xe != er {
+		t.Errorf("election got %#v want %#v", *xe, er)
+	}
+	revs, err := edb2.ElectionRevisions(eid)
+	mtfail(t, err, "restored revisions, %v", err)
+	if len(revs) != 2 || revs[1].Rev != 2 {
+		t.Errorf("revisions got %#v", revs)
+	}
+	rr, err := edb2.GetElectionRevision(eid, 1)
+	if err != nil || rr == nil || rr.Data != `{"Election": [{"Name": "first"}]}` {
+		t.Errorf("revision 1 got %#v %v", rr, err)
+	}
+	state, err := edb2.GetElectionState(eid)
+	mtfail(t, err, "restored state, %v", err)
+	if state != StateProofing {
+		t.Errorf("state got %s", state)
+	}
+	tags, err := edb2.ElectionTags(eid)
+	mtfail(t, err, "restored tags, %v", err)
+	if !reflect.DeepEqual(tags, []string{"2024-general", "king county"}) {
+		t.Errorf("tags got %v", tags)
+	}
+	xnp, err := edb2.GetNotifyPrefs(7)
+	mtfail(t, err, "restored notify prefs, %v", err)
+	if xnp == nil || *xnp != np {
+		t.Errorf("notify prefs got %#v", xnp)
+	}
+	xs, err := edb2.GetScan(sr.Id)
+	mtfail(t, err, "get restored scan, %v", err)
+	if !reflect.DeepEqual(*xs, sr) {
+		t.Errorf("scan got %#v want %#v", *xs, sr)
+	}
+	xwh, err := edb2.GetWebhook(wh.Id)
+	mtfail(t, err, "get restored webhook, %v", err)
+	if xwh == nil || !reflect.DeepEqual(*xwh, wh) {
+		t.Errorf("webhook got %#v want %#v", xwh, wh)
+	}
+	xwd, err := edb2.WebhookDeliveries(wh.Id, 10)
+	mtfail(t, err, "restored deliveries, %v", err)
+	if len(xwd) != 1 || xwd[0] != wd {
+		t.Errorf("deliveries got %#v want %#v", xwd, wd)
+	}
+	var username string
+	var pwhash []byte
+	err = db2.QueryRow(`SELECT username, pwhash FROM users WHERE guid = 7`).Scan(&username, &pwhash)
+	mtfail(t, err, "restored user, %v", err)
+	if username != "bob" || !bytes.Equal(pwhash, []byte{0, 0xfe, 3}) {
+		t.Errorf("user got %s %v", username, pwhash)
+	}
+	imb, err := ioutil.ReadFile(filepath.Join(imdir2, "sub", "ima_1.cbor"))
+	mtfail(t, err, "restored im file, %v", err)
+	if string(imb) != "cbor" {
+		t.Errorf("im file got %q", imb)
+	}
+	newid, err := edb2.PutElection(electionRecord{Owner: 7, Data: "{}"})
+	mtfail(t, err, "put after restore, %v", err)
+	if newid <= eid {
+		t.Errorf("new election id %d not after restored %d", newid, eid)
+	}
+
+	// only into an empty database
+	err = readBackup(bytes.NewReader(backup), edb2, sqlTableDB{db2, "sqlite3"}, sqlTableDB{db2, "sqlite3"}, "")
+	if err == nil {
+		t.Errorf("restore over existing elections should fail")
+	}
+}
+
+// with -login-db, election tables not saved through edb still come from the election database
+func TestBackupSeparateLoginDB(t *testing.T) {
+	open := func() (*sql.DB, electionAppDB, *sql.DB) {
+		edb, db := testSqliteEDB(t)
+		udb, err := sql.Open("sqlite3", ":memory:")
+		mtfail(t, err, "open sqlite mem, %v", err)
+		udb.SetMaxOpenConns(1)
+		t.Cleanup(func() { udb.Close() })
+		_, err = udb.Exec(`CREATE TABLE users (guid INTEGER PRIMARY KEY, username TEXT)`)
+		mtfail(t, err, "users table, %v", err)
+		return db, edb, udb
+	}
+	db, edb, udb := open()
+	_, err := edb.PutElection(electionRecord{Owner: 7, Data: `{}`})
+	mtfail(t, err, "put election, %v", err)
+	quota := quotaLimits{Elections: 3, ScanBytes: 1000, Revisions: 5}
+	err = edb.SetUserQuota(7, &quota)
+	mtfail(t, err, "quota, %v", err)
+	_, err = udb.Exec(`INSERT INTO users (guid, username) VALUES (7, 'bob')`)
+	mtfail(t, err, "put user, %v", err)
+
+	var buf bytes.Buffer
+	err = writeBackup(&buf, edb, sqlTableDB{db, "sqlite3"}, sqlTableDB{udb, "sqlite3"}, "")
+	mtfail(t, err, "backup, %v", err)
+
+	db2, edb2, udb2 := open()
+	err = readBackup(&buf, edb2, sqlTableDB{db2, "sqlite3"}, sqlTableDB{udb2, "sqlite3"}, "")
+	mtfail(t, err, "restore, %v", err)
+	xq, err := edb2.GetUserQuota(7)
+	mtfail(t, err, "restored quota, %v", err)
+	if xq == nil || *xq != quota {
+		t.Errorf("quota got %#v", xq)
+	}
+	var username string
+	err = udb2.QueryRow(`SELECT username FROM users WHERE guid = 7`).Scan(&username)
+	if err != nil || username != "bob" {
+		t.Errorf("restored user %q %v", username, err)
+	}
+	var n int
+	err = udb2.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'user_quotas'`).Scan(&n)
+	if err != nil || n != 0 {
+		t.Errorf("user_quotas made in the login database, %d %v", n, err)
+	}
+}
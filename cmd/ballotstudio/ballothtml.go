@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// GET /election/{id}.html is the ballot as a web page for voters using a
+// screen reader or other assistive technology, to review it before voting.
+// It's drawn from the same document as the PDF and readable by the same
+// people. Ballot styles are sections with headings, and each contest is a
+// fieldset whose legend is its title, so a screen reader announces the
+// contest and how many to vote for on entering it.
+// ?style={n} shows one ballot style, by its index in the bubbles JSON.
+func (sh *StudioHandler) handleElectionHTML(w http.ResponseWriter, r *http.Request, electionid int64) {
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if maybeerr(w, err, 500, "bad election json") {
+		return
+	}
+	bv := newBallotView(doc)
+	bv.PDFURL = sitePath(r, "/election/"+electionRef(r, electionid)+".pdf")
+	if v := r.URL.Query().Get("style"); v != "" {
+		style, err := strconv.Atoi(v)
+		if maybeerr(w, err, 400, "bad style %#v", v) {
+			return
+		}
+		if style < 0 || style >= len(bv.Styles) {
+			texterr(w, 404, "no ballot style %d, %d styles", style, len(bv.Styles))
+			return
+		}
+		if len(bv.Styles) > 1 {
+			bv.AllStylesURL = sitePath(r, "/election/"+electionRef(r, electionid)+".html")
+		}
+		bv.Styles = bv.Styles[style : style+1]
+	}
+	bt, err := sh.templates.Lookup("ballot.html")
+	if maybeerr(w, err, 500, "ballot.html: %v", err) {
+		return
+	}
+	var page bytes.Buffer
+	err = bt.Execute(&page, &bv)
+	if maybeerr(w, err, 500, "ballot.html: %v", err) {
+		return
+	}
+	writeArtifact(w, r, "text/html; charset=utf-8", page.Bytes(), sh.electionModified(strconv.FormatInt(electionid, 10)))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio"
+)
+
+func TestElectionHTML(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	templates, err := HtmlTemplateFS(ballotstudio.Templates, "gotemplates/*.html")
+	mtfail(t, err, "templates, %v", err)
+	sh := StudioHandler{edb: edb, templates: templates}
+
+	// a second style with just the measure, which gets its full text
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(overlayTestDoc), &doc)
+	mtfail(t, err, "doc, %v", err)
+	el := mapList(doc["Election"])[0]
+	mapList(el["Contest"])[1]["FullText"] = "Shall the city\nbuy a boat?"
+	el["BallotStyle"] = append(el["BallotStyle"].([]interface{}), map[string]interface{}{
+		"GpUnitIds":      []interface{}{"gpunit1"},
+		"OrderedContent": []interface{}{map[string]interface{}{"@type": "ElectionResults.OrderedContest", "ContestId": "bmc1"}},
+	})
+	data, _ := json.Marshal(doc)
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: string(data)})
+	mtfail(t, err, "put election, %v", err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sh.handleElectionHTML(rec, httptest.NewRequest("GET", path, nil), eid)
+		return rec
+	}
+	rec := get("/election/1.html")
+	page := rec.Body.String()
+	if rec.Code != 200 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("html %d %s", rec.Code, page)
+	}
+	for _, want := range []string{
+		`<html lang="en">`,
+		`<fieldset aria-describedby="style-0-ccont1-about">`,
+		`<legend><h3>Mayor</h3></legend>`,
+		`id="style-0-ccont1-about">Vote for one</p>`,
+		`<span class="visually-hidden">Party: </span>Anklebiter Assembly`,
+		`<p>buy a boat?</p>`,
+		`href="?style=1"`,
+		`href="/election/1.pdf"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Count(page, "<fieldset") != 3 {
+		t.Errorf("%d fieldsets", strings.Count(page, "<fieldset"))
+	}
+
+	rec = get("/election/1.html?style=1")
+	page = rec.Body.String()
+	if rec.Code != 200 || strings.Count(page, "<fieldset") != 1 || !strings.Contains(page, "Show all ballot styles") {
+		t.Errorf("one style %d %s", rec.Code, page)
+	}
+	if rec := get("/election/1.html?style=2"); rec.Code != 404 {
+		t.Errorf("no style %d", rec.Code)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Mounting under a path prefix, e.g. https://example.gov/ballotstudio/ behind
+// a reverse proxy. -base-url sets the prefix, and the scheme and host of
+// absolute links if it has them. Without it, a trusted proxy can send the
+// prefix per request as X-Forwarded-Prefix. The proxy may strip the prefix or
+// pass it through; requests that still have it are routed as if it weren't
+// there. Links the server generates all start with the prefix.
+//
+// Media references saved inside election documents stay root relative, so a
+// document means the same thing wherever the server is mounted.
+
+type siteBaseKey struct{}
+
+type siteBase struct {
+	prefix string // "" or "/ballotstudio", no trailing slash
+	origin string // "https://example.gov" from -base-url, or "" to use the request's
+}
+
+// parseBaseURL parses -base-url, "/prefix" or "https://host/prefix". "" is nil.
+func parseBaseURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.RawQuery != "" || u.Fragment != "" || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") || (u.Scheme == "") != (u.Host == "") {
+		return nil, fmt.Errorf("bad base url %q, want /prefix or https://host/prefix", s)
+	}
+	if u.Path != "" && !strings.HasPrefix(u.Path, "/") {
+		return nil, fmt.Errorf("bad base url %q, want /prefix or https://host/prefix", s)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	return u, nil
+}
+
+// cleanPrefix makes an X-Forwarded-Prefix into "" or "/something"
+func cleanPrefix(prefix string) string {
+	prefix = strings.TrimRight(strings.TrimSpace(prefix), "/")
+	if prefix == "" || !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "\"'<>?# ") {
+		return ""
+	}
+	return prefix
+}
+
+// baseURLHandler strips the prefix from incoming paths and notes it for links
+type baseURLHandler struct {
+	sub  http.Handler
+	base *url.URL // -base-url, may be nil
+}
+
+func (bh *baseURLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var sb siteBase
+	if bh.base != nil {
+		sb.prefix = bh.base.Path
+		if bh.base.Host != "" {
+			sb.origin = bh.base.Scheme + "://" + bh.base.Host
+		}
+	} else if prefix, ok := r.Context().Value(forwardedPrefixKey{}).(string); ok {
+		sb.prefix = cleanPrefix(prefix)
+	}
+	if sb == (siteBase{}) {
+		bh.sub.ServeHTTP(w, r)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), siteBaseKey{}, sb))
+	if sb.prefix != "" && strings.HasPrefix(r.URL.Path, sb.prefix) {
+		rest := r.URL.Path[len(sb.prefix):]
+		if rest == "" || rest[0] == '/' {
+			if rest == "" {
+				rest = "/"
+			}
+			u := *r.URL
+			u.Path = rest
+			u.RawPath = ""
+			r.URL = &u
+		}
+	}
+	bh.sub.ServeHTTP(w, r)
+}
+
+// basePath is the prefix the server is mounted under, "" at the root
+func basePath(r *http.Request) string {
+	sb, _ := r.Context().Value(siteBaseKey{}).(siteBase)
+	return sb.prefix
+}
+
+// sitePath is a root relative link to path on this server
+func sitePath(r *http.Request, path string) string {
+	return basePath(r) + path
+}
+
+// serverURL is path on the server r came to, for links that leave the site in email or chat
+func serverURL(r *http.Request, path string) string {
+	sb, _ := r.Context().Value(siteBaseKey{}).(siteBase)
+	if sb.origin != "" {
+		return sb.origin + sb.prefix + path
+	}
+	return requestScheme(r) + "://" + r.Host + sb.prefix + path
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBaseURL(t *testing.T) {
+	for _, bad := range []string{"ballotstudio", "ftp://host/x", "https:///x", "/x?y=1"} {
+		if _, err := parseBaseURL(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+
+	var path string
+	var ec EditContext
+	var link string
+	sub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		ec = EditContext{}
+		ec.set(r, 3)
+		link = serverURL(r, "/share/x.pdf")
+	})
+	get := func(h http.Handler, target string, header map[string]string) {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "127.0.0.1:5000"
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	base, err := parseBaseURL("https://example.gov/ballotstudio/")
+	mtfail(t, err, "parse, %v", err)
+	h := &baseURLHandler{sub, base}
+	// the proxy passed the prefix through, or stripped it
+	for _, target := range []string{"http://10.0.0.2/ballotstudio/edit/3", "http://10.0.0.2/edit/3"} {
+		get(h, target, nil)
+		if path != "/edit/3" || ec.PDFURL != "/ballotstudio/election/3.pdf" || ec.StaticRoot != "/ballotstudio/static" || link != "https://example.gov/ballotstudio/share/x.pdf" {
+			t.Errorf("%s: path %q pdf %q static %q link %q", target, path, ec.PDFURL, ec.StaticRoot, link)
+		}
+	}
+	get(h, "http://10.0.0.2/ballotstudiox", nil)
+	if path != "/ballotstudiox" {
+		t.Errorf("stripped from %q", path)
+	}
+
+	// per request from a trusted proxy
+	proxies, _ := parseTrustedProxies("127.0.0.1")
+	h2 := &trustedProxyHandler{&baseURLHandler{sub, nil}, proxies}
+	get(h2, "http://ballots.example.com/bs/edit/3", map[string]string{"X-Forwarded-Prefix": "/bs/", "X-Forwarded-Proto": "https"})
+	if path != "/edit/3" || ec.EditURL != "/bs/edit/3" || link != "https://ballots.example.com/bs/share/x.pdf" {
+		t.Errorf("forwarded: path %q edit %q link %q", path, ec.EditURL, link)
+	}
+	get(&baseURLHandler{sub, nil}, "http://ballots.example.com/edit/3", map[string]string{"X-Forwarded-Prefix": "/bs"})
+	if ec.EditURL != "/edit/3" {
+		t.Errorf("untrusted prefix used, %q", ec.EditURL)
+	}
+
+	rec := httptest.NewRecorder()
+	(&baseURLHandler{http.HandlerFunc(handleOpenAPI), base}).ServeHTTP(rec, httptest.NewRequest("GET", "/ballotstudio/openapi.json", nil))
+	var doc struct {
+		Servers []struct{ URL string } `json:"servers"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &doc)
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != "/ballotstudio" {
+		t.Errorf("openapi servers %v", doc.Servers)
+	}
+}
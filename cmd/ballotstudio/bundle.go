@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+// Single election bundles, for auditors or moving one election between servers.
+// GET /election/{id}/export is a zip:
+//
+//	bundle.json        bundleManifest, with the SHA-256 of every other file
+//	election.json      the election document
+//	revisions/{rev}.json backupRevision, each saved version of the document, oldest first
+//	ballot.pdf         rendered ballot, if the draw server could render it
+//	bubbles.json       bubble positions for ballot.pdf
+//	scans/{id}.json    backupScan
+//	scans/{id}.{ext}   uploaded scan image
+//	media/{mediaid}    candidate photos, party symbols and fonts the document refers to
+//
+// POST /election/import takes that zip and makes a new draft election owned by the uploader.
+
+const bundleFormat = "ballotstudio-election-bundle"
+const bundleVersion = 1
+
+// largest bundle accepted by /election/import
+const MaxImportBundleBytes = 100000000
+
+type bundleManifest struct {
+	Format      string    `json:"format"`
+	Version     int       `json:"version"`
+	Exported    time.Time `json:"exported"`
+	ElectionId  int64     `json:"itemid"`
+	State       string    `json:"state"`
+	Scans       int       `json:"scans"`
+	Revisions   int       `json:"revisions"`
+	Media       int       `json:"media"`
+	RenderError string    `json:"render_error,omitempty"`
+
+	// hex SHA-256 of each file in the bundle by name, bundle.json aside
+	Files map[string]string `json:"sha256,omitempty"`
+}
+
+// bundleFile is one file of the zip after bundle.json
+type bundleFile struct {
+	name  string
+	data  []byte
+	mtime time.Time
+}
+
+// unanchored mediaRefRe
+var mediaRefAnyRe = regexp.MustCompile(`/election/\d+/media/([0-9a-f]{64}\.(?:png|jpg|gif|ttf))`)
+
+func scanImageExt(contentType string) string {
+	if ext, ok := mediaTypes[contentType]; ok {
+		return ext
+	}
+	if contentType == "application/pdf" {
+		return "pdf"
+	}
+	return "bin"
+}
+
+func zipFile(zw *zip.Writer, name string, data []byte, mtime time.Time) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mtime})
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+func zipJSON(zw *zip.Writer, name string, v interface{}, mtime time.Time) error {
+	b, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return zipFile(zw, name, b, mtime)
+}
+
+// bundleFiles gathers the manifest and files of the election's bundle
+func (sh *StudioHandler) bundleFiles(ctx context.Context, er *electionRecord) (bm bundleManifest, files []bundleFile, err error) {
+	edb := sh.edb.WithContext(ctx)
+	now := time.Now().UTC()
+	bm = bundleManifest{Format: bundleFormat, Version: bundleVersion, Exported: now, ElectionId: er.Id}
+	bm.State, err = edb.GetElectionState(er.Id)
+	if err != nil {
+		return
+	}
+	sids, err := edb.ScansForElection(er.Id)
+	if err != nil {
+		return
+	}
+	bm.Scans = len(sids)
+	mediaids := make(map[string]bool)
+	for _, m := range mediaRefAnyRe.FindAllStringSubmatch(er.Data, -1) {
+		mediaids[m[1]] = true
+	}
+	bm.Media = len(mediaids)
+	ctx, note := withStaleNote(ctx)
+	bothob, rerr := sh.getPdf(ctx, strconv.FormatInt(er.Id, 10), draw.RenderOptions{}, false)
+	if rerr != nil {
+		bm.RenderError = rerr.(*httpError).msg
+		bothob = nil
+	} else {
+		defer bothob.Release()
+		if note.stale {
+			bm.RenderError = "draw backend unavailable, ballot.pdf is an older render"
+		}
+	}
+
+	files = append(files, bundleFile{"election.json", []byte(er.Data), now})
+	revisions, err := electionRevisionsWithData(edb, er.Id)
+	if err != nil {
+		return bm, nil, fmt.Errorf("revisions, %v", err)
+	}
+	bm.Revisions = len(revisions)
+	for _, br := range revisions {
+		brjson, err := json.MarshalIndent(br, "", " ")
+		if err != nil {
+			return bm, nil, fmt.Errorf("revision %d, %v", br.Rev, err)
+		}
+		files = append(files, bundleFile{fmt.Sprintf("revisions/%d.json", br.Rev), brjson, time.Unix(br.Created, 0)})
+	}
+	if bothob != nil {
+		pdf, err := bothob.PdfBytes()
+		if err != nil {
+			return bm, nil, fmt.Errorf("ballot.pdf, %v", err)
+		}
+		files = append(files, bundleFile{"ballot.pdf", pdf, now}, bundleFile{"bubbles.json", bothob.BubblesJson, now})
+	}
+	for _, sid := range sids {
+		sr, err := edb.GetScan(sid)
+		if err != nil {
+			return bm, nil, fmt.Errorf("scan %d, %v", sid, err)
+		}
+		mtime := time.Unix(sr.Created, 0)
+		bs := backupScan{sr.Id, sr.ElectionId, sr.Owner, sr.ContentType, sr.Interpreter, sr.Result, sr.Created, sr.Custody, sr.Rev}
+		bsjson, err := json.MarshalIndent(bs, "", " ")
+		if err != nil {
+			return bm, nil, fmt.Errorf("scan %d, %v", sid, err)
+		}
+		files = append(files,
+			bundleFile{fmt.Sprintf("scans/%d.json", sid), bsjson, mtime},
+			bundleFile{fmt.Sprintf("scans/%d.%s", sid, scanImageExt(sr.ContentType)), sr.Image, mtime})
+	}
+	ids := make([]string, 0, len(mediaids))
+	for mediaid := range mediaids {
+		ids = append(ids, mediaid)
+	}
+	sort.Strings(ids)
+	for _, mediaid := range ids {
+		mdata, _, err := sh.media.GetMedia(mediaid)
+		if err != nil {
+			// the document refers to it but it's gone; the bundle is still useful
+			continue
+		}
+		files = append(files, bundleFile{"media/" + mediaid, mdata, now})
+	}
+	bm.Files = make(map[string]string, len(files))
+	for _, bf := range files {
+		bm.Files[bf.name] = sha256Hex(bf.data)
+	}
+	return bm, files, nil
+}
+
+// writeBundle writes the election's bundle zip to out
+func (sh *StudioHandler) writeBundle(ctx context.Context, out io.Writer, er *electionRecord) error {
+	bm, files, err := sh.bundleFiles(ctx, er)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(out)
+	err = zipJSON(zw, "bundle.json", bm, bm.Exported)
+	if err != nil {
+		return err
+	}
+	for _, bf := range files {
+		err = zipFile(zw, bf.name, bf.data, bf.mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// GET /election/{id}/export, owner only
+func (sh *StudioHandler) handleElectionExport(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	edb := sh.edb.WithContext(r.Context())
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	var buf bytes.Buffer
+	err = sh.writeBundle(r.Context(), &buf, er)
+	if maybeerr(w, err, 500, "export") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"election-%d.zip\"", electionid))
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+// importBundle makes a new election for user from a bundle zip, returning its id
+func (sh *StudioHandler) importBundle(zipBytes []byte, user *login.User) (newid int64, err error) {
+	owner := user.Guid
+	zr, err := zip.NewReader(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+	if err != nil {
+		return 0, &httpError{400, "not a zip", err}
+	}
+	files := make(map[string][]byte, len(zr.File))
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		fr, err := zf.Open()
+		if err != nil {
+			return 0, &httpError{400, "bad zip", err}
+		}
+		fdata, err := ioutil.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			return 0, &httpError{400, "bad zip", err}
+		}
+		files[path.Clean(zf.Name)] = fdata
+	}
+	var bm bundleManifest
+	json.Unmarshal(files["bundle.json"], &bm)
+	if bm.Format != bundleFormat {
+		return 0, &httpError{400, "not an election bundle", nil}
+	}
+	if bm.Version > bundleVersion {
+		return 0, &httpError{400, fmt.Sprintf("bundle version %d is newer than this server (%d)", bm.Version, bundleVersion), nil}
+	}
+	var ob map[string]interface{}
+	err = json.Unmarshal(files["election.json"], &ob)
+	if err != nil {
+		return 0, &httpError{400, "bad election.json", err}
+	}
+	ob = data.Fixup(ob)
+	problems := data.CheckBubbleGeometry(ob)
+	if len(problems) != 0 {
+		return 0, &httpError{400, "bad BubbleGeometry\n" + strings.Join(problems, "\n"), nil}
+	}
+	for name, mdata := range files {
+		if !strings.HasPrefix(name, "media/") {
+			continue
+		}
+		var contentType string
+		if strings.HasSuffix(name, ".ttf") {
+			_, contentType, err = checkFont(mdata)
+		} else {
+			contentType, _, _, err = checkMedia(mdata)
+		}
+		if err != nil {
+			return 0, &httpError{400, name, err}
+		}
+		if mediaId(mdata, contentType) != strings.TrimPrefix(name, "media/") {
+			return 0, &httpError{400, name + " content does not match name", nil}
+		}
+		_, err = sh.media.PutMedia(mdata, contentType)
+		if err != nil {
+			return 0, &httpError{500, "media put", err}
+		}
+	}
+	var scanBytes int64
+	for name, fdata := range files {
+		if strings.HasPrefix(name, "scans/") && !strings.HasSuffix(name, ".json") {
+			scanBytes += int64(len(fdata))
+		}
+	}
+	err = sh.checkQuota(user, 1, scanBytes)
+	if qe, ok := err.(*quotaError); ok {
+		return 0, qe
+	} else if err != nil {
+		return 0, &httpError{500, "quota", err}
+	}
+	doc, err := json.Marshal(ob)
+	if err != nil {
+		return 0, &httpError{500, "re-json", err}
+	}
+	newid, err = sh.edb.PutElection(electionRecord{Owner: owner, Data: string(doc)})
+	if err != nil {
+		return 0, &httpError{500, "db put fail", err}
+	}
+	// point media references at the new election
+	mediaPrefix := fmt.Sprintf("/election/%d/media/$1", newid)
+	rewritten := mediaRefAnyRe.ReplaceAllString(string(doc), mediaPrefix)
+	var revisions []backupRevision
+	for name, fdata := range files {
+		if !strings.HasPrefix(name, "revisions/") {
+			continue
+		}
+		var br backupRevision
+		err = json.Unmarshal(fdata, &br)
+		if err != nil {
+			return newid, &httpError{400, name, err}
+		}
+		br.Data = mediaRefAnyRe.ReplaceAllString(br.Data, mediaPrefix)
+		revisions = append(revisions, br)
+	}
+	if len(revisions) != 0 {
+		sort.Slice(revisions, func(i, j int) bool { return revisions[i].Rev < revisions[j].Rev })
+		err = sh.edb.RestoreRevisions(newid, revisionRecords(newid, revisions))
+		if err != nil {
+			return newid, &httpError{500, "db revisions", err}
+		}
+	}
+	if rewritten != string(doc) || len(revisions) != 0 {
+		// a new revision after the imported ones, unless the document is the same as the last
+		_, err = sh.edb.PutElection(electionRecord{Id: newid, Owner: owner, Data: rewritten})
+		if err != nil {
+			return newid, &httpError{500, "db put fail", err}
+		}
+	}
+	var scanNames []string
+	for name := range files {
+		if strings.HasPrefix(name, "scans/") && strings.HasSuffix(name, ".json") {
+			scanNames = append(scanNames, name)
+		}
+	}
+	sort.Strings(scanNames)
+	for _, name := range scanNames {
+		var bs backupScan
+		err = json.Unmarshal(files[name], &bs)
+		if err != nil {
+			return newid, &httpError{400, name, err}
+		}
+		image := files[fmt.Sprintf("scans/%d.%s", bs.Id, scanImageExt(bs.ContentType))]
+		sr := scanRecord{ElectionId: newid, Owner: owner, Image: image, ContentType: bs.ContentType, Interpreter: bs.Interpreter, Result: bs.Result, Created: bs.Created, Custody: bs.Custody}
+		if len(revisions) != 0 {
+			// revisions keep their numbers
+			sr.Rev = bs.Rev
+		}
+		_, err = sh.edb.PutScan(sr)
+		if err != nil {
+			return newid, &httpError{500, "db scan put", err}
+		}
+	}
+	// after the scans, which keep the revisions they were read against
+	sh.pruneRevisions(user, newid)
+	return newid, nil
+}
+
+// POST /election/import, bundle zip body
+func (sh *StudioHandler) handleElectionImport(w http.ResponseWriter, r *http.Request, user *login.User) {
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxImportBundleBytes))
+	if err != nil {
+		texterr(w, http.StatusRequestEntityTooLarge, "bundle too large or broken, limit %d bytes", MaxImportBundleBytes)
+		return
+	}
+	newid, err := sh.importBundle(body, user)
+	if qe, ok := err.(*quotaError); ok {
+		qe.write(w)
+		return
+	}
+	if err != nil {
+		he := err.(*httpError)
+		if he.err != nil {
+			maybeerr(w, he.err, he.code, he.msg)
+		} else {
+			texterr(w, he.code, "%s", he.msg)
+		}
+		return
+	}
+	editContextFinish(w, r, newid, nil)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestBundleExportImport(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}}
+
+	photo := testPng(t, 3, 3)
+	mid, err := sh.media.PutMedia(photo, "image/png")
+	mtfail(t, err, "put media, %v", err)
+	doc := `{"Election": [{"Candidate": [{"@id": "c1", "PhotoUri": "/election/1/media/` + mid + `"}]}]}`
+	first := `{"Election": [{"Name": "first draft"}]}`
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: first})
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.PutScan(scanRecord{ElectionId: eid, Owner: 7, Image: []byte("jpegbytes"), ContentType: "image/jpeg", Result: `{}`, Created: 1600000000})
+	mtfail(t, err, "put scan, %v", err)
+	sh.cache.Put(renderKey(strconv.FormatInt(eid, 10), doc, draw.RenderOptions{}), &draw.DrawBothOb{Pdf: []byte("%PDF"), BubblesJson: []byte(`{"bubbles":[]}`)}, 100)
+
+	er, err := edb.GetElection(eid)
+	mtfail(t, err, "get election, %v", err)
+	var buf bytes.Buffer
+	err = sh.writeBundle(context.Background(), &buf, er)
+	mtfail(t, err, "export, %v", err)
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	mtfail(t, err, "export zip, %v", err)
+	names := make(map[string]bool)
+	for _, zf := range zr.File {
+		names[zf.Name] = true
+	}
+	for _, want := range []string{"bundle.json", "election.json", "ballot.pdf", "bubbles.json", "scans/1.json", "scans/1.jpg", "media/" + mid, "revisions/1.json", "revisions/2.json"} {
+		if !names[want] {
+			t.Errorf("export missing %s, has %v", want, names)
+		}
+	}
+
+	newid, err := sh.importBundle(buf.Bytes(), &login.User{Guid: 9})
+	mtfail(t, err, "import, %v", err)
+	if newid == eid {
+		t.Fatalf("import reused id %d", newid)
+	}
+	ner, err := edb.GetElection(newid)
+	mtfail(t, err, "get imported, %v", err)
+	if ner.Owner != 9 || !strings.Contains(ner.Data, fmt.Sprintf("/election/%d/media/%s", newid, mid)) {
+		t.Errorf("imported election %#v", ner)
+	}
+	// the history comes along, then the imported document
+	revs, err := edb.ElectionRevisions(newid)
+	mtfail(t, err, "imported revisions, %v", err)
+	if len(revs) != 3 || revs[0].Rev != 1 || revs[2].Rev != 3 {
+		t.Errorf("imported revisions %#v", revs)
+	}
+	rr, err := edb.GetElectionRevision(newid, 1)
+	if err != nil || rr == nil || rr.Data != first {
+		t.Errorf("imported revision 1 %#v %v", rr, err)
+	}
+	rr, err = edb.GetElectionRevision(newid, 2)
+	if err != nil || rr == nil || !strings.Contains(rr.Data, fmt.Sprintf("/election/%d/media/%s", newid, mid)) {
+		t.Errorf("imported revision 2 media %#v %v", rr, err)
+	}
+	sids, err := edb.ScansForElection(newid)
+	mtfail(t, err, "imported scans, %v", err)
+	if len(sids) != 1 {
+		t.Fatalf("imported %d scans", len(sids))
+	}
+	sr, err := edb.GetScan(sids[0])
+	mtfail(t, err, "imported scan, %v", err)
+	if string(sr.Image) != "jpegbytes" || sr.ContentType != "image/jpeg" {
+		t.Errorf("imported scan %#v", sr)
+	}
+
+	_, err = sh.importBundle([]byte("not a zip"), &login.User{Guid: 9})
+	if err == nil || err.(*httpError).code != 400 {
+		t.Errorf("bad bundle got %v", err)
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"container/heap"
+	"strings"
+	"sync"
+	"time"
 )
 
 type cacheEntry struct {
@@ -10,7 +13,7 @@ type cacheEntry struct {
 	size  uint64
 	seen  uint64
 	seeni int
-	//expires time.Time
+	used  time.Time // last Put or Get, for Prune
 }
 
 type seenHeap struct {
@@ -39,6 +42,7 @@ func (sh *seenHeap) Swap(i, j int) {
 // heap.Interface
 func (sh *seenHeap) Push(x interface{}) {
 	it := x.(*cacheEntry)
+	it.seeni = len(sh.they)
 	sh.they = append(sh.they, it)
 }
 
@@ -52,7 +56,23 @@ func (sh *seenHeap) Pop() interface{} {
 
 type expireHeap []*cacheEntry
 
+// cacheHeld values are held while they're in a Cache and released when
+// they leave it, so a spooled render's file lasts as long as it's cached
+// (see draw.DrawBothOb.Hold)
+type cacheHeld interface {
+	Hold() bool
+	Release()
+}
+
+func cacheRelease(v interface{}) {
+	if held, ok := v.(cacheHeld); ok {
+		held.Release()
+	}
+}
+
+// Cache is safe for use by several goroutines
 type Cache struct {
+	lock        sync.Mutex
 	MaxSize     uint64
 	byKey       map[string]*cacheEntry
 	currentSize uint64
@@ -61,11 +81,17 @@ type Cache struct {
 }
 
 func (c *Cache) Put(key string, v interface{}, size int) {
+	if held, ok := v.(cacheHeld); ok && !held.Hold() {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	ent := &cacheEntry{
 		key:  key,
 		data: v,
 		size: uint64(size),
 		seen: c.ai,
+		used: time.Now(),
 	}
 	c.ai++
 	if c.byKey == nil {
@@ -75,9 +101,11 @@ func (c *Cache) Put(key string, v interface{}, size int) {
 	if prev != nil {
 		c.currentSize -= prev.size
 		c.currentSize += uint64(size)
+		ent.seeni = prev.seeni
 		c.bySeen.they[prev.seeni] = ent
 		heap.Fix(&c.bySeen, prev.seeni)
 		c.byKey[key] = ent
+		cacheRelease(prev.data)
 	} else {
 		c.byKey[key] = ent
 		c.currentSize += uint64(size)
@@ -87,22 +115,96 @@ func (c *Cache) Put(key string, v interface{}, size int) {
 		c.MaxSize = 10000000
 	}
 	for c.currentSize > c.MaxSize {
-		oldest := heap.Pop(&c.bySeen).(cacheEntry)
+		oldest := heap.Pop(&c.bySeen).(*cacheEntry)
 		delete(c.byKey, oldest.key)
 		c.currentSize -= oldest.size
+		cacheRelease(oldest.data)
 	}
 }
 
 func (c *Cache) Invalidate(key string) {
-	delete(c.byKey, key)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ent := c.byKey[key]; ent != nil {
+		c.remove(ent)
+	}
+}
+
+// InvalidatePrefix removes every key starting with prefix
+func (c *Cache) InvalidatePrefix(prefix string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, ent := range c.byKey {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(ent)
+		}
+	}
+}
+
+// Prune removes entries not used since before, returning how many
+func (c *Cache) Prune(before time.Time) (removed int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, ent := range c.byKey {
+		if ent.used.Before(before) {
+			c.remove(ent)
+			removed++
+		}
+	}
+	return
+}
+
+// PruneKeys removes entries whose key drop is true for, returning how many
+func (c *Cache) PruneKeys(drop func(key string) bool) (removed int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, ent := range c.byKey {
+		if drop(key) {
+			c.remove(ent)
+			removed++
+		}
+	}
+	return
+}
+
+// Clear removes everything, returning how many entries there were
+func (c *Cache) Clear() (removed int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	removed = len(c.byKey)
+	for _, ent := range c.byKey {
+		cacheRelease(ent.data)
+	}
+	c.byKey = nil
+	c.bySeen.they = nil
+	c.currentSize = 0
+	return
+}
+
+// Len is the number of entries and their total size
+func (c *Cache) Len() (count int, size uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.byKey), c.currentSize
+}
+
+// remove with c.lock held
+func (c *Cache) remove(ent *cacheEntry) {
+	delete(c.byKey, ent.key)
+	heap.Remove(&c.bySeen, ent.seeni)
+	c.currentSize -= ent.size
+	cacheRelease(ent.data)
 }
 
 func (c *Cache) Get(key string) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	ent := c.byKey[key]
 	if ent == nil {
 		return nil
 	}
 	ent.seen = c.ai
+	ent.used = time.Now()
 	c.ai++
 	heap.Fix(&c.bySeen, ent.seeni)
 	return ent.data
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// counts holds like a spooled draw.DrawBothOb
+type heldValue struct {
+	holds int
+}
+
+func (hv *heldValue) Hold() bool {
+	if hv.holds <= 0 {
+		return false
+	}
+	hv.holds++
+	return true
+}
+
+func (hv *heldValue) Release() {
+	hv.holds--
+}
+
+func TestCacheHolds(t *testing.T) {
+	c := Cache{MaxSize: 100}
+	a, b, d := &heldValue{1}, &heldValue{1}, &heldValue{1}
+	c.Put("a", a, 60)
+	c.Put("b", b, 10)
+	if a.holds != 2 || b.holds != 2 {
+		t.Errorf("put holds %d %d", a.holds, b.holds)
+	}
+	// pushes a out
+	c.Put("d", d, 60)
+	if a.holds != 1 || d.holds != 2 {
+		t.Errorf("evicted holds %d %d", a.holds, d.holds)
+	}
+	c.Put("b", d, 10)
+	if b.holds != 1 || d.holds != 3 {
+		t.Errorf("replaced holds %d %d", b.holds, d.holds)
+	}
+	c.Invalidate("b")
+	if d.holds != 2 {
+		t.Errorf("invalidated hold %d", d.holds)
+	}
+	c.Prune(time.Now().Add(time.Minute))
+	if d.holds != 1 {
+		t.Errorf("pruned hold %d", d.holds)
+	}
+	c.Put("d", d, 10)
+	c.Clear()
+	if d.holds != 1 {
+		t.Errorf("cleared hold %d", d.holds)
+	}
+
+	// one every holder let go of isn't cached
+	d.Release()
+	c.Put("d", d, 10)
+	if c.Get("d") != nil || d.holds != 0 {
+		t.Errorf("cached a released value, %d holds", d.holds)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+// Render cache administration, admins only.
+//
+//	GET /admin/cache                       how full the caches are, how busy PDF to PNG conversion is and how election documents are read
+//	POST /admin/cache/invalidate?ids=1,2   drop those elections' renders
+//	POST /admin/cache/invalidate?all=1     drop everything, e.g. after upgrading the draw backend
+//	POST /admin/cache/warm?ids=1,2         render the PDF and page PNGs now, e.g. before a deadline
+//
+// Invalidating also drops the last good renders kept for when the draw
+// backend is down, so nothing drawn by the old backend is served again.
+// Warming renders one election at a time and reports how each went.
+
+// most elections in one warm request
+const maxCacheWarm = 500
+
+// GET /admin/cache and what invalidate returns
+type cacheStatus struct {
+	Entries      int    `json:"entries"`
+	Bytes        uint64 `json:"bytes"`
+	StaleEntries int    `json:"stale_entries"`
+	StaleBytes   uint64 `json:"stale_bytes"`
+	Removed      int    `json:"removed,omitempty"` // entries invalidated
+
+	// how busy PDF to PNG conversion is, GET only
+	PdfToPng *draw.PngPoolStats `json:"pdftopng,omitempty"`
+
+	// election document reads, GET only
+	Documents *docCacheStats `json:"documents,omitempty"`
+}
+
+// one election in the POST /admin/cache/warm response
+type cacheWarmResult struct {
+	ElectionId int64   `json:"itemid"`
+	Pages      int     `json:"pages,omitempty"`
+	Stale      bool    `json:"stale,omitempty"` // the draw backend was down, nothing was cached
+	Seconds    float64 `json:"seconds"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (sh *StudioHandler) cacheStatus() cacheStatus {
+	var cs cacheStatus
+	cs.Entries, cs.Bytes = sh.cache.Len()
+	cs.StaleEntries, cs.StaleBytes = sh.stale.Len()
+	return cs
+}
+
+// parseIds reads a comma separated list of election ids
+func parseIds(v string) (ids []int64, err error) {
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("bad election id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// GET /admin/cache, POST /admin/cache/invalidate, POST /admin/cache/warm
+func (sh *StudioHandler) handleCacheAdmin(w http.ResponseWriter, r *http.Request, user *login.User, op string) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	admin, err := sh.isAdmin(user)
+	if maybeerr(w, err, 500, "db staff") {
+		return
+	}
+	if !admin {
+		texterr(w, http.StatusForbidden, "admins only")
+		return
+	}
+	if op == "" {
+		if r.Method != "GET" {
+			texterr(w, http.StatusMethodNotAllowed, "GET only")
+			return
+		}
+		cs := sh.cacheStatus()
+		pool := draw.PngConversions.Stats()
+		cs.PdfToPng = &pool
+		if sh.docs != nil {
+			ds := sh.docs.Stats()
+			cs.Documents = &ds
+		}
+		writeJSON(w, cs)
+		return
+	}
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	query := r.URL.Query()
+	ids, err := parseIds(query.Get("ids"))
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	all := qbool(query.Get("all"))
+	switch op {
+	case "/invalidate":
+		if len(ids) == 0 && !all {
+			texterr(w, 400, "want ids=1,2,... or all=1")
+			return
+		}
+		before := sh.cacheStatus()
+		if all {
+			sh.cache.Clear()
+			sh.stale.Clear()
+			if sh.docs != nil {
+				sh.docs.forgetAll()
+			}
+		} else {
+			for _, id := range ids {
+				sh.forgetElection(strconv.FormatInt(id, 10))
+			}
+		}
+		cs := sh.cacheStatus()
+		cs.Removed = before.Entries + before.StaleEntries - cs.Entries - cs.StaleEntries
+		log.Printf("%s invalidated %d cache entries", user.Username, cs.Removed)
+		writeJSON(w, cs)
+	case "/warm":
+		if len(ids) == 0 || len(ids) > maxCacheWarm {
+			texterr(w, 400, "want ids=1,2,... of at most %d elections", maxCacheWarm)
+			return
+		}
+		out := make([]cacheWarmResult, 0, len(ids))
+		for _, id := range ids {
+			if r.Context().Err() != nil {
+				return
+			}
+			start := time.Now()
+			wr := cacheWarmResult{ElectionId: id}
+			ctx, note := withStaleNote(r.Context())
+			pages, err := sh.getPng(ctx, strconv.FormatInt(id, 10), draw.RenderOptions{}, false)
+			if he, ok := err.(*httpError); ok {
+				wr.Error = fmt.Sprintf("%s, %v", he.msg, he.err)
+			} else if err != nil {
+				wr.Error = err.Error()
+			}
+			wr.Pages = len(pages)
+			wr.Stale = note.stale
+			wr.Seconds = time.Since(start).Seconds()
+			out = append(out, wr)
+		}
+		writeJSON(w, out)
+	}
+}
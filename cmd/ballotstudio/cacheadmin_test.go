@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestCacheAdmin(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}, admins: map[string]bool{"root": true}}
+	doc := `{"Election": [{"BallotStyle": [{"GpUnitIds": ["g1"], "OrderedContent": []}]}]}`
+	a, err := edb.PutElection(electionRecord{Owner: 7, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+	b, err := edb.PutElection(electionRecord{Owner: 7, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+	root := &login.User{Guid: 1, Username: "root"}
+	do := func(user *login.User, method, path string, out interface{}) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		m := cacheAdminPathRe.FindStringSubmatch(req.URL.Path)
+		sh.handleCacheAdmin(rec, req, user, m[1])
+		if out != nil {
+			json.Unmarshal(rec.Body.Bytes(), out)
+		}
+		return rec.Code
+	}
+	if code := do(&login.User{Guid: 7, Username: "ann"}, "POST", "/admin/cache/invalidate?all=1", nil); code != 403 {
+		t.Errorf("not admin %d", code)
+	}
+	if code := do(root, "POST", "/admin/cache/warm?ids=1,x", nil); code != 400 {
+		t.Errorf("bad id %d", code)
+	}
+	if code := do(root, "POST", "/admin/cache/invalidate?x=1", nil); code != 400 {
+		t.Errorf("invalidate nothing %d", code)
+	}
+
+	var warmed []cacheWarmResult
+	path := "/admin/cache/warm?ids=" + strconv.FormatInt(a, 10) + "," + strconv.FormatInt(b, 10) + ",999"
+	if code := do(root, "POST", path, &warmed); code != 200 || len(warmed) != 3 {
+		t.Fatalf("warm %d %#v", code, warmed)
+	}
+	if warmed[0].Error != "" || warmed[0].Pages == 0 || warmed[1].Error != "" || warmed[2].Error == "" {
+		t.Errorf("warm results %#v", warmed)
+	}
+	cached := func(name string) bool {
+		return sh.cache.Get(renderKey(name, doc, draw.RenderOptions{})) != nil
+	}
+	if !cached(strconv.FormatInt(a, 10)) || !cached(strconv.FormatInt(b, 10)+".png") {
+		t.Errorf("not cached")
+	}
+	var cs cacheStatus
+	if code := do(root, "GET", "/admin/cache", &cs); code != 200 || cs.Entries != 4 || cs.StaleEntries != 2 || cs.Bytes == 0 {
+		t.Errorf("status %d %#v", code, cs)
+	}
+
+	if code := do(root, "POST", "/admin/cache/invalidate?ids="+strconv.FormatInt(a, 10), &cs); code != 200 || cs.Removed != 3 || cs.Entries != 2 {
+		t.Errorf("invalidate one %d %#v", code, cs)
+	}
+	if cached(strconv.FormatInt(a, 10)) || !cached(strconv.FormatInt(b, 10)) {
+		t.Errorf("invalidated the wrong one")
+	}
+	if code := do(root, "POST", "/admin/cache/invalidate?all=1", &cs); code != 200 || cs.Removed != 3 || cs.Entries != 0 || cs.StaleEntries != 0 {
+		t.Errorf("invalidate all %d %#v", code, cs)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Election facts: the date, jurisdiction and type of each election, taken
+// from its document into their own election_search columns whenever it is
+// saved, so listings can filter on them without reading every document.
+//
+// The date is the first Election's StartDate, the type its Type (or
+// OtherType), and the jurisdiction the Name of its ElectionScopeId GpUnit,
+// or failing that the document's Issuer.
+//
+// GET /admin/calendar (admins only) lists the instance's elections from
+// ?from (YYYY-MM-DD, default today) for ?days (default 90), soonest first.
+// It and the home page list take ?jurisdiction= and ?type= filters too.
+
+const defaultCalendarDays = 90
+const maxCalendarDays = 366
+const maxCalendarElections = 1000
+
+var factsDateRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)
+
+type electionFacts struct {
+	ElectionId   int64  `json:"itemid"`
+	Owner        int64  `json:"owner"`
+	Name         string `json:"name"`
+	Date         string `json:"date"` // YYYY-MM-DD, "" if the document has none
+	Jurisdiction string `json:"jurisdiction"`
+	Type         string `json:"type"`
+	State        string `json:"state,omitempty"`
+}
+
+// factsFilter picks elections by their facts; zero values match everything
+type factsFilter struct {
+	Owner        int64
+	From, To     string // YYYY-MM-DD, inclusive
+	Jurisdiction string // any case
+	Type         string
+	Limit        int
+}
+
+// docFacts pulls an election document's facts out; Name is left for the search title
+func docFacts(data string) (ef electionFacts) {
+	var doc map[string]interface{}
+	if json.Unmarshal([]byte(data), &doc) != nil {
+		return
+	}
+	elections := mapList(doc["Election"])
+	if len(elections) == 0 {
+		return
+	}
+	el := elections[0]
+	ef.Date = factsDateRe.FindString(docString(el["StartDate"]))
+	ef.Type = strings.ToLower(docString(el["Type"]))
+	if ef.Type == "other" && docString(el["OtherType"]) != "" {
+		ef.Type = strings.ToLower(docString(el["OtherType"]))
+	}
+	scope, _ := el["ElectionScopeId"].(string)
+	for _, gp := range mapList(doc["GpUnit"]) {
+		if id, _ := gp["@id"].(string); scope != "" && id == scope {
+			ef.Jurisdiction = docString(gp["Name"])
+			break
+		}
+	}
+	if ef.Jurisdiction == "" {
+		ef.Jurisdiction = docString(doc["Issuer"])
+	}
+	return
+}
+
+// parseFactsFilter reads from, to, jurisdiction and type query parameters
+func parseFactsFilter(query url.Values) (f factsFilter, err error) {
+	get := func(k string) string {
+		return strings.TrimSpace(query.Get(k))
+	}
+	f.From, f.To = get("from"), get("to")
+	for _, d := range []string{f.From, f.To} {
+		if d == "" {
+			continue
+		}
+		if _, err = time.Parse("2006-01-02", d); err != nil {
+			return f, fmt.Errorf("bad date %q, want YYYY-MM-DD", d)
+		}
+	}
+	f.Jurisdiction = get("jurisdiction")
+	f.Type = strings.ToLower(get("type"))
+	return f, nil
+}
+
+// active is true if f filters anything besides the owner
+func (f factsFilter) active() bool {
+	return f.From != "" || f.To != "" || f.Jurisdiction != "" || f.Type != ""
+}
+
+// queryFacts is common to all backends. param is "$" for numbered
+// placeholders or "?", idcol is the elections id column.
+func queryFacts(db sqlDB, param, idcol string, f factsFilter) ([]electionFacts, error) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		ph := "?"
+		if param != "?" {
+			ph = fmt.Sprintf("$%d", len(args))
+		}
+		where = append(where, fmt.Sprintf(cond, ph))
+	}
+	if f.Owner != 0 {
+		add("e.owner = %s", f.Owner)
+	}
+	if f.From != "" {
+		add("s.election_date >= %s", f.From)
+	}
+	if f.To != "" {
+		add("s.election_date <= %s", f.To)
+	}
+	if f.Jurisdiction != "" {
+		add("LOWER(s.jurisdiction) = %s", strings.ToLower(f.Jurisdiction))
+	}
+	if f.Type != "" {
+		add("s.election_type = %s", f.Type)
+	}
+	query := fmt.Sprintf(`SELECT s.election, e.owner, s.title, s.election_date, s.jurisdiction, s.election_type FROM election_search s JOIN elections e ON e.%s = s.election WHERE e.trashed IS NULL`, idcol)
+	for _, w := range where {
+		query += " AND " + w
+	}
+	query += " ORDER BY s.election_date, s.election"
+	if f.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(f.Limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("election facts, %v", err)
+	}
+	defer rows.Close()
+	var out []electionFacts
+	for rows.Next() {
+		var ef electionFacts
+		var name, date, jurisdiction, etype sql.NullString
+		err = rows.Scan(&ef.ElectionId, &ef.Owner, &name, &date, &jurisdiction, &etype)
+		if err != nil {
+			return nil, fmt.Errorf("election facts row, %v", err)
+		}
+		ef.Name, ef.Date, ef.Jurisdiction, ef.Type = name.String, date.String, jurisdiction.String, etype.String
+		out = append(out, ef)
+	}
+	return out, rows.Err()
+}
+
+// GET /admin/calendar
+type calendarResponse struct {
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	Elections []electionFacts `json:"elections"`
+}
+
+func (sh *StudioHandler) handleCalendar(w http.ResponseWriter, r *http.Request, user *login.User) {
+	edb := sh.edb.WithContext(r.Context())
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	admin, err := sh.isAdmin(user)
+	if maybeerr(w, err, 500, "db staff") {
+		return
+	}
+	if !admin {
+		texterr(w, http.StatusForbidden, "admins only")
+		return
+	}
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	query := r.URL.Query()
+	f, err := parseFactsFilter(query)
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	if f.To != "" {
+		texterr(w, 400, "use from and days")
+		return
+	}
+	if f.From == "" {
+		f.From = time.Now().UTC().Format("2006-01-02")
+	}
+	days := defaultCalendarDays
+	if v := query.Get("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > maxCalendarDays {
+			texterr(w, 400, "days should be 1 to %d", maxCalendarDays)
+			return
+		}
+	}
+	from, _ := time.Parse("2006-01-02", f.From)
+	f.To = from.AddDate(0, 0, days-1).Format("2006-01-02")
+	f.Limit = maxCalendarElections
+	elections, err := edb.ElectionFacts(f)
+	if maybeerr(w, err, 500, "db facts") {
+		return
+	}
+	for i := range elections {
+		elections[i].State, _ = edb.GetElectionState(elections[i].ElectionId)
+	}
+	if elections == nil {
+		elections = []electionFacts{}
+	}
+	writeJSON(w, calendarResponse{From: f.From, To: f.To, Elections: elections})
+}
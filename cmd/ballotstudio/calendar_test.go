@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestDocFacts(t *testing.T) {
+	for _, tc := range []struct {
+		doc  string
+		want electionFacts
+	}{
+		{`{"GpUnit": [{"@id": "g1", "Name": "Ward 3"}, {"@id": "g2", "Name": "Springfield"}],
+"Election": [{"StartDate": "2026-11-03", "Type": "General", "ElectionScopeId": "g2"}]}`,
+			electionFacts{Date: "2026-11-03", Jurisdiction: "Springfield", Type: "general"}},
+		{`{"Issuer": "Shelby County", "Election": [{"StartDate": "2027-03-01T00:00:00Z", "Type": "other", "OtherType": "Recall"}]}`,
+			electionFacts{Date: "2027-03-01", Jurisdiction: "Shelby County", Type: "recall"}},
+		{`{"Election": [{"StartDate": "soon"}]}`, electionFacts{}},
+		{`not json`, electionFacts{}},
+	} {
+		if got := docFacts(tc.doc); got != tc.want {
+			t.Errorf("%s: got %#v", tc.doc, got)
+		}
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	put := func(owner int64, date, jurisdiction, etype string) int64 {
+		eid, err := edb.PutElection(electionRecord{Owner: owner, Data: `{"Issuer": "` + jurisdiction + `", "Election": [{"Name": "E", "StartDate": "` + date + `", "Type": "` + etype + `"}]}`})
+		mtfail(t, err, "put, %v", err)
+		return eid
+	}
+	fall := put(1, "2026-11-03", "Springfield", "general")
+	spring := put(2, "2027-03-02", "Shelbyville", "primary")
+	put(1, "2028-11-07", "Springfield", "general")
+	trashed := put(1, "2026-12-01", "Springfield", "special")
+	err := edb.TrashElection(trashed, time.Now())
+	mtfail(t, err, "trash, %v", err)
+
+	sh := StudioHandler{edb: edb, admins: map[string]bool{"root": true}}
+	root := &login.User{Guid: 1, Username: "root"}
+	calendar := func(user *login.User, q string) (code int, cr calendarResponse) {
+		rec := httptest.NewRecorder()
+		sh.handleCalendar(rec, httptest.NewRequest("GET", "/admin/calendar?"+q, nil), user)
+		json.Unmarshal(rec.Body.Bytes(), &cr)
+		return rec.Code, cr
+	}
+	ids := func(cr calendarResponse) (out []int64) {
+		for _, ef := range cr.Elections {
+			out = append(out, ef.ElectionId)
+		}
+		return
+	}
+	if code, _ := calendar(&login.User{Guid: 1, Username: "ann"}, ""); code != 403 {
+		t.Errorf("not admin %d", code)
+	}
+	if code, _ := calendar(root, "from=11/3/2026"); code != 400 {
+		t.Errorf("bad date %d", code)
+	}
+	if code, _ := calendar(root, "days=1000"); code != 400 {
+		t.Errorf("too many days %d", code)
+	}
+	code, cr := calendar(root, "from=2026-10-01&days=365")
+	if code != 200 || cr.To != "2027-09-30" || len(cr.Elections) != 2 || cr.Elections[0].ElectionId != fall || cr.Elections[1].ElectionId != spring {
+		t.Fatalf("calendar %d %#v", code, cr)
+	}
+	if ef := cr.Elections[0]; ef.Jurisdiction != "Springfield" || ef.Type != "general" || ef.State != StateDraft || ef.Owner != 1 {
+		t.Errorf("facts %#v", ef)
+	}
+	if _, cr = calendar(root, "from=2026-10-01&days=365&jurisdiction=SHELBYVILLE"); len(cr.Elections) != 1 || cr.Elections[0].ElectionId != spring {
+		t.Errorf("jurisdiction %v", ids(cr))
+	}
+	if _, cr = calendar(root, "from=2026-01-01&days=366&type=General"); len(cr.Elections) != 1 || cr.Elections[0].ElectionId != fall {
+		t.Errorf("type %v", ids(cr))
+	}
+
+	// the home page list filters the same way
+	facts, err := edb.ElectionFacts(factsFilter{Owner: 1, From: "2026-01-01", Type: "general"})
+	mtfail(t, err, "facts, %v", err)
+	if len(facts) != 2 || facts[0].ElectionId != fall {
+		t.Errorf("owner facts %#v", facts)
+	}
+}
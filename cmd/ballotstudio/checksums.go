@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+// GET /election/{id}/checksums lists the SHA-256 of the document and of
+// each artifact as its URL serves it, and the per file hashes that go in a
+// bundle's bundle.json, so a printer or auditor can check what they
+// downloaded without fetching the whole bundle.
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type artifactChecksum struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Sha256 string `json:"sha256,omitempty"`
+	Size   int    `json:"size"`
+	Stale  bool   `json:"stale,omitempty"` // an older render, the draw backend is down
+	Error  string `json:"error,omitempty"` // couldn't be made, no sha256
+}
+
+type electionChecksums struct {
+	ElectionId int64              `json:"itemid"`
+	State      string             `json:"state"`
+	Document   artifactChecksum   `json:"document"`
+	Artifacts  []artifactChecksum `json:"artifacts"`
+	Bundle     map[string]string  `json:"bundle_manifest"` // bundle.json "sha256", bundle file name to hash
+	Generated  time.Time          `json:"generated"`
+}
+
+func checksumOf(name, url string, b []byte) artifactChecksum {
+	return artifactChecksum{Name: name, Url: url, Sha256: sha256Hex(b), Size: len(b)}
+}
+
+// electionChecksums hashes what each URL would serve right now
+func (sh *StudioHandler) electionChecksums(ctx context.Context, er *electionRecord) (*electionChecksums, error) {
+	el := strconv.FormatInt(er.Id, 10)
+	ec := &electionChecksums{ElectionId: er.Id, Generated: time.Now().UTC()}
+	var err error
+	ec.State, err = sh.edb.GetElectionState(er.Id)
+	if err != nil {
+		return nil, err
+	}
+	// as GET /election/{id} serves it
+	var ob map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &ob)
+	if err != nil {
+		return nil, fmt.Errorf("bad json, %v", err)
+	}
+	doc, err := json.Marshal(data.Fixup(ob))
+	if err != nil {
+		return nil, err
+	}
+	ec.Document = checksumOf(el+".json", "/election/"+el, doc)
+
+	rctx, note := withStaleNote(ctx)
+	bothob, err := sh.getPdf(rctx, el, draw.RenderOptions{}, false)
+	if err != nil {
+		msg := err.(*httpError).msg
+		ec.Artifacts = append(ec.Artifacts,
+			artifactChecksum{Name: el + ".pdf", Url: "/election/" + el + ".pdf", Error: msg},
+			artifactChecksum{Name: el + "_bubbles.json", Url: "/election/" + el + "_bubbles.json", Error: msg})
+	} else {
+		defer bothob.Release()
+		pdf := artifactChecksum{Name: el + ".pdf", Url: "/election/" + el + ".pdf", Sha256: hex.EncodeToString(bothob.PdfSum()), Size: int(bothob.PdfSize())}
+		bubbles := checksumOf(el+"_bubbles.json", "/election/"+el+"_bubbles.json", bothob.BubblesJson)
+		pdf.Stale, bubbles.Stale = note.stale, note.stale
+		ec.Artifacts = append(ec.Artifacts, pdf, bubbles)
+	}
+	rctx, note = withStaleNote(ctx)
+	pamphlet, err := sh.getPamphlet(rctx, el, false)
+	if err != nil {
+		ec.Artifacts = append(ec.Artifacts, artifactChecksum{Name: el + "_pamphlet.pdf", Url: "/election/" + el + "_pamphlet.pdf", Error: err.(*httpError).msg})
+	} else {
+		pc := checksumOf(el+"_pamphlet.pdf", "/election/"+el+"_pamphlet.pdf", pamphlet)
+		pc.Stale = note.stale
+		ec.Artifacts = append(ec.Artifacts, pc)
+	}
+
+	bm, files, err := sh.bundleFiles(ctx, er)
+	if err != nil {
+		return nil, err
+	}
+	ec.Bundle = bm.Files
+	// candidate photos and party symbols
+	for _, bf := range files {
+		if strings.HasPrefix(bf.name, "media/") {
+			ec.Artifacts = append(ec.Artifacts, checksumOf(bf.name, "/election/"+el+"/"+bf.name, bf.data))
+		}
+	}
+	return ec, nil
+}
+
+// GET /election/{id}/checksums, readable by anyone who can read the document
+func (sh *StudioHandler) handleElectionChecksums(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	ec, err := sh.electionChecksums(r.Context(), er)
+	if maybeerr(w, err, 500, "checksums, %v", err) {
+		return
+	}
+	writeJSON(w, ec)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+func TestElectionChecksums(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}, drawClient: &draw.Client{}}
+
+	photo := testPng(t, 3, 3)
+	mid, err := sh.media.PutMedia(photo, "image/png")
+	mtfail(t, err, "put media, %v", err)
+	doc := `{"Election": [{"Candidate": [{"@id": "c1", "PhotoUri": "/election/1/media/` + mid + `"}]}]}`
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.PutScan(scanRecord{ElectionId: eid, Owner: 7, Image: []byte("jpegbytes"), ContentType: "image/jpeg", Result: `{}`, Created: 1600000000})
+	mtfail(t, err, "put scan, %v", err)
+	el := strconv.FormatInt(eid, 10)
+	pdf := []byte("%PDF ballot")
+	sh.cache.Put(renderKey(el, doc, draw.RenderOptions{}), &draw.DrawBothOb{Pdf: pdf, BubblesJson: []byte(`{"bubbles":[]}`)}, 100)
+
+	rec := httptest.NewRecorder()
+	sh.handleElectionChecksums(rec, httptest.NewRequest("GET", "/election/"+el+"/checksums", nil), nil, eid)
+	if rec.Code != 200 {
+		t.Fatalf("checksums %d %s", rec.Code, rec.Body.String())
+	}
+	var ec electionChecksums
+	err = json.Unmarshal(rec.Body.Bytes(), &ec)
+	mtfail(t, err, "checksums json, %v", err)
+
+	// the document as GET /election/{id} serves it
+	rec = httptest.NewRecorder()
+	sh.handleElectionDocGET(rec, httptest.NewRequest("GET", "/election/"+el, nil), nil, eid)
+	if ec.Document.Sha256 != sha256Hex(rec.Body.Bytes()) {
+		t.Errorf("document %#v", ec.Document)
+	}
+	byName := make(map[string]artifactChecksum)
+	for _, ac := range ec.Artifacts {
+		byName[ac.Name] = ac
+	}
+	if ac := byName[el+".pdf"]; ac.Sha256 != sha256Hex(pdf) || ac.Size != len(pdf) {
+		t.Errorf("pdf %#v", ac)
+	}
+	if ac := byName[el+"_pamphlet.pdf"]; ac.Error == "" || ac.Sha256 != "" {
+		t.Errorf("pamphlet without a draw backend %#v", ac)
+	}
+	if ac := byName["media/"+mid]; ac.Sha256 != sha256Hex(photo) || ac.Url != "/election/"+el+"/media/"+mid {
+		t.Errorf("media %#v", ac)
+	}
+
+	// every file in an export matches the listing and its own bundle.json
+	er, err := edb.GetElection(eid)
+	mtfail(t, err, "get election, %v", err)
+	var buf bytes.Buffer
+	err = sh.writeBundle(context.Background(), &buf, er)
+	mtfail(t, err, "export, %v", err)
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	mtfail(t, err, "export zip, %v", err)
+	var bm bundleManifest
+	for _, zf := range zr.File {
+		fr, err := zf.Open()
+		mtfail(t, err, "open %s, %v", zf.Name, err)
+		fdata, err := ioutil.ReadAll(fr)
+		fr.Close()
+		mtfail(t, err, "read %s, %v", zf.Name, err)
+		if zf.Name == "bundle.json" {
+			json.Unmarshal(fdata, &bm)
+			continue
+		}
+		if sum := sha256Hex(fdata); ec.Bundle[zf.Name] != sum {
+			t.Errorf("%s sha256 %s, listed %s", zf.Name, sum, ec.Bundle[zf.Name])
+		}
+	}
+	if len(bm.Files) != len(ec.Bundle) || len(bm.Files) != len(zr.File)-1 {
+		t.Errorf("bundle.json lists %d files, checksums %d, zip has %d", len(bm.Files), len(ec.Bundle), len(zr.File))
+	}
+
+	err = edb.TrashElection(eid, time.Now())
+	mtfail(t, err, "trash, %v", err)
+	rec = httptest.NewRecorder()
+	sh.handleElectionChecksums(rec, httptest.NewRequest("GET", "/election/"+el+"/checksums", nil), nil, eid)
+	if rec.Code != 404 {
+		t.Errorf("trashed election checksums %d", rec.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/login/login"
+)
+
+// Cloning a published election into another organization, e.g. a state's
+// standard ballot as the start of each county's. POST /election/{id}/clone
+// makes a new draft owned by the caller with the layout and contest
+// structure of the source, and nothing that belongs to the source office:
+// no scans, annotations, lifecycle state, public results or template
+// setting, and the document is stripped of the keys below. If the caller is
+// provisioned staff, the copy's Issuer is their organization.
+
+// removed wherever they appear in the document
+var cloneStripKeys = map[string]bool{
+	"ExternalIdentifier": true, // fips: and ocd-id: codes of the source's districts
+	"ContactInformation": true,
+}
+
+// removed from the top level ElectionReport
+var cloneStripReportKeys = []string{"Issuer", "IssuerAbbreviation", "VendorApplicationId", "GeneratedDate"}
+
+// sanitizeClone strips source organization identifiers from a document, in place
+func sanitizeClone(doc map[string]interface{}, issuer string) map[string]interface{} {
+	var strip func(v interface{})
+	strip = func(v interface{}) {
+		switch xv := v.(type) {
+		case map[string]interface{}:
+			for k, sub := range xv {
+				if cloneStripKeys[k] {
+					delete(xv, k)
+					continue
+				}
+				strip(sub)
+			}
+		case []interface{}:
+			for _, sub := range xv {
+				strip(sub)
+			}
+		}
+	}
+	strip(doc)
+	for _, k := range cloneStripReportKeys {
+		delete(doc, k)
+	}
+	if issuer != "" {
+		doc["Issuer"] = issuer
+	}
+	return doc
+}
+
+// cloneElection makes a new draft election for user from published election sourceid
+func (sh *StudioHandler) cloneElection(sourceid int64, user *login.User) (newid int64, err error) {
+	er, err := sh.edb.GetElection(sourceid)
+	if err != nil || er.Trashed != 0 {
+		return 0, &httpError{404, "no item", err}
+	}
+	var ob map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &ob)
+	if err != nil {
+		return 0, &httpError{500, "bad election json", err}
+	}
+	issuer := ""
+	sr, err := sh.edb.StaffForUser(user.Guid)
+	if err != nil {
+		return 0, &httpError{500, "db staff", err}
+	}
+	if sr != nil {
+		issuer = sr.Organization
+	}
+	ob = data.Fixup(sanitizeClone(ob, issuer))
+	doc, err := json.Marshal(ob)
+	if err != nil {
+		return 0, &httpError{500, "re-json", err}
+	}
+	newid, err = sh.edb.PutElection(electionRecord{Owner: user.Guid, Data: string(doc)})
+	if err != nil {
+		return 0, &httpError{500, "db put fail", err}
+	}
+	// media is shared by content hash, so only the URLs move to the new election
+	rewritten := mediaRefAnyRe.ReplaceAllString(string(doc), fmt.Sprintf("/election/%d/media/$1", newid))
+	if rewritten != string(doc) {
+		_, err = sh.edb.PutElection(electionRecord{Id: newid, Owner: user.Guid, Data: rewritten})
+		if err != nil {
+			return newid, &httpError{500, "db put fail", err}
+		}
+	}
+	return newid, nil
+}
+
+// POST /election/{id}/clone, any logged in user, source must be published
+func (sh *StudioHandler) handleElectionClone(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	if sh.checkElectionState(w, electionid, actionClone) {
+		return
+	}
+	if sh.overQuota(w, user, 1, 0) {
+		return
+	}
+	newid, err := sh.cloneElection(electionid, user)
+	if err != nil {
+		he := err.(*httpError)
+		if he.err != nil {
+			maybeerr(w, he.err, he.code, he.msg)
+		} else {
+			texterr(w, he.code, "%s", he.msg)
+		}
+		return
+	}
+	editContextFinish(w, r, newid, nil)
+}
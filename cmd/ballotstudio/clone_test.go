@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestElectionClone(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}}
+
+	source := `{"Issuer": "State of Oregon", "IssuerAbbreviation": "OR", "GeneratedDate": "2026-01-02",
+"Election": [{"Name": "General", "Contest": [{"@id": "k1", "Name": "Governor", "ContestSelection": [{"@id": "s1", "CandidateIds": ["c1"]}]}],
+"Candidate": [{"@id": "c1", "BallotName": "Ann", "PhotoUri": "/election/1/media/` + strings.Repeat("a", 64) + `.png"}],
+"Person": [{"@id": "p1", "ContactInformation": {"Email": ["ann@example.com"]}}],
+"GpUnit": [{"@id": "g1", "Name": "Oregon", "ExternalIdentifier": ["fips:41"]}]}]}`
+	eid, err := edb.PutElection(electionRecord{Owner: 1, Data: source, Meta: electionMeta{PublicResults: true}.String()})
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.PutScan(scanRecord{ElectionId: eid, Owner: 1})
+	mtfail(t, err, "put scan, %v", err)
+	err = edb.PutStaff(staffRecord{Email: "bo@example.com", Role: StaffEditor, Organization: "Kent County", UserId: 2})
+	mtfail(t, err, "put staff, %v", err)
+
+	clone := func(user *login.User) (int, EditContext) {
+		rec := httptest.NewRecorder()
+		sh.handleElectionClone(rec, httptest.NewRequest("POST", fmt.Sprintf("/election/%d/clone", eid), nil), user, eid)
+		var ec EditContext
+		if rec.Code == 200 {
+			json.Unmarshal(rec.Body.Bytes(), &ec)
+		}
+		return rec.Code, ec
+	}
+	bo := &login.User{Guid: 2, Username: "bo"}
+	if code, _ := clone(nil); code != 401 {
+		t.Errorf("anonymous clone %d", code)
+	}
+	if code, _ := clone(bo); code != 409 {
+		t.Errorf("draft clone %d", code)
+	}
+	for _, step := range [][2]string{{StateDraft, StateProofing}, {StateProofing, StateApproved}, {StateApproved, StatePublished}} {
+		_, err = edb.SetElectionState(eid, step[0], step[1])
+		mtfail(t, err, "state, %v", err)
+	}
+	code, ec := clone(bo)
+	if code != 200 || ec.ElectionId == 0 || ec.ElectionId == eid {
+		t.Fatalf("clone %d %#v", code, ec)
+	}
+
+	er, err := edb.GetElection(ec.ElectionId)
+	mtfail(t, err, "get clone, %v", err)
+	if er.Owner != 2 || er.Meta != "" {
+		t.Errorf("clone owner %d meta %q", er.Owner, er.Meta)
+	}
+	for _, gone := range []string{"State of Oregon", "IssuerAbbreviation", "GeneratedDate", "fips:41", "ann@example.com", "/election/1/media/"} {
+		if strings.Contains(er.Data, gone) {
+			t.Errorf("clone still has %q", gone)
+		}
+	}
+	for _, kept := range []string{`"Issuer":"Kent County"`, "Governor", `"CandidateIds":["c1"]`, fmt.Sprintf("/election/%d/media/", ec.ElectionId)} {
+		if !strings.Contains(er.Data, kept) {
+			t.Errorf("clone lost %q", kept)
+		}
+	}
+	state, err := edb.GetElectionState(ec.ElectionId)
+	if state != StateDraft || err != nil {
+		t.Errorf("clone state %q %v", state, err)
+	}
+	scans, err := edb.ScansForElection(ec.ElectionId)
+	if len(scans) != 0 || err != nil {
+		t.Errorf("clone scans %v %v", scans, err)
+	}
+}
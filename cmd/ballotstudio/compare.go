@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brianolson/login/login"
+)
+
+// GET /elections/compare?a={id}&b={id} reports what changed from election a
+// to election b: contests and candidates added, removed and changed, the
+// candidates on each contest's ballot, and the old and new wording of every
+// text field that was edited. It's for reviewing, say, the proofed version
+// against the certified one without drawing either.
+//
+// Either side may be {id}@{rev}, a saved revision (see revdiff.go), so two
+// versions of one election compare the same way as two elections. Objects
+// are matched by @id, and then, since separately made elections don't share
+// ids, by name. References are compared by what they name: a contest's
+// district by the GpUnit's name, a candidate's party by the party's, and
+// selections by their candidates' ballot names.
+
+// fields compared by what they name, or through something else, not as is
+var compareSkipFields = map[string]bool{
+	"@id":              true,
+	"ContestSelection": true,
+	"PersonId":         true,
+}
+
+type compareSide struct {
+	ElectionId int64  `json:"itemid"`
+	Rev        int    `json:"rev,omitempty"` // 0 for the current version
+	Title      string `json:"title"`
+	State      string `json:"state"`
+}
+
+// textEdit is a text field's wording in a and in b, "" where it isn't set
+type textEdit struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+type objectComparison struct {
+	Id   string `json:"id"`
+	AId  string `json:"a_id,omitempty"` // when a's object, matched by name, has another @id
+	Name string `json:"name"`
+	// Text edits, including references by name: District, Party
+	Text []textEdit `json:"text,omitempty"`
+	// Fields are other changed fields
+	Fields []string `json:"fields,omitempty"`
+	// SelectionsAdded and SelectionsRemoved are contest choices by their
+	// candidates' ballot names, or a measure's choice text
+	SelectionsAdded   []string `json:"selections_added,omitempty"`
+	SelectionsRemoved []string `json:"selections_removed,omitempty"`
+}
+
+type objectComparisons struct {
+	Added   []objectChange     `json:"added"`
+	Removed []objectChange     `json:"removed"`
+	Changed []objectComparison `json:"changed"`
+}
+
+type electionComparison struct {
+	A compareSide `json:"a"`
+	B compareSide `json:"b"`
+	// Election is the text edits to the first Election's own fields
+	Election   []textEdit        `json:"election"`
+	Contests   objectComparisons `json:"contests"`
+	Candidates objectComparisons `json:"candidates"`
+}
+
+// fieldText is a string or InternationalizedText field as text, false for anything else
+func fieldText(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return x, true
+	case map[string]interface{}:
+		if _, ok := x["Text"]; ok {
+			return docString(x), true
+		}
+	}
+	return "", false
+}
+
+// compareNameKey matches objects across elections that don't share @ids
+func compareNameKey(ob map[string]interface{}) string {
+	return strings.Join(strings.Fields(strings.ToLower(objectName(ob))), " ")
+}
+
+// compareDoc is what references in one document name
+type compareDoc struct {
+	doc   map[string]interface{}
+	names map[string]string // @id -> name, of every object
+}
+
+func newCompareDoc(doc map[string]interface{}) compareDoc {
+	cd := compareDoc{doc: doc, names: make(map[string]string)}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if id, ok := x["@id"].(string); ok {
+				cd.names[id] = objectName(x)
+			}
+			for _, sub := range x {
+				walk(sub)
+			}
+		case []interface{}:
+			for _, sub := range x {
+				walk(sub)
+			}
+		}
+	}
+	walk(doc)
+	return cd
+}
+
+// selectionNames are a contest's choices as voters read them
+func (cd compareDoc) selectionNames(co map[string]interface{}) (out []string) {
+	for _, sel := range mapList(co["ContestSelection"]) {
+		if s := docString(sel["Selection"]); s != "" {
+			out = append(out, s)
+			continue
+		}
+		if writein, _ := sel["IsWriteIn"].(bool); writein {
+			out = append(out, "Write-in")
+			continue
+		}
+		var names []string
+		for _, cid := range ifaceStrings(sel["CandidateIds"]) {
+			names = append(names, cd.names[cid])
+		}
+		out = append(out, strings.Join(names, " / "))
+	}
+	return
+}
+
+// refText is a reference field by the name of what it refers to
+func (cd compareDoc) refText(field string, v interface{}) (label, text string, ok bool) {
+	switch field {
+	case "ElectionDistrictId":
+		label = "District"
+	case "PartyId":
+		label = "Party"
+	default:
+		return "", "", false
+	}
+	id, _ := v.(string)
+	if name := cd.names[id]; name != "" {
+		return label, name, true
+	}
+	return label, id, true
+}
+
+// compareFields compares two matched objects field by field
+func compareFields(a, b compareDoc, aob, bob map[string]interface{}) (text []textEdit, fields []string) {
+	keys := make(map[string]bool)
+	for k := range aob {
+		keys[k] = true
+	}
+	for k := range bob {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		if !compareSkipFields[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		av, bv := aob[k], bob[k]
+		if label, at, ok := a.refText(k, av); ok {
+			_, bt, _ := b.refText(k, bv)
+			if at != bt {
+				text = append(text, textEdit{Field: label, A: at, B: bt})
+			}
+			continue
+		}
+		if reflect.DeepEqual(av, bv) {
+			continue
+		}
+		at, aok := fieldText(av)
+		bt, bok := fieldText(bv)
+		if aok && bok {
+			if at != bt {
+				text = append(text, textEdit{Field: k, A: at, B: bt})
+			} else {
+				// only another language's text changed
+				fields = append(fields, k)
+			}
+			continue
+		}
+		fields = append(fields, k)
+	}
+	return
+}
+
+// stringsDiff is what's in b and not a, and in a and not b, in order
+func stringsDiff(a, b []string) (added, removed []string) {
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		if count[s] > 0 {
+			count[s]--
+		} else {
+			added = append(added, s)
+		}
+	}
+	count = make(map[string]int)
+	for _, s := range b {
+		count[s]++
+	}
+	for _, s := range a {
+		if count[s] > 0 {
+			count[s]--
+		} else {
+			removed = append(removed, s)
+		}
+	}
+	return
+}
+
+// compareObjects matches the `kind` objects of two documents and compares them
+func compareObjects(a, b compareDoc, kind string) (oc objectComparisons) {
+	aObs, aOrder := docObjects(a.doc, kind)
+	bObs, bOrder := docObjects(b.doc, kind)
+	// a's object for each of b's
+	match := make(map[string]string)
+	matched := make(map[string]bool)
+	for _, id := range bOrder {
+		if _, ok := aObs[id]; ok {
+			match[id] = id
+			matched[id] = true
+		}
+	}
+	aByName := make(map[string]string)
+	for _, id := range aOrder {
+		if key := compareNameKey(aObs[id]); key != "" && !matched[id] {
+			if _, dup := aByName[key]; !dup {
+				aByName[key] = id
+			}
+		}
+	}
+	for _, id := range bOrder {
+		if _, ok := match[id]; ok {
+			continue
+		}
+		key := compareNameKey(bObs[id])
+		if aid, ok := aByName[key]; ok && key != "" && !matched[aid] {
+			match[id] = aid
+			matched[aid] = true
+		}
+	}
+	oc.Added = []objectChange{}
+	oc.Removed = []objectChange{}
+	oc.Changed = []objectComparison{}
+	for _, id := range aOrder {
+		if !matched[id] {
+			oc.Removed = append(oc.Removed, objectChange{Id: id, Name: objectName(aObs[id])})
+		}
+	}
+	for _, id := range bOrder {
+		bob := bObs[id]
+		aid, ok := match[id]
+		if !ok {
+			oc.Added = append(oc.Added, objectChange{Id: id, Name: objectName(bob)})
+			continue
+		}
+		aob := aObs[aid]
+		cmp := objectComparison{Id: id, Name: objectName(bob)}
+		if aid != id {
+			cmp.AId = aid
+		}
+		cmp.Text, cmp.Fields = compareFields(a, b, aob, bob)
+		if kind == "Contest" {
+			cmp.SelectionsAdded, cmp.SelectionsRemoved = stringsDiff(a.selectionNames(aob), b.selectionNames(bob))
+		}
+		if len(cmp.Text) != 0 || len(cmp.Fields) != 0 || len(cmp.SelectionsAdded) != 0 || len(cmp.SelectionsRemoved) != 0 {
+			oc.Changed = append(oc.Changed, cmp)
+		}
+	}
+	return
+}
+
+// compareElections is what changed from document a to document b
+func compareElections(adoc, bdoc map[string]interface{}) (ec electionComparison) {
+	a := newCompareDoc(adoc)
+	b := newCompareDoc(bdoc)
+	ec.Election = []textEdit{}
+	var ael, bel map[string]interface{}
+	if els := mapList(adoc["Election"]); len(els) != 0 {
+		ael = els[0]
+	}
+	if els := mapList(bdoc["Election"]); len(els) != 0 {
+		bel = els[0]
+	}
+	for _, field := range []string{"Name", "Type", "StartDate", "EndDate"} {
+		at, _ := fieldText(ael[field])
+		bt, _ := fieldText(bel[field])
+		if at != bt {
+			ec.Election = append(ec.Election, textEdit{Field: field, A: at, B: bt})
+		}
+	}
+	ec.Contests = compareObjects(a, b, "Contest")
+	ec.Candidates = compareObjects(a, b, "Candidate")
+	return
+}
+
+// compareParam parses a= or b=, an election number or public id and maybe "@" a revision
+func compareParam(r *http.Request, name string) (eid int64, rev int, err error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, 0, fmt.Errorf("%s= wants an election", name)
+	}
+	ref := v
+	if at := strings.IndexByte(v, '@'); at >= 0 {
+		ref = v[:at]
+		rev, err = strconv.Atoi(v[at+1:])
+		if err != nil || rev < 1 {
+			return 0, 0, fmt.Errorf("bad %s revision %q", name, v[at+1:])
+		}
+	}
+	if ic, ok := r.Context().Value(publicIdsKey{}).(*idCodec); ok {
+		if id, ok := ic.decode(ref); ok {
+			return id, rev, nil
+		}
+	}
+	eid, err = strconv.ParseInt(ref, 10, 64)
+	if err != nil || eid < 1 {
+		return 0, 0, fmt.Errorf("bad %s %q", name, v)
+	}
+	return eid, rev, nil
+}
+
+// compareDocument loads one side of a comparison, writing an error and
+// returning nil if it can't
+func (sh *StudioHandler) compareDocument(ctx context.Context, w http.ResponseWriter, eid int64, rev int, side *compareSide) map[string]interface{} {
+	edb := sh.edb.WithContext(ctx)
+	er, err := edb.GetElection(eid)
+	if maybeerr(w, err, 404, "no election %d", eid) {
+		return nil
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", eid)
+		return nil
+	}
+	data := er.Data
+	if rev != 0 {
+		rr, err := edb.GetElectionRevision(eid, rev)
+		if maybeerr(w, err, 500, "db revision, %v", err) {
+			return nil
+		}
+		if rr == nil {
+			texterr(w, 404, "election %d has no rev %d", eid, rev)
+			return nil
+		}
+		data = rr.Data
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(data), &doc)
+	if maybeerr(w, err, 500, "election %d bad json, %v", eid, err) {
+		return nil
+	}
+	side.ElectionId = eid
+	side.Rev = rev
+	side.State, _ = edb.GetElectionState(eid)
+	if els := mapList(doc["Election"]); len(els) != 0 {
+		side.Title = docString(els[0]["Name"])
+	}
+	return doc
+}
+
+// GET /elections/compare?a={id}[@rev]&b={id}[@rev], signed in users
+func (sh *StudioHandler) handleElectionCompare(w http.ResponseWriter, r *http.Request, user *login.User) {
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	var sides [2]compareSide
+	var docs [2]map[string]interface{}
+	for i, name := range []string{"a", "b"} {
+		eid, rev, err := compareParam(r, name)
+		if maybeerr(w, err, 400, "%v", err) {
+			return
+		}
+		docs[i] = sh.compareDocument(r.Context(), w, eid, rev, &sides[i])
+		if docs[i] == nil {
+			return
+		}
+	}
+	ec := compareElections(docs[0], docs[1])
+	ec.A, ec.B = sides[0], sides[1]
+	writeJSON(w, ec)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+const testCompareProofed = `{
+  "Party": [{"@id": "p1", "Name": "Green"}, {"@id": "p2", "Name": "Blue"}],
+  "GpUnit": [{"@id": "g1", "Name": "Springfield"}, {"@id": "g2", "Name": "Ward 2"}],
+  "Election": [{"Name": "Spring", "StartDate": "2026-04-01",
+    "Candidate": [{"@id": "c1", "BallotName": "Ann", "PartyId": "p1"}, {"@id": "c2", "BallotName": "Bob"}, {"@id": "c9", "BallotName": "Dee"}],
+    "Contest": [
+      {"@id": "k1", "Name": "Mayor", "ElectionDistrictId": "g1", "VotesAllowed": 1, "ContestSelection": [{"@id": "s1", "CandidateIds": ["c1"]}, {"@id": "s2", "CandidateIds": ["c2"]}]},
+      {"@id": "k2", "Name": "Dog Catcher", "ContestSelection": [{"@id": "s9", "CandidateIds": ["c9"]}]},
+      {"@id": "m1", "Name": "Measure A", "FullText": {"Text": [{"Content": "Shall we?", "Language": "en"}]}, "ContestSelection": [{"@id": "y", "Selection": "Yes"}, {"@id": "n", "Selection": "No"}]}
+    ]}]
+}`
+
+// made separately: other @ids for the same mayor's race and measure
+const testCompareCertified = `{
+  "Party": [{"@id": "pa", "Name": "Green"}, {"@id": "pb", "Name": "Blue"}],
+  "GpUnit": [{"@id": "ga", "Name": "Springfield"}, {"@id": "gb", "Name": "Ward 2"}],
+  "Election": [{"Name": "Spring General", "StartDate": "2026-04-01",
+    "Candidate": [{"@id": "ca", "BallotName": "Ann", "PartyId": "pb"}, {"@id": "cc", "BallotName": "Cy"}],
+    "Contest": [
+      {"@id": "ka", "Name": "mayor", "ElectionDistrictId": "gb", "VotesAllowed": 2, "ContestSelection": [{"@id": "sa", "CandidateIds": ["ca"]}, {"@id": "sc", "CandidateIds": ["cc"]}, {"@id": "sw", "IsWriteIn": true}]},
+      {"@id": "ma", "Name": "Measure A", "FullText": {"Text": [{"Content": "Shall we now?", "Language": "en"}]}, "ContestSelection": [{"@id": "ya", "Selection": "Yes"}, {"@id": "na", "Selection": "No"}]},
+      {"@id": "kz", "Name": "Treasurer"}
+    ]}]
+}`
+
+func TestCompareElections(t *testing.T) {
+	var a, b map[string]interface{}
+	if err := json.Unmarshal([]byte(testCompareProofed), &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(testCompareCertified), &b); err != nil {
+		t.Fatal(err)
+	}
+	ec := compareElections(a, b)
+	if len(ec.Election) != 1 || ec.Election[0] != (textEdit{"Name", "Spring", "Spring General"}) {
+		t.Errorf("election %#v", ec.Election)
+	}
+	co := ec.Contests
+	if len(co.Added) != 1 || co.Added[0].Name != "Treasurer" || len(co.Removed) != 1 || co.Removed[0].Id != "k2" {
+		t.Errorf("contests added %#v removed %#v", co.Added, co.Removed)
+	}
+	if len(co.Changed) != 2 {
+		t.Fatalf("contests changed %#v", co.Changed)
+	}
+	mayor := co.Changed[0]
+	got, _ := json.Marshal(mayor)
+	want := `{"id":"ka","a_id":"k1","name":"mayor","text":[{"field":"District","a":"Springfield","b":"Ward 2"},{"field":"Name","a":"Mayor","b":"mayor"}],"fields":["VotesAllowed"],"selections_added":["Cy","Write-in"],"selections_removed":["Bob"]}`
+	if string(got) != want {
+		t.Errorf("mayor\n got %s\nwant %s", got, want)
+	}
+	measure := co.Changed[1]
+	if len(measure.Text) != 1 || measure.Text[0] != (textEdit{"FullText", "Shall we?", "Shall we now?"}) || len(measure.SelectionsAdded) != 0 {
+		t.Errorf("measure %#v", measure)
+	}
+	ca := ec.Candidates
+	if len(ca.Added) != 1 || ca.Added[0].Name != "Cy" || len(ca.Removed) != 2 {
+		t.Errorf("candidates added %#v removed %#v", ca.Added, ca.Removed)
+	}
+	if len(ca.Changed) != 1 || len(ca.Changed[0].Text) != 1 || ca.Changed[0].Text[0] != (textEdit{"Party", "Green", "Blue"}) {
+		t.Errorf("candidates changed %#v", ca.Changed)
+	}
+
+	// nothing changed, nothing to report
+	ec = compareElections(a, a)
+	if len(ec.Election)+len(ec.Contests.Added)+len(ec.Contests.Removed)+len(ec.Contests.Changed)+len(ec.Candidates.Changed) != 0 {
+		t.Errorf("same doc %#v", ec)
+	}
+}
+
+func TestElectionCompareHandler(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb}
+	user := &login.User{Guid: 7, Username: "ann"}
+
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: testCompareProofed})
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: testCompareCertified})
+	mtfail(t, err, "put election, %v", err)
+	other, err := edb.PutElection(electionRecord{Owner: 7, Data: testCompareProofed})
+	mtfail(t, err, "put election, %v", err)
+
+	compare := func(u *login.User, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sh.handleElectionCompare(rec, httptest.NewRequest("GET", "/elections/compare?"+query, nil), u)
+		return rec
+	}
+	if rec := compare(nil, fmt.Sprintf("a=%d&b=%d", other, eid)); rec.Code != 401 {
+		t.Errorf("anonymous %d", rec.Code)
+	}
+	for _, bad := range []string{"a=1", fmt.Sprintf("a=%d&b=x", eid), fmt.Sprintf("a=%d@0&b=%d", eid, eid)} {
+		if rec := compare(user, bad); rec.Code != 400 {
+			t.Errorf("%s %d", bad, rec.Code)
+		}
+	}
+	if rec := compare(user, fmt.Sprintf("a=%d@9&b=%d", eid, eid)); rec.Code != 404 {
+		t.Errorf("no such rev %d", rec.Code)
+	}
+
+	for _, query := range []string{fmt.Sprintf("a=%d&b=%d", other, eid), fmt.Sprintf("a=%d@1&b=%d@2", eid, eid)} {
+		rec := compare(user, query)
+		var ec electionComparison
+		if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &ec) != nil {
+			t.Fatalf("%s %d %s", query, rec.Code, rec.Body.String())
+		}
+		if ec.B.ElectionId != eid || ec.A.Title != "Spring" || ec.B.Title != "Spring General" || ec.B.State != StateDraft {
+			t.Errorf("%s sides %#v %#v", query, ec.A, ec.B)
+		}
+		if len(ec.Contests.Added) != 1 || len(ec.Contests.Removed) != 1 || len(ec.Contests.Changed) != 2 {
+			t.Errorf("%s contests %#v", query, ec.Contests)
+		}
+	}
+
+	err = edb.TrashElection(other, time.Now())
+	mtfail(t, err, "trash, %v", err)
+	if rec := compare(user, fmt.Sprintf("a=%d&b=%d", other, eid)); rec.Code != 404 {
+		t.Errorf("trashed %d", rec.Code)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+// Conditional and Range GET for rendered PDFs, PNGs and bubbles. The ETag
+// is a hash of the bytes served, so it changes with the document, the
+// render options and the renderer. Last-Modified is when the document was
+// last saved. Cache-Control: no-cache lets a browser keep its copy but
+// check it each time, and a 304 answers that without sending the file
+// again. Range requests let a PDF viewer show the first pages of a big
+// multi-style ballot before the rest arrives.
+
+func artifactETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return sumETag(sum[:])
+}
+
+// sumETag is artifactETag from the body's sha256
+func sumETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// electionModified is when election el's document last changed, zero if not known
+func (sh *StudioHandler) electionModified(el string) time.Time {
+	electionid, err := strconv.ParseInt(el, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	revs, err := sh.edb.ElectionRevisions(electionid)
+	if err != nil || len(revs) == 0 {
+		return time.Time{}
+	}
+	return revisionTime(revs[len(revs)-1])
+}
+
+// renderModified is electionModified, or zero for a stale render, which is older than the document
+func (sh *StudioHandler) renderModified(el string, note *staleNote) time.Time {
+	if note.stale {
+		return time.Time{}
+	}
+	return sh.electionModified(el)
+}
+
+// revisionTime is zero for revisions from before they had times
+func revisionTime(rr revisionRecord) time.Time {
+	if rr.Created == 0 {
+		return time.Time{}
+	}
+	return time.Unix(rr.Created, 0)
+}
+
+// writeArtifact sends body with validators, answering conditional and
+// Range requests. modified may be zero.
+func writeArtifact(w http.ResponseWriter, r *http.Request, contentType string, body []byte, modified time.Time) {
+	writeCachedArtifact(w, r, contentType, body, modified, "no-cache")
+}
+
+// writeCachedArtifact is writeArtifact with other caching than no-cache,
+// for public pages a shared cache may keep
+func writeCachedArtifact(w http.ResponseWriter, r *http.Request, contentType string, body []byte, modified time.Time, cacheControl string) {
+	h := w.Header()
+	h.Set("ETag", artifactETag(body))
+	h.Set("Cache-Control", cacheControl)
+	h.Set("Content-Type", contentType)
+	// also does If-None-Match, If-Modified-Since, If-Range and HEAD
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
+
+// writePdfArtifact is writeCachedArtifact for a render's PDF, streamed from
+// its spool file if it has one rather than read into memory
+func writePdfArtifact(w http.ResponseWriter, r *http.Request, bothob *draw.DrawBothOb, modified time.Time, cacheControl string) {
+	pdf, err := bothob.OpenPdf()
+	if maybeerr(w, err, 500, "render spool, %v", err) {
+		return
+	}
+	defer pdf.Close()
+	h := w.Header()
+	h.Set("ETag", sumETag(bothob.PdfSum()))
+	h.Set("Cache-Control", cacheControl)
+	h.Set("Content-Type", "application/pdf")
+	http.ServeContent(w, r, "", modified, pdf)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+func TestWriteArtifact(t *testing.T) {
+	body := []byte("%PDF ballot")
+	modified := time.Date(2026, 3, 4, 5, 6, 7, 800, time.UTC)
+	get := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/election/1.pdf", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		writeArtifact(rec, r, "application/pdf", body, modified)
+		return rec
+	}
+	rec := get("", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 200 || rec.Body.String() != string(body) || etag == "" || rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("first get %d %v", rec.Code, rec.Header())
+	}
+	if lm := rec.Header().Get("Last-Modified"); lm != "Wed, 04 Mar 2026 05:06:07 GMT" {
+		t.Errorf("Last-Modified %q", lm)
+	}
+	for _, tc := range []struct {
+		header, value string
+		code          int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other", W/` + etag, http.StatusNotModified},
+		{"If-None-Match", `"other"`, 200},
+		{"If-Modified-Since", "Wed, 04 Mar 2026 05:06:07 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Wed, 04 Mar 2026 05:06:06 GMT", 200},
+		{"If-Modified-Since", "not a date", 200},
+	} {
+		rec = get(tc.header, tc.value)
+		if rec.Code != tc.code {
+			t.Errorf("%s: %s got %d", tc.header, tc.value, rec.Code)
+		}
+		if rec.Code == http.StatusNotModified && (rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag) {
+			t.Errorf("304 with body or no ETag")
+		}
+	}
+	// If-None-Match wins
+	r := httptest.NewRequest("GET", "/election/1.pdf", nil)
+	r.Header.Set("If-None-Match", `"other"`)
+	r.Header.Set("If-Modified-Since", "Wed, 04 Mar 2026 05:06:07 GMT")
+	rec = httptest.NewRecorder()
+	writeArtifact(rec, r, "application/pdf", body, modified)
+	if rec.Code != 200 {
+		t.Errorf("both validators got %d", rec.Code)
+	}
+
+	// a render's PDF gets the same validators
+	rec = httptest.NewRecorder()
+	writePdfArtifact(rec, httptest.NewRequest("GET", "/election/1.pdf", nil), &draw.DrawBothOb{Pdf: body}, modified, "no-cache")
+	if rec.Code != 200 || rec.Body.String() != string(body) || rec.Header().Get("ETag") != etag {
+		t.Errorf("render pdf %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestWriteArtifactRange(t *testing.T) {
+	body := []byte("%PDF-1.4 0123456789")
+	r := httptest.NewRequest("GET", "/election/1.pdf", nil)
+	r.Header.Set("Range", "bytes=0-7")
+	rec := httptest.NewRecorder()
+	writeArtifact(rec, r, "application/pdf", body, time.Time{})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "%PDF-1.4" {
+		t.Errorf("range got %d %q", rec.Code, rec.Body.String())
+	}
+	if cr := rec.Header().Get("Content-Range"); cr != "bytes 0-7/19" {
+		t.Errorf("Content-Range %q", cr)
+	}
+
+	// a stale If-Range gets the whole thing
+	r.Header.Set("If-Range", `"old"`)
+	rec = httptest.NewRecorder()
+	writeArtifact(rec, r, "application/pdf", body, time.Time{})
+	if rec.Code != 200 || rec.Body.Len() != len(body) || rec.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("If-Range old got %d %d bytes", rec.Code, rec.Body.Len())
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config file and environment settings.
+//
+// Every command line flag can also be set by a -config file or a
+// BALLOTSTUDIO_{FLAG_NAME} environment variable (e.g. BALLOTSTUDIO_RENDER_RATE).
+// Precedence is command line, then environment, then config file, then default.
+// Config files are flat; TOML (`key = value`) or, for .yaml/.yml, YAML (`key: value`).
+// Keys are flag names; '_' may be used for '-'.
+
+const configEnvPrefix = "BALLOTSTUDIO_"
+
+// flags that are not config settings themselves
+var configSkipFlags = map[string]bool{
+	"config":       true,
+	"print-config": true,
+}
+
+// flags whose values are not printed by -print-config
+var configSecretFlags = map[string]bool{
+	"cookie-key":    true,
+	"postgres":      true,
+	"mysql":         true,
+	"login-db":      true,
+	"smtp-password": true,
+	"share-key":     true,
+	"id-key":        true,
+	"oidc-key":      true,
+	"saml-key":      true,
+}
+
+func configKeyFlag(key string) string {
+	return strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+}
+
+func flagEnvName(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseConfig reads flat `key = value` (or `key: value` if yaml) lines
+func parseConfig(r io.Reader, yaml bool) (map[string]string, error) {
+	sep := "="
+	if yaml {
+		sep = ":"
+	}
+	out := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || (yaml && line == "---") {
+			continue
+		}
+		if line[0] == '[' {
+			return nil, fmt.Errorf("line %d: config sections are not supported, settings are top level", lineno)
+		}
+		i := strings.Index(line, sep)
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key %s value", lineno, sep)
+		}
+		key := configKeyFlag(line[:i])
+		value, err := configValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", lineno, key, err)
+		}
+		out[key] = value
+	}
+	return out, scanner.Err()
+}
+
+// unquote a value and strip any trailing comment
+func configValue(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	switch v[0] {
+	case '"':
+		end := strings.LastIndex(v, "\"")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return strconv.Unquote(v[:end+1])
+	case '\'':
+		end := strings.LastIndex(v, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return v[1:end], nil
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
+
+func parseConfigFile(path string) (map[string]string, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	ext := strings.ToLower(filepath.Ext(path))
+	settings, err := parseConfig(fin, ext == ".yaml" || ext == ".yml")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return settings, nil
+}
+
+// applyConfig sets flags that were not given on the command line,
+// from environment variables and then the config file settings.
+func applyConfig(fs *flag.FlagSet, settings map[string]string, getenv func(string) string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var problems []string
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if fs.Lookup(key) == nil || configSkipFlags[key] {
+			problems = append(problems, fmt.Sprintf("config: unknown setting %#v", key))
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || configSkipFlags[f.Name] {
+			return
+		}
+		source := flagEnvName(f.Name)
+		value := getenv(source)
+		if value == "" {
+			var ok bool
+			value, ok = settings[f.Name]
+			if !ok {
+				return
+			}
+			source = "config " + f.Name
+		}
+		err := fs.Set(f.Name, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: bad value %#v, %v", source, value, err))
+		}
+	})
+	if len(problems) != 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// printConfig writes current settings in config file (TOML) form
+func printConfig(fs *flag.FlagSet, w io.Writer) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if configSkipFlags[f.Name] {
+			return
+		}
+		fmt.Fprintf(w, "# %s\n", f.Usage)
+		value := f.Value.String()
+		if configSecretFlags[f.Name] && value != "" {
+			fmt.Fprintf(w, "# %s = (set, not shown)\n", f.Name)
+			return
+		}
+		if _, err := strconv.ParseFloat(value, 64); err == nil || value == "true" || value == "false" {
+			fmt.Fprintf(w, "%s = %s\n", f.Name, value)
+		} else {
+			fmt.Fprintf(w, "%s = %s\n", f.Name, strconv.Quote(value))
+		}
+	})
+}
+
+// serverConfigProblems checks settings that parse fine but don't make sense together
+func serverConfigProblems(fs *flag.FlagSet) (problems []string) {
+	getf := func(name string) float64 {
+		v, _ := strconv.ParseFloat(fs.Lookup(name).Value.String(), 64)
+		return v
+	}
+	if fs.Lookup("http").Value.String() == "" {
+		problems = append(problems, "http: listen address is required")
+	}
+	var dbs []string
+	for _, name := range []string{"sqlite", "postgres", "mysql"} {
+		if fs.Lookup(name) != nil && fs.Lookup(name).Value.String() != "" {
+			dbs = append(dbs, name)
+		}
+	}
+	if len(dbs) > 1 {
+		problems = append(problems, fmt.Sprintf("%s are all set, pick one database", strings.Join(dbs, " and ")))
+	}
+	for _, name := range []string{"render-rate", "render-burst", "scan-rate", "scan-burst", "login-rate", "login-burst", "max-uploads", "max-scan-uploads", "max-doc-uploads", "max-upload-bytes", "draw-concurrency", "draw-retries", "draw-breaker-failures", "pdftopng-concurrency", "pdftopng-queue", "max-header-bytes"} {
+		if fs.Lookup(name) != nil && getf(name) < 0 {
+			problems = append(problems, fmt.Sprintf("%s: must not be negative", name))
+		}
+	}
+	if fs.Lookup("tls-cert") != nil {
+		cert, key := fs.Lookup("tls-cert").Value.String(), fs.Lookup("tls-key").Value.String()
+		if (cert == "") != (key == "") {
+			problems = append(problems, "tls-cert, tls-key: set both or neither")
+		}
+	}
+	if getf("scan-max-bytes") <= 0 {
+		problems = append(problems, "scan-max-bytes: must be positive")
+	}
+	if fs.Lookup("cors-origins") != nil {
+		_, err := parseCORSOrigins(fs.Lookup("cors-origins").Value.String())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("cors-origins: %v", err))
+		}
+	}
+	if fs.Lookup("trusted-proxies") != nil {
+		_, err := parseTrustedProxies(fs.Lookup("trusted-proxies").Value.String())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("trusted-proxies: %v", err))
+		}
+	}
+	if fs.Lookup("base-url") != nil {
+		_, err := parseBaseURL(fs.Lookup("base-url").Value.String())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("base-url: %v", err))
+		}
+	}
+	if fs.Lookup("sqlite-journal-mode") != nil {
+		sp := sqlitePragmas{
+			JournalMode: fs.Lookup("sqlite-journal-mode").Value.String(),
+			Synchronous: fs.Lookup("sqlite-synchronous").Value.String(),
+		}
+		sp.BusyTimeout, _ = time.ParseDuration(fs.Lookup("sqlite-busy-timeout").Value.String())
+		problems = append(problems, sp.problems()...)
+	}
+	return
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	toml := `# comment
+http = ":9000"
+render_rate = 3.5 # per second
+sqlite = 'bs.sqlite'
+debug = true
+`
+	settings, err := parseConfig(strings.NewReader(toml), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"http": ":9000", "render-rate": "3.5", "sqlite": "bs.sqlite", "debug": "true"}
+	for k, v := range want {
+		if settings[k] != v {
+			t.Errorf("toml %s wanted %#v got %#v", k, v, settings[k])
+		}
+	}
+
+	yaml := "---\nhttp: \":9000\"\nscan-rate: 0\n"
+	settings, err = parseConfig(strings.NewReader(yaml), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings["http"] != ":9000" || settings["scan-rate"] != "0" {
+		t.Errorf("yaml got %#v", settings)
+	}
+
+	_, err = parseConfig(strings.NewReader("[server]\nhttp = \":1\"\n"), false)
+	if err == nil {
+		t.Errorf("sections should be an error")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	a := fs.String("a-b", "default", "")
+	c := fs.Int("c", 1, "")
+	d := fs.Int("d", 1, "")
+	fs.String("config", "", "")
+	err := fs.Parse([]string{"-d", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"BALLOTSTUDIO_C": "3", "BALLOTSTUDIO_D": "5"}
+	settings := map[string]string{"a-b": "file", "c": "2", "d": "2"}
+	err = applyConfig(fs, settings, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// command line > env > file > default
+	if *a != "file" || *c != 3 || *d != 4 {
+		t.Errorf("got a=%#v c=%d d=%d", *a, *c, *d)
+	}
+
+	err = applyConfig(fs, map[string]string{"bogus": "1"}, func(string) string { return "" })
+	if err == nil {
+		t.Errorf("unknown setting should be an error")
+	}
+	fs2 := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs2.Int("c", 1, "")
+	err = applyConfig(fs2, map[string]string{"c": "x"}, func(string) string { return "" })
+	if err == nil {
+		t.Errorf("bad int should be an error")
+	}
+}
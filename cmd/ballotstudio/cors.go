@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS for single page apps on other origins that use the API. Origins in
+// -cors-origins may make credentialed requests (the login cookie) and, since
+// they can't read this site's CSRF cookie, are trusted in place of a CSRF
+// token. "*" lets any origin read without credentials.
+
+// corsPathPrefixes are the API routes CORS applies to. Add new API routes here.
+var corsPathPrefixes = []string{"/election", "/scan", "/share/", "/trash", "/digest", "/admin/", "/webhooks", "/library", "/print/", "/sample/", "/notifications", "/account", "/openapi.json", "/formats"}
+
+const corsAllowMethods = "GET, HEAD, POST, PUT, DELETE"
+
+// request headers a cross-origin client may send
+const corsAllowHeaders = "Authorization, Content-Type, X-CSRF-Token, If-None-Match, If-Modified-Since, If-Range, Range"
+
+// response headers a cross-origin client may read, besides the CORS-safelisted ones
+const corsExposeHeaders = "ETag, X-Election-State, Content-Disposition, Content-Range, Accept-Ranges"
+
+// parseCORSOrigins parses the comma separated -cors-origins flag
+func parseCORSOrigins(s string) (origins map[string]bool, err error) {
+	origins = make(map[string]bool)
+	for _, origin := range strings.Split(s, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+				return nil, fmt.Errorf("bad origin %q, want scheme://host[:port]", origin)
+			}
+			origin = u.Scheme + "://" + u.Host
+		}
+		origins[origin] = true
+	}
+	return origins, nil
+}
+
+func corsPath(path string) bool {
+	for _, prefix := range corsPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHandler adds CORS headers for allowed origins and answers preflight
+// OPTIONS requests itself
+type corsHandler struct {
+	sub     http.Handler
+	origins map[string]bool
+}
+
+// corsTrusted is true if origin is listed by name, so its requests can skip the CSRF check
+func corsTrusted(origins map[string]bool, origin string) bool {
+	return origin != "" && origin != "*" && origins[origin]
+}
+
+func (ch *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(ch.origins) == 0 || !corsPath(r.URL.Path) {
+		ch.sub.ServeHTTP(w, r)
+		return
+	}
+	hdr := w.Header()
+	hdr.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !(ch.origins[origin] || ch.origins["*"]) {
+		ch.sub.ServeHTTP(w, r)
+		return
+	}
+	if corsTrusted(ch.origins, origin) {
+		hdr.Set("Access-Control-Allow-Origin", origin)
+		hdr.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		hdr.Set("Access-Control-Allow-Origin", "*")
+	}
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		hdr.Set("Access-Control-Allow-Methods", corsAllowMethods)
+		hdr.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		hdr.Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	hdr.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	ch.sub.ServeHTTP(w, r)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	for _, bad := range []string{"app.example.com", "https://app.example.com/path", "ftp://x"} {
+		if _, err := parseCORSOrigins(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+	origins, err := parseCORSOrigins(" https://app.example.com/, http://localhost:3000")
+	mtfail(t, err, "parse, %v", err)
+	if len(origins) != 2 || !origins["https://app.example.com"] || !origins["http://localhost:3000"] {
+		t.Fatalf("origins %v", origins)
+	}
+
+	reached := false
+	sub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true })
+	ch := &corsHandler{&csrfHandler{sub: sub, origins: origins}, origins}
+	do := func(method, path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		reached = false
+		rec := httptest.NewRecorder()
+		ch.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("OPTIONS", "/election/1", "https://app.example.com")
+	if rec.Code != 204 || reached || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || rec.Header().Get("Access-Control-Allow-Methods") != corsAllowMethods {
+		t.Errorf("preflight %d %v", rec.Code, rec.Header())
+	}
+	// a trusted origin doesn't need a CSRF token
+	rec = do("POST", "/election/1", "https://app.example.com")
+	if rec.Code != 200 || !reached || rec.Header().Get("Access-Control-Allow-Credentials") != "true" || rec.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Errorf("trusted post %d %v", rec.Code, rec.Header())
+	}
+	rec = do("POST", "/election/1", "https://evil.example.com")
+	if rec.Code != 403 || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin %d %v", rec.Code, rec.Header())
+	}
+	// html pages aren't API
+	rec = do("GET", "/edit/1", "https://app.example.com")
+	if !reached || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("edit page %v", rec.Header())
+	}
+
+	anyone, _ := parseCORSOrigins("*")
+	ch = &corsHandler{&csrfHandler{sub: sub, origins: anyone}, anyone}
+	rec = do("GET", "/election/1.pdf", "https://evil.example.com")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("* get %v", rec.Header())
+	}
+	rec = do("POST", "/election/1", "https://evil.example.com")
+	if rec.Code != 403 {
+		t.Errorf("* post skipped csrf, %d", rec.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// CSRF protection by double submit. Every browser gets a random token in a
+// SameSite=Lax cookie, and a POST, PUT or DELETE must send the same token back
+// in an X-CSRF-Token header (index.js and scan.js), a csrf form field
+// (urlencoded forms) or a ?csrf= query parameter (multipart forms, whose
+// handlers stream the body). Another site can make a browser send the cookie
+// but can't read it to send the copy.
+//
+// A request with an Authorization header is an API client, not a browser
+// form, and is let through; a browser won't add that header cross-site
+// without a CORS preflight. Requests from an origin listed in -cors-origins
+// are let through too, see cors.go.
+
+const csrfCookieName = "csrf"
+const csrfHeader = "X-CSRF-Token"
+const csrfField = "csrf"
+
+// bytes of randomness in a token
+const csrfTokenBytes = 24
+
+type csrfTokenKey struct{}
+
+// csrfToken is the token forms on the page being served to r must send back
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfTokenKey{}).(string)
+	return token
+}
+
+func validCSRFToken(token string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(raw) == csrfTokenBytes
+}
+
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// csrfHandler checks state changing requests to sub. Paths in exempt are
+// passed through, e.g. oauth callbacks that come back as a POST from the
+// provider.
+type csrfHandler struct {
+	sub     http.Handler
+	exempt  map[string]bool
+	origins map[string]bool // -cors-origins
+}
+
+func (ch *csrfHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var token string
+	if c, err := r.Cookie(csrfCookieName); err == nil && validCSRFToken(c.Value) {
+		token = c.Value
+	}
+	check := !csrfSafeMethod(r.Method) && r.Header.Get("Authorization") == "" && !ch.exempt[r.URL.Path]
+	if check && !corsTrusted(ch.origins, r.Header.Get("Origin")) {
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submittedCSRF(r))) != 1 {
+			log.Printf("%s %s: bad csrf token", r.Method, r.URL.Path)
+			texterr(w, http.StatusForbidden, "bad or missing CSRF token, reload the page and try again")
+			return
+		}
+	}
+	if token == "" {
+		raw := make([]byte, csrfTokenBytes)
+		rand.Read(raw)
+		token = base64.RawURLEncoding.EncodeToString(raw)
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true, // pages get it from the template, not document.cookie
+			Secure:   requestScheme(r) == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	ch.sub.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfTokenKey{}, token)))
+}
+
+// submittedCSRF is the token a request sent back, "" if none
+func submittedCSRF(r *http.Request) string {
+	if v := r.Header.Get(csrfHeader); v != "" {
+		return v
+	}
+	if v := r.URL.Query().Get(csrfField); v != "" {
+		return v
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		// the handler's own ParseForm later is a no-op
+		r.ParseForm()
+		return r.PostForm.Get(csrfField)
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	var seenToken, seenBody string
+	ch := &csrfHandler{
+		sub: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seenToken = csrfToken(r)
+			r.ParseForm()
+			seenBody = r.PostForm.Get("username")
+			if r.PostForm.Get("username") == "" && r.Body != nil {
+				body, _ := ioutil.ReadAll(r.Body)
+				seenBody = string(body)
+			}
+		}),
+		exempt: map[string]bool{"/oauth/callback": true},
+	}
+
+	// first visit gets a token cookie
+	rec := httptest.NewRecorder()
+	ch.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName || cookies[0].Value != seenToken || !validCSRFToken(seenToken) {
+		t.Fatalf("cookies %v token %q", cookies, seenToken)
+	}
+	token := seenToken
+	// and keeps it
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	ch.ServeHTTP(rec, req)
+	if len(rec.Result().Cookies()) != 0 || seenToken != token {
+		t.Errorf("token changed, %q", seenToken)
+	}
+
+	post := func(target, contentType, body, header string, cookie bool) int {
+		req := httptest.NewRequest("POST", target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if header != "" {
+			req.Header.Set(csrfHeader, header)
+		}
+		if cookie {
+			req.AddCookie(cookies[0])
+		}
+		seenBody = ""
+		rec := httptest.NewRecorder()
+		ch.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	form := url.Values{"username": {"ann"}, csrfField: {token}}.Encode()
+	if code := post("/signup/x", "application/x-www-form-urlencoded", form, "", true); code != 200 || seenBody != "ann" {
+		t.Errorf("form post %d %q", code, seenBody)
+	}
+	if code := post("/election/1", "application/json", "{}", token, true); code != 200 || seenBody != "{}" {
+		t.Errorf("header post %d %q", code, seenBody)
+	}
+	if code := post("/election/1/scan?csrf="+token, "multipart/form-data; boundary=x", "--x--", "", true); code != 200 || seenBody != "--x--" {
+		t.Errorf("query post %d %q", code, seenBody)
+	}
+	for _, bad := range []struct {
+		header string
+		cookie bool
+	}{{"", true}, {token, false}, {"AAAA" + token[4:], true}} {
+		if code := post("/election/1", "application/json", "{}", bad.header, bad.cookie); code != 403 {
+			t.Errorf("%#v got %d", bad, code)
+		}
+	}
+	if code := post("/oauth/callback", "application/x-www-form-urlencoded", "code=1", "", false); code != 200 {
+		t.Errorf("exempt path %d", code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/digest", nil)
+	req.Header.Set("Authorization", "Bearer x")
+	rec = httptest.NewRecorder()
+	ch.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("api client %d", rec.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// GET /election/{id}/cvr.json is the cast vote records: every stored scan's
+// marks with where the paper came from, election owner only.
+
+// one scanned ballot's votes
+type castVoteRecord struct {
+	// Ballot numbers scans from 1 in scan id order, as /audit samples them
+	Ballot      int         `json:"ballot"`
+	ScanId      int64       `json:"scan"`
+	Custody     scanCustody `json:"custody"`
+	Created     int64       `json:"created"` // upload time, unix seconds
+	Interpreter string      `json:"interpreter"`
+	ImageSha256 string      `json:"image_sha256"`
+
+	// contest id -> selection id -> marked
+	Votes map[string]map[string]bool `json:"votes"`
+}
+
+type cvrExport struct {
+	ElectionId int64            `json:"itemid"`
+	Records    []castVoteRecord `json:"records"`
+	Generated  time.Time        `json:"generated"`
+}
+
+func (sh *StudioHandler) handleElectionCVR(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	edb := sh.edb.WithContext(r.Context())
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	sids, err := edb.ScansForElection(electionid)
+	if maybeerr(w, err, 500, "db scans, %v", err) {
+		return
+	}
+	out := cvrExport{ElectionId: electionid, Records: make([]castVoteRecord, 0, len(sids)), Generated: time.Now().UTC()}
+	for i, sid := range sids {
+		sr, err := edb.GetScan(sid)
+		if maybeerr(w, err, 500, "db scan %d, %v", sid, err) {
+			return
+		}
+		cvr := castVoteRecord{
+			Ballot:      i + 1,
+			ScanId:      sid,
+			Custody:     sr.Custody,
+			Created:     sr.Created,
+			Interpreter: sr.Interpreter,
+			ImageSha256: sha256Hex(sr.Image),
+		}
+		err = json.Unmarshal([]byte(sr.Result), &cvr.Votes)
+		if maybeerr(w, err, 500, "scan %d result, %v", sid, err) {
+			return
+		}
+		out.Records = append(out.Records, cvr)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%d_cvr.json\"", electionid))
+	writeJSON(w, out)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestElectionCVR(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	custody := scanCustody{"scanner-3", "pat", "12", "Ward 4"}
+	for _, result := range []string{`{"ccont1":{"csel1":true}}`, `{"ccont1":{"csel2":true}}`} {
+		_, err = edb.PutScan(scanRecord{ElectionId: eid, Image: []byte(result), Interpreter: "1", Result: result, Created: 1700000000, Custody: custody})
+		mtfail(t, err, "put scan, %v", err)
+	}
+
+	get := func(user *login.User) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sh.handleElectionCVR(rec, httptest.NewRequest("GET", "/election/1/cvr.json", nil), user, eid)
+		return rec
+	}
+	if rec := get(nil); rec.Code != 401 {
+		t.Errorf("no user %d", rec.Code)
+	}
+	if rec := get(&login.User{Guid: 8}); rec.Code != 403 {
+		t.Errorf("not owner %d", rec.Code)
+	}
+	rec := get(&login.User{Guid: 7})
+	var out cvrExport
+	json.Unmarshal(rec.Body.Bytes(), &out)
+	if rec.Code != 200 || len(out.Records) != 2 {
+		t.Fatalf("cvr %d %s", rec.Code, rec.Body.String())
+	}
+	second := out.Records[1]
+	if second.Ballot != 2 || second.Custody != custody || !second.Votes["ccont1"]["csel2"] || second.ImageSha256 != sha256Hex([]byte(`{"ccont1":{"csel2":true}}`)) {
+		t.Errorf("record %#v", second)
+	}
+}
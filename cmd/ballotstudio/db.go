@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 )
 
@@ -13,53 +13,312 @@ type electionRecord struct {
 	Owner int64
 	Data  string // json
 	Meta  string // json
+
+	Trashed int64 // unix seconds, 0 if not in the trash
+}
+
+// one uploaded scan and how it was read
+type scanRecord struct {
+	Id          int64
+	ElectionId  int64
+	Owner       int64 // uploading user, 0 if anonymous
+	Image       []byte
+	ContentType string
+	Interpreter string // scan.InterpreterVersion that produced Result
+	Result      string // json
+	Created     int64  // unix seconds
+	Custody     scanCustody
+	Rev         int // revision of the election read against, 0 if from before they were kept
+}
+
+// where a scanned ballot came from, given with the upload for auditors
+type scanCustody struct {
+	Device   string `json:"device"` // scanner id
+	Operator string `json:"operator"`
+	Batch    string `json:"batch"`
+	Precinct string `json:"precinct"`
+}
+
+// a reviewer's pin on a rendered page
+type annotationRecord struct {
+	Id         int64   `json:"id"`
+	ElectionId int64   `json:"itemid"`
+	Page       int     `json:"page"` // 0 based, as /election/{id}.{page}.png
+	X          float64 `json:"x"`    // fraction of page width from the left
+	Y          float64 `json:"y"`    // fraction of page height from the top
+	Comment    string  `json:"comment"`
+	Author     int64   `json:"author"`
+	AuthorName string  `json:"author_name"`
+	Created    int64   `json:"created"` // unix seconds
+}
+
+// a user's weekly digest email
+type digestSchedule struct {
+	UserId   int64  `json:"user"`
+	Email    string `json:"email"`
+	Weekday  int    `json:"weekday"`   // 0 is Sunday
+	Hour     int    `json:"hour"`      // UTC
+	LastSent int64  `json:"last_sent"` // unix seconds
+}
+
+// a provisioned election office staff member, see staff.go
+type staffRecord struct {
+	Email        string `json:"email"`
+	Role         string `json:"role"`
+	Organization string `json:"organization"`
+	UserId       int64  `json:"user,omitempty"`   // 0 until they sign up
+	Invite       string `json:"invite,omitempty"` // signup token
+	Provisioned  int64  `json:"provisioned"`      // unix seconds
+}
+
+// one saved version of an election document
+type revisionRecord struct {
+	ElectionId int64  `json:"election"`
+	Rev        int    `json:"rev"`
+	Data       string `json:"-"`
+	Size       int    `json:"size"`
+	Created    int64  `json:"created"` // unix seconds, 0 if from before revisions were kept
 }
 
 // edb for short
 type electionAppDB interface {
+	// Setup applies any schema migrations not yet applied
 	Setup() error
+	Migrator() *migrator
+	// WithContext is the same database with queries run under ctx, see dbctx.go
+	WithContext(ctx context.Context) electionAppDB
+
 	GetElection(id int64) (*electionRecord, error)
 	PutElection(electionRecord) (newid int64, err error)
+	// PutElectionIf saves er.Data as election er.Id's document if it is
+	// still old, ok false if someone else saved it since
+	PutElectionIf(er electionRecord, old string) (ok bool, err error)
+	// SetElectionMeta saves election id's settings, leaving its document as it is
+	SetElectionMeta(id int64, meta string) error
 	ElectionsForUser(uid int64) (ids []int64, err error)
 	MakeInviteToken(token string, expires time.Time) error
 	PeekInviteToken(token string) (ok bool, expires time.Time, err error)
 	UseInviteToken(token string) (ok bool, err error)
-	GCInviteTokens() (err error)
+	// GCInviteTokens deletes expired invite tokens
+	GCInviteTokens() (removed int64, err error)
+	PutScan(sr scanRecord) (newid int64, err error)
+	GetScan(id int64) (*scanRecord, error)
+	ScansForElection(eid int64) (ids []int64, err error)
+	UpdateScanResult(id int64, interpreter, result string) error
+
+	// for backup and restore
+	ElectionIds() (ids []int64, err error)
+	// RestoreElection and RestoreScan insert a record keeping its Id
+	RestoreElection(er electionRecord) error
+	RestoreScan(sr scanRecord) error
+
+	// TrashElection hides an election from listings and rendering until
+	// UntrashElection, or until PurgeTrash deletes it.
+	TrashElection(id int64, when time.Time) error
+	UntrashElection(id int64) error
+	TrashedForUser(uid int64) (ids []int64, err error)
+	// PurgeTrash deletes elections trashed before `before`, with their scans, state, revisions, search text, tags and webhooks
+	PurgeTrash(before time.Time) (purged int64, err error)
+	// StaleDrafts lists drafts, not in the trash, last saved before `before`
+	StaleDrafts(before time.Time) (ids []int64, err error)
+
+	PutAnnotation(ar annotationRecord) (newid int64, err error)
+	// AnnotationsForElection returns annotations in the order they were made
+	AnnotationsForElection(eid int64) ([]annotationRecord, error)
+	DeleteAnnotation(eid, id int64) error
+
+	// GetElectionState returns StateDraft if never set
+	GetElectionState(id int64) (state string, err error)
+	// SetElectionState changes state only if it is currently `from`
+	SetElectionState(id int64, from, to string) (ok bool, err error)
+
+	// PutDigestSchedule replaces any schedule for ds.UserId
+	PutDigestSchedule(ds digestSchedule) error
+	// GetDigestSchedule returns nil if the user has none
+	GetDigestSchedule(uid int64) (*digestSchedule, error)
+	DeleteDigestSchedule(uid int64) error
+	DigestSchedules() ([]digestSchedule, error)
+
+	// PutNotifyPrefs replaces any settings for np.UserId
+	PutNotifyPrefs(np notifyPrefs) error
+	// GetNotifyPrefs and NotifyPrefsForUsername return nil if the user has none
+	GetNotifyPrefs(uid int64) (*notifyPrefs, error)
+	NotifyPrefsForUsername(username string) (*notifyPrefs, error)
+	DeleteNotifyPrefs(uid int64) error
+	AllNotifyPrefs() ([]notifyPrefs, error)
+
+	// PutStaff replaces any record for sr.Email
+	PutStaff(sr staffRecord) error
+	// GetStaff, StaffByInvite and StaffForUser return nil if there's no such staff member
+	GetStaff(email string) (*staffRecord, error)
+	StaffByInvite(token string) (*staffRecord, error)
+	StaffForUser(uid int64) (*staffRecord, error)
+	StaffList() ([]staffRecord, error)
+
+	// ElectionRevisions lists the saved versions of an election, oldest
+	// first, without their Data. PutElection and RestoreElection add them.
+	ElectionRevisions(eid int64) ([]revisionRecord, error)
+	// GetElectionRevision returns nil if there's no such revision
+	GetElectionRevision(eid int64, rev int) (*revisionRecord, error)
+	// RestoreRevisions replaces eid's revisions with revs, keeping their numbers and times
+	RestoreRevisions(eid int64, revs []revisionRecord) error
+
+	// SearchElections finds untrashed elections owned by uid or published
+	// with a word starting with each of terms (from searchTerms), best first
+	SearchElections(terms []string, uid int64, limit int) ([]searchRecord, error)
+
+	// ElectionFacts lists untrashed elections matching f by date, then id
+	ElectionFacts(f factsFilter) ([]electionFacts, error)
+
+	// UserUsage is what uid's untrashed elections store, see quota.go
+	UserUsage(uid int64) (quotaUsage, error)
+	// GetUserQuota returns nil if uid has the default limits
+	GetUserQuota(uid int64) (*quotaLimits, error)
+	// SetUserQuota gives uid other limits, or nil for the defaults
+	SetUserQuota(uid int64, q *quotaLimits) error
+	// PruneRevisions drops all but eid's newest keep revisions, except those scans were read against
+	PruneRevisions(eid int64, keep int64) error
+
+	// GetAccount returns nil if uid has never set a profile, see account.go
+	GetAccount(uid int64) (*accountRecord, error)
+	// PutAccount replaces any profile for ar.UserId
+	PutAccount(ar accountRecord) error
+	// DeleteAccount purges uid's elections, or gives them to electionsTo if
+	// that isn't 0, deletes uid's settings and marks the account deleted
+	DeleteAccount(uid, electionsTo int64) (purged int64, err error)
+	// ListAccounts is every user with records here, see listAccounts
+	ListAccounts() ([]accountSummary, error)
+
+	// GetExternalIdentity returns nil if subject of issuer has never signed in, see extlogin.go
+	GetExternalIdentity(issuer, subject string) (*externalIdentity, error)
+	PutExternalIdentity(ei externalIdentity) error
+
+	// ElectionTags returns eid's tags sorted
+	ElectionTags(eid int64) ([]string, error)
+	// SetElectionTags replaces eid's tags
+	SetElectionTags(eid int64, tags []string) error
+	// TagsForUser maps uid's untrashed elections that have tags to their tags
+	TagsForUser(uid int64) (map[int64][]string, error)
+
+	PutWebhook(wh webhookRecord) (newid int64, err error)
+	// GetWebhook returns nil if there's no such webhook
+	GetWebhook(id int64) (*webhookRecord, error)
+	WebhooksForUser(uid int64) ([]webhookRecord, error)
+	// WebhooksForElection are the webhooks on eid and on all of its owner's elections
+	WebhooksForElection(eid int64) ([]webhookRecord, error)
+	// DeleteWebhook deletes a webhook and its deliveries
+	DeleteWebhook(id int64) error
+	// PutWebhookDelivery queues d if its Id is 0, otherwise updates its progress
+	PutWebhookDelivery(d webhookDelivery) (id int64, err error)
+	// DueWebhookDeliveries are pending deliveries with NextTry at or before now, oldest first
+	DueWebhookDeliveries(now int64, limit int) ([]webhookDelivery, error)
+	// WebhookDeliveries are a webhook's most recent deliveries, newest first
+	WebhookDeliveries(webhookid int64, limit int) ([]webhookDelivery, error)
+	// PurgeWebhookDeliveries deletes delivered and failed deliveries created before `before`
+	PurgeWebhookDeliveries(before int64) (purged int64, err error)
+
+	// PutPrintJob queues pj if its Id is 0, otherwise saves its status, PDF and times
+	PutPrintJob(pj printJob) (id int64, err error)
+	// GetPrintJob returns nil if there's no such job, with its PDF
+	GetPrintJob(id int64) (*printJob, error)
+	// PickUpPrintJob marks a ready job picked_up and drops its PDF, false if it wasn't ready
+	PickUpPrintJob(id, now int64) (bool, error)
+	// PrintJobsForElection are an election's most recent print jobs, newest first, without PDFs
+	PrintJobsForElection(eid int64, limit int) ([]printJob, error)
+	// QueuedPrintJobs are jobs waiting to be drawn, oldest first, without PDFs
+	QueuedPrintJobs(limit int) ([]printJob, error)
+	// PrintJobCounts is ballot style -> status -> number of an election's print jobs
+	PrintJobCounts(eid int64) (map[int]map[string]int, error)
+
+	// PutPrintRun records a numbered ballot run and sets pr.Id, unless it
+	// overlaps one of the election's runs, which comes back instead.
+	// next renumbers pr to follow the election's last run, keeping its count.
+	PutPrintRun(pr *printRun, next bool) (overlap *printRun, err error)
+	// GetPrintRun returns nil if there's no such run
+	GetPrintRun(id int64) (*printRun, error)
+	// PrintRunsForElection are an election's numbered ballot runs, oldest first
+	PrintRunsForElection(eid int64) ([]printRun, error)
+	// PutPrintRunDownload records that a batch of a run was handed out
+	PutPrintRunDownload(d printRunDownload) error
+	// PrintRunDownloads are a run's batch downloads, oldest first
+	PrintRunDownloads(runid int64) ([]printRunDownload, error)
+
+	// SetSampleSlug gives eid the sample ballot page /sample/{slug} in place of any it had, "" for none.
+	// errSampleSlugTaken if another election has it.
+	SetSampleSlug(eid int64, slug string) error
+	// SampleSlug is eid's sample ballot slug, "" if none
+	SampleSlug(eid int64) (string, error)
+	// SampleElection is the election with sample ballot slug, 0 if none
+	SampleElection(slug string) (int64, error)
+
+	// PutLibraryEntry adds le if its Id is 0, otherwise saves its name, data and updated time
+	PutLibraryEntry(le libraryEntry) (id int64, err error)
+	// GetLibraryEntry returns nil if there's no such entry
+	GetLibraryEntry(id int64) (*libraryEntry, error)
+	// LibraryEntries is the whole contest library, by kind and name
+	LibraryEntries() ([]libraryEntry, error)
+	// DeleteLibraryEntry leaves copies of it in elections as they are
+	DeleteLibraryEntry(id int64) error
+	// LibraryElections are the elections not in the trash with a copy of entry id
+	LibraryElections(id int64) ([]int64, error)
 }
 
 func NewSqliteEDB(db *sql.DB) electionAppDB {
-	return &sqliteedb{db}
+	return &sqliteedb{db: db}
 }
 
 type sqliteedb struct {
-	db *sql.DB
+	db  *sql.DB
+	ctx context.Context // see WithContext
+
+	// election_fts is usable, see search.go
+	fts bool
 }
 
 // implement electionAppDB
 func (sdb *sqliteedb) Setup() error {
-	cmds := []string{
-		// use builtin ROWID
-		"CREATE TABLE IF NOT EXISTS elections (data TEXT, owner bigint, meta TEXT)",
-
-		"CREATE TABLE IF NOT EXISTS metastate (k TEXT PRIMARY KEY, v BLOB)",
-		`CREATE TABLE IF NOT EXISTS invites (token TEXT PRIMARY KEY, expires bigint)`,
+	err := sdb.Migrator().migrate(latestMigration)
+	if err != nil {
+		return err
+	}
+	err = indexUnindexed(sdb.conn(), "$", `SELECT ROWID, data FROM elections WHERE ROWID NOT IN (SELECT election FROM election_search)`)
+	if err != nil {
+		return err
 	}
-	return dbTxCmdList(sdb.db, cmds)
+	sdb.fts = sqliteFTS(sdb.db)
+	return nil
+}
+
+func (sdb *sqliteedb) Migrator() *migrator {
+	return &migrator{db: sdb.db, steps: sqliteMigrations, param: "$"}
+}
+
+func (sdb *sqliteedb) WithContext(ctx context.Context) electionAppDB {
+	out := *sdb
+	out.ctx = ctx
+	return &out
+}
+
+func (sdb *sqliteedb) conn() sqlDB {
+	return dbWithContext(sdb.db, sdb.ctx)
 }
 
 func (sdb *sqliteedb) GetElection(id int64) (er *electionRecord, err error) {
-	row := sdb.db.QueryRow(`SELECT data, owner, meta FROM elections WHERE ROWID = $1`, id)
+	row := sdb.conn().QueryRow(`SELECT data, owner, meta, trashed FROM elections WHERE ROWID = $1`, id)
 	er = &electionRecord{Id: id}
-	err = row.Scan(&er.Data, &er.Owner, &er.Meta)
+	var trashed sql.NullInt64
+	err = row.Scan(&er.Data, &er.Owner, &er.Meta, &trashed)
 	if err != nil {
 		er = nil
+		return
 	}
+	er.Trashed = trashed.Int64
 	return
 }
 func (sdb *sqliteedb) PutElection(er electionRecord) (newid int64, err error) {
 	var result sql.Result
 	if er.Id == 0 {
-		result, err = sdb.db.Exec(`INSERT INTO elections (data, owner, meta) VALUES ($1, $2, $3)`, er.Data, er.Owner, er.Meta)
+		result, err = sdb.conn().Exec(`INSERT INTO elections (data, owner, meta) VALUES ($1, $2, $3)`, er.Data, er.Owner, er.Meta)
 		if err != nil {
 			err = fmt.Errorf("sqlite put election insert, %v", err)
 			return
@@ -69,16 +328,59 @@ func (sdb *sqliteedb) PutElection(er electionRecord) (newid int64, err error) {
 			err = fmt.Errorf("sqlite put election wat, %v, %v", err, result)
 			return
 		}
-		return
+	} else {
+		newid = er.Id
+		_, err = sdb.conn().Exec(`UPDATE elections SET data = $1, owner = $2, meta = $3 WHERE ROWID = $4`, er.Data, er.Owner, er.Meta, er.Id)
+		if err != nil {
+			err = fmt.Errorf("sqlite put election update, %v", err)
+			return
+		}
+	}
+	err = addRevision(sdb.conn(), "$", newid, er.Data)
+	if err == nil {
+		err = sdb.index(newid, er.Data)
+	}
+	return
+}
+
+func (sdb *sqliteedb) PutElectionIf(er electionRecord, old string) (ok bool, err error) {
+	ok, err = updateElectionIf(sdb.conn(), "$", "ROWID", er, old)
+	if ok {
+		err = addRevision(sdb.conn(), "$", er.Id, er.Data)
+	}
+	if ok && err == nil {
+		err = sdb.index(er.Id, er.Data)
 	}
-	newid = er.Id
-	_, err = sdb.db.Exec(`UPDATE elections SET data = $1, owner = $2, meta = $3 WHERE ROWID = $4`, er.Data, er.Owner, er.Meta, er.Id)
 	return
 }
 
+func (sdb *sqliteedb) SetElectionMeta(id int64, meta string) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET meta = $1 WHERE ROWID = $2`, meta, id)
+	if err != nil {
+		return fmt.Errorf("sqlite set election meta, %v", err)
+	}
+	return nil
+}
+
+// index updates election_search and election_fts
+func (sdb *sqliteedb) index(eid int64, data string) error {
+	err := indexElection(sdb.conn(), "$", eid, data)
+	if err != nil || !sdb.fts {
+		return err
+	}
+	_, err = sdb.conn().Exec(`DELETE FROM election_fts WHERE rowid = $1`, eid)
+	if err == nil {
+		_, err = sdb.conn().Exec(`INSERT INTO election_fts (rowid, title, contests, candidates) SELECT election, title, contests, candidates FROM election_search WHERE election = $1`, eid)
+	}
+	if err != nil {
+		return fmt.Errorf("sqlite election_fts, %v", err)
+	}
+	return nil
+}
+
 func (sdb *sqliteedb) ElectionsForUser(uid int64) (ids []int64, err error) {
 	var rows *sql.Rows
-	rows, err = sdb.db.Query(`SELECT ROWID FROM elections WHERE owner = $1`, uid)
+	rows, err = sdb.conn().Query(`SELECT ROWID FROM elections WHERE owner = $1 AND trashed IS NULL`, uid)
 	if err != nil {
 		err = fmt.Errorf("sqlite user er doc scan, %v", err)
 		return
@@ -96,14 +398,14 @@ func (sdb *sqliteedb) ElectionsForUser(uid int64) (ids []int64, err error) {
 }
 
 func (sdb *sqliteedb) MakeInviteToken(token string, expires time.Time) (err error) {
-	_, err = sdb.db.Exec(`INSERT INTO invites (token, expires) VALUES ($1, $2)`, token, expires.UTC().Unix())
+	_, err = sdb.conn().Exec(`INSERT INTO invites (token, expires) VALUES ($1, $2)`, token, expires.UTC().Unix())
 	if err != nil {
 		err = fmt.Errorf("invite put, %v", err)
 	}
 	return err
 }
 func (sdb *sqliteedb) PeekInviteToken(token string) (ok bool, expires time.Time, err error) {
-	row := sdb.db.QueryRow(`SELECT expires from INVITES Where token = $1`, token)
+	row := sdb.conn().QueryRow(`SELECT expires from INVITES Where token = $1`, token)
 	var expiresi int64
 	err = row.Scan(&expiresi)
 	if err == sql.ErrNoRows {
@@ -114,7 +416,7 @@ func (sdb *sqliteedb) PeekInviteToken(token string) (ok bool, expires time.Time,
 }
 func (sdb *sqliteedb) UseInviteToken(token string) (ok bool, err error) {
 	ok = false
-	tx, err := sdb.db.Begin()
+	tx, err := sdb.conn().Begin()
 	if err != nil {
 		err = fmt.Errorf("tx err, %v", err)
 		return
@@ -145,68 +447,70 @@ func (sdb *sqliteedb) UseInviteToken(token string) (ok bool, err error) {
 	}
 	return true, err
 }
-func (sdb *sqliteedb) GCInviteTokens() (err error) {
-	_, err = sdb.db.Exec(`DELETE FROM expires WHERE expires < $1`, time.Now().UTC().Unix())
-	return nil
-}
-
-func NewPostgresEDB(db *sql.DB) electionAppDB {
-	return &postgresedb{db}
-}
-
-type postgresedb struct {
-	db *sql.DB
+func (sdb *sqliteedb) GCInviteTokens() (removed int64, err error) {
+	result, err := sdb.conn().Exec(`DELETE FROM invites WHERE expires < $1`, time.Now().UTC().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("invite gc, %v", err)
+	}
+	return result.RowsAffected()
 }
 
-// implement electionAppDB
-func (sdb *postgresedb) Setup() error {
-	cmds := []string{
-		"CREATE TABLE IF NOT EXISTS elections (id bigserial, data TEXT, owner bigint, meta TEXT)",
-
-		"CREATE TABLE IF NOT EXISTS metastate (k TEXT PRIMARY KEY, v bytea)",
-		`CREATE TABLE IF NOT EXISTS invites (token text PRIMARY KEY, expires timestamp without time zone)`,
+func (sdb *sqliteedb) PutScan(sr scanRecord) (newid int64, err error) {
+	result, err := sdb.conn().Exec(`INSERT INTO scans (election, owner, image, content_type, interpreter, result, created, device, operator, batch, precinct, rev) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`, sr.ElectionId, sr.Owner, sr.Image, sr.ContentType, sr.Interpreter, sr.Result, sr.Created, sr.Custody.Device, sr.Custody.Operator, sr.Custody.Batch, sr.Custody.Precinct, sr.Rev)
+	if err != nil {
+		err = fmt.Errorf("sqlite put scan insert, %v", err)
+		return
+	}
+	newid, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("sqlite put scan wat, %v, %v", err, result)
 	}
-	return dbTxCmdList(sdb.db, cmds)
+	return
 }
 
-func (sdb *postgresedb) GetElection(id int64) (er *electionRecord, err error) {
-	row := sdb.db.QueryRow(`SELECT data, owner, meta FROM elections WHERE id = $1`, id)
-	er = &electionRecord{Id: id}
-	err = row.Scan(&er.Data, &er.Owner, &er.Meta)
+func (sdb *sqliteedb) GetScan(id int64) (sr *scanRecord, err error) {
+	row := sdb.conn().QueryRow(`SELECT election, owner, image, content_type, interpreter, result, created, `+scanCustodyColumns+`, COALESCE(rev, 0) FROM scans WHERE ROWID = $1`, id)
+	sr = &scanRecord{Id: id}
+	err = row.Scan(&sr.ElectionId, &sr.Owner, &sr.Image, &sr.ContentType, &sr.Interpreter, &sr.Result, &sr.Created, &sr.Custody.Device, &sr.Custody.Operator, &sr.Custody.Batch, &sr.Custody.Precinct, &sr.Rev)
 	if err != nil {
-		er = nil
+		sr = nil
 	}
 	return
 }
-func (sdb *postgresedb) PutElection(er electionRecord) (newid int64, err error) {
-	if er.Id == 0 {
-		row := sdb.db.QueryRow(`INSERT INTO elections (data, owner, meta) VALUES ($1, $2, $3) RETURNING id`, er.Data, er.Owner, er.Meta)
-		err = row.Scan(&newid)
-		if err != nil {
-			err = fmt.Errorf("pg put election insert, %v", err)
-		}
-	} else {
-		_, err = sdb.db.Exec(`UPDATE elections SET data = $1, owner = $2, meta = $3 WHERE id = $4`, er.Data, er.Owner, er.Meta, er.Id)
+
+func (sdb *sqliteedb) ScansForElection(eid int64) (ids []int64, err error) {
+	var rows *sql.Rows
+	rows, err = sdb.conn().Query(`SELECT ROWID FROM scans WHERE election = $1 ORDER BY ROWID`, eid)
+	if err != nil {
+		err = fmt.Errorf("sqlite election scans, %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sid int64
+		err = rows.Scan(&sid)
 		if err != nil {
-			err = fmt.Errorf("pg put election update, %v", err)
+			err = fmt.Errorf("sqlite election scans row, %v", err)
+			return
 		}
-		newid = er.Id
+		ids = append(ids, sid)
 	}
 	return
 }
 
-func (sdb *postgresedb) ElectionsForUser(uid int64) (ids []int64, err error) {
+func (sdb *sqliteedb) ElectionIds() (ids []int64, err error) {
 	var rows *sql.Rows
-	rows, err = sdb.db.Query(`SELECT id FROM elections WHERE owner = $1`, uid)
+	rows, err = sdb.conn().Query(`SELECT ROWID FROM elections ORDER BY ROWID`)
 	if err != nil {
-		err = fmt.Errorf("pg user er doc scan, %v", err)
+		err = fmt.Errorf("sqlite election ids, %v", err)
 		return
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var eid int64
 		err = rows.Scan(&eid)
 		if err != nil {
-			err = fmt.Errorf("pg user er doc row, %v", err)
+			err = fmt.Errorf("sqlite election ids row, %v", err)
 			return
 		}
 		ids = append(ids, eid)
@@ -214,99 +518,1436 @@ func (sdb *postgresedb) ElectionsForUser(uid int64) (ids []int64, err error) {
 	return
 }
 
-func (sdb *postgresedb) MakeInviteToken(token string, expires time.Time) error {
-	_, err := sdb.db.Exec(`INSERT INTO invites (token, expires) VALUES ($1, $2)`, token, expires.UTC())
+func (sdb *sqliteedb) RestoreElection(er electionRecord) error {
+	_, err := sdb.conn().Exec(`INSERT INTO elections (ROWID, data, owner, meta, trashed) VALUES ($1, $2, $3, $4, $5)`, er.Id, er.Data, er.Owner, er.Meta, trashedValue(er.Trashed))
 	if err != nil {
-		err = fmt.Errorf("invite put, %v", err)
+		return fmt.Errorf("sqlite restore election %d, %v", er.Id, err)
 	}
-	return err
+	err = addRevision(sdb.conn(), "$", er.Id, er.Data)
+	if err != nil {
+		return err
+	}
+	return sdb.index(er.Id, er.Data)
 }
-func (sdb *postgresedb) PeekInviteToken(token string) (ok bool, expires time.Time, err error) {
-	row := sdb.db.QueryRow(`SELECT expires from INVITES Where token = $1`, token)
-	//var expires time.Time
-	err = row.Scan(&expires)
-	if err == sql.ErrNoRows {
-		return false, time.Time{}, nil
+
+func (sdb *sqliteedb) RestoreScan(sr scanRecord) error {
+	_, err := sdb.conn().Exec(`INSERT INTO scans (ROWID, election, owner, image, content_type, interpreter, result, created, device, operator, batch, precinct, rev) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`, sr.Id, sr.ElectionId, sr.Owner, sr.Image, sr.ContentType, sr.Interpreter, sr.Result, sr.Created, sr.Custody.Device, sr.Custody.Operator, sr.Custody.Batch, sr.Custody.Precinct, sr.Rev)
+	if err != nil {
+		return fmt.Errorf("sqlite restore scan %d, %v", sr.Id, err)
 	}
+	return nil
+}
+
+func (sdb *sqliteedb) UpdateScanResult(id int64, interpreter, result string) (err error) {
+	_, err = sdb.conn().Exec(`UPDATE scans SET interpreter = $1, result = $2 WHERE ROWID = $3`, interpreter, result, id)
 	if err != nil {
-		return false, expires, err
+		err = fmt.Errorf("sqlite scan update, %v", err)
 	}
-	return expires.After(time.Now()), expires, nil
+	return
 }
-func (sdb *postgresedb) UseInviteToken(token string) (ok bool, err error) {
-	ok = false
-	tx, err := sdb.db.Begin()
+
+func (sdb *sqliteedb) TrashElection(id int64, when time.Time) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET trashed = $1 WHERE ROWID = $2`, when.Unix(), id)
 	if err != nil {
-		err = fmt.Errorf("tx err, %v", err)
-		return
+		return fmt.Errorf("sqlite trash election, %v", err)
 	}
-	defer tx.Rollback()
-	row := tx.QueryRow(`SELECT expires FROM invites WHERE token = $1`, token)
-	var expires time.Time
-	err = row.Scan(&expires)
-	if err == sql.ErrNoRows {
-		return false, nil
+	return nil
+}
+
+func (sdb *sqliteedb) UntrashElection(id int64) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET trashed = NULL WHERE ROWID = $1`, id)
+	if err != nil {
+		return fmt.Errorf("sqlite untrash election, %v", err)
 	}
+	return nil
+}
+
+func (sdb *sqliteedb) TrashedForUser(uid int64) (ids []int64, err error) {
+	var rows *sql.Rows
+	rows, err = sdb.conn().Query(`SELECT ROWID FROM elections WHERE owner = $1 AND trashed IS NOT NULL ORDER BY trashed DESC`, uid)
 	if err != nil {
-		err = fmt.Errorf("invite get, %v", err)
+		err = fmt.Errorf("sqlite user trash, %v", err)
 		return
 	}
-	if time.Now().After(expires) {
-		return false, nil
+	defer rows.Close()
+	for rows.Next() {
+		var eid int64
+		err = rows.Scan(&eid)
+		if err != nil {
+			err = fmt.Errorf("sqlite user trash row, %v", err)
+			return
+		}
+		ids = append(ids, eid)
 	}
-	_, err = tx.Exec(`DELETE FROM invites WHERE token = $1`, token)
+	return
+}
+
+func (sdb *sqliteedb) PurgeTrash(before time.Time) (purged int64, err error) {
+	return purgeTrash(sdb.conn(), "ROWID", "$1", before)
+}
+
+func (sdb *sqliteedb) StaleDrafts(before time.Time) (ids []int64, err error) {
+	return staleDrafts(sdb.conn(), "ROWID", "$1", "$2", before)
+}
+
+func (sdb *sqliteedb) PutAnnotation(ar annotationRecord) (newid int64, err error) {
+	result, err := sdb.conn().Exec(`INSERT INTO annotations (election, page, x, y, comment, author, author_name, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, ar.ElectionId, ar.Page, ar.X, ar.Y, ar.Comment, ar.Author, ar.AuthorName, ar.Created)
 	if err != nil {
-		err = fmt.Errorf("invite del, %v", err)
+		err = fmt.Errorf("sqlite put annotation insert, %v", err)
 		return
 	}
-	err = tx.Commit()
+	newid, err = result.LastInsertId()
 	if err != nil {
-		err = fmt.Errorf("invite del commit, %v", err)
-		return
+		err = fmt.Errorf("sqlite put annotation id, %v", err)
 	}
-	return true, err
+	return
 }
-func (sdb *postgresedb) GCInviteTokens() (err error) {
-	var result sql.Result
-	result, err = sdb.db.Exec(`DELETE FROM invites WHERE expires < CURRENT_TIMESTAMP AT TIME ZONE 'UTC'`)
+
+func (sdb *sqliteedb) AnnotationsForElection(eid int64) ([]annotationRecord, error) {
+	return queryAnnotations(sdb.conn(), `SELECT ROWID, election, page, x, y, comment, author, author_name, created FROM annotations WHERE election = $1 ORDER BY ROWID`, eid)
+}
+
+func (sdb *sqliteedb) DeleteAnnotation(eid, id int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM annotations WHERE ROWID = $1 AND election = $2`, id, eid)
 	if err != nil {
-		err = fmt.Errorf("invite del, %v", err)
+		return fmt.Errorf("sqlite delete annotation, %v", err)
 	}
-	rows, xe := result.RowsAffected()
-	if rows > 0 || xe != nil {
-		log.Printf("invite gc deleted %d, %v", rows, xe)
+	return nil
+}
+
+func (sdb *sqliteedb) GetElectionState(id int64) (state string, err error) {
+	return getElectionState(sdb.conn(), id)
+}
+
+func (sdb *sqliteedb) SetElectionState(id int64, from, to string) (ok bool, err error) {
+	return setElectionState(sdb.conn(), id, from, to,
+		`INSERT OR REPLACE INTO election_state (election, state, changed) VALUES ($1, $2, $3)`,
+		time.Now().UTC().Unix())
+}
+
+func (sdb *sqliteedb) PutDigestSchedule(ds digestSchedule) error {
+	_, err := sdb.conn().Exec(`INSERT OR REPLACE INTO digest_schedules (user_id, email, weekday, hour, last_sent) VALUES ($1, $2, $3, $4, $5)`, ds.UserId, ds.Email, ds.Weekday, ds.Hour, ds.LastSent)
+	if err != nil {
+		return fmt.Errorf("sqlite put digest schedule, %v", err)
 	}
-	return
+	return nil
 }
 
-func dbTxCmdList(db *sql.DB, cmds []string) error {
-	tx, err := db.Begin()
+func (sdb *sqliteedb) GetDigestSchedule(uid int64) (*digestSchedule, error) {
+	return getDigestSchedule(sdb.conn(), uid)
+}
+
+func (sdb *sqliteedb) DeleteDigestSchedule(uid int64) error {
+	return deleteDigestSchedule(sdb.conn(), `DELETE FROM digest_schedules WHERE user_id = $1`, uid)
+}
+
+func (sdb *sqliteedb) DigestSchedules() ([]digestSchedule, error) {
+	return queryDigestSchedules(sdb.conn())
+}
+
+func (sdb *sqliteedb) PutNotifyPrefs(np notifyPrefs) error {
+	_, err := sdb.conn().Exec(`INSERT OR REPLACE INTO notify_prefs (user_id, username, email, shares, mentions, renders) VALUES ($1, $2, $3, $4, $5, $6)`, np.UserId, np.Username, np.Email, boolInt(np.Shares), boolInt(np.Mentions), boolInt(np.Renders))
 	if err != nil {
-		return err
+		return fmt.Errorf("sqlite put notify prefs, %v", err)
 	}
-	defer tx.Rollback() // nop if committed
-	for _, cmd := range cmds {
-		_, err := tx.Exec(cmd)
-		if err != nil {
-			return fmt.Errorf("sql failed %#v, %v", cmd, err)
-		}
+	return nil
+}
+
+func (sdb *sqliteedb) GetNotifyPrefs(uid int64) (*notifyPrefs, error) {
+	return getNotifyPrefs(sdb.conn(), `SELECT user_id, username, email, shares, mentions, renders FROM notify_prefs WHERE user_id = $1`, uid)
+}
+
+func (sdb *sqliteedb) NotifyPrefsForUsername(username string) (*notifyPrefs, error) {
+	return getNotifyPrefs(sdb.conn(), `SELECT user_id, username, email, shares, mentions, renders FROM notify_prefs WHERE LOWER(username) = LOWER($1)`, username)
+}
+
+func (sdb *sqliteedb) DeleteNotifyPrefs(uid int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM notify_prefs WHERE user_id = $1`, uid)
+	if err != nil {
+		return fmt.Errorf("notify prefs delete, %v", err)
 	}
-	err = tx.Commit()
+	return nil
+}
+
+func (sdb *sqliteedb) AllNotifyPrefs() ([]notifyPrefs, error) {
+	return queryNotifyPrefs(sdb.conn())
+}
+
+func (sdb *sqliteedb) PutStaff(sr staffRecord) error {
+	_, err := sdb.conn().Exec(`INSERT OR REPLACE INTO staff (email, role, organization, user_id, invite, provisioned) VALUES ($1, $2, $3, $4, $5, $6)`, sr.Email, sr.Role, sr.Organization, sr.UserId, sr.Invite, sr.Provisioned)
 	if err != nil {
-		return fmt.Errorf("commit of %d commands failed, %v", len(cmds), err)
+		return fmt.Errorf("sqlite put staff, %v", err)
 	}
 	return nil
 }
 
-func gcThread(ctx context.Context, edb electionAppDB, period time.Duration) {
-	t := time.NewTicker(period)
-	defer t.Stop()
-	for true {
-		select {
-		case <-ctx.Done():
-			return
-		case <-t.C:
-			edb.GCInviteTokens()
+func (sdb *sqliteedb) GetStaff(email string) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE email = $1`, email)
+}
+
+func (sdb *sqliteedb) StaffByInvite(token string) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE invite = $1`, token)
+}
+
+func (sdb *sqliteedb) StaffForUser(uid int64) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE user_id = $1`, uid)
+}
+
+func (sdb *sqliteedb) StaffList() ([]staffRecord, error) {
+	return queryStaff(sdb.conn())
+}
+
+func (sdb *sqliteedb) ElectionRevisions(eid int64) ([]revisionRecord, error) {
+	return electionRevisions(sdb.conn(), `SELECT election, rev, LENGTH(data), created FROM election_revisions WHERE election = $1 ORDER BY rev`, eid)
+}
+
+func (sdb *sqliteedb) GetElectionRevision(eid int64, rev int) (*revisionRecord, error) {
+	return getElectionRevision(sdb.conn(), `SELECT data, created FROM election_revisions WHERE election = $1 AND rev = $2`, eid, rev)
+}
+
+func (sdb *sqliteedb) RestoreRevisions(eid int64, revs []revisionRecord) error {
+	return restoreRevisions(sdb.conn(), "$", eid, revs)
+}
+
+func (sdb *sqliteedb) SearchElections(terms []string, uid int64, limit int) ([]searchRecord, error) {
+	scope := `e.trashed IS NULL AND (e.owner = $1 OR st.state = $2)`
+	if sdb.fts {
+		quoted := make([]string, len(terms))
+		for i, t := range terms {
+			quoted[i] = `"` + t + `"*`
 		}
+		return querySearch(sdb.conn(), `SELECT s.election, e.owner, s.title, s.contests, s.candidates FROM election_fts
+JOIN election_search s ON s.election = election_fts.rowid JOIN elections e ON e.ROWID = s.election
+LEFT JOIN election_state st ON st.election = s.election
+WHERE `+scope+` AND election_fts MATCH $3 ORDER BY election_fts.rank LIMIT $4`, uid, StatePublished, strings.Join(quoted, " "), limit)
+	}
+	// sqlite numbers $N parameters in the order they appear, keep them in order
+	args := []interface{}{uid, StatePublished}
+	var likes []string
+	for i, arg := range likeArgs(terms) {
+		likes = append(likes, fmt.Sprintf(`(s.title || ' ' || s.contests || ' ' || s.candidates) LIKE $%d`, i+3))
+		args = append(args, arg)
+	}
+	args = append(args, limit)
+	return querySearch(sdb.conn(), `SELECT s.election, e.owner, s.title, s.contests, s.candidates FROM election_search s
+JOIN elections e ON e.ROWID = s.election LEFT JOIN election_state st ON st.election = s.election
+WHERE `+scope+` AND `+strings.Join(likes, " AND ")+fmt.Sprintf(` ORDER BY s.election DESC LIMIT $%d`, len(args)), args...)
+}
+
+func (sdb *sqliteedb) ElectionFacts(f factsFilter) ([]electionFacts, error) {
+	return queryFacts(sdb.conn(), "$", "ROWID", f)
+}
+
+func (sdb *sqliteedb) UserUsage(uid int64) (quotaUsage, error) {
+	return queryUsage(sdb.conn(), "$", "ROWID", uid)
+}
+
+func (sdb *sqliteedb) GetUserQuota(uid int64) (*quotaLimits, error) {
+	return getUserQuota(sdb.conn(), "$", uid)
+}
+
+func (sdb *sqliteedb) SetUserQuota(uid int64, q *quotaLimits) error {
+	return setUserQuota(sdb.conn(), "$", uid, q)
+}
+
+func (sdb *sqliteedb) PruneRevisions(eid int64, keep int64) error {
+	return pruneRevisions(sdb.conn(), "$", eid, keep)
+}
+
+func (sdb *sqliteedb) GetAccount(uid int64) (*accountRecord, error) {
+	return getAccount(sdb.conn(), "$", uid)
+}
+
+func (sdb *sqliteedb) PutAccount(ar accountRecord) error {
+	return putAccount(sdb.conn(), "$", ar)
+}
+
+func (sdb *sqliteedb) DeleteAccount(uid, electionsTo int64) (int64, error) {
+	return deleteAccount(sdb.conn(), "$", "ROWID", uid, electionsTo)
+}
+
+func (sdb *sqliteedb) ListAccounts() ([]accountSummary, error) {
+	return listAccounts(sdb.conn())
+}
+
+func (sdb *sqliteedb) GetExternalIdentity(issuer, subject string) (*externalIdentity, error) {
+	return getExternalIdentity(sdb.conn(), "$", issuer, subject)
+}
+
+func (sdb *sqliteedb) PutExternalIdentity(ei externalIdentity) error {
+	return putExternalIdentity(sdb.conn(), "$", ei)
+}
+
+func (sdb *sqliteedb) ElectionTags(eid int64) ([]string, error) {
+	tags, err := queryTags(sdb.conn(), `SELECT election, tag FROM election_tags WHERE election = $1`, eid)
+	return tags[eid], err
+}
+
+func (sdb *sqliteedb) SetElectionTags(eid int64, tags []string) error {
+	return setElectionTags(sdb.conn(), "$", eid, tags)
+}
+
+func (sdb *sqliteedb) TagsForUser(uid int64) (map[int64][]string, error) {
+	return queryTags(sdb.conn(), `SELECT t.election, t.tag FROM election_tags t JOIN elections e ON e.ROWID = t.election WHERE e.owner = $1 AND e.trashed IS NULL`, uid)
+}
+
+func (sdb *sqliteedb) PutWebhook(wh webhookRecord) (newid int64, err error) {
+	result, err := sdb.conn().Exec(`INSERT INTO webhooks (owner, election, url, secret, events, created) VALUES ($1, $2, $3, $4, $5, $6)`, wh.Owner, wh.ElectionId, wh.URL, wh.Secret, strings.Join(wh.Events, ","), wh.Created)
+	if err != nil {
+		err = fmt.Errorf("sqlite put webhook insert, %v", err)
+		return
+	}
+	newid, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("sqlite put webhook id, %v", err)
+	}
+	return
+}
+
+func (sdb *sqliteedb) GetWebhook(id int64) (*webhookRecord, error) {
+	return getWebhook(sdb.conn(), `SELECT ROWID, owner, election, url, secret, events, created FROM webhooks WHERE ROWID = $1`, id)
+}
+
+func (sdb *sqliteedb) WebhooksForUser(uid int64) ([]webhookRecord, error) {
+	return queryWebhooks(sdb.conn(), `SELECT ROWID, owner, election, url, secret, events, created FROM webhooks WHERE owner = $1 ORDER BY ROWID`, uid)
+}
+
+func (sdb *sqliteedb) WebhooksForElection(eid int64) ([]webhookRecord, error) {
+	return queryWebhooks(sdb.conn(), `SELECT ROWID, owner, election, url, secret, events, created FROM webhooks WHERE election = $1 OR (election = 0 AND owner = (SELECT owner FROM elections WHERE ROWID = $1))`, eid)
+}
+
+func (sdb *sqliteedb) DeleteWebhook(id int64) error {
+	return deleteWebhook(sdb.conn(), "$", "ROWID", id)
+}
+
+func (sdb *sqliteedb) PutWebhookDelivery(d webhookDelivery) (id int64, err error) {
+	if d.Id != 0 {
+		return d.Id, updateDelivery(sdb.conn(), "$", "ROWID", d)
+	}
+	result, err := sdb.conn().Exec(`INSERT INTO webhook_deliveries (webhook, event, payload, status, attempts, next_try, last_error, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, d.WebhookId, d.Event, d.Payload, d.Status, d.Attempts, d.NextTry, d.LastError, d.Created)
+	if err != nil {
+		err = fmt.Errorf("sqlite put webhook delivery insert, %v", err)
+		return
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("sqlite put webhook delivery id, %v", err)
+	}
+	return
+}
+
+func (sdb *sqliteedb) DueWebhookDeliveries(now int64, limit int) ([]webhookDelivery, error) {
+	return queryDeliveries(sdb.conn(), `SELECT ROWID, webhook, event, payload, status, attempts, next_try, last_error, created FROM webhook_deliveries WHERE status = 'pending' AND next_try <= $1 ORDER BY ROWID LIMIT $2`, now, limit)
+}
+
+func (sdb *sqliteedb) WebhookDeliveries(webhookid int64, limit int) ([]webhookDelivery, error) {
+	return queryDeliveries(sdb.conn(), `SELECT ROWID, webhook, event, payload, status, attempts, next_try, last_error, created FROM webhook_deliveries WHERE webhook = $1 ORDER BY ROWID DESC LIMIT $2`, webhookid, limit)
+}
+
+func (sdb *sqliteedb) PurgeWebhookDeliveries(before int64) (purged int64, err error) {
+	return purgeDeliveries(sdb.conn(), "$", before)
+}
+
+func (sdb *sqliteedb) PutPrintJob(pj printJob) (id int64, err error) {
+	if pj.Id != 0 {
+		return pj.Id, updatePrintJob(sdb.conn(), "$", "ROWID", pj)
+	}
+	result, err := sdb.conn().Exec(`INSERT INTO print_jobs (election, style, requested_by, status, error, created, done, picked_up) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, pj.ElectionId, pj.Style, pj.RequestedBy, pj.Status, pj.Error, pj.Created, pj.Done, pj.PickedUp)
+	if err != nil {
+		err = fmt.Errorf("sqlite put print job insert, %v", err)
+		return
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("sqlite put print job id, %v", err)
+	}
+	return
+}
+
+func (sdb *sqliteedb) GetPrintJob(id int64) (*printJob, error) {
+	return getPrintJob(sdb.conn(), `SELECT ROWID, `+printJobColumns+`, pdf FROM print_jobs WHERE ROWID = $1`, id)
+}
+
+func (sdb *sqliteedb) PickUpPrintJob(id, now int64) (bool, error) {
+	return pickUpPrintJob(sdb.conn(), "$", "ROWID", id, now)
+}
+
+func (sdb *sqliteedb) PrintJobsForElection(eid int64, limit int) ([]printJob, error) {
+	return queryPrintJobs(sdb.conn(), `SELECT ROWID, `+printJobColumns+` FROM print_jobs WHERE election = $1 ORDER BY ROWID DESC LIMIT $2`, eid, limit)
+}
+
+func (sdb *sqliteedb) QueuedPrintJobs(limit int) ([]printJob, error) {
+	return queryPrintJobs(sdb.conn(), `SELECT ROWID, `+printJobColumns+` FROM print_jobs WHERE status = 'queued' ORDER BY ROWID LIMIT $1`, limit)
+}
+
+func (sdb *sqliteedb) PrintJobCounts(eid int64) (map[int]map[string]int, error) {
+	return printJobCounts(sdb.conn(), `SELECT style, status, COUNT(*) FROM print_jobs WHERE election = $1 GROUP BY style, status`, eid)
+}
+
+func (sdb *sqliteedb) PutPrintRun(pr *printRun, next bool) (*printRun, error) {
+	// a write that changes nothing takes the database's write lock up front,
+	// so a second run waits for this one instead of failing to upgrade its read
+	lock := `UPDATE print_runs SET election = election WHERE election = $1 AND 0`
+	runs := `SELECT ROWID, ` + printRunColumns + ` FROM print_runs WHERE election = $1 ORDER BY ROWID`
+	return putPrintRun(sdb.conn(), lock, runs, pr, next, func(tx *sql.Tx) (id int64, err error) {
+		result, err := tx.Exec(`INSERT INTO print_runs (`+printRunColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, pr.ElectionId, pr.Style, pr.First, pr.Last, pr.BatchSize, pr.Rev, pr.RequestedBy, pr.Created)
+		if err != nil {
+			err = fmt.Errorf("sqlite put print run insert, %v", err)
+			return
+		}
+		id, err = result.LastInsertId()
+		if err != nil {
+			err = fmt.Errorf("sqlite put print run id, %v", err)
+		}
+		return
+	})
+}
+
+func (sdb *sqliteedb) GetPrintRun(id int64) (*printRun, error) {
+	return getPrintRun(sdb.conn(), `SELECT ROWID, `+printRunColumns+` FROM print_runs WHERE ROWID = $1`, id)
+}
+
+func (sdb *sqliteedb) PrintRunsForElection(eid int64) ([]printRun, error) {
+	return queryPrintRuns(sdb.conn(), `SELECT ROWID, `+printRunColumns+` FROM print_runs WHERE election = $1 ORDER BY ROWID`, eid)
+}
+
+func (sdb *sqliteedb) PutPrintRunDownload(d printRunDownload) error {
+	return putPrintRunDownload(sdb.conn(), "$", d)
+}
+
+func (sdb *sqliteedb) PrintRunDownloads(runid int64) ([]printRunDownload, error) {
+	return printRunDownloads(sdb.conn(), `SELECT batch, downloaded_by, downloaded FROM print_run_downloads WHERE run = $1 ORDER BY downloaded, ROWID`, runid)
+}
+
+func (sdb *sqliteedb) SetSampleSlug(eid int64, slug string) error {
+	return setSampleSlug(sdb.conn(), "$", eid, slug)
+}
+
+func (sdb *sqliteedb) SampleSlug(eid int64) (string, error) {
+	return sampleSlug(sdb.conn(), `SELECT slug FROM sample_ballots WHERE election = $1`, eid)
+}
+
+func (sdb *sqliteedb) SampleElection(slug string) (int64, error) {
+	return sampleElection(sdb.conn(), `SELECT election FROM sample_ballots WHERE slug = $1`, slug)
+}
+
+func (sdb *sqliteedb) PutLibraryEntry(le libraryEntry) (id int64, err error) {
+	if le.Id != 0 {
+		return le.Id, updateLibraryEntry(sdb.conn(), "$", "ROWID", le)
+	}
+	result, err := sdb.conn().Exec(`INSERT INTO library_entries (owner, kind, name, data, updated) VALUES ($1, $2, $3, $4, $5)`, le.Owner, le.Kind, le.Name, string(le.Data), le.Updated)
+	if err != nil {
+		err = fmt.Errorf("sqlite put library entry insert, %v", err)
+		return
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("sqlite put library entry id, %v", err)
+	}
+	return
+}
+
+func (sdb *sqliteedb) GetLibraryEntry(id int64) (*libraryEntry, error) {
+	return getLibraryEntry(sdb.conn(), `SELECT ROWID, `+libraryEntryColumns+` FROM library_entries WHERE ROWID = $1`, id)
+}
+
+func (sdb *sqliteedb) LibraryEntries() ([]libraryEntry, error) {
+	return queryLibraryEntries(sdb.conn(), `SELECT ROWID, `+libraryEntryColumns+` FROM library_entries ORDER BY kind, name, ROWID`)
+}
+
+func (sdb *sqliteedb) DeleteLibraryEntry(id int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM library_entries WHERE ROWID = $1`, id)
+	if err != nil {
+		return fmt.Errorf("sqlite delete library entry, %v", err)
+	}
+	return nil
+}
+
+func (sdb *sqliteedb) LibraryElections(id int64) ([]int64, error) {
+	return libraryElections(sdb.conn(), "$", "ROWID", id)
+}
+
+func NewPostgresEDB(db *sql.DB) electionAppDB {
+	return &postgresedb{db: db}
+}
+
+type postgresedb struct {
+	db  *sql.DB
+	ctx context.Context // see WithContext
+}
+
+// implement electionAppDB
+func (sdb *postgresedb) Setup() error {
+	err := sdb.Migrator().migrate(latestMigration)
+	if err != nil {
+		return err
+	}
+	return indexUnindexed(sdb.conn(), "$", `SELECT id, data FROM elections WHERE id NOT IN (SELECT election FROM election_search)`)
+}
+
+func (sdb *postgresedb) Migrator() *migrator {
+	return &migrator{db: sdb.db, steps: postgresMigrations, param: "$"}
+}
+
+func (sdb *postgresedb) WithContext(ctx context.Context) electionAppDB {
+	return &postgresedb{sdb.db, ctx}
+}
+
+func (sdb *postgresedb) conn() sqlDB {
+	return dbWithContext(sdb.db, sdb.ctx)
+}
+
+func (sdb *postgresedb) GetElection(id int64) (er *electionRecord, err error) {
+	row := sdb.conn().QueryRow(`SELECT data, owner, meta, trashed FROM elections WHERE id = $1`, id)
+	er = &electionRecord{Id: id}
+	var trashed sql.NullInt64
+	err = row.Scan(&er.Data, &er.Owner, &er.Meta, &trashed)
+	if err != nil {
+		er = nil
+		return
+	}
+	er.Trashed = trashed.Int64
+	return
+}
+func (sdb *postgresedb) PutElection(er electionRecord) (newid int64, err error) {
+	if er.Id == 0 {
+		row := sdb.conn().QueryRow(`INSERT INTO elections (data, owner, meta) VALUES ($1, $2, $3) RETURNING id`, er.Data, er.Owner, er.Meta)
+		err = row.Scan(&newid)
+		if err != nil {
+			err = fmt.Errorf("pg put election insert, %v", err)
+		}
+	} else {
+		_, err = sdb.conn().Exec(`UPDATE elections SET data = $1, owner = $2, meta = $3 WHERE id = $4`, er.Data, er.Owner, er.Meta, er.Id)
+		if err != nil {
+			err = fmt.Errorf("pg put election update, %v", err)
+		}
+		newid = er.Id
+	}
+	if err == nil {
+		err = addRevision(sdb.conn(), "$", newid, er.Data)
+	}
+	if err == nil {
+		err = indexElection(sdb.conn(), "$", newid, er.Data)
+	}
+	return
+}
+
+func (sdb *postgresedb) PutElectionIf(er electionRecord, old string) (ok bool, err error) {
+	ok, err = updateElectionIf(sdb.conn(), "$", "id", er, old)
+	if ok {
+		err = addRevision(sdb.conn(), "$", er.Id, er.Data)
+	}
+	if ok && err == nil {
+		err = indexElection(sdb.conn(), "$", er.Id, er.Data)
+	}
+	return
+}
+
+func (sdb *postgresedb) SetElectionMeta(id int64, meta string) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET meta = $1 WHERE id = $2`, meta, id)
+	if err != nil {
+		return fmt.Errorf("pg set election meta, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) ElectionsForUser(uid int64) (ids []int64, err error) {
+	var rows *sql.Rows
+	rows, err = sdb.conn().Query(`SELECT id FROM elections WHERE owner = $1 AND trashed IS NULL`, uid)
+	if err != nil {
+		err = fmt.Errorf("pg user er doc scan, %v", err)
+		return
+	}
+	for rows.Next() {
+		var eid int64
+		err = rows.Scan(&eid)
+		if err != nil {
+			err = fmt.Errorf("pg user er doc row, %v", err)
+			return
+		}
+		ids = append(ids, eid)
+	}
+	return
+}
+
+func (sdb *postgresedb) MakeInviteToken(token string, expires time.Time) error {
+	_, err := sdb.conn().Exec(`INSERT INTO invites (token, expires) VALUES ($1, $2)`, token, expires.UTC())
+	if err != nil {
+		err = fmt.Errorf("invite put, %v", err)
+	}
+	return err
+}
+func (sdb *postgresedb) PeekInviteToken(token string) (ok bool, expires time.Time, err error) {
+	row := sdb.conn().QueryRow(`SELECT expires from INVITES Where token = $1`, token)
+	//var expires time.Time
+	err = row.Scan(&expires)
+	if err == sql.ErrNoRows {
+		return false, time.Time{}, nil
+	}
+	if err != nil {
+		return false, expires, err
+	}
+	return expires.After(time.Now()), expires, nil
+}
+func (sdb *postgresedb) UseInviteToken(token string) (ok bool, err error) {
+	ok = false
+	tx, err := sdb.conn().Begin()
+	if err != nil {
+		err = fmt.Errorf("tx err, %v", err)
+		return
+	}
+	defer tx.Rollback()
+	row := tx.QueryRow(`SELECT expires FROM invites WHERE token = $1`, token)
+	var expires time.Time
+	err = row.Scan(&expires)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("invite get, %v", err)
+		return
+	}
+	if time.Now().After(expires) {
+		return false, nil
+	}
+	_, err = tx.Exec(`DELETE FROM invites WHERE token = $1`, token)
+	if err != nil {
+		err = fmt.Errorf("invite del, %v", err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		err = fmt.Errorf("invite del commit, %v", err)
+		return
+	}
+	return true, err
+}
+func (sdb *postgresedb) GCInviteTokens() (removed int64, err error) {
+	result, err := sdb.conn().Exec(`DELETE FROM invites WHERE expires < CURRENT_TIMESTAMP AT TIME ZONE 'UTC'`)
+	if err != nil {
+		return 0, fmt.Errorf("invite del, %v", err)
+	}
+	return result.RowsAffected()
+}
+
+func (sdb *postgresedb) PutScan(sr scanRecord) (newid int64, err error) {
+	row := sdb.conn().QueryRow(`INSERT INTO scans (election, owner, image, content_type, interpreter, result, created, device, operator, batch, precinct, rev) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`, sr.ElectionId, sr.Owner, sr.Image, sr.ContentType, sr.Interpreter, sr.Result, sr.Created, sr.Custody.Device, sr.Custody.Operator, sr.Custody.Batch, sr.Custody.Precinct, sr.Rev)
+	err = row.Scan(&newid)
+	if err != nil {
+		err = fmt.Errorf("pg put scan insert, %v", err)
+	}
+	return
+}
+
+func (sdb *postgresedb) GetScan(id int64) (sr *scanRecord, err error) {
+	row := sdb.conn().QueryRow(`SELECT election, owner, image, content_type, interpreter, result, created, `+scanCustodyColumns+`, COALESCE(rev, 0) FROM scans WHERE id = $1`, id)
+	sr = &scanRecord{Id: id}
+	err = row.Scan(&sr.ElectionId, &sr.Owner, &sr.Image, &sr.ContentType, &sr.Interpreter, &sr.Result, &sr.Created, &sr.Custody.Device, &sr.Custody.Operator, &sr.Custody.Batch, &sr.Custody.Precinct, &sr.Rev)
+	if err != nil {
+		sr = nil
+	}
+	return
+}
+
+func (sdb *postgresedb) ScansForElection(eid int64) (ids []int64, err error) {
+	var rows *sql.Rows
+	rows, err = sdb.conn().Query(`SELECT id FROM scans WHERE election = $1 ORDER BY id`, eid)
+	if err != nil {
+		err = fmt.Errorf("pg election scans, %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sid int64
+		err = rows.Scan(&sid)
+		if err != nil {
+			err = fmt.Errorf("pg election scans row, %v", err)
+			return
+		}
+		ids = append(ids, sid)
+	}
+	return
+}
+
+func (sdb *postgresedb) ElectionIds() (ids []int64, err error) {
+	var rows *sql.Rows
+	rows, err = sdb.conn().Query(`SELECT id FROM elections ORDER BY id`)
+	if err != nil {
+		err = fmt.Errorf("pg election ids, %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eid int64
+		err = rows.Scan(&eid)
+		if err != nil {
+			err = fmt.Errorf("pg election ids row, %v", err)
+			return
+		}
+		ids = append(ids, eid)
+	}
+	return
+}
+
+// explicit ids don't advance the bigserial sequence, so move it past them
+func (sdb *postgresedb) RestoreElection(er electionRecord) error {
+	_, err := sdb.conn().Exec(`INSERT INTO elections (id, data, owner, meta, trashed) VALUES ($1, $2, $3, $4, $5)`, er.Id, er.Data, er.Owner, er.Meta, trashedValue(er.Trashed))
+	if err != nil {
+		return fmt.Errorf("pg restore election %d, %v", er.Id, err)
+	}
+	_, err = sdb.conn().Exec(`SELECT setval(pg_get_serial_sequence('elections', 'id'), (SELECT MAX(id) FROM elections))`)
+	if err != nil {
+		return fmt.Errorf("pg restore elections sequence, %v", err)
+	}
+	err = addRevision(sdb.conn(), "$", er.Id, er.Data)
+	if err != nil {
+		return err
+	}
+	return indexElection(sdb.conn(), "$", er.Id, er.Data)
+}
+
+func (sdb *postgresedb) RestoreScan(sr scanRecord) error {
+	_, err := sdb.conn().Exec(`INSERT INTO scans (id, election, owner, image, content_type, interpreter, result, created, device, operator, batch, precinct, rev) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`, sr.Id, sr.ElectionId, sr.Owner, sr.Image, sr.ContentType, sr.Interpreter, sr.Result, sr.Created, sr.Custody.Device, sr.Custody.Operator, sr.Custody.Batch, sr.Custody.Precinct, sr.Rev)
+	if err != nil {
+		return fmt.Errorf("pg restore scan %d, %v", sr.Id, err)
+	}
+	_, err = sdb.conn().Exec(`SELECT setval(pg_get_serial_sequence('scans', 'id'), (SELECT MAX(id) FROM scans))`)
+	if err != nil {
+		return fmt.Errorf("pg restore scans sequence, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) UpdateScanResult(id int64, interpreter, result string) (err error) {
+	_, err = sdb.conn().Exec(`UPDATE scans SET interpreter = $1, result = $2 WHERE id = $3`, interpreter, result, id)
+	if err != nil {
+		err = fmt.Errorf("pg scan update, %v", err)
+	}
+	return
+}
+
+func (sdb *postgresedb) TrashElection(id int64, when time.Time) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET trashed = $1 WHERE id = $2`, when.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("pg trash election, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) UntrashElection(id int64) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET trashed = NULL WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("pg untrash election, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) TrashedForUser(uid int64) (ids []int64, err error) {
+	var rows *sql.Rows
+	rows, err = sdb.conn().Query(`SELECT id FROM elections WHERE owner = $1 AND trashed IS NOT NULL ORDER BY trashed DESC`, uid)
+	if err != nil {
+		err = fmt.Errorf("pg user trash, %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eid int64
+		err = rows.Scan(&eid)
+		if err != nil {
+			err = fmt.Errorf("pg user trash row, %v", err)
+			return
+		}
+		ids = append(ids, eid)
+	}
+	return
+}
+
+func (sdb *postgresedb) PurgeTrash(before time.Time) (purged int64, err error) {
+	return purgeTrash(sdb.conn(), "id", "$1", before)
+}
+
+func (sdb *postgresedb) StaleDrafts(before time.Time) (ids []int64, err error) {
+	return staleDrafts(sdb.conn(), "id", "$1", "$2", before)
+}
+
+func (sdb *postgresedb) PutAnnotation(ar annotationRecord) (newid int64, err error) {
+	row := sdb.conn().QueryRow(`INSERT INTO annotations (election, page, x, y, comment, author, author_name, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`, ar.ElectionId, ar.Page, ar.X, ar.Y, ar.Comment, ar.Author, ar.AuthorName, ar.Created)
+	err = row.Scan(&newid)
+	if err != nil {
+		err = fmt.Errorf("pg put annotation insert, %v", err)
+	}
+	return
+}
+
+func (sdb *postgresedb) AnnotationsForElection(eid int64) ([]annotationRecord, error) {
+	return queryAnnotations(sdb.conn(), `SELECT id, election, page, x, y, comment, author, author_name, created FROM annotations WHERE election = $1 ORDER BY id`, eid)
+}
+
+func (sdb *postgresedb) DeleteAnnotation(eid, id int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM annotations WHERE id = $1 AND election = $2`, id, eid)
+	if err != nil {
+		return fmt.Errorf("pg delete annotation, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) GetElectionState(id int64) (state string, err error) {
+	return getElectionState(sdb.conn(), id)
+}
+
+func (sdb *postgresedb) SetElectionState(id int64, from, to string) (ok bool, err error) {
+	return setElectionState(sdb.conn(), id, from, to,
+		`INSERT INTO election_state (election, state, changed) VALUES ($1, $2, $3) ON CONFLICT (election) DO UPDATE SET state = EXCLUDED.state, changed = EXCLUDED.changed`,
+		time.Now().UTC())
+}
+
+func (sdb *postgresedb) PutDigestSchedule(ds digestSchedule) error {
+	_, err := sdb.conn().Exec(`INSERT INTO digest_schedules (user_id, email, weekday, hour, last_sent) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id) DO UPDATE SET email = EXCLUDED.email, weekday = EXCLUDED.weekday, hour = EXCLUDED.hour, last_sent = EXCLUDED.last_sent`, ds.UserId, ds.Email, ds.Weekday, ds.Hour, ds.LastSent)
+	if err != nil {
+		return fmt.Errorf("pg put digest schedule, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) GetDigestSchedule(uid int64) (*digestSchedule, error) {
+	return getDigestSchedule(sdb.conn(), uid)
+}
+
+func (sdb *postgresedb) DeleteDigestSchedule(uid int64) error {
+	return deleteDigestSchedule(sdb.conn(), `DELETE FROM digest_schedules WHERE user_id = $1`, uid)
+}
+
+func (sdb *postgresedb) DigestSchedules() ([]digestSchedule, error) {
+	return queryDigestSchedules(sdb.conn())
+}
+
+func (sdb *postgresedb) PutNotifyPrefs(np notifyPrefs) error {
+	_, err := sdb.conn().Exec(`INSERT INTO notify_prefs (user_id, username, email, shares, mentions, renders) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (user_id) DO UPDATE SET username = EXCLUDED.username, email = EXCLUDED.email, shares = EXCLUDED.shares, mentions = EXCLUDED.mentions, renders = EXCLUDED.renders`, np.UserId, np.Username, np.Email, boolInt(np.Shares), boolInt(np.Mentions), boolInt(np.Renders))
+	if err != nil {
+		return fmt.Errorf("postgres put notify prefs, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) GetNotifyPrefs(uid int64) (*notifyPrefs, error) {
+	return getNotifyPrefs(sdb.conn(), `SELECT user_id, username, email, shares, mentions, renders FROM notify_prefs WHERE user_id = $1`, uid)
+}
+
+func (sdb *postgresedb) NotifyPrefsForUsername(username string) (*notifyPrefs, error) {
+	return getNotifyPrefs(sdb.conn(), `SELECT user_id, username, email, shares, mentions, renders FROM notify_prefs WHERE LOWER(username) = LOWER($1)`, username)
+}
+
+func (sdb *postgresedb) DeleteNotifyPrefs(uid int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM notify_prefs WHERE user_id = $1`, uid)
+	if err != nil {
+		return fmt.Errorf("notify prefs delete, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) AllNotifyPrefs() ([]notifyPrefs, error) {
+	return queryNotifyPrefs(sdb.conn())
+}
+
+func (sdb *postgresedb) PutStaff(sr staffRecord) error {
+	_, err := sdb.conn().Exec(`INSERT INTO staff (email, role, organization, user_id, invite, provisioned) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (email) DO UPDATE SET role = EXCLUDED.role, organization = EXCLUDED.organization, user_id = EXCLUDED.user_id, invite = EXCLUDED.invite, provisioned = EXCLUDED.provisioned`, sr.Email, sr.Role, sr.Organization, sr.UserId, sr.Invite, sr.Provisioned)
+	if err != nil {
+		return fmt.Errorf("pg put staff, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) GetStaff(email string) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE email = $1`, email)
+}
+
+func (sdb *postgresedb) StaffByInvite(token string) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE invite = $1`, token)
+}
+
+func (sdb *postgresedb) StaffForUser(uid int64) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE user_id = $1`, uid)
+}
+
+func (sdb *postgresedb) StaffList() ([]staffRecord, error) {
+	return queryStaff(sdb.conn())
+}
+
+func (sdb *postgresedb) ElectionRevisions(eid int64) ([]revisionRecord, error) {
+	return electionRevisions(sdb.conn(), `SELECT election, rev, LENGTH(data), created FROM election_revisions WHERE election = $1 ORDER BY rev`, eid)
+}
+
+func (sdb *postgresedb) GetElectionRevision(eid int64, rev int) (*revisionRecord, error) {
+	return getElectionRevision(sdb.conn(), `SELECT data, created FROM election_revisions WHERE election = $1 AND rev = $2`, eid, rev)
+}
+
+func (sdb *postgresedb) RestoreRevisions(eid int64, revs []revisionRecord) error {
+	return restoreRevisions(sdb.conn(), "$", eid, revs)
+}
+
+// common to sqlite and postgres
+func getElectionState(db sqlDB, id int64) (state string, err error) {
+	row := db.QueryRow(`SELECT state FROM election_state WHERE election = $1`, id)
+	err = row.Scan(&state)
+	if err == sql.ErrNoRows {
+		return StateDraft, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("election state get, %v", err)
+	}
+	return
+}
+
+// common to sqlite and postgres, upsert and changed differ
+func setElectionState(db sqlDB, id int64, from, to, upsert string, changed interface{}) (ok bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		err = fmt.Errorf("tx err, %v", err)
+		return
+	}
+	defer tx.Rollback()
+	var state string
+	row := tx.QueryRow(`SELECT state FROM election_state WHERE election = $1`, id)
+	err = row.Scan(&state)
+	if err == sql.ErrNoRows {
+		state = StateDraft
+	} else if err != nil {
+		err = fmt.Errorf("election state get, %v", err)
+		return
+	}
+	if state != from {
+		return false, nil
+	}
+	_, err = tx.Exec(upsert, id, to, changed)
+	if err != nil {
+		err = fmt.Errorf("election state put, %v", err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		err = fmt.Errorf("election state commit, %v", err)
+		return
+	}
+	return true, nil
+}
+
+// common to all backends, query differs
+func queryAnnotations(db sqlDB, query string, eid int64) (out []annotationRecord, err error) {
+	rows, err := db.Query(query, eid)
+	if err != nil {
+		return nil, fmt.Errorf("annotations, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ar annotationRecord
+		err = rows.Scan(&ar.Id, &ar.ElectionId, &ar.Page, &ar.X, &ar.Y, &ar.Comment, &ar.Author, &ar.AuthorName, &ar.Created)
+		if err != nil {
+			return nil, fmt.Errorf("annotations row, %v", err)
+		}
+		out = append(out, ar)
+	}
+	return out, rows.Err()
+}
+
+// common to sqlite and postgres
+func getDigestSchedule(db sqlDB, uid int64) (*digestSchedule, error) {
+	ds := digestSchedule{UserId: uid}
+	row := db.QueryRow(`SELECT email, weekday, hour, last_sent FROM digest_schedules WHERE user_id = $1`, uid)
+	err := row.Scan(&ds.Email, &ds.Weekday, &ds.Hour, &ds.LastSent)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("digest schedule get, %v", err)
+	}
+	return &ds, nil
+}
+
+// common to all backends, query differs
+func deleteDigestSchedule(db sqlDB, query string, uid int64) error {
+	_, err := db.Exec(query, uid)
+	if err != nil {
+		return fmt.Errorf("digest schedule delete, %v", err)
+	}
+	return nil
+}
+
+// common to all backends
+func queryDigestSchedules(db sqlDB) (out []digestSchedule, err error) {
+	rows, err := db.Query(`SELECT user_id, email, weekday, hour, last_sent FROM digest_schedules ORDER BY user_id`)
+	if err != nil {
+		return nil, fmt.Errorf("digest schedules, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ds digestSchedule
+		err = rows.Scan(&ds.UserId, &ds.Email, &ds.Weekday, &ds.Hour, &ds.LastSent)
+		if err != nil {
+			return nil, fmt.Errorf("digest schedules row, %v", err)
+		}
+		out = append(out, ds)
+	}
+	return out, rows.Err()
+}
+
+// common to all backends, query differs
+func getStaff(db sqlDB, query string, arg interface{}) (*staffRecord, error) {
+	var sr staffRecord
+	err := db.QueryRow(query, arg).Scan(&sr.Email, &sr.Role, &sr.Organization, &sr.UserId, &sr.Invite, &sr.Provisioned)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("staff get, %v", err)
+	}
+	return &sr, nil
+}
+
+// common to all backends
+func queryStaff(db sqlDB) (out []staffRecord, err error) {
+	rows, err := db.Query(`SELECT email, role, organization, user_id, invite, provisioned FROM staff ORDER BY organization, email`)
+	if err != nil {
+		return nil, fmt.Errorf("staff, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sr staffRecord
+		err = rows.Scan(&sr.Email, &sr.Role, &sr.Organization, &sr.UserId, &sr.Invite, &sr.Provisioned)
+		if err != nil {
+			return nil, fmt.Errorf("staff row, %v", err)
+		}
+		out = append(out, sr)
+	}
+	return out, rows.Err()
+}
+
+// addRevision saves data as the next revision of election eid, unless
+// it's the same as the latest one. Common to all backends, param is "$"
+// for numbered placeholders or "?".
+func addRevision(db sqlDB, param string, eid int64, data string) (err error) {
+	ph := func(i int) string {
+		if param == "?" {
+			return "?"
+		}
+		return fmt.Sprintf("$%d", i)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("revision tx, %v", err)
+	}
+	defer tx.Rollback()
+	var rev int
+	var latest sql.NullString
+	err = tx.QueryRow(fmt.Sprintf(`SELECT rev, data FROM election_revisions WHERE election = %s ORDER BY rev DESC LIMIT 1`, ph(1)), eid).Scan(&rev, &latest)
+	if err == nil && latest.String == data {
+		return nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("revision latest, %v", err)
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO election_revisions (election, rev, data, created) VALUES (%s, %s, %s, %s)`, ph(1), ph(2), ph(3), ph(4)), eid, rev+1, data, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("revision insert, %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("revision commit, %v", err)
+	}
+	return nil
+}
+
+// updateElectionIf replaces election er.Id's document if it is still old,
+// common to all backends
+func updateElectionIf(db sqlDB, param, idcol string, er electionRecord, old string) (ok bool, err error) {
+	if er.Data == old {
+		// nothing to write, and mysql counts only the rows it changed
+		return true, nil
+	}
+	query := fmt.Sprintf(`UPDATE elections SET data = $1 WHERE %s = $2 AND data = $3`, idcol)
+	if param == "?" {
+		query = fmt.Sprintf(`UPDATE elections SET data = ? WHERE %s = ? AND data = ?`, idcol)
+	}
+	result, err := db.Exec(query, er.Data, er.Id, old)
+	if err != nil {
+		return false, fmt.Errorf("election update, %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("election update count, %v", err)
+	}
+	return n == 1, nil
+}
+
+// restoreRevisions replaces eid's revisions with revs, common to all backends
+func restoreRevisions(db sqlDB, param string, eid int64, revs []revisionRecord) (err error) {
+	ph := func(i int) string {
+		if param == "?" {
+			return "?"
+		}
+		return fmt.Sprintf("$%d", i)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("restore revisions tx, %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM election_revisions WHERE election = `+ph(1), eid)
+	if err != nil {
+		return fmt.Errorf("restore revisions delete, %v", err)
+	}
+	for _, rr := range revs {
+		_, err = tx.Exec(fmt.Sprintf(`INSERT INTO election_revisions (election, rev, data, created) VALUES (%s, %s, %s, %s)`, ph(1), ph(2), ph(3), ph(4)), eid, rr.Rev, rr.Data, rr.Created)
+		if err != nil {
+			return fmt.Errorf("restore revision %d, %v", rr.Rev, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("restore revisions commit, %v", err)
+	}
+	return nil
+}
+
+// prefix matches of every term, ranked
+func (sdb *postgresedb) SearchElections(terms []string, uid int64, limit int) ([]searchRecord, error) {
+	prefixes := make([]string, len(terms))
+	for i, t := range terms {
+		prefixes[i] = t + ":*"
+	}
+	return querySearch(sdb.conn(), `SELECT s.election, e.owner, s.title, s.contests, s.candidates FROM election_search s
+JOIN elections e ON e.id = s.election LEFT JOIN election_state st ON st.election = s.election
+WHERE to_tsvector('simple', s.title || ' ' || s.contests || ' ' || s.candidates) @@ to_tsquery('simple', $3)
+AND e.trashed IS NULL AND (e.owner = $1 OR st.state = $2)
+ORDER BY ts_rank(to_tsvector('simple', s.title || ' ' || s.contests || ' ' || s.candidates), to_tsquery('simple', $3)) DESC LIMIT $4`,
+		uid, StatePublished, strings.Join(prefixes, " & "), limit)
+}
+
+func (sdb *postgresedb) ElectionFacts(f factsFilter) ([]electionFacts, error) {
+	return queryFacts(sdb.conn(), "$", "id", f)
+}
+
+func (sdb *postgresedb) UserUsage(uid int64) (quotaUsage, error) {
+	return queryUsage(sdb.conn(), "$", "id", uid)
+}
+
+func (sdb *postgresedb) GetUserQuota(uid int64) (*quotaLimits, error) {
+	return getUserQuota(sdb.conn(), "$", uid)
+}
+
+func (sdb *postgresedb) SetUserQuota(uid int64, q *quotaLimits) error {
+	return setUserQuota(sdb.conn(), "$", uid, q)
+}
+
+func (sdb *postgresedb) PruneRevisions(eid int64, keep int64) error {
+	return pruneRevisions(sdb.conn(), "$", eid, keep)
+}
+
+func (sdb *postgresedb) GetAccount(uid int64) (*accountRecord, error) {
+	return getAccount(sdb.conn(), "$", uid)
+}
+
+func (sdb *postgresedb) PutAccount(ar accountRecord) error {
+	return putAccount(sdb.conn(), "$", ar)
+}
+
+func (sdb *postgresedb) DeleteAccount(uid, electionsTo int64) (int64, error) {
+	return deleteAccount(sdb.conn(), "$", "id", uid, electionsTo)
+}
+
+func (sdb *postgresedb) ListAccounts() ([]accountSummary, error) {
+	return listAccounts(sdb.conn())
+}
+
+func (sdb *postgresedb) GetExternalIdentity(issuer, subject string) (*externalIdentity, error) {
+	return getExternalIdentity(sdb.conn(), "$", issuer, subject)
+}
+
+func (sdb *postgresedb) PutExternalIdentity(ei externalIdentity) error {
+	return putExternalIdentity(sdb.conn(), "$", ei)
+}
+
+func (sdb *postgresedb) ElectionTags(eid int64) ([]string, error) {
+	tags, err := queryTags(sdb.conn(), `SELECT election, tag FROM election_tags WHERE election = $1`, eid)
+	return tags[eid], err
+}
+
+func (sdb *postgresedb) SetElectionTags(eid int64, tags []string) error {
+	return setElectionTags(sdb.conn(), "$", eid, tags)
+}
+
+func (sdb *postgresedb) TagsForUser(uid int64) (map[int64][]string, error) {
+	return queryTags(sdb.conn(), `SELECT t.election, t.tag FROM election_tags t JOIN elections e ON e.id = t.election WHERE e.owner = $1 AND e.trashed IS NULL`, uid)
+}
+
+func (sdb *postgresedb) PutWebhook(wh webhookRecord) (newid int64, err error) {
+	row := sdb.conn().QueryRow(`INSERT INTO webhooks (owner, election, url, secret, events, created) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`, wh.Owner, wh.ElectionId, wh.URL, wh.Secret, strings.Join(wh.Events, ","), wh.Created)
+	err = row.Scan(&newid)
+	if err != nil {
+		err = fmt.Errorf("pg put webhook insert, %v", err)
+	}
+	return
+}
+
+func (sdb *postgresedb) GetWebhook(id int64) (*webhookRecord, error) {
+	return getWebhook(sdb.conn(), `SELECT id, owner, election, url, secret, events, created FROM webhooks WHERE id = $1`, id)
+}
+
+func (sdb *postgresedb) WebhooksForUser(uid int64) ([]webhookRecord, error) {
+	return queryWebhooks(sdb.conn(), `SELECT id, owner, election, url, secret, events, created FROM webhooks WHERE owner = $1 ORDER BY id`, uid)
+}
+
+func (sdb *postgresedb) WebhooksForElection(eid int64) ([]webhookRecord, error) {
+	return queryWebhooks(sdb.conn(), `SELECT id, owner, election, url, secret, events, created FROM webhooks WHERE election = $1 OR (election = 0 AND owner = (SELECT owner FROM elections WHERE id = $1))`, eid)
+}
+
+func (sdb *postgresedb) DeleteWebhook(id int64) error {
+	return deleteWebhook(sdb.conn(), "$", "id", id)
+}
+
+func (sdb *postgresedb) PutWebhookDelivery(d webhookDelivery) (id int64, err error) {
+	if d.Id != 0 {
+		return d.Id, updateDelivery(sdb.conn(), "$", "id", d)
+	}
+	row := sdb.conn().QueryRow(`INSERT INTO webhook_deliveries (webhook, event, payload, status, attempts, next_try, last_error, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`, d.WebhookId, d.Event, d.Payload, d.Status, d.Attempts, d.NextTry, d.LastError, d.Created)
+	err = row.Scan(&id)
+	if err != nil {
+		err = fmt.Errorf("pg put webhook delivery insert, %v", err)
+	}
+	return
+}
+
+func (sdb *postgresedb) DueWebhookDeliveries(now int64, limit int) ([]webhookDelivery, error) {
+	return queryDeliveries(sdb.conn(), `SELECT id, webhook, event, payload, status, attempts, next_try, last_error, created FROM webhook_deliveries WHERE status = 'pending' AND next_try <= $1 ORDER BY id LIMIT $2`, now, limit)
+}
+
+func (sdb *postgresedb) WebhookDeliveries(webhookid int64, limit int) ([]webhookDelivery, error) {
+	return queryDeliveries(sdb.conn(), `SELECT id, webhook, event, payload, status, attempts, next_try, last_error, created FROM webhook_deliveries WHERE webhook = $1 ORDER BY id DESC LIMIT $2`, webhookid, limit)
+}
+
+func (sdb *postgresedb) PurgeWebhookDeliveries(before int64) (purged int64, err error) {
+	return purgeDeliveries(sdb.conn(), "$", before)
+}
+
+func (sdb *postgresedb) PutPrintJob(pj printJob) (id int64, err error) {
+	if pj.Id != 0 {
+		return pj.Id, updatePrintJob(sdb.conn(), "$", "id", pj)
+	}
+	row := sdb.conn().QueryRow(`INSERT INTO print_jobs (election, style, requested_by, status, error, created, done, picked_up) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`, pj.ElectionId, pj.Style, pj.RequestedBy, pj.Status, pj.Error, pj.Created, pj.Done, pj.PickedUp)
+	err = row.Scan(&id)
+	if err != nil {
+		err = fmt.Errorf("pg put print job insert, %v", err)
+	}
+	return
+}
+
+func (sdb *postgresedb) GetPrintJob(id int64) (*printJob, error) {
+	return getPrintJob(sdb.conn(), `SELECT id, `+printJobColumns+`, pdf FROM print_jobs WHERE id = $1`, id)
+}
+
+func (sdb *postgresedb) PickUpPrintJob(id, now int64) (bool, error) {
+	return pickUpPrintJob(sdb.conn(), "$", "id", id, now)
+}
+
+func (sdb *postgresedb) PrintJobsForElection(eid int64, limit int) ([]printJob, error) {
+	return queryPrintJobs(sdb.conn(), `SELECT id, `+printJobColumns+` FROM print_jobs WHERE election = $1 ORDER BY id DESC LIMIT $2`, eid, limit)
+}
+
+func (sdb *postgresedb) QueuedPrintJobs(limit int) ([]printJob, error) {
+	return queryPrintJobs(sdb.conn(), `SELECT id, `+printJobColumns+` FROM print_jobs WHERE status = 'queued' ORDER BY id LIMIT $1`, limit)
+}
+
+func (sdb *postgresedb) PrintJobCounts(eid int64) (map[int]map[string]int, error) {
+	return printJobCounts(sdb.conn(), `SELECT style, status, COUNT(*) FROM print_jobs WHERE election = $1 GROUP BY style, status`, eid)
+}
+
+func (sdb *postgresedb) PutPrintRun(pr *printRun, next bool) (*printRun, error) {
+	lock := `SELECT id FROM elections WHERE id = $1 FOR UPDATE`
+	runs := `SELECT id, ` + printRunColumns + ` FROM print_runs WHERE election = $1 ORDER BY id`
+	return putPrintRun(sdb.conn(), lock, runs, pr, next, func(tx *sql.Tx) (id int64, err error) {
+		row := tx.QueryRow(`INSERT INTO print_runs (`+printRunColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`, pr.ElectionId, pr.Style, pr.First, pr.Last, pr.BatchSize, pr.Rev, pr.RequestedBy, pr.Created)
+		err = row.Scan(&id)
+		if err != nil {
+			err = fmt.Errorf("pg put print run insert, %v", err)
+		}
+		return
+	})
+}
+
+func (sdb *postgresedb) GetPrintRun(id int64) (*printRun, error) {
+	return getPrintRun(sdb.conn(), `SELECT id, `+printRunColumns+` FROM print_runs WHERE id = $1`, id)
+}
+
+func (sdb *postgresedb) PrintRunsForElection(eid int64) ([]printRun, error) {
+	return queryPrintRuns(sdb.conn(), `SELECT id, `+printRunColumns+` FROM print_runs WHERE election = $1 ORDER BY id`, eid)
+}
+
+func (sdb *postgresedb) PutPrintRunDownload(d printRunDownload) error {
+	return putPrintRunDownload(sdb.conn(), "$", d)
+}
+
+func (sdb *postgresedb) PrintRunDownloads(runid int64) ([]printRunDownload, error) {
+	return printRunDownloads(sdb.conn(), `SELECT batch, downloaded_by, downloaded FROM print_run_downloads WHERE run = $1 ORDER BY downloaded, id`, runid)
+}
+
+func (sdb *postgresedb) SetSampleSlug(eid int64, slug string) error {
+	return setSampleSlug(sdb.conn(), "$", eid, slug)
+}
+
+func (sdb *postgresedb) SampleSlug(eid int64) (string, error) {
+	return sampleSlug(sdb.conn(), `SELECT slug FROM sample_ballots WHERE election = $1`, eid)
+}
+
+func (sdb *postgresedb) SampleElection(slug string) (int64, error) {
+	return sampleElection(sdb.conn(), `SELECT election FROM sample_ballots WHERE slug = $1`, slug)
+}
+
+func (sdb *postgresedb) PutLibraryEntry(le libraryEntry) (id int64, err error) {
+	if le.Id != 0 {
+		return le.Id, updateLibraryEntry(sdb.conn(), "$", "id", le)
+	}
+	row := sdb.conn().QueryRow(`INSERT INTO library_entries (owner, kind, name, data, updated) VALUES ($1, $2, $3, $4, $5) RETURNING id`, le.Owner, le.Kind, le.Name, string(le.Data), le.Updated)
+	err = row.Scan(&id)
+	if err != nil {
+		err = fmt.Errorf("pg put library entry insert, %v", err)
+	}
+	return
+}
+
+func (sdb *postgresedb) GetLibraryEntry(id int64) (*libraryEntry, error) {
+	return getLibraryEntry(sdb.conn(), `SELECT id, `+libraryEntryColumns+` FROM library_entries WHERE id = $1`, id)
+}
+
+func (sdb *postgresedb) LibraryEntries() ([]libraryEntry, error) {
+	return queryLibraryEntries(sdb.conn(), `SELECT id, `+libraryEntryColumns+` FROM library_entries ORDER BY kind, name, id`)
+}
+
+func (sdb *postgresedb) DeleteLibraryEntry(id int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM library_entries WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("pg delete library entry, %v", err)
+	}
+	return nil
+}
+
+func (sdb *postgresedb) LibraryElections(id int64) ([]int64, error) {
+	return libraryElections(sdb.conn(), "$", "id", id)
+}
+
+// common to all backends, query differs
+func electionRevisions(db sqlDB, query string, eid int64) (out []revisionRecord, err error) {
+	rows, err := db.Query(query, eid)
+	if err != nil {
+		return nil, fmt.Errorf("revisions, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rr revisionRecord
+		var size sql.NullInt64
+		err = rows.Scan(&rr.ElectionId, &rr.Rev, &size, &rr.Created)
+		if err != nil {
+			return nil, fmt.Errorf("revisions row, %v", err)
+		}
+		rr.Size = int(size.Int64)
+		out = append(out, rr)
+	}
+	return out, rows.Err()
+}
+
+// common to all backends, query differs
+func getElectionRevision(db sqlDB, query string, eid int64, rev int) (*revisionRecord, error) {
+	rr := revisionRecord{ElectionId: eid, Rev: rev}
+	var data sql.NullString
+	err := db.QueryRow(query, eid, rev).Scan(&data, &rr.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("revision get, %v", err)
+	}
+	rr.Data = data.String
+	rr.Size = len(rr.Data)
+	return &rr, nil
+}
+
+// trashedValue is NULL for a live election
+// scans from before custody was kept have NULLs
+const scanCustodyColumns = `COALESCE(device, ''), COALESCE(operator, ''), COALESCE(batch, ''), COALESCE(precinct, '')`
+
+func trashedValue(trashed int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: trashed, Valid: trashed != 0}
+}
+
+// common to all backends, idcol and param differ
+func purgeTrash(db sqlDB, idcol, param string, before time.Time) (purged int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		err = fmt.Errorf("tx err, %v", err)
+		return
+	}
+	defer tx.Rollback()
+	purged, err = purgeElections(tx, idcol, "trashed < "+param, before.Unix())
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		err = fmt.Errorf("purge trash commit, %v", err)
+	}
+	return
+}
+
+// purgeElections deletes the elections matching `where` (one placeholder,
+// arg) and everything stored about them
+func purgeElections(tx *sql.Tx, idcol, where string, arg interface{}) (purged int64, err error) {
+	matched := fmt.Sprintf("SELECT %s FROM elections WHERE %s", idcol, where)
+	_, err = tx.Exec("DELETE FROM print_run_downloads WHERE run IN (SELECT "+idcol+" FROM print_runs WHERE election IN ("+matched+"))", arg)
+	if err != nil {
+		err = fmt.Errorf("purge print run downloads, %v", err)
+		return
+	}
+	for _, table := range []string{"scans", "election_state", "annotations", "election_revisions", "election_search", "election_tags", "sample_ballots", "print_jobs", "print_runs"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE election IN ("+matched+")", arg)
+		if err != nil {
+			err = fmt.Errorf("purge %s, %v", table, err)
+			return
+		}
+	}
+	_, err = tx.Exec("DELETE FROM webhook_deliveries WHERE webhook IN (SELECT "+idcol+" FROM webhooks WHERE election IN ("+matched+"))", arg)
+	if err != nil {
+		err = fmt.Errorf("purge webhook deliveries, %v", err)
+		return
+	}
+	_, err = tx.Exec("DELETE FROM webhooks WHERE election IN ("+matched+")", arg)
+	if err != nil {
+		err = fmt.Errorf("purge webhooks, %v", err)
+		return
+	}
+	result, err := tx.Exec("DELETE FROM elections WHERE "+where, arg)
+	if err != nil {
+		err = fmt.Errorf("purge elections, %v", err)
+		return
+	}
+	purged, _ = result.RowsAffected()
+	return
+}
+
+// common to all backends. Elections saved before revisions were kept don't
+// know when they were last saved and are never stale.
+func staleDrafts(db sqlDB, idcol, p1, p2 string, before time.Time) (ids []int64, err error) {
+	rows, err := db.Query(`SELECT e.`+idcol+` FROM elections e LEFT JOIN election_state st ON st.election = e.`+idcol+`
+WHERE e.trashed IS NULL AND (st.state IS NULL OR st.state = `+p1+`)
+AND (SELECT MAX(r.created) FROM election_revisions r WHERE r.election = e.`+idcol+`) BETWEEN 1 AND `+p2, StateDraft, before.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("stale drafts, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eid int64
+		err = rows.Scan(&eid)
+		if err != nil {
+			return nil, fmt.Errorf("stale drafts row, %v", err)
+		}
+		ids = append(ids, eid)
 	}
+	return ids, rows.Err()
 }
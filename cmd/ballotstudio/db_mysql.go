@@ -0,0 +1,691 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MySQL/MariaDB electionAppDB.
+// Uses `?` placeholders; times are stored as unix seconds like sqlite so the
+// connection doesn't need parseTime=true.
+
+func NewMysqlEDB(db *sql.DB) electionAppDB {
+	return &mysqledb{db: db}
+}
+
+type mysqledb struct {
+	db  *sql.DB
+	ctx context.Context // see WithContext
+}
+
+// implement electionAppDB
+func (sdb *mysqledb) Setup() error {
+	err := sdb.Migrator().migrate(latestMigration)
+	if err != nil {
+		return err
+	}
+	return indexUnindexed(sdb.conn(), "?", `SELECT id, data FROM elections WHERE id NOT IN (SELECT election FROM election_search)`)
+}
+
+func (sdb *mysqledb) Migrator() *migrator {
+	return &migrator{db: sdb.db, steps: mysqlMigrations, param: "?"}
+}
+
+func (sdb *mysqledb) WithContext(ctx context.Context) electionAppDB {
+	return &mysqledb{sdb.db, ctx}
+}
+
+func (sdb *mysqledb) conn() sqlDB {
+	return dbWithContext(sdb.db, sdb.ctx)
+}
+
+func (sdb *mysqledb) GetElection(id int64) (er *electionRecord, err error) {
+	row := sdb.conn().QueryRow(`SELECT data, owner, meta, trashed FROM elections WHERE id = ?`, id)
+	er = &electionRecord{Id: id}
+	var trashed sql.NullInt64
+	err = row.Scan(&er.Data, &er.Owner, &er.Meta, &trashed)
+	if err != nil {
+		er = nil
+		return
+	}
+	er.Trashed = trashed.Int64
+	return
+}
+
+func (sdb *mysqledb) PutElection(er electionRecord) (newid int64, err error) {
+	if er.Id == 0 {
+		var result sql.Result
+		result, err = sdb.conn().Exec(`INSERT INTO elections (data, owner, meta) VALUES (?, ?, ?)`, er.Data, er.Owner, er.Meta)
+		if err != nil {
+			err = fmt.Errorf("mysql put election insert, %v", err)
+			return
+		}
+		newid, err = result.LastInsertId()
+		if err != nil {
+			err = fmt.Errorf("mysql put election id, %v", err)
+			return
+		}
+		err = addRevision(sdb.conn(), "?", newid, er.Data)
+		if err == nil {
+			err = indexElection(sdb.conn(), "?", newid, er.Data)
+		}
+		return
+	}
+	_, err = sdb.conn().Exec(`UPDATE elections SET data = ?, owner = ?, meta = ? WHERE id = ?`, er.Data, er.Owner, er.Meta, er.Id)
+	if err != nil {
+		err = fmt.Errorf("mysql put election update, %v", err)
+		return
+	}
+	newid = er.Id
+	err = addRevision(sdb.conn(), "?", newid, er.Data)
+	if err == nil {
+		err = indexElection(sdb.conn(), "?", newid, er.Data)
+	}
+	return
+}
+
+func (sdb *mysqledb) PutElectionIf(er electionRecord, old string) (ok bool, err error) {
+	ok, err = updateElectionIf(sdb.conn(), "?", "id", er, old)
+	if ok {
+		err = addRevision(sdb.conn(), "?", er.Id, er.Data)
+	}
+	if ok && err == nil {
+		err = indexElection(sdb.conn(), "?", er.Id, er.Data)
+	}
+	return
+}
+
+func (sdb *mysqledb) SetElectionMeta(id int64, meta string) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET meta = ? WHERE id = ?`, meta, id)
+	if err != nil {
+		return fmt.Errorf("mysql set election meta, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) ElectionsForUser(uid int64) (ids []int64, err error) {
+	return mysqlIds(sdb.conn(), "mysql user er doc", `SELECT id FROM elections WHERE owner = ? AND trashed IS NULL`, uid)
+}
+
+func (sdb *mysqledb) MakeInviteToken(token string, expires time.Time) (err error) {
+	_, err = sdb.conn().Exec(`INSERT INTO invites (token, expires) VALUES (?, ?)`, token, expires.UTC().Unix())
+	if err != nil {
+		err = fmt.Errorf("invite put, %v", err)
+	}
+	return err
+}
+
+func (sdb *mysqledb) PeekInviteToken(token string) (ok bool, expires time.Time, err error) {
+	row := sdb.conn().QueryRow(`SELECT expires FROM invites WHERE token = ?`, token)
+	var expiresi int64
+	err = row.Scan(&expiresi)
+	if err == sql.ErrNoRows {
+		return false, time.Time{}, nil
+	}
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("invite get, %v", err)
+	}
+	return time.Now().UTC().Unix() < expiresi, time.Unix(expiresi, 0), nil
+}
+
+func (sdb *mysqledb) UseInviteToken(token string) (ok bool, err error) {
+	tx, err := sdb.conn().Begin()
+	if err != nil {
+		err = fmt.Errorf("tx err, %v", err)
+		return
+	}
+	defer tx.Rollback()
+	row := tx.QueryRow(`SELECT expires FROM invites WHERE token = ? FOR UPDATE`, token)
+	var expires int64
+	err = row.Scan(&expires)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("invite get, %v", err)
+		return
+	}
+	if time.Now().UTC().Unix() > expires {
+		return false, nil
+	}
+	_, err = tx.Exec(`DELETE FROM invites WHERE token = ?`, token)
+	if err != nil {
+		err = fmt.Errorf("invite del, %v", err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		err = fmt.Errorf("invite del commit, %v", err)
+		return
+	}
+	return true, nil
+}
+
+func (sdb *mysqledb) GCInviteTokens() (removed int64, err error) {
+	result, err := sdb.conn().Exec(`DELETE FROM invites WHERE expires < ?`, time.Now().UTC().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("invite gc, %v", err)
+	}
+	return result.RowsAffected()
+}
+
+func (sdb *mysqledb) PutScan(sr scanRecord) (newid int64, err error) {
+	result, err := sdb.conn().Exec(`INSERT INTO scans (election, owner, image, content_type, interpreter, result, created, device, operator, batch, precinct, rev) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, sr.ElectionId, sr.Owner, sr.Image, sr.ContentType, sr.Interpreter, sr.Result, sr.Created, sr.Custody.Device, sr.Custody.Operator, sr.Custody.Batch, sr.Custody.Precinct, sr.Rev)
+	if err != nil {
+		err = fmt.Errorf("mysql put scan insert, %v", err)
+		return
+	}
+	newid, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("mysql put scan id, %v", err)
+	}
+	return
+}
+
+func (sdb *mysqledb) GetScan(id int64) (sr *scanRecord, err error) {
+	row := sdb.conn().QueryRow(`SELECT election, owner, image, content_type, interpreter, result, created, `+scanCustodyColumns+`, COALESCE(rev, 0) FROM scans WHERE id = ?`, id)
+	sr = &scanRecord{Id: id}
+	err = row.Scan(&sr.ElectionId, &sr.Owner, &sr.Image, &sr.ContentType, &sr.Interpreter, &sr.Result, &sr.Created, &sr.Custody.Device, &sr.Custody.Operator, &sr.Custody.Batch, &sr.Custody.Precinct, &sr.Rev)
+	if err != nil {
+		sr = nil
+	}
+	return
+}
+
+func (sdb *mysqledb) ScansForElection(eid int64) (ids []int64, err error) {
+	return mysqlIds(sdb.conn(), "mysql election scans", `SELECT id FROM scans WHERE election = ? ORDER BY id`, eid)
+}
+
+func (sdb *mysqledb) ElectionIds() (ids []int64, err error) {
+	return mysqlIds(sdb.conn(), "mysql election ids", `SELECT id FROM elections ORDER BY id`)
+}
+
+func (sdb *mysqledb) RestoreElection(er electionRecord) error {
+	_, err := sdb.conn().Exec(`INSERT INTO elections (id, data, owner, meta, trashed) VALUES (?, ?, ?, ?, ?)`, er.Id, er.Data, er.Owner, er.Meta, trashedValue(er.Trashed))
+	if err != nil {
+		return fmt.Errorf("mysql restore election %d, %v", er.Id, err)
+	}
+	err = addRevision(sdb.conn(), "?", er.Id, er.Data)
+	if err != nil {
+		return err
+	}
+	return indexElection(sdb.conn(), "?", er.Id, er.Data)
+}
+
+func (sdb *mysqledb) RestoreScan(sr scanRecord) error {
+	_, err := sdb.conn().Exec(`INSERT INTO scans (id, election, owner, image, content_type, interpreter, result, created, device, operator, batch, precinct, rev) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, sr.Id, sr.ElectionId, sr.Owner, sr.Image, sr.ContentType, sr.Interpreter, sr.Result, sr.Created, sr.Custody.Device, sr.Custody.Operator, sr.Custody.Batch, sr.Custody.Precinct, sr.Rev)
+	if err != nil {
+		return fmt.Errorf("mysql restore scan %d, %v", sr.Id, err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) UpdateScanResult(id int64, interpreter, result string) (err error) {
+	_, err = sdb.conn().Exec(`UPDATE scans SET interpreter = ?, result = ? WHERE id = ?`, interpreter, result, id)
+	if err != nil {
+		err = fmt.Errorf("mysql scan update, %v", err)
+	}
+	return
+}
+
+func (sdb *mysqledb) TrashElection(id int64, when time.Time) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET trashed = ? WHERE id = ?`, when.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("mysql trash election, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) UntrashElection(id int64) error {
+	_, err := sdb.conn().Exec(`UPDATE elections SET trashed = NULL WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("mysql untrash election, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) TrashedForUser(uid int64) (ids []int64, err error) {
+	return mysqlIds(sdb.conn(), "mysql user trash", `SELECT id FROM elections WHERE owner = ? AND trashed IS NOT NULL ORDER BY trashed DESC`, uid)
+}
+
+// mysql won't delete from a table while selecting from it in a subquery, but
+// scans and election_state are different tables and elections goes last
+func (sdb *mysqledb) PurgeTrash(before time.Time) (purged int64, err error) {
+	return purgeTrash(sdb.conn(), "id", "?", before)
+}
+
+func (sdb *mysqledb) StaleDrafts(before time.Time) (ids []int64, err error) {
+	return staleDrafts(sdb.conn(), "id", "?", "?", before)
+}
+
+func (sdb *mysqledb) PutAnnotation(ar annotationRecord) (newid int64, err error) {
+	result, err := sdb.conn().Exec(`INSERT INTO annotations (election, page, x, y, comment, author, author_name, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, ar.ElectionId, ar.Page, ar.X, ar.Y, ar.Comment, ar.Author, ar.AuthorName, ar.Created)
+	if err != nil {
+		err = fmt.Errorf("mysql put annotation insert, %v", err)
+		return
+	}
+	newid, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("mysql put annotation id, %v", err)
+	}
+	return
+}
+
+func (sdb *mysqledb) AnnotationsForElection(eid int64) ([]annotationRecord, error) {
+	return queryAnnotations(sdb.conn(), `SELECT id, election, page, x, y, comment, author, author_name, created FROM annotations WHERE election = ? ORDER BY id`, eid)
+}
+
+func (sdb *mysqledb) DeleteAnnotation(eid, id int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM annotations WHERE id = ? AND election = ?`, id, eid)
+	if err != nil {
+		return fmt.Errorf("mysql delete annotation, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) GetElectionState(id int64) (state string, err error) {
+	row := sdb.conn().QueryRow(`SELECT state FROM election_state WHERE election = ?`, id)
+	err = row.Scan(&state)
+	if err == sql.ErrNoRows {
+		return StateDraft, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("election state get, %v", err)
+	}
+	return
+}
+
+func (sdb *mysqledb) SetElectionState(id int64, from, to string) (ok bool, err error) {
+	tx, err := sdb.conn().Begin()
+	if err != nil {
+		err = fmt.Errorf("tx err, %v", err)
+		return
+	}
+	defer tx.Rollback()
+	var state string
+	row := tx.QueryRow(`SELECT state FROM election_state WHERE election = ? FOR UPDATE`, id)
+	err = row.Scan(&state)
+	if err == sql.ErrNoRows {
+		state = StateDraft
+	} else if err != nil {
+		err = fmt.Errorf("election state get, %v", err)
+		return
+	}
+	if state != from {
+		return false, nil
+	}
+	_, err = tx.Exec(`INSERT INTO election_state (election, state, changed) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE state = VALUES(state), changed = VALUES(changed)`, id, to, time.Now().UTC().Unix())
+	if err != nil {
+		err = fmt.Errorf("election state put, %v", err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		err = fmt.Errorf("election state commit, %v", err)
+		return
+	}
+	return true, nil
+}
+
+// query for a list of ids
+func mysqlIds(db sqlDB, what, query string, args ...interface{}) (ids []int64, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		err = fmt.Errorf("%s, %v", what, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			err = fmt.Errorf("%s row, %v", what, err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+func (sdb *mysqledb) PutDigestSchedule(ds digestSchedule) error {
+	_, err := sdb.conn().Exec(`INSERT INTO digest_schedules (user_id, email, weekday, hour, last_sent) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE email = VALUES(email), weekday = VALUES(weekday), hour = VALUES(hour), last_sent = VALUES(last_sent)`, ds.UserId, ds.Email, ds.Weekday, ds.Hour, ds.LastSent)
+	if err != nil {
+		return fmt.Errorf("mysql put digest schedule, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) GetDigestSchedule(uid int64) (*digestSchedule, error) {
+	ds := digestSchedule{UserId: uid}
+	row := sdb.conn().QueryRow(`SELECT email, weekday, hour, last_sent FROM digest_schedules WHERE user_id = ?`, uid)
+	err := row.Scan(&ds.Email, &ds.Weekday, &ds.Hour, &ds.LastSent)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("digest schedule get, %v", err)
+	}
+	return &ds, nil
+}
+
+func (sdb *mysqledb) DeleteDigestSchedule(uid int64) error {
+	return deleteDigestSchedule(sdb.conn(), `DELETE FROM digest_schedules WHERE user_id = ?`, uid)
+}
+
+func (sdb *mysqledb) DigestSchedules() ([]digestSchedule, error) {
+	return queryDigestSchedules(sdb.conn())
+}
+
+func (sdb *mysqledb) PutNotifyPrefs(np notifyPrefs) error {
+	_, err := sdb.conn().Exec(`INSERT INTO notify_prefs (user_id, username, email, shares, mentions, renders) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE username = VALUES(username), email = VALUES(email), shares = VALUES(shares), mentions = VALUES(mentions), renders = VALUES(renders)`, np.UserId, np.Username, np.Email, boolInt(np.Shares), boolInt(np.Mentions), boolInt(np.Renders))
+	if err != nil {
+		return fmt.Errorf("mysql put notify prefs, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) GetNotifyPrefs(uid int64) (*notifyPrefs, error) {
+	return getNotifyPrefs(sdb.conn(), `SELECT user_id, username, email, shares, mentions, renders FROM notify_prefs WHERE user_id = ?`, uid)
+}
+
+func (sdb *mysqledb) NotifyPrefsForUsername(username string) (*notifyPrefs, error) {
+	return getNotifyPrefs(sdb.conn(), `SELECT user_id, username, email, shares, mentions, renders FROM notify_prefs WHERE LOWER(username) = LOWER(?)`, username)
+}
+
+func (sdb *mysqledb) DeleteNotifyPrefs(uid int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM notify_prefs WHERE user_id = ?`, uid)
+	if err != nil {
+		return fmt.Errorf("notify prefs delete, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) AllNotifyPrefs() ([]notifyPrefs, error) {
+	return queryNotifyPrefs(sdb.conn())
+}
+
+func (sdb *mysqledb) PutStaff(sr staffRecord) error {
+	_, err := sdb.conn().Exec(`INSERT INTO staff (email, role, organization, user_id, invite, provisioned) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE role = VALUES(role), organization = VALUES(organization), user_id = VALUES(user_id), invite = VALUES(invite), provisioned = VALUES(provisioned)`, sr.Email, sr.Role, sr.Organization, sr.UserId, sr.Invite, sr.Provisioned)
+	if err != nil {
+		return fmt.Errorf("mysql put staff, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) GetStaff(email string) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE email = ?`, email)
+}
+
+func (sdb *mysqledb) StaffByInvite(token string) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE invite = ?`, token)
+}
+
+func (sdb *mysqledb) StaffForUser(uid int64) (*staffRecord, error) {
+	return getStaff(sdb.conn(), `SELECT email, role, organization, user_id, invite, provisioned FROM staff WHERE user_id = ?`, uid)
+}
+
+func (sdb *mysqledb) StaffList() ([]staffRecord, error) {
+	return queryStaff(sdb.conn())
+}
+
+func (sdb *mysqledb) ElectionRevisions(eid int64) ([]revisionRecord, error) {
+	return electionRevisions(sdb.conn(), `SELECT election, rev, LENGTH(data), created FROM election_revisions WHERE election = ? ORDER BY rev`, eid)
+}
+
+func (sdb *mysqledb) GetElectionRevision(eid int64, rev int) (*revisionRecord, error) {
+	return getElectionRevision(sdb.conn(), `SELECT data, created FROM election_revisions WHERE election = ? AND rev = ?`, eid, rev)
+}
+
+func (sdb *mysqledb) RestoreRevisions(eid int64, revs []revisionRecord) error {
+	return restoreRevisions(sdb.conn(), "?", eid, revs)
+}
+
+// boolean mode, every term required as a prefix. Words shorter than
+// innodb_ft_min_token_size (3) aren't indexed and can't be found.
+func (sdb *mysqledb) SearchElections(terms []string, uid int64, limit int) ([]searchRecord, error) {
+	required := make([]string, len(terms))
+	for i, t := range terms {
+		required[i] = "+" + t + "*"
+	}
+	against := strings.Join(required, " ")
+	return querySearch(sdb.conn(), `SELECT s.election, e.owner, s.title, s.contests, s.candidates FROM election_search s
+JOIN elections e ON e.id = s.election LEFT JOIN election_state st ON st.election = s.election
+WHERE MATCH (s.title, s.contests, s.candidates) AGAINST (? IN BOOLEAN MODE)
+AND e.trashed IS NULL AND (e.owner = ? OR st.state = ?)
+ORDER BY MATCH (s.title, s.contests, s.candidates) AGAINST (? IN BOOLEAN MODE) DESC LIMIT ?`,
+		against, uid, StatePublished, against, limit)
+}
+
+func (sdb *mysqledb) ElectionFacts(f factsFilter) ([]electionFacts, error) {
+	return queryFacts(sdb.conn(), "?", "id", f)
+}
+
+func (sdb *mysqledb) UserUsage(uid int64) (quotaUsage, error) {
+	return queryUsage(sdb.conn(), "?", "id", uid)
+}
+
+func (sdb *mysqledb) GetUserQuota(uid int64) (*quotaLimits, error) {
+	return getUserQuota(sdb.conn(), "?", uid)
+}
+
+func (sdb *mysqledb) SetUserQuota(uid int64, q *quotaLimits) error {
+	return setUserQuota(sdb.conn(), "?", uid, q)
+}
+
+func (sdb *mysqledb) PruneRevisions(eid int64, keep int64) error {
+	return pruneRevisions(sdb.conn(), "?", eid, keep)
+}
+
+func (sdb *mysqledb) GetAccount(uid int64) (*accountRecord, error) {
+	return getAccount(sdb.conn(), "?", uid)
+}
+
+func (sdb *mysqledb) PutAccount(ar accountRecord) error {
+	return putAccount(sdb.conn(), "?", ar)
+}
+
+func (sdb *mysqledb) DeleteAccount(uid, electionsTo int64) (int64, error) {
+	return deleteAccount(sdb.conn(), "?", "id", uid, electionsTo)
+}
+
+func (sdb *mysqledb) ListAccounts() ([]accountSummary, error) {
+	return listAccounts(sdb.conn())
+}
+
+func (sdb *mysqledb) GetExternalIdentity(issuer, subject string) (*externalIdentity, error) {
+	return getExternalIdentity(sdb.conn(), "?", issuer, subject)
+}
+
+func (sdb *mysqledb) PutExternalIdentity(ei externalIdentity) error {
+	return putExternalIdentity(sdb.conn(), "?", ei)
+}
+
+func (sdb *mysqledb) ElectionTags(eid int64) ([]string, error) {
+	tags, err := queryTags(sdb.conn(), `SELECT election, tag FROM election_tags WHERE election = ?`, eid)
+	return tags[eid], err
+}
+
+func (sdb *mysqledb) SetElectionTags(eid int64, tags []string) error {
+	return setElectionTags(sdb.conn(), "?", eid, tags)
+}
+
+func (sdb *mysqledb) TagsForUser(uid int64) (map[int64][]string, error) {
+	return queryTags(sdb.conn(), `SELECT t.election, t.tag FROM election_tags t JOIN elections e ON e.id = t.election WHERE e.owner = ? AND e.trashed IS NULL`, uid)
+}
+
+func (sdb *mysqledb) PutWebhook(wh webhookRecord) (newid int64, err error) {
+	result, err := sdb.conn().Exec(`INSERT INTO webhooks (owner, election, url, secret, events, created) VALUES (?, ?, ?, ?, ?, ?)`, wh.Owner, wh.ElectionId, wh.URL, wh.Secret, strings.Join(wh.Events, ","), wh.Created)
+	if err != nil {
+		err = fmt.Errorf("mysql put webhook insert, %v", err)
+		return
+	}
+	newid, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("mysql put webhook id, %v", err)
+	}
+	return
+}
+
+func (sdb *mysqledb) GetWebhook(id int64) (*webhookRecord, error) {
+	return getWebhook(sdb.conn(), `SELECT id, owner, election, url, secret, events, created FROM webhooks WHERE id = ?`, id)
+}
+
+func (sdb *mysqledb) WebhooksForUser(uid int64) ([]webhookRecord, error) {
+	return queryWebhooks(sdb.conn(), `SELECT id, owner, election, url, secret, events, created FROM webhooks WHERE owner = ? ORDER BY id`, uid)
+}
+
+func (sdb *mysqledb) WebhooksForElection(eid int64) ([]webhookRecord, error) {
+	return queryWebhooks(sdb.conn(), `SELECT id, owner, election, url, secret, events, created FROM webhooks WHERE election = ? OR (election = 0 AND owner = (SELECT owner FROM elections WHERE id = ?))`, eid, eid)
+}
+
+func (sdb *mysqledb) DeleteWebhook(id int64) error {
+	return deleteWebhook(sdb.conn(), "?", "id", id)
+}
+
+func (sdb *mysqledb) PutWebhookDelivery(d webhookDelivery) (id int64, err error) {
+	if d.Id != 0 {
+		return d.Id, updateDelivery(sdb.conn(), "?", "id", d)
+	}
+	result, err := sdb.conn().Exec(`INSERT INTO webhook_deliveries (webhook, event, payload, status, attempts, next_try, last_error, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, d.WebhookId, d.Event, d.Payload, d.Status, d.Attempts, d.NextTry, d.LastError, d.Created)
+	if err != nil {
+		err = fmt.Errorf("mysql put webhook delivery insert, %v", err)
+		return
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("mysql put webhook delivery id, %v", err)
+	}
+	return
+}
+
+func (sdb *mysqledb) DueWebhookDeliveries(now int64, limit int) ([]webhookDelivery, error) {
+	return queryDeliveries(sdb.conn(), `SELECT id, webhook, event, payload, status, attempts, next_try, last_error, created FROM webhook_deliveries WHERE status = 'pending' AND next_try <= ? ORDER BY id LIMIT ?`, now, limit)
+}
+
+func (sdb *mysqledb) WebhookDeliveries(webhookid int64, limit int) ([]webhookDelivery, error) {
+	return queryDeliveries(sdb.conn(), `SELECT id, webhook, event, payload, status, attempts, next_try, last_error, created FROM webhook_deliveries WHERE webhook = ? ORDER BY id DESC LIMIT ?`, webhookid, limit)
+}
+
+func (sdb *mysqledb) PurgeWebhookDeliveries(before int64) (purged int64, err error) {
+	return purgeDeliveries(sdb.conn(), "?", before)
+}
+
+func (sdb *mysqledb) PutPrintJob(pj printJob) (id int64, err error) {
+	if pj.Id != 0 {
+		return pj.Id, updatePrintJob(sdb.conn(), "?", "id", pj)
+	}
+	result, err := sdb.conn().Exec(`INSERT INTO print_jobs (election, style, requested_by, status, error, created, done, picked_up) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, pj.ElectionId, pj.Style, pj.RequestedBy, pj.Status, pj.Error, pj.Created, pj.Done, pj.PickedUp)
+	if err != nil {
+		err = fmt.Errorf("mysql put print job insert, %v", err)
+		return
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("mysql put print job id, %v", err)
+	}
+	return
+}
+
+func (sdb *mysqledb) GetPrintJob(id int64) (*printJob, error) {
+	return getPrintJob(sdb.conn(), `SELECT id, `+printJobColumns+`, pdf FROM print_jobs WHERE id = ?`, id)
+}
+
+func (sdb *mysqledb) PickUpPrintJob(id, now int64) (bool, error) {
+	return pickUpPrintJob(sdb.conn(), "?", "id", id, now)
+}
+
+func (sdb *mysqledb) PrintJobsForElection(eid int64, limit int) ([]printJob, error) {
+	return queryPrintJobs(sdb.conn(), `SELECT id, `+printJobColumns+` FROM print_jobs WHERE election = ? ORDER BY id DESC LIMIT ?`, eid, limit)
+}
+
+func (sdb *mysqledb) QueuedPrintJobs(limit int) ([]printJob, error) {
+	return queryPrintJobs(sdb.conn(), `SELECT id, `+printJobColumns+` FROM print_jobs WHERE status = 'queued' ORDER BY id LIMIT ?`, limit)
+}
+
+func (sdb *mysqledb) PrintJobCounts(eid int64) (map[int]map[string]int, error) {
+	return printJobCounts(sdb.conn(), `SELECT style, status, COUNT(*) FROM print_jobs WHERE election = ? GROUP BY style, status`, eid)
+}
+
+func (sdb *mysqledb) PutPrintRun(pr *printRun, next bool) (*printRun, error) {
+	lock := `SELECT id FROM elections WHERE id = ? FOR UPDATE`
+	runs := `SELECT id, ` + printRunColumns + ` FROM print_runs WHERE election = ? ORDER BY id`
+	return putPrintRun(sdb.conn(), lock, runs, pr, next, func(tx *sql.Tx) (id int64, err error) {
+		result, err := tx.Exec(`INSERT INTO print_runs (`+printRunColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, pr.ElectionId, pr.Style, pr.First, pr.Last, pr.BatchSize, pr.Rev, pr.RequestedBy, pr.Created)
+		if err != nil {
+			err = fmt.Errorf("mysql put print run insert, %v", err)
+			return
+		}
+		id, err = result.LastInsertId()
+		if err != nil {
+			err = fmt.Errorf("mysql put print run id, %v", err)
+		}
+		return
+	})
+}
+
+func (sdb *mysqledb) GetPrintRun(id int64) (*printRun, error) {
+	return getPrintRun(sdb.conn(), `SELECT id, `+printRunColumns+` FROM print_runs WHERE id = ?`, id)
+}
+
+func (sdb *mysqledb) PrintRunsForElection(eid int64) ([]printRun, error) {
+	return queryPrintRuns(sdb.conn(), `SELECT id, `+printRunColumns+` FROM print_runs WHERE election = ? ORDER BY id`, eid)
+}
+
+func (sdb *mysqledb) PutPrintRunDownload(d printRunDownload) error {
+	return putPrintRunDownload(sdb.conn(), "?", d)
+}
+
+func (sdb *mysqledb) PrintRunDownloads(runid int64) ([]printRunDownload, error) {
+	return printRunDownloads(sdb.conn(), `SELECT batch, downloaded_by, downloaded FROM print_run_downloads WHERE run = ? ORDER BY downloaded, id`, runid)
+}
+
+func (sdb *mysqledb) SetSampleSlug(eid int64, slug string) error {
+	return setSampleSlug(sdb.conn(), "?", eid, slug)
+}
+
+func (sdb *mysqledb) SampleSlug(eid int64) (string, error) {
+	return sampleSlug(sdb.conn(), `SELECT slug FROM sample_ballots WHERE election = ?`, eid)
+}
+
+func (sdb *mysqledb) SampleElection(slug string) (int64, error) {
+	return sampleElection(sdb.conn(), `SELECT election FROM sample_ballots WHERE slug = ?`, slug)
+}
+
+func (sdb *mysqledb) PutLibraryEntry(le libraryEntry) (id int64, err error) {
+	if le.Id != 0 {
+		return le.Id, updateLibraryEntry(sdb.conn(), "?", "id", le)
+	}
+	result, err := sdb.conn().Exec(`INSERT INTO library_entries (owner, kind, name, data, updated) VALUES (?, ?, ?, ?, ?)`, le.Owner, le.Kind, le.Name, string(le.Data), le.Updated)
+	if err != nil {
+		err = fmt.Errorf("mysql put library entry insert, %v", err)
+		return
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("mysql put library entry id, %v", err)
+	}
+	return
+}
+
+func (sdb *mysqledb) GetLibraryEntry(id int64) (*libraryEntry, error) {
+	return getLibraryEntry(sdb.conn(), `SELECT id, `+libraryEntryColumns+` FROM library_entries WHERE id = ?`, id)
+}
+
+func (sdb *mysqledb) LibraryEntries() ([]libraryEntry, error) {
+	return queryLibraryEntries(sdb.conn(), `SELECT id, `+libraryEntryColumns+` FROM library_entries ORDER BY kind, name, id`)
+}
+
+func (sdb *mysqledb) DeleteLibraryEntry(id int64) error {
+	_, err := sdb.conn().Exec(`DELETE FROM library_entries WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("mysql delete library entry, %v", err)
+	}
+	return nil
+}
+
+func (sdb *mysqledb) LibraryElections(id int64) ([]int64, error) {
+	return libraryElections(sdb.conn(), "?", "id", id)
+}
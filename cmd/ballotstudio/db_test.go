@@ -7,7 +7,8 @@ import (
 	"testing"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3" // driver="sqlite3"
+	_ "github.com/go-sql-driver/mysql" // driver="mysql"
+	_ "github.com/mattn/go-sqlite3"    // driver="sqlite3"
 )
 
 func mtfail(t *testing.T, err error, format string, args ...interface{}) {
@@ -19,9 +20,12 @@ func mtfail(t *testing.T, err error, format string, args ...interface{}) {
 
 var pgConnectString string
 var pgdb *sql.DB
+var mysqlConnectString string
+var mysqldb *sql.DB
 
 func TestMain(m *testing.M) {
 	flag.StringVar(&pgConnectString, "postgres", "", "connection string for postgres")
+	flag.StringVar(&mysqlConnectString, "mysql", "", "connection string for mysql")
 	flag.Parse()
 
 	if pgConnectString != "" {
@@ -30,17 +34,31 @@ func TestMain(m *testing.M) {
 		maybefail(err, "error opening postgres db, %v", err)
 		defer pgdb.Close()
 	}
+	if mysqlConnectString != "" {
+		var err error
+		mysqldb, err = sql.Open("mysql", mysqlConnectString)
+		maybefail(err, "error opening mysql db, %v", err)
+		defer mysqldb.Close()
+	}
 
 	os.Exit(m.Run())
 }
 
-func TestSqliteDB(t *testing.T) {
+// testSqliteEDB is a fresh in memory election database, closed when the
+// test ends. One connection, each :memory: connection is its own database.
+func testSqliteEDB(t *testing.T) (electionAppDB, *sql.DB) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	mtfail(t, err, "open sqlite mem, %v", err)
-	defer db.Close()
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
 	edb := NewSqliteEDB(db)
 	err = edb.Setup()
 	mtfail(t, err, "edb sqlite setup, %v", err)
+	return edb, db
+}
+
+func TestSqliteDB(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
 	testEdb(t, edb)
 }
 
@@ -55,6 +73,17 @@ func TestPostgresDB(t *testing.T) {
 	testEdb(t, edb)
 }
 
+func TestMysqlDB(t *testing.T) {
+	if mysqldb == nil {
+		t.Skip("no -mysql connect string")
+		return
+	}
+	edb := NewMysqlEDB(mysqldb)
+	err := edb.Setup()
+	mtfail(t, err, "edb mysql setup, %v", err)
+	testEdb(t, edb)
+}
+
 func testEdb(t *testing.T, edb electionAppDB) {
 	// election data stuff
 	er := electionRecord{
@@ -82,6 +111,20 @@ func testEdb(t *testing.T, edb electionAppDB) {
 	if *e2 != *xe {
 		t.Errorf("update-get neq a=%#v b=%v", *xe, *e2)
 	}
+	revs, err := edb.ElectionRevisions(xe.Id)
+	mtfail(t, err, "er revisions, %v", err)
+	err = edb.SetElectionMeta(xe.Id, `{"public_results":true}`)
+	mtfail(t, err, "er set meta, %v", err)
+	e2, err = edb.GetElection(xe.Id)
+	mtfail(t, err, "er get 3, %v", err)
+	if e2.Meta != `{"public_results":true}` || e2.Data != xe.Data {
+		t.Errorf("set meta got %#v", *e2)
+	}
+	revs2, err := edb.ElectionRevisions(xe.Id)
+	mtfail(t, err, "er revisions 2, %v", err)
+	if len(revs2) != len(revs) {
+		t.Errorf("set meta made a revision, %d -> %d", len(revs), len(revs2))
+	}
 
 	eids, err := edb.ElectionsForUser(er.Owner)
 	mtfail(t, err, "er ElectionsForUser, %v", err)
@@ -90,6 +133,11 @@ func testEdb(t *testing.T, edb electionAppDB) {
 	} else if eids[0] != newid {
 		t.Errorf("listed election for owner %d wrong id, wanted %d, got %d", er.Owner, newid, eids[0])
 	}
+	eids, err = edb.ElectionIds()
+	mtfail(t, err, "er ElectionIds, %v", err)
+	if len(eids) == 0 || eids[len(eids)-1] != newid {
+		t.Errorf("ElectionIds %v missing %d", eids, newid)
+	}
 
 	// invite token stuff
 	const token = "tok"
@@ -116,14 +164,193 @@ func testEdb(t *testing.T, edb electionAppDB) {
 
 	const t2 = "t2"
 	ago := now.Add(-1 * time.Minute)
-	err = edb.MakeInviteToken(token, ago)
+	err = edb.MakeInviteToken(t2, ago)
 	mtfail(t, err, "MakeInviteToken 2 %v", err)
-	err = edb.GCInviteTokens()
+	removed, err := edb.GCInviteTokens()
 	mtfail(t, err, "GCInviteTokens %v", err)
+	if removed != 1 {
+		t.Errorf("GCInviteTokens removed %d", removed)
+	}
 
 	ok, _, _ = edb.PeekInviteToken(t2)
 	o2, _ := edb.UseInviteToken(t2)
 	if ok || o2 {
 		t.Errorf("t2 should be gone")
 	}
+
+	testScanDB(t, edb)
+	testStateDB(t, edb, newid)
+	testAnnotationDB(t, edb, newid)
+	testTrashDB(t, edb, newid)
+	testDigestDB(t, edb)
+}
+
+func testScanDB(t *testing.T, edb electionAppDB) {
+	sr := scanRecord{
+		ElectionId:  7,
+		Owner:       1,
+		Image:       []byte{0x89, 'P', 'N', 'G'},
+		ContentType: "image/png",
+		Interpreter: "1",
+		Result:      `{"c1":{"cs1":true}}`,
+		Created:     time.Now().Unix(),
+		Custody:     scanCustody{Device: "scanner-3", Operator: "pat", Batch: "12", Precinct: "Ward 4"},
+	}
+	sid, err := edb.PutScan(sr)
+	mtfail(t, err, "PutScan %v", err)
+	sr.Id = sid
+	xs, err := edb.GetScan(sid)
+	mtfail(t, err, "GetScan %v", err)
+	if string(xs.Image) != string(sr.Image) || xs.Result != sr.Result || xs.ElectionId != sr.ElectionId || xs.Interpreter != sr.Interpreter || xs.Custody != sr.Custody {
+		t.Errorf("scan put-get neq a=%#v b=%#v", sr, *xs)
+	}
+	sids, err := edb.ScansForElection(sr.ElectionId)
+	mtfail(t, err, "ScansForElection %v", err)
+	if len(sids) != 1 || sids[0] != sid {
+		t.Errorf("ScansForElection wanted [%d] got %v", sid, sids)
+	}
+	err = edb.UpdateScanResult(sid, "2", `{}`)
+	mtfail(t, err, "UpdateScanResult %v", err)
+	xs, err = edb.GetScan(sid)
+	mtfail(t, err, "GetScan 2 %v", err)
+	if xs.Interpreter != "2" || xs.Result != `{}` {
+		t.Errorf("scan update not stored, got %#v", *xs)
+	}
+}
+
+func testStateDB(t *testing.T, edb electionAppDB, eid int64) {
+	state, err := edb.GetElectionState(eid)
+	mtfail(t, err, "GetElectionState %v", err)
+	if state != StateDraft {
+		t.Errorf("new election state %#v, wanted draft", state)
+	}
+	ok, err := edb.SetElectionState(eid, StateDraft, StateProofing)
+	mtfail(t, err, "SetElectionState %v", err)
+	if !ok {
+		t.Errorf("draft->proofing not set")
+	}
+	// stale `from` must not change anything
+	ok, err = edb.SetElectionState(eid, StateDraft, StateArchived)
+	mtfail(t, err, "SetElectionState 2 %v", err)
+	if ok {
+		t.Errorf("state set from wrong prior state")
+	}
+	ok, err = edb.SetElectionState(eid, StateProofing, StateApproved)
+	mtfail(t, err, "SetElectionState 3 %v", err)
+	state, _ = edb.GetElectionState(eid)
+	if !ok || state != StateApproved {
+		t.Errorf("proofing->approved got ok=%v state=%#v", ok, state)
+	}
+}
+
+func testAnnotationDB(t *testing.T, edb electionAppDB, eid int64) {
+	ar := annotationRecord{ElectionId: eid, Page: 1, X: 0.25, Y: 0.5, Comment: "too close to the fold", Author: 3, AuthorName: "rev", Created: time.Now().Unix()}
+	aid, err := edb.PutAnnotation(ar)
+	mtfail(t, err, "PutAnnotation %v", err)
+	ar.Id = aid
+	_, err = edb.PutAnnotation(annotationRecord{ElectionId: eid + 1000, Comment: "other election"})
+	mtfail(t, err, "PutAnnotation 2 %v", err)
+	ars, err := edb.AnnotationsForElection(eid)
+	mtfail(t, err, "AnnotationsForElection %v", err)
+	if len(ars) != 1 || ars[0] != ar {
+		t.Errorf("annotations wanted [%#v] got %#v", ar, ars)
+	}
+	// wrong election deletes nothing
+	err = edb.DeleteAnnotation(eid+1000, aid)
+	mtfail(t, err, "DeleteAnnotation %v", err)
+	err = edb.DeleteAnnotation(eid, aid)
+	mtfail(t, err, "DeleteAnnotation 2 %v", err)
+	ars, _ = edb.AnnotationsForElection(eid)
+	if len(ars) != 0 {
+		t.Errorf("annotation not deleted, %#v", ars)
+	}
+}
+
+func testTrashDB(t *testing.T, edb electionAppDB, eid int64) {
+	er, err := edb.GetElection(eid)
+	mtfail(t, err, "GetElection %v", err)
+	when := time.Now().Add(-time.Hour)
+	err = edb.TrashElection(eid, when)
+	mtfail(t, err, "TrashElection %v", err)
+	eids, err := edb.ElectionsForUser(er.Owner)
+	mtfail(t, err, "ElectionsForUser %v", err)
+	for _, x := range eids {
+		if x == eid {
+			t.Errorf("trashed election %d still listed", eid)
+		}
+	}
+	tids, err := edb.TrashedForUser(er.Owner)
+	mtfail(t, err, "TrashedForUser %v", err)
+	if len(tids) != 1 || tids[0] != eid {
+		t.Errorf("TrashedForUser wanted [%d] got %v", eid, tids)
+	}
+	xe, err := edb.GetElection(eid)
+	mtfail(t, err, "GetElection trashed %v", err)
+	if xe.Trashed != when.Unix() {
+		t.Errorf("trashed at %d, wanted %d", xe.Trashed, when.Unix())
+	}
+
+	// not old enough yet
+	purged, err := edb.PurgeTrash(when.Add(-time.Minute))
+	mtfail(t, err, "PurgeTrash %v", err)
+	if purged != 0 {
+		t.Errorf("purged %d too soon", purged)
+	}
+	err = edb.UntrashElection(eid)
+	mtfail(t, err, "UntrashElection %v", err)
+	xe, _ = edb.GetElection(eid)
+	if xe == nil || xe.Trashed != 0 {
+		t.Errorf("untrash got %#v", xe)
+	}
+
+	err = edb.TrashElection(eid, when)
+	mtfail(t, err, "TrashElection 2 %v", err)
+	sid, err := edb.PutScan(scanRecord{ElectionId: eid, Owner: er.Owner, Result: `{}`})
+	mtfail(t, err, "PutScan %v", err)
+	purged, err = edb.PurgeTrash(time.Now())
+	mtfail(t, err, "PurgeTrash 2 %v", err)
+	if purged != 1 {
+		t.Errorf("purged %d, wanted 1", purged)
+	}
+	if _, err = edb.GetElection(eid); err == nil {
+		t.Errorf("purged election %d still there", eid)
+	}
+	if _, err = edb.GetScan(sid); err == nil {
+		t.Errorf("purged election's scan %d still there", sid)
+	}
+	state, _ := edb.GetElectionState(eid)
+	if state != StateDraft {
+		t.Errorf("purged election state %#v left behind", state)
+	}
+}
+
+func testDigestDB(t *testing.T, edb electionAppDB) {
+	ds, err := edb.GetDigestSchedule(42)
+	mtfail(t, err, "GetDigestSchedule none %v", err)
+	if ds != nil {
+		t.Errorf("unexpected digest schedule %#v", ds)
+	}
+	want := digestSchedule{UserId: 42, Email: "a@example.com", Weekday: 1, Hour: 14, LastSent: 1000}
+	err = edb.PutDigestSchedule(want)
+	mtfail(t, err, "PutDigestSchedule %v", err)
+	want.Weekday = 3
+	want.LastSent = 2000
+	err = edb.PutDigestSchedule(want)
+	mtfail(t, err, "PutDigestSchedule replace %v", err)
+	ds, err = edb.GetDigestSchedule(42)
+	mtfail(t, err, "GetDigestSchedule %v", err)
+	if ds == nil || *ds != want {
+		t.Errorf("digest schedule wanted %#v got %#v", want, ds)
+	}
+	all, err := edb.DigestSchedules()
+	mtfail(t, err, "DigestSchedules %v", err)
+	if len(all) != 1 || all[0] != want {
+		t.Errorf("DigestSchedules wanted [%#v] got %#v", want, all)
+	}
+	err = edb.DeleteDigestSchedule(42)
+	mtfail(t, err, "DeleteDigestSchedule %v", err)
+	ds, _ = edb.GetDigestSchedule(42)
+	if ds != nil {
+		t.Errorf("digest schedule not deleted, %#v", ds)
+	}
 }
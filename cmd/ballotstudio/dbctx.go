@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Queries under a request's context. electionAppDB.WithContext gives a
+// view of the database whose queries and transactions are canceled with
+// the context, so work for a client that went away or a request past its
+// route's timeout (see timeouts.go) stops instead of running on.
+
+// sqlDB is the part of *sql.DB the query helpers use
+type sqlDB interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Begin() (*sql.Tx, error)
+}
+
+// ctxDB is db with every query run under ctx
+type ctxDB struct {
+	db  *sql.DB
+	ctx context.Context
+}
+
+func (cd ctxDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return cd.db.QueryContext(cd.ctx, query, args...)
+}
+
+func (cd ctxDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return cd.db.QueryRowContext(cd.ctx, query, args...)
+}
+
+func (cd ctxDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return cd.db.ExecContext(cd.ctx, query, args...)
+}
+
+func (cd ctxDB) Begin() (*sql.Tx, error) {
+	return cd.db.BeginTx(cd.ctx, nil)
+}
+
+// dbWithContext is db, or db under ctx if there is one
+func dbWithContext(db *sql.DB, ctx context.Context) sqlDB {
+	if ctx == nil {
+		return db
+	}
+	return ctxDB{db, ctx}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/brianolson/ballotstudio/data"
+)
+
+// Example elections for new installs and demos. With -demo the server
+// loads demo/*.json as it starts: a county general election, a closed
+// partisan primary, a ranked choice city election and an English and
+// Spanish special election. They belong to no account, and are published
+// templates, so anyone logged in can clone one or start from it. Each is
+// tagged demo-{file name} and only loaded if no election has that tag, so
+// restarting with -demo doesn't add more copies.
+//
+// The renderers don't draw ranking grids yet; the ranked choice contests
+// (VoteVariation "rcv") come out with one bubble per candidate.
+
+// demoOwner owns the demo elections, no user
+const demoOwner = 0
+
+const demoTagPrefix = "demo-"
+
+// loadDemoElections adds the demo/*.json elections in demos that edb
+// doesn't have, returning how many it added
+func loadDemoElections(edb electionAppDB, demos fs.FS) (loaded int, err error) {
+	tagged, err := edb.TagsForUser(demoOwner)
+	if err != nil {
+		return 0, fmt.Errorf("demo tags, %v", err)
+	}
+	have := make(map[string]bool)
+	for _, tags := range tagged {
+		for _, tag := range tags {
+			have[tag] = true
+		}
+	}
+	names, err := fs.Glob(demos, "demo/*.json")
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		tag := demoTagPrefix + strings.TrimSuffix(path.Base(name), ".json")
+		if have[tag] {
+			continue
+		}
+		body, err := fs.ReadFile(demos, name)
+		if err != nil {
+			return loaded, err
+		}
+		var ob map[string]interface{}
+		err = json.Unmarshal(body, &ob)
+		if err != nil {
+			return loaded, fmt.Errorf("%s, %v", name, err)
+		}
+		doc, err := json.Marshal(data.Fixup(ob))
+		if err != nil {
+			return loaded, fmt.Errorf("%s re-json, %v", name, err)
+		}
+		eid, err := edb.PutElection(electionRecord{Owner: demoOwner, Data: string(doc), Meta: electionMeta{Template: true}.String()})
+		if err != nil {
+			return loaded, fmt.Errorf("%s put, %v", name, err)
+		}
+		err = edb.SetElectionTags(eid, []string{tag})
+		if err != nil {
+			return loaded, fmt.Errorf("%s tags, %v", name, err)
+		}
+		_, err = edb.SetElectionState(eid, StateDraft, StatePublished)
+		if err != nil {
+			return loaded, fmt.Errorf("%s publish, %v", name, err)
+		}
+		loaded++
+	}
+	return loaded, nil
+}
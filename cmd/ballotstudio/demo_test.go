@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+
+	"github.com/brianolson/ballotstudio"
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+func TestDemoElections(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+
+	loaded, err := loadDemoElections(edb, ballotstudio.Demo)
+	mtfail(t, err, "load, %v", err)
+	names, _ := fs.Glob(ballotstudio.Demo, "demo/*.json")
+	if loaded != len(names) || loaded < 4 {
+		t.Fatalf("loaded %d of %d", loaded, len(names))
+	}
+	tagged, err := edb.TagsForUser(demoOwner)
+	mtfail(t, err, "tags, %v", err)
+	for eid, tags := range tagged {
+		er, err := edb.GetElection(eid)
+		mtfail(t, err, "get %d, %v", eid, err)
+		if !parseElectionMeta(er.Meta).Template {
+			t.Errorf("%v not a template", tags)
+		}
+		state, err := edb.GetElectionState(eid)
+		if state != StatePublished || err != nil {
+			t.Errorf("%v state %s %v", tags, state, err)
+		}
+		report := validateDocument(tags[0], []byte(er.Data))
+		for _, item := range report.Items {
+			if item.Status == readyFail {
+				t.Errorf("%v: %s %s", tags, item.Check, item.Message)
+			}
+		}
+		_, err = (&draw.Client{}).DrawElection(context.Background(), er.Data, draw.RenderOptions{})
+		if err != nil {
+			t.Errorf("%v draw, %v", tags, err)
+		}
+	}
+
+	// again loads nothing, unless one was removed
+	loaded, err = loadDemoElections(edb, ballotstudio.Demo)
+	if loaded != 0 || err != nil {
+		t.Errorf("loaded %d more, %v", loaded, err)
+	}
+	for eid, tags := range tagged {
+		if tags[0] == "demo-rcv" {
+			err = edb.SetElectionTags(eid, nil)
+			mtfail(t, err, "untag, %v", err)
+		}
+	}
+	loaded, err = loadDemoElections(edb, ballotstudio.Demo)
+	if loaded != 1 || err != nil {
+		t.Errorf("reloaded %d, %v", loaded, err)
+	}
+
+	accounts, err := edb.ListAccounts()
+	mtfail(t, err, "accounts, %v", err)
+	if len(accounts) != 0 {
+		t.Errorf("demo owner listed as an account, %v", accounts)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Weekly digest email. A user picks a weekday, hour (UTC) and address with
+// POST /digest and the digests job (jobs.go) mails them a summary of their elections that
+// need attention: election day coming up before the ballot is published,
+// scans to review by hand, and ballots that last failed to render.
+// GET /digest/report shows the same summary without waiting for the email.
+
+// how far ahead of election day a not yet published election shows up in the digest
+const DigestHorizon = 14 * 24 * time.Hour
+
+// one line of the digest
+type digestItem struct {
+	Id    int64  `json:"itemid"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+
+	Date     string  `json:"date,omitempty"` // election StartDate, for deadlines
+	DaysLeft int     `json:"days_left"`
+	Scans    []int64 `json:"scans,omitempty"` // scan ids needing review
+	Error    string  `json:"error,omitempty"` // last render failure
+}
+
+type digestReport struct {
+	Deadlines      []digestItem `json:"deadlines"`
+	NeedsReview    []digestItem `json:"needs_review"`
+	RenderFailures []digestItem `json:"render_failures"`
+	Generated      time.Time    `json:"generated"`
+}
+
+func (dr *digestReport) empty() bool {
+	return len(dr.Deadlines) == 0 && len(dr.NeedsReview) == 0 && len(dr.RenderFailures) == 0
+}
+
+// POST /digest body
+type digestRequest struct {
+	Email   string `json:"email"`
+	Weekday int    `json:"weekday"` // 0 is Sunday
+	Hour    int    `json:"hour"`    // UTC
+}
+
+type renderFailure struct {
+	When  time.Time
+	Error string
+}
+
+// renderFailureLog remembers each election's last render failure until it
+// renders again. Only in memory; a restart forgets them.
+type renderFailureLog struct {
+	l sync.Mutex
+	m map[int64]renderFailure
+}
+
+func (rf *renderFailureLog) fail(electionid int64, err error) {
+	rf.l.Lock()
+	defer rf.l.Unlock()
+	if rf.m == nil {
+		rf.m = make(map[int64]renderFailure)
+	}
+	rf.m[electionid] = renderFailure{time.Now(), err.Error()}
+}
+
+func (rf *renderFailureLog) ok(electionid int64) {
+	rf.l.Lock()
+	defer rf.l.Unlock()
+	delete(rf.m, electionid)
+}
+
+func (rf *renderFailureLog) get(electionid int64) (fail renderFailure, failed bool) {
+	rf.l.Lock()
+	defer rf.l.Unlock()
+	fail, failed = rf.m[electionid]
+	return
+}
+
+// scanNeedsReview is true if a scan couldn't be read or overvoted a contest
+func scanNeedsReview(doc map[string]interface{}, sr *scanRecord) bool {
+	var result map[string]map[string]bool
+	if json.Unmarshal([]byte(sr.Result), &result) != nil || len(result) == 0 {
+		return true
+	}
+	for _, ct := range tallyResults(doc, []map[string]map[string]bool{result}).Contests {
+		if ct.Overvotes != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// digestReport gathers what uid's elections need as of now
+func (sh *StudioHandler) digestReport(uid int64, now time.Time) (*digestReport, error) {
+	dr := &digestReport{
+		Deadlines:      []digestItem{},
+		NeedsReview:    []digestItem{},
+		RenderFailures: []digestItem{},
+		Generated:      now.UTC(),
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	eids, err := sh.edb.ElectionsForUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, eid := range eids {
+		er, err := sh.edb.GetElection(eid)
+		if err != nil {
+			return nil, fmt.Errorf("election %d, %v", eid, err)
+		}
+		if er.Trashed != 0 {
+			continue
+		}
+		state, err := sh.edb.GetElectionState(eid)
+		if err != nil {
+			return nil, fmt.Errorf("election %d, %v", eid, err)
+		}
+		if state == StateArchived {
+			continue
+		}
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(er.Data), &doc)
+		item := digestItem{Id: eid, State: state}
+		var startDate string
+		for _, el := range mapList(doc["Election"]) {
+			item.Name = docString(el["Name"])
+			startDate, _ = el["StartDate"].(string)
+			break
+		}
+
+		if day, err := time.Parse("2006-01-02", startDate); err == nil && state != StatePublished {
+			left := day.Sub(today)
+			if left >= 0 && left <= DigestHorizon {
+				deadline := item
+				deadline.Date = startDate
+				deadline.DaysLeft = int(left / (24 * time.Hour))
+				dr.Deadlines = append(dr.Deadlines, deadline)
+			}
+		}
+
+		sids, err := sh.edb.ScansForElection(eid)
+		if err != nil {
+			return nil, fmt.Errorf("election %d scans, %v", eid, err)
+		}
+		var review []int64
+		for _, sid := range sids {
+			sr, err := sh.edb.GetScan(sid)
+			if err != nil {
+				return nil, fmt.Errorf("scan %d, %v", sid, err)
+			}
+			if scanNeedsReview(doc, sr) {
+				review = append(review, sid)
+			}
+		}
+		if len(review) != 0 {
+			ri := item
+			ri.Scans = review
+			dr.NeedsReview = append(dr.NeedsReview, ri)
+		}
+
+		if fail, failed := sh.renderFailures.get(eid); failed {
+			fi := item
+			fi.Error = fail.Error
+			dr.RenderFailures = append(dr.RenderFailures, fi)
+		}
+	}
+	return dr, nil
+}
+
+func (di digestItem) label() string {
+	if di.Name == "" {
+		return fmt.Sprintf("#%d (%s)", di.Id, di.State)
+	}
+	return fmt.Sprintf("#%d %s (%s)", di.Id, di.Name, di.State)
+}
+
+// digestText is the email body
+func digestText(dr *digestReport) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "BallotStudio digest, %s\n", dr.Generated.Format("Monday 2 January 2006"))
+	if len(dr.Deadlines) != 0 {
+		sb.WriteString("\nElection day is coming and the ballot isn't published:\n")
+		for _, di := range dr.Deadlines {
+			fmt.Fprintf(&sb, "  %s: %s, %d days\n", di.label(), di.Date, di.DaysLeft)
+		}
+	}
+	if len(dr.NeedsReview) != 0 {
+		sb.WriteString("\nScans to review (overvoted or unreadable):\n")
+		for _, di := range dr.NeedsReview {
+			sids := make([]string, len(di.Scans))
+			for i, sid := range di.Scans {
+				sids[i] = fmt.Sprint(sid)
+			}
+			fmt.Fprintf(&sb, "  %s: scans %s\n", di.label(), strings.Join(sids, ", "))
+		}
+	}
+	if len(dr.RenderFailures) != 0 {
+		sb.WriteString("\nBallots that failed to render:\n")
+		for _, di := range dr.RenderFailures {
+			fmt.Fprintf(&sb, "  %s: %s\n", di.label(), di.Error)
+		}
+	}
+	if dr.empty() {
+		sb.WriteString("\nNothing needs attention.\n")
+	}
+	return sb.String()
+}
+
+func digestSubject(dr *digestReport) string {
+	n := len(dr.Deadlines) + len(dr.NeedsReview) + len(dr.RenderFailures)
+	return fmt.Sprintf("BallotStudio digest: %d elections need attention", n)
+}
+
+// nextDigest is the first ds.Weekday at ds.Hour:00 UTC after `after`
+func nextDigest(ds digestSchedule, after time.Time) time.Time {
+	after = after.UTC()
+	next := time.Date(after.Year(), after.Month(), after.Day(), ds.Hour, 0, 0, 0, time.UTC)
+	next = next.AddDate(0, 0, (ds.Weekday-int(next.Weekday())+7)%7)
+	if !next.After(after) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// sendDueDigests mails every digest whose time has come since it was last sent.
+// A server that was down over a scheduled time sends one when it comes back.
+// Nothing is sent when nothing needs attention.
+func (sh *StudioHandler) sendDueDigests(now time.Time) {
+	schedules, err := sh.edb.DigestSchedules()
+	if err != nil {
+		log.Printf("digest schedules, %v", err)
+		return
+	}
+	for _, ds := range schedules {
+		if now.Before(nextDigest(ds, time.Unix(ds.LastSent, 0))) {
+			continue
+		}
+		dr, err := sh.digestReport(ds.UserId, now)
+		if err != nil {
+			log.Printf("digest for user %d, %v", ds.UserId, err)
+			continue
+		}
+		if !dr.empty() {
+			err = sh.mailer.SendMail(ds.Email, digestSubject(dr), digestText(dr))
+			if err != nil {
+				// try again next tick
+				log.Printf("digest for user %d, %v", ds.UserId, err)
+				continue
+			}
+		}
+		ds.LastSent = now.Unix()
+		err = sh.edb.PutDigestSchedule(ds)
+		if err != nil {
+			log.Printf("digest for user %d, %v", ds.UserId, err)
+		}
+	}
+}
+
+// GET /digest your schedule, POST /digest set it, DELETE /digest stop it
+func (sh *StudioHandler) handleDigest(w http.ResponseWriter, r *http.Request, user *login.User) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		ds, err := sh.edb.GetDigestSchedule(user.Guid)
+		if maybeerr(w, err, 500, "db digest") {
+			return
+		}
+		if ds == nil {
+			texterr(w, 404, "no digest scheduled")
+			return
+		}
+		writeJSON(w, ds)
+	case "POST":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		var req digestRequest
+		err = json.Unmarshal(body, &req)
+		if maybeerr(w, err, 400, "bad json, %v", err) {
+			return
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if !strings.Contains(req.Email, "@") || !headerSafe(req.Email) {
+			texterr(w, 400, "bad email %q", req.Email)
+			return
+		}
+		if req.Weekday < 0 || req.Weekday > 6 || req.Hour < 0 || req.Hour > 23 {
+			texterr(w, 400, "weekday should be 0-6 and hour 0-23")
+			return
+		}
+		// the first digest goes out at the next scheduled time, not right away
+		ds := digestSchedule{user.Guid, req.Email, req.Weekday, req.Hour, time.Now().Unix()}
+		err = sh.edb.PutDigestSchedule(ds)
+		if maybeerr(w, err, 500, "db digest put") {
+			return
+		}
+		writeJSON(w, ds)
+	case "DELETE":
+		err := sh.edb.DeleteDigestSchedule(user.Guid)
+		if maybeerr(w, err, 500, "db digest delete") {
+			return
+		}
+		texterr(w, 200, "digest stopped")
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET, POST or DELETE")
+	}
+}
+
+// GET /digest/report what the next digest would say
+func (sh *StudioHandler) handleDigestReport(w http.ResponseWriter, r *http.Request, user *login.User) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	dr, err := sh.digestReport(user.Guid, time.Now())
+	if maybeerr(w, err, 500, "digest report, %v", err) {
+		return
+	}
+	writeJSON(w, dr)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMail struct {
+	to, subject, body string
+}
+
+type testMailer struct {
+	sent []testMail
+}
+
+func (tm *testMailer) SendMail(to, subject, body string) error {
+	tm.sent = append(tm.sent, testMail{to, subject, body})
+	return nil
+}
+
+func TestNextDigest(t *testing.T) {
+	// Monday 14:00, Friday 16 October 2026 is a Friday
+	ds := digestSchedule{Weekday: 1, Hour: 14}
+	fri := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	want := time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC)
+	if got := nextDigest(ds, fri); !got.Equal(want) {
+		t.Errorf("from friday got %v", got)
+	}
+	// exactly on the hour goes a week later
+	if got := nextDigest(ds, want); !got.Equal(want.AddDate(0, 0, 7)) {
+		t.Errorf("from send time got %v", got)
+	}
+	// same day, earlier hour
+	if got := nextDigest(ds, want.Add(-3*time.Hour)); !got.Equal(want) {
+		t.Errorf("from monday morning got %v", got)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	mail := &testMailer{}
+	sh := StudioHandler{edb: edb, mailer: mail}
+
+	now := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	soon, err := edb.PutElection(electionRecord{Owner: 1, Data: `{"Election": [{"Name": "Fall General", "StartDate": "2026-10-20"}]}`})
+	mtfail(t, err, "put election, %v", err)
+	later, err := edb.PutElection(electionRecord{Owner: 1, Data: `{"Election": [{"Name": "Spring Primary", "StartDate": "2027-03-02"}]}`})
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.PutElection(electionRecord{Owner: 2, Data: `{"Election": [{"Name": "Not Mine", "StartDate": "2026-10-20"}]}`})
+	mtfail(t, err, "put election, %v", err)
+
+	overvote, err := edb.PutScan(scanRecord{ElectionId: later, Result: `{"ccont1": {"csel1": true, "csel2": true}}`})
+	mtfail(t, err, "put scan, %v", err)
+	_, err = edb.PutScan(scanRecord{ElectionId: later, Result: `{"ccont1": {"csel1": true}}`})
+	mtfail(t, err, "put scan, %v", err)
+	_, err = edb.PutElection(electionRecord{Id: later, Owner: 1, Data: `{"Election": [{"Name": "Spring Primary", "StartDate": "2027-03-02", "Contest": [{"@id": "ccont1", "VotesAllowed": 1, "ContestSelection": [{"@id": "csel1"}, {"@id": "csel2"}]}]}]}`})
+	mtfail(t, err, "put election, %v", err)
+	sh.renderFailures.fail(later, errors.New("draw fail"))
+
+	dr, err := sh.digestReport(1, now)
+	mtfail(t, err, "digest report, %v", err)
+	if len(dr.Deadlines) != 1 || dr.Deadlines[0].Id != soon || dr.Deadlines[0].DaysLeft != 4 {
+		t.Errorf("deadlines %#v", dr.Deadlines)
+	}
+	if len(dr.NeedsReview) != 1 || dr.NeedsReview[0].Id != later || len(dr.NeedsReview[0].Scans) != 1 || dr.NeedsReview[0].Scans[0] != overvote {
+		t.Errorf("needs review %#v", dr.NeedsReview)
+	}
+	if len(dr.RenderFailures) != 1 || dr.RenderFailures[0].Error != "draw fail" {
+		t.Errorf("render failures %#v", dr.RenderFailures)
+	}
+
+	// published elections are past their deadline worries
+	_, err = edb.SetElectionState(soon, StateDraft, StatePublished)
+	mtfail(t, err, "set state, %v", err)
+	sh.renderFailures.ok(later)
+	dr, _ = sh.digestReport(1, now)
+	if len(dr.Deadlines) != 0 || len(dr.RenderFailures) != 0 {
+		t.Errorf("after publish and render %#v", dr)
+	}
+
+	// Monday 14:00 UTC, last sent the Monday before
+	ds := digestSchedule{UserId: 1, Email: "a@example.com", Weekday: 1, Hour: 14, LastSent: time.Date(2026, 10, 12, 14, 0, 0, 0, time.UTC).Unix()}
+	err = edb.PutDigestSchedule(ds)
+	mtfail(t, err, "put digest, %v", err)
+	sh.sendDueDigests(now)
+	if len(mail.sent) != 0 {
+		t.Errorf("sent before monday %#v", mail.sent)
+	}
+	monday := time.Date(2026, 10, 19, 14, 5, 0, 0, time.UTC)
+	sh.sendDueDigests(monday)
+	if len(mail.sent) != 1 || mail.sent[0].to != "a@example.com" || !strings.Contains(mail.sent[0].body, "Spring Primary") {
+		t.Fatalf("monday sent %#v", mail.sent)
+	}
+	sh.sendDueDigests(monday.Add(10 * time.Minute))
+	if len(mail.sent) != 1 {
+		t.Errorf("sent twice %#v", mail.sent)
+	}
+	xds, _ := edb.GetDigestSchedule(1)
+	if xds == nil || xds.LastSent != monday.Unix() {
+		t.Errorf("last sent not updated %#v", xds)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/login/login"
+)
+
+type electionDistrictsJSON struct {
+	ElectionId int64                `json:"itemid"`
+	Districts  []data.District      `json:"districts"`
+	Issues     []data.DistrictIssue `json:"issues"`
+}
+
+// GET /election/{id}/districts
+func (sh *StudioHandler) handleElectionDistricts(w http.ResponseWriter, r *http.Request, electionid int64) {
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if maybeerr(w, err, 500, "bad election json, %v", err) {
+		return
+	}
+	districts, _ := data.Districts(doc)
+	out, err := json.Marshal(electionDistrictsJSON{
+		ElectionId: electionid,
+		Districts:  districts,
+		Issues:     data.CheckDistricts(doc),
+	})
+	if maybeerr(w, err, 500, "json ret prep") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(out)
+}
+
+type districtImportJSON struct {
+	EditContext
+	Added        int                  `json:"added"`
+	Updated      int                  `json:"updated"`
+	BallotStyles int                  `json:"ballot_styles"`
+	Issues       []data.DistrictIssue `json:"issues"`
+}
+
+// readDistricts reads the precincts and districts of a POST /election/{id}/districts body
+func readDistricts(q map[string][]string, body []byte) ([]interface{}, error) {
+	format := ""
+	if f := q["format"]; len(f) != 0 {
+		format = f[0]
+	}
+	switch format {
+	case "geojson":
+		fields := data.GeoJSONFields{Districts: make(map[string]string)}
+		if v := q["precinct"]; len(v) != 0 {
+			fields.Precinct = v[0]
+		}
+		if v := q["name"]; len(v) != 0 {
+			fields.Name = v[0]
+		}
+		for _, d := range q["district"] {
+			parts := strings.SplitN(d, ":", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("bad district %q, want PROPERTY:type", d)
+			}
+			fields.Districts[parts[0]] = parts[1]
+		}
+		return data.ImportGeoJSONDistricts(bytes.NewReader(body), fields)
+	case "vip":
+		return data.ImportVIPXMLDistricts(bytes.NewReader(body))
+	}
+	return nil, fmt.Errorf("format %q, want geojson or vip", format)
+}
+
+// POST /election/{id}/districts?format=geojson&precinct=PROP[&name=PROP]&district=PROP:type...
+// POST /election/{id}/districts?format=vip
+// merges the precincts and districts in the body into the document's GpUnits
+// and generates its ballot styles from them, owner only
+func (sh *StudioHandler) handleElectionDistrictsImport(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxImportBundleBytes))
+	if err != nil {
+		texterr(w, http.StatusRequestEntityTooLarge, "district upload too large or broken, limit %d bytes", MaxImportBundleBytes)
+		return
+	}
+	units, err := readDistricts(r.URL.Query(), body)
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if maybeerr(w, err, 500, "bad election json, %v", err) {
+		return
+	}
+	added, updated := data.MergeGpUnits(doc, units)
+	styles := data.GenerateBallotStyles(doc)
+	nbody, err := json.Marshal(doc)
+	if maybeerr(w, err, 500, "json prep") {
+		return
+	}
+	// saved like any other edit, with its validation, revision and webhooks
+	sh.handleElectionDocPOSTJson(w, r, user, electionid, nbody, func(w http.ResponseWriter, r *http.Request, newid int64, issues []data.RuleIssue) {
+		out := districtImportJSON{Added: added, Updated: updated, BallotStyles: styles, Issues: data.CheckDistricts(doc)}
+		out.set(r, newid)
+		for _, issue := range issues {
+			if issue.Severity == data.IssueError {
+				out.Errors = append(out.Errors, issue)
+			} else {
+				out.Warnings = append(out.Warnings, issue)
+			}
+		}
+		writeJSON(w, out)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Election documents read through a small in-memory cache. GetElection is
+// called on every render and every document GET, so hot documents are kept
+// for -doc-cache-ttl, up to -doc-cache-bytes in all, and counted either way
+// for GET /admin/cache. Writes through this process drop the cached copy;
+// the TTL bounds how long a write by another server sharing the database
+// goes unseen.
+
+// docCacheStats are the counts since start
+type docCacheStats struct {
+	Entries   int     `json:"entries"`
+	Bytes     uint64  `json:"bytes"`
+	Reads     int64   `json:"reads"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	DBSeconds float64 `json:"db_seconds"` // spent on misses
+}
+
+// docCache is shared by a docCacheEDB and its WithContext views
+type docCache struct {
+	cache   Cache
+	ttl     time.Duration
+	enabled bool
+
+	l     sync.Mutex
+	stats docCacheStats
+	// gen counts invalidations, so a read that raced a write isn't cached
+	// after the write dropped the old copy
+	gen uint64
+}
+
+type cachedElection struct {
+	er      electionRecord
+	fetched time.Time
+}
+
+// docCacheEDB is an electionAppDB with GetElection through a docCache
+type docCacheEDB struct {
+	electionAppDB
+	docs *docCache
+}
+
+// newDocCacheEDB caches up to maxBytes of documents for ttl, 0 to only count reads
+func newDocCacheEDB(edb electionAppDB, maxBytes uint64, ttl time.Duration) *docCacheEDB {
+	docs := &docCache{ttl: ttl, enabled: maxBytes > 0 && ttl > 0}
+	docs.cache.MaxSize = maxBytes
+	return &docCacheEDB{edb, docs}
+}
+
+func (dc *docCache) count(hit bool, took time.Duration) {
+	dc.l.Lock()
+	defer dc.l.Unlock()
+	dc.stats.Reads++
+	if hit {
+		dc.stats.Hits++
+	} else {
+		dc.stats.Misses++
+		dc.stats.DBSeconds += took.Seconds()
+	}
+}
+
+// Stats is a snapshot of the counts
+func (dc *docCache) Stats() docCacheStats {
+	dc.l.Lock()
+	s := dc.stats
+	dc.l.Unlock()
+	s.Entries, s.Bytes = dc.cache.Len()
+	return s
+}
+
+func (dc *docCache) forget(id int64) {
+	dc.l.Lock()
+	defer dc.l.Unlock()
+	dc.gen++
+	dc.cache.Invalidate(strconv.FormatInt(id, 10))
+}
+
+// forgetAll drops every cached document
+func (dc *docCache) forgetAll() {
+	dc.l.Lock()
+	defer dc.l.Unlock()
+	dc.gen++
+	dc.cache.Clear()
+}
+
+func (dc *docCache) generation() uint64 {
+	dc.l.Lock()
+	defer dc.l.Unlock()
+	return dc.gen
+}
+
+// fill caches er, read when the generation was gen, unless something was
+// invalidated since and er may be older than what's in the database
+func (dc *docCache) fill(key string, gen uint64, ce *cachedElection) {
+	dc.l.Lock()
+	defer dc.l.Unlock()
+	if dc.gen != gen {
+		return
+	}
+	dc.cache.Put(key, ce, len(ce.er.Data)+len(ce.er.Meta)+100)
+}
+
+func (cdb *docCacheEDB) WithContext(ctx context.Context) electionAppDB {
+	return &docCacheEDB{cdb.electionAppDB.WithContext(ctx), cdb.docs}
+}
+
+func (cdb *docCacheEDB) GetElection(id int64) (*electionRecord, error) {
+	key := strconv.FormatInt(id, 10)
+	if ce, ok := cdb.docs.cache.Get(key).(*cachedElection); ok && time.Since(ce.fetched) < cdb.docs.ttl {
+		cdb.docs.count(true, 0)
+		// a copy, callers may change theirs
+		er := ce.er
+		return &er, nil
+	}
+	gen := cdb.docs.generation()
+	start := time.Now()
+	er, err := cdb.electionAppDB.GetElection(id)
+	cdb.docs.count(false, time.Since(start))
+	if err == nil && cdb.docs.enabled {
+		cdb.docs.fill(key, gen, &cachedElection{*er, start})
+	}
+	return er, err
+}
+
+func (cdb *docCacheEDB) PutElection(er electionRecord) (newid int64, err error) {
+	newid, err = cdb.electionAppDB.PutElection(er)
+	cdb.docs.forget(er.Id)
+	return
+}
+
+func (cdb *docCacheEDB) RestoreElection(er electionRecord) error {
+	err := cdb.electionAppDB.RestoreElection(er)
+	cdb.docs.forget(er.Id)
+	return err
+}
+
+func (cdb *docCacheEDB) TrashElection(id int64, when time.Time) error {
+	err := cdb.electionAppDB.TrashElection(id, when)
+	cdb.docs.forget(id)
+	return err
+}
+
+func (cdb *docCacheEDB) UntrashElection(id int64) error {
+	err := cdb.electionAppDB.UntrashElection(id)
+	cdb.docs.forget(id)
+	return err
+}
+
+func (cdb *docCacheEDB) PurgeTrash(before time.Time) (purged int64, err error) {
+	purged, err = cdb.electionAppDB.PurgeTrash(before)
+	if purged != 0 {
+		cdb.docs.forgetAll()
+	}
+	return
+}
+
+func (cdb *docCacheEDB) DeleteAccount(uid, electionsTo int64) (purged int64, err error) {
+	purged, err = cdb.electionAppDB.DeleteAccount(uid, electionsTo)
+	// elections purged or given to another owner
+	cdb.docs.forgetAll()
+	return
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDocCache(t *testing.T) {
+	inner, _ := testSqliteEDB(t)
+	edb := newDocCacheEDB(inner, 10000, time.Minute)
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: `{"v": 1}`})
+	mtfail(t, err, "put election, %v", err)
+
+	for i := 0; i < 3; i++ {
+		er, err := edb.GetElection(eid)
+		if err != nil || er.Data != `{"v": 1}` {
+			t.Fatalf("get %v %v", er, err)
+		}
+		er.Data = "changed by the caller"
+	}
+	if s := edb.docs.Stats(); s.Reads != 3 || s.Hits != 2 || s.Misses != 1 || s.Entries != 1 {
+		t.Errorf("stats %#v", s)
+	}
+
+	// saving, here or through a WithContext view, drops the copy
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: `{"v": 2}`})
+	mtfail(t, err, "put election, %v", err)
+	if er, _ := edb.GetElection(eid); er.Data != `{"v": 2}` {
+		t.Errorf("after save %s", er.Data)
+	}
+	err = edb.WithContext(nil).TrashElection(eid, time.Now())
+	mtfail(t, err, "trash, %v", err)
+	if er, _ := edb.GetElection(eid); er.Trashed == 0 {
+		t.Errorf("trashed election read from cache")
+	}
+
+	// a save by another server is seen after the TTL
+	edb.docs.ttl = 0
+	_, err = inner.PutElection(electionRecord{Id: eid, Owner: 7, Data: `{"v": 3}`})
+	mtfail(t, err, "put election, %v", err)
+	if er, _ := edb.GetElection(eid); er.Data != `{"v": 3}` {
+		t.Errorf("after ttl %s", er.Data)
+	}
+
+	// a read that raced a save isn't cached after the save dropped the old copy
+	racy := &racyReadEDB{electionAppDB: inner}
+	edb = newDocCacheEDB(racy, 10000, time.Minute)
+	racy.during = func() {
+		_, err := edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: `{"v": 4}`})
+		mtfail(t, err, "put election, %v", err)
+	}
+	if er, _ := edb.GetElection(eid); er.Data != `{"v": 3}` {
+		t.Errorf("racing read %s", er.Data)
+	}
+	if er, _ := edb.GetElection(eid); er.Data != `{"v": 4}` {
+		t.Errorf("after racing read %s", er.Data)
+	}
+
+	// counting only
+	edb = newDocCacheEDB(inner, 0, time.Minute)
+	edb.GetElection(eid)
+	edb.GetElection(eid)
+	if s := edb.docs.Stats(); s.Reads != 2 || s.Misses != 2 || s.Entries != 0 {
+		t.Errorf("uncached stats %#v", s)
+	}
+}
+
+// racyReadEDB runs during once, after GetElection has read its record
+type racyReadEDB struct {
+	electionAppDB
+	during func()
+}
+
+func (rdb *racyReadEDB) GetElection(id int64) (*electionRecord, error) {
+	er, err := rdb.electionAppDB.GetElection(id)
+	if rdb.during != nil {
+		during := rdb.during
+		rdb.during = nil
+		during()
+	}
+	return er, err
+}
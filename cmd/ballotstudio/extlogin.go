@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Users who sign in through another service, OpenID Connect (oidc.go) or
+// SAML (saml.go). Each identity, a subject of an issuer, gets a local user
+// on its first sign in, recorded in oidc_identities. Sessions come from the
+// login library's form login, as after signup, with a password derived from
+// a server key and the identity, so nothing that signs in is stored.
+
+// a local user made for an identity from another service
+type externalIdentity struct {
+	Issuer   string
+	Subject  string
+	UserId   int64
+	Username string
+	Created  int64 // unix seconds
+}
+
+type externalUsers struct {
+	edb electionAppDB
+	udb login.UserDB
+	key []byte // -oidc-key or -saml-key
+}
+
+// password is the local password of an identity's user
+func (eu *externalUsers) password(issuer, subject string) string {
+	mac := hmac.New(sha256.New, eu.key)
+	mac.Write([]byte(issuer + "\n" + subject))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// user finds subject of issuer's user, or makes one with the first of
+// usernames not taken and a profile with displayName and email
+func (eu *externalUsers) user(service, issuer, subject string, usernames []string, displayName, email string) (*externalIdentity, error) {
+	ei, err := eu.edb.GetExternalIdentity(issuer, subject)
+	if err != nil || ei != nil {
+		return ei, err
+	}
+	newuser := login.User{Email: email}
+	newuser.SetPassword(eu.password(issuer, subject))
+	var created *login.User
+	for _, name := range usernames {
+		newuser.Username = name
+		created, err = eu.udb.PutNewUser(&newuser)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("new user, %v", err)
+	}
+	if created == nil {
+		created = &newuser
+	}
+	now := time.Now().Unix()
+	ei = &externalIdentity{issuer, subject, created.Guid, created.Username, now}
+	err = eu.edb.PutExternalIdentity(*ei)
+	if err != nil {
+		return nil, err
+	}
+	if displayName == "" {
+		displayName = created.Username
+	}
+	err = eu.edb.PutAccount(accountRecord{UserId: created.Guid, DisplayName: displayName, Email: email, Updated: now})
+	if err != nil {
+		log.Printf("%d: %s profile, %v", created.Guid, service, err)
+	}
+	log.Printf("%s: new user %d %s", service, created.Guid, created.Username)
+	return ei, nil
+}
+
+// signIn starts a session for ei's user
+func (eu *externalUsers) signIn(w http.ResponseWriter, r *http.Request, ei *externalIdentity) error {
+	if liveUser(eu.edb, &login.User{Guid: ei.UserId}) == nil {
+		return fmt.Errorf("%s: account deleted or disabled", ei.Username)
+	}
+	form := url.Values{"username": {ei.Username}, "password": {eu.password(ei.Issuer, ei.Subject)}}
+	lr := r.Clone(r.Context())
+	lr.Method = "POST"
+	lr.Form, lr.PostForm = form, form
+	user, err := login.GetHttpUser(w, lr, eu.udb)
+	if user == nil {
+		return fmt.Errorf("%s sign in, %v", ei.Username, err)
+	}
+	return nil
+}
+
+// oidc_identities queries common to all backends. param is "$" for
+// numbered placeholders or "?".
+
+func getExternalIdentity(db sqlDB, param, issuer, subject string) (*externalIdentity, error) {
+	q := `SELECT user_id, username, created FROM oidc_identities WHERE issuer = $1 AND subject = $2`
+	if param == "?" {
+		q = `SELECT user_id, username, created FROM oidc_identities WHERE issuer = ? AND subject = ?`
+	}
+	ei := externalIdentity{Issuer: issuer, Subject: subject}
+	err := db.QueryRow(q, issuer, subject).Scan(&ei.UserId, &ei.Username, &ei.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("external identity, %v", err)
+	}
+	return &ei, nil
+}
+
+func putExternalIdentity(db sqlDB, param string, ei externalIdentity) error {
+	q := `INSERT INTO oidc_identities (issuer, subject, user_id, username, created) VALUES ($1, $2, $3, $4, $5)`
+	if param == "?" {
+		q = `INSERT INTO oidc_identities (issuer, subject, user_id, username, created) VALUES (?, ?, ?, ?, ?)`
+	}
+	_, err := db.Exec(q, ei.Issuer, ei.Subject, ei.UserId, ei.Username, ei.Created)
+	if err != nil {
+		return fmt.Errorf("external identity put, %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/brianolson/login/login"
+)
+
+// Election fonts. A TrueType font is uploaded with
+// POST /election/{id}/fonts?license=OFL-1.1&license_uri=..., kept in the media
+// store, and selected by listing it in the Election "Fonts" extension field:
+//
+//	"Fonts": [{"Uri": "/election/{id}/media/{mediaid}", "Family": "Noto Sans",
+//	           "Style": "regular", "License": "OFL-1.1", "LicenseUri": "https://..."}]
+//
+// Style is "regular" (the default) or "bold"; with only one of them it is used
+// for both. At render time the fonts are inlined like images and draw.py embeds
+// them in the PDF. GET /election/{id}/fonts and the readiness report list the
+// characters in the document that the selected fonts don't have.
+
+const DefaultFontMaxBytes = 20000000
+
+// OS/2 fsType bits that keep a font out of a PDF
+const (
+	fsTypeRestricted   = 0x0002 // restricted license embedding
+	fsTypeNoSubsetting = 0x0100 // reportlab always embeds subsets
+	fsTypeBitmapOnly   = 0x0200
+)
+
+var errFontTruncated = errors.New("font file truncated")
+
+// fontInfo is what is needed of a TrueType font: its names, embedding
+// permission and character map
+type fontInfo struct {
+	Family   string
+	FullName string
+	FsType   uint16
+
+	cmapFormat uint16
+	cmap       []byte
+}
+
+// parseFont reads the table directory, name, OS/2 and cmap tables of a TrueType font
+func parseFont(data []byte) (*fontInfo, error) {
+	if len(data) < 12 {
+		return nil, errFontTruncated
+	}
+	switch string(data[:4]) {
+	case "\x00\x01\x00\x00", "true":
+	case "OTTO":
+		return nil, errors.New("OpenType with PostScript (CFF) outlines, the draw backend needs TrueType outlines")
+	case "ttcf":
+		return nil, errors.New("font collection, upload the one font")
+	default:
+		return nil, errors.New("not a TrueType font")
+	}
+	tables := make(map[string][]byte)
+	numTables := int(binary.BigEndian.Uint16(data[4:]))
+	if 12+16*numTables > len(data) {
+		return nil, errFontTruncated
+	}
+	for i := 0; i < numTables; i++ {
+		rec := data[12+16*i:]
+		offset := int64(binary.BigEndian.Uint32(rec[8:]))
+		length := int64(binary.BigEndian.Uint32(rec[12:]))
+		if offset+length > int64(len(data)) {
+			return nil, errFontTruncated
+		}
+		tables[string(rec[:4])] = data[offset : offset+length]
+	}
+	fi := &fontInfo{}
+	if os2 := tables["OS/2"]; len(os2) >= 10 {
+		fi.FsType = binary.BigEndian.Uint16(os2[8:])
+	}
+	if name := tables["name"]; name != nil {
+		fi.Family = fontName(name, 1)
+		fi.FullName = fontName(name, 4)
+	}
+	err := fi.parseCmap(tables["cmap"])
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+// fontName is a name table entry, preferring Windows US English
+func fontName(table []byte, nameID uint16) string {
+	if len(table) < 6 {
+		return ""
+	}
+	count := int(binary.BigEndian.Uint16(table[2:]))
+	strOffset := int(binary.BigEndian.Uint16(table[4:]))
+	best, bestScore := "", 0
+	for i := 0; i < count && 6+12*i+12 <= len(table); i++ {
+		rec := table[6+12*i:]
+		platform := binary.BigEndian.Uint16(rec)
+		lang := binary.BigEndian.Uint16(rec[4:])
+		if binary.BigEndian.Uint16(rec[6:]) != nameID {
+			continue
+		}
+		start := strOffset + int(binary.BigEndian.Uint16(rec[10:]))
+		end := start + int(binary.BigEndian.Uint16(rec[8:]))
+		if end > len(table) {
+			continue
+		}
+		raw := table[start:end]
+		var text string
+		score := 1
+		switch platform {
+		case 0, 3:
+			u := make([]uint16, len(raw)/2)
+			for j := range u {
+				u[j] = binary.BigEndian.Uint16(raw[2*j:])
+			}
+			text = string(utf16.Decode(u))
+			score = 2
+			if platform == 3 && lang == 0x409 {
+				score = 3
+			}
+		case 1:
+			text = string(raw)
+		default:
+			continue
+		}
+		if score > bestScore {
+			best, bestScore = text, score
+		}
+	}
+	return best
+}
+
+// parseCmap picks the Unicode subtable, format 12 (full Unicode) over format 4 (BMP)
+func (fi *fontInfo) parseCmap(table []byte) error {
+	if len(table) < 4 {
+		return errors.New("font has no character map")
+	}
+	numTables := int(binary.BigEndian.Uint16(table[2:]))
+	for i := 0; i < numTables && 4+8*i+8 <= len(table); i++ {
+		rec := table[4+8*i:]
+		platform := binary.BigEndian.Uint16(rec)
+		encoding := binary.BigEndian.Uint16(rec[2:])
+		if !(platform == 0 || (platform == 3 && (encoding == 1 || encoding == 10))) {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(rec[4:]))
+		if offset+4 > len(table) {
+			return errFontTruncated
+		}
+		sub := table[offset:]
+		format := binary.BigEndian.Uint16(sub)
+		var length int
+		switch format {
+		case 4:
+			length = int(binary.BigEndian.Uint16(sub[2:]))
+		case 12:
+			if len(sub) < 16 {
+				return errFontTruncated
+			}
+			length = int(binary.BigEndian.Uint32(sub[4:]))
+		default:
+			continue
+		}
+		if length > len(sub) {
+			return errFontTruncated
+		}
+		if format == 12 || fi.cmap == nil {
+			fi.cmapFormat, fi.cmap = format, sub[:length]
+		}
+	}
+	if fi.cmap == nil {
+		return errors.New("font has no Unicode character map")
+	}
+	return nil
+}
+
+// HasGlyph is true if the font maps r to a glyph other than .notdef
+func (fi *fontInfo) HasGlyph(r rune) bool {
+	cm := fi.cmap
+	switch fi.cmapFormat {
+	case 12:
+		numGroups := int(binary.BigEndian.Uint32(cm[12:]))
+		if 16+12*numGroups > len(cm) {
+			numGroups = (len(cm) - 16) / 12
+		}
+		c := uint32(r)
+		i := sort.Search(numGroups, func(i int) bool {
+			return binary.BigEndian.Uint32(cm[16+12*i+4:]) >= c
+		})
+		if i == numGroups {
+			return false
+		}
+		group := cm[16+12*i:]
+		start := binary.BigEndian.Uint32(group)
+		return start <= c && binary.BigEndian.Uint32(group[8:])+(c-start) != 0
+	case 4:
+		if r > 0xffff || len(cm) < 14 {
+			return false
+		}
+		segCount := int(binary.BigEndian.Uint16(cm[6:])) / 2
+		if 16+8*segCount > len(cm) {
+			return false
+		}
+		c := uint16(r)
+		endCodes := cm[14:]
+		i := sort.Search(segCount, func(i int) bool {
+			return binary.BigEndian.Uint16(endCodes[2*i:]) >= c
+		})
+		if i == segCount {
+			return false
+		}
+		start := binary.BigEndian.Uint16(cm[16+2*segCount+2*i:])
+		if c < start || c == 0xffff {
+			return false
+		}
+		delta := binary.BigEndian.Uint16(cm[16+4*segCount+2*i:])
+		rangeAt := 16 + 6*segCount + 2*i
+		rangeOffset := int(binary.BigEndian.Uint16(cm[rangeAt:]))
+		if rangeOffset == 0 {
+			return c+delta != 0
+		}
+		at := rangeAt + rangeOffset + 2*int(c-start)
+		if at+2 > len(cm) {
+			return false
+		}
+		glyph := binary.BigEndian.Uint16(cm[at:])
+		return glyph != 0 && glyph+delta != 0
+	}
+	return false
+}
+
+// checkEmbeddable refuses fonts whose license doesn't allow them in a PDF
+func (fi *fontInfo) checkEmbeddable() error {
+	switch {
+	case fi.FsType&fsTypeRestricted != 0:
+		return errors.New("font license does not allow embedding (OS/2 fsType restricted)")
+	case fi.FsType&fsTypeNoSubsetting != 0:
+		return errors.New("font license does not allow subsetting, which the draw backend needs")
+	case fi.FsType&fsTypeBitmapOnly != 0:
+		return errors.New("font license only allows embedding bitmaps")
+	}
+	return nil
+}
+
+// checkFont sniffs a font upload, which must be an embeddable TrueType font
+func checkFont(data []byte) (fi *fontInfo, contentType string, err error) {
+	fi, err = parseFont(data)
+	if err != nil {
+		return nil, "", err
+	}
+	err = fi.checkEmbeddable()
+	if err != nil {
+		return nil, "", err
+	}
+	return fi, "font/ttf", nil
+}
+
+// defaultFontCovers is roughly what Liberation Sans, used when an election has no Fonts, has
+func defaultFontCovers(r rune) bool {
+	switch {
+	case r <= 0x24f: // Latin-1, Latin Extended A and B
+		return true
+	case r >= 0x370 && r <= 0x4ff: // Greek and Cyrillic
+		return true
+	case r >= 0x1e00 && r <= 0x1eff: // Latin Extended Additional
+		return true
+	case r >= 0x2000 && r <= 0x206f: // General Punctuation
+		return true
+	case r >= 0x20a0 && r <= 0x20cf: // Currency Symbols
+		return true
+	}
+	return false
+}
+
+// documentText counts the characters of printed text in doc, skipping ids, types, dates and URIs
+func documentText(doc interface{}) map[rune]int {
+	counts := make(map[rune]int)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			for k, sub := range x {
+				if k == "@id" || k == "@type" || k == "Language" || k == "Fonts" || k == "BubbleGeometry" ||
+					strings.HasSuffix(k, "Id") || strings.HasSuffix(k, "Ids") || strings.HasSuffix(k, "Uri") || strings.HasSuffix(k, "Date") {
+					continue
+				}
+				walk(sub)
+			}
+		case []interface{}:
+			for _, sub := range x {
+				walk(sub)
+			}
+		case string:
+			for _, r := range x {
+				if !unicode.IsControl(r) && !unicode.IsSpace(r) {
+					counts[r]++
+				}
+			}
+		}
+	}
+	walk(doc)
+	return counts
+}
+
+// electionFont is an entry of the Election "Fonts" extension field
+type electionFont struct {
+	Id         string `json:"id,omitempty"`
+	URL        string `json:"url"`
+	Family     string `json:"family,omitempty"`
+	Style      string `json:"style"`
+	License    string `json:"license,omitempty"`
+	LicenseUri string `json:"license_uri,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	info *fontInfo
+}
+
+// missingGlyph is a character of the document some selected font doesn't have
+type missingGlyph struct {
+	Char  string   `json:"char"`
+	Code  string   `json:"code"` // U+4E80
+	Count int      `json:"count"`
+	Fonts []string `json:"fonts"` // the fonts without it
+}
+
+func (mg missingGlyph) String() string {
+	return fmt.Sprintf("%s %s not in %s (%d times)", mg.Code, mg.Char, strings.Join(mg.Fonts, ", "), mg.Count)
+}
+
+// electionFonts loads the fonts the first Election of doc selects.
+// Ones that can't be loaded have Error set; the draw backend leaves those out.
+func (sh *StudioHandler) electionFonts(doc map[string]interface{}) []electionFont {
+	var out []electionFont
+	for _, el := range mapList(doc["Election"]) {
+		for _, fob := range mapList(el["Fonts"]) {
+			ef := electionFont{Style: "regular"}
+			ef.URL, _ = fob["Uri"].(string)
+			ef.Family, _ = fob["Family"].(string)
+			if style, _ := fob["Style"].(string); style != "" {
+				ef.Style = style
+			}
+			ef.License, _ = fob["License"].(string)
+			ef.LicenseUri, _ = fob["LicenseUri"].(string)
+			m := mediaRefRe.FindStringSubmatch(ef.URL)
+			if m == nil || sh.media == nil {
+				ef.Error = "not an uploaded font"
+				out = append(out, ef)
+				continue
+			}
+			ef.Id = m[1]
+			data, _, err := sh.media.GetMedia(ef.Id)
+			if err == nil {
+				ef.info, err = parseFont(data)
+			}
+			if err != nil {
+				ef.Error = err.Error()
+			} else if ef.Family == "" {
+				ef.Family = ef.info.Family
+			}
+			out = append(out, ef)
+		}
+		// fonts are per Election, like the bubbles only the first is drawn
+		break
+	}
+	return out
+}
+
+// missingGlyphs lists the document's characters each font (or the default font) lacks, by code point
+func missingGlyphs(doc map[string]interface{}, fonts []electionFont) []missingGlyph {
+	type coverer struct {
+		name   string
+		covers func(rune) bool
+	}
+	var use []coverer
+	for _, ef := range fonts {
+		if ef.info != nil {
+			name := ef.Family
+			if ef.Style != "regular" {
+				name += " " + ef.Style
+			}
+			use = append(use, coverer{name, ef.info.HasGlyph})
+		}
+	}
+	if len(use) == 0 {
+		use = append(use, coverer{"Liberation Sans", defaultFontCovers})
+	}
+	var out []missingGlyph
+	for r, count := range documentText(doc) {
+		var without []string
+		for _, cv := range use {
+			if !cv.covers(r) {
+				without = append(without, cv.name)
+			}
+		}
+		if len(without) != 0 {
+			out = append(out, missingGlyph{Char: string(r), Code: fmt.Sprintf("U+%04X", r), Count: count, Fonts: without})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return []rune(out[i].Char)[0] < []rune(out[j].Char)[0] })
+	return out
+}
+
+// checkFonts fails on characters the election's fonts don't have, and warns
+// on ones the default font probably doesn't have (its coverage is a guess),
+// fonts that can't be used, and fonts with no license noted
+func (sh *StudioHandler) checkFonts(doc map[string]interface{}) readinessItem {
+	fonts := sh.electionFonts(doc)
+	var problems []string
+	for _, mg := range missingGlyphs(doc, fonts) {
+		problems = append(problems, mg.String())
+	}
+	selected := false
+	for _, ef := range fonts {
+		selected = selected || ef.info != nil
+	}
+	if len(problems) != 0 {
+		status := readyFail
+		if !selected {
+			status = readyWarn
+		}
+		return readinessItem{Check: "fonts", Status: status, Message: fmt.Sprintf("%d characters missing from the fonts", len(problems)), Details: problems}
+	}
+	var warns []string
+	for _, ef := range fonts {
+		if ef.Error != "" {
+			warns = append(warns, fmt.Sprintf("%s: %s", ef.URL, ef.Error))
+		} else if ef.License == "" {
+			warns = append(warns, fmt.Sprintf("%s: no License", ef.Family))
+		}
+	}
+	if len(warns) != 0 {
+		return readinessItem{Check: "fonts", Status: readyWarn, Message: "font problems", Details: warns}
+	}
+	return readinessItem{Check: "fonts", Status: readyPass, Message: "the fonts have every character"}
+}
+
+type fontsJSON struct {
+	Fonts   []electionFont `json:"fonts"`
+	Missing []missingGlyph `json:"missing"`
+}
+
+type fontUploadJSON struct {
+	Id         string `json:"id"`
+	URL        string `json:"url"`
+	Family     string `json:"family"`
+	FullName   string `json:"full_name"`
+	License    string `json:"license"`
+	LicenseUri string `json:"license_uri,omitempty"`
+}
+
+// POST /election/{id}/fonts?license=...[&license_uri=...], TrueType font body, owner only
+// GET /election/{id}/fonts, the selected fonts and the characters they're missing
+func (sh *StudioHandler) handleElectionFonts(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if r.Method == "GET" {
+		er, err := sh.edb.GetElection(electionid)
+		if maybeerr(w, err, 404, "no item") {
+			return
+		}
+		var doc map[string]interface{}
+		err = json.Unmarshal([]byte(er.Data), &doc)
+		if maybeerr(w, err, 500, "bad election json") {
+			return
+		}
+		fonts := sh.electionFonts(doc)
+		out, err := json.Marshal(fontsJSON{Fonts: fonts, Missing: missingGlyphs(doc, fonts)})
+		if maybeerr(w, err, 500, "json ret prep") {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(out)
+		return
+	}
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "GET or POST only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	license := strings.TrimSpace(r.URL.Query().Get("license"))
+	if license == "" {
+		texterr(w, 400, "license required, e.g. ?license=OFL-1.1")
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, sh.fontMaxBytes))
+	if err != nil {
+		texterr(w, http.StatusRequestEntityTooLarge, "font upload too large or broken, limit %d bytes", sh.fontMaxBytes)
+		return
+	}
+	fi, contentType, err := checkFont(data)
+	if err != nil {
+		texterr(w, http.StatusUnsupportedMediaType, "%v", err)
+		return
+	}
+	mediaid, err := sh.media.PutMedia(data, contentType)
+	if maybeerr(w, err, 500, "media put") {
+		return
+	}
+	out, err := json.Marshal(fontUploadJSON{
+		Id:         mediaid,
+		URL:        fmt.Sprintf("/election/%d/media/%s", electionid, mediaid),
+		Family:     fi.Family,
+		FullName:   fi.FullName,
+		License:    license,
+		LicenseUri: r.URL.Query().Get("license_uri"),
+	})
+	if maybeerr(w, err, 500, "json ret prep") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(out)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// testFont builds a TrueType font with just the tables parseFont reads,
+// mapping the characters of each [first, last] pair to glyphs
+func testFont(family string, fsType uint16, ranges ...[2]uint16) []byte {
+	be := binary.BigEndian
+	var os2 bytes.Buffer
+	binary.Write(&os2, be, []uint16{4, 500, 400, 5, fsType})
+
+	var name bytes.Buffer
+	nameText := utf16.Encode([]rune(family))
+	binary.Write(&name, be, []uint16{0, 1, 6 + 12})
+	binary.Write(&name, be, []uint16{3, 1, 0x409, 1, uint16(2 * len(nameText)), 0})
+	binary.Write(&name, be, nameText)
+
+	// format 4 with the 0xffff end segment
+	ranges = append(ranges, [2]uint16{0xffff, 0xffff})
+	segCount := len(ranges)
+	var sub bytes.Buffer
+	binary.Write(&sub, be, []uint16{4, uint16(16 + 8*segCount), 0, uint16(2 * segCount), 0, 0, 0})
+	for _, r := range ranges {
+		binary.Write(&sub, be, r[1])
+	}
+	binary.Write(&sub, be, uint16(0))
+	for _, r := range ranges {
+		binary.Write(&sub, be, r[0])
+	}
+	glyph := uint16(1)
+	for _, r := range ranges {
+		if r[0] == 0xffff {
+			binary.Write(&sub, be, uint16(1))
+			continue
+		}
+		binary.Write(&sub, be, glyph-r[0])
+		glyph += r[1] - r[0] + 1
+	}
+	for range ranges {
+		binary.Write(&sub, be, uint16(0))
+	}
+	var cmap bytes.Buffer
+	binary.Write(&cmap, be, []uint16{0, 1, 3, 1})
+	binary.Write(&cmap, be, uint32(12))
+	cmap.Write(sub.Bytes())
+
+	tables := []struct {
+		tag  string
+		data []byte
+	}{{"OS/2", os2.Bytes()}, {"cmap", cmap.Bytes()}, {"name", name.Bytes()}}
+	var out bytes.Buffer
+	binary.Write(&out, be, uint32(0x00010000))
+	binary.Write(&out, be, []uint16{uint16(len(tables)), 0, 0, 0})
+	offset := 12 + 16*len(tables)
+	for _, table := range tables {
+		out.WriteString(table.tag)
+		binary.Write(&out, be, []uint32{0, uint32(offset), uint32(len(table.data))})
+		offset += len(table.data)
+	}
+	for _, table := range tables {
+		out.Write(table.data)
+	}
+	return out.Bytes()
+}
+
+func TestParseFont(t *testing.T) {
+	fi, ct, err := checkFont(testFont("Test Sans", 0, [2]uint16{0x20, 0x7e}, [2]uint16{0x4e80, 0x4e80}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct != "font/ttf" || fi.Family != "Test Sans" {
+		t.Errorf("got %s %q", ct, fi.Family)
+	}
+	for _, r := range " Az~亀" {
+		if !fi.HasGlyph(r) {
+			t.Errorf("missing %U", r)
+		}
+	}
+	for _, r := range "é亁\U0001f600" {
+		if fi.HasGlyph(r) {
+			t.Errorf("unexpected %U", r)
+		}
+	}
+	_, _, err = checkFont(testFont("Locked", fsTypeRestricted, [2]uint16{0x20, 0x7e}))
+	if err == nil {
+		t.Errorf("restricted license embedding font allowed")
+	}
+	_, _, err = checkFont(append([]byte("OTTO"), make([]byte, 20)...))
+	if err == nil || !strings.Contains(err.Error(), "CFF") {
+		t.Errorf("CFF font got %v", err)
+	}
+	_, _, err = checkFont(testFont("Test Sans", 0, [2]uint16{0x20, 0x7e})[:40])
+	if err == nil {
+		t.Errorf("truncated font allowed")
+	}
+}
+
+func TestCheckFonts(t *testing.T) {
+	ms := &memMediaStore{}
+	mid, err := ms.PutMedia(testFont("Test Sans", 0, [2]uint16{0x20, 0x7e}), "font/ttf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(mid, ".ttf") || !mediaIdRe.MatchString(mid) {
+		t.Fatalf("font media id %s", mid)
+	}
+	sh := &StudioHandler{media: ms}
+	doc := map[string]interface{}{
+		"Election": []interface{}{map[string]interface{}{
+			"@id":       "el1",
+			"StartDate": "2024-11-05",
+			"Name":      map[string]interface{}{"Text": []interface{}{map[string]interface{}{"Language": "en", "Content": "Café"}, map[string]interface{}{"Language": "zh", "Content": "選舉"}}},
+		}},
+	}
+	item := sh.checkFonts(doc)
+	if item.Status != readyWarn || len(item.Details) != 2 {
+		t.Errorf("default font got %#v", item)
+	}
+	doc["Election"].([]interface{})[0].(map[string]interface{})["Fonts"] = []interface{}{
+		map[string]interface{}{"Uri": "/election/1/media/" + mid, "License": "OFL-1.1"},
+	}
+	fonts := sh.electionFonts(doc)
+	if len(fonts) != 1 || fonts[0].Family != "Test Sans" || fonts[0].Error != "" {
+		t.Fatalf("fonts %#v", fonts)
+	}
+	missing := missingGlyphs(doc, fonts)
+	if len(missing) != 3 || missing[0].Code != "U+00E9" || missing[1].Char != "舉" {
+		t.Errorf("missing %v", missing)
+	}
+	item = sh.checkFonts(doc)
+	if item.Status != readyFail || len(item.Details) != 3 {
+		t.Errorf("selected font got %#v", item)
+	}
+	out, err := inlineMedia(ms, `{"Election": [{"Fonts": [{"Uri": "/election/1/media/`+mid+`"}]}]}`)
+	if err != nil || !strings.Contains(out, "data:font/ttf;base64,") {
+		t.Errorf("inlined got %s %v", out, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+// largest bubbles layout POST /formats/bubbles converts
+const maxBubblesConvertBytes = 20000000
+
+// GET /formats
+type formatsList struct {
+	Bubbles bubblesFormats `json:"bubbles"`
+}
+
+type bubblesFormats struct {
+	// Latest is the newest version, Default what /election/{id}_bubbles.json serves unasked
+	Latest   int                  `json:"latest"`
+	Default  int                  `json:"default"`
+	Versions []scan.BubblesFormat `json:"versions"`
+	// Convert takes a POSTed layout of any version and returns ?version=N
+	Convert string `json:"convert"`
+}
+
+// bubblesFormat is the version asked for by ?version=N, else by Accept,
+// else the default. nil for a version this build doesn't have.
+func bubblesFormat(r *http.Request) *scan.BubblesFormat {
+	want := scan.BubblesVersionDefault
+	if vs := r.URL.Query().Get("version"); vs != "" {
+		v, err := strconv.Atoi(vs)
+		if err != nil {
+			return nil
+		}
+		want = v
+	} else {
+		for _, accept := range r.Header.Values("Accept") {
+			for _, format := range scan.BubblesFormats {
+				if strings.Contains(accept, format.Accept) {
+					want = format.Version
+				}
+			}
+		}
+	}
+	for i, format := range scan.BubblesFormats {
+		if format.Version == want {
+			return &scan.BubblesFormats[i]
+		}
+	}
+	return nil
+}
+
+// GET /formats
+func handleFormats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	writeJSON(w, formatsList{Bubbles: bubblesFormats{
+		Latest:   scan.BubblesVersionLatest,
+		Default:  scan.BubblesVersionDefault,
+		Versions: scan.BubblesFormats,
+		Convert:  sitePath(r, "/formats/bubbles"),
+	}})
+}
+
+// POST /formats/bubbles?version=N
+// Rewrites a bubbles layout of any supported version as version N, for
+// scanners that saved a layout from another release.
+func handleBubblesConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	format := bubblesFormat(r)
+	if format == nil {
+		texterr(w, 400, "bubbles version not supported, see /formats")
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBubblesConvertBytes))
+	if maybeerr(w, err, 400, "bad body") {
+		return
+	}
+	out, err := scan.ConvertBubbles(body, format.Version)
+	if err != nil {
+		texterr(w, 400, "bad bubbles json, %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", format.MediaType)
+	w.WriteHeader(200)
+	w.Write(out)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+func TestBubblesFormat(t *testing.T) {
+	for _, tc := range []struct {
+		query, accept string
+		want          int
+	}{
+		{"", "", 1},
+		{"", "application/json", 1},
+		{"", scan.BubblesV2MediaType, 2},
+		{"", scan.BubblesV1MediaType + ", application/json", 1},
+		{"?version=2", "", 2},
+		{"?version=1", scan.BubblesV2MediaType, 1},
+		{"?version=3", "", 0},
+		{"?version=x", "", 0},
+	} {
+		req := httptest.NewRequest("GET", "/election/1_bubbles.json"+tc.query, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		got := 0
+		if format := bubblesFormat(req); format != nil {
+			got = format.Version
+		}
+		if got != tc.want {
+			t.Errorf("%q %q got version %d, want %d", tc.query, tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleFormats(rec, httptest.NewRequest("GET", "/formats", nil))
+	var fl formatsList
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &fl) != nil || fl.Bubbles.Latest != 2 || fl.Bubbles.Default != 1 || len(fl.Bubbles.Versions) != 2 || fl.Bubbles.Convert != "/formats/bubbles" {
+		t.Errorf("formats %d %s", rec.Code, rec.Body.String())
+	}
+
+	v1 := `{"draw_settings": {"pagesize": [612, 792], "pageMargin": 36}, "bubbles": [{"c1": {"s1": [1, 2, 3, 4]}}], "bsdata": [{"GpUnitIds": ["g1"], "pages": 1, "bubble_pages": {"c1": 1}}]}`
+	convert := func(query, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleBubblesConvert(rec, httptest.NewRequest("POST", "/formats/bubbles"+query, strings.NewReader(body)))
+		return rec
+	}
+	rec = convert("?version=2", v1)
+	var bv scan.BubblesV2
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != scan.BubblesV2MediaType || json.Unmarshal(rec.Body.Bytes(), &bv) != nil || len(bv.Pages) != 1 || bv.Pages[0].Targets[0].Id != "c1/s1" {
+		t.Fatalf("to v2 %d %s", rec.Code, rec.Body.String())
+	}
+	v2 := rec.Body.String()
+	rec = convert("", v2)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"version":1`) || !strings.Contains(rec.Body.String(), `"s1":[1,2,3,4]`) {
+		t.Errorf("to v1 %d %s", rec.Code, rec.Body.String())
+	}
+	for _, bad := range [][2]string{{"?version=9", v1}, {"", `{"version": 9}`}, {"", "not json"}} {
+		if rec = convert(bad[0], bad[1]); rec.Code != 400 {
+			t.Errorf("%s %s: %d", bad[0], bad[1], rec.Code)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/ballotstudio/synth"
+	"github.com/brianolson/login/login"
+)
+
+// Imposition for print vendors: GET /election/{id}/print.pdf lays the final
+// ballot's pages out on press sheets, so the vendor doesn't have to
+// reprocess the voter facing PDF.
+//
+//	nup=1|2|4    pages on each side of a sheet, side by side, then in rows
+//	duplex=1     backs follow fronts, mirrored left to right so each page
+//	             backs its front when the sheet is turned over side to side
+//	repeat=1     step and repeat: every cell on a side is the same page
+//	booklet=1    saddle stitch: 2-up, duplex, in folding order
+//	bleed=N      points of white around each page's trim, at most 36
+//	marks=1      crop marks at the trim lines and a slug line naming the sheet
+//	sheet=NAME   letter, legal, tabloid, a4, a3, 12x18 or 13x19; by default
+//	             just big enough
+//	style=N      only that ballot style
+//
+// Pages are never scaled, since scanners need the bubbles where the bubbles
+// JSON says they are. Each ballot style starts on a new sheet, and in a
+// booklet each style is its own booklet. Pages are the rendered page images,
+// as in the review and test deck PDFs.
+
+// at most this many points of bleed around each page
+const maxImposeBleed = 36.0
+
+// crop marks start this far outside the bleed and are this long, points
+const (
+	cropMarkGap    = 3.0
+	cropMarkLength = 18.0
+)
+
+// margin around the cells for crop marks and the slug line, points
+const imposeMarkMargin = 36.0
+
+// press sheet sizes in points, portrait; a sheet is turned if that fits better
+var imposeSheets = map[string][2]float64{
+	"letter":  {612, 792},
+	"legal":   {612, 1008},
+	"tabloid": {792, 1224},
+	"a4":      {595.28, 841.89},
+	"a3":      {841.89, 1190.55},
+	"12x18":   {864, 1296},
+	"13x19":   {936, 1368},
+}
+
+type imposeOptions struct {
+	NUp     int
+	Duplex  bool
+	Repeat  bool
+	Booklet bool
+	Bleed   float64 // points
+	Marks   bool
+	Sheet   string // "" for just big enough
+	Style   int    // -1 for every style
+}
+
+func parseImposeOptions(query url.Values) (opts imposeOptions, err error) {
+	opts.Duplex = qbool(query.Get("duplex"))
+	opts.Repeat = qbool(query.Get("repeat"))
+	opts.Booklet = qbool(query.Get("booklet"))
+	opts.Marks = qbool(query.Get("marks"))
+	opts.NUp = 1
+	if opts.Booklet {
+		opts.NUp = 2
+		opts.Duplex = true
+	}
+	if v := query.Get("nup"); v != "" {
+		opts.NUp, err = strconv.Atoi(v)
+		if err != nil || (opts.NUp != 1 && opts.NUp != 2 && opts.NUp != 4) {
+			return opts, fmt.Errorf("nup %q should be 1, 2 or 4", v)
+		}
+	}
+	if opts.Booklet && opts.NUp != 2 {
+		return opts, fmt.Errorf("a booklet is 2-up")
+	}
+	if opts.Booklet && opts.Repeat {
+		return opts, fmt.Errorf("booklet and repeat are exclusive")
+	}
+	if v := query.Get("bleed"); v != "" {
+		opts.Bleed, err = strconv.ParseFloat(v, 64)
+		if err != nil || opts.Bleed < 0 || opts.Bleed > maxImposeBleed {
+			return opts, fmt.Errorf("bleed %q should be 0 to %g points", v, maxImposeBleed)
+		}
+	}
+	opts.Sheet = strings.ToLower(query.Get("sheet"))
+	if _, ok := imposeSheets[opts.Sheet]; opts.Sheet != "" && !ok {
+		return opts, fmt.Errorf("sheet %q should be letter, legal, tabloid, a4, a3, 12x18 or 13x19", opts.Sheet)
+	}
+	opts.Style = -1
+	if v := query.Get("style"); v != "" {
+		opts.Style, err = strconv.Atoi(v)
+		if err != nil || opts.Style < 0 {
+			return opts, fmt.Errorf("bad style %q", v)
+		}
+	}
+	return opts, nil
+}
+
+// imposeLayout is where the cells go on a sheet
+type imposeLayout struct {
+	SheetWidth, SheetHeight float64
+	Cols, Rows              int
+	// lower left of the cell grid, bleed included
+	X, Y float64
+	// a cell is a page and its bleed all around
+	CellWidth, CellHeight float64
+}
+
+func layoutSheet(opts imposeOptions, pageWidth, pageHeight float64) (lo imposeLayout, err error) {
+	lo.Cols, lo.Rows = 1, 1
+	switch opts.NUp {
+	case 2:
+		lo.Cols = 2
+	case 4:
+		lo.Cols, lo.Rows = 2, 2
+	}
+	lo.CellWidth = pageWidth + 2*opts.Bleed
+	lo.CellHeight = pageHeight + 2*opts.Bleed
+	gridWidth := float64(lo.Cols) * lo.CellWidth
+	gridHeight := float64(lo.Rows) * lo.CellHeight
+	margin := 0.0
+	if opts.Marks {
+		margin = imposeMarkMargin
+	}
+	needWidth := gridWidth + 2*margin
+	needHeight := gridHeight + 2*margin
+	if opts.Sheet == "" {
+		lo.SheetWidth, lo.SheetHeight = needWidth, needHeight
+	} else {
+		size := imposeSheets[opts.Sheet]
+		switch {
+		case size[0] >= needWidth && size[1] >= needHeight:
+			lo.SheetWidth, lo.SheetHeight = size[0], size[1]
+		case size[1] >= needWidth && size[0] >= needHeight:
+			lo.SheetWidth, lo.SheetHeight = size[1], size[0]
+		default:
+			return lo, fmt.Errorf("%d-up pages of %.0fx%.0f points don't fit on %s", opts.NUp, pageWidth, pageHeight, opts.Sheet)
+		}
+	}
+	lo.X = (lo.SheetWidth - gridWidth) / 2
+	lo.Y = (lo.SheetHeight - gridHeight) / 2
+	return lo, nil
+}
+
+// cell is the lower left of cell k's page; cells go left to right then top to bottom
+func (lo imposeLayout) cell(k int, bleed float64) (x, y float64) {
+	col := k % lo.Cols
+	row := k / lo.Cols
+	x = lo.X + float64(col)*lo.CellWidth + bleed
+	y = lo.Y + float64(lo.Rows-1-row)*lo.CellHeight + bleed
+	return
+}
+
+// mirror is the cell behind cell k after the sheet is turned over side to side
+func (lo imposeLayout) mirror(k int) int {
+	col := k % lo.Cols
+	row := k / lo.Cols
+	return row*lo.Cols + lo.Cols - 1 - col
+}
+
+// imposeGroup is a ballot style's pages, as indexes from 0
+type imposeGroup struct {
+	Pages []int
+	Label string
+}
+
+// imposedSide is one side of a press sheet: a page index into all the
+// rendered pages for each cell, -1 for none
+type imposedSide struct {
+	Pages []int
+	Label string
+}
+
+// imposeSides lays each group of pages (a ballot style's, in order) out on
+// sheet sides of `cells` cells
+func imposeSides(groups []imposeGroup, opts imposeOptions, lo imposeLayout) (sides []imposedSide) {
+	cells := lo.Cols * lo.Rows
+	blank := func() []int {
+		out := make([]int, cells)
+		for i := range out {
+			out[i] = -1
+		}
+		return out
+	}
+	for _, g := range groups {
+		pages := g.Pages
+		if opts.Duplex && len(pages)%2 == 1 {
+			pages = append(pages, -1)
+		}
+		if opts.Booklet {
+			for len(pages)%4 != 0 {
+				pages = append(pages, -1)
+			}
+		}
+		sheet := 0
+		add := func(front, back []int) {
+			sheet++
+			label := fmt.Sprintf("%s sheet %d", g.Label, sheet)
+			if back == nil {
+				sides = append(sides, imposedSide{Pages: front, Label: label})
+				return
+			}
+			sides = append(sides, imposedSide{Pages: front, Label: label + " front"}, imposedSide{Pages: back, Label: label + " back"})
+		}
+		switch {
+		case opts.Booklet:
+			// the outside sheet has the last and first pages on its front
+			n := len(pages)
+			for s := 0; s < n/4; s++ {
+				add([]int{pages[n-1-2*s], pages[2*s]}, []int{pages[2*s+1], pages[n-2-2*s]})
+			}
+		case opts.Repeat:
+			step := 1
+			if opts.Duplex {
+				step = 2
+			}
+			for i := 0; i < len(pages); i += step {
+				front := blank()
+				for k := range front {
+					front[k] = pages[i]
+				}
+				var back []int
+				if opts.Duplex {
+					back = blank()
+					for k := range back {
+						back[k] = pages[i+1]
+					}
+				}
+				add(front, back)
+			}
+		case opts.Duplex:
+			for i := 0; i < len(pages); i += 2 * cells {
+				front, back := blank(), blank()
+				for k := 0; k < cells && i+2*k < len(pages); k++ {
+					front[k] = pages[i+2*k]
+					back[lo.mirror(k)] = pages[i+2*k+1]
+				}
+				add(front, back)
+			}
+		default:
+			for i := 0; i < len(pages); i += cells {
+				front := blank()
+				for k := 0; k < cells && i+k < len(pages); k++ {
+					front[k] = pages[i+k]
+				}
+				add(front, nil)
+			}
+		}
+	}
+	return
+}
+
+// imposeGroups is each ballot style's pages, or just style's if it's not -1
+func imposeGroups(bv *scan.BubblesV2, style, npages int) ([]imposeGroup, error) {
+	if len(bv.Styles) == 0 {
+		if style > 0 {
+			return nil, fmt.Errorf("no ballot style %d", style)
+		}
+		g := imposeGroup{Label: "style 0"}
+		for p := 0; p < npages; p++ {
+			g.Pages = append(g.Pages, p)
+		}
+		return []imposeGroup{g}, nil
+	}
+	var groups []imposeGroup
+	for si := range bv.Styles {
+		if style >= 0 && si != style {
+			continue
+		}
+		first, count, err := synth.StylePages(bv, si, npages)
+		if err != nil {
+			return nil, err
+		}
+		g := imposeGroup{Label: fmt.Sprintf("style %d", si)}
+		for p := first; p < first+count; p++ {
+			g.Pages = append(g.Pages, p-1)
+		}
+		groups = append(groups, g)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no ballot style %d", style)
+	}
+	return groups, nil
+}
+
+// imposePdf draws the sides as a PDF, each page image once however many
+// cells it's in
+func imposePdf(pngPages [][]byte, pageWidth, pageHeight float64, sides []imposedSide, lo imposeLayout, opts imposeOptions, slug string) ([]byte, error) {
+	var pw draw.PdfWriter
+	catalog := pw.Alloc()
+	pages := pw.Alloc()
+	font := pw.Alloc()
+	pw.Set(font, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	images := make(map[int]int)
+	var kids []string
+	for _, side := range sides {
+		var content bytes.Buffer
+		var xobjects []string
+		onSide := make(map[int]bool)
+		for k, p := range side.Pages {
+			if p < 0 {
+				continue
+			}
+			imobj, ok := images[p]
+			if !ok {
+				var err error
+				imobj, err = addPageImage(&pw, pngPages[p])
+				if err != nil {
+					return nil, fmt.Errorf("page %d, %v", p+1, err)
+				}
+				images[p] = imobj
+			}
+			if !onSide[p] {
+				onSide[p] = true
+				xobjects = append(xobjects, fmt.Sprintf("/P%d %d 0 R", p, imobj))
+			}
+			x, y := lo.cell(k, opts.Bleed)
+			fmt.Fprintf(&content, "q %.2f 0 0 %.2f %.2f %.2f cm /P%d Do Q\n", pageWidth, pageHeight, x, y, p)
+		}
+		if opts.Marks {
+			cropMarks(&content, lo, opts.Bleed)
+			fmt.Fprintf(&content, "BT /F1 6 Tf %.2f %.2f Td %s Tj ET\n", lo.X, lo.Y-cropMarkGap-cropMarkLength-8, draw.PdfLatin1String(slug+" "+side.Label))
+		}
+		contentObj := pw.Stream("", content.Bytes())
+		page := pw.Add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 %d 0 R >> /XObject << %s >> >> /Contents %d 0 R >>",
+			pages, lo.SheetWidth, lo.SheetHeight, font, strings.Join(xobjects, " "), contentObj))
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+	pw.Set(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	pw.Set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	return pw.Bytes(catalog), nil
+}
+
+// addPageImage adds a rendered page PNG as a JPEG image XObject
+func addPageImage(pw *draw.PdfWriter, pngb []byte) (int, error) {
+	im, _, err := image.Decode(bytes.NewReader(pngb))
+	if err != nil {
+		return 0, fmt.Errorf("png, %v", err)
+	}
+	var jb bytes.Buffer
+	err = jpeg.Encode(&jb, im, &jpeg.Options{Quality: 90})
+	if err != nil {
+		return 0, fmt.Errorf("jpeg, %v", err)
+	}
+	colorspace := "/DeviceRGB"
+	if _, ok := im.(*image.Gray); ok {
+		// jpeg.Encode writes one channel for these
+		colorspace = "/DeviceGray"
+	}
+	bounds := im.Bounds()
+	return pw.Stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode", bounds.Dx(), bounds.Dy(), colorspace), jb.Bytes()), nil
+}
+
+// cropMarks draws hairlines in the margin along each trim line
+func cropMarks(content *bytes.Buffer, lo imposeLayout, bleed float64) {
+	left := lo.X
+	right := lo.X + float64(lo.Cols)*lo.CellWidth
+	bottom := lo.Y
+	top := lo.Y + float64(lo.Rows)*lo.CellHeight
+	content.WriteString("q 0.25 w 0 G\n")
+	for col := 0; col < lo.Cols; col++ {
+		for _, x := range []float64{lo.X + float64(col)*lo.CellWidth + bleed, lo.X + float64(col+1)*lo.CellWidth - bleed} {
+			fmt.Fprintf(content, "%.2f %.2f m %.2f %.2f l S\n", x, bottom-cropMarkGap, x, bottom-cropMarkGap-cropMarkLength)
+			fmt.Fprintf(content, "%.2f %.2f m %.2f %.2f l S\n", x, top+cropMarkGap, x, top+cropMarkGap+cropMarkLength)
+		}
+	}
+	for row := 0; row < lo.Rows; row++ {
+		for _, y := range []float64{lo.Y + float64(row)*lo.CellHeight + bleed, lo.Y + float64(row+1)*lo.CellHeight - bleed} {
+			fmt.Fprintf(content, "%.2f %.2f m %.2f %.2f l S\n", left-cropMarkGap, y, left-cropMarkGap-cropMarkLength, y)
+			fmt.Fprintf(content, "%.2f %.2f m %.2f %.2f l S\n", right+cropMarkGap, y, right+cropMarkGap+cropMarkLength, y)
+		}
+	}
+	content.WriteString("Q\n")
+}
+
+// GET /election/{id}/print.pdf
+func (sh *StudioHandler) handleElectionImpose(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	if sh.printElection(w, user, electionid) == nil {
+		return
+	}
+	if sh.checkElectionState(w, electionid, actionFinal) {
+		return
+	}
+	opts, err := parseImposeOptions(r.URL.Query())
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	ms, err := sh.markSource(r.Context(), electionid, true)
+	if err != nil {
+		he := err.(*httpError)
+		if he.err == nil {
+			texterr(w, he.code, "%s", he.msg)
+		} else {
+			maybeerr(w, he.err, he.code, he.msg)
+		}
+		return
+	}
+	groups, err := imposeGroups(ms.bubbles, opts.Style, len(ms.pngs))
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	lo, err := layoutSheet(opts, ms.pageWidth, ms.pageHeight)
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	sides := imposeSides(groups, opts, lo)
+	pdf, err := imposePdf(ms.pngs, ms.pageWidth, ms.pageHeight, sides, lo, opts, fmt.Sprintf("election %d", electionid))
+	if maybeerr(w, err, 500, "impose, %v", err) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"election_%d_print.pdf\"", electionid))
+	w.Write(pdf)
+}
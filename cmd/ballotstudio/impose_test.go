@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestImposeOptions(t *testing.T) {
+	opts, err := parseImposeOptions(url.Values{"booklet": {"1"}, "bleed": {"9"}, "sheet": {"Tabloid"}})
+	if err != nil || opts.NUp != 2 || !opts.Duplex || opts.Bleed != 9 || opts.Sheet != "tabloid" || opts.Style != -1 {
+		t.Errorf("booklet %#v %v", opts, err)
+	}
+	for _, bad := range []string{"nup=3", "booklet=1&nup=4", "booklet=1&repeat=1", "bleed=40", "sheet=b5", "style=x"} {
+		query, _ := url.ParseQuery(bad)
+		if _, err := parseImposeOptions(query); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestImposeLayout(t *testing.T) {
+	// 2-up letter turns tabloid sideways, and needs a bigger sheet for bleed and marks
+	lo, err := layoutSheet(imposeOptions{NUp: 2, Sheet: "tabloid"}, 612, 792)
+	if err != nil || lo.SheetWidth != 1224 || lo.SheetHeight != 792 || lo.X != 0 {
+		t.Fatalf("tabloid %#v %v", lo, err)
+	}
+	if _, err := layoutSheet(imposeOptions{NUp: 2, Bleed: 9, Marks: true, Sheet: "tabloid"}, 612, 792); err == nil {
+		t.Errorf("2-up letter with marks fit on tabloid")
+	}
+	lo, err = layoutSheet(imposeOptions{NUp: 2, Bleed: 9, Marks: true, Sheet: "13x19"}, 612, 792)
+	if err != nil || lo.SheetWidth != 1368 || lo.X != 54 || lo.Y != 63 {
+		t.Fatalf("13x19 %#v %v", lo, err)
+	}
+	lo, err = layoutSheet(imposeOptions{NUp: 4, Bleed: 9}, 612, 792)
+	if err != nil || lo.SheetWidth != 2*630 || lo.SheetHeight != 2*810 {
+		t.Fatalf("4-up %#v %v", lo, err)
+	}
+	// cell 2 is bottom left
+	if x, y := lo.cell(2, 9); x != 9 || y != 9 {
+		t.Errorf("cell 2 at %g,%g", x, y)
+	}
+	if lo.mirror(0) != 1 || lo.mirror(3) != 2 {
+		t.Errorf("mirror %d %d", lo.mirror(0), lo.mirror(3))
+	}
+}
+
+func TestImposeSides(t *testing.T) {
+	groups := []imposeGroup{{Pages: []int{0, 1, 2, 3, 4}, Label: "style 0"}, {Pages: []int{5, 6}, Label: "style 1"}}
+	sidesString := func(opts imposeOptions) string {
+		lo, err := layoutSheet(opts, 612, 792)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		for _, side := range imposeSides(groups, opts, lo) {
+			fmt.Fprintf(&buf, "%v", side.Pages)
+		}
+		return buf.String()
+	}
+	for _, tc := range []struct {
+		opts imposeOptions
+		want string
+	}{
+		{imposeOptions{NUp: 2}, "[0 1][2 3][4 -1][5 6]"},
+		// page 1 backs page 0 on the right
+		{imposeOptions{NUp: 2, Duplex: true}, "[0 2][3 1][4 -1][-1 -1][5 -1][-1 6]"},
+		{imposeOptions{NUp: 2, Repeat: true, Duplex: true}, "[0 0][1 1][2 2][3 3][4 4][-1 -1][5 5][6 6]"},
+		// 5 pages pad to 8, two sheets; 2 pages pad to 4, one
+		{imposeOptions{NUp: 2, Duplex: true, Booklet: true}, "[-1 0][1 -1][-1 2][3 4][-1 5][6 -1]"},
+	} {
+		if got := sidesString(tc.opts); got != tc.want {
+			t.Errorf("%#v\n got %s\nwant %s", tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestImposePdf(t *testing.T) {
+	pngs := [][]byte{testPng(t, 85, 110), testPng(t, 85, 110)}
+	opts := imposeOptions{NUp: 4, Repeat: true, Marks: true, Bleed: 9}
+	lo, err := layoutSheet(opts, 612, 792)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sides := imposeSides([]imposeGroup{{Pages: []int{0, 1}, Label: "style 0"}}, opts, lo)
+	pdf, err := imposePdf(pngs, 612, 792, sides, lo, opts, "election 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each page image once, however many cells it fills
+	if n := bytes.Count(pdf, []byte("/Subtype /Image")); n != 2 {
+		t.Errorf("%d images", n)
+	}
+	if n := bytes.Count(pdf, []byte("/Type /Page ")); n != 2 {
+		t.Errorf("%d sheets", n)
+	}
+	for _, want := range []string{"/Count 2", "(election 3 style 0 sheet 2)", "/MediaBox [0 0 1332.00 1692.00]"} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("pdf has no %s", want)
+		}
+	}
+}
@@ -35,6 +35,8 @@ type inviteHandler struct {
 	udb login.UserDB
 
 	authmods []*login.OauthCallbackHandler
+	oidc     []*oidcProvider
+	saml     *samlProvider
 
 	//signupPage *template.Template
 	templates *TemplateSet
@@ -45,7 +47,7 @@ func (ih *inviteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	if !strings.HasPrefix(path, "/signup/") {
 		log.Printf("not signup path=%#v", path)
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
 		return
 	}
 	if r.Method == "POST" {
@@ -55,7 +57,7 @@ func (ih *inviteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ok, expires, err := ih.edb.PeekInviteToken(token)
 	if !ok {
 		log.Printf("token %#v %v %v %v", token, ok, expires, err)
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
 		return
 	}
 	now := time.Now()
@@ -74,7 +76,7 @@ func (ih *inviteHandler) handlePOST(w http.ResponseWriter, r *http.Request) {
 	cx, err := r.Cookie("i")
 	if err != nil || cx == nil {
 		log.Print("no invite cookie")
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
 		return
 	}
 	ok, expires, err := ih.edb.PeekInviteToken(cx.Value)
@@ -94,15 +96,31 @@ func (ih *inviteHandler) handlePOST(w http.ResponseWriter, r *http.Request) {
 		ih.renderSignup(w, r, ih.scm("password cannot be blank"))
 		return
 	}
+	// a provisioned staff member's invite, see staff.go
+	staff, err := ih.edb.StaffByInvite(cx.Value)
+	if err != nil {
+		log.Printf("invite staff lookup, %v", err)
+	}
 	newuser := login.User{}
 	newuser.Username = username
 	newuser.SetPassword(password)
-	_, err = ih.udb.PutNewUser(&newuser)
+	if staff != nil {
+		newuser.Email = staff.Email
+	}
+	created, err := ih.udb.PutNewUser(&newuser)
 	if err != nil {
 		texterr(w, 500, "error creating user, %v", err)
 		return
 	}
 	ih.edb.UseInviteToken(cx.Value)
+	if staff != nil && created != nil {
+		staff.UserId = created.Guid
+		staff.Invite = ""
+		err = ih.edb.PutStaff(*staff)
+		if err != nil {
+			log.Printf("staff %s user %d, %v", staff.Email, created.Guid, err)
+		}
+	}
 	// clear invite token
 	icookie := http.Cookie{
 		Name:   "i",
@@ -111,16 +129,20 @@ func (ih *inviteHandler) handlePOST(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &icookie)
 	// this should set a login cookie using the same form values
 	login.GetHttpUser(w, r, ih.udb)
-	http.Redirect(w, r, "/", http.StatusFound)
+	http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
 }
 
 type SignupContext struct {
 	Message  string
 	AuthMods []*login.OauthCallbackHandler
+	OIDC     []*oidcProvider
+	SAML     *samlProvider
+	CSRF     string
+	Base     string
 }
 
 func (ih *inviteHandler) scm(message string) SignupContext {
-	return SignupContext{message, ih.authmods}
+	return SignupContext{Message: message, AuthMods: ih.authmods, OIDC: ih.oidc, SAML: ih.saml}
 }
 
 func (ih *inviteHandler) renderSignup(w http.ResponseWriter, r *http.Request, ctx SignupContext) {
@@ -130,6 +152,8 @@ func (ih *inviteHandler) renderSignup(w http.ResponseWriter, r *http.Request, ct
 	if maybeerr(w, err, 500, "signup.html: %v", err) {
 		return
 	}
+	ctx.CSRF = csrfToken(r)
+	ctx.Base = basePath(r)
 	signupPage.Execute(w, ctx)
 }
 
@@ -149,13 +173,13 @@ func (riw *requireInviteWrapper) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	cx, err := r.Cookie("i")
 	if err != nil || cx == nil {
 		log.Print("no invite cookie")
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
 		return
 	}
 	ok, expires, err := riw.edb.PeekInviteToken(cx.Value)
 	if !ok {
 		log.Printf("invite token %v %v %v", ok, expires, err)
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
 		return
 	}
 	riw.sub.ServeHTTP(w, r)
@@ -171,12 +195,24 @@ type makeInviteTokenHandler struct {
 
 type tokenPageContext struct {
 	Token string
+	CSRF  string
+	Base  string
 }
 
 func (ih *makeInviteTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	user, _ := login.GetHttpUser(w, r, ih.udb)
+	user := httpUser(w, r, ih.udb, ih.edb)
 	if user == nil {
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
+		return
+	}
+	if r.Method != "POST" {
+		// a page with a button to POST back here, so a link can't make tokens
+		w.Header().Set("Content-Type", "text/html")
+		tokenpage, err := ih.templates.Lookup("invitetoken.html")
+		if maybeerr(w, err, 500, "invitetoken.html:%v", err) {
+			return
+		}
+		tokenpage.Execute(w, tokenPageContext{CSRF: csrfToken(r), Base: basePath(r)})
 		return
 	}
 	inviteToken := randomInviteToken(2)
@@ -190,5 +226,5 @@ func (ih *makeInviteTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	if maybeerr(w, err, 500, "invitetoken.html:%v", err) {
 		return
 	}
-	tokenpage.Execute(w, tokenPageContext{inviteToken})
+	tokenpage.Execute(w, tokenPageContext{Token: inviteToken, Base: basePath(r)})
 }
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Background jobs. Housekeeping that used to be spread over gcThread,
+// digestThread and webhookThread registers with a jobScheduler, which runs
+// each job every so often on its own goroutine, never two runs of the same
+// job at once, and keeps counts of how each has gone.
+//
+//	GET /admin/jobs          every job's stats, admins only
+//	GET /admin/jobs/{name}   one job's
+//	POST /admin/jobs/{name}  run it now and wait for it, 409 if it's already running
+//
+// A job returns a short result like "purged 3 elections" for the stats and log.
+// Jobs that delete or drop things also count how many in their stats, per
+// run and in total. How often they run and what they keep is a gcPolicy,
+// set by the -gc-* flags.
+
+// job names
+const (
+	jobInviteGC       = "invite-gc"
+	jobTrashPurge     = "trash-purge"
+	jobStaleDrafts    = "stale-drafts"
+	jobCachePrune     = "cache-prune"
+	jobDraftRevisions = "draft-revisions"
+	jobMediaOrphans   = "media-orphans"
+	jobDigests        = "digests"
+	jobWebhooks       = "webhooks"
+	jobWebhookHistory = "webhook-history"
+	jobPrintQueue     = "print-queue"
+)
+
+// renders not asked for in this long are dropped from the cache
+const cacheIdle = time.Hour
+
+// last good renders for when the draw backend is down are kept longer
+const staleCacheIdle = 7 * 24 * time.Hour
+
+// an uploaded image no election refers to is deleted after this, so there's
+// time to save the document that will use it
+const mediaOrphanAge = 24 * time.Hour
+
+// gcPolicy is how often housekeeping runs and what it keeps
+type gcPolicy struct {
+	// invite-gc, trash-purge, webhook-history and draft-revisions, 0 to not run them
+	Every time.Duration
+	// cache-prune, 0 to not run it
+	CacheEvery       time.Duration
+	CacheIdle        time.Duration
+	StaleCacheIdle   time.Duration
+	MediaOrphanAge   time.Duration
+	TrashRetention   time.Duration
+	WebhookRetention time.Duration
+	// 0 leaves drafts alone
+	StaleDraftAge time.Duration
+	// newest revisions a draft keeps, 0 keeps them all
+	DraftRevisions int64
+}
+
+func defaultGCPolicy() gcPolicy {
+	return gcPolicy{
+		Every:            57 * time.Minute,
+		CacheEvery:       10 * time.Minute,
+		CacheIdle:        cacheIdle,
+		StaleCacheIdle:   staleCacheIdle,
+		MediaOrphanAge:   mediaOrphanAge,
+		TrashRetention:   TrashRetention,
+		WebhookRetention: webhookDeliveryRetention,
+	}
+}
+
+var errJobRunning = errors.New("job is already running")
+
+type jobFunc func(ctx context.Context, now time.Time) (result string, err error)
+
+// gcFunc is a job that deletes or drops things, returning how many
+type gcFunc func(ctx context.Context, now time.Time) (reclaimed int64, result string, err error)
+
+// what GET /admin/jobs shows for a job
+type jobStats struct {
+	Name         string  `json:"name"`
+	Every        string  `json:"every"`
+	Running      bool    `json:"running"`
+	Runs         int     `json:"runs"`
+	Failures     int     `json:"failures"`
+	LastStart    int64   `json:"last_start,omitempty"` // unix seconds
+	LastSeconds  float64 `json:"last_seconds"`
+	TotalSeconds float64 `json:"total_seconds"`
+	LastResult   string  `json:"last_result,omitempty"`
+	LastError    string  `json:"last_error,omitempty"`
+	NextRun      int64   `json:"next_run"` // unix seconds
+	// things deleted or dropped by gc jobs, last run and all runs
+	LastReclaimed int64 `json:"last_reclaimed,omitempty"`
+	Reclaimed     int64 `json:"reclaimed,omitempty"`
+}
+
+type job struct {
+	every time.Duration
+	run   jobFunc
+	stats jobStats
+	next  time.Time
+}
+
+type jobScheduler struct {
+	l    sync.Mutex
+	jobs map[string]*job
+	wake chan string
+}
+
+func newJobScheduler() *jobScheduler {
+	return &jobScheduler{
+		jobs: make(map[string]*job),
+		wake: make(chan string, 10),
+	}
+}
+
+// register adds a job, first run `every` after the scheduler starts
+func (js *jobScheduler) register(name string, every time.Duration, run jobFunc) {
+	js.l.Lock()
+	defer js.l.Unlock()
+	js.jobs[name] = &job{every: every, run: run, stats: jobStats{Name: name, Every: every.String()}}
+}
+
+// registerGC adds a job that counts what it reclaims. every 0 doesn't add it.
+func (js *jobScheduler) registerGC(name string, every time.Duration, run gcFunc) {
+	if every <= 0 {
+		return
+	}
+	js.register(name, every, func(ctx context.Context, now time.Time) (string, error) {
+		reclaimed, result, err := run(ctx, now)
+		js.l.Lock()
+		defer js.l.Unlock()
+		j := js.jobs[name]
+		j.stats.LastReclaimed = reclaimed
+		j.stats.Reclaimed += reclaimed
+		return result, err
+	})
+}
+
+// Wake asks for a job to run soon rather than waiting for its time. It
+// doesn't block, and does nothing on a nil scheduler (as in tests).
+func (js *jobScheduler) Wake(name string) {
+	if js == nil {
+		return
+	}
+	select {
+	case js.wake <- name:
+	default:
+		// plenty of wakes already queued
+	}
+}
+
+// Stats lists every job's stats by name, or just name's if it's not ""
+func (js *jobScheduler) Stats(name string) []jobStats {
+	js.l.Lock()
+	defer js.l.Unlock()
+	out := []jobStats{}
+	for jn, j := range js.jobs {
+		if name == "" || name == jn {
+			out = append(out, j.stats)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// claim marks a job running, false if it already is or there's no such job
+func (js *jobScheduler) claim(name string, now time.Time) (*job, bool) {
+	js.l.Lock()
+	defer js.l.Unlock()
+	j := js.jobs[name]
+	if j == nil || j.stats.Running {
+		return j, false
+	}
+	j.stats.Running = true
+	j.stats.LastStart = now.Unix()
+	j.next = now.Add(j.every)
+	j.stats.NextRun = j.next.Unix()
+	return j, true
+}
+
+// runJob runs a claimed job and records how it went
+func (js *jobScheduler) runJob(ctx context.Context, name string, j *job, now time.Time) jobStats {
+	start := time.Now()
+	result, err := j.run(ctx, now)
+	took := time.Since(start)
+	js.l.Lock()
+	defer js.l.Unlock()
+	j.stats.Running = false
+	j.stats.Runs++
+	j.stats.LastSeconds = took.Seconds()
+	j.stats.TotalSeconds += took.Seconds()
+	j.stats.LastResult = result
+	j.stats.LastError = ""
+	if err != nil {
+		j.stats.Failures++
+		j.stats.LastError = err.Error()
+		log.Printf("job %s, %v", name, err)
+	} else if result != "" {
+		log.Printf("job %s: %s", name, result)
+	}
+	return j.stats
+}
+
+// RunNow runs a job and waits for it
+func (js *jobScheduler) RunNow(ctx context.Context, name string) (jobStats, error) {
+	j, ok := js.claim(name, time.Now())
+	if j == nil {
+		return jobStats{}, fmt.Errorf("no job %q", name)
+	}
+	if !ok {
+		return j.stats, errJobRunning
+	}
+	return js.runJob(ctx, name, j, time.Now()), nil
+}
+
+// start runs name in the background unless it's already running
+func (js *jobScheduler) start(ctx context.Context, name string, now time.Time) {
+	j, ok := js.claim(name, now)
+	if ok {
+		go js.runJob(ctx, name, j, now)
+	}
+}
+
+// Run starts jobs when they're due or woken until ctx is done
+func (js *jobScheduler) Run(ctx context.Context) {
+	js.l.Lock()
+	now := time.Now()
+	for _, j := range js.jobs {
+		j.next = now.Add(j.every)
+		j.stats.NextRun = j.next.Unix()
+	}
+	js.l.Unlock()
+	for true {
+		select {
+		case <-ctx.Done():
+			return
+		case name := <-js.wake:
+			js.start(ctx, name, time.Now())
+		case now := <-time.After(js.untilNext(time.Now())):
+			var due []string
+			js.l.Lock()
+			for name, j := range js.jobs {
+				if !now.Before(j.next) {
+					due = append(due, name)
+				}
+			}
+			js.l.Unlock()
+			for _, name := range due {
+				js.start(ctx, name, now)
+			}
+		}
+	}
+}
+
+// untilNext is how long until the next job is due, at most a minute
+func (js *jobScheduler) untilNext(now time.Time) time.Duration {
+	js.l.Lock()
+	defer js.l.Unlock()
+	wait := time.Minute
+	for _, j := range js.jobs {
+		if d := j.next.Sub(now); d < wait && !j.stats.Running {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// registerJobs sets up the server's housekeeping
+func (sh *StudioHandler) registerJobs(gc gcPolicy) {
+	sh.gc = gc
+	js := sh.jobs
+	js.registerGC(jobInviteGC, gc.Every, func(ctx context.Context, now time.Time) (int64, string, error) {
+		removed, err := sh.edb.GCInviteTokens()
+		if removed == 0 {
+			return 0, "", err
+		}
+		return removed, fmt.Sprintf("deleted %d expired invites", removed), err
+	})
+	js.registerGC(jobTrashPurge, gc.Every, func(ctx context.Context, now time.Time) (int64, string, error) {
+		purged, err := sh.edb.PurgeTrash(now.Add(-gc.TrashRetention))
+		if purged == 0 {
+			return 0, "", err
+		}
+		return purged, fmt.Sprintf("purged %d elections from the trash", purged), err
+	})
+	if gc.StaleDraftAge > 0 {
+		js.register(jobStaleDrafts, 24*time.Hour, func(ctx context.Context, now time.Time) (string, error) {
+			return sh.trashStaleDrafts(now, now.Add(-gc.StaleDraftAge))
+		})
+	}
+	if gc.DraftRevisions > 0 {
+		js.registerGC(jobDraftRevisions, gc.Every, func(ctx context.Context, now time.Time) (int64, string, error) {
+			return sh.pruneDraftRevisions(ctx, gc.DraftRevisions)
+		})
+	}
+	js.registerGC(jobCachePrune, gc.CacheEvery, func(ctx context.Context, now time.Time) (int64, string, error) {
+		return sh.pruneCaches(now, gc.CacheIdle, gc.StaleCacheIdle)
+	})
+	if fia, ok := sh.media.(*fileImageArchiver); ok {
+		js.registerGC(jobMediaOrphans, 24*time.Hour, func(ctx context.Context, now time.Time) (int64, string, error) {
+			keep, err := sh.mediaInUse(ctx)
+			if err != nil {
+				return 0, "", err
+			}
+			removed, err := fia.pruneMedia(keep, now.Add(-gc.MediaOrphanAge))
+			if removed == 0 {
+				return 0, "", err
+			}
+			return int64(removed), fmt.Sprintf("deleted %d unused media files", removed), err
+		})
+	}
+	js.register(jobDigests, 10*time.Minute, func(ctx context.Context, now time.Time) (string, error) {
+		sh.sendDueDigests(now)
+		return "", nil
+	})
+	js.register(jobWebhooks, time.Minute, func(ctx context.Context, now time.Time) (string, error) {
+		n := sh.deliverDueWebhooks(ctx, now)
+		if n == 0 {
+			return "", nil
+		}
+		return fmt.Sprintf("tried %d deliveries", n), nil
+	})
+	js.registerGC(jobWebhookHistory, gc.Every, func(ctx context.Context, now time.Time) (int64, string, error) {
+		purged, err := sh.edb.PurgeWebhookDeliveries(now.Add(-gc.WebhookRetention).Unix())
+		if purged == 0 {
+			return 0, "", err
+		}
+		return purged, fmt.Sprintf("deleted %d webhook deliveries", purged), err
+	})
+	js.register(jobPrintQueue, time.Minute, sh.printQueued)
+}
+
+// trashRetention is how long trashed elections are kept before trash-purge deletes them
+func (sh *StudioHandler) trashRetention() time.Duration {
+	if sh.gc.TrashRetention > 0 {
+		return sh.gc.TrashRetention
+	}
+	return TrashRetention
+}
+
+// pruneCaches drops renders not used since idle ago, last good renders not
+// used since staleIdle ago, and both for elections that no longer exist
+func (sh *StudioHandler) pruneCaches(now time.Time, idle, staleIdle time.Duration) (int64, string, error) {
+	n := sh.cache.Prune(now.Add(-idle))
+	ns := sh.stale.Prune(now.Add(-staleIdle))
+	eids, err := sh.edb.ElectionIds()
+	if err != nil {
+		return int64(n + ns), "", err
+	}
+	exists := make(map[int64]bool, len(eids))
+	for _, eid := range eids {
+		exists[eid] = true
+	}
+	orphan := func(key string) bool {
+		eid, ok := cacheKeyElection(key)
+		return ok && !exists[eid]
+	}
+	no := sh.cache.PruneKeys(orphan) + sh.stale.PruneKeys(orphan)
+	if n+ns+no == 0 {
+		return 0, "", nil
+	}
+	return int64(n + ns + no), fmt.Sprintf("dropped %d renders, %d last good renders and %d of deleted elections", n, ns, no), nil
+}
+
+// cacheKeyElection is the election number a render cache key starts with
+func cacheKeyElection(key string) (eid int64, ok bool) {
+	end := 0
+	for end < len(key) && key[end] >= '0' && key[end] <= '9' {
+		end++
+	}
+	eid, err := strconv.ParseInt(key[:end], 10, 64)
+	return eid, err == nil
+}
+
+// pruneDraftRevisions drops all but each draft's newest keep revisions.
+// Every save of a draft, autosaves included, adds one.
+func (sh *StudioHandler) pruneDraftRevisions(ctx context.Context, keep int64) (int64, string, error) {
+	eids, err := sh.edb.ElectionIds()
+	if err != nil {
+		return 0, "", err
+	}
+	var dropped int64
+	result := func() string {
+		if dropped == 0 {
+			return ""
+		}
+		return fmt.Sprintf("dropped %d draft revisions", dropped)
+	}
+	for _, eid := range eids {
+		if err := ctx.Err(); err != nil {
+			return dropped, result(), err
+		}
+		state, err := sh.edb.GetElectionState(eid)
+		if err != nil {
+			return dropped, result(), fmt.Errorf("election %d state, %v", eid, err)
+		}
+		if state != StateDraft {
+			continue
+		}
+		revs, err := sh.edb.ElectionRevisions(eid)
+		if err != nil {
+			return dropped, result(), fmt.Errorf("election %d revisions, %v", eid, err)
+		}
+		if int64(len(revs)) <= keep {
+			continue
+		}
+		err = sh.edb.PruneRevisions(eid, keep)
+		if err != nil {
+			return dropped, result(), err
+		}
+		dropped += int64(len(revs)) - keep
+	}
+	return dropped, result(), nil
+}
+
+// trashStaleDrafts moves drafts last saved before `before` to the trash,
+// where TrashRetention later purges them unless their owner restores them
+func (sh *StudioHandler) trashStaleDrafts(now, before time.Time) (string, error) {
+	ids, err := sh.edb.StaleDrafts(before)
+	if err != nil {
+		return "", err
+	}
+	for _, eid := range ids {
+		err = sh.edb.TrashElection(eid, now)
+		if err != nil {
+			return fmt.Sprintf("trashed %d stale drafts", len(ids)), err
+		}
+		sh.forgetElection(strconv.FormatInt(eid, 10))
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("trashed %d stale drafts", len(ids)), nil
+}
+
+// mediaInUse is every media id referred to by any election, trashed or not,
+// or any of their revisions
+func (sh *StudioHandler) mediaInUse(ctx context.Context) (map[string]bool, error) {
+	eids, err := sh.edb.ElectionIds()
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool)
+	note := func(data string) {
+		for _, m := range mediaRefAnyRe.FindAllStringSubmatch(data, -1) {
+			keep[m[1]] = true
+		}
+	}
+	for _, eid := range eids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		er, err := sh.edb.GetElection(eid)
+		if err != nil {
+			return nil, fmt.Errorf("election %d, %v", eid, err)
+		}
+		note(er.Data)
+		revs, err := sh.edb.ElectionRevisions(eid)
+		if err != nil {
+			return nil, fmt.Errorf("election %d revisions, %v", eid, err)
+		}
+		for _, rev := range revs {
+			rr, err := sh.edb.GetElectionRevision(eid, rev.Rev)
+			if err != nil {
+				return nil, fmt.Errorf("election %d revision %d, %v", eid, rev.Rev, err)
+			}
+			note(rr.Data)
+		}
+	}
+	return keep, nil
+}
+
+// GET /admin/jobs[/{name}], POST /admin/jobs/{name}, admins only
+func (sh *StudioHandler) handleJobs(w http.ResponseWriter, r *http.Request, user *login.User, name string) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	admin, err := sh.isAdmin(user)
+	if maybeerr(w, err, 500, "db staff") {
+		return
+	}
+	if !admin {
+		texterr(w, http.StatusForbidden, "admins only")
+		return
+	}
+	switch {
+	case r.Method == "GET":
+		stats := sh.jobs.Stats(name)
+		if name == "" {
+			writeJSON(w, stats)
+		} else if len(stats) == 0 {
+			texterr(w, 404, "no job %q", name)
+		} else {
+			writeJSON(w, stats[0])
+		}
+	case r.Method == "POST" && name != "":
+		if len(sh.jobs.Stats(name)) == 0 {
+			texterr(w, 404, "no job %q", name)
+			return
+		}
+		stats, err := sh.jobs.RunNow(r.Context(), name)
+		if err == errJobRunning {
+			texterr(w, http.StatusConflict, "job %s is already running", name)
+			return
+		}
+		if maybeerr(w, err, 500, "%v", err) {
+			return
+		}
+		log.Printf("job %s run by %s", name, user.Username)
+		writeJSON(w, stats)
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET /admin/jobs, POST /admin/jobs/{name}")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestJobScheduler(t *testing.T) {
+	js := newJobScheduler()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	js.register("slow", time.Hour, func(ctx context.Context, now time.Time) (string, error) {
+		started <- struct{}{}
+		<-release
+		return "done", nil
+	})
+	fail := true
+	js.register("flaky", time.Hour, func(ctx context.Context, now time.Time) (string, error) {
+		if fail {
+			return "", errors.New("oops")
+		}
+		return "", nil
+	})
+
+	st, err := js.RunNow(context.Background(), "flaky")
+	if err != nil || st.Runs != 1 || st.Failures != 1 || st.LastError != "oops" {
+		t.Errorf("flaky %#v %v", st, err)
+	}
+	fail = false
+	st, _ = js.RunNow(context.Background(), "flaky")
+	if st.Runs != 2 || st.Failures != 1 || st.LastError != "" {
+		t.Errorf("flaky again %#v", st)
+	}
+	if _, err = js.RunNow(context.Background(), "nope"); err == nil {
+		t.Errorf("ran a job that isn't there")
+	}
+
+	js.start(context.Background(), "slow", time.Now())
+	<-started
+	if _, err = js.RunNow(context.Background(), "slow"); err != errJobRunning {
+		t.Errorf("second run got %v", err)
+	}
+	if stats := js.Stats("slow"); len(stats) != 1 || !stats[0].Running {
+		t.Errorf("running %#v", stats)
+	}
+	close(release)
+	for js.Stats("slow")[0].Running {
+		time.Sleep(time.Millisecond)
+	}
+	if st := js.Stats("slow")[0]; st.Runs != 1 || st.LastResult != "done" {
+		t.Errorf("slow %#v", st)
+	}
+	if stats := js.Stats(""); len(stats) != 2 || stats[0].Name != "flaky" {
+		t.Errorf("all %#v", stats)
+	}
+
+	js.registerGC("gc", time.Hour, func(ctx context.Context, now time.Time) (int64, string, error) {
+		return 3, "dropped 3", nil
+	})
+	js.registerGC("off", 0, func(ctx context.Context, now time.Time) (int64, string, error) {
+		return 0, "", nil
+	})
+	js.RunNow(context.Background(), "gc")
+	st, _ = js.RunNow(context.Background(), "gc")
+	if st.LastReclaimed != 3 || st.Reclaimed != 6 || st.LastResult != "dropped 3" {
+		t.Errorf("gc %#v", st)
+	}
+	if len(js.Stats("off")) != 0 {
+		t.Errorf("registered a job with no interval")
+	}
+
+	var nilScheduler *jobScheduler
+	nilScheduler.Wake("slow")
+}
+
+func TestCachePrune(t *testing.T) {
+	c := Cache{MaxSize: 100}
+	c.Put("a", 1, 10)
+	c.Put("b", 2, 10)
+	c.Put("a?x=1", 3, 10)
+	c.Invalidate("b")
+	c.InvalidatePrefix("a?")
+	if n, size := c.Len(); n != 1 || size != 10 {
+		t.Errorf("after invalidate %d %d", n, size)
+	}
+	// over MaxSize drops the least recently used
+	c.Put("c", 4, 50)
+	c.Get("a")
+	c.Put("d", 5, 50)
+	if c.Get("c") != nil || c.Get("a") == nil || c.Get("d") == nil {
+		t.Errorf("eviction kept the wrong ones")
+	}
+	if n := c.Prune(time.Now().Add(-time.Minute)); n != 0 {
+		t.Errorf("pruned %d recently used", n)
+	}
+	if n := c.Prune(time.Now().Add(time.Minute)); n != 2 {
+		t.Errorf("pruned %d", n)
+	}
+	if n, size := c.Len(); n != 0 || size != 0 {
+		t.Errorf("after prune %d %d", n, size)
+	}
+}
+
+func TestStaleDrafts(t *testing.T) {
+	edb, db := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb}
+	old, err := edb.PutElection(electionRecord{Owner: 1, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+	recent, err := edb.PutElection(electionRecord{Owner: 1, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+	oldPublished, err := edb.PutElection(electionRecord{Owner: 1, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+	_, err = edb.SetElectionState(oldPublished, StateDraft, StatePublished)
+	mtfail(t, err, "state, %v", err)
+	longAgo := time.Now().Add(-200 * 24 * time.Hour)
+	_, err = db.Exec(`UPDATE election_revisions SET created = $1 WHERE election <> $2`, longAgo.Unix(), recent)
+	mtfail(t, err, "backdate, %v", err)
+
+	now := time.Now()
+	result, err := sh.trashStaleDrafts(now, now.Add(-180*24*time.Hour))
+	if err != nil || result != "trashed 1 stale drafts" {
+		t.Errorf("got %q %v", result, err)
+	}
+	for eid, trashed := range map[int64]bool{old: true, recent: false, oldPublished: false} {
+		er, _ := edb.GetElection(eid)
+		if (er.Trashed != 0) != trashed {
+			t.Errorf("election %d trashed %d", eid, er.Trashed)
+		}
+	}
+}
+
+func TestPruneCaches(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb}
+	eid, err := edb.PutElection(electionRecord{Owner: 1, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+	el := strconv.FormatInt(eid, 10)
+	gone := strconv.FormatInt(eid+1, 10)
+	sh.cache.Put(renderKey(el, `{}`, draw.RenderOptions{}), 1, 10)
+	sh.cache.Put(renderKey(gone, `{}`, draw.RenderOptions{}), 2, 10)
+	sh.cache.Put(gone+"_results", 3, 10)
+	sh.stale.Put(gone+"_pamphlet.pdf", 4, 10)
+	sh.stale.Put(el, 5, 10)
+
+	reclaimed, result, err := sh.pruneCaches(time.Now(), time.Hour, time.Hour)
+	if err != nil || reclaimed != 3 || result != "dropped 0 renders, 0 last good renders and 3 of deleted elections" {
+		t.Errorf("got %d %q %v", reclaimed, result, err)
+	}
+	if n, _ := sh.cache.Len(); n != 1 {
+		t.Errorf("cache has %d", n)
+	}
+	if sh.stale.Get(el) == nil {
+		t.Errorf("dropped a last good render of an election that's there")
+	}
+	if eid, ok := cacheKeyElection("nope"); ok {
+		t.Errorf("key election %d", eid)
+	}
+}
+
+func TestPruneDraftRevisions(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb}
+	draft, err := edb.PutElection(electionRecord{Owner: 1, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+	published, err := edb.PutElection(electionRecord{Owner: 1, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+	// saves of unchanged data don't add a revision
+	for i := 1; i <= 4; i++ {
+		data := fmt.Sprintf(`{"v": %d}`, i)
+		_, err = edb.PutElection(electionRecord{Id: draft, Owner: 1, Data: data})
+		mtfail(t, err, "put, %v", err)
+		_, err = edb.PutElection(electionRecord{Id: published, Owner: 1, Data: data})
+		mtfail(t, err, "put, %v", err)
+	}
+	_, err = edb.SetElectionState(published, StateDraft, StatePublished)
+	mtfail(t, err, "state, %v", err)
+
+	dropped, result, err := sh.pruneDraftRevisions(context.Background(), 2)
+	if err != nil || dropped != 3 || result != "dropped 3 draft revisions" {
+		t.Errorf("got %d %q %v", dropped, result, err)
+	}
+	for eid, want := range map[int64]int{draft: 2, published: 5} {
+		revs, _ := edb.ElectionRevisions(eid)
+		if len(revs) != want {
+			t.Errorf("election %d has %d revisions", eid, len(revs))
+		}
+	}
+}
+
+func TestPruneMedia(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media")
+	mtfail(t, err, "tempdir, %v", err)
+	defer os.RemoveAll(dir)
+	fia := &fileImageArchiver{path: dir}
+	used, err := fia.PutMedia([]byte("used"), "image/png")
+	mtfail(t, err, "put, %v", err)
+	unused, err := fia.PutMedia([]byte("unused"), "image/png")
+	mtfail(t, err, "put, %v", err)
+	fresh, err := fia.PutMedia([]byte("fresh"), "image/png")
+	mtfail(t, err, "put, %v", err)
+	mdir := filepath.Join(dir, "media")
+	err = ioutil.WriteFile(filepath.Join(mdir, "tmp123"), []byte("partial"), 0644)
+	mtfail(t, err, "tmp, %v", err)
+	longAgo := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{used, unused, "tmp123"} {
+		os.Chtimes(filepath.Join(mdir, name), longAgo, longAgo)
+	}
+
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, media: fia}
+	// referred to only by an earlier revision
+	eid, err := edb.PutElection(electionRecord{Owner: 1, Data: `{"Party": [{"LogoUri": "/election/1/media/` + used + `"}]}`})
+	mtfail(t, err, "put, %v", err)
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 1, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+
+	keep, err := sh.mediaInUse(context.Background())
+	mtfail(t, err, "in use, %v", err)
+	removed, err := fia.pruneMedia(keep, time.Now().Add(-mediaOrphanAge))
+	if err != nil || removed != 2 {
+		t.Errorf("removed %d, %v", removed, err)
+	}
+	for name, want := range map[string]bool{used: true, unused: false, fresh: true, "tmp123": false} {
+		_, err := os.Stat(filepath.Join(mdir, name))
+		if (err == nil) != want {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestHandleJobs(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, jobs: newJobScheduler(), admins: map[string]bool{"root": true}}
+	sh.registerJobs(defaultGCPolicy())
+	root := &login.User{Guid: 1, Username: "root"}
+	do := func(user *login.User, method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		m := jobsPathRe.FindStringSubmatch(path)
+		sh.handleJobs(rec, httptest.NewRequest(method, path, nil), user, m[1])
+		return rec
+	}
+	if rec := do(&login.User{Guid: 2, Username: "bob"}, "GET", "/admin/jobs"); rec.Code != 403 {
+		t.Errorf("not admin %d", rec.Code)
+	}
+	rec := do(root, "GET", "/admin/jobs")
+	var stats []jobStats
+	json.Unmarshal(rec.Body.Bytes(), &stats)
+	if rec.Code != 200 || len(stats) != 7 {
+		t.Errorf("list %d %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), jobStaleDrafts) {
+		t.Errorf("stale drafts job without -stale-draft-age")
+	}
+	rec = do(root, "POST", "/admin/jobs/trash-purge")
+	var st jobStats
+	json.Unmarshal(rec.Body.Bytes(), &st)
+	if rec.Code != 200 || st.Runs != 1 || st.Running {
+		t.Errorf("run %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(root, "POST", "/admin/jobs/no-such-job"); rec.Code != 404 {
+		t.Errorf("no such job %d", rec.Code)
+	}
+	if rec := do(root, "POST", "/admin/jobs"); rec.Code != 405 {
+		t.Errorf("post all %d", rec.Code)
+	}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/login/login"
+)
+
+// Contest library: contests and candidates that come back election after
+// election (judicial retention questions, a standing office, a long-serving
+// incumbent) are kept once and inserted into elections by reference. The
+// copy in an election carries "LibraryId", the entry's id, and when the
+// entry is edited every draft election with a copy gets the new version.
+//
+//	GET /library                        every entry, ?kind=contest or candidate
+//	POST /library                       {"name": ..., "data": {...}}, a new entry
+//	GET /library/{id}
+//	PUT /library/{id}                   {"name": ..., "data": {...}}, owner or admin, updates draft elections
+//	DELETE /library/{id}                owner or admin, copies in elections stay as they are, returns the rest
+//	POST /election/{id}/library/{entry} insert a copy, ?district={gpunit} for a contest, election owner only
+//
+// An entry's data is {"Contest": {...}, "Candidate": [...]}, a contest and
+// the candidates its selections name, or {"Candidate": [{...}]}, one
+// candidate. A copy's @id is "lib{id}" (then "lib{id}.2" and so on), and its
+// selections' and candidates' are that, '-' and their @id in the entry, so
+// the same entry can go in twice and doesn't collide with the election's own
+// ids. Other references (PartyId, PersonId, OfficeIds) are copied as they
+// are; the election should have those.
+//
+// An update keeps each copy's @id, ElectionDistrictId and SequenceOrder, and
+// ballot styles' selection order for the selections still there. Elections
+// past draft keep the version they were proofed with and are reported as
+// skipped.
+
+const (
+	libraryContest   = "contest"
+	libraryCandidate = "candidate"
+)
+
+// largest library entry accepted
+const maxLibraryEntryBytes = 1000000
+
+// a copy keeps these of its own when its entry is updated
+var libraryLocalFields = []string{"ElectionDistrictId", "SequenceOrder"}
+
+type libraryEntry struct {
+	Id      int64           `json:"id"`
+	Owner   int64           `json:"owner"`
+	Kind    string          `json:"kind"` // libraryContest or libraryCandidate
+	Name    string          `json:"name"`
+	Data    json.RawMessage `json:"data"`
+	Updated int64           `json:"updated"` // unix seconds
+}
+
+// POST /library and PUT /library/{id} body
+type libraryRequest struct {
+	// Name is how the entry is listed, default the contest or candidate's name
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+}
+
+// PUT /library/{id} response
+type libraryUpdateJSON struct {
+	Entry libraryEntry `json:"entry"`
+	// Updated are the elections given the new version
+	Updated []int64 `json:"updated"`
+	// Skipped are elections with copies that are past draft, or that were
+	// saved by someone else while being updated
+	Skipped []librarySkip `json:"skipped,omitempty"`
+}
+
+type librarySkip struct {
+	ElectionId int64  `json:"itemid"`
+	State      string `json:"state"`
+	// Conflict is set if it was saved by someone else while being updated
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+// POST /election/{id}/library/{entry} response
+type libraryInsertJSON struct {
+	EditContext
+	// Id is the @id of the copy
+	Id string `json:"id"`
+}
+
+type libraryData struct {
+	Contest   map[string]interface{}   `json:"Contest,omitempty"`
+	Candidate []map[string]interface{} `json:"Candidate,omitempty"`
+}
+
+func ifaceStrings(v interface{}) (out []string) {
+	list, _ := v.([]interface{})
+	for _, x := range list {
+		if s, ok := x.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return
+}
+
+// parseLibraryData checks an entry's data and says which kind of entry it is
+func parseLibraryData(raw []byte) (ld libraryData, kind string, err error) {
+	err = json.Unmarshal(raw, &ld)
+	if err != nil {
+		return ld, "", fmt.Errorf("bad library data, %v", err)
+	}
+	candidates := make(map[string]bool, len(ld.Candidate))
+	for _, cand := range ld.Candidate {
+		id, _ := cand["@id"].(string)
+		if id == "" || candidates[id] {
+			return ld, "", fmt.Errorf("every Candidate needs its own @id")
+		}
+		candidates[id] = true
+	}
+	if ld.Contest == nil {
+		if len(ld.Candidate) != 1 {
+			return ld, "", fmt.Errorf("want a Contest, or one Candidate")
+		}
+		return ld, libraryCandidate, nil
+	}
+	if t, _ := ld.Contest["@type"].(string); !strings.HasSuffix(t, "Contest") {
+		return ld, "", fmt.Errorf("Contest @type %q isn't a contest", t)
+	}
+	for _, sel := range mapList(ld.Contest["ContestSelection"]) {
+		id, _ := sel["@id"].(string)
+		if id == "" {
+			return ld, "", fmt.Errorf("every ContestSelection needs an @id")
+		}
+		for _, cid := range ifaceStrings(sel["CandidateIds"]) {
+			if !candidates[cid] {
+				return ld, "", fmt.Errorf("selection %s names candidate %s, which isn't in the entry", id, cid)
+			}
+		}
+	}
+	// a RetentionContest's judge
+	if cid, ok := ld.Contest["CandidateId"].(string); ok && !candidates[cid] {
+		return ld, "", fmt.Errorf("contest names candidate %s, which isn't in the entry", cid)
+	}
+	return ld, libraryContest, nil
+}
+
+// libraryName is an entry's default name
+func (ld libraryData) libraryName() string {
+	if ld.Contest != nil {
+		if name := docString(ld.Contest["Name"]); name != "" {
+			return name
+		}
+		return docString(ld.Contest["BallotTitle"])
+	}
+	if len(ld.Candidate) != 0 {
+		return docString(ld.Candidate[0]["BallotName"])
+	}
+	return ""
+}
+
+// libraryCopy is a fresh copy of le with @id prefix, see above: the contest
+// (nil for a candidate entry) and the candidates
+func libraryCopy(le libraryEntry, prefix string) (contest map[string]interface{}, candidates []interface{}, err error) {
+	ld, _, err := parseLibraryData(le.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	local := func(id string) string {
+		return prefix + "-" + id
+	}
+	if ld.Contest == nil {
+		cand := ld.Candidate[0]
+		cand["@id"] = prefix
+		cand["LibraryId"] = le.Id
+		return nil, []interface{}{cand}, nil
+	}
+	contest = ld.Contest
+	contest["@id"] = prefix
+	contest["LibraryId"] = le.Id
+	for _, sel := range mapList(contest["ContestSelection"]) {
+		sel["@id"] = local(sel["@id"].(string))
+		if cids := ifaceStrings(sel["CandidateIds"]); cids != nil {
+			ids := make([]interface{}, len(cids))
+			for i, cid := range cids {
+				ids[i] = local(cid)
+			}
+			sel["CandidateIds"] = ids
+		}
+	}
+	if cid, ok := contest["CandidateId"].(string); ok {
+		contest["CandidateId"] = local(cid)
+	}
+	for _, cand := range ld.Candidate {
+		cand["@id"] = local(cand["@id"].(string))
+		cand["LibraryId"] = le.Id
+		candidates = append(candidates, cand)
+	}
+	return contest, candidates, nil
+}
+
+// libraryIdOf is the LibraryId of a copy, 0 for anything else
+func libraryIdOf(ob map[string]interface{}) int64 {
+	switch v := ob["LibraryId"].(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	}
+	return 0
+}
+
+// docIds collects every @id in v
+func docIds(v interface{}, ids map[string]bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if id, ok := x["@id"].(string); ok {
+			ids[id] = true
+		}
+		for _, sub := range x {
+			docIds(sub, ids)
+		}
+	case []interface{}:
+		for _, sub := range x {
+			docIds(sub, ids)
+		}
+	}
+}
+
+// insertLibraryEntry adds a copy of le to the document's first Election,
+// a contest in district if that isn't "". Returns the copy's @id.
+func insertLibraryEntry(doc map[string]interface{}, le libraryEntry, district string) (string, error) {
+	els := mapList(doc["Election"])
+	if len(els) == 0 {
+		return "", fmt.Errorf("no Election to put it in")
+	}
+	el := els[0]
+	taken := make(map[string]bool)
+	docIds(doc, taken)
+	prefix := fmt.Sprintf("lib%d", le.Id)
+	for n := 2; libraryPrefixTaken(taken, prefix); n++ {
+		prefix = fmt.Sprintf("lib%d.%d", le.Id, n)
+	}
+	contest, candidates, err := libraryCopy(le, prefix)
+	if err != nil {
+		return "", err
+	}
+	if contest != nil {
+		if district != "" {
+			contest["ElectionDistrictId"] = district
+		}
+		contests, _ := el["Contest"].([]interface{})
+		el["Contest"] = append(contests, contest)
+	}
+	cands, _ := el["Candidate"].([]interface{})
+	el["Candidate"] = append(cands, candidates...)
+	return prefix, nil
+}
+
+func libraryPrefixTaken(taken map[string]bool, prefix string) bool {
+	if taken[prefix] {
+		return true
+	}
+	for id := range taken {
+		if strings.HasPrefix(id, prefix+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// updateLibraryCopies replaces the document's copies of le with its current
+// version, returning how many there were
+func updateLibraryCopies(doc map[string]interface{}, le libraryEntry) (copies int, err error) {
+	for _, el := range mapList(doc["Election"]) {
+		contests, _ := el["Contest"].([]interface{})
+		candidates, _ := el["Candidate"].([]interface{})
+		if le.Kind == libraryCandidate {
+			for i, x := range candidates {
+				cand, ok := x.(map[string]interface{})
+				if !ok || libraryIdOf(cand) != le.Id {
+					continue
+				}
+				_, fresh, err := libraryCopy(le, cand["@id"].(string))
+				if err != nil {
+					return copies, err
+				}
+				candidates[i] = fresh[0]
+				copies++
+			}
+			continue
+		}
+		for i, x := range contests {
+			co, ok := x.(map[string]interface{})
+			if !ok || libraryIdOf(co) != le.Id {
+				continue
+			}
+			prefix, _ := co["@id"].(string)
+			fresh, cands, err := libraryCopy(le, prefix)
+			if err != nil {
+				return copies, err
+			}
+			for _, k := range libraryLocalFields {
+				if v, ok := co[k]; ok {
+					fresh[k] = v
+				}
+			}
+			contests[i] = fresh
+			var kept []interface{}
+			for _, y := range candidates {
+				cand, ok := y.(map[string]interface{})
+				if ok && libraryIdOf(cand) == le.Id && strings.HasPrefix(fmt.Sprint(cand["@id"]), prefix+"-") {
+					continue
+				}
+				kept = append(kept, y)
+			}
+			candidates = append(kept, cands...)
+			keepSelectionOrder(el, fresh)
+			copies++
+		}
+		el["Candidate"] = candidates
+	}
+	return copies, nil
+}
+
+// keepSelectionOrder fixes ballot styles' OrderedContestSelectionIds for
+// contest co's selections: ones that are gone are dropped, new ones go last
+func keepSelectionOrder(el, co map[string]interface{}) {
+	var sels []string
+	have := make(map[string]bool)
+	for _, sel := range mapList(co["ContestSelection"]) {
+		id, _ := sel["@id"].(string)
+		sels = append(sels, id)
+		have[id] = true
+	}
+	for _, bs := range mapList(el["BallotStyle"]) {
+		for _, oc := range mapList(bs["OrderedContent"]) {
+			order, ok := oc["OrderedContestSelectionIds"].([]interface{})
+			if !ok || oc["ContestId"] != co["@id"] {
+				continue
+			}
+			out := []interface{}{}
+			listed := make(map[string]bool)
+			for _, x := range order {
+				id, _ := x.(string)
+				if have[id] && !listed[id] {
+					out = append(out, id)
+					listed[id] = true
+				}
+			}
+			for _, id := range sels {
+				if !listed[id] {
+					out = append(out, id)
+				}
+			}
+			oc["OrderedContestSelectionIds"] = out
+		}
+	}
+}
+
+// updateLibraryElections gives every draft election with a copy of le its
+// current version, saved as a new revision the way an edit is
+func (sh *StudioHandler) updateLibraryElections(le libraryEntry) (updated []int64, skipped []librarySkip, err error) {
+	eids, err := sh.edb.LibraryElections(le.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, eid := range eids {
+		er, err := sh.edb.GetElection(eid)
+		if err != nil {
+			log.Printf("library %d: election %d, %v", le.Id, eid, err)
+			continue
+		}
+		if er.Trashed != 0 {
+			continue
+		}
+		var doc map[string]interface{}
+		err = json.Unmarshal([]byte(er.Data), &doc)
+		if err != nil {
+			log.Printf("library %d: election %d json, %v", le.Id, eid, err)
+			continue
+		}
+		before, _ := json.Marshal(doc)
+		copies, err := updateLibraryCopies(doc, le)
+		if err != nil {
+			return updated, skipped, err
+		}
+		after, err := json.Marshal(doc)
+		if err != nil {
+			return updated, skipped, err
+		}
+		if copies == 0 || bytes.Equal(before, after) {
+			continue
+		}
+		state, err := sh.edb.GetElectionState(eid)
+		if err != nil {
+			return updated, skipped, err
+		}
+		if !stateAllows(state, actionEdit) {
+			skipped = append(skipped, librarySkip{ElectionId: eid, State: state})
+			continue
+		}
+		after, _, err = sh.checkElectionDoc(doc, eid)
+		if err != nil {
+			return updated, skipped, fmt.Errorf("election %d, %v", eid, err)
+		}
+		_, err = sh.saveElectionDoc(sh.electionOwner(er.Owner), er, after, map[string]interface{}{"library": le.Id})
+		if he, ok := err.(*httpError); ok && he.code == http.StatusConflict {
+			// edited meanwhile, its owner gets the new version on the entry's next update
+			skipped = append(skipped, librarySkip{ElectionId: eid, State: state, Conflict: true})
+			continue
+		} else if err != nil {
+			return updated, skipped, fmt.Errorf("election %d, %v", eid, err)
+		}
+		updated = append(updated, eid)
+	}
+	return updated, skipped, nil
+}
+
+// electionOwner looks up an election owner for their revisions quota, only
+// the Guid is set if the login database can't look users up
+func (sh *StudioHandler) electionOwner(guid int64) *login.User {
+	if ug, ok := sh.udb.(userGetter); ok {
+		user, err := ug.GetUser(guid)
+		if err == nil && user != nil {
+			return user
+		}
+	}
+	return &login.User{Guid: guid}
+}
+
+// readLibraryRequest reads a POST or PUT body into le, writing an error and
+// returning false if it's no good
+func readLibraryRequest(w http.ResponseWriter, r *http.Request, le *libraryEntry) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLibraryEntryBytes))
+	if err != nil {
+		texterr(w, http.StatusRequestEntityTooLarge, "library entry too large or broken, limit %d bytes", maxLibraryEntryBytes)
+		return false
+	}
+	var req libraryRequest
+	err = json.Unmarshal(body, &req)
+	if maybeerr(w, err, 400, "bad library json") {
+		return false
+	}
+	ld, kind, err := parseLibraryData(req.Data)
+	if maybeerr(w, err, 400, "%v", err) {
+		return false
+	}
+	if le.Kind != "" && kind != le.Kind {
+		texterr(w, 400, "entry %d is a %s, it can't become a %s", le.Id, le.Kind, kind)
+		return false
+	}
+	var compact bytes.Buffer
+	err = json.Compact(&compact, req.Data)
+	if maybeerr(w, err, 400, "bad library data") {
+		return false
+	}
+	le.Kind = kind
+	le.Name = strings.TrimSpace(req.Name)
+	if le.Name == "" {
+		le.Name = ld.libraryName()
+	}
+	if le.Name == "" {
+		texterr(w, 400, "the entry needs a name")
+		return false
+	}
+	le.Data = compact.Bytes()
+	le.Updated = time.Now().Unix()
+	return true
+}
+
+// handler of /library and /library/{id}, signed in users
+func (sh *StudioHandler) handleLibrary(w http.ResponseWriter, r *http.Request, user *login.User, entryid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	if entryid == 0 {
+		switch r.Method {
+		case "GET":
+			entries, err := sh.edb.LibraryEntries()
+			if maybeerr(w, err, 500, "db library, %v", err) {
+				return
+			}
+			kind := r.URL.Query().Get("kind")
+			out := []libraryEntry{}
+			for _, le := range entries {
+				if kind == "" || le.Kind == kind {
+					out = append(out, le)
+				}
+			}
+			writeJSON(w, out)
+		case "POST":
+			le := libraryEntry{Owner: user.Guid}
+			if !readLibraryRequest(w, r, &le) {
+				return
+			}
+			var err error
+			le.Id, err = sh.edb.PutLibraryEntry(le)
+			if maybeerr(w, err, 500, "db library put, %v", err) {
+				return
+			}
+			writeJSON(w, le)
+		default:
+			texterr(w, http.StatusMethodNotAllowed, "GET or POST only")
+		}
+		return
+	}
+	le, err := sh.edb.GetLibraryEntry(entryid)
+	if maybeerr(w, err, 500, "db library, %v", err) {
+		return
+	}
+	if le == nil {
+		texterr(w, 404, "no library entry %d", entryid)
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, le)
+		return
+	}
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		texterr(w, http.StatusMethodNotAllowed, "GET, PUT or DELETE only")
+		return
+	}
+	admin, err := sh.isAdmin(user)
+	if maybeerr(w, err, 500, "db staff, %v", err) {
+		return
+	}
+	if le.Owner != user.Guid && !admin {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	if r.Method == "DELETE" {
+		err = sh.edb.DeleteLibraryEntry(entryid)
+		if maybeerr(w, err, 500, "db library delete, %v", err) {
+			return
+		}
+		entries, err := sh.edb.LibraryEntries()
+		if maybeerr(w, err, 500, "db library, %v", err) {
+			return
+		}
+		if entries == nil {
+			entries = []libraryEntry{}
+		}
+		writeJSON(w, entries)
+		return
+	}
+	if !readLibraryRequest(w, r, le) {
+		return
+	}
+	_, err = sh.edb.PutLibraryEntry(*le)
+	if maybeerr(w, err, 500, "db library put, %v", err) {
+		return
+	}
+	out := libraryUpdateJSON{Entry: *le, Updated: []int64{}}
+	updated, skipped, err := sh.updateLibraryElections(*le)
+	if maybeerr(w, err, 500, "library %d saved, updating elections failed, %v", entryid, err) {
+		return
+	}
+	if updated != nil {
+		out.Updated = updated
+	}
+	out.Skipped = skipped
+	writeJSON(w, out)
+}
+
+// POST /election/{id}/library/{entry}[?district={gpunit}]
+// adds a copy of a library entry to the election, owner only
+func (sh *StudioHandler) handleElectionLibraryInsert(w http.ResponseWriter, r *http.Request, user *login.User, electionid, entryid int64) {
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	le, err := sh.edb.GetLibraryEntry(entryid)
+	if maybeerr(w, err, 500, "db library, %v", err) {
+		return
+	}
+	if le == nil {
+		texterr(w, 404, "no library entry %d", entryid)
+		return
+	}
+	district := r.URL.Query().Get("district")
+	if district != "" && le.Kind != libraryContest {
+		texterr(w, 400, "district is for contests, entry %d is a %s", entryid, le.Kind)
+		return
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if maybeerr(w, err, 500, "bad election json, %v", err) {
+		return
+	}
+	id, err := insertLibraryEntry(doc, *le, district)
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	nbody, err := json.Marshal(doc)
+	if maybeerr(w, err, 500, "json prep") {
+		return
+	}
+	sh.handleElectionDocPOSTJson(w, r, user, electionid, nbody, func(w http.ResponseWriter, r *http.Request, newid int64, issues []data.RuleIssue) {
+		out := libraryInsertJSON{Id: id}
+		out.set(r, newid)
+		for _, issue := range issues {
+			if issue.Severity == data.IssueError {
+				out.Errors = append(out.Errors, issue)
+			} else {
+				out.Warnings = append(out.Warnings, issue)
+			}
+		}
+		writeJSON(w, out)
+	})
+}
+
+// libraryEntryColumns follow the id in library queries
+const libraryEntryColumns = `owner, kind, name, data, updated`
+
+// common to all backends, query selects id and libraryEntryColumns
+func queryLibraryEntries(db sqlDB, query string) (out []libraryEntry, err error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("library, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var le libraryEntry
+		var leData string
+		err = rows.Scan(&le.Id, &le.Owner, &le.Kind, &le.Name, &leData, &le.Updated)
+		if err != nil {
+			return nil, fmt.Errorf("library row, %v", err)
+		}
+		le.Data = json.RawMessage(leData)
+		out = append(out, le)
+	}
+	return out, rows.Err()
+}
+
+// getLibraryEntry returns nil if there's no such entry. Common to all
+// backends, query selects id and libraryEntryColumns.
+func getLibraryEntry(db sqlDB, query string, id int64) (*libraryEntry, error) {
+	var le libraryEntry
+	var leData string
+	err := db.QueryRow(query, id).Scan(&le.Id, &le.Owner, &le.Kind, &le.Name, &leData, &le.Updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("library entry, %v", err)
+	}
+	le.Data = json.RawMessage(leData)
+	return &le, nil
+}
+
+// libraryElections finds the elections not in the trash with a copy of
+// entry id. Documents are saved compact, so the id is followed by , or }.
+// Common to all backends, param is "$" for numbered placeholders or "?".
+func libraryElections(db sqlDB, param, idcol string, id int64) (ids []int64, err error) {
+	query := fmt.Sprintf(`SELECT %s FROM elections WHERE trashed IS NULL AND (data LIKE $1 OR data LIKE $2) ORDER BY %s`, idcol, idcol)
+	if param == "?" {
+		query = fmt.Sprintf(`SELECT %s FROM elections WHERE trashed IS NULL AND (data LIKE ? OR data LIKE ?) ORDER BY %s`, idcol, idcol)
+	}
+	mark := fmt.Sprintf(`%%"LibraryId":%d`, id)
+	rows, err := db.Query(query, mark+",%", mark+"}%")
+	if err != nil {
+		return nil, fmt.Errorf("library elections, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eid int64
+		err = rows.Scan(&eid)
+		if err != nil {
+			return nil, fmt.Errorf("library elections row, %v", err)
+		}
+		ids = append(ids, eid)
+	}
+	return ids, rows.Err()
+}
+
+// updateLibraryEntry saves an entry's name and data. Common to all
+// backends, param is "$" for numbered placeholders or "?".
+func updateLibraryEntry(db sqlDB, param, idcol string, le libraryEntry) error {
+	query := fmt.Sprintf(`UPDATE library_entries SET name = $1, data = $2, updated = $3 WHERE %s = $4`, idcol)
+	if param == "?" {
+		query = fmt.Sprintf(`UPDATE library_entries SET name = ?, data = ?, updated = ? WHERE %s = ?`, idcol)
+	}
+	_, err := db.Exec(query, le.Name, string(le.Data), le.Updated, le.Id)
+	if err != nil {
+		return fmt.Errorf("library entry update, %v", err)
+	}
+	return nil
+}
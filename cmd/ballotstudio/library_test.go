@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+const testLibraryRetention = `{
+  "Contest": {"@id": "k", "@type": "ElectionResults.RetentionContest", "Name": "Retain Judge Ito", "CandidateId": "judge",
+    "ContestSelection": [
+      {"@id": "yes", "@type": "ElectionResults.BallotMeasureSelection", "Selection": "Yes"},
+      {"@id": "no", "@type": "ElectionResults.BallotMeasureSelection", "Selection": "No"}
+    ]},
+  "Candidate": [{"@id": "judge", "@type": "ElectionResults.Candidate", "BallotName": "Lance Ito"}]
+}`
+
+func TestParseLibraryData(t *testing.T) {
+	ld, kind, err := parseLibraryData([]byte(testLibraryRetention))
+	if err != nil || kind != libraryContest || ld.libraryName() != "Retain Judge Ito" {
+		t.Errorf("retention %s %q %v", kind, ld.libraryName(), err)
+	}
+	_, kind, err = parseLibraryData([]byte(`{"Candidate": [{"@id": "c", "BallotName": "Ann"}]}`))
+	if err != nil || kind != libraryCandidate {
+		t.Errorf("candidate %s %v", kind, err)
+	}
+	for _, bad := range []string{
+		`{}`,
+		`{"Candidate": [{"@id": "a"}, {"@id": "b"}]}`,
+		`{"Contest": {"@type": "ElectionResults.Candidate"}}`,
+		`{"Contest": {"@type": "ElectionResults.CandidateContest", "ContestSelection": [{"@id": "s", "CandidateIds": ["elsewhere"]}]}}`,
+		`{"Contest": {"@type": "ElectionResults.CandidateContest", "ContestSelection": [{"Selection": "Yes"}]}}`,
+	} {
+		if _, _, err := parseLibraryData([]byte(bad)); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestLibraryCopies(t *testing.T) {
+	le := libraryEntry{Id: 12, Kind: libraryContest, Data: json.RawMessage(testLibraryRetention)}
+	var doc map[string]interface{}
+	err := json.Unmarshal([]byte(`{"Election": [{"Contest": [{"@id": "lib12", "Name": "not from the library"}]}]}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := insertLibraryEntry(doc, le, "gp-county")
+	if err != nil || id != "lib12.2" {
+		t.Fatalf("insert %q %v", id, err)
+	}
+	id, err = insertLibraryEntry(doc, le, "")
+	if err != nil || id != "lib12.3" {
+		t.Fatalf("second insert %q %v", id, err)
+	}
+	el := doc["Election"].([]interface{})[0].(map[string]interface{})
+	el["BallotStyle"] = []interface{}{map[string]interface{}{"OrderedContent": []interface{}{
+		map[string]interface{}{"ContestId": "lib12.2", "OrderedContestSelectionIds": []interface{}{"lib12.2-no", "lib12.2-yes"}},
+	}}}
+	blob, _ := json.Marshal(doc)
+	for _, want := range []string{`"CandidateId":"lib12.2-judge"`, `"@id":"lib12.3-yes"`, `"ElectionDistrictId":"gp-county"`, `"LibraryId":12`} {
+		if !strings.Contains(string(blob), want) {
+			t.Errorf("inserted doc has no %s", want)
+		}
+	}
+
+	// the judge retires; the new entry asks about a different one, with an abstain option
+	le.Data = json.RawMessage(strings.NewReplacer("Ito", "Ng", `"no"`, `"against"`).Replace(testLibraryRetention))
+	var ld map[string]interface{}
+	json.Unmarshal(le.Data, &ld)
+	contest := ld["Contest"].(map[string]interface{})
+	contest["ContestSelection"] = append(contest["ContestSelection"].([]interface{}), map[string]interface{}{"@id": "abstain", "Selection": "Abstain"})
+	le.Data, _ = json.Marshal(ld)
+	copies, err := updateLibraryCopies(doc, le)
+	if err != nil || copies != 2 {
+		t.Fatalf("update %d %v", copies, err)
+	}
+	contests := el["Contest"].([]interface{})
+	if len(contests) != 3 || contests[0].(map[string]interface{})["Name"] != "not from the library" {
+		t.Errorf("contests %v", contests)
+	}
+	updated := contests[1].(map[string]interface{})
+	if updated["Name"] != "Retain Judge Ng" || updated["ElectionDistrictId"] != "gp-county" {
+		t.Errorf("updated %v", updated)
+	}
+	if cands := el["Candidate"].([]interface{}); len(cands) != 2 || cands[0].(map[string]interface{})["BallotName"] != "Lance Ng" {
+		t.Errorf("candidates %v", cands)
+	}
+	order := el["BallotStyle"].([]interface{})[0].(map[string]interface{})["OrderedContent"].([]interface{})[0].(map[string]interface{})["OrderedContestSelectionIds"]
+	if got, _ := json.Marshal(order); string(got) != `["lib12.2-yes","lib12.2-against","lib12.2-abstain"]` {
+		t.Errorf("selection order %s", got)
+	}
+
+	cand := libraryEntry{Id: 3, Kind: libraryCandidate, Data: json.RawMessage(`{"Candidate": [{"@id": "c", "BallotName": "Ann"}]}`)}
+	if id, err = insertLibraryEntry(doc, cand, ""); err != nil || id != "lib3" {
+		t.Fatalf("candidate insert %q %v", id, err)
+	}
+	cand.Data = json.RawMessage(`{"Candidate": [{"@id": "c", "BallotName": "Ann Marie"}]}`)
+	if copies, err = updateLibraryCopies(doc, cand); err != nil || copies != 1 {
+		t.Fatalf("candidate update %d %v", copies, err)
+	}
+	blob, _ = json.Marshal(el["Candidate"])
+	if !strings.Contains(string(blob), `{"@id":"lib3","BallotName":"Ann Marie","LibraryId":3}`) {
+		t.Errorf("candidate update %s", blob)
+	}
+}
+
+func TestLibraryHandlers(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, quotas: quotaLimits{Revisions: 2}}
+	ann := &login.User{Guid: 1, Username: "ann"}
+	bo := &login.User{Guid: 2, Username: "bo"}
+
+	library := func(user *login.User, method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		var entryid int64
+		if m := libraryPathRe.FindStringSubmatch(path); m != nil && m[1] != "" {
+			entryid, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+		sh.handleLibrary(rec, httptest.NewRequest(method, path, strings.NewReader(body)), user, entryid)
+		return rec
+	}
+	if rec := library(nil, "GET", "/library", ""); rec.Code != 401 {
+		t.Errorf("anonymous list %d", rec.Code)
+	}
+	rec := library(ann, "POST", "/library", `{"data": `+testLibraryRetention+`}`)
+	var le libraryEntry
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &le) != nil || le.Id == 0 || le.Kind != libraryContest || le.Name != "Retain Judge Ito" {
+		t.Fatalf("post %d %s", rec.Code, rec.Body.String())
+	}
+
+	var eids []int64
+	for i := 0; i < 2; i++ {
+		eid, err := edb.PutElection(electionRecord{Owner: 2, Data: `{"Election": [{"Name": "General"}]}`})
+		mtfail(t, err, "put election, %v", err)
+		rec = httptest.NewRecorder()
+		path := fmt.Sprintf("/election/%d/library/%d?district=gp1", eid, le.Id)
+		sh.handleElectionLibraryInsert(rec, httptest.NewRequest("POST", path, nil), bo, eid, le.Id)
+		var out libraryInsertJSON
+		if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &out) != nil || out.Id != fmt.Sprintf("lib%d", le.Id) {
+			t.Fatalf("insert %d %s", rec.Code, rec.Body.String())
+		}
+		eids = append(eids, eid)
+	}
+	_, err := edb.SetElectionState(eids[1], StateDraft, StateProofing)
+	mtfail(t, err, "state, %v", err)
+
+	path := fmt.Sprintf("/library/%d", le.Id)
+	newer := `{"data": ` + strings.Replace(testLibraryRetention, "Ito", "Ng", -1) + `}`
+	if rec = library(bo, "PUT", path, newer); rec.Code != 403 {
+		t.Errorf("not the owner's put %d", rec.Code)
+	}
+	if rec = library(ann, "PUT", path, `{"data": {"Candidate": [{"@id": "c"}]}}`); rec.Code != 400 {
+		t.Errorf("contest to candidate %d", rec.Code)
+	}
+	rec = library(ann, "PUT", path, newer)
+	var up libraryUpdateJSON
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &up) != nil {
+		t.Fatalf("put %d %s", rec.Code, rec.Body.String())
+	}
+	if len(up.Updated) != 1 || up.Updated[0] != eids[0] || len(up.Skipped) != 1 || up.Skipped[0].State != StateProofing {
+		t.Errorf("update %#v", up)
+	}
+	for i, want := range []string{"Retain Judge Ng", "Retain Judge Ito"} {
+		er, err := edb.GetElection(eids[i])
+		mtfail(t, err, "get election, %v", err)
+		if !strings.Contains(er.Data, want) || !strings.Contains(er.Data, `"ElectionDistrictId":"gp1"`) {
+			t.Errorf("election %d %s", eids[i], er.Data)
+		}
+	}
+	// saved like an edit, pruned to bo's quota
+	revs, err := edb.ElectionRevisions(eids[0])
+	mtfail(t, err, "revisions, %v", err)
+	if len(revs) != 2 || revs[1].Rev != 3 {
+		t.Errorf("revisions %#v", revs)
+	}
+
+	if rec = library(ann, "DELETE", path, ""); rec.Code != 200 || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("delete %d %s", rec.Code, rec.Body.String())
+	}
+	if rec = library(ann, "GET", path, ""); rec.Code != 404 {
+		t.Errorf("deleted entry %d", rec.Code)
+	}
+}
+
+func TestLibraryElections(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	var eids []int64
+	for _, data := range []string{
+		`{"Election":[{"Contest":[{"@id":"lib1","LibraryId":1}]}]}`,
+		`{"Election":[{"Candidate":[{"@id":"lib12","LibraryId":12}]}]}`,
+		`{"Election":[{"Contest":[{"@id":"lib1","LibraryId":1,"Name":"x"}]}]}`,
+		`{"Election":[{"Contest":[{"@id":"lib1","LibraryId":1}]}]}`,
+	} {
+		eid, err := edb.PutElection(electionRecord{Owner: 1, Data: data})
+		mtfail(t, err, "put election, %v", err)
+		eids = append(eids, eid)
+	}
+	err := edb.TrashElection(eids[3], time.Now())
+	mtfail(t, err, "trash, %v", err)
+	got, err := edb.LibraryElections(1)
+	mtfail(t, err, "library elections, %v", err)
+	if len(got) != 2 || got[0] != eids[0] || got[1] != eids[2] {
+		t.Errorf("library 1 elections %v of %v", got, eids)
+	}
+
+	er, err := edb.GetElection(eids[0])
+	mtfail(t, err, "get election, %v", err)
+	ok, err := edb.PutElectionIf(electionRecord{Id: eids[0], Data: `{"Election":[{"Name":"mine"}]}`}, er.Data)
+	if err != nil || !ok {
+		t.Fatalf("put if unchanged %v %v", ok, err)
+	}
+	ok, err = edb.PutElectionIf(electionRecord{Id: eids[0], Data: `{"Election":[{"Name":"theirs"}]}`}, er.Data)
+	if err != nil || ok {
+		t.Errorf("put if changed %v %v", ok, err)
+	}
+	er, err = edb.GetElection(eids[0])
+	mtfail(t, err, "get election, %v", err)
+	if er.Data != `{"Election":[{"Name":"mine"}]}` || er.Owner != 1 {
+		t.Errorf("after put if %#v", er)
+	}
+}
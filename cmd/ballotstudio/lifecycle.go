@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/brianolson/login/login"
+)
+
+// Election lifecycle states
+const (
+	StateDraft     = "draft"
+	StateProofing  = "proofing"
+	StateApproved  = "approved"
+	StatePublished = "published"
+	StateArchived  = "archived"
+	// frozen for certification, only an admin can unlock it
+	StateLocked = "locked"
+)
+
+// allowed transitions, from -> []to
+var stateTransitions = map[string][]string{
+	StateDraft:     {StateProofing, StateArchived},
+	StateProofing:  {StateDraft, StateApproved},
+	StateApproved:  {StateDraft, StatePublished, StateLocked},
+	StatePublished: {StateArchived, StateLocked},
+	StateArchived:  {},
+	StateLocked:    {StateApproved, StatePublished},
+}
+
+// transitions only an admin may make, reopening an approved design
+var adminTransitions = map[string][]string{
+	StateApproved: {StateDraft},
+	StateLocked:   {StateApproved, StatePublished},
+}
+
+// things that depend on lifecycle state
+const (
+	actionEdit     = "edit"
+	actionScan     = "scan"
+	actionFinal    = "render final ballots"
+	actionClone    = "clone"
+	actionSettings = "change settings"
+	actionAnnotate = "annotate"
+	actionTrash    = "move to the trash"
+	actionSample   = "show a sample ballot"
+)
+
+// which states allow an action
+var stateActions = map[string][]string{
+	actionEdit:     {StateDraft},
+	actionScan:     {StateDraft, StateProofing, StateApproved, StatePublished, StateLocked},
+	actionFinal:    {StateApproved, StatePublished, StateLocked},
+	actionClone:    {StatePublished},
+	actionSettings: {StateDraft, StateProofing, StatePublished},
+	actionAnnotate: {StateDraft, StateProofing},
+	actionTrash:    {StateDraft, StateProofing, StatePublished, StateArchived},
+	actionSample:   {StatePublished, StateLocked},
+}
+
+func validState(state string) bool {
+	_, ok := stateTransitions[state]
+	return ok
+}
+
+func canTransition(from, to string) bool {
+	for _, x := range stateTransitions[from] {
+		if x == to {
+			return true
+		}
+	}
+	return false
+}
+
+func adminTransition(from, to string) bool {
+	for _, x := range adminTransitions[from] {
+		if x == to {
+			return true
+		}
+	}
+	return false
+}
+
+func stateAllows(state, action string) bool {
+	for _, x := range stateActions[action] {
+		if x == state {
+			return true
+		}
+	}
+	return false
+}
+
+// checkElectionState writes a 409 and returns true if the election's state does not allow action
+func (sh *StudioHandler) checkElectionState(w http.ResponseWriter, electionid int64, action string) bool {
+	state, err := sh.edb.GetElectionState(electionid)
+	if maybeerr(w, err, 500, "db state, %v", err) {
+		return true
+	}
+	if !stateAllows(state, action) {
+		texterr(w, http.StatusConflict, "election is %s, cannot %s", state, action)
+		return true
+	}
+	return false
+}
+
+type electionStateJSON struct {
+	ElectionId int64    `json:"itemid"`
+	State      string   `json:"state"`
+	Next       []string `json:"next"`
+	AdminOnly  []string `json:"admin_only,omitempty"` // those of next only an admin may choose
+}
+
+// GET|POST /election/{id}/state
+// POST body is the new state, as text or {"state":"..."}, by the owner or an admin
+func (sh *StudioHandler) handleElectionState(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if r.Method == "POST" {
+		if user == nil {
+			texterr(w, http.StatusUnauthorized, "nope")
+			return
+		}
+		admin, err := sh.isAdmin(user)
+		if maybeerr(w, err, 500, "db staff, %v", err) {
+			return
+		}
+		if er.Owner != user.Guid && !admin {
+			texterr(w, http.StatusForbidden, "nope")
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		var req electionStateJSON
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			err = json.Unmarshal(body, &req)
+			if maybeerr(w, err, 400, "bad json") {
+				return
+			}
+		} else {
+			req.State = strings.TrimSpace(string(body))
+		}
+		if !validState(req.State) {
+			texterr(w, 400, "unknown state %#v", req.State)
+			return
+		}
+		from, err := sh.edb.GetElectionState(electionid)
+		if maybeerr(w, err, 500, "db state, %v", err) {
+			return
+		}
+		if !canTransition(from, req.State) {
+			texterr(w, http.StatusConflict, "cannot go from %s to %s", from, req.State)
+			return
+		}
+		if adminTransition(from, req.State) && !admin {
+			texterr(w, http.StatusForbidden, "only an admin can go from %s to %s", from, req.State)
+			return
+		}
+		if req.State == StatePublished {
+			rr, err := sh.electionReadiness(r.Context(), electionid, false)
+			if err != nil {
+				he := err.(*httpError)
+				maybeerr(w, he.err, he.code, he.msg)
+				return
+			}
+			if rr.Status == readyFail {
+				var failed []string
+				for _, item := range rr.Items {
+					if item.Status == readyFail {
+						failed = append(failed, item.Check+": "+item.Message)
+					}
+				}
+				texterr(w, http.StatusConflict, "not ready to publish\n%s", strings.Join(failed, "\n"))
+				return
+			}
+		}
+		ok, err := sh.edb.SetElectionState(electionid, from, req.State)
+		if maybeerr(w, err, 500, "db state, %v", err) {
+			return
+		}
+		if !ok {
+			texterr(w, http.StatusConflict, "state changed during request, try again")
+			return
+		}
+		if req.State == StatePublished {
+			sh.fireWebhooks(webhookPublish, electionid, map[string]interface{}{"from": from})
+		}
+		sh.writeElectionState(w, electionid, req.State)
+		return
+	}
+	state, err := sh.edb.GetElectionState(electionid)
+	if maybeerr(w, err, 500, "db state, %v", err) {
+		return
+	}
+	sh.writeElectionState(w, electionid, state)
+}
+
+func (sh *StudioHandler) writeElectionState(w http.ResponseWriter, electionid int64, state string) {
+	out, err := json.Marshal(electionStateJSON{
+		ElectionId: electionid,
+		State:      state,
+		Next:       stateTransitions[state],
+		AdminOnly:  adminTransitions[state],
+	})
+	if maybeerr(w, err, 500, "json ret prep") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(out)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestStateTransitions(t *testing.T) {
+	for from, tos := range stateTransitions {
+		for _, to := range tos {
+			if !validState(to) {
+				t.Errorf("%s -> unknown state %s", from, to)
+			}
+		}
+	}
+	if !canTransition(StateDraft, StateProofing) {
+		t.Errorf("draft should go to proofing")
+	}
+	if canTransition(StateDraft, StatePublished) {
+		t.Errorf("draft should not skip to published")
+	}
+	if canTransition(StateArchived, StateDraft) {
+		t.Errorf("archived should be final")
+	}
+	if !stateAllows(StateDraft, actionEdit) || stateAllows(StatePublished, actionEdit) {
+		t.Errorf("edit should only be allowed in draft")
+	}
+	if stateAllows(StateArchived, actionScan) {
+		t.Errorf("archived should not take scans")
+	}
+	for _, state := range []string{StateApproved, StateLocked} {
+		for _, action := range []string{actionEdit, actionSettings, actionAnnotate, actionTrash} {
+			if stateAllows(state, action) {
+				t.Errorf("%s should not allow %s", state, action)
+			}
+		}
+	}
+	for from, tos := range adminTransitions {
+		for _, to := range tos {
+			if !canTransition(from, to) {
+				t.Errorf("admin transition %s -> %s isn't a transition", from, to)
+			}
+		}
+	}
+}
+
+func TestLockedElection(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, admins: map[string]bool{"root": true}}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: `{}`})
+	mtfail(t, err, "put election, %v", err)
+	owner := &login.User{Guid: 7, Username: "ann"}
+	admin := &login.User{Guid: 1, Username: "root"}
+	other := &login.User{Guid: 8, Username: "bob"}
+	setState := func(user *login.User, to string) int {
+		rec := httptest.NewRecorder()
+		sh.handleElectionState(rec, httptest.NewRequest("POST", "/election/1/state", strings.NewReader(to)), user, eid)
+		return rec.Code
+	}
+	for _, to := range []string{StateProofing, StateApproved} {
+		if code := setState(owner, to); code != 200 {
+			t.Fatalf("-> %s %d", to, code)
+		}
+	}
+	if code := setState(owner, StateDraft); code != http.StatusForbidden {
+		t.Errorf("owner reopened approved, %d", code)
+	}
+	rec := httptest.NewRecorder()
+	sh.handleElectionTemplate(rec, httptest.NewRequest("POST", "/election/1/template", strings.NewReader("true")), owner, eid)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("settings changed while approved, %d", rec.Code)
+	}
+	if code := setState(owner, StateLocked); code != 200 {
+		t.Fatalf("lock %d", code)
+	}
+	rec = httptest.NewRecorder()
+	sh.handleElectionDelete(rec, httptest.NewRequest("DELETE", "/election/1", nil), owner, eid)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("trashed while locked, %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	sh.handleElectionState(rec, httptest.NewRequest("GET", "/election/1/state", nil), nil, eid)
+	if !strings.Contains(rec.Body.String(), `"admin_only":["approved","published"]`) {
+		t.Errorf("state %s", rec.Body.String())
+	}
+	for _, user := range []*login.User{owner, other} {
+		if code := setState(user, StateApproved); code != http.StatusForbidden {
+			t.Errorf("%s unlocked, %d", user.Username, code)
+		}
+	}
+	if code := setState(admin, StateApproved); code != 200 {
+		t.Errorf("admin unlock %d", code)
+	}
+	if code := setState(admin, StateDraft); code != 200 {
+		t.Errorf("admin reopen %d", code)
+	}
+}
+
+func TestFinalRender(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}, drawClient: &draw.Client{}}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: `{}`})
+	mtfail(t, err, "put election, %v", err)
+	el := strconv.FormatInt(eid, 10)
+
+	try := func(query string) int {
+		q, _ := url.ParseQuery(query)
+		rec := httptest.NewRecorder()
+		if _, ok := sh.renderQueryOptions(rec, q, el); ok {
+			return 200
+		}
+		return rec.Code
+	}
+	if code := try("proof=1"); code != 200 {
+		t.Errorf("draft proof %d", code)
+	}
+	if code := try("final=1"); code != http.StatusConflict {
+		t.Errorf("draft final %d", code)
+	}
+	for _, to := range []string{StateProofing, StateApproved, StatePublished} {
+		from, _ := edb.GetElectionState(eid)
+		ok, err := edb.SetElectionState(eid, from, to)
+		if !ok || err != nil {
+			t.Fatalf("%s -> %s, %v", from, to, err)
+		}
+		code := try("final=1")
+		if to == StateProofing && code != http.StatusConflict {
+			t.Errorf("proofing final %d", code)
+		} else if to != StateProofing && code != 200 {
+			t.Errorf("%s final %d", to, code)
+		}
+	}
+	if code := try("final=1&proof=1"); code != 400 {
+		t.Errorf("final proof %d", code)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listen opens the server's TCP listener. With reusePort, SO_REUSEPORT is set
+// so a new server process can bind the same address while the old one drains.
+func listen(addr string, reusePort bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenFDsStart is the first socket systemd passes, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// listeners are the sockets systemd passed this process (see
+// systemd.socket(5)) if it was started by socket activation, and otherwise
+// new listeners on addrs, a comma separated list of -http addresses.
+func listeners(addrs string, reusePort bool) ([]net.Listener, error) {
+	lns, err := activatedListeners(os.Getenv, os.Getpid(), listenFDsStart)
+	if err != nil || len(lns) != 0 {
+		return lns, err
+	}
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		ln, err := listen(addr, reusePort)
+		if err != nil {
+			closeListeners(lns)
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// activatedListeners are the LISTEN_FDS sockets from firstFD on, if
+// LISTEN_PID is pid. The variables are unset so programs this one runs
+// don't think the sockets are theirs.
+func activatedListeners(getenv func(string) string, pid int, firstFD int) ([]net.Listener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS=%#v", getenv("LISTEN_FDS"))
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	lns := make([]net.Listener, 0, nfds)
+	for fd := firstFD; fd < firstFD+nfds; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener has its own copy of the descriptor
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(lns)
+			return nil, fmt.Errorf("socket activation fd %d, %w", fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+// serverTuning is how long the server waits on clients and how much
+// header it reads, so a slow or idle client can't hold a connection open
+// for good. 0 durations are no limit.
+type serverTuning struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration // whole request, body included
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration // between requests on a keep-alive connection
+	MaxHeaderBytes    int
+
+	// HTTP2 is offered to TLS clients, see serve
+	HTTP2 bool
+}
+
+func (st serverTuning) apply(server *http.Server) {
+	server.ReadHeaderTimeout = st.ReadHeaderTimeout
+	server.ReadTimeout = st.ReadTimeout
+	server.WriteTimeout = st.WriteTimeout
+	server.IdleTimeout = st.IdleTimeout
+	server.MaxHeaderBytes = st.MaxHeaderBytes
+	if !st.HTTP2 {
+		// a non-nil map keeps net/http from setting up HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+}
+
+// serve runs server on each of lns, with TLS if certFile is set, until one
+// fails or the server is shut down. Under TLS, net/http negotiates HTTP/2
+// with clients that offer it, unless turned off by serverTuning.HTTP2.
+func serve(server *http.Server, lns []net.Listener, certFile, keyFile string) error {
+	if certFile != "" && server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			if certFile == "" {
+				errs <- server.Serve(ln)
+			} else {
+				errs <- server.ServeTLS(ln, certFile, keyFile)
+			}
+		}(ln)
+	}
+	for range lns {
+		if err := <-errs; err != http.ErrServerClosed {
+			return err
+		}
+	}
+	return http.ErrServerClosed
+}
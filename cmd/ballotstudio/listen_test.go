@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned writes a certificate for 127.0.0.1 and its key into dir
+func selfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mtfail(t, err, "key, %v", err)
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	mtfail(t, err, "cert, %v", err)
+	kb, err := x509.MarshalECPrivateKey(key)
+	mtfail(t, err, "marshal key, %v", err)
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	mtfail(t, err, "write cert, %v", err)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	mtfail(t, err, "write key, %v", err)
+	return
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile := selfSigned(t, t.TempDir())
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	for _, http2 := range []bool{true, false} {
+		tuning := serverTuning{ReadHeaderTimeout: time.Second, IdleTimeout: time.Second, MaxHeaderBytes: 4 << 10, HTTP2: http2}
+		server := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		})}
+		tuning.apply(&server)
+		if server.ReadHeaderTimeout != time.Second || server.MaxHeaderBytes != 4<<10 {
+			t.Errorf("tuning not applied, %v %d", server.ReadHeaderTimeout, server.MaxHeaderBytes)
+		}
+		ln, err := listen("127.0.0.1:0", false)
+		mtfail(t, err, "listen, %v", err)
+		go serve(&server, []net.Listener{ln}, certFile, keyFile)
+
+		resp, err := client.Get("https://" + ln.Addr().String() + "/")
+		mtfail(t, err, "get, %v", err)
+		proto, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := "HTTP/1.1"
+		if http2 {
+			want = "HTTP/2.0"
+		}
+		if string(proto) != want {
+			t.Errorf("http2=%v served %s", http2, proto)
+		}
+		// past MaxHeaderBytes (plus net/http's slack) is refused
+		req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+"/", nil)
+		req.Header.Set("X-Big", strings.Repeat("x", 16<<10))
+		if resp, err = client.Do(req); err == nil {
+			if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+				t.Errorf("http2=%v big header got %s", http2, resp.Status)
+			}
+			resp.Body.Close()
+		}
+		server.Close()
+	}
+}
+
+func TestListeners(t *testing.T) {
+	lns, err := listeners("127.0.0.1:0, 127.0.0.1:0", false)
+	mtfail(t, err, "listeners, %v", err)
+	defer closeListeners(lns)
+	if len(lns) != 2 {
+		t.Fatalf("%d listeners for 2 addresses", len(lns))
+	}
+	server := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	done := make(chan error, 1)
+	go func() { done <- serve(&server, lns, "", "") }()
+	for _, ln := range lns {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		mtfail(t, err, "get %s, %v", ln.Addr(), err)
+		resp.Body.Close()
+	}
+	server.Close()
+	if err = <-done; err != http.ErrServerClosed {
+		t.Errorf("serve returned %v", err)
+	}
+}
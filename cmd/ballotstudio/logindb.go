@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/brianolson/login/login"
+)
+
+// Login data (users, oauth links) can be kept apart from election data with
+// -login-db scheme:connect, e.g. "postgres:host=logins dbname=users" or
+// "sqlite:users.sqlite". Sessions are encrypted cookies (-cookie-key), so any
+// number of web servers sharing a cookie key and a login db can serve the same users.
+
+// userDBOpeners maps a -login-db scheme to a function that opens it.
+// Only sql stores the login package can query are here; MySQL isn't one, its
+// placeholders differ. A non-sql store would need its own login.UserDB.
+var userDBOpeners = map[string]func(connect string) (login.UserDB, io.Closer, error){
+	"sqlite":   sqlUserDBOpener("sqlite3"),
+	"postgres": sqlUserDBOpener("postgres"),
+}
+
+func sqlUserDBOpener(driver string) func(string) (login.UserDB, io.Closer, error) {
+	return func(connect string) (login.UserDB, io.Closer, error) {
+		if driver == "sqlite3" {
+			connect = sqliteSettings.dsn(connect)
+		}
+		db, err := sql.Open(driver, connect)
+		if err != nil {
+			return nil, nil, err
+		}
+		return login.NewSqlUserDB(db), db, nil
+	}
+}
+
+// openUserDB opens a -login-db spec. The caller should Setup() the UserDB and Close() the Closer.
+func openUserDB(spec string) (login.UserDB, io.Closer, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	open := userDBOpeners[parts[0]]
+	if len(parts) != 2 || open == nil {
+		var schemes []string
+		for scheme := range userDBOpeners {
+			schemes = append(schemes, scheme)
+		}
+		sort.Strings(schemes)
+		return nil, nil, fmt.Errorf("-login-db %#v, want {%s}:connect", spec, strings.Join(schemes, "|"))
+	}
+	connect := parts[1]
+	if strings.HasPrefix(connect, "//") {
+		// URL style, postgres://...
+		connect = spec
+	}
+	return open(connect)
+}
+
+// loginDBDriver is the database/sql driver name for a -login-db spec
+func loginDBDriver(spec string) string {
+	scheme := strings.SplitN(spec, ":", 2)[0]
+	if scheme == "sqlite" {
+		return "sqlite3"
+	}
+	return scheme
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOpenUserDB(t *testing.T) {
+	udb, closer, err := openUserDB("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	err = udb.Setup()
+	if err != nil {
+		t.Errorf("setup, %v", err)
+	}
+	for _, bad := range []string{"", "sqlite", "redis:localhost:6379"} {
+		_, _, err = openUserDB(bad)
+		if err == nil {
+			t.Errorf("%#v should be an error", bad)
+		}
+	}
+}
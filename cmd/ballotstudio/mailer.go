@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text email
+type Mailer interface {
+	SendMail(to, subject, body string) error
+}
+
+// NewMailer sends through the SMTP server at addr (host:port), or if addr is
+// "" only logs what it would have sent.
+// user and password may be "" for a relay that doesn't want auth.
+func NewMailer(addr, from, user, password string) Mailer {
+	if addr == "" {
+		return logMailer{}
+	}
+	sm := &smtpMailer{addr: addr, from: from}
+	if user != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		sm.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return sm
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// headerSafe is false for values that could add headers to a message
+func headerSafe(v string) bool {
+	return !strings.ContainsAny(v, "\r\n")
+}
+
+func (sm *smtpMailer) SendMail(to, subject, body string) error {
+	if !headerSafe(to) || !headerSafe(subject) {
+		return fmt.Errorf("mail to %q: bad header value", to)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", sm.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	err := smtp.SendMail(sm.addr, sm.auth, sm.from, []string{to}, msg.Bytes())
+	if err != nil {
+		return fmt.Errorf("mail to %s, %v", to, err)
+	}
+	return nil
+}
+
+// logMailer is for running without -smtp
+type logMailer struct{}
+
+func (logMailer) SendMail(to, subject, body string) error {
+	log.Printf("no -smtp, not mailing %s %q:\n%s", to, subject, body)
+	return nil
+}
@@ -2,30 +2,38 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	_ "github.com/lib/pq"           // driver="postgres"
-	_ "github.com/mattn/go-sqlite3" // driver="sqlite3"
+	_ "github.com/go-sql-driver/mysql" // driver="mysql"
+	_ "github.com/lib/pq"              // driver="postgres"
+	_ "github.com/mattn/go-sqlite3"    // driver="sqlite3"
 
+	"github.com/brianolson/ballotstudio"
 	"github.com/brianolson/ballotstudio/data"
 	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
 	"github.com/brianolson/login/login"
 )
 
@@ -61,37 +69,219 @@ func texterr(w http.ResponseWriter, code int, format string, args ...interface{}
 	w.Write([]byte(msg))
 }
 
-// handler of /election and /election/*{,.pdf,.png,_bubbles.json,/scan}
+// jsonerr writes {"error":msg}
+func jsonerr(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if code >= 500 {
+		log.Print(msg)
+	}
+	eb, _ := json.Marshal(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(eb)
+}
+
+// handler of /election and /election/*{,.pdf,.html,.png,_bubbles.json,_pamphlet.pdf,/scan,/rescan,/state,/media,/export,/import,/audit,/cvr.json,/print,/print.pdf,/print/runs,/sample,/template,/annotations,/review.pdf,/revisions,/diff,/clone,/sharelink,/tags,/prerender,/testdeck.pdf,/testdeck.json,/synthetic.jpg,/synthetic.png,/library/{entry}}, /share, /trash, /digest, /admin/staff, /admin/jobs, /admin/cache, /elections/search, /elections/compare, /elections/tags, /scan/{id}/overlay.png, /print/{job}, /print/runs/{run}, /sample/{slug}, /webhooks, /library, /notifications and /account
 type StudioHandler struct {
 	edb electionAppDB
 	udb login.UserDB
 
-	drawBackend string
+	drawClient *draw.Client
+	// reads marks off scans, nil for scan.Local
+	scanInterpreter scan.Interpreter
 
 	cache Cache
+	// last good renders, for when the draw backend is down
+	stale Cache
 
 	//scantemplate *template.Template
 	//home         *template.Template
 	templates *TemplateSet
 	archiver  ImageArchiver
+	media     MediaStore
+
+	// largest candidate photo or party symbol upload accepted, bytes
+	mediaMaxBytes int64
+	// largest font upload accepted, bytes
+	fontMaxBytes int64
+	// largest election document accepted, bytes, 0 for DefaultDocMaxBytes
+	docMaxBytes int64
 
 	authmods []*login.OauthCallbackHandler
+	oidc     []*oidcProvider
+	saml     *samlProvider
+
+	// per-user or per-IP limits on expensive requests, nil for unlimited
+	renderLimit *RateLimiter
+	scanLimit   *RateLimiter
+
+	// largest scan upload accepted, bytes
+	scanMaxBytes int64
+	// accept scans without device, operator, batch and precinct
+	scanCustodyOptional bool
+
+	// simultaneous upload limits, nil for unlimited
+	scanUploads *UploadLimiter
+	docUploads  *UploadLimiter
+
+	// weekly digests go out through this
+	mailer Mailer
+
+	// elections whose last render failed, for the digest
+	renderFailures renderFailureLog
+
+	// draws in progress, and how long a failed one is cached, see renderflight.go
+	renderFlights    renderFlights
+	renderFailureTTL time.Duration
+
+	// election documents read through edb, see doccache.go; nil in tests
+	docs *docCache
+
+	// background renders after saving, see prerender.go
+	prerenders prerenderSet
+
+	// usernames from -admin, who may provision staff
+	admins map[string]bool
+
+	// signs share links, see sharelink.go
+	shareKey []byte
+
+	// default per-user limits, see quota.go
+	quotas quotaLimits
+
+	// user given deleted accounts' elections, 0 to purge them, see account.go
+	deletedElectionsTo int64
+
+	// posts webhook deliveries
+	webhookClient *http.Client
+
+	// housekeeping and other background work, see jobs.go
+	jobs *jobScheduler
+	gc   gcPolicy
 }
 
 var pdfPathRe *regexp.Regexp
+var htmlPathRe *regexp.Regexp
 var bubblesPathRe *regexp.Regexp
 var pngPathRe *regexp.Regexp
 var pngPagePathRe *regexp.Regexp
 var scanPathRe *regexp.Regexp
+var rescanPathRe *regexp.Regexp
+var statePathRe *regexp.Regexp
+var districtsPathRe *regexp.Regexp
+var readinessPathRe *regexp.Regexp
+var resultsPathRe *regexp.Regexp
+var mediaPathRe *regexp.Regexp
+var fontsPathRe *regexp.Regexp
+var exportPathRe *regexp.Regexp
+var checksumsPathRe *regexp.Regexp
+var auditPathRe *regexp.Regexp
+var cvrPathRe *regexp.Regexp
+var printPathRe *regexp.Regexp
+var imposePathRe *regexp.Regexp
+var printRunsPathRe *regexp.Regexp
+var printRunPathRe *regexp.Regexp
+var printJobPathRe *regexp.Regexp
+var electionSamplePathRe *regexp.Regexp
+var samplePathRe *regexp.Regexp
+var importPathRe *regexp.Regexp
+var pamphletPathRe *regexp.Regexp
 var docPathRe *regexp.Regexp
+var trashPathRe *regexp.Regexp
+var annotationsPathRe *regexp.Regexp
+var templatePathRe *regexp.Regexp
+var prerenderPathRe *regexp.Regexp
+var testDeckPathRe *regexp.Regexp
+var syntheticPathRe *regexp.Regexp
+var reviewPdfPathRe *regexp.Regexp
+var trashRestorePathRe *regexp.Regexp
+var digestPathRe *regexp.Regexp
+var staffPathRe *regexp.Regexp
+var jobsPathRe *regexp.Regexp
+var cacheAdminPathRe *regexp.Regexp
+var calendarPathRe *regexp.Regexp
+var quotasPathRe *regexp.Regexp
+var revisionsPathRe *regexp.Regexp
+var diffPathRe *regexp.Regexp
+var clonePathRe *regexp.Regexp
+var shareLinkPathRe *regexp.Regexp
+var sharePathRe *regexp.Regexp
+var searchPathRe *regexp.Regexp
+var comparePathRe *regexp.Regexp
+var electionTagsPathRe *regexp.Regexp
+var tagsPathRe *regexp.Regexp
+var webhooksPathRe *regexp.Regexp
+var notificationsPathRe *regexp.Regexp
+var accountPathRe *regexp.Regexp
+var scanOverlayPathRe *regexp.Regexp
+var libraryPathRe *regexp.Regexp
+var electionLibraryPathRe *regexp.Regexp
 
 func init() {
 	pdfPathRe = regexp.MustCompile(`^/election/(\d+)\.pdf$`)
+	htmlPathRe = regexp.MustCompile(`^/election/(\d+)\.html$`)
 	bubblesPathRe = regexp.MustCompile(`^/election/(\d+)_bubbles\.json$`)
 	pngPathRe = regexp.MustCompile(`^/election/(\d+)\.png$`)
 	pngPagePathRe = regexp.MustCompile(`^/election/(\d+)\.(\d+)\.png$`)
 	scanPathRe = regexp.MustCompile(`^/election/(\d+)/scan$`)
+	rescanPathRe = regexp.MustCompile(`^/election/(\d+)/rescan$`)
+	statePathRe = regexp.MustCompile(`^/election/(\d+)/state$`)
+	districtsPathRe = regexp.MustCompile(`^/election/(\d+)/districts$`)
+	readinessPathRe = regexp.MustCompile(`^/election/(\d+)/readiness$`)
+	resultsPathRe = regexp.MustCompile(`^/election/(\d+)/results(\.json)?$`)
+	exportPathRe = regexp.MustCompile(`^/election/(\d+)/export$`)
+	checksumsPathRe = regexp.MustCompile(`^/election/(\d+)/checksums$`)
+	auditPathRe = regexp.MustCompile(`^/election/(\d+)/audit$`)
+	cvrPathRe = regexp.MustCompile(`^/election/(\d+)/cvr\.json$`)
+	printPathRe = regexp.MustCompile(`^/election/(\d+)/print$`)
+	imposePathRe = regexp.MustCompile(`^/election/(\d+)/print\.pdf$`)
+	printRunsPathRe = regexp.MustCompile(`^/election/(\d+)/print/runs$`)
+	printRunPathRe = regexp.MustCompile(`^/print/runs/(\d+)(?:/(\d+)\.pdf)?$`)
+	printJobPathRe = regexp.MustCompile(`^/print/(\d+)(\.pdf)?$`)
+	electionSamplePathRe = regexp.MustCompile(`^/election/(\d+)/sample$`)
+	samplePathRe = regexp.MustCompile(`^/sample/([a-z0-9-]+)(\.pdf)?$`)
+	importPathRe = regexp.MustCompile(`^/election/import$`)
+	mediaPathRe = regexp.MustCompile(`^/election/(\d+)/media(?:/([^/]+))?$`)
+	fontsPathRe = regexp.MustCompile(`^/election/(\d+)/fonts$`)
+	pamphletPathRe = regexp.MustCompile(`^/election/(\d+)_pamphlet\.pdf$`)
 	docPathRe = regexp.MustCompile(`^/election/(\d+)(.json)?$`)
+	templatePathRe = regexp.MustCompile(`^/election/(\d+)/template$`)
+	prerenderPathRe = regexp.MustCompile(`^/election/(\d+)/prerender$`)
+	testDeckPathRe = regexp.MustCompile(`^/election/(\d+)/testdeck\.(pdf|json)$`)
+	syntheticPathRe = regexp.MustCompile(`^/election/(\d+)/synthetic\.(jpg|png)$`)
+	annotationsPathRe = regexp.MustCompile(`^/election/(\d+)/annotations(?:/(\d+))?$`)
+	reviewPdfPathRe = regexp.MustCompile(`^/election/(\d+)/review\.pdf$`)
+	trashPathRe = regexp.MustCompile(`^/trash(\.json)?$`)
+	trashRestorePathRe = regexp.MustCompile(`^/trash/(\d+)/restore$`)
+	digestPathRe = regexp.MustCompile(`^/digest(/report)?$`)
+	staffPathRe = regexp.MustCompile(`^/admin/staff$`)
+	jobsPathRe = regexp.MustCompile(`^/admin/jobs(?:/([a-z-]+))?$`)
+	cacheAdminPathRe = regexp.MustCompile(`^/admin/cache(/invalidate|/warm)?$`)
+	calendarPathRe = regexp.MustCompile(`^/admin/calendar$`)
+	quotasPathRe = regexp.MustCompile(`^/admin/quotas/(\d+)$`)
+	revisionsPathRe = regexp.MustCompile(`^/election/(\d+)/revisions$`)
+	diffPathRe = regexp.MustCompile(`^/election/(\d+)/diff$`)
+	clonePathRe = regexp.MustCompile(`^/election/(\d+)/clone$`)
+	shareLinkPathRe = regexp.MustCompile(`^/election/(\d+)/sharelink$`)
+	searchPathRe = regexp.MustCompile(`^/elections/search$`)
+	comparePathRe = regexp.MustCompile(`^/elections/compare$`)
+	electionTagsPathRe = regexp.MustCompile(`^/election/(\d+)/tags(?:/([^/]+))?$`)
+	tagsPathRe = regexp.MustCompile(`^/elections/tags(?:/([^/]+))?$`)
+	webhooksPathRe = regexp.MustCompile(`^/webhooks(?:/(\d+)(/deliveries|/ping)?)?$`)
+	notificationsPathRe = regexp.MustCompile(`^/notifications$`)
+	accountPathRe = regexp.MustCompile(`^/account(/export)?$`)
+	scanOverlayPathRe = regexp.MustCompile(`^/scan/(\d+)/overlay\.png$`)
+	libraryPathRe = regexp.MustCompile(`^/library(?:/(\d+))?$`)
+	electionLibraryPathRe = regexp.MustCompile(`^/election/(\d+)/library/(\d+)$`)
+	sharePathRe = regexp.MustCompile(`^/share/([A-Za-z0-9_-]+\.[A-Za-z0-9_-]+)(?:\.(\d+)\.png|\.pdf)$`)
+}
+
+// noCache tells browsers to re-check every response, for -dev
+func noCache(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		h.ServeHTTP(w, r)
+	})
 }
 
 var truthy []string = []string{"t", "1", "true"}
@@ -111,13 +301,22 @@ func qbool(q string) bool {
 
 // implement http.Handler
 func (sh *StudioHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	user, _ := login.GetHttpUser(w, r, sh.udb)
+	user := httpUser(w, r, sh.udb, sh.edb)
 	path := r.URL.Path
 	query := r.URL.Query()
 	redraw := qbool(query.Get("redraw"))
 	if path == "/election" {
 		if r.Method == "POST" {
-			sh.handleElectionDocPOST(w, r, user, "", 0)
+			release, stop := uploadLimited(w, r, sh.docUploads, sh.maxDocBytes())
+			if stop {
+				return
+			}
+			defer release()
+			if template := query.Get("template"); template != "" {
+				sh.handleElectionFromTemplate(w, r, user, template)
+				return
+			}
+			sh.handleElectionDocPOST(w, r, user, 0)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -135,7 +334,14 @@ func (sh *StudioHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			sh.handleElectionDocGET(w, r, user, electionid)
 		} else if r.Method == "POST" {
-			sh.handleElectionDocPOST(w, r, user, m[1], electionid)
+			release, stop := uploadLimited(w, r, sh.docUploads, sh.maxDocBytes())
+			if stop {
+				return
+			}
+			defer release()
+			sh.handleElectionDocPOST(w, r, user, electionid)
+		} else if r.Method == "DELETE" {
+			sh.handleElectionDelete(w, r, user, electionid)
 		} else {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(400)
@@ -146,56 +352,125 @@ func (sh *StudioHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// `^/election/(\d+)\.pdf$`
 	m = pdfPathRe.FindStringSubmatch(path)
 	if m != nil {
-		bothob, err := sh.getPdf(r.Context(), m[1], redraw)
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		opts, ok := sh.renderQueryOptions(w, query, m[1])
+		if !ok {
+			return
+		}
+		ctx, note := withStaleNote(r.Context())
+		bothob, err := sh.getPdf(ctx, m[1], opts, redraw)
+		if err != nil {
+			he := err.(*httpError)
+			maybeerr(w, he.err, he.code, he.msg)
+			return
+		}
+		defer bothob.Release()
+		note.setHeader(w)
+		writePdfArtifact(w, r, bothob, sh.renderModified(m[1], note), "no-cache")
+		return
+	}
+	// `^/election/(\d+)\.html$`
+	m = htmlPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionHTML(w, r, electionid)
+		return
+	}
+	// `^/election/(\d+)_pamphlet\.pdf$`
+	m = pamphletPathRe.FindStringSubmatch(path)
+	if m != nil {
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		ctx, note := withStaleNote(r.Context())
+		pdf, err := sh.getPamphlet(ctx, m[1], redraw)
 		if err != nil {
 			he := err.(*httpError)
 			maybeerr(w, he.err, he.code, he.msg)
 			return
 		}
-		w.Header().Set("Content-Type", "application/pdf")
-		w.WriteHeader(200)
-		w.Write(bothob.Pdf)
+		note.setHeader(w)
+		writeArtifact(w, r, "application/pdf", pdf, sh.renderModified(m[1], note))
 		return
 	}
 	// `^/election/(\d+)_bubbles\.json$`
 	m = bubblesPathRe.FindStringSubmatch(path)
 	if m != nil {
-		bothob, err := sh.getPdf(r.Context(), m[1], redraw)
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		opts, ok := sh.renderQueryOptions(w, query, m[1])
+		if !ok {
+			return
+		}
+		ctx, note := withStaleNote(r.Context())
+		bothob, err := sh.getPdf(ctx, m[1], opts, redraw)
 		if err != nil {
 			he := err.(*httpError)
 			maybeerr(w, he.err, he.code, he.msg)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(200)
-		w.Write(bothob.BubblesJson)
+		defer bothob.Release()
+		note.setHeader(w)
+		w.Header().Set("Vary", "Accept")
+		format := bubblesFormat(r)
+		if format == nil {
+			texterr(w, 400, "bubbles version not supported, see /formats")
+			return
+		}
+		out, err := scan.ConvertBubbles(bothob.BubblesJson, format.Version)
+		if maybeerr(w, err, 500, "bad bubbles json") {
+			return
+		}
+		writeArtifact(w, r, format.MediaType, out, sh.renderModified(m[1], note))
 		return
 	}
 	// `^/election/(\d+)\.(\d+)\.png$`
 	m = pngPagePathRe.FindStringSubmatch(path)
 	if m != nil {
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
 		pagenum, err := strconv.Atoi(string(m[2]))
 		if maybeerr(w, err, 400, "bad page") {
 			return
 		}
-		pngbytes, err := sh.getPng(r.Context(), m[1], redraw)
+		opts, ok := sh.renderQueryOptions(w, query, m[1])
+		if !ok {
+			return
+		}
+		ctx, note := withStaleNote(r.Context())
+		pngbytes, err := sh.getPng(ctx, m[1], opts, redraw)
 		if err != nil {
 			he := err.(*httpError)
 			maybeerr(w, he.err, he.code, he.msg)
 			return
 		}
-		if pagenum > len(pngbytes) {
+		if pagenum >= len(pngbytes) {
 			texterr(w, 400, "bad page")
+			return
 		}
-		w.Header().Set("Content-Type", "image/png")
-		w.WriteHeader(200)
-		w.Write(pngbytes[pagenum])
+		note.setHeader(w)
+		writeArtifact(w, r, "image/png", pngbytes[pagenum], sh.renderModified(m[1], note))
 		return
 	}
 	// `^/election/(\d+)\.png$`
 	m = pngPathRe.FindStringSubmatch(path)
 	if m != nil {
-		pngbytes, err := sh.getPng(r.Context(), m[1], redraw)
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		opts, ok := sh.renderQueryOptions(w, query, m[1])
+		if !ok {
+			return
+		}
+		ctx, note := withStaleNote(r.Context())
+		pngbytes, err := sh.getPng(ctx, m[1], opts, redraw)
 		if err != nil {
 			he := err.(*httpError)
 			maybeerr(w, he.err, he.code, he.msg)
@@ -203,33 +478,576 @@ func (sh *StudioHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		if len(pngbytes) > 1 {
 			texterr(w, 400, "document has more than one page")
+			return
+		}
+		note.setHeader(w)
+		writeArtifact(w, r, "image/png", pngbytes[0], sh.renderModified(m[1], note))
+		return
+	}
+	// `^/election/(\d+)/scan$`
+	m = scanPathRe.FindStringSubmatch(path)
+	if m != nil {
+		// POST: receive image
+		// GET: serve a page with image upload
+		if r.Method == "POST" {
+			if rateLimited(w, r, sh.scanLimit, user) {
+				return
+			}
+			electionid, err := strconv.ParseInt(m[1], 10, 64)
+			if maybeerr(w, err, 400, "bad item") {
+				return
+			}
+			if sh.checkElectionState(w, electionid, actionScan) {
+				return
+			}
+			release, stop := uploadLimited(w, r, sh.scanUploads, sh.scanMaxBytes)
+			if stop {
+				return
+			}
+			defer release()
+			sh.handleElectionScanPOST(w, r, user, m[1])
+			return
+		}
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
 		}
-		w.Header().Set("Content-Type", "image/png")
-		w.WriteHeader(200)
-		w.Write(pngbytes[0])
+		w.Header().Set("Content-Type", "text/html")
+		ec := EditContext{}
+		ec.set(r, electionid)
+		ec.Nonce = cspNonce(r)
+		ec.CSRF = csrfToken(r)
+		scantemplate, err := sh.templates.Lookup("scanform.html")
+		if maybeerr(w, err, 500, "scanform.html: %v", err) {
+			return
+		}
+		scantemplate.Execute(w, ec)
+		return
+	}
+	// `^/election/(\d+)/rescan$`
+	m = rescanPathRe.FindStringSubmatch(path)
+	if m != nil {
+		if r.Method != "POST" {
+			texterr(w, http.StatusMethodNotAllowed, "POST only")
+			return
+		}
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if rateLimited(w, r, sh.scanLimit, user) {
+			return
+		}
+		if sh.checkElectionState(w, electionid, actionScan) {
+			return
+		}
+		sh.handleElectionRescan(w, r, user, m[1], electionid)
+		return
+	}
+	// `^/election/(\d+)/state$`
+	m = statePathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionState(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/districts$`
+	m = districtsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if r.Method == "POST" {
+			if sh.checkElectionState(w, electionid, actionEdit) {
+				return
+			}
+			release, stop := uploadLimited(w, r, sh.docUploads, MaxImportBundleBytes)
+			if stop {
+				return
+			}
+			defer release()
+			sh.handleElectionDistrictsImport(w, r, user, electionid)
+			return
+		}
+		sh.handleElectionDistricts(w, r, electionid)
+		return
+	}
+	// `^/election/(\d+)/readiness$`
+	m = readinessPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionReadiness(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/results(\.json)?$`
+	m = resultsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionResults(w, r, user, electionid, m[2] != "")
+		return
+	}
+	// `^/election/(\d+)/export$`
+	m = exportPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		sh.handleElectionExport(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/checksums$`
+	m = checksumsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		sh.handleElectionChecksums(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/revisions$`
+	m = revisionsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionRevisions(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/diff$`
+	m = diffPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		sh.handleElectionDiff(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/clone$`
+	m = clonePathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionClone(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/sharelink$`
+	m = shareLinkPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionShareLink(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/tags(?:/([^/]+))?$`
+	m = electionTagsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionTags(w, r, user, electionid, m[2])
+		return
+	}
+	// `^/share/([A-Za-z0-9_-]+\.[A-Za-z0-9_-]+)(?:\.(\d+)\.png|\.pdf)$`
+	m = sharePathRe.FindStringSubmatch(path)
+	if m != nil {
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		sh.handleShare(w, r, m[1], m[2])
+		return
+	}
+	// `^/election/(\d+)/audit$`
+	m = auditPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionAudit(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/cvr\.json$`
+	m = cvrPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionCVR(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/print$`
+	m = printPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionPrint(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/print\.pdf$`
+	m = imposePathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionImpose(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/print/runs$`
+	m = printRunsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionPrintRuns(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/sample$`
+	m = electionSamplePathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionSample(w, r, user, electionid)
+		return
+	}
+	// `^/election/import$`
+	if importPathRe.MatchString(path) {
+		release, stop := uploadLimited(w, r, sh.docUploads, MaxImportBundleBytes)
+		if stop {
+			return
+		}
+		defer release()
+		sh.handleElectionImport(w, r, user)
+		return
+	}
+	// `^/election/(\d+)/media(?:/([^/]+))?$`
+	m = mediaPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if r.Method == "POST" {
+			if sh.checkElectionState(w, electionid, actionEdit) {
+				return
+			}
+			release, stop := uploadLimited(w, r, sh.docUploads, sh.mediaMaxBytes)
+			if stop {
+				return
+			}
+			defer release()
+		}
+		sh.handleElectionMedia(w, r, user, electionid, m[2])
+		return
+	}
+	// `^/election/(\d+)/fonts$`
+	m = fontsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if r.Method == "POST" {
+			if sh.checkElectionState(w, electionid, actionEdit) {
+				return
+			}
+			release, stop := uploadLimited(w, r, sh.docUploads, sh.fontMaxBytes)
+			if stop {
+				return
+			}
+			defer release()
+		}
+		sh.handleElectionFonts(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/library/(\d+)$`
+	m = electionLibraryPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		entryid, err := strconv.ParseInt(m[2], 10, 64)
+		if maybeerr(w, err, 400, "bad library entry") {
+			return
+		}
+		if r.Method == "POST" && sh.checkElectionState(w, electionid, actionEdit) {
+			return
+		}
+		sh.handleElectionLibraryInsert(w, r, user, electionid, entryid)
+		return
+	}
+	// `^/election/(\d+)/template$`
+	m = templatePathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionTemplate(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/prerender$`
+	m = prerenderPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleElectionPrerender(w, r, user, electionid)
+		return
+	}
+	// `^/election/(\d+)/testdeck\.(pdf|json)$`
+	m = testDeckPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		sh.handleElectionTestDeck(w, r, user, electionid, m[2] == "json")
+		return
+	}
+	// `^/election/(\d+)/synthetic\.(jpg|png)$`
+	m = syntheticPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		sh.handleSyntheticBallot(w, r, user, electionid, m[2])
+		return
+	}
+	// `^/election/(\d+)/annotations(?:/(\d+))?$`
+	m = annotationsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		var annotationid int64
+		if m[2] != "" {
+			annotationid, err = strconv.ParseInt(m[2], 10, 64)
+			if maybeerr(w, err, 400, "bad annotation") {
+				return
+			}
+		}
+		sh.handleElectionAnnotations(w, r, user, electionid, annotationid)
+		return
+	}
+	// `^/election/(\d+)/review\.pdf$`
+	m = reviewPdfPathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		if rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		sh.handleElectionReviewPdf(w, r, electionid)
+		return
+	}
+	// `^/trash(\.json)?$`
+	m = trashPathRe.FindStringSubmatch(path)
+	if m != nil {
+		sh.handleTrash(w, r, user, m[1] != "")
+		return
+	}
+	// `^/trash/(\d+)/restore$`
+	m = trashRestorePathRe.FindStringSubmatch(path)
+	if m != nil {
+		electionid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad item") {
+			return
+		}
+		sh.handleTrashRestore(w, r, user, electionid)
+		return
+	}
+	// `^/digest(/report)?$`
+	m = digestPathRe.FindStringSubmatch(path)
+	if m != nil {
+		if m[1] != "" {
+			sh.handleDigestReport(w, r, user)
+		} else {
+			sh.handleDigest(w, r, user)
+		}
+		return
+	}
+	// `^/admin/staff$`
+	if staffPathRe.MatchString(path) {
+		sh.handleStaff(w, r, user)
+		return
+	}
+	// `^/admin/jobs(?:/([a-z-]+))?$`
+	m = jobsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		sh.handleJobs(w, r, user, m[1])
+		return
+	}
+	// `^/admin/cache(/invalidate|/warm)?$`
+	m = cacheAdminPathRe.FindStringSubmatch(path)
+	if m != nil {
+		sh.handleCacheAdmin(w, r, user, m[1])
+		return
+	}
+	// `^/admin/calendar$`
+	if calendarPathRe.MatchString(path) {
+		sh.handleCalendar(w, r, user)
+		return
+	}
+	// `^/admin/quotas/(\d+)$`
+	m = quotasPathRe.FindStringSubmatch(path)
+	if m != nil {
+		uid, err := parseUserId(m[1])
+		if maybeerr(w, err, 400, "bad user") {
+			return
+		}
+		sh.handleQuotaAdmin(w, r, user, uid)
+		return
+	}
+	// `^/elections/search$`
+	if searchPathRe.MatchString(path) {
+		sh.handleElectionSearch(w, r, user)
+		return
+	}
+	// `^/elections/compare$`
+	if comparePathRe.MatchString(path) {
+		sh.handleElectionCompare(w, r, user)
+		return
+	}
+	// `^/elections/tags(?:/([^/]+))?$`
+	m = tagsPathRe.FindStringSubmatch(path)
+	if m != nil {
+		sh.handleTags(w, r, user, m[1])
+		return
+	}
+	// `^/library(?:/(\d+))?$`
+	m = libraryPathRe.FindStringSubmatch(path)
+	if m != nil {
+		var entryid int64
+		if m[1] != "" {
+			var err error
+			entryid, err = strconv.ParseInt(m[1], 10, 64)
+			if maybeerr(w, err, 400, "bad library entry") {
+				return
+			}
+		}
+		sh.handleLibrary(w, r, user, entryid)
+		return
+	}
+	// `^/webhooks(?:/(\d+)(/deliveries|/ping)?)?$`
+	m = webhooksPathRe.FindStringSubmatch(path)
+	if m != nil {
+		var webhookid int64
+		if m[1] != "" {
+			var err error
+			webhookid, err = strconv.ParseInt(m[1], 10, 64)
+			if maybeerr(w, err, 400, "bad webhook") {
+				return
+			}
+		}
+		sh.handleWebhooks(w, r, user, webhookid, m[2])
+		return
+	}
+	// `^/print/runs/(\d+)(?:/(\d+)\.pdf)?$`
+	m = printRunPathRe.FindStringSubmatch(path)
+	if m != nil {
+		runid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad print run") {
+			return
+		}
+		batch := 0
+		if m[2] != "" {
+			batch, err = strconv.Atoi(m[2])
+			if err != nil || batch < 1 {
+				texterr(w, 400, "bad batch")
+				return
+			}
+		}
+		sh.handlePrintRun(w, r, user, runid, batch)
+		return
+	}
+	// `^/print/(\d+)(\.pdf)?$`
+	m = printJobPathRe.FindStringSubmatch(path)
+	if m != nil {
+		jobid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad print job") {
+			return
+		}
+		sh.handlePrintJob(w, r, user, jobid, m[2] != "")
+		return
+	}
+	// `^/sample/([a-z0-9-]+)(\.pdf)?$`
+	m = samplePathRe.FindStringSubmatch(path)
+	if m != nil {
+		if m[2] != "" && rateLimited(w, r, sh.renderLimit, user) {
+			return
+		}
+		sh.handleSample(w, r, m[1], m[2] != "")
+		return
+	}
+	// `^/notifications$`
+	if notificationsPathRe.MatchString(path) {
+		sh.handleNotifications(w, r, user)
+		return
+	}
+	// `^/account(/export)?$`
+	m = accountPathRe.FindStringSubmatch(path)
+	if m != nil {
+		sh.handleAccount(w, r, user, m[1] != "")
 		return
 	}
-	// `^/election/(\d+)/scan$`
-	m = scanPathRe.FindStringSubmatch(path)
+	// `^/scan/(\d+)/overlay\.png$`
+	m = scanOverlayPathRe.FindStringSubmatch(path)
 	if m != nil {
-		// POST: receive image
-		// GET: serve a page with image upload
-		if r.Method == "POST" {
-			sh.handleElectionScanPOST(w, r, user, m[1])
+		scanid, err := strconv.ParseInt(m[1], 10, 64)
+		if maybeerr(w, err, 400, "bad scan") {
 			return
 		}
-		electionid, err := strconv.ParseInt(m[1], 10, 64)
-		if maybeerr(w, err, 400, "bad item") {
-			return
-		}
-		w.Header().Set("Content-Type", "text/html")
-		ec := EditContext{}
-		ec.set(electionid)
-		scantemplate, err := sh.templates.Lookup("scanform.html")
-		if maybeerr(w, err, 500, "scanform.html: %v", err) {
+		if rateLimited(w, r, sh.renderLimit, user) {
 			return
 		}
-		scantemplate.Execute(w, ec)
+		sh.handleScanOverlay(w, r, user, scanid)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html")
@@ -238,29 +1056,83 @@ func (sh *StudioHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if maybeerr(w, err, 500, "home.html: %v", err) {
 		return
 	}
-	var eids []int64
+	var elections []electionSummary
+	var folders []tagCount
+	tag, _ := cleanTag(query.Get("tag"))
+	// a bad date just doesn't filter, see calendar.go
+	filter, _ := parseFactsFilter(query)
 	if user != nil {
-		eids, _ = sh.edb.ElectionsForUser(user.Guid)
+		edb := sh.edb.WithContext(r.Context())
+		eids, _ := edb.ElectionsForUser(user.Guid)
+		tags, _ := edb.TagsForUser(user.Guid)
+		folders = countTags(tags)
+		filter.Owner = user.Guid
+		facts, _ := edb.ElectionFacts(filter)
+		factsById := make(map[int64]electionFacts, len(facts))
+		for _, ef := range facts {
+			factsById[ef.ElectionId] = ef
+		}
+		for _, eid := range eids {
+			if tag != "" && !hasTag(tags[eid], tag) {
+				continue
+			}
+			ef, ok := factsById[eid]
+			if filter.active() && !ok {
+				continue
+			}
+			state, _ := edb.GetElectionState(eid)
+			elections = append(elections, electionSummary{eid, state, tags[eid], ef.Date, ef.Jurisdiction, ef.Type})
+		}
 	}
-	home.Execute(w, HomeContext{user, sh.authmods, eids})
+	home.Execute(w, HomeContext{user, sh.authmods, sh.oidc, sh.saml, elections, csrfToken(r), basePath(r), folders, tag, filter})
+}
+
+type electionSummary struct {
+	Id    int64
+	State string
+	Tags  []string
+
+	// from the document, see calendar.go
+	Date         string
+	Jurisdiction string
+	Type         string
 }
 
 type HomeContext struct {
-	User        *login.User
-	AuthMods    []*login.OauthCallbackHandler
-	ElectionIds []int64
+	User      *login.User
+	AuthMods  []*login.OauthCallbackHandler
+	OIDC      []*oidcProvider
+	SAML      *samlProvider
+	Elections []electionSummary
+	CSRF      string
+	Base      string // mount prefix for links, see baseurl.go
+
+	Tags []tagCount // the user's tags, see tags.go
+	Tag  string     // ?tag= the list is filtered by, or ""
+
+	Filter factsFilter // ?from= ?to= ?jurisdiction= ?type=, see calendar.go
 }
 
-const MaxUploadDocumentBytes = 1000000
+// DefaultDocMaxBytes is the largest election document accepted without -doc-max-bytes.
+// Images belong in the media store (see media.go), not the document.
+const DefaultDocMaxBytes = 4000000
+
+// maxDocBytes is the largest election document accepted
+func (sh *StudioHandler) maxDocBytes() int64 {
+	if sh.docMaxBytes > 0 {
+		return sh.docMaxBytes
+	}
+	return DefaultDocMaxBytes
+}
 
-func (sh *StudioHandler) handleElectionDocPOST(w http.ResponseWriter, r *http.Request, user *login.User, itemname string, itemid int64) {
+func (sh *StudioHandler) handleElectionDocPOST(w http.ResponseWriter, r *http.Request, user *login.User, itemid int64) {
 	if user == nil {
 		texterr(w, http.StatusUnauthorized, "nope")
 		return
 	}
 	contentType := r.Header.Get("Content-Type")
 	if strings.HasPrefix(contentType, "application/json") {
-		mbr := http.MaxBytesReader(w, r.Body, int64(MaxUploadDocumentBytes))
+		mbr := http.MaxBytesReader(w, r.Body, sh.maxDocBytes())
 		body, err := ioutil.ReadAll(mbr)
 		if err == io.EOF {
 			err = nil
@@ -268,7 +1140,7 @@ func (sh *StudioHandler) handleElectionDocPOST(w http.ResponseWriter, r *http.Re
 		if maybeerr(w, err, 400, "bad body") {
 			return
 		}
-		sh.handleElectionDocPOSTJson(w, r, user, itemname, itemid, body, editContextFinish)
+		sh.handleElectionDocPOSTJson(w, r, user, itemid, body, editContextFinish)
 		return
 	} else if strings.HasPrefix(contentType, "multipart/form-data") {
 		mr, err := r.MultipartReader()
@@ -286,10 +1158,10 @@ func (sh *StudioHandler) handleElectionDocPOST(w http.ResponseWriter, r *http.Re
 			}
 			name := part.FormName()
 			if name == "ejsn" {
-				mbr := http.MaxBytesReader(w, part, MaxUploadDocumentBytes)
+				mbr := http.MaxBytesReader(w, part, sh.maxDocBytes())
 				body, err = io.ReadAll(mbr)
 				log.Printf("got %d bytes of json body from %s", len(body), name)
-				sh.handleElectionDocPOSTJson(w, r, user, itemname, itemid, body, editRedirect)
+				sh.handleElectionDocPOSTJson(w, r, user, itemid, body, editRedirect)
 				return
 			}
 		}
@@ -298,51 +1170,143 @@ func (sh *StudioHandler) handleElectionDocPOST(w http.ResponseWriter, r *http.Re
 	texterr(w, 400, "unknown content-type: %s", contentType)
 }
 
-type docPostFinishFunc func(w http.ResponseWriter, r *http.Request, newid int64)
+// docPostFinishFunc answers a saved POST; issues are what data.Validate found, saved anyway
+type docPostFinishFunc func(w http.ResponseWriter, r *http.Request, newid int64, issues []data.RuleIssue)
 
-func (sh *StudioHandler) handleElectionDocPOSTJson(w http.ResponseWriter, r *http.Request, user *login.User, itemname string, itemid int64, body []byte, finish docPostFinishFunc) {
+func (sh *StudioHandler) handleElectionDocPOSTJson(w http.ResponseWriter, r *http.Request, user *login.User, itemid int64, body []byte, finish docPostFinishFunc) {
 	var ob map[string]interface{}
 	err := json.Unmarshal(body, &ob)
 	if maybeerr(w, err, 400, "bad json") {
 		return
 	}
-	ob = data.Fixup(ob)
-	nbody, err := json.Marshal(ob)
-	if maybeerr(w, err, 400, "re-json body") {
+	body, issues, err := sh.checkElectionDoc(ob, itemid)
+	if err != nil {
+		writeHTTPError(w, err)
 		return
 	}
-	body = nbody
+	var older *electionRecord
 	if itemid != 0 {
-		older, _ := sh.edb.GetElection(itemid)
+		older, _ = sh.edb.GetElection(itemid)
 		if older != nil {
 			if older.Owner != user.Guid {
 				texterr(w, http.StatusUnauthorized, "nope")
 				return
 			}
+			if older.Trashed != 0 {
+				texterr(w, http.StatusConflict, "election %d is in the trash, restore it first", itemid)
+				return
+			}
+			if sh.checkElectionState(w, itemid, actionEdit) {
+				return
+			}
 		}
 	}
-	er := electionRecord{
-		Id:    itemid,
-		Owner: user.Guid,
-		Data:  string(body),
+	if older == nil && sh.overQuota(w, user, 1, 0) {
+		return
 	}
-	newid, err := sh.edb.PutElection(er)
-	if maybeerr(w, err, 500, "db put fail") {
+	newid, err := sh.saveElectionDoc(user, older, body, nil)
+	if err != nil {
+		writeHTTPError(w, err)
 		return
 	}
-	sh.cache.Invalidate(itemname)
-	sh.cache.Invalidate(itemname + ".png")
-	er.Id = newid
-	finish(w, r, newid)
+	finish(w, r, newid, issues)
+}
+
+// checkElectionDoc cleans up a document the way every save does and checks
+// that it can be drawn. itemid is 0 for a new election, whose inline images
+// stay inline until it has an id. Rule issues don't stop a draft saving, the
+// readiness check holds back publishing. Errors are *httpError.
+func (sh *StudioHandler) checkElectionDoc(ob map[string]interface{}, itemid int64) (doc []byte, issues []data.RuleIssue, err error) {
+	ob = data.Fixup(ob)
+	if itemid != 0 && sh.media != nil {
+		// a new election has no id for the URLs yet, its next save moves them
+		moved, err := extractMedia(sh.media, ob, itemid, sh.mediaMaxBytes)
+		if err != nil {
+			return nil, nil, &httpError{500, err.Error(), err}
+		}
+		if moved != 0 {
+			log.Printf("election %d: moved %d inline images to media", itemid, moved)
+		}
+	}
+	problems := data.CheckBubbleGeometry(ob)
+	if len(problems) != 0 {
+		return nil, nil, &httpError{400, "bad BubbleGeometry\n" + strings.Join(problems, "\n"), nil}
+	}
+	doc, err = json.Marshal(ob)
+	if err != nil {
+		return nil, nil, &httpError{400, "re-json body", err}
+	}
+	_, err = draw.DocRenderOptions(string(doc))
+	if err != nil {
+		return nil, nil, &httpError{400, err.Error(), err}
+	}
+	_, err = draw.DocRenderProfiles(string(doc))
+	if err != nil {
+		return nil, nil, &httpError{400, err.Error(), err}
+	}
+	return doc, data.Validate(ob), nil
+}
+
+// saveElectionDoc saves a document from checkElectionDoc over older, or as a
+// new election owned by owner if older is nil. older is only replaced if it's
+// still what's stored, a save by someone else in between is a 409. hook adds
+// to the save webhook's payload. Errors are *httpError.
+func (sh *StudioHandler) saveElectionDoc(owner *login.User, older *electionRecord, doc []byte, hook map[string]interface{}) (newid int64, err error) {
+	var meta string
+	if older == nil {
+		newid, err = sh.edb.PutElection(electionRecord{Owner: owner.Guid, Data: string(doc)})
+		if err != nil {
+			return 0, &httpError{500, "db put fail", err}
+		}
+	} else {
+		newid = older.Id
+		meta = older.Meta
+		ok, err := sh.edb.PutElectionIf(electionRecord{Id: older.Id, Owner: older.Owner, Data: string(doc)}, older.Data)
+		if err != nil {
+			return 0, &httpError{500, "db put fail", err}
+		}
+		if !ok {
+			return 0, &httpError{http.StatusConflict, fmt.Sprintf("election %d was saved by someone else meanwhile, reload it", older.Id), nil}
+		}
+	}
+	sh.pruneRevisions(owner, newid)
+	itemname := strconv.FormatInt(newid, 10)
+	sh.invalidateElection(itemname)
+	payload := map[string]interface{}{"new": older == nil, "bytes": len(doc)}
+	for k, v := range hook {
+		payload[k] = v
+	}
+	sh.fireWebhooks(webhookSave, newid, payload)
+	if parseElectionMeta(meta).Prerender {
+		sh.prerender(itemname)
+	}
+	return newid, nil
 }
 
-func editRedirect(w http.ResponseWriter, r *http.Request, newid int64) {
-	http.Redirect(w, r, fmt.Sprintf("/edit/%d", newid), http.StatusFound)
+// writeHTTPError answers with an *httpError
+func writeHTTPError(w http.ResponseWriter, err error) {
+	he := err.(*httpError)
+	if he.err != nil {
+		maybeerr(w, he.err, he.code, "%s", he.msg)
+	} else {
+		texterr(w, he.code, "%s", he.msg)
+	}
+}
+
+func editRedirect(w http.ResponseWriter, r *http.Request, newid int64, issues []data.RuleIssue) {
+	http.Redirect(w, r, sitePath(r, "/edit/"+electionRef(r, newid)), http.StatusFound)
 }
 
-func editContextFinish(w http.ResponseWriter, r *http.Request, newid int64) {
+func editContextFinish(w http.ResponseWriter, r *http.Request, newid int64, issues []data.RuleIssue) {
 	ec := EditContext{}
-	ec.set(newid)
+	ec.set(r, newid)
+	for _, issue := range issues {
+		if issue.Severity == data.IssueError {
+			ec.Errors = append(ec.Errors, issue)
+		} else {
+			ec.Warnings = append(ec.Warnings, issue)
+		}
+	}
 	out, err := json.Marshal(ec)
 	if maybeerr(w, err, 500, "json ret prep") {
 		return
@@ -353,15 +1317,20 @@ func editContextFinish(w http.ResponseWriter, r *http.Request, newid int64) {
 }
 
 func (sh *StudioHandler) handleElectionDocGET(w http.ResponseWriter, r *http.Request, user *login.User, itemid int64) {
+	edb := sh.edb.WithContext(r.Context())
 	// Allow everything to be readable? TODO: flexible ACL?
 	// if user == nil {
 	// 	texterr(w, http.StatusUnauthorized, "nope")
 	// 	return
 	// }
-	er, err := sh.edb.GetElection(itemid)
+	er, err := edb.GetElection(itemid)
 	if maybeerr(w, err, 400, "no item") {
 		return
 	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", itemid)
+		return
+	}
 	// Allow everything to be readable? TODO: flexible ACL?
 	// if user.Guid != er.Owner {
 	// 	texterr(w, http.StatusForbidden, "nope")
@@ -378,7 +1347,12 @@ func (sh *StudioHandler) handleElectionDocGET(w http.ResponseWriter, r *http.Req
 	if maybeerr(w, err, 400, "re-json body") {
 		return
 	}
+	state, err := edb.GetElectionState(itemid)
+	if maybeerr(w, err, 500, "db state, %v", err) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Election-State", state)
 	r.ParseForm()
 	download := qbool(r.Form.Get("dl"))
 	download = download || qbool(r.Form.Get("download"))
@@ -389,33 +1363,220 @@ func (sh *StudioHandler) handleElectionDocGET(w http.ResponseWriter, r *http.Req
 	w.Write(nbody)
 }
 
-func (sh *StudioHandler) getPdf(ctx context.Context, el string, redraw bool) (bothob *draw.DrawBothOb, err error) {
-	var cr interface{}
-	if !redraw {
-		cr = sh.cache.Get(el)
+// optionsKey is the cache key for name drawn with opts from the query
+func optionsKey(name string, opts draw.RenderOptions) string {
+	if opts == (draw.RenderOptions{}) {
+		return name
 	}
-	if cr != nil {
-		bothob = cr.(*draw.DrawBothOb)
-	} else {
+	return name + "?" + opts.Query().Encode()
+}
+
+// renderKey is the cache key for a render of el's document doc with opts
+// from the query. It has a hash of the document, which covers the
+// document's own RenderOptions, so saving a new version misses the cache
+// without anything having to be invalidated. The stale cache is keyed
+// without it (optionsKey), as it's for the last good render of any version.
+func renderKey(el, doc string, opts draw.RenderOptions) string {
+	return optionsKey(el+"#"+sha256Hex([]byte(doc))[:16], opts)
+}
+
+// renderElection is the election to draw for el
+func (sh *StudioHandler) renderElection(ctx context.Context, el string) (*electionRecord, error) {
+	electionid, err := strconv.ParseInt(el, 10, 64)
+	if err != nil {
+		return nil, &httpError{400, "bad item", err}
+	}
+	er, err := sh.edb.WithContext(ctx).GetElection(electionid)
+	if err != nil {
+		return nil, &httpError{400, "no item", err}
+	}
+	if er.Trashed != 0 {
+		return nil, &httpError{404, "no item", errTrashed}
+	}
+	return er, nil
+}
+
+// renderQueryOptions reads a render's RenderOptions from its query, and
+// final=1, which asks for a production ballot: only drawn for an approved
+// election and never as a proof. It writes an error and returns !ok if the
+// render shouldn't happen.
+func (sh *StudioHandler) renderQueryOptions(w http.ResponseWriter, query url.Values, el string) (opts draw.RenderOptions, ok bool) {
+	opts, err := draw.ParseRenderOptions(query)
+	if maybeerr(w, err, 400, "%v", err) {
+		return opts, false
+	}
+	if v := query.Get("final"); v != "" {
+		final, err := strconv.ParseBool(v)
+		if maybeerr(w, err, 400, "bad final %#v", v) {
+			return opts, false
+		}
+		if !final {
+			return opts, true
+		}
+		if opts.Proof {
+			texterr(w, 400, "final and proof are exclusive")
+			return opts, false
+		}
 		electionid, err := strconv.ParseInt(el, 10, 64)
-		if err != nil {
-			return nil, &httpError{400, "bad item", err}
+		if maybeerr(w, err, 400, "bad item") {
+			return opts, false
 		}
-		er, err := sh.edb.GetElection(electionid)
-		if err != nil {
-			return nil, &httpError{400, "no item", err}
+		if sh.checkElectionState(w, electionid, actionFinal) {
+			return opts, false
 		}
-		bothob, err = draw.DrawElection(sh.drawBackend, er.Data)
-		if err != nil {
-			return nil, &httpError{500, "draw fail", err}
+	}
+	return opts, true
+}
+
+// getPdf draws election el, opts overriding its RenderOptions. The caller
+// holds the render and must Release it, which keeps a spooled PDF's file
+// until it's read.
+func (sh *StudioHandler) getPdf(ctx context.Context, el string, opts draw.RenderOptions, redraw bool) (bothob *draw.DrawBothOb, err error) {
+	er, err := sh.renderElection(ctx, el)
+	if err != nil {
+		return nil, err
+	}
+	key := renderKey(el, er.Data, opts)
+	if !redraw {
+		// one the cache let go of since Get is as good as a miss
+		if cr, ok := sh.cache.Get(key).(*draw.DrawBothOb); ok && cr.Hold() {
+			noteWarnings(ctx, cr.Warnings)
+			return cr, nil
+		}
+		if he := sh.cachedFailure(key); he != nil {
+			return nil, he
 		}
-		sh.cache.Put(el, bothob, len(bothob.Pdf)+len(bothob.BubblesJson))
 	}
-	return
+	drew := false
+	v, err := sh.renderFlights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		drew = true
+		return sh.drawPdf(ctx, er, key, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	drawn := v.(drawnRender)
+	bothob = drawn.render.(*draw.DrawBothOb)
+	// drawPdf's hold is ours; waiting on someone else's draw takes another
+	if !drew && !bothob.Hold() {
+		return sh.getPdf(ctx, el, opts, redraw)
+	}
+	if drawn.stale {
+		markStale(ctx)
+	}
+	noteWarnings(ctx, bothob.Warnings)
+	return bothob, nil
+}
+
+// drawPdf draws er into the cache at key, for getPdf, which gets the hold on it
+func (sh *StudioHandler) drawPdf(ctx context.Context, er *electionRecord, key string, opts draw.RenderOptions) (drawnRender, error) {
+	electionid := er.Id
+	el := strconv.FormatInt(electionid, 10)
+	doc, err := inlineMedia(sh.media, er.Data)
+	if err != nil {
+		return drawnRender{}, &httpError{500, "bad election json", err}
+	}
+	start := time.Now()
+	bothob, err := sh.drawClient.DrawElection(ctx, doc, opts)
+	if err != nil {
+		if he := canceled(ctx, err); he != nil {
+			return drawnRender{}, he
+		}
+		if ue, ok := err.(*draw.UnsupportedError); ok {
+			sh.renderFailures.fail(electionid, err)
+			return drawnRender{}, sh.rememberFailure(key, &httpError{501, ue.Error(), err})
+		}
+		if errors.Is(err, draw.ErrNoProfile) {
+			return drawnRender{}, sh.rememberFailure(key, &httpError{400, err.Error(), err})
+		}
+		if !draw.IsUnavailable(err) {
+			sh.renderFailures.fail(electionid, err)
+			go sh.notifySlow(er.Owner, time.Since(start), fmt.Sprintf("BallotStudio: election %d failed to render", electionid), fmt.Sprintf("Rendering the ballot for election %d failed, %v\n", electionid, err))
+			return drawnRender{}, sh.rememberFailure(key, &httpError{500, "draw fail", err})
+		}
+		old, ok := sh.stale.Get(optionsKey(el, opts)).(*draw.DrawBothOb)
+		if !ok || !old.Hold() {
+			return drawnRender{}, &httpError{503, "draw backend unavailable", err}
+		}
+		return drawnRender{old, true}, nil
+	}
+	size := int(bothob.PdfSize()) + len(bothob.BubblesJson)
+	for _, page := range bothob.Png {
+		size += len(page)
+	}
+	sh.cache.Put(key, bothob, size)
+	sh.stale.Put(optionsKey(el, opts), bothob, size)
+	sh.renderFailures.ok(electionid)
+	sh.fireWebhooks(webhookRender, electionid, map[string]interface{}{"options": opts.Query().Encode(), "pdf_bytes": bothob.PdfSize()})
+	go sh.notifySlow(er.Owner, time.Since(start), fmt.Sprintf("BallotStudio: election %d rendered", electionid), fmt.Sprintf("The ballot for election %d is rendered.\n", electionid))
+	return drawnRender{bothob, false}, nil
+}
+
+func (sh *StudioHandler) getPamphlet(ctx context.Context, el string, redraw bool) (pdf []byte, err error) {
+	er, err := sh.renderElection(ctx, el)
+	if err != nil {
+		return nil, err
+	}
+	staleKey := el + "_pamphlet.pdf"
+	key := renderKey(staleKey, er.Data, draw.RenderOptions{})
+	if !redraw {
+		if cr, ok := sh.cache.Get(key).([]byte); ok {
+			return cr, nil
+		}
+		if he := sh.cachedFailure(key); he != nil {
+			return nil, he
+		}
+	}
+	v, err := sh.renderFlights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return sh.drawPamphlet(ctx, er, key, staleKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	drawn := v.(drawnRender)
+	if drawn.stale {
+		markStale(ctx)
+	}
+	return drawn.render.([]byte), nil
+}
+
+// drawPamphlet draws er's pamphlet into the cache at key, for getPamphlet
+func (sh *StudioHandler) drawPamphlet(ctx context.Context, er *electionRecord, key, staleKey string) (drawnRender, error) {
+	doc, err := inlineMedia(sh.media, er.Data)
+	if err != nil {
+		return drawnRender{}, &httpError{500, "bad election json", err}
+	}
+	pdf, err := sh.drawClient.DrawPamphlet(ctx, doc)
+	if err != nil {
+		if he := canceled(ctx, err); he != nil {
+			return drawnRender{}, he
+		}
+		if err == draw.ErrNoPamphlet {
+			return drawnRender{}, &httpError{501, "no draw backend for pamphlets, run with -draw-backend", err}
+		}
+		if ue, ok := err.(*draw.UnsupportedError); ok {
+			return drawnRender{}, sh.rememberFailure(key, &httpError{501, ue.Error(), err})
+		}
+		if !draw.IsUnavailable(err) {
+			return drawnRender{}, sh.rememberFailure(key, &httpError{500, "draw fail", err})
+		}
+		old, ok := sh.stale.Get(staleKey).([]byte)
+		if !ok {
+			return drawnRender{}, &httpError{503, "draw backend unavailable", err}
+		}
+		return drawnRender{old, true}, nil
+	}
+	sh.cache.Put(key, pdf, len(pdf))
+	sh.stale.Put(staleKey, pdf, len(pdf))
+	return drawnRender{pdf, false}, nil
 }
 
-func (sh *StudioHandler) getPng(ctx context.Context, el string, redraw bool) (pngbytes [][]byte, err error) {
-	pngkey := el + ".png"
+func (sh *StudioHandler) getPng(ctx context.Context, el string, opts draw.RenderOptions, redraw bool) (pngbytes [][]byte, err error) {
+	er, err := sh.renderElection(ctx, el)
+	if err != nil {
+		return nil, err
+	}
+	pngkey := renderKey(el+".png", er.Data, opts)
 	var cr interface{}
 	if !redraw {
 		cr = sh.cache.Get(pngkey)
@@ -424,14 +1585,37 @@ func (sh *StudioHandler) getPng(ctx context.Context, el string, redraw bool) (pn
 		pngbytes = cr.([][]byte)
 		return
 	}
+	ctx, note := withStaleNote(ctx)
 	var bothob *draw.DrawBothOb
-	bothob, err = sh.getPdf(ctx, el, false)
+	bothob, err = sh.getPdf(ctx, el, opts, false)
 	if err != nil {
 		return nil, err
 	}
-	pngbytes, err = draw.PdfToPng(ctx, bothob.Pdf)
-	if err != nil {
-		return nil, &httpError{500, "png fail", err}
+	defer bothob.Release()
+	if len(bothob.Png) != 0 {
+		pngbytes = bothob.Png
+	} else {
+		// by the PDF, which may be a stale one
+		var v interface{}
+		v, err = sh.renderFlights.do(ctx, "png "+sumETag(bothob.PdfSum()), func(ctx context.Context) (interface{}, error) {
+			pdf, err := bothob.PdfBytes()
+			if err != nil {
+				return nil, &httpError{500, "render spool", err}
+			}
+			pngbytes, err := draw.PdfToPng(ctx, pdf)
+			if err != nil {
+				return nil, pngError(ctx, err)
+			}
+			return pngbytes, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		pngbytes = v.([][]byte)
+	}
+	if note.stale || len(note.warnings) != 0 {
+		// not cached, so later responses get the headers from getPdf
+		return
 	}
 	tlen := 0
 	for _, page := range pngbytes {
@@ -441,6 +1625,17 @@ func (sh *StudioHandler) getPng(ctx context.Context, el string, redraw bool) (pn
 	return
 }
 
+// pngError is the httpError for draw.PdfToPng failing with err
+func pngError(ctx context.Context, err error) *httpError {
+	if he := canceled(ctx, err); he != nil {
+		return he
+	}
+	if errors.Is(err, draw.ErrPngBusy) {
+		return &httpError{http.StatusServiceUnavailable, "too many page images being made, try again soon", err}
+	}
+	return &httpError{500, "png fail", err}
+}
+
 type httpError struct {
 	code int
 	msg  string
@@ -460,28 +1655,51 @@ type editHandler struct {
 
 type EditContext struct {
 	ElectionId    int64  `json:"itemid,omitepmty"`
+	PublicId      string `json:"publicid,omitempty"` // see publicid.go
 	PDFURL        string `json:"pdf,omitepmty"`
 	BubbleJSONURL string `json:"bubbles,omitepmty"`
+	PamphletURL   string `json:"pamphlet,omitempty"`
 	ScanFormURL   string `json:"scan,omitepmty"`
 	PostURL       string `json:"post,omitempty"`
 	EditURL       string `json:"edit,omitempty"`
 	GETURL        string `json:"url,omitempty"`
 	StaticRoot    string `json:"staticroot,omitempty"`
+	State         string `json:"state,omitempty"`
+	StateURL      string `json:"stateurl,omitempty"`
+	ReadinessURL  string `json:"readiness,omitempty"`
+	ResultsURL    string `json:"results,omitempty"`
+	Nonce         string `json:"-"` // CSP nonce for script tags
+	CSRF          string `json:"csrf,omitempty"`
+
+	// validation rule findings for the document just saved
+	Errors   []data.RuleIssue `json:"errors,omitempty"`
+	Warnings []data.RuleIssue `json:"warnings,omitempty"`
 }
 
-func (ec *EditContext) set(eid int64) {
+// set fills in the URLs for election eid, or a new election if 0, for
+// request r on a server that may be mounted under a prefix
+func (ec *EditContext) set(r *http.Request, eid int64) {
+	base := basePath(r)
 	if eid == 0 {
-		ec.PostURL = "/election"
+		ec.PostURL = base + "/election"
 	} else {
 		ec.ElectionId = eid
-		ec.PDFURL = fmt.Sprintf("/election/%d.pdf", eid)
-		ec.BubbleJSONURL = fmt.Sprintf("/election/%d_bubbles.json", eid)
-		ec.ScanFormURL = fmt.Sprintf("/election/%d/scan", eid)
-		ec.PostURL = fmt.Sprintf("/election/%d", eid)
-		ec.EditURL = fmt.Sprintf("/edit/%d", eid)
-		ec.GETURL = fmt.Sprintf("/election/%d", eid)
+		ref := electionRef(r, eid)
+		if ref != strconv.FormatInt(eid, 10) {
+			ec.PublicId = ref
+		}
+		ec.PDFURL = fmt.Sprintf("%s/election/%s.pdf", base, ref)
+		ec.BubbleJSONURL = fmt.Sprintf("%s/election/%s_bubbles.json", base, ref)
+		ec.PamphletURL = fmt.Sprintf("%s/election/%s_pamphlet.pdf", base, ref)
+		ec.ScanFormURL = fmt.Sprintf("%s/election/%s/scan", base, ref)
+		ec.PostURL = fmt.Sprintf("%s/election/%s", base, ref)
+		ec.EditURL = fmt.Sprintf("%s/edit/%s", base, ref)
+		ec.GETURL = fmt.Sprintf("%s/election/%s", base, ref)
+		ec.StateURL = fmt.Sprintf("%s/election/%s/state", base, ref)
+		ec.ReadinessURL = fmt.Sprintf("%s/election/%s/readiness", base, ref)
+		ec.ResultsURL = fmt.Sprintf("%s/election/%s/results", base, ref)
 	}
-	ec.StaticRoot = "/static"
+	ec.StaticRoot = base + "/static"
 }
 
 func (ec EditContext) Json() template.JS {
@@ -514,7 +1732,12 @@ func (edit *editHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "text/html")
 	ec := EditContext{}
-	ec.set(electionid)
+	ec.set(r, electionid)
+	ec.Nonce = cspNonce(r)
+	ec.CSRF = csrfToken(r)
+	if electionid != 0 {
+		ec.State, _ = edit.edb.GetElectionState(electionid)
+	}
 	t, err := edit.ts.Lookup("edit.html")
 	if maybeerr(w, err, 500, "edit.html: %v", err) {
 		return
@@ -538,11 +1761,19 @@ func addrGetPort(listenAddr string) int {
 	return int(v)
 }
 
-func sigtermHandler(c <-chan os.Signal, server *http.Server, cf func()) {
+// sigtermHandler stops accepting connections and waits up to drain for requests in progress, then closes done
+func sigtermHandler(c <-chan os.Signal, server *http.Server, cf func(), drain time.Duration, done chan<- struct{}) {
+	defer close(done)
 	_, ok := <-c
 	if ok {
-		go cf()
-		server.Shutdown(context.Background())
+		log.Print("draining")
+		ctx, dcf := context.WithTimeout(context.Background(), drain)
+		defer dcf()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("shutdown, %v", err)
+		}
+		cf()
 	}
 }
 
@@ -554,40 +1785,327 @@ func exists(path string) (out string, ok bool) {
 	return "", false
 }
 
+// startDrawBackend is the url to draw with: drawBackend if set, otherwise
+// that of a draw server run with flaskPath (or ./flask or
+// bsvenv/bin/flask), or "" to draw in process. Stop the returned
+// DrawServer when done; if none was started that does nothing.
+func startDrawBackend(drawBackend, flaskPath string) (*draw.DrawServer, string, error) {
+	drawserver := &draw.DrawServer{}
+	if len(drawBackend) == 0 && flaskPath == "" {
+		for _, fp := range []string{"./flask", "bsvenv/bin/flask"} {
+			var ok bool
+			flaskPath, ok = exists(fp)
+			if ok {
+				break
+			}
+		}
+	}
+	if len(drawBackend) == 0 && flaskPath != "" {
+		drawserver.FlaskPath = flaskPath
+		err := drawserver.Start()
+		if err != nil {
+			return drawserver, "", err
+		}
+		drawBackend = drawserver.BackendUrl()
+	}
+	if len(drawBackend) == 0 {
+		log.Printf("no -draw-backend or flask, drawing ballots in process (lower fidelity, no pamphlets)")
+	}
+	return drawserver, drawBackend, nil
+}
+
 func main() {
+	// `ballotstudio [command] [flags]`, no command runs the server
+	var subcommand string
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		subcommand = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	// `ballotstudio admin user promote 7 [flags]`, the words before the flags
+	var adminArgs []string
+	for subcommand == "admin" && len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		adminArgs = append(adminArgs, os.Args[1])
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	var backupPath string
+	var renderIn, renderOut, renderBubbles, renderOptions string
+	var scanBubbles, scanOrig, scanImg string
+	var adminOpts adminOptions
+	switch subcommand {
+	case "":
+	case "backup":
+		flag.StringVar(&backupPath, "out", "", "file to write backup tar.gz to, - for stdout")
+	case "restore":
+		flag.StringVar(&backupPath, "in", "", "backup tar.gz to restore from into empty databases, - for stdin")
+	case "render":
+		flag.StringVar(&renderIn, "in", "", "election json to draw, - for stdin")
+		flag.StringVar(&renderOut, "out", "", "file to write the ballot PDF to, - for stdout")
+		flag.StringVar(&renderBubbles, "bubbles", "", "file to write the bubbles json to")
+		flag.StringVar(&renderOptions, "options", "", "render options as in a PDF URL's query, e.g. pagesize=a4&duplex=1")
+	case "validate", "selftest":
+	case "scan":
+		flag.StringVar(&scanBubbles, "bubbles", "", "bubbles json of the ballot")
+		flag.StringVar(&scanOrig, "orig", "", "the ballot page as drawn, PNG, or the ballot PDF")
+		flag.StringVar(&scanImg, "img", "", "scanned image, JPEG, PNG or PDF; more may follow the flags")
+	case "admin":
+		flag.StringVar(&adminOpts.Email, "email", "", "staff email for admin user promote, if the user has none on file")
+		flag.DurationVar(&adminOpts.Expires, "expires", 24*time.Hour, "how long an admin invite create link is good for")
+	default:
+		log.Printf("unknown command %#v, want backup, restore, render, validate, scan, selftest or admin (or none to run the server)", subcommand)
+		os.Exit(1)
+	}
 	var listenAddr string
-	flag.StringVar(&listenAddr, "http", ":8180", "interface:port to listen on, default \":8180\"")
+	flag.StringVar(&listenAddr, "http", ":8180", "interface:port to listen on, default \":8180\"; several separated by commas. Sockets passed by systemd socket activation are used instead")
 	var oauthConfigPath string
 	flag.StringVar(&oauthConfigPath, "oauth-json", "", "json file with oauth configs")
+	var oidcConfigPath string
+	flag.StringVar(&oidcConfigPath, "oidc-json", "", "json file listing OpenID Connect providers: name, issuer, client_id, client_secret")
+	var oidcKeyb64 string
+	flag.StringVar(&oidcKeyb64, "oidc-key", "", "base64 of 32 bytes; needed with -oidc-json, changing it stops OpenID Connect users signing in")
+	var samlConfigPath string
+	flag.StringVar(&samlConfigPath, "saml-json", "", "json file describing a SAML identity provider: name, idp_metadata_url or idp_metadata_file, attribute mappings")
+	var samlKeyb64 string
+	flag.StringVar(&samlKeyb64, "saml-key", "", "base64 of 32 bytes; needed with -saml-json, changing it stops SAML users signing in")
 	var sqlitePath string
 	flag.StringVar(&sqlitePath, "sqlite", "", "path to sqlite3 db to keep local data in")
+	flag.StringVar(&sqliteSettings.JournalMode, "sqlite-journal-mode", sqliteSettings.JournalMode, "sqlite journal_mode pragma; WAL lets scans and editor saves not block readers")
+	flag.DurationVar(&sqliteSettings.BusyTimeout, "sqlite-busy-timeout", sqliteSettings.BusyTimeout, "how long a sqlite write waits for another's lock before \"database is locked\"")
+	flag.StringVar(&sqliteSettings.Synchronous, "sqlite-synchronous", sqliteSettings.Synchronous, "sqlite synchronous pragma: OFF, NORMAL or FULL")
 	var postgresConnectString string
 	flag.StringVar(&postgresConnectString, "postgres", "", "connection string to postgres database")
+	var mysqlConnectString string
+	flag.StringVar(&mysqlConnectString, "mysql", "", "connection string (DSN) to mysql or mariadb database")
+	var scanBackend string
+	flag.StringVar(&scanBackend, "scan-backend", "", "url of a scan interpreter service (see scan.Client); if unset, read scans in process")
+	var migrateTo string
+	flag.StringVar(&migrateTo, "migrate", "", "migrate the election db schema and exit: status, latest, or a version number to go up or roll back to")
+	var loginDBSpec string
+	flag.StringVar(&loginDBSpec, "login-db", "", "keep users in a separate database, {sqlite|postgres}:connect; default is the election database")
 	var drawBackend string
-	flag.StringVar(&drawBackend, "draw-backend", "", "url to drawing backend")
+	flag.StringVar(&drawBackend, "draw-backend", "", "url to drawing backend; if unset, run draw/app.py with -flask (or ./flask or bsvenv/bin/flask), or failing that draw ballots in process")
+	dc := draw.NewClient("")
+	flag.DurationVar(&dc.Timeout, "draw-timeout", dc.Timeout, "how long one draw backend request may take, 0 for no limit")
+	timeouts := routeTimeouts{Request: 30 * time.Second, Render: 2 * time.Minute, Upload: 5 * time.Minute}
+	flag.DurationVar(&timeouts.Request, "request-timeout", timeouts.Request, "how long a request may take before its work is canceled, 0 for no limit")
+	flag.DurationVar(&timeouts.Render, "render-timeout", timeouts.Render, "how long a request that draws ballots may take, 0 for no limit")
+	flag.DurationVar(&timeouts.Upload, "upload-timeout", timeouts.Upload, "how long a POST or PUT may take, 0 for no limit")
+	flag.IntVar(&dc.MaxConcurrent, "draw-concurrency", dc.MaxConcurrent, "draw backend requests allowed in flight, 0 for unlimited")
+	var docCacheBytes uint64
+	flag.Uint64Var(&docCacheBytes, "doc-cache-bytes", 0, "keep up to this much of recently read election documents in memory, 0 to always read the database")
+	var docCacheTTL time.Duration
+	flag.DurationVar(&docCacheTTL, "doc-cache-ttl", 5*time.Second, "how long a document kept by -doc-cache-bytes is used before it's read again, bounding how long a save by another server goes unseen")
+	var renderFailureTTL time.Duration
+	flag.DurationVar(&renderFailureTTL, "render-failure-ttl", 10*time.Second, "how long a render that failed on its document is cached before it's drawn again, 0 to not cache failures")
+	flag.StringVar(&dc.Spool, "render-spool", "", "directory to stream rendered PDFs into and serve them from, instead of holding them in memory")
+	flag.IntVar(&draw.PngConversions.Max, "pdftopng-concurrency", draw.PngConversions.Max, "pdftoppm conversions allowed at once, 0 for unlimited; default the number of CPUs")
+	flag.IntVar(&draw.PngConversions.MaxQueue, "pdftopng-queue", draw.PngConversions.MaxQueue, "pdftoppm conversions allowed to wait for a turn before more are refused with 503, 0 for unlimited")
+	flag.IntVar(&dc.Retries, "draw-retries", dc.Retries, "retries when the draw backend is unreachable or answers 502/503/504")
+	flag.DurationVar(&dc.Backoff, "draw-backoff", dc.Backoff, "wait before the first draw retry, doubling after that")
+	flag.IntVar(&dc.BreakerFailures, "draw-breaker-failures", dc.BreakerFailures, "consecutive draw backend failures that stop calling it for -draw-breaker-cooldown, 0 to always call")
+	flag.DurationVar(&dc.BreakerCooldown, "draw-breaker-cooldown", dc.BreakerCooldown, "how long to stop calling a failing draw backend, serving older renders meanwhile")
+	flag.BoolVar(&dc.Strict, "draw-strict", false, "fail renders that need something the draw backend lacks, instead of leaving it out with a Warning header")
 	var imageArchiveDir string
 	flag.StringVar(&imageArchiveDir, "im-archive-dir", "", "directory to archive uploaded scanned images to; will mkdir -p")
 	var cookieKeyb64 string
 	flag.StringVar(&cookieKeyb64, "cookie-key", "", "base64 of 16 bytes for encrypting cookies")
+	var reusePort bool
+	flag.BoolVar(&reusePort, "reuseport", false, "listen with SO_REUSEPORT so a new server can start on the same port before this one exits")
+	tuning := serverTuning{ReadHeaderTimeout: 10 * time.Second, ReadTimeout: 10 * time.Minute, IdleTimeout: 2 * time.Minute, MaxHeaderBytes: 64 << 10, HTTP2: true}
+	flag.DurationVar(&tuning.ReadHeaderTimeout, "read-header-timeout", tuning.ReadHeaderTimeout, "how long a client may take to send request headers, 0 for no limit")
+	flag.DurationVar(&tuning.ReadTimeout, "read-timeout", tuning.ReadTimeout, "how long a client may take to send a whole request, body included, 0 for no limit; keep it longer than -upload-timeout")
+	flag.DurationVar(&tuning.WriteTimeout, "write-timeout", tuning.WriteTimeout, "how long writing a response may take, 0 for no limit; keep it longer than -render-timeout")
+	flag.DurationVar(&tuning.IdleTimeout, "idle-timeout", tuning.IdleTimeout, "how long a keep-alive connection may wait for its next request, 0 for no limit")
+	flag.IntVar(&tuning.MaxHeaderBytes, "max-header-bytes", tuning.MaxHeaderBytes, "most request header bytes read, 0 for the net/http default of 1MB")
+	flag.BoolVar(&tuning.HTTP2, "http2", tuning.HTTP2, "offer HTTP/2 to clients connecting with TLS")
+	var tlsCert, tlsKey string
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate (chain) file to serve HTTPS with -tls-key, instead of plain HTTP")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key file for -tls-cert")
+	var drainTimeout time.Duration
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "on SIGTERM, how long to let requests in progress finish")
 	var pidpath string
 	flag.StringVar(&pidpath, "pid", "", "path to write process id to")
 	var debug bool
 	flag.BoolVar(&debug, "debug", false, "more logging")
 	var flaskPath string
 	flag.StringVar(&flaskPath, "flask", "", "path to flask for running draw/app.py")
+	var overrideDir string
+	flag.StringVar(&overrideDir, "override-dir", "", "directory with gotemplates/ and static/ to serve instead of the built in copies")
+	var devMode bool
+	flag.BoolVar(&devMode, "dev", false, "development mode, serve from -override-dir (default \".\") and reload templates when they change")
+	var renderRate, renderBurst float64
+	flag.Float64Var(&renderRate, "render-rate", 2, "pdf/png renders per second allowed per user or IP, 0 for unlimited")
+	flag.Float64Var(&renderBurst, "render-burst", 20, "burst of renders allowed before -render-rate applies")
+	var scanRate, scanBurst float64
+	flag.Float64Var(&scanRate, "scan-rate", 1, "scan uploads per second allowed per user or IP, 0 for unlimited")
+	flag.Float64Var(&scanBurst, "scan-burst", 10, "burst of scan uploads allowed before -scan-rate applies")
+	var mediaMaxBytes int64
+	flag.Int64Var(&mediaMaxBytes, "media-max-bytes", DefaultMediaMaxBytes, "largest candidate photo or party symbol upload accepted")
+	var fontMaxBytes int64
+	flag.Int64Var(&fontMaxBytes, "font-max-bytes", DefaultFontMaxBytes, "largest font upload accepted")
+	var docMaxBytes int64
+	flag.Int64Var(&docMaxBytes, "doc-max-bytes", DefaultDocMaxBytes, "largest election document accepted; inline images are moved out to media when saved")
+	var scanMaxBytes int64
+	flag.Int64Var(&scanMaxBytes, "scan-max-bytes", DefaultScanMaxBytes, "largest scan upload accepted")
+	var scanCustodyOptional bool
+	flag.BoolVar(&scanCustodyOptional, "scan-custody-optional", false, "accept scans without device, operator, batch and precinct, for demos")
+	var maxUploads, maxScanUploads, maxDocUploads int
+	flag.IntVar(&maxUploads, "max-uploads", 16, "simultaneous uploads allowed across the server, 0 for unlimited")
+	flag.IntVar(&maxScanUploads, "max-scan-uploads", 8, "simultaneous scan uploads allowed, 0 for unlimited")
+	flag.IntVar(&maxDocUploads, "max-doc-uploads", 8, "simultaneous election document uploads allowed, 0 for unlimited")
+	var maxUploadBytes int64
+	flag.Int64Var(&maxUploadBytes, "max-upload-bytes", 100000000, "total bytes of uploads allowed in flight across the server, 0 for unlimited")
+	var loginRate, loginBurst float64
+	flag.Float64Var(&loginRate, "login-rate", 0.2, "login/signup attempts per second allowed per IP, 0 for unlimited")
+	flag.Float64Var(&loginBurst, "login-burst", 10, "burst of login attempts allowed before -login-rate applies")
+	var smtpAddr, smtpUser, smtpPassword, mailFrom string
+	flag.StringVar(&smtpAddr, "smtp", "", "host:port of SMTP server for digest and notification emails; if unset they are only logged")
+	flag.StringVar(&smtpUser, "smtp-user", "", "SMTP login, if the server wants one")
+	flag.StringVar(&smtpPassword, "smtp-password", "", "SMTP password")
+	flag.StringVar(&mailFrom, "mail-from", "ballotstudio@localhost", "From: address of digest and notification emails")
+	var adminUsers string
+	flag.StringVar(&adminUsers, "admin", "", "comma separated usernames who may provision staff at /admin/staff")
+	var shareKeyb64 string
+	flag.StringVar(&shareKeyb64, "share-key", "", "base64 of 32 bytes for signing share links")
+	var quotas quotaLimits
+	flag.Int64Var(&quotas.Elections, "quota-elections", 0, "most untrashed elections a user may own, 0 for no limit")
+	flag.Int64Var(&quotas.ScanBytes, "quota-scan-bytes", 0, "most scan image bytes stored for a user's elections, 0 for no limit")
+	flag.Int64Var(&quotas.Revisions, "quota-revisions", 0, "revisions kept per election, oldest dropped first, 0 to keep all")
+	var accountDeleteElections string
+	flag.StringVar(&accountDeleteElections, "account-delete-elections", "purge", "what happens to a deleted account's elections: purge, or a user number to give them to")
+	var idKeyb64 string
+	flag.StringVar(&idKeyb64, "id-key", "", "base64 of 16 bytes; election links use public ids encrypted under it instead of numbers")
+	var requirePublicIds bool
+	flag.BoolVar(&requirePublicIds, "require-public-ids", false, "404 election numbers in paths for requests not logged in, so documents can't be enumerated; needs -id-key")
+	var csp string
+	flag.StringVar(&csp, "csp", defaultCSP, "Content-Security-Policy header, {nonce} is replaced per request; empty to not send one")
+	var corsOrigins string
+	flag.StringVar(&corsOrigins, "cors-origins", "", "comma separated origins (https://app.example.com) allowed to use the API from the browser, * for read-only from anywhere")
+	var trustedProxies string
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated IPs or CIDRs of reverse proxies whose X-Forwarded-For and X-Forwarded-Proto are believed")
+	var baseURLs string
+	flag.StringVar(&baseURLs, "base-url", "", "/prefix or https://host/prefix the server is reached at behind a reverse proxy, for links it generates")
+	var webhookPrivate bool
+	flag.BoolVar(&webhookPrivate, "webhook-private", false, "allow webhooks to loopback and private network addresses")
+	gc := defaultGCPolicy()
+	flag.DurationVar(&gc.StaleDraftAge, "stale-draft-age", 0, "move drafts not saved in this long (e.g. 4320h) to the trash; 0 never does")
+	flag.DurationVar(&gc.Every, "gc-interval", gc.Every, "how often expired invites, trash, webhook history and draft revisions are cleaned up, 0 never does")
+	flag.DurationVar(&gc.CacheEvery, "gc-cache-interval", gc.CacheEvery, "how often idle renders and renders of deleted elections are dropped from the caches, 0 never does")
+	flag.DurationVar(&gc.CacheIdle, "gc-cache-idle", gc.CacheIdle, "drop renders nobody has asked for in this long")
+	flag.DurationVar(&gc.StaleCacheIdle, "gc-stale-cache-idle", gc.StaleCacheIdle, "drop last good renders, for when the draw backend is down, nobody has asked for in this long")
+	flag.DurationVar(&gc.MediaOrphanAge, "gc-media-orphan-age", gc.MediaOrphanAge, "delete uploaded images no election refers to once they're this old")
+	flag.DurationVar(&gc.TrashRetention, "gc-trash-retention", gc.TrashRetention, "how long elections stay in the trash before they're deleted for good")
+	flag.DurationVar(&gc.WebhookRetention, "gc-webhook-retention", gc.WebhookRetention, "how long webhook delivery history is kept")
+	flag.Int64Var(&gc.DraftRevisions, "gc-draft-revisions", 0, "newest revisions (every save, autosaves too) a draft keeps, older ones are dropped; 0 keeps all")
+	var loadDemo bool
+	flag.BoolVar(&loadDemo, "demo", false, "load example elections (general, primary, ranked choice, multilingual) as published templates, if not already loaded")
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "TOML or YAML file of settings by flag name; BALLOTSTUDIO_{FLAG} env vars also work")
+	var printConfigOnly bool
+	flag.BoolVar(&printConfigOnly, "print-config", false, "print effective config and exit")
 	flag.Parse()
 
+	var configSettings map[string]string
+	if configPath != "" {
+		var err error
+		configSettings, err = parseConfigFile(configPath)
+		maybefail(err, "-config %v", err)
+	}
+	err := applyConfig(flag.CommandLine, configSettings, os.Getenv)
+	maybefail(err, "%v", err)
+	configProblems := serverConfigProblems(flag.CommandLine)
+	if printConfigOnly {
+		printConfig(flag.CommandLine, os.Stdout)
+	}
+	if len(configProblems) != 0 {
+		log.Printf("bad config:\n%s", strings.Join(configProblems, "\n"))
+		os.Exit(1)
+	}
+	if printConfigOnly {
+		return
+	}
+
 	if debug {
 		data.DebugOut = os.Stderr
 		draw.DebugOut = os.Stderr
 	}
 
-	//templates, err := template.ParseGlob("gotemplates/*.html")
-	templates, err := HtmlTemplateGlob("gotemplates/*.html")
-	templates.Reloading = true // TODO: disable for prod
+	if subcommand == "validate" {
+		ok, err := runValidateCommand(flag.Args(), os.Stdout)
+		maybefail(err, "validate, %v", err)
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if subcommand == "scan" {
+		var interpreter scan.Interpreter = scan.Local{}
+		if scanBackend != "" {
+			interpreter = scan.NewClient(scanBackend)
+		}
+		var images []string
+		if scanImg != "" {
+			images = append(images, scanImg)
+		}
+		ok, err := runScanCommand(context.Background(), interpreter, scanBubbles, scanOrig, append(images, flag.Args()...), os.Stdout)
+		maybefail(err, "scan, %v", err)
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if subcommand == "selftest" {
+		var interpreter scan.Interpreter = scan.Local{}
+		if scanBackend != "" {
+			interpreter = scan.NewClient(scanBackend)
+		}
+		drawserver, backend, err := startDrawBackend(drawBackend, flaskPath)
+		maybefail(err, "could not start draw server, %v", err)
+		dc.BackendUrl = backend
+		ok, err := runSelftestCommand(context.Background(), dc, interpreter, os.Stdout)
+		drawserver.Stop()
+		maybefail(err, "selftest, %v", err)
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if subcommand == "render" {
+		var media MediaStore
+		if imageArchiveDir != "" {
+			archiver, err := NewFileImageArchiver(imageArchiveDir)
+			maybefail(err, "image archive dir, %v", err)
+			media = archiver.(MediaStore)
+		}
+		drawserver, backend, err := startDrawBackend(drawBackend, flaskPath)
+		maybefail(err, "could not start draw server, %v", err)
+		dc.BackendUrl = backend
+		err = runRenderCommand(context.Background(), dc, media, renderIn, renderOut, renderBubbles, renderOptions)
+		drawserver.Stop()
+		maybefail(err, "render, %v", err)
+		return
+	}
+
+	if devMode && overrideDir == "" {
+		overrideDir = "."
+	}
+	var templateFS, staticFS fs.FS
+	if overrideDir != "" {
+		templateFS = os.DirFS(overrideDir)
+		staticFS = os.DirFS(filepath.Join(overrideDir, "static"))
+	} else {
+		templateFS = ballotstudio.Templates
+		staticFS, err = fs.Sub(ballotstudio.Static, "static")
+		maybefail(err, "static, %v", err)
+	}
+	templates, err := HtmlTemplateFS(templateFS, "gotemplates/*.html")
+	templates.Reloading = devMode
 	maybefail(err, "parse templates, %v", err)
-	_, err = templates.Lookup("edit.html")
+	et, err := templates.Lookup("edit.html")
 	maybefail(err, "no edit.html, %v", err)
+	if et == nil {
+		log.Printf("no gotemplates/edit.html in -override-dir %#v", overrideDir)
+		os.Exit(1)
+	}
 
 	if cookieKeyb64 == "" {
 		ck := login.GenerateCookieKey()
@@ -600,99 +2118,233 @@ func main() {
 	}
 
 	var db *sql.DB
+	var dbDriver string
 	var udb login.UserDB
 	var edb electionAppDB
 
 	if len(sqlitePath) > 0 {
-		if len(postgresConnectString) > 0 {
-			fmt.Fprintf(os.Stderr, "error, only one of -sqlite or -postgres should be set")
-			os.Exit(1)
-			return
-		}
 		var err error
-		db, err = sql.Open("sqlite3", sqlitePath)
+		dbDriver = "sqlite3"
+		db, err = sql.Open("sqlite3", sqliteSettings.dsn(sqlitePath))
 		maybefail(err, "error opening sqlite3 db %#v, %v", sqlitePath, err)
 		udb = login.NewSqlUserDB(db)
 		edb = NewSqliteEDB(db)
 	} else if len(postgresConnectString) > 0 {
 		var err error
+		dbDriver = "postgres"
 		db, err = sql.Open("postgres", postgresConnectString)
 		maybefail(err, "error opening postgres db %#v, %v", postgresConnectString, err)
 		udb = login.NewSqlUserDB(db)
 		edb = NewPostgresEDB(db)
+	} else if len(mysqlConnectString) > 0 {
+		// the login package's queries use $n placeholders, which MySQL doesn't take
+		if loginDBSpec == "" {
+			log.Fatal("-mysql keeps elections only, user accounts need -login-db sqlite:... or postgres:...")
+		}
+		var err error
+		dbDriver = "mysql"
+		db, err = sql.Open("mysql", mysqlConnectString)
+		maybefail(err, "error opening mysql db, %v", err)
+		// udb comes from -login-db below
+		edb = NewMysqlEDB(db)
 	} else {
 		log.Print("warning, running with in-memory database that will disappear when shut down")
 		var err error
+		dbDriver = "sqlite3"
 		db, err = sql.Open("sqlite3", ":memory:")
 		maybefail(err, "error opening sqlite3 memory db, %v", err)
 		udb = login.NewSqlUserDB(db)
 		edb = NewSqliteEDB(db)
 	}
 	defer db.Close()
+	electionTableDB := sqlTableDB{db, dbDriver}
+	userTables := electionTableDB
+	if loginDBSpec != "" {
+		var udbCloser io.Closer
+		udb, udbCloser, err = openUserDB(loginDBSpec)
+		maybefail(err, "%v", err)
+		defer udbCloser.Close()
+		userTables = sqlTableDB{driver: loginDBDriver(loginDBSpec)}
+		userTables.db, _ = udbCloser.(*sql.DB)
+	}
+	if migrateTo != "" {
+		err = runMigrate(edb.Migrator(), migrateTo, os.Stdout)
+		maybefail(err, "-migrate %s, %v", migrateTo, err)
+		return
+	}
 	err = edb.Setup()
 	maybefail(err, "edb setup, %v", err)
 	err = udb.Setup()
 	maybefail(err, "udb setup, %v", err)
+	if subcommand == "admin" {
+		baseURL, _ := parseBaseURL(baseURLs)
+		adminOpts.BaseURL = signupBase(listenAddr, baseURL)
+		err = runAdminCommand(adminArgs, edb, udb, adminOpts, os.Stdout)
+		maybefail(err, "admin, %v", err)
+		return
+	}
+	if subcommand != "" {
+		err = runBackupCommand(subcommand, backupPath, edb, electionTableDB, userTables, imageArchiveDir)
+		maybefail(err, "%s, %v", subcommand, err)
+		return
+	}
+	docs := newDocCacheEDB(edb, docCacheBytes, docCacheTTL)
+	edb = docs
+	if loadDemo {
+		loaded, err := loadDemoElections(edb, ballotstudio.Demo)
+		maybefail(err, "-demo, %v", err)
+		log.Printf("-demo loaded %d example elections", loaded)
+	}
 	inviteToken := randomInviteToken(2)
 	err = edb.MakeInviteToken(inviteToken, time.Now().Add(30*time.Minute))
 	maybefail(err, "storing invite token %s, %v", inviteToken, err)
 	ok, expires, err := edb.PeekInviteToken(inviteToken)
 	log.Printf("token=%s ok=%v expires=%s, err=%v", inviteToken, ok, expires, err)
-	log.Printf("http://localhost:%d/signup/%s", addrGetPort(listenAddr), inviteToken)
+	log.Printf("http://localhost:%d/signup/%s (make more with `ballotstudio admin invite create`)", addrGetPort(strings.Split(listenAddr, ",")[0]), inviteToken)
 	ctx, cf := context.WithCancel(context.Background())
 	defer cf()
-	go gcThread(ctx, edb, 57*time.Minute)
 
-	if len(drawBackend) == 0 {
-		var drawserver draw.DrawServer
-		if flaskPath == "" {
-			for _, fp := range []string{"./flask", "bsvenv/bin/flask"} {
-				var ok bool
-				flaskPath, ok = exists(fp)
-				if ok {
-					break
-				}
-			}
-		}
-		drawserver.FlaskPath = flaskPath
-		err = drawserver.Start()
-		maybefail(err, "could not start draw server, %v", err)
-		drawBackend = drawserver.BackendUrl()
-		defer drawserver.Stop()
+	drawserver, drawBackend, err := startDrawBackend(drawBackend, flaskPath)
+	maybefail(err, "could not start draw server, %v", err)
+	defer drawserver.Stop()
+	dc.BackendUrl = drawBackend
+	if dc.Spool != "" {
+		err = draw.ClearSpool(dc.Spool)
+		maybefail(err, "-render-spool %s, %v", dc.Spool, err)
+	}
+	var scanInterpreter scan.Interpreter
+	if scanBackend != "" {
+		scanInterpreter = scan.NewClient(scanBackend)
 	}
 
 	var archiver ImageArchiver
+	var media MediaStore
 	if imageArchiveDir != "" {
 		archiver, err = NewFileImageArchiver(imageArchiveDir)
 		maybefail(err, "image archive dir, %v", err)
+		media = archiver.(MediaStore)
+	} else {
+		log.Print("warning, no -im-archive-dir, uploaded candidate photos will disappear when shut down")
+		media = &memMediaStore{}
 	}
+	globalUploads := NewUploadLimiter(maxUploads, maxUploadBytes, nil)
 	sh := StudioHandler{
 		edb:         edb,
 		udb:         udb,
-		drawBackend: drawBackend,
-		templates:   &templates,
+		drawClient:  dc,
+		templates:   templates,
 		archiver:    archiver,
+		media:       media,
+		renderLimit: NewRateLimiter(renderRate, renderBurst),
+		scanLimit:   NewRateLimiter(scanRate, scanBurst),
+
+		scanInterpreter:     scanInterpreter,
+		scanMaxBytes:        scanMaxBytes,
+		scanCustodyOptional: scanCustodyOptional,
+		mediaMaxBytes:       mediaMaxBytes,
+		fontMaxBytes:        fontMaxBytes,
+		docMaxBytes:         docMaxBytes,
+		scanUploads:         NewUploadLimiter(maxScanUploads, 0, globalUploads),
+		docUploads:          NewUploadLimiter(maxDocUploads, 0, globalUploads),
+
+		renderFailureTTL: renderFailureTTL,
+		docs:             docs.docs,
+
+		mailer: NewMailer(smtpAddr, mailFrom, smtpUser, smtpPassword),
+		admins: make(map[string]bool),
+		quotas: quotas,
+
+		webhookClient: newWebhookClient(webhookPrivate),
+		jobs:          newJobScheduler(),
+	}
+	for _, name := range strings.Split(adminUsers, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			sh.admins[name] = true
+		}
+	}
+	if shareKeyb64 == "" {
+		log.Print("warning, no -share-key, share links will stop working when shut down")
+		sh.shareKey = make([]byte, 32)
+		_, err = rand.Read(sh.shareKey)
+		maybefail(err, "share key, %v", err)
+	} else {
+		sh.shareKey, err = base64.StdEncoding.DecodeString(shareKeyb64)
+		maybefail(err, "-share-key, %v", err)
+	}
+	if accountDeleteElections != "purge" {
+		sh.deletedElectionsTo, err = parseUserId(accountDeleteElections)
+		maybefail(err, "-account-delete-elections should be purge or a user number, %v", err)
 	}
-	edith := editHandler{edb, udb, &templates}
+	sh.registerJobs(gc)
+	go sh.jobs.Run(ctx)
+	edith := editHandler{edb, udb, templates}
 	ih := inviteHandler{
 		edb: edb,
 		udb: udb,
 		//signupPage: templates.Lookup("signup.html"),
-		templates: &templates,
+		templates: templates,
 	}
 
 	mith := makeInviteTokenHandler{
 		edb:       edb,
 		udb:       udb,
-		templates: &templates, //.Lookup("invitetoken.html"),
+		templates: templates, //.Lookup("invitetoken.html"),
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/election", &sh)
 	mux.Handle("/election/", &sh)
+	mux.Handle("/share/", &sh)
+	mux.Handle("/trash", &sh)
+	mux.Handle("/trash.json", &sh)
+	mux.Handle("/trash/", &sh)
+	mux.Handle("/digest", &sh)
+	mux.Handle("/digest/", &sh)
+	mux.Handle("/admin/", &sh)
+	mux.Handle("/elections/", &sh)
+	mux.Handle("/webhooks", &sh)
+	mux.Handle("/webhooks/", &sh)
+	mux.Handle("/library", &sh)
+	mux.Handle("/library/", &sh)
+	mux.Handle("/notifications", &sh)
+	mux.Handle("/account", &sh)
+	mux.Handle("/account/", &sh)
+	mux.Handle("/scan/", &sh)
+	mux.Handle("/print/", &sh)
+	mux.Handle("/sample/", &sh)
 	mux.Handle("/edit", &edith)
 	mux.Handle("/edit/", &edith)
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.HandleFunc("/openapi.json", handleOpenAPI)
+	mux.HandleFunc("/formats", handleFormats)
+	mux.HandleFunc("/formats/bubbles", handleBubblesConvert)
+	origins, err := parseCORSOrigins(corsOrigins)
+	maybefail(err, "-cors-origins %v", err)
+	proxies, err := parseTrustedProxies(trustedProxies)
+	maybefail(err, "-trusted-proxies %v", err)
+	baseURL, err := parseBaseURL(baseURLs)
+	maybefail(err, "-base-url %v", err)
+	var routes http.Handler = mux
+	if idKeyb64 != "" {
+		idKey, err := base64.StdEncoding.DecodeString(idKeyb64)
+		maybefail(err, "-id-key, %v", err)
+		codec, err := newIdCodec(idKey)
+		maybefail(err, "-id-key, %v", err)
+		routes = &publicIdHandler{mux, codec, requirePublicIds, udb, edb}
+	} else if requirePublicIds {
+		log.Fatal("-require-public-ids needs -id-key")
+	}
+	csrfh := &csrfHandler{sub: routes, exempt: make(map[string]bool), origins: origins}
+	// converting changes nothing, and scanners post without a session
+	csrfh.exempt["/formats/bubbles"] = true
+	var statich http.Handler
+	if devMode {
+		statich = noCache(http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
+	} else {
+		staticFiles, err = newStaticAssets(staticFS)
+		maybefail(err, "static, %v", err)
+		statich = http.StripPrefix("/static/", staticFiles)
+	}
+	mux.Handle("/static/", statich)
 	var authmods []*login.OauthCallbackHandler
 	if len(oauthConfigPath) > 0 {
 		fin, err := os.Open(oauthConfigPath)
@@ -703,20 +2355,60 @@ func main() {
 		maybefail(err, "%s: oauth problems, %v", oauthConfigPath, err)
 		for _, am := range authmods {
 			mux.Handle(am.HandlerUrl(), am)
+			csrfh.exempt[am.HandlerUrl()] = true
 		}
 	}
 	ih.authmods = authmods
 	sh.authmods = authmods
-	mux.Handle("/signup/", &ih)
+	loginLimit := NewRateLimiter(loginRate, loginBurst)
+	if oidcConfigPath != "" {
+		fin, err := os.Open(oidcConfigPath)
+		maybefail(err, "%s: could not open, %v", oidcConfigPath, err)
+		providers, err := parseOIDCConfig(fin)
+		fin.Close()
+		maybefail(err, "%s: %v", oidcConfigPath, err)
+		oidcKey, err := base64.StdEncoding.DecodeString(oidcKeyb64)
+		if err == nil && len(oidcKey) < 32 {
+			err = errors.New("want 32 bytes")
+		}
+		maybefail(err, "-oidc-key, %v", err)
+		oh := &oidcHandler{providers: make(map[string]*oidcProvider), users: &externalUsers{edb, udb, oidcKey}}
+		for _, p := range providers {
+			oh.providers[p.Id] = p
+		}
+		mux.Handle("/oidc/", &loginRateLimitHandler{loginLimit, oh, false})
+		ih.oidc = providers
+		sh.oidc = providers
+		log.Printf("initialized %d OpenID Connect providers", len(providers))
+	}
+	if samlConfigPath != "" {
+		fin, err := os.Open(samlConfigPath)
+		maybefail(err, "%s: could not open, %v", samlConfigPath, err)
+		sp, err := parseSAMLConfig(fin)
+		fin.Close()
+		maybefail(err, "%s: %v", samlConfigPath, err)
+		samlKey, err := base64.StdEncoding.DecodeString(samlKeyb64)
+		if err == nil && len(samlKey) < 32 {
+			err = errors.New("want 32 bytes")
+		}
+		maybefail(err, "-saml-key, %v", err)
+		mux.Handle("/saml/", &loginRateLimitHandler{loginLimit, &samlHandler{sp, &externalUsers{edb, udb, samlKey}, edb}, false})
+		csrfh.exempt["/saml/acs"] = true
+		ih.saml = sp
+		sh.saml = sp
+		log.Printf("initialized SAML identity provider %s", sp.Name)
+	}
+	mux.Handle("/signup/", &loginRateLimitHandler{loginLimit, &ih, false})
 	log.Printf("initialized %d oauth mods", len(authmods))
 	mux.HandleFunc("/logout", login.LogoutHandler)
 	mux.Handle("/makeinvite", &mith)
-	mux.Handle("/", &sh)
+	mux.Handle("/", &loginRateLimitHandler{loginLimit, &sh, true})
 	server := http.Server{
 		Addr:        listenAddr,
-		Handler:     mux,
+		Handler:     &trustedProxyHandler{&baseURLHandler{securityHeaders(&corsHandler{&timeoutHandler{csrfh, timeouts}, origins}, csp), baseURL}, proxies},
 		BaseContext: func(l net.Listener) context.Context { return ctx },
 	}
+	tuning.apply(&server)
 	if pidpath != "" {
 		pidf, err := os.Create(pidpath)
 		if err != nil {
@@ -727,9 +2419,18 @@ func main() {
 			pidf.Close()
 		}
 	}
+	lns, err := listeners(listenAddr, reusePort)
+	maybefail(err, "listen %s, %v", listenAddr, err)
 	sigterm := make(chan os.Signal, 1)
-	go sigtermHandler(sigterm, &server, cf)
+	shutdownDone := make(chan struct{})
+	go sigtermHandler(sigterm, &server, cf, drainTimeout, shutdownDone)
 	signal.Notify(sigterm, syscall.SIGTERM)
-	log.Print("serving ", listenAddr)
-	log.Fatal(server.ListenAndServe())
+	for _, ln := range lns {
+		log.Print("serving ", ln.Addr())
+	}
+	err = serve(&server, lns, tlsCert, tlsKey)
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
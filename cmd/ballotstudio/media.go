@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Candidate photos, party symbols, seals and signatures, and fonts (see fonts.go).
+// Uploaded with POST /election/{id}/media, served from /election/{id}/media/{mediaid},
+// and referenced from the election document by that URL in Candidate "PhotoUri"
+// (extension), Party "LogoUri" or Election "BallotImages" "Uri" (extension). At render time the referenced images are inlined
+// as data: URIs so the draw backend doesn't have to reach back to this server.
+// Images saved inline in a document, as data: URIs anywhere in it, are moved to
+// the media store and replaced by their URL, so documents stay small.
+
+// MediaStore keeps uploaded images. Ids are content hashes, so the same image uploaded twice is stored once.
+type MediaStore interface {
+	PutMedia(data []byte, contentType string) (mediaid string, err error)
+	// GetMedia returns os.ErrNotExist for unknown ids
+	GetMedia(mediaid string) (data []byte, contentType string, err error)
+}
+
+const DefaultMediaMaxBytes = 2000000
+
+// largest width or height accepted, pixels
+const mediaMaxPixels = 4000
+
+// content type -> file extension
+var mediaTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/gif":  "gif",
+}
+
+// content type -> file extension of fonts, see fonts.go
+var fontTypes = map[string]string{
+	"font/ttf": "ttf",
+}
+
+var mediaIdRe = regexp.MustCompile(`^[0-9a-f]{64}\.(png|jpg|gif|ttf)$`)
+
+// reference in a document, /election/{id}/media/{mediaid}
+var mediaRefRe = regexp.MustCompile(`^/election/\d+/media/([0-9a-f]{64}\.(?:png|jpg|gif|ttf))$`)
+
+func mediaId(data []byte, contentType string) string {
+	sum := sha256.Sum256(data)
+	ext, ok := mediaTypes[contentType]
+	if !ok {
+		ext = fontTypes[contentType]
+	}
+	return hex.EncodeToString(sum[:]) + "." + ext
+}
+
+func mediaContentType(mediaid string) string {
+	ext := filepath.Ext(mediaid)
+	for _, types := range []map[string]string{mediaTypes, fontTypes} {
+		for ct, cext := range types {
+			if "."+cext == ext {
+				return ct
+			}
+		}
+	}
+	return "application/octet-stream"
+}
+
+// checkMedia sniffs an upload, which must be a PNG, JPEG or GIF of reasonable dimensions
+func checkMedia(data []byte) (contentType string, width, height int, err error) {
+	contentType = http.DetectContentType(data)
+	if _, ok := mediaTypes[contentType]; !ok {
+		err = fmt.Errorf("%s not allowed, want PNG, JPEG or GIF", contentType)
+		return
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		err = fmt.Errorf("bad image, %v", err)
+		return
+	}
+	if cfg.Width < 1 || cfg.Height < 1 || cfg.Width > mediaMaxPixels || cfg.Height > mediaMaxPixels {
+		err = fmt.Errorf("image %dx%d, want at most %dx%d", cfg.Width, cfg.Height, mediaMaxPixels, mediaMaxPixels)
+		return
+	}
+	return contentType, cfg.Width, cfg.Height, nil
+}
+
+// fileImageArchiver keeps media under archivedir/media/
+func (fia *fileImageArchiver) PutMedia(data []byte, contentType string) (mediaid string, err error) {
+	mediaid = mediaId(data, contentType)
+	dir := filepath.Join(fia.path, "media")
+	fpath := filepath.Join(dir, mediaid)
+	if _, err := os.Stat(fpath); err == nil {
+		return mediaid, nil
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return mediaid, nil
+}
+
+func (fia *fileImageArchiver) GetMedia(mediaid string) (data []byte, contentType string, err error) {
+	if !mediaIdRe.MatchString(mediaid) {
+		return nil, "", os.ErrNotExist
+	}
+	data, err = ioutil.ReadFile(filepath.Join(fia.path, "media", mediaid))
+	return data, mediaContentType(mediaid), err
+}
+
+// pruneMedia deletes media files not in keep, and temp files left by a failed
+// PutMedia, last modified before `before`
+func (fia *fileImageArchiver) pruneMedia(keep map[string]bool, before time.Time) (removed int, err error) {
+	dir := filepath.Join(fia.path, "media")
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || keep[name] || !fi.ModTime().Before(before) {
+			continue
+		}
+		if !mediaIdRe.MatchString(name) && !strings.HasPrefix(name, "tmp") {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// memMediaStore is for running without -im-archive-dir, everything is lost at shutdown
+type memMediaStore struct {
+	lock sync.Mutex
+	they map[string][]byte
+}
+
+func (ms *memMediaStore) PutMedia(data []byte, contentType string) (mediaid string, err error) {
+	mediaid = mediaId(data, contentType)
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.they == nil {
+		ms.they = make(map[string][]byte)
+	}
+	ms.they[mediaid] = data
+	return mediaid, nil
+}
+
+func (ms *memMediaStore) GetMedia(mediaid string) (data []byte, contentType string, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	data, ok := ms.they[mediaid]
+	if !ok {
+		return nil, "", os.ErrNotExist
+	}
+	return data, mediaContentType(mediaid), nil
+}
+
+type mediaUploadJSON struct {
+	Id          string `json:"id"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
+// POST /election/{id}/media, image body, owner only
+// GET /election/{id}/media/{mediaid}
+func (sh *StudioHandler) handleElectionMedia(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64, mediaid string) {
+	if mediaid != "" {
+		if r.Method != "GET" {
+			texterr(w, http.StatusMethodNotAllowed, "GET only")
+			return
+		}
+		data, contentType, err := sh.media.GetMedia(mediaid)
+		if os.IsNotExist(err) {
+			texterr(w, 404, "no such media")
+			return
+		}
+		if maybeerr(w, err, 500, "media get") {
+			return
+		}
+		// content addressed, never changes
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(200)
+		w.Write(data)
+		return
+	}
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, sh.mediaMaxBytes))
+	if err != nil {
+		texterr(w, http.StatusRequestEntityTooLarge, "media upload too large or broken, limit %d bytes", sh.mediaMaxBytes)
+		return
+	}
+	contentType, width, height, err := checkMedia(data)
+	if err != nil {
+		texterr(w, http.StatusUnsupportedMediaType, "%v", err)
+		return
+	}
+	mediaid, err = sh.media.PutMedia(data, contentType)
+	if maybeerr(w, err, 500, "media put") {
+		return
+	}
+	out, err := json.Marshal(mediaUploadJSON{
+		Id:          mediaid,
+		URL:         fmt.Sprintf("/election/%d/media/%s", electionid, mediaid),
+		ContentType: contentType,
+		Width:       width,
+		Height:      height,
+	})
+	if maybeerr(w, err, 500, "json ret prep") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(out)
+}
+
+// extractMedia moves base64 data: URI images anywhere in doc to the media
+// store, replacing them with their /election/{id}/media/{mediaid} URL. Ones that
+// aren't an image checkMedia allows, or are over maxBytes, are left as they are.
+func extractMedia(ms MediaStore, doc interface{}, electionid int64, maxBytes int64) (moved int, err error) {
+	extract := func(uri string) (string, error) {
+		if !strings.HasPrefix(uri, "data:image/") {
+			return uri, nil
+		}
+		comma := strings.IndexByte(uri, ',')
+		if comma < 0 || !strings.HasSuffix(uri[:comma], ";base64") || int64(len(uri)-comma)*3/4 > maxBytes {
+			return uri, nil
+		}
+		data, err := base64.StdEncoding.DecodeString(uri[comma+1:])
+		if err != nil {
+			return uri, nil
+		}
+		contentType, _, _, err := checkMedia(data)
+		if err != nil {
+			return uri, nil
+		}
+		mediaid, err := ms.PutMedia(data, contentType)
+		if err != nil {
+			return uri, fmt.Errorf("media put, %v", err)
+		}
+		moved++
+		return fmt.Sprintf("/election/%d/media/%s", electionid, mediaid), nil
+	}
+	var walk func(v interface{}) error
+	walk = func(v interface{}) error {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			for k, x := range vv {
+				if s, ok := x.(string); ok {
+					vv[k], err = extract(s)
+				} else {
+					err = walk(x)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for i, x := range vv {
+				if s, ok := x.(string); ok {
+					vv[i], err = extract(s)
+				} else {
+					err = walk(x)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err = walk(doc)
+	return moved, err
+}
+
+// inlineMedia replaces Candidate PhotoUri, Party LogoUri, Election BallotImages Uri and Fonts Uri
+// references to uploaded media with data: URIs, for the draw backend.
+// Missing media is left as the URL, which the draw backend ignores.
+func inlineMedia(ms MediaStore, electionJSON string) (string, error) {
+	if ms == nil || !strings.Contains(electionJSON, "/media/") {
+		return electionJSON, nil
+	}
+	var doc map[string]interface{}
+	err := json.Unmarshal([]byte(electionJSON), &doc)
+	if err != nil {
+		return electionJSON, err
+	}
+	changed := false
+	inline := func(uri string) string {
+		m := mediaRefRe.FindStringSubmatch(uri)
+		if m == nil {
+			return uri
+		}
+		data, contentType, err := ms.GetMedia(m[1])
+		if err != nil {
+			log.Printf("media %s, %v", uri, err)
+			return uri
+		}
+		changed = true
+		return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	}
+	for _, el := range mapList(doc["Election"]) {
+		for _, cand := range mapList(el["Candidate"]) {
+			inlineUriField(cand, "PhotoUri", inline)
+		}
+		for _, bi := range mapList(el["BallotImages"]) {
+			inlineUriField(bi, "Uri", inline)
+		}
+		for _, font := range mapList(el["Fonts"]) {
+			inlineUriField(font, "Uri", inline)
+		}
+	}
+	for _, party := range mapList(doc["Party"]) {
+		inlineUriField(party, "LogoUri", inline)
+	}
+	if !changed {
+		return electionJSON, nil
+	}
+	out, err := json.Marshal(doc)
+	return string(out), err
+}
+
+// a uri field may be a string, a NIST AnnotatedUri {"Content": uri}, or a list of those
+func inlineUriField(ob map[string]interface{}, field string, inline func(string) string) {
+	switch v := ob[field].(type) {
+	case string:
+		ob[field] = inline(v)
+	case map[string]interface{}:
+		if s, ok := v["Content"].(string); ok {
+			v["Content"] = inline(s)
+		}
+	case []interface{}:
+		for i, x := range v {
+			switch xv := x.(type) {
+			case string:
+				v[i] = inline(xv)
+			case map[string]interface{}:
+				if s, ok := xv["Content"].(string); ok {
+					xv["Content"] = inline(s)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func testPng(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckMedia(t *testing.T) {
+	ct, w, h, err := checkMedia(testPng(t, 30, 40))
+	if err != nil || ct != "image/png" || w != 30 || h != 40 {
+		t.Errorf("png got %s %dx%d %v", ct, w, h, err)
+	}
+	_, _, _, err = checkMedia([]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"))
+	if err == nil {
+		t.Errorf("svg should not be allowed")
+	}
+	_, _, _, err = checkMedia(testPng(t, mediaMaxPixels+1, 1))
+	if err == nil {
+		t.Errorf("too wide should not be allowed")
+	}
+}
+
+func TestInlineMedia(t *testing.T) {
+	ms := &memMediaStore{}
+	im := testPng(t, 2, 2)
+	mid, err := ms.PutMedia(im, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ms.PutMedia(im, "image/png"); again != mid {
+		t.Errorf("same image different id %s %s", mid, again)
+	}
+	doc := `{"Election": [{"Candidate": [{"@id": "c1", "PhotoUri": "/election/1/media/` + mid + `"}, {"@id": "c2", "PhotoUri": "https://example.com/x.png"}],
+ "BallotImages": [{"Uri": "/election/1/media/` + mid + `", "Placement": "footer-right", "Caption": "County Clerk"}]}],
+ "Party": [{"@id": "p1", "LogoUri": [{"Content": "/election/1/media/` + mid + `"}]}]}`
+	out, err := inlineMedia(ms, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "data:image/png;base64,") != 3 || !strings.Contains(out, "https://example.com/x.png") {
+		t.Errorf("inlined got %s", out)
+	}
+	plain := `{"Election": []}`
+	if out, _ := inlineMedia(ms, plain); out != plain {
+		t.Errorf("doc without media changed, %s", out)
+	}
+}
+
+func TestExtractMedia(t *testing.T) {
+	ms := &memMediaStore{}
+	im := testPng(t, 2, 2)
+	inline := "data:image/png;base64," + base64.StdEncoding.EncodeToString(im)
+	svg := "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte("<svg></svg>"))
+	doc := `{"Election": [{"Candidate": [{"@id": "c1", "PhotoUri": "` + inline + `"}]}],
+ "Party": [{"@id": "p1", "LogoUri": [{"Content": "` + inline + `"}, {"Content": "` + svg + `"}]}]}`
+	var ob map[string]interface{}
+	err := json.Unmarshal([]byte(doc), &ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := extractMedia(ms, ob, 7, DefaultMediaMaxBytes)
+	if err != nil || moved != 2 {
+		t.Errorf("moved %d, %v", moved, err)
+	}
+	out, _ := json.Marshal(ob)
+	url := "/election/7/media/" + mediaId(im, "image/png")
+	if strings.Count(string(out), url) != 2 || strings.Contains(string(out), inline) || !strings.Contains(string(out), svg) {
+		t.Errorf("extracted got %s", out)
+	}
+	if _, _, err := ms.GetMedia(mediaId(im, "image/png")); err != nil {
+		t.Errorf("not stored, %v", err)
+	}
+	moved, _ = extractMedia(ms, ob, 7, 10)
+	if moved != 0 {
+		t.Errorf("moved %d again", moved)
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Schema migrations.
+//
+// Each backend has an ordered list of migrations with the same versions and names.
+// The versions applied are recorded in schema_migrations. Migrations are never
+// edited once released; add a new one instead. Early steps use IF NOT EXISTS so
+// that databases made before migrations existed adopt them cleanly.
+// MySQL commits DDL immediately, so a failed step there may need manual cleanup.
+
+type migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+const latestMigration = -1
+
+var sqliteMigrations = []migration{
+	{1, "elections, metastate, invites", []string{
+		// use builtin ROWID
+		"CREATE TABLE IF NOT EXISTS elections (data TEXT, owner bigint, meta TEXT)",
+		"CREATE TABLE IF NOT EXISTS metastate (k TEXT PRIMARY KEY, v BLOB)",
+		`CREATE TABLE IF NOT EXISTS invites (token TEXT PRIMARY KEY, expires bigint)`,
+	}, []string{
+		"DROP TABLE invites",
+		"DROP TABLE metastate",
+		"DROP TABLE elections",
+	}},
+	{2, "scans", []string{
+		// use builtin ROWID
+		"CREATE TABLE IF NOT EXISTS scans (election bigint, owner bigint, image BLOB, content_type TEXT, interpreter TEXT, result TEXT, created bigint)",
+		"CREATE INDEX IF NOT EXISTS scans_election ON scans (election)",
+	}, []string{
+		"DROP INDEX IF EXISTS scans_election",
+		"DROP TABLE scans",
+	}},
+	{3, "election_state", []string{
+		"CREATE TABLE IF NOT EXISTS election_state (election bigint PRIMARY KEY, state TEXT, changed bigint)",
+	}, []string{
+		"DROP TABLE election_state",
+	}},
+	{4, "elections trashed", []string{
+		// unix seconds, NULL if not in the trash
+		"ALTER TABLE elections ADD COLUMN trashed bigint",
+	}, []string{
+		// sqlite before 3.35 has no DROP COLUMN, copy keeping ROWID
+		"CREATE TABLE elections_down (data TEXT, owner bigint, meta TEXT)",
+		"INSERT INTO elections_down (ROWID, data, owner, meta) SELECT ROWID, data, owner, meta FROM elections",
+		"DROP TABLE elections",
+		"ALTER TABLE elections_down RENAME TO elections",
+	}},
+	{5, "annotations", []string{
+		// x, y are fractions of page width and height from the top left
+		"CREATE TABLE IF NOT EXISTS annotations (election bigint, page int, x double precision, y double precision, comment TEXT, author bigint, author_name TEXT, created bigint)",
+		"CREATE INDEX IF NOT EXISTS annotations_election ON annotations (election)",
+	}, []string{
+		"DROP INDEX IF EXISTS annotations_election",
+		"DROP TABLE annotations",
+	}},
+	{6, "digest schedules", []string{
+		// weekday 0 is Sunday, hour is UTC
+		"CREATE TABLE IF NOT EXISTS digest_schedules (user_id bigint PRIMARY KEY, email TEXT, weekday int, hour int, last_sent bigint)",
+	}, []string{
+		"DROP TABLE digest_schedules",
+	}},
+	{7, "staff", []string{
+		"CREATE TABLE IF NOT EXISTS staff (email TEXT PRIMARY KEY, role TEXT, organization TEXT, user_id bigint, invite TEXT, provisioned bigint)",
+		"CREATE INDEX IF NOT EXISTS staff_invite ON staff (invite)",
+		"CREATE INDEX IF NOT EXISTS staff_user ON staff (user_id)",
+	}, []string{
+		"DROP INDEX IF EXISTS staff_user",
+		"DROP INDEX IF EXISTS staff_invite",
+		"DROP TABLE staff",
+	}},
+	{8, "election revisions", []string{
+		// every saved version of an election document; rev 1 is what was there before revisions were kept
+		"CREATE TABLE IF NOT EXISTS election_revisions (election bigint, rev int, data TEXT, created bigint, PRIMARY KEY (election, rev))",
+		"INSERT INTO election_revisions (election, rev, data, created) SELECT ROWID, 1, data, 0 FROM elections",
+	}, []string{
+		"DROP TABLE election_revisions",
+	}},
+	{9, "election search", []string{
+		// names one per line, see search.go; filled in by Setup for existing elections
+		"CREATE TABLE IF NOT EXISTS election_search (election bigint PRIMARY KEY, title TEXT, contests TEXT, candidates TEXT)",
+	}, []string{
+		"DROP TABLE IF EXISTS election_fts",
+		"DROP TABLE election_search",
+	}},
+	{10, "election tags", []string{
+		"CREATE TABLE IF NOT EXISTS election_tags (election bigint, tag TEXT, PRIMARY KEY (election, tag))",
+	}, []string{
+		"DROP TABLE election_tags",
+	}},
+	{11, "webhooks", []string{
+		// election 0 is all of the owner's elections; events is comma separated
+		"CREATE TABLE IF NOT EXISTS webhooks (owner bigint, election bigint, url TEXT, secret TEXT, events TEXT, created bigint)",
+		"CREATE INDEX IF NOT EXISTS webhooks_owner ON webhooks (owner)",
+		"CREATE TABLE IF NOT EXISTS webhook_deliveries (webhook bigint, event TEXT, payload TEXT, status TEXT, attempts int, next_try bigint, last_error TEXT, created bigint)",
+		"CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook)",
+		"CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_try)",
+	}, []string{
+		"DROP INDEX IF EXISTS webhook_deliveries_due",
+		"DROP INDEX IF EXISTS webhook_deliveries_webhook",
+		"DROP TABLE webhook_deliveries",
+		"DROP INDEX IF EXISTS webhooks_owner",
+		"DROP TABLE webhooks",
+	}},
+	{12, "notification preferences", []string{
+		"CREATE TABLE IF NOT EXISTS notify_prefs (user_id bigint PRIMARY KEY, username TEXT, email TEXT, shares int, mentions int, renders int)",
+	}, []string{
+		"DROP TABLE notify_prefs",
+	}},
+	{13, "scan custody", []string{
+		"ALTER TABLE scans ADD COLUMN device TEXT",
+		"ALTER TABLE scans ADD COLUMN operator TEXT",
+		"ALTER TABLE scans ADD COLUMN batch TEXT",
+		"ALTER TABLE scans ADD COLUMN precinct TEXT",
+	}, []string{
+		// no DROP COLUMN before sqlite 3.35, copy keeping ROWID
+		"CREATE TABLE scans_down (election bigint, owner bigint, image BLOB, content_type TEXT, interpreter TEXT, result TEXT, created bigint)",
+		"INSERT INTO scans_down (ROWID, election, owner, image, content_type, interpreter, result, created) SELECT ROWID, election, owner, image, content_type, interpreter, result, created FROM scans",
+		"DROP TABLE scans",
+		"ALTER TABLE scans_down RENAME TO scans",
+		"CREATE INDEX IF NOT EXISTS scans_election ON scans (election)",
+	}},
+	{14, "print jobs", []string{
+		"CREATE TABLE IF NOT EXISTS print_jobs (election bigint, style int, requested_by bigint, status TEXT, pdf BLOB, error TEXT, created bigint, done bigint, picked_up bigint)",
+		"CREATE INDEX IF NOT EXISTS print_jobs_election ON print_jobs (election)",
+		"CREATE INDEX IF NOT EXISTS print_jobs_status ON print_jobs (status)",
+	}, []string{
+		"DROP INDEX IF EXISTS print_jobs_status",
+		"DROP INDEX IF EXISTS print_jobs_election",
+		"DROP TABLE print_jobs",
+	}},
+	{15, "sample ballots", []string{
+		"CREATE TABLE IF NOT EXISTS sample_ballots (slug TEXT PRIMARY KEY, election bigint UNIQUE)",
+	}, []string{
+		"DROP TABLE sample_ballots",
+	}},
+	{16, "election facts", []string{
+		// see calendar.go; emptied so that Setup indexes every election again to fill them in
+		"ALTER TABLE election_search ADD COLUMN election_date TEXT",
+		"ALTER TABLE election_search ADD COLUMN jurisdiction TEXT",
+		"ALTER TABLE election_search ADD COLUMN election_type TEXT",
+		"CREATE INDEX IF NOT EXISTS election_search_date ON election_search (election_date)",
+		"DELETE FROM election_search",
+	}, []string{
+		// no DROP COLUMN before sqlite 3.35; it is all derived, Setup fills it again
+		"DROP INDEX IF EXISTS election_search_date",
+		"DROP TABLE election_search",
+		"CREATE TABLE election_search (election bigint PRIMARY KEY, title TEXT, contests TEXT, candidates TEXT)",
+	}},
+	{17, "user quotas", []string{
+		"CREATE TABLE IF NOT EXISTS user_quotas (owner bigint PRIMARY KEY, elections bigint, scan_bytes bigint, revisions bigint)",
+	}, []string{
+		"DROP TABLE user_quotas",
+	}},
+	{18, "account profiles", []string{
+		"CREATE TABLE IF NOT EXISTS account_profiles (user_id bigint PRIMARY KEY, display_name TEXT, email TEXT, updated bigint, deleted bigint)",
+	}, []string{
+		"DROP TABLE account_profiles",
+	}},
+	{19, "oidc identities", []string{
+		"CREATE TABLE IF NOT EXISTS oidc_identities (issuer TEXT, subject TEXT, user_id bigint, username TEXT, created bigint, PRIMARY KEY (issuer, subject))",
+	}, []string{
+		"DROP TABLE oidc_identities",
+	}},
+	{20, "account disabled", []string{
+		// unix seconds, NULL or 0 for an account that can sign in
+		"ALTER TABLE account_profiles ADD COLUMN disabled bigint",
+	}, []string{
+		"CREATE TABLE account_profiles_down (user_id bigint PRIMARY KEY, display_name TEXT, email TEXT, updated bigint, deleted bigint)",
+		"INSERT INTO account_profiles_down (user_id, display_name, email, updated, deleted) SELECT user_id, display_name, email, updated, deleted FROM account_profiles",
+		"DROP TABLE account_profiles",
+		"ALTER TABLE account_profiles_down RENAME TO account_profiles",
+	}},
+	{21, "contest library", []string{
+		"CREATE TABLE IF NOT EXISTS library_entries (owner bigint, kind TEXT, name TEXT, data TEXT, updated bigint)",
+	}, []string{
+		"DROP TABLE library_entries",
+	}},
+	{22, "print runs", []string{
+		"CREATE TABLE IF NOT EXISTS print_runs (election bigint, style int, first_number bigint, last_number bigint, batch_size int, rev int, requested_by bigint, created bigint)",
+		"CREATE INDEX IF NOT EXISTS print_runs_election ON print_runs (election)",
+		"CREATE TABLE IF NOT EXISTS print_run_downloads (run bigint, batch int, downloaded_by bigint, downloaded bigint)",
+		"CREATE INDEX IF NOT EXISTS print_run_downloads_run ON print_run_downloads (run)",
+	}, []string{
+		"DROP INDEX IF EXISTS print_run_downloads_run",
+		"DROP TABLE print_run_downloads",
+		"DROP INDEX IF EXISTS print_runs_election",
+		"DROP TABLE print_runs",
+	}},
+	{23, "scan revision", []string{
+		"ALTER TABLE scans ADD COLUMN rev int DEFAULT 0",
+	}, []string{
+		// no DROP COLUMN before sqlite 3.35, copy keeping ROWID
+		"CREATE TABLE scans_down (election bigint, owner bigint, image BLOB, content_type TEXT, interpreter TEXT, result TEXT, created bigint, device TEXT, operator TEXT, batch TEXT, precinct TEXT)",
+		"INSERT INTO scans_down (ROWID, election, owner, image, content_type, interpreter, result, created, device, operator, batch, precinct) SELECT ROWID, election, owner, image, content_type, interpreter, result, created, device, operator, batch, precinct FROM scans",
+		"DROP TABLE scans",
+		"ALTER TABLE scans_down RENAME TO scans",
+		"CREATE INDEX IF NOT EXISTS scans_election ON scans (election)",
+	}},
+}
+
+var postgresMigrations = []migration{
+	{1, "elections, metastate, invites", []string{
+		"CREATE TABLE IF NOT EXISTS elections (id bigserial, data TEXT, owner bigint, meta TEXT)",
+		"CREATE TABLE IF NOT EXISTS metastate (k TEXT PRIMARY KEY, v bytea)",
+		`CREATE TABLE IF NOT EXISTS invites (token text PRIMARY KEY, expires timestamp without time zone)`,
+	}, []string{
+		"DROP TABLE invites",
+		"DROP TABLE metastate",
+		"DROP TABLE elections",
+	}},
+	{2, "scans", []string{
+		"CREATE TABLE IF NOT EXISTS scans (id bigserial, election bigint, owner bigint, image bytea, content_type text, interpreter text, result text, created bigint)",
+		"CREATE INDEX IF NOT EXISTS scans_election ON scans (election)",
+	}, []string{
+		"DROP INDEX IF EXISTS scans_election",
+		"DROP TABLE scans",
+	}},
+	{3, "election_state", []string{
+		"CREATE TABLE IF NOT EXISTS election_state (election bigint PRIMARY KEY, state text, changed timestamp without time zone)",
+	}, []string{
+		"DROP TABLE election_state",
+	}},
+	{4, "elections trashed", []string{
+		"ALTER TABLE elections ADD COLUMN IF NOT EXISTS trashed bigint",
+	}, []string{
+		"ALTER TABLE elections DROP COLUMN trashed",
+	}},
+	{5, "annotations", []string{
+		"CREATE TABLE IF NOT EXISTS annotations (id bigserial, election bigint, page integer, x double precision, y double precision, comment text, author bigint, author_name text, created bigint)",
+		"CREATE INDEX IF NOT EXISTS annotations_election ON annotations (election)",
+	}, []string{
+		"DROP INDEX IF EXISTS annotations_election",
+		"DROP TABLE annotations",
+	}},
+	{6, "digest schedules", []string{
+		"CREATE TABLE IF NOT EXISTS digest_schedules (user_id bigint PRIMARY KEY, email text, weekday integer, hour integer, last_sent bigint)",
+	}, []string{
+		"DROP TABLE digest_schedules",
+	}},
+	{7, "staff", []string{
+		"CREATE TABLE IF NOT EXISTS staff (email text PRIMARY KEY, role text, organization text, user_id bigint, invite text, provisioned bigint)",
+		"CREATE INDEX IF NOT EXISTS staff_invite ON staff (invite)",
+		"CREATE INDEX IF NOT EXISTS staff_user ON staff (user_id)",
+	}, []string{
+		"DROP INDEX IF EXISTS staff_user",
+		"DROP INDEX IF EXISTS staff_invite",
+		"DROP TABLE staff",
+	}},
+	{8, "election revisions", []string{
+		"CREATE TABLE IF NOT EXISTS election_revisions (election bigint, rev integer, data text, created bigint, PRIMARY KEY (election, rev))",
+		"INSERT INTO election_revisions (election, rev, data, created) SELECT id, 1, data, 0 FROM elections",
+	}, []string{
+		"DROP TABLE election_revisions",
+	}},
+	{9, "election search", []string{
+		"CREATE TABLE IF NOT EXISTS election_search (election bigint PRIMARY KEY, title text, contests text, candidates text)",
+		"CREATE INDEX IF NOT EXISTS election_search_fts ON election_search USING GIN (to_tsvector('simple', title || ' ' || contests || ' ' || candidates))",
+	}, []string{
+		"DROP INDEX IF EXISTS election_search_fts",
+		"DROP TABLE election_search",
+	}},
+	{10, "election tags", []string{
+		"CREATE TABLE IF NOT EXISTS election_tags (election bigint, tag text, PRIMARY KEY (election, tag))",
+	}, []string{
+		"DROP TABLE election_tags",
+	}},
+	{11, "webhooks", []string{
+		"CREATE TABLE IF NOT EXISTS webhooks (id bigserial, owner bigint, election bigint, url text, secret text, events text, created bigint)",
+		"CREATE INDEX IF NOT EXISTS webhooks_owner ON webhooks (owner)",
+		"CREATE TABLE IF NOT EXISTS webhook_deliveries (id bigserial, webhook bigint, event text, payload text, status text, attempts integer, next_try bigint, last_error text, created bigint)",
+		"CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook)",
+		"CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_try)",
+	}, []string{
+		"DROP INDEX IF EXISTS webhook_deliveries_due",
+		"DROP INDEX IF EXISTS webhook_deliveries_webhook",
+		"DROP TABLE webhook_deliveries",
+		"DROP INDEX IF EXISTS webhooks_owner",
+		"DROP TABLE webhooks",
+	}},
+	{12, "notification preferences", []string{
+		"CREATE TABLE IF NOT EXISTS notify_prefs (user_id bigint PRIMARY KEY, username text, email text, shares integer, mentions integer, renders integer)",
+	}, []string{
+		"DROP TABLE notify_prefs",
+	}},
+	{13, "scan custody", []string{
+		"ALTER TABLE scans ADD COLUMN IF NOT EXISTS device text, ADD COLUMN IF NOT EXISTS operator text, ADD COLUMN IF NOT EXISTS batch text, ADD COLUMN IF NOT EXISTS precinct text",
+	}, []string{
+		"ALTER TABLE scans DROP COLUMN precinct, DROP COLUMN batch, DROP COLUMN operator, DROP COLUMN device",
+	}},
+	{14, "print jobs", []string{
+		"CREATE TABLE IF NOT EXISTS print_jobs (id bigserial, election bigint, style integer, requested_by bigint, status text, pdf bytea, error text, created bigint, done bigint, picked_up bigint)",
+		"CREATE INDEX IF NOT EXISTS print_jobs_election ON print_jobs (election)",
+		"CREATE INDEX IF NOT EXISTS print_jobs_status ON print_jobs (status)",
+	}, []string{
+		"DROP INDEX IF EXISTS print_jobs_status",
+		"DROP INDEX IF EXISTS print_jobs_election",
+		"DROP TABLE print_jobs",
+	}},
+	{15, "sample ballots", []string{
+		"CREATE TABLE IF NOT EXISTS sample_ballots (slug text PRIMARY KEY, election bigint UNIQUE)",
+	}, []string{
+		"DROP TABLE sample_ballots",
+	}},
+	{16, "election facts", []string{
+		"ALTER TABLE election_search ADD COLUMN IF NOT EXISTS election_date text, ADD COLUMN IF NOT EXISTS jurisdiction text, ADD COLUMN IF NOT EXISTS election_type text",
+		"CREATE INDEX IF NOT EXISTS election_search_date ON election_search (election_date)",
+		"DELETE FROM election_search",
+	}, []string{
+		"DROP INDEX IF EXISTS election_search_date",
+		"ALTER TABLE election_search DROP COLUMN election_type, DROP COLUMN jurisdiction, DROP COLUMN election_date",
+	}},
+	{17, "user quotas", []string{
+		"CREATE TABLE IF NOT EXISTS user_quotas (owner bigint PRIMARY KEY, elections bigint, scan_bytes bigint, revisions bigint)",
+	}, []string{
+		"DROP TABLE user_quotas",
+	}},
+	{18, "account profiles", []string{
+		"CREATE TABLE IF NOT EXISTS account_profiles (user_id bigint PRIMARY KEY, display_name text, email text, updated bigint, deleted bigint)",
+	}, []string{
+		"DROP TABLE account_profiles",
+	}},
+	{19, "oidc identities", []string{
+		"CREATE TABLE IF NOT EXISTS oidc_identities (issuer text, subject text, user_id bigint, username text, created bigint, PRIMARY KEY (issuer, subject))",
+	}, []string{
+		"DROP TABLE oidc_identities",
+	}},
+	{20, "account disabled", []string{
+		"ALTER TABLE account_profiles ADD COLUMN IF NOT EXISTS disabled bigint",
+	}, []string{
+		"ALTER TABLE account_profiles DROP COLUMN disabled",
+	}},
+	{21, "contest library", []string{
+		"CREATE TABLE IF NOT EXISTS library_entries (id bigserial, owner bigint, kind text, name text, data text, updated bigint)",
+	}, []string{
+		"DROP TABLE library_entries",
+	}},
+	{22, "print runs", []string{
+		"CREATE TABLE IF NOT EXISTS print_runs (id bigserial, election bigint, style integer, first_number bigint, last_number bigint, batch_size integer, rev integer, requested_by bigint, created bigint)",
+		"CREATE INDEX IF NOT EXISTS print_runs_election ON print_runs (election)",
+		"CREATE TABLE IF NOT EXISTS print_run_downloads (id bigserial, run bigint, batch integer, downloaded_by bigint, downloaded bigint)",
+		"CREATE INDEX IF NOT EXISTS print_run_downloads_run ON print_run_downloads (run)",
+	}, []string{
+		"DROP INDEX IF EXISTS print_run_downloads_run",
+		"DROP TABLE print_run_downloads",
+		"DROP INDEX IF EXISTS print_runs_election",
+		"DROP TABLE print_runs",
+	}},
+	{23, "scan revision", []string{
+		"ALTER TABLE scans ADD COLUMN IF NOT EXISTS rev integer DEFAULT 0",
+	}, []string{
+		"ALTER TABLE scans DROP COLUMN rev",
+	}},
+}
+
+var mysqlMigrations = []migration{
+	{1, "elections, metastate, invites", []string{
+		"CREATE TABLE IF NOT EXISTS elections (id BIGINT AUTO_INCREMENT PRIMARY KEY, data LONGTEXT, owner BIGINT, meta TEXT, INDEX elections_owner (owner))",
+		"CREATE TABLE IF NOT EXISTS metastate (k VARCHAR(255) PRIMARY KEY, v BLOB)",
+		"CREATE TABLE IF NOT EXISTS invites (token VARCHAR(255) PRIMARY KEY, expires BIGINT)",
+	}, []string{
+		"DROP TABLE invites",
+		"DROP TABLE metastate",
+		"DROP TABLE elections",
+	}},
+	{2, "scans", []string{
+		"CREATE TABLE IF NOT EXISTS scans (id BIGINT AUTO_INCREMENT PRIMARY KEY, election BIGINT, owner BIGINT, image LONGBLOB, content_type VARCHAR(255), interpreter VARCHAR(255), result TEXT, created BIGINT, INDEX scans_election (election))",
+	}, []string{
+		"DROP TABLE scans",
+	}},
+	{3, "election_state", []string{
+		"CREATE TABLE IF NOT EXISTS election_state (election BIGINT PRIMARY KEY, state VARCHAR(64), changed BIGINT)",
+	}, []string{
+		"DROP TABLE election_state",
+	}},
+	{4, "elections trashed", []string{
+		"ALTER TABLE elections ADD COLUMN trashed BIGINT",
+	}, []string{
+		"ALTER TABLE elections DROP COLUMN trashed",
+	}},
+	{5, "annotations", []string{
+		"CREATE TABLE IF NOT EXISTS annotations (id BIGINT AUTO_INCREMENT PRIMARY KEY, election BIGINT, page INT, x DOUBLE, y DOUBLE, comment TEXT, author BIGINT, author_name VARCHAR(255), created BIGINT, INDEX annotations_election (election))",
+	}, []string{
+		"DROP TABLE annotations",
+	}},
+	{6, "digest schedules", []string{
+		"CREATE TABLE IF NOT EXISTS digest_schedules (user_id BIGINT PRIMARY KEY, email VARCHAR(255), weekday INT, hour INT, last_sent BIGINT)",
+	}, []string{
+		"DROP TABLE digest_schedules",
+	}},
+	{7, "staff", []string{
+		"CREATE TABLE IF NOT EXISTS staff (email VARCHAR(255) PRIMARY KEY, role VARCHAR(64), organization VARCHAR(255), user_id BIGINT, invite VARCHAR(255), provisioned BIGINT, INDEX staff_invite (invite), INDEX staff_user (user_id))",
+	}, []string{
+		"DROP TABLE staff",
+	}},
+	{8, "election revisions", []string{
+		"CREATE TABLE IF NOT EXISTS election_revisions (election BIGINT, rev INT, data LONGTEXT, created BIGINT, PRIMARY KEY (election, rev))",
+		"INSERT INTO election_revisions (election, rev, data, created) SELECT id, 1, data, 0 FROM elections",
+	}, []string{
+		"DROP TABLE election_revisions",
+	}},
+	{9, "election search", []string{
+		"CREATE TABLE IF NOT EXISTS election_search (election BIGINT PRIMARY KEY, title TEXT, contests MEDIUMTEXT, candidates MEDIUMTEXT, FULLTEXT election_search_fts (title, contests, candidates))",
+	}, []string{
+		"DROP TABLE election_search",
+	}},
+	{10, "election tags", []string{
+		"CREATE TABLE IF NOT EXISTS election_tags (election BIGINT, tag VARCHAR(64), PRIMARY KEY (election, tag))",
+	}, []string{
+		"DROP TABLE election_tags",
+	}},
+	{11, "webhooks", []string{
+		"CREATE TABLE IF NOT EXISTS webhooks (id BIGINT AUTO_INCREMENT PRIMARY KEY, owner BIGINT, election BIGINT, url TEXT, secret VARCHAR(255), events VARCHAR(255), created BIGINT, INDEX webhooks_owner (owner))",
+		"CREATE TABLE IF NOT EXISTS webhook_deliveries (id BIGINT AUTO_INCREMENT PRIMARY KEY, webhook BIGINT, event VARCHAR(32), payload MEDIUMTEXT, status VARCHAR(16), attempts INT, next_try BIGINT, last_error TEXT, created BIGINT, INDEX webhook_deliveries_webhook (webhook), INDEX webhook_deliveries_due (status, next_try))",
+	}, []string{
+		"DROP TABLE webhook_deliveries",
+		"DROP TABLE webhooks",
+	}},
+	{12, "notification preferences", []string{
+		"CREATE TABLE IF NOT EXISTS notify_prefs (user_id BIGINT PRIMARY KEY, username VARCHAR(255), email VARCHAR(255), shares INT, mentions INT, renders INT)",
+	}, []string{
+		"DROP TABLE notify_prefs",
+	}},
+	{13, "scan custody", []string{
+		"ALTER TABLE scans ADD COLUMN device VARCHAR(255), ADD COLUMN operator VARCHAR(255), ADD COLUMN batch VARCHAR(255), ADD COLUMN precinct VARCHAR(255)",
+	}, []string{
+		"ALTER TABLE scans DROP COLUMN precinct, DROP COLUMN batch, DROP COLUMN operator, DROP COLUMN device",
+	}},
+	{14, "print jobs", []string{
+		"CREATE TABLE IF NOT EXISTS print_jobs (id BIGINT AUTO_INCREMENT PRIMARY KEY, election BIGINT, style INT, requested_by BIGINT, status VARCHAR(16), pdf LONGBLOB, error TEXT, created BIGINT, done BIGINT, picked_up BIGINT, INDEX print_jobs_election (election), INDEX print_jobs_status (status))",
+	}, []string{
+		"DROP TABLE print_jobs",
+	}},
+	{15, "sample ballots", []string{
+		"CREATE TABLE IF NOT EXISTS sample_ballots (slug VARCHAR(64) PRIMARY KEY, election BIGINT, UNIQUE INDEX sample_ballots_election (election))",
+	}, []string{
+		"DROP TABLE sample_ballots",
+	}},
+	{16, "election facts", []string{
+		"ALTER TABLE election_search ADD COLUMN election_date VARCHAR(10), ADD COLUMN jurisdiction VARCHAR(255), ADD COLUMN election_type VARCHAR(64), ADD INDEX election_search_date (election_date)",
+		"DELETE FROM election_search",
+	}, []string{
+		"ALTER TABLE election_search DROP INDEX election_search_date, DROP COLUMN election_type, DROP COLUMN jurisdiction, DROP COLUMN election_date",
+	}},
+	{17, "user quotas", []string{
+		"CREATE TABLE IF NOT EXISTS user_quotas (owner BIGINT PRIMARY KEY, elections BIGINT, scan_bytes BIGINT, revisions BIGINT)",
+	}, []string{
+		"DROP TABLE user_quotas",
+	}},
+	{18, "account profiles", []string{
+		"CREATE TABLE IF NOT EXISTS account_profiles (user_id BIGINT PRIMARY KEY, display_name VARCHAR(255), email VARCHAR(255), updated BIGINT, deleted BIGINT)",
+	}, []string{
+		"DROP TABLE account_profiles",
+	}},
+	{19, "oidc identities", []string{
+		"CREATE TABLE IF NOT EXISTS oidc_identities (issuer VARCHAR(255), subject VARCHAR(255), user_id BIGINT, username VARCHAR(255), created BIGINT, PRIMARY KEY (issuer, subject))",
+	}, []string{
+		"DROP TABLE oidc_identities",
+	}},
+	{20, "account disabled", []string{
+		"ALTER TABLE account_profiles ADD COLUMN disabled BIGINT",
+	}, []string{
+		"ALTER TABLE account_profiles DROP COLUMN disabled",
+	}},
+	{21, "contest library", []string{
+		"CREATE TABLE IF NOT EXISTS library_entries (id BIGINT AUTO_INCREMENT PRIMARY KEY, owner BIGINT, kind VARCHAR(16), name VARCHAR(255), data MEDIUMTEXT, updated BIGINT)",
+	}, []string{
+		"DROP TABLE library_entries",
+	}},
+	{22, "print runs", []string{
+		"CREATE TABLE IF NOT EXISTS print_runs (id BIGINT AUTO_INCREMENT PRIMARY KEY, election BIGINT, style INT, first_number BIGINT, last_number BIGINT, batch_size INT, rev INT, requested_by BIGINT, created BIGINT, INDEX print_runs_election (election))",
+		"CREATE TABLE IF NOT EXISTS print_run_downloads (id BIGINT AUTO_INCREMENT PRIMARY KEY, run BIGINT, batch INT, downloaded_by BIGINT, downloaded BIGINT, INDEX print_run_downloads_run (run))",
+	}, []string{
+		"DROP TABLE print_run_downloads",
+		"DROP TABLE print_runs",
+	}},
+	{23, "scan revision", []string{
+		"ALTER TABLE scans ADD COLUMN rev INT DEFAULT 0",
+	}, []string{
+		"ALTER TABLE scans DROP COLUMN rev",
+	}},
+}
+
+// migrator applies one backend's migrations
+type migrator struct {
+	db    *sql.DB
+	steps []migration
+
+	// placeholder style, "$" for $1 or "?"
+	param string
+}
+
+func (m *migrator) p(i int) string {
+	if m.param == "?" {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", i)
+}
+
+func (m *migrator) setup() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version bigint PRIMARY KEY, name varchar(255), applied bigint)`)
+	if err != nil {
+		err = fmt.Errorf("schema_migrations setup, %v", err)
+	}
+	return err
+}
+
+// version is the highest applied migration, 0 if none
+func (m *migrator) version() (version int, err error) {
+	err = m.setup()
+	if err != nil {
+		return
+	}
+	var v sql.NullInt64
+	err = m.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&v)
+	if err != nil {
+		err = fmt.Errorf("schema version, %v", err)
+		return
+	}
+	return int(v.Int64), nil
+}
+
+func (m *migrator) latest() int {
+	if len(m.steps) == 0 {
+		return 0
+	}
+	return m.steps[len(m.steps)-1].Version
+}
+
+// migrate applies Up steps or rolls back Down steps until the schema is at target.
+// target latestMigration means the last step.
+func (m *migrator) migrate(target int) error {
+	if target == latestMigration {
+		target = m.latest()
+	}
+	if target < 0 || target > m.latest() {
+		return fmt.Errorf("no schema version %d, latest is %d", target, m.latest())
+	}
+	current, err := m.version()
+	if err != nil {
+		return err
+	}
+	for _, step := range m.steps {
+		if step.Version > current && step.Version <= target {
+			err = m.apply(step, step.Up, fmt.Sprintf(`INSERT INTO schema_migrations (version, name, applied) VALUES (%s, %s, %s)`, m.p(1), m.p(2), m.p(3)), step.Version, step.Name, time.Now().Unix())
+			if err != nil {
+				return err
+			}
+			log.Printf("schema migrated up to %d %s", step.Version, step.Name)
+		}
+	}
+	for i := len(m.steps) - 1; i >= 0; i-- {
+		step := m.steps[i]
+		if step.Version <= current && step.Version > target {
+			err = m.apply(step, step.Down, fmt.Sprintf(`DELETE FROM schema_migrations WHERE version = %s`, m.p(1)), step.Version)
+			if err != nil {
+				return err
+			}
+			log.Printf("schema rolled back %d %s", step.Version, step.Name)
+		}
+	}
+	return nil
+}
+
+func (m *migrator) apply(step migration, cmds []string, record string, args ...interface{}) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	for _, cmd := range cmds {
+		_, err := tx.Exec(cmd)
+		if err != nil {
+			return fmt.Errorf("migration %d %s: sql failed %#v, %v", step.Version, step.Name, cmd, err)
+		}
+	}
+	_, err = tx.Exec(record, args...)
+	if err != nil {
+		return fmt.Errorf("migration %d %s: record, %v", step.Version, step.Name, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("migration %d %s: commit, %v", step.Version, step.Name, err)
+	}
+	return nil
+}
+
+// status lists every migration and whether it has been applied
+func (m *migrator) status() (lines []string, err error) {
+	current, err := m.version()
+	if err != nil {
+		return
+	}
+	for _, step := range m.steps {
+		mark := " "
+		if step.Version <= current {
+			mark = "*"
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %s", mark, step.Version, step.Name))
+	}
+	return
+}
+
+// runMigrate does -migrate status|latest|{version}
+func runMigrate(m *migrator, arg string, out io.Writer) error {
+	switch arg {
+	case "status":
+	case "latest":
+		err := m.migrate(latestMigration)
+		if err != nil {
+			return err
+		}
+	default:
+		target, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("want status, latest, or a version number")
+		}
+		err = m.migrate(target)
+		if err != nil {
+			return err
+		}
+	}
+	lines, err := m.status()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return nil
+}
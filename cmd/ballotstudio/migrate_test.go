@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+)
+
+func TestMigrationParity(t *testing.T) {
+	for name, steps := range map[string][]migration{"postgres": postgresMigrations, "mysql": mysqlMigrations} {
+		if len(steps) != len(sqliteMigrations) {
+			t.Errorf("%s has %d migrations, sqlite has %d", name, len(steps), len(sqliteMigrations))
+			continue
+		}
+		for i, step := range steps {
+			if step.Version != sqliteMigrations[i].Version || step.Name != sqliteMigrations[i].Name {
+				t.Errorf("%s migration %d is %d %s, sqlite has %d %s", name, i, step.Version, step.Name, sqliteMigrations[i].Version, sqliteMigrations[i].Name)
+			}
+			if step.Version != i+1 {
+				t.Errorf("%s migration %d has version %d", name, i, step.Version)
+			}
+		}
+	}
+}
+
+func TestSqliteMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	mtfail(t, err, "open sqlite mem, %v", err)
+	defer db.Close()
+	db.SetMaxOpenConns(1) // one :memory: db
+	edb := NewSqliteEDB(db)
+	m := edb.Migrator()
+	err = edb.Setup()
+	mtfail(t, err, "setup, %v", err)
+	v, err := m.version()
+	mtfail(t, err, "version, %v", err)
+	if v != m.latest() {
+		t.Errorf("setup left version %d, wanted %d", v, m.latest())
+	}
+	// again is a nop
+	err = edb.Setup()
+	mtfail(t, err, "setup again, %v", err)
+
+	var out bytes.Buffer
+	err = runMigrate(m, "1", &out)
+	mtfail(t, err, "roll back to 1, %v", err)
+	_, err = edb.ScansForElection(1)
+	if err == nil {
+		t.Errorf("scans table still there after roll back")
+	}
+	if out.String()[:1] != "*" {
+		t.Errorf("status %#v", out.String())
+	}
+	err = runMigrate(m, "latest", &out)
+	mtfail(t, err, "migrate up, %v", err)
+	_, err = edb.ScansForElection(1)
+	mtfail(t, err, "scans after migrate up, %v", err)
+	err = runMigrate(m, "99", &out)
+	if err == nil {
+		t.Errorf("migrate to 99 should fail")
+	}
+}
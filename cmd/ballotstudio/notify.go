@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Email notifications, as they happen rather than weekly like the digest.
+// A user sets an address and which notices they want with POST /notifications:
+//
+//	shares    an election's owner sent you a share link, POST /election/{id}/sharelink?notify=you
+//	mentions  a review comment says @you
+//	renders   a render of your ballot, or a rescan you ran, took a long time and is done
+//
+// Collaborators are found by login name among users who have set up
+// notifications, so nobody gets mail they didn't ask for. Notices go out
+// through the same -smtp as digests.
+
+// renders and rescans that take longer than this send a notice when done
+const notifySlowWork = 30 * time.Second
+
+// a user's notification settings
+type notifyPrefs struct {
+	UserId   int64  `json:"user"`
+	Username string `json:"username"` // what @mentions and ?notify= match, case insensitive
+	Email    string `json:"email"`
+	Shares   bool   `json:"shares"`
+	Mentions bool   `json:"mentions"`
+	Renders  bool   `json:"renders"`
+}
+
+// POST /notifications body, the notices default on
+type notifyRequest struct {
+	Email    string `json:"email"`
+	Shares   bool   `json:"shares"`
+	Mentions bool   `json:"mentions"`
+	Renders  bool   `json:"renders"`
+}
+
+// @name in a comment, not in the middle of an email address
+var mentionRe = regexp.MustCompile(`(?:^|[^\w.@])@([\w.-]*\w)`)
+
+// mentions lists the distinct names @mentioned in text
+func mentions(text string) (names []string) {
+	seen := make(map[string]bool)
+	for _, m := range mentionRe.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(m[1])
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// sendNotice mails a notice, logging rather than failing whatever caused it
+func (sh *StudioHandler) sendNotice(np *notifyPrefs, subject, body string) bool {
+	err := sh.mailer.SendMail(np.Email, subject, body)
+	if err != nil {
+		log.Printf("notice to user %d, %v", np.UserId, err)
+		return false
+	}
+	return true
+}
+
+// notifyShare mails the link to each named user who wants share notices,
+// returning the names mailed
+func (sh *StudioHandler) notifyShare(from *login.User, names []string, electionid int64, link shareLinkJSON) (sent []string) {
+	subject := fmt.Sprintf("BallotStudio: %s shared election %d with you", from.Username, electionid)
+	body := fmt.Sprintf("%s shared a proof of election %d with you.\n\nBallot PDF: %s\nPage images: %s\n\nThe links work without logging in until %s.\n",
+		from.Username, electionid, link.PDFURL, link.PNGURL, link.Expires.Format("Monday 2 January 2006 15:04 MST"))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		np, err := sh.edb.NotifyPrefsForUsername(name)
+		if err != nil {
+			log.Printf("notify %q, %v", name, err)
+			continue
+		}
+		if np == nil || !np.Shares || np.UserId == from.Guid {
+			continue
+		}
+		if sh.sendNotice(np, subject, body) {
+			sent = append(sent, np.Username)
+		}
+	}
+	return
+}
+
+// notifyMentions mails everyone @mentioned in a new annotation who wants
+// mention notices, except its author
+func (sh *StudioHandler) notifyMentions(r *http.Request, ar annotationRecord) {
+	names := mentions(ar.Comment)
+	if len(names) == 0 {
+		return
+	}
+	subject := fmt.Sprintf("BallotStudio: %s mentioned you on election %d", ar.AuthorName, ar.ElectionId)
+	body := fmt.Sprintf("%s commented on page %d of election %d:\n\n%s\n\n%s\n",
+		ar.AuthorName, ar.Page+1, ar.ElectionId, ar.Comment, serverURL(r, "/election/"+electionRef(r, ar.ElectionId)+"/review.pdf"))
+	for _, name := range names {
+		np, err := sh.edb.NotifyPrefsForUsername(name)
+		if err != nil {
+			log.Printf("notify %q, %v", name, err)
+			continue
+		}
+		if np == nil || !np.Mentions || np.UserId == ar.Author {
+			continue
+		}
+		sh.sendNotice(np, subject, body)
+	}
+}
+
+// notifySlow mails uid that something they waited on for `took` is done, if
+// it was slow and they want render notices
+func (sh *StudioHandler) notifySlow(uid int64, took time.Duration, subject, body string) {
+	if took < notifySlowWork {
+		return
+	}
+	np, err := sh.edb.GetNotifyPrefs(uid)
+	if err != nil {
+		log.Printf("notify user %d, %v", uid, err)
+		return
+	}
+	if np == nil || !np.Renders {
+		return
+	}
+	sh.sendNotice(np, subject, body+fmt.Sprintf("\nIt took %s.\n", took.Round(time.Second)))
+}
+
+// GET /notifications your settings, POST /notifications set them, DELETE /notifications stop them
+func (sh *StudioHandler) handleNotifications(w http.ResponseWriter, r *http.Request, user *login.User) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		np, err := sh.edb.GetNotifyPrefs(user.Guid)
+		if maybeerr(w, err, 500, "db notifications") {
+			return
+		}
+		if np == nil {
+			texterr(w, 404, "no notifications set up")
+			return
+		}
+		writeJSON(w, np)
+	case "POST":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		req := notifyRequest{Shares: true, Mentions: true, Renders: true}
+		err = json.Unmarshal(body, &req)
+		if maybeerr(w, err, 400, "bad json, %v", err) {
+			return
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if !strings.Contains(req.Email, "@") || !headerSafe(req.Email) {
+			texterr(w, 400, "bad email %q", req.Email)
+			return
+		}
+		np := notifyPrefs{user.Guid, user.Username, req.Email, req.Shares, req.Mentions, req.Renders}
+		err = sh.edb.PutNotifyPrefs(np)
+		if maybeerr(w, err, 500, "db notifications put") {
+			return
+		}
+		writeJSON(w, np)
+	case "DELETE":
+		err := sh.edb.DeleteNotifyPrefs(user.Guid)
+		if maybeerr(w, err, 500, "db notifications delete") {
+			return
+		}
+		texterr(w, 200, "notifications stopped")
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET, POST or DELETE")
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// common to all backends, query selects user_id, username, email, shares, mentions, renders
+func getNotifyPrefs(db sqlDB, query string, arg interface{}) (*notifyPrefs, error) {
+	var np notifyPrefs
+	var shares, mentions, renders int
+	err := db.QueryRow(query, arg).Scan(&np.UserId, &np.Username, &np.Email, &shares, &mentions, &renders)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("notify prefs get, %v", err)
+	}
+	np.Shares, np.Mentions, np.Renders = shares != 0, mentions != 0, renders != 0
+	return &np, nil
+}
+
+// common to all backends
+func queryNotifyPrefs(db sqlDB) (out []notifyPrefs, err error) {
+	rows, err := db.Query(`SELECT user_id, username, email, shares, mentions, renders FROM notify_prefs ORDER BY user_id`)
+	if err != nil {
+		return nil, fmt.Errorf("notify prefs, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var np notifyPrefs
+		var shares, mentions, renders int
+		err = rows.Scan(&np.UserId, &np.Username, &np.Email, &shares, &mentions, &renders)
+		if err != nil {
+			return nil, fmt.Errorf("notify prefs row, %v", err)
+		}
+		np.Shares, np.Mentions, np.Renders = shares != 0, mentions != 0, renders != 0
+		out = append(out, np)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestMentions(t *testing.T) {
+	got := mentions("@Ann please check this, and @bob.smith too. Mail clerk@example.com or @ann again.")
+	if !reflect.DeepEqual(got, []string{"ann", "bob.smith"}) {
+		t.Errorf("got %v", got)
+	}
+	if got := mentions("no one"); got != nil {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	mail := &testMailer{}
+	sh := StudioHandler{edb: edb, mailer: mail, shareKey: []byte("test share key")}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: `{}`})
+	mtfail(t, err, "put election, %v", err)
+
+	ann := &login.User{Guid: 7, Username: "ann"}
+	bob := &login.User{Guid: 8, Username: "Bob"}
+	cat := &login.User{Guid: 9, Username: "cat"}
+	setPrefs := func(user *login.User, body string) (int, notifyPrefs) {
+		rec := httptest.NewRecorder()
+		sh.handleNotifications(rec, httptest.NewRequest("POST", "/notifications", strings.NewReader(body)), user)
+		var np notifyPrefs
+		json.Unmarshal(rec.Body.Bytes(), &np)
+		return rec.Code, np
+	}
+	if code, _ := setPrefs(bob, `{"email": "not an address"}`); code != 400 {
+		t.Errorf("bad email got %d", code)
+	}
+	code, np := setPrefs(bob, `{"email": "bob@example.com"}`)
+	if code != 200 || np != (notifyPrefs{8, "Bob", "bob@example.com", true, true, true}) {
+		t.Errorf("defaults %d %#v", code, np)
+	}
+	setPrefs(ann, `{"email": "ann@example.com"}`)
+	setPrefs(cat, `{"email": "cat@example.com", "shares": false, "mentions": false}`)
+
+	rec := httptest.NewRecorder()
+	sh.handleNotifications(rec, httptest.NewRequest("GET", "/notifications", nil), cat)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"renders":true`) || !strings.Contains(rec.Body.String(), `"shares":false`) {
+		t.Errorf("get %d %s", rec.Code, rec.Body.String())
+	}
+
+	// a share link mailed to those who want it, matching names case insensitively
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: `{}`})
+	mtfail(t, err, "put election, %v", err)
+	rec = httptest.NewRecorder()
+	sh.handleElectionShareLink(rec, httptest.NewRequest("POST", "/election/1/sharelink?notify=bob,+cat,nobody,ann", nil), ann, eid)
+	var sl shareLinkJSON
+	json.Unmarshal(rec.Body.Bytes(), &sl)
+	if rec.Code != 200 || !reflect.DeepEqual(sl.Notified, []string{"Bob"}) {
+		t.Fatalf("share %d %s", rec.Code, rec.Body.String())
+	}
+	if len(mail.sent) != 1 || mail.sent[0].to != "bob@example.com" || !strings.Contains(mail.sent[0].body, sl.PDFURL) {
+		t.Errorf("share mail %#v", mail.sent)
+	}
+
+	// @mentions, but not of yourself or someone who opted out
+	mail.sent = nil
+	rec = httptest.NewRecorder()
+	body := `{"page": 0, "x": 0.5, "y": 0.5, "comment": "@bob @cat @ann the date is wrong"}`
+	sh.handleElectionAnnotations(rec, httptest.NewRequest("POST", "/election/1/annotations", strings.NewReader(body)), ann, eid, 0)
+	if rec.Code != 200 {
+		t.Fatalf("annotate %d %s", rec.Code, rec.Body.String())
+	}
+	if len(mail.sent) != 1 || mail.sent[0].to != "bob@example.com" || !strings.Contains(mail.sent[0].body, "the date is wrong") {
+		t.Errorf("mention mail %#v", mail.sent)
+	}
+
+	// slow work only
+	mail.sent = nil
+	sh.notifySlow(cat.Guid, time.Second, "quick", "done")
+	sh.notifySlow(cat.Guid, time.Minute, "slow", "done")
+	sh.notifySlow(42, time.Minute, "no settings", "done")
+	if len(mail.sent) != 1 || mail.sent[0].subject != "slow" || !strings.Contains(mail.sent[0].body, "It took 1m0s") {
+		t.Errorf("slow mail %#v", mail.sent)
+	}
+
+	rec = httptest.NewRecorder()
+	sh.handleNotifications(rec, httptest.NewRequest("DELETE", "/notifications", nil), bob)
+	if np, _ := edb.GetNotifyPrefs(bob.Guid); rec.Code != 200 || np != nil {
+		t.Errorf("delete %d %#v", rec.Code, np)
+	}
+}
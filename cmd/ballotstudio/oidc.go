@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect sign in. Besides the login library's -oauth-json
+// providers, any OpenID Connect issuer (Azure AD, Okta, Keycloak, ...) can
+// be used from its discovery document by listing it in -oidc-json:
+//
+//	[{"name": "Okta", "issuer": "https://example.okta.com", "client_id": "...", "client_secret": "..."}]
+//
+// "discovery_url" is for providers whose discovery document isn't at
+// {issuer}/.well-known/openid-configuration, "scopes" defaults to openid,
+// email and profile, and "id" (default from the name) is the provider's
+// path: sign in starts at /oidc/{id} and the redirect URI to register with
+// the provider is /oidc/{id}/callback.
+//
+// The code flow uses PKCE, and the ID token's signature, issuer, audience,
+// expiry and nonce are all checked. The first sign in of an identity makes
+// a user named {id}:{preferred_username, email or subject}, with a display
+// name and email from the token. Sessions are made as in extlogin.go, with
+// -oidc-key, which must stay the same for people to keep signing in.
+
+// how long someone has to finish signing in at the provider
+const oidcSignInTime = 10 * time.Minute
+
+// how long a discovery document is used before it is fetched again
+const oidcDiscoveryTTL = 24 * time.Hour
+
+// least time between signing key fetches for unknown key ids
+const oidcKeysRefetch = time.Minute
+
+// ID token times may be this far off the server's clock
+const oidcClockSkew = time.Minute
+
+// largest discovery, key set or token response, bytes
+const maxOIDCResponse = 1000000
+
+const oidcCookie = "oidc"
+
+var oidcPathRe = regexp.MustCompile(`^/oidc/([a-z0-9-]+)(/callback)?$`)
+var oidcIdRe = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// one -oidc-json entry
+type oidcConfig struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	DiscoveryURL string   `json:"discovery_url"`
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// the parts of a discovery document used
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JwksURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type oidcProvider struct {
+	oidcConfig
+
+	client *http.Client
+
+	lock        sync.Mutex
+	discovery   *oidcDiscovery
+	discovered  time.Time
+	keys        map[string]interface{} // kid -> *rsa.PublicKey or *ecdsa.PublicKey
+	keysFetched time.Time
+}
+
+// StartUrl is where signing in with p starts, for the home and signup pages
+func (p *oidcProvider) StartUrl() string {
+	return "/oidc/" + p.Id
+}
+
+var nonIdRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// parseOIDCConfig reads -oidc-json
+func parseOIDCConfig(r io.Reader) ([]*oidcProvider, error) {
+	var configs []oidcConfig
+	err := json.NewDecoder(r).Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("bad json, %v", err)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	seen := make(map[string]bool)
+	var out []*oidcProvider
+	for i, oc := range configs {
+		if oc.Name == "" || oc.ClientId == "" || (oc.Issuer == "" && oc.DiscoveryURL == "") {
+			return nil, fmt.Errorf("provider %d: name, client_id and issuer are required", i)
+		}
+		if oc.Id == "" {
+			oc.Id = strings.Trim(nonIdRe.ReplaceAllString(strings.ToLower(oc.Name), "-"), "-")
+		}
+		if !oidcIdRe.MatchString(oc.Id) {
+			return nil, fmt.Errorf("provider %d: id %q should be lower case letters, digits and -", i, oc.Id)
+		}
+		if seen[oc.Id] {
+			return nil, fmt.Errorf("provider %d: id %q used twice", i, oc.Id)
+		}
+		seen[oc.Id] = true
+		if oc.DiscoveryURL == "" {
+			oc.DiscoveryURL = strings.TrimSuffix(oc.Issuer, "/") + "/.well-known/openid-configuration"
+		}
+		if len(oc.Scopes) == 0 {
+			oc.Scopes = []string{"openid", "email", "profile"}
+		}
+		out = append(out, &oidcProvider{oidcConfig: oc, client: client})
+	}
+	return out, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(v)
+}
+
+// discover fetches p's discovery document, or has it from the last day
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.discovery != nil && time.Since(p.discovered) < oidcDiscoveryTTL {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	err := p.getJSON(ctx, p.DiscoveryURL, &d)
+	if err != nil {
+		return nil, fmt.Errorf("%s discovery, %v", p.Id, err)
+	}
+	if d.Issuer == "" || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, fmt.Errorf("%s discovery missing issuer or endpoints", p.Id)
+	}
+	if p.Issuer != "" && strings.TrimSuffix(d.Issuer, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("%s discovery issuer %q, configured %q", p.Id, d.Issuer, p.Issuer)
+	}
+	p.discovery, p.discovered = &d, time.Now()
+	return &d, nil
+}
+
+// a JSON web key, RSA or EC
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("bad key number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64int(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, fmt.Errorf("bad rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("ec key not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// signingKey finds key kid, fetching the key set again if it's new
+func (p *oidcProvider) signingKey(ctx context.Context, d *oidcDiscovery, kid string) (interface{}, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeysRefetch {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := p.getJSON(ctx, d.JwksURI, &set)
+	if err != nil {
+		return nil, fmt.Errorf("%s keys, %v", p.Id, err)
+	}
+	p.keys = make(map[string]interface{}, len(set.Keys))
+	p.keysFetched = time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("%s key %q: %v", p.Id, k.Kid, err)
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verifyJWS checks sig over signed with key by alg
+func verifyJWS(alg string, key interface{}, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch strings.TrimLeft(alg, "RSEP") {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if hash == 0 || len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return errors.New("bad ecdsa signature size")
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return errors.New("bad ecdsa signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("alg %q doesn't fit the key", alg)
+}
+
+// aud is one string or a list
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*a = oidcAudience{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// the ID token claims used
+type oidcClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	Expires           int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	PreferredUsername string       `json:"preferred_username"`
+	Name              string       `json:"name"`
+}
+
+// verifyIDToken checks an ID token is from p, for us, current, and for this sign in
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token, nonce string) (*oidcClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token not a JWS")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(hb, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("id token header, %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id token signature, %v", err)
+	}
+	key, err := p.signingKey(ctx, d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWS(header.Alg, key, parts[0]+"."+parts[1], sig)
+	if err != nil {
+		return nil, fmt.Errorf("id token signature, %v", err)
+	}
+	var claims oidcClaims
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(pb, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("id token claims, %v", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, fmt.Errorf("id token from %q, not %q", claims.Issuer, d.Issuer)
+	case !containsString(claims.Audience, p.ClientId):
+		return nil, fmt.Errorf("id token for %v, not us", claims.Audience)
+	case now.Add(-oidcClockSkew).Unix() >= claims.Expires:
+		return nil, errors.New("id token expired")
+	case claims.IssuedAt > now.Add(oidcClockSkew).Unix():
+		return nil, errors.New("id token from the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("id token for another sign in")
+	case claims.Subject == "":
+		return nil, errors.New("id token has no subject")
+	}
+	return &claims, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange trades a code for p's ID token and verifies it
+func (p *oidcProvider) exchange(ctx context.Context, code, redirectURI, verifier, nonce string) (*oidcClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	// client_secret_basic unless the provider only takes client_secret_post
+	basic := len(d.TokenAuthMethods) == 0 || containsString(d.TokenAuthMethods, "client_secret_basic")
+	if !basic {
+		form.Set("client_id", p.ClientId)
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s token, %v", p.Id, err)
+	}
+	defer resp.Body.Close()
+	var tr struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOIDCResponse))
+	if err == nil {
+		err = json.Unmarshal(body, &tr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s token %s, %v", p.Id, resp.Status, err)
+	}
+	if tr.Error != "" || resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s token %s, %s %s", p.Id, resp.Status, tr.Error, tr.ErrorDescription)
+	}
+	if tr.IdToken == "" {
+		return nil, fmt.Errorf("%s token response has no id_token", p.Id)
+	}
+	return p.verifyIDToken(ctx, tr.IdToken, nonce)
+}
+
+// handles /oidc/{id} and /oidc/{id}/callback
+type oidcHandler struct {
+	providers map[string]*oidcProvider
+	users     *externalUsers
+}
+
+func oidcRandom() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func (oh *oidcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := oidcPathRe.FindStringSubmatch(r.URL.Path)
+	if m == nil || oh.providers[m[1]] == nil {
+		texterr(w, 404, "no such sign in provider")
+		return
+	}
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	p := oh.providers[m[1]]
+	if m[2] != "" {
+		oh.callback(w, r, p)
+	} else {
+		oh.start(w, r, p)
+	}
+}
+
+func (oh *oidcHandler) redirectURI(r *http.Request, p *oidcProvider) string {
+	return serverURL(r, "/oidc/"+p.Id+"/callback")
+}
+
+// start sends the browser to the provider
+func (oh *oidcHandler) start(w http.ResponseWriter, r *http.Request, p *oidcProvider) {
+	d, err := p.discover(r.Context())
+	if err != nil {
+		log.Print(err)
+		texterr(w, http.StatusBadGateway, "%s sign in is unavailable", p.Name)
+		return
+	}
+	state, nonce, verifier := oidcRandom(), oidcRandom(), oidcRandom()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    strings.Join([]string{p.Id, state, nonce, verifier}, "."),
+		Path:     sitePath(r, "/oidc/"),
+		MaxAge:   int(oidcSignInTime.Seconds()),
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientId},
+		"redirect_uri":          {oh.redirectURI(r, p)},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// callback is where the provider sends the browser back
+func (oh *oidcHandler) callback(w http.ResponseWriter, r *http.Request, p *oidcProvider) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		texterr(w, http.StatusForbidden, "%s sign in refused: %s %s", p.Name, e, q.Get("error_description"))
+		return
+	}
+	c, err := r.Cookie(oidcCookie)
+	var parts []string
+	if err == nil {
+		parts = strings.Split(c.Value, ".")
+	}
+	if len(parts) != 4 || parts[0] != p.Id || subtle.ConstantTimeCompare([]byte(parts[1]), []byte(q.Get("state"))) != 1 {
+		texterr(w, 400, "sign in expired or started elsewhere, try again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: sitePath(r, "/oidc/"), MaxAge: -1})
+	claims, err := p.exchange(r.Context(), q.Get("code"), oh.redirectURI(r, p), parts[3], parts[2])
+	if err != nil {
+		log.Printf("oidc %s: %v", p.Id, err)
+		texterr(w, http.StatusForbidden, "%s sign in failed", p.Name)
+		return
+	}
+	oi, err := oh.identity(p, claims)
+	if maybeerr(w, err, 500, "oidc user") {
+		return
+	}
+	if err = oh.users.signIn(w, r, oi); err != nil {
+		log.Printf("oidc %s: %v", p.Id, err)
+		texterr(w, 500, "sign in failed")
+		return
+	}
+	http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
+}
+
+// identity finds the user for claims, making one on first sign in
+func (oh *oidcHandler) identity(p *oidcProvider, claims *oidcClaims) (*externalIdentity, error) {
+	name := claims.PreferredUsername
+	if name == "" {
+		name = claims.Email
+	}
+	usernames := []string{p.Id + ":" + claims.Subject}
+	if name != "" {
+		usernames = []string{p.Id + ":" + name, usernames[0]}
+	}
+	return oh.users.user(p.Id, claims.Issuer, claims.Subject, usernames, claims.Name, claims.Email)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// fakeIssuer is an OpenID Connect provider signing ID tokens with key
+type fakeIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{} // the next token's
+}
+
+func (fi *fakeIssuer) token(claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "kid": "k1"}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, fi.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	mtfail(t, err, "rsa key, %v", err)
+	fi := &fakeIssuer{key: key}
+	mux := http.NewServeMux()
+	fi.server = httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, oidcDiscovery{Issuer: fi.server.URL, AuthorizationEndpoint: fi.server.URL + "/auth", TokenEndpoint: fi.server.URL + "/token", JwksURI: fi.server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+		writeJSON(w, map[string][]jwk{"keys": {{Kty: "RSA", Kid: "k1", Use: "sig", N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()), E: e}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "studio" || secret != "shh" || r.FormValue("code") != "good" || r.FormValue("code_verifier") == "" {
+			w.WriteHeader(400)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]string{"id_token": fi.token(fi.claims)})
+	})
+	return fi
+}
+
+func TestOIDC(t *testing.T) {
+	fi := newFakeIssuer(t)
+	defer fi.server.Close()
+	providers, err := parseOIDCConfig(strings.NewReader(`[{"name": "Big Co SSO", "issuer": "` + fi.server.URL + `", "client_id": "studio", "client_secret": "shh"}]`))
+	mtfail(t, err, "config, %v", err)
+	p := providers[0]
+	if p.Id != "big-co-sso" || len(p.Scopes) != 3 {
+		t.Errorf("config defaults %#v", p.oidcConfig)
+	}
+	for _, bad := range []string{`[{"name": "x"}]`, `[{"name": "x", "id": "X!", "issuer": "i", "client_id": "c"}]`, `[{"name": "x", "issuer": "i", "client_id": "c"}, {"name": "X", "issuer": "j", "client_id": "c"}]`} {
+		if _, err := parseOIDCConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+
+	edb, db := testSqliteEDB(t)
+	udb := login.NewSqlUserDB(db)
+	err = udb.Setup()
+	mtfail(t, err, "udb setup, %v", err)
+	oh := &oidcHandler{providers: map[string]*oidcProvider{p.Id: p}, users: &externalUsers{edb, udb, make([]byte, 32)}}
+
+	// start sends the browser to the provider with PKCE and a nonce
+	rec := httptest.NewRecorder()
+	oh.ServeHTTP(rec, httptest.NewRequest("GET", "/oidc/big-co-sso", nil))
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != 302 || loc == nil || loc.Path != "/auth" || loc.Query().Get("code_challenge_method") != "S256" || loc.Query().Get("client_id") != "studio" {
+		t.Fatalf("start %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	cookie := rec.Result().Cookies()[0]
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 4 || parts[1] != loc.Query().Get("state") || parts[2] != loc.Query().Get("nonce") {
+		t.Fatalf("cookie %q", cookie.Value)
+	}
+
+	// a callback with the wrong state is refused before asking for a token
+	req := httptest.NewRequest("GET", "/oidc/big-co-sso/callback?code=good&state=wrong", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	oh.ServeHTTP(rec, req)
+	if rec.Code != 400 {
+		t.Errorf("wrong state %d", rec.Code)
+	}
+
+	now := time.Now().Unix()
+	good := func() map[string]interface{} {
+		return map[string]interface{}{"iss": fi.server.URL, "sub": "u-1", "aud": "studio", "exp": now + 300, "iat": now, "nonce": "n1", "email": "ann@bigco.example", "preferred_username": "ann", "name": "Ann Clerk"}
+	}
+	ctx := context.Background()
+	fi.claims = good()
+	claims, err := p.exchange(ctx, "good", "https://studio.example/oidc/big-co-sso/callback", "v", "n1")
+	mtfail(t, err, "exchange, %v", err)
+	if claims.Subject != "u-1" || claims.Email != "ann@bigco.example" {
+		t.Errorf("claims %#v", claims)
+	}
+	if _, err := p.exchange(ctx, "bad", "x", "v", "n1"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("bad code, %v", err)
+	}
+	for name, change := range map[string]func(map[string]interface{}){
+		"nonce":    func(c map[string]interface{}) { c["nonce"] = "other" },
+		"audience": func(c map[string]interface{}) { c["aud"] = []string{"someone-else"} },
+		"expired":  func(c map[string]interface{}) { c["exp"] = now - 600 },
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example" },
+	} {
+		fi.claims = good()
+		change(fi.claims)
+		if _, err := p.exchange(ctx, "good", "x", "v", "n1"); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	forged := fi.token(good())
+	forged = forged[:len(forged)-4] + "AAAA"
+	if _, err := p.verifyIDToken(ctx, forged, "n1"); err == nil {
+		t.Errorf("forged signature accepted")
+	}
+
+	// the first sign in makes a user, later ones find it
+	oi, err := oh.identity(p, claims)
+	mtfail(t, err, "identity, %v", err)
+	if oi.Username != "big-co-sso:ann" || oi.UserId == 0 {
+		t.Errorf("identity %#v", oi)
+	}
+	ar, _ := edb.GetAccount(oi.UserId)
+	if ar == nil || ar.DisplayName != "Ann Clerk" || ar.Email != "ann@bigco.example" {
+		t.Errorf("profile %#v", ar)
+	}
+	again, err := oh.identity(p, claims)
+	mtfail(t, err, "identity again, %v", err)
+	if again.UserId != oi.UserId {
+		t.Errorf("second sign in user %d, first %d", again.UserId, oi.UserId)
+	}
+	if oh.users.password(oi.Issuer, "u-1") == oh.users.password(oi.Issuer, "u-2") {
+		t.Errorf("identities share a password")
+	}
+
+	// a disabled account doesn't get a session
+	ar.Disabled = now
+	err = edb.PutAccount(*ar)
+	mtfail(t, err, "disable, %v", err)
+	rec = httptest.NewRecorder()
+	if err = oh.users.signIn(rec, httptest.NewRequest("GET", "/oidc/big-co-sso/callback", nil), oi); err == nil || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("disabled account signed in, %v", err)
+	}
+}
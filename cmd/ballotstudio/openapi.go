@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+// apiRoute describes one endpoint for /openapi.json
+// Request and Response are example Go values; their types become the JSON schemas,
+// so the spec follows the structs the handlers actually marshal.
+type apiRoute struct {
+	Path    string
+	Method  string
+	Summary string
+	Tag     string
+	Query   []apiParam
+
+	Request     interface{} // JSON body, or nil
+	RequestType string      // non-JSON request body content type
+
+	Response     interface{} // JSON response, or nil
+	ResponseType string      // non-JSON response content type
+
+	Auth   bool  // requires login
+	Errors []int // besides 200
+}
+
+type apiParam struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+var redrawParam = apiParam{"redraw", "true to skip the render cache", "boolean"}
+
+// override the document's RenderOptions, see draw.ParseRenderOptions
+var renderQuery = []apiParam{redrawParam,
+	{"pagesize", "letter, legal or a4", "string"},
+	{"duplex", "true to pad each ballot style to an even number of pages", "boolean"},
+	{"columns", "contest columns per page, 1 to 6", "integer"},
+	{"minfont", "smallest font size in points", "number"},
+	{"highcontrast", "true for black on white with no shaded title bars", "boolean"},
+	{"layout", "office-block or party-column", "string"},
+	{"pdfa", "true for tagged PDF/A-2b with embedded fonts and document metadata", "boolean"},
+	{"proof", "true to stamp SAMPLE / PROOF across every page", "boolean"},
+	{"profile", "render profile, e.g. large-print, high-contrast or single-column, or one from the document's RenderProfiles", "string"},
+	{"final", "true for production ballots, 409 unless the election is approved, published or locked", "boolean"}}
+
+var bubblesVersionParam = apiParam{"version", "bubbles json version, 1 (the default) or 2", "integer"}
+
+var testDeckQuery = []apiParam{{"once", "true to mark each position on one ballot, not the Nth on N", "boolean"}}
+
+var custodyQuery = []apiParam{
+	{"device", "id of the scanner, required unless -scan-custody-optional", "string"},
+	{"operator", "who ran the scanner, required unless -scan-custody-optional", "string"},
+	{"batch", "batch number, required unless -scan-custody-optional", "string"},
+	{"precinct", "precinct the ballots came from, required unless -scan-custody-optional", "string"}}
+
+var auditQuery = []apiParam{{"risk", "risk limit, default 0.05", "number"}, {"seed", "sampler seed, random if not given", "string"}, {"contest", "contest @id to audit, repeatable, default all", "string"}}
+
+var districtImportQuery = []apiParam{{"format", "geojson or vip", "string"}, {"precinct", "geojson: the feature property holding the precinct code", "string"}, {"name", "geojson: the feature property holding the precinct name", "string"}, {"district", "geojson: PROPERTY:type, a property assigning districts of that ReportingUnit type, repeatable", "string"}}
+
+var fontUploadQuery = []apiParam{{"license", "the font's license, e.g. OFL-1.1, required", "string"}, {"license_uri", "where the license text is", "string"}}
+
+// election document, NIST 1500-100 v2 ElectionReport json
+type electionDocument map[string]interface{}
+
+// POST /election/{id}/scan result, contest id -> selection id -> marked
+type scanMarks map[string]map[string]bool
+
+var apiRoutes = []apiRoute{
+	{Path: "/election", Method: "post", Tag: "election", Summary: "Create a new election document; with ?template={id} the body is instead {\"placeholder\": \"value\"} to fill in that template",
+		Query:   []apiParam{{"template", "id of a template election to copy", "integer"}},
+		Request: electionDocument{}, Response: EditContext{}, Auth: true, Errors: []int{400, 401, 403, 404, 413, 429, 503}},
+	{Path: "/election/{id}", Method: "get", Tag: "election", Summary: "Get an election document",
+		Query:    []apiParam{{"dl", "true to download as attachment", "boolean"}},
+		Response: electionDocument{}, Errors: []int{400}},
+	{Path: "/election/{id}", Method: "post", Tag: "election", Summary: "Replace an election document",
+		Request: electionDocument{}, Response: EditContext{}, Auth: true, Errors: []int{400, 401, 409, 503}},
+	{Path: "/election/{id}", Method: "delete", Tag: "election", Summary: "Move an election to the trash, purged after 30 days",
+		Response: []trashedElection{}, Auth: true, Errors: []int{401, 403, 404}},
+	{Path: "/trash.json", Method: "get", Tag: "election", Summary: "Your elections in the trash",
+		Response: []trashedElection{}, Auth: true, Errors: []int{401, 500}},
+	{Path: "/trash/{id}/restore", Method: "post", Tag: "election", Summary: "Take an election back out of the trash",
+		Response: EditContext{}, Auth: true, Errors: []int{401, 403, 404, 409}},
+	{Path: "/digest", Method: "get", Tag: "digest", Summary: "Your weekly digest email schedule",
+		Response: digestSchedule{}, Auth: true, Errors: []int{401, 404, 500}},
+	{Path: "/digest", Method: "post", Tag: "digest", Summary: "Schedule a weekly digest email; weekday 0 is Sunday, hour is UTC",
+		Request: digestRequest{}, Response: digestSchedule{}, Auth: true, Errors: []int{400, 401, 500}},
+	{Path: "/digest", Method: "delete", Tag: "digest", Summary: "Stop the weekly digest email",
+		ResponseType: "text/plain", Auth: true, Errors: []int{401, 500}},
+	{Path: "/digest/report", Method: "get", Tag: "digest", Summary: "Elections needing attention, as the next digest would list them",
+		Response: digestReport{}, Auth: true, Errors: []int{401, 500}},
+	{Path: "/admin/staff", Method: "get", Tag: "admin", Summary: "Provisioned staff; admins only",
+		Response: []staffRecord{}, Auth: true, Errors: []int{401, 403, 500}},
+	{Path: "/admin/staff", Method: "post", Tag: "admin", Summary: "Provision staff from CSV of email,role,organization, inviting new ones; admins only. Any bad row is a 400 report and nothing changes",
+		RequestType: "text/csv", Response: staffReport{}, Auth: true, Errors: []int{400, 401, 403, 500}},
+	{Path: "/admin/jobs", Method: "get", Tag: "admin", Summary: "Background jobs with their run counts, timings and last results; admins only",
+		Response: []jobStats{}, Auth: true, Errors: []int{401, 403, 500}},
+	{Path: "/admin/jobs/{job}", Method: "get", Tag: "admin", Summary: "One background job's stats; admins only",
+		Response: jobStats{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/admin/jobs/{job}", Method: "post", Tag: "admin", Summary: "Run a background job now and wait for it; admins only",
+		Response: jobStats{}, Auth: true, Errors: []int{401, 403, 404, 409, 500}},
+	{Path: "/admin/cache", Method: "get", Tag: "admin", Summary: "Render cache entries and bytes; admins only",
+		Response: cacheStatus{}, Auth: true, Errors: []int{401, 403, 500}},
+	{Path: "/admin/cache/invalidate", Method: "post", Tag: "admin", Summary: "Drop cached renders, including last good ones, of some elections or all; admins only",
+		Query:    []apiParam{{"ids", "comma separated election ids", "string"}, {"all", "true to drop everything", "boolean"}},
+		Response: cacheStatus{}, Auth: true, Errors: []int{400, 401, 403, 500}},
+	{Path: "/admin/cache/warm", Method: "post", Tag: "admin", Summary: "Render elections' PDFs and page PNGs into the cache now, one at a time; admins only",
+		Query:    []apiParam{{"ids", "comma separated election ids, at most 500", "string"}},
+		Response: []cacheWarmResult{}, Auth: true, Errors: []int{400, 401, 403}},
+	{Path: "/admin/calendar", Method: "get", Tag: "admin", Summary: "Elections on the instance by date, soonest first; admins only",
+		Query:    []apiParam{{"from", "YYYY-MM-DD, default today", "string"}, {"days", "how far ahead, default 90, at most 366", "integer"}, {"jurisdiction", "only this jurisdiction, any case", "string"}, {"type", "only this election type, e.g. general", "string"}},
+		Response: calendarResponse{}, Auth: true, Errors: []int{400, 401, 403, 500}},
+	{Path: "/admin/quotas/{user}", Method: "get", Tag: "admin", Summary: "A user's storage limits and usage; admins only",
+		Response: userQuotaJSON{}, Auth: true, Errors: []int{400, 401, 403, 500}},
+	{Path: "/admin/quotas/{user}", Method: "put", Tag: "admin", Summary: "Give a user other storage limits, 0 for none; fields left out keep their value; admins only",
+		Request: quotaLimits{}, Response: userQuotaJSON{}, Auth: true, Errors: []int{400, 401, 403, 500}},
+	{Path: "/admin/quotas/{user}", Method: "delete", Tag: "admin", Summary: "Put a user back on the default storage limits; admins only",
+		Response: userQuotaJSON{}, Auth: true, Errors: []int{400, 401, 403, 500}},
+	{Path: "/elections/search", Method: "get", Tag: "election", Summary: "Search titles, contest and candidate names of your own and published elections, best first",
+		Query:    []apiParam{{"q", "words, each must start a word in the election", "string"}, {"limit", "most results, default 50, at most 200", "integer"}},
+		Response: []searchHit{}, Errors: []int{400, 500}},
+	{Path: "/elections/compare", Method: "get", Tag: "election", Summary: "What changed from election a to election b: contests and candidates added, removed and changed, selections, and old and new text",
+		Query:    []apiParam{{"a", "election number or public id, or {id}@{rev} for a revision", "string"}, {"b", "election number or public id, or {id}@{rev} for a revision", "string"}},
+		Response: electionComparison{}, Auth: true, Errors: []int{400, 401, 404, 500}},
+	{Path: "/elections/tags", Method: "get", Tag: "election", Summary: "Your tags with how many of your elections have each, most used first",
+		Response: []tagCount{}, Auth: true, Errors: []int{401, 500}},
+	{Path: "/elections/tags/{tag}", Method: "get", Tag: "election", Summary: "Your elections with a tag",
+		Response: []taggedElection{}, Auth: true, Errors: []int{400, 401, 500}},
+	{Path: "/election/{id}/tags", Method: "get", Tag: "election", Summary: "The election's tags; owner only",
+		Response: []string{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/election/{id}/tags", Method: "put", Tag: "election", Summary: "Replace the election's tags; owner only. Tags are lower cased letters, digits, space, '-', '_' and '.', at most 64 bytes and 32 to an election",
+		Request: []string{}, Response: []string{}, Auth: true, Errors: []int{400, 401, 403, 404, 500}},
+	{Path: "/election/{id}/tags/{tag}", Method: "put", Tag: "election", Summary: "Add a tag; owner only",
+		Response: []string{}, Auth: true, Errors: []int{400, 401, 403, 404, 500}},
+	{Path: "/election/{id}/tags/{tag}", Method: "delete", Tag: "election", Summary: "Remove a tag; owner only",
+		Response: []string{}, Auth: true, Errors: []int{400, 401, 403, 404, 500}},
+	{Path: "/webhooks", Method: "get", Tag: "webhook", Summary: "Your webhooks, without their secrets",
+		Response: []webhookRecord{}, Auth: true, Errors: []int{401, 500}},
+	{Path: "/webhooks", Method: "post", Tag: "webhook", Summary: "Register a URL to POST signed events to, for one election or all of yours; the response has the HMAC secret, shown only this once",
+		Request: webhookRequest{}, Response: webhookRecord{}, Auth: true, Errors: []int{400, 401, 403, 404, 409, 500}},
+	{Path: "/webhooks/{webhookid}", Method: "delete", Tag: "webhook", Summary: "Remove a webhook and its delivery history, returns the rest",
+		Response: []webhookRecord{}, Auth: true, Errors: []int{401, 404, 500}},
+	{Path: "/webhooks/{webhookid}/deliveries", Method: "get", Tag: "webhook", Summary: "The webhook's most recent deliveries, newest first",
+		Response: []webhookDelivery{}, Auth: true, Errors: []int{401, 404, 500}},
+	{Path: "/webhooks/{webhookid}/ping", Method: "post", Tag: "webhook", Summary: "Send a ping event now and report how it went",
+		Response: webhookDelivery{}, Auth: true, Errors: []int{401, 404, 500}},
+	{Path: "/library", Method: "get", Tag: "library", Summary: "The shared library of contests and candidates to insert into elections",
+		Query: []apiParam{{"kind", "contest or candidate, default both", "string"}}, Response: []libraryEntry{}, Auth: true, Errors: []int{401, 500}},
+	{Path: "/library", Method: "post", Tag: "library", Summary: "Add a library entry: data is {\"Contest\": {...}, \"Candidate\": [...]} with the candidates the contest names, or {\"Candidate\": [{...}]}",
+		Request: libraryRequest{}, Response: libraryEntry{}, Auth: true, Errors: []int{400, 401, 413, 500}},
+	{Path: "/library/{entry}", Method: "get", Tag: "library", Summary: "A library entry",
+		Response: libraryEntry{}, Auth: true, Errors: []int{401, 404, 500}},
+	{Path: "/library/{entry}", Method: "put", Tag: "library", Summary: "Replace a library entry, owner or admin; draft elections with copies of it get the new version, others are listed as skipped",
+		Request: libraryRequest{}, Response: libraryUpdateJSON{}, Auth: true, Errors: []int{400, 401, 403, 404, 413, 500}},
+	{Path: "/library/{entry}", Method: "delete", Tag: "library", Summary: "Delete a library entry, owner or admin; copies in elections stay as they are. Returns the rest",
+		Response: []libraryEntry{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/notifications", Method: "get", Tag: "notification", Summary: "Your email notification settings",
+		Response: notifyPrefs{}, Auth: true, Errors: []int{401, 404, 500}},
+	{Path: "/notifications", Method: "post", Tag: "notification", Summary: "Set the address and which notices to email: shares, @mentions and slow renders; each defaults to on",
+		Request: notifyRequest{}, Response: notifyPrefs{}, Auth: true, Errors: []int{400, 401, 500}},
+	{Path: "/notifications", Method: "delete", Tag: "notification", Summary: "Stop email notifications",
+		ResponseType: "text/plain", Auth: true, Errors: []int{401, 500}},
+	{Path: "/account", Method: "get", Tag: "account", Summary: "Your display name, email, storage limits and usage",
+		Response: accountJSON{}, Auth: true, Errors: []int{401, 500}},
+	{Path: "/account", Method: "put", Tag: "account", Summary: "Set your display name or email; fields left out keep their value. A new email also goes to your digest and notification settings",
+		Request: accountRequest{}, Response: accountJSON{}, Auth: true, Errors: []int{400, 401, 500}},
+	{Path: "/account", Method: "delete", Tag: "account", Summary: "Delete your account with its settings and webhooks; your elections are purged, or given to the user the server names",
+		Query:        []apiParam{{"confirm", "your login name", "string"}},
+		ResponseType: "text/plain", Auth: true, Errors: []int{400, 401, 409, 500}},
+	{Path: "/account/export", Method: "get", Tag: "account", Summary: "Everything stored about you and your elections, as one JSON download; scan images and media are in each election's bundle",
+		Response: accountExport{}, Auth: true, Errors: []int{401, 500}},
+	{Path: "/election/{id}/state", Method: "get", Tag: "election", Summary: "Get lifecycle state",
+		Response: electionStateJSON{}, Errors: []int{404}},
+	{Path: "/election/{id}/state", Method: "post", Tag: "election", Summary: "Change lifecycle state; owner or admin, and only an admin can unlock or reopen an approved election",
+		Request: electionStateJSON{}, Response: electionStateJSON{}, Auth: true, Errors: []int{400, 401, 403, 409}},
+	{Path: "/election/{id}/districts", Method: "get", Tag: "election", Summary: "Districts with their precincts, and contest eligibility problems",
+		Response: electionDistrictsJSON{}, Errors: []int{404, 500}},
+	{Path: "/election/{id}/districts", Method: "post", Tag: "election", Summary: "Import precincts and districts from GeoJSON feature properties or a VIP XML feed, and generate the ballot styles from them",
+		Query: districtImportQuery, RequestType: "application/json", Response: districtImportJSON{}, Auth: true, Errors: []int{400, 401, 403, 404, 409, 413, 500, 503}},
+	{Path: "/election/{id}/readiness", Method: "get", Tag: "election", Summary: "Pass/warn/fail checklist to review before publishing",
+		Query:    []apiParam{{"render", "true to draw the ballot again and compare layouts", "boolean"}},
+		Response: readinessReport{}, Errors: []int{404, 429, 500}},
+	{Path: "/election/{id}/results", Method: "get", Tag: "results", Summary: "Public unofficial results page, if turned on",
+		ResponseType: "text/html", Errors: []int{404, 500}},
+	{Path: "/election/{id}/results", Method: "post", Tag: "results", Summary: "Turn the public results page on or off (body true|false)",
+		RequestType: "text/plain", Response: electionMeta{}, Auth: true, Errors: []int{401, 403, 404}},
+	{Path: "/election/{id}/results.json", Method: "get", Tag: "results", Summary: "Unofficial tally of stored scans, if public results are on; 304 if ?since= is still the version after waiting",
+		Query:    []apiParam{{"provenance", "true to list the scans behind each total", "boolean"}, {"since", "a version already seen, wait up to 60s for a different one", "string"}},
+		Response: resultsTally{}, Errors: []int{404, 500}},
+	{Path: "/election/{id}/export", Method: "get", Tag: "election", Summary: "Zip of the document, rendered ballot, bubbles, scans and media",
+		ResponseType: "application/zip", Auth: true, Errors: []int{401, 403, 404, 429, 500}},
+	{Path: "/election/{id}/checksums", Method: "get", Tag: "election", Summary: "SHA-256 of the document, ballot PDF, bubbles, pamphlet, media and each file of the export zip",
+		Response: electionChecksums{}, Errors: []int{404, 429, 500}},
+	{Path: "/election/{id}/revisions", Method: "get", Tag: "election", Summary: "Saved versions of the document, oldest first",
+		Response: []revisionRecord{}, Errors: []int{404, 500}},
+	{Path: "/election/{id}/diff", Method: "get", Tag: "election", Summary: "Contests and candidates changed between two revisions, and changed pixels per rendered page; with page=N, that page as an overlay PNG (removed red, added green)",
+		Query:    []apiParam{{"from", "revision to compare from, default the one before `to`", "integer"}, {"to", "revision to compare to, default the latest", "integer"}, {"page", "page number from 0, to get its overlay PNG instead of JSON", "integer"}},
+		Response: revisionDiff{}, Errors: []int{400, 404, 429, 500, 501, 503}},
+	{Path: "/election/{id}/clone", Method: "post", Tag: "election", Summary: "New draft from a published election, without its scans, settings or source office identifiers",
+		Response: EditContext{}, Auth: true, Errors: []int{401, 404, 409, 429, 500}},
+	{Path: "/election/{id}/sharelink", Method: "post", Tag: "render", Summary: "Signed, expiring URLs for the current revision's PDF and PNGs that work without login; owner only",
+		Query:    []apiParam{{"ttl", "how long the links work, e.g. 72h, default 168h, at most 2160h", "string"}, {"proof", "true to draw the SAMPLE / PROOF watermark", "boolean"}, {"notify", "comma separated user names to email the links to, if they want share notices", "string"}},
+		Response: shareLinkJSON{}, Auth: true, Errors: []int{400, 401, 403, 404, 500}},
+	{Path: "/share/{token}.pdf", Method: "get", Tag: "render", Summary: "Ballot PDF from a share link",
+		ResponseType: "application/pdf", Errors: []int{403, 404, 410, 429, 500, 501, 503}},
+	{Path: "/share/{token}.{page}.png", Method: "get", Tag: "render", Summary: "One page of the ballot as PNG from a share link",
+		ResponseType: "image/png", Errors: []int{400, 403, 404, 410, 429, 500, 501, 503}},
+	{Path: "/election/import", Method: "post", Tag: "election", Summary: "New draft election from an export zip",
+		RequestType: "application/zip", Response: EditContext{}, Auth: true, Errors: []int{400, 401, 413, 429, 500, 503}},
+	{Path: "/election/{id}/media", Method: "post", Tag: "election", Summary: "Upload a candidate photo or party symbol (PNG, JPEG or GIF) to reference from the document",
+		RequestType: "image/*", Response: mediaUploadJSON{}, Auth: true, Errors: []int{401, 403, 404, 409, 413, 415, 503}},
+	{Path: "/election/{id}/media/{mediaid}", Method: "get", Tag: "election", Summary: "An uploaded image",
+		ResponseType: "image/*", Errors: []int{404}},
+	{Path: "/election/{id}/fonts", Method: "post", Tag: "election", Summary: "Upload an embeddable TrueType font to list in the Election Fonts field",
+		Query: fontUploadQuery, RequestType: "font/ttf", Response: fontUploadJSON{}, Auth: true, Errors: []int{400, 401, 403, 404, 409, 413, 415, 503}},
+	{Path: "/election/{id}/fonts", Method: "get", Tag: "election", Summary: "The election's fonts and the document's characters they don't have",
+		Response: fontsJSON{}, Errors: []int{404, 500}},
+	{Path: "/election/{id}/library/{entry}", Method: "post", Tag: "library", Summary: "Insert a copy of a library entry into a draft election, kept up to date when the entry changes; owner only",
+		Query: []apiParam{{"district", "the GpUnit @id a contest is held in", "string"}}, Response: libraryInsertJSON{}, Auth: true, Errors: []int{400, 401, 403, 404, 409, 500}},
+	{Path: "/election/{id}/audit", Method: "get", Tag: "results", Summary: "Risk-limiting audit sample size and ballot sample from the stored scans",
+		Query: auditQuery, Response: auditPlan{}, Auth: true, Errors: []int{400, 401, 403, 404, 500}},
+	{Path: "/election/{id}/audit", Method: "post", Tag: "results", Summary: "Audit sample using reported totals, contest id -> selection id -> votes",
+		Query: auditQuery, Request: reportedTotals{}, Response: auditPlan{}, Auth: true, Errors: []int{400, 401, 403, 404, 500}},
+	{Path: "/election/{id}/cvr.json", Method: "get", Tag: "results", Summary: "Cast vote records: each stored scan's marks with its device, operator, batch and precinct; owner only",
+		Response: cvrExport{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/election/{id}/sample", Method: "get", Tag: "election", Summary: "The election's public sample ballot address, and whether it's showing; owner only",
+		Response: sampleSlugJSON{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/election/{id}/sample", Method: "post", Tag: "election", Summary: "Set the sample ballot slug (body text, letters, digits and '-'), or empty to take it down; it shows while the election is published or locked",
+		RequestType: "text/plain", Response: sampleSlugJSON{}, Auth: true, Errors: []int{400, 401, 403, 404, 409, 500}},
+	{Path: "/sample/{slug}", Method: "get", Tag: "election", Summary: "Public sample ballot page, every ballot style's contests and choices",
+		ResponseType: "text/html", Errors: []int{404, 500}},
+	{Path: "/sample/{slug}.pdf", Method: "get", Tag: "election", Summary: "Public sample ballot PDF, watermarked",
+		ResponseType: "application/pdf", Errors: []int{404, 429, 500, 501, 503}},
+	{Path: "/election/{id}/template", Method: "get", Tag: "election", Summary: "Whether this election is a template, and its {{placeholder}} names",
+		Response: electionTemplateJSON{}, Errors: []int{404}},
+	{Path: "/election/{id}/template", Method: "post", Tag: "election", Summary: "Make this election a template others can copy, or not (body true|false)",
+		RequestType: "text/plain", Response: electionTemplateJSON{}, Auth: true, Errors: []int{401, 403, 404}},
+	{Path: "/election/{id}/prerender", Method: "get", Tag: "render", Summary: "Whether this election is drawn in the background after each save",
+		Response: electionPrerenderJSON{}, Auth: true, Errors: []int{401, 403, 404}},
+	{Path: "/election/{id}/prerender", Method: "post", Tag: "render", Summary: "Draw the PDF and page PNGs after each save so previews are ready, or not (body true|false), owner only",
+		RequestType: "text/plain", Response: electionPrerenderJSON{}, Auth: true, Errors: []int{401, 403, 404, 409}},
+	{Path: "/election/{id}/testdeck.pdf", Method: "get", Tag: "results", Summary: "Pre-marked logic and accuracy test ballots: the Nth selection of each contest marked on N ballots, then an overvote and a blank ballot per style; owner only",
+		Query: testDeckQuery, ResponseType: "application/pdf", Auth: true, Errors: []int{400, 401, 403, 404, 429, 500, 501, 503}},
+	{Path: "/election/{id}/testdeck.json", Method: "get", Tag: "results", Summary: "The marks on each test deck ballot, and the totals counting them should give",
+		Query: testDeckQuery, Response: testDeck{}, Auth: true, Errors: []int{400, 401, 403, 404, 429, 500, 501, 503}},
+	{Path: "/election/{id}/synthetic.jpg", Method: "post", Tag: "results", Summary: "A page of the ballot marked as the body says, optionally jittered, rotated and noisy, as a scanner would send it",
+		Request: syntheticBallotRequest{}, ResponseType: "image/jpeg", Auth: true, Errors: []int{400, 401, 404, 429, 500, 503}},
+	{Path: "/election/{id}/synthetic.png", Method: "post", Tag: "results", Summary: "The same synthetic ballot page, lossless",
+		Request: syntheticBallotRequest{}, ResponseType: "image/png", Auth: true, Errors: []int{400, 401, 404, 429, 500, 503}},
+	{Path: "/election/{id}/annotations", Method: "get", Tag: "review", Summary: "Reviewer pins on the rendered pages, in the order they were made",
+		Response: []annotationRecord{}, Errors: []int{404, 500}},
+	{Path: "/election/{id}/annotations", Method: "post", Tag: "review", Summary: "Pin a comment to a page; x and y are fractions of the page from the top left",
+		Request: annotationJSON{}, Response: annotationRecord{}, Auth: true, Errors: []int{400, 401, 404, 500}},
+	{Path: "/election/{id}/annotations/{annotationid}", Method: "delete", Tag: "review", Summary: "Remove a pin, by its author or the election owner",
+		Response: []annotationRecord{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/election/{id}/review.pdf", Method: "get", Tag: "review", Summary: "The ballot with numbered pins and PDF comments, then a list of the comments",
+		ResponseType: "application/pdf", Errors: []int{400, 404, 429, 500, 503}},
+
+	{Path: "/election/{id}.pdf", Method: "get", Tag: "render", Summary: "Ballot PDF",
+		Query: renderQuery, ResponseType: "application/pdf", Errors: []int{400, 409, 429, 500, 501}},
+	{Path: "/election/{id}.html", Method: "get", Tag: "render", Summary: "The ballot as an accessible web page: headings per ballot style and a fieldset per contest, for screen readers",
+		Query: []apiParam{{"style", "show one ballot style, by index", "integer"}}, ResponseType: "text/html", Errors: []int{400, 404, 500}},
+	{Path: "/election/{id}_bubbles.json", Method: "get", Tag: "render", Summary: "Bubble positions for the ballot PDF, with \"version\"; v2 (by page) for version=2 or Accept: " + scan.BubblesV2MediaType + ", see /formats",
+		Query: append([]apiParam{bubblesVersionParam}, renderQuery...), Response: map[string]interface{}{}, Errors: []int{400, 409, 429, 500, 501}},
+	{Path: "/election/{id}.png", Method: "get", Tag: "render", Summary: "Ballot PNG, single page documents only",
+		Query: renderQuery, ResponseType: "image/png", Errors: []int{400, 409, 429, 500, 501}},
+	{Path: "/election/{id}.{page}.png", Method: "get", Tag: "render", Summary: "One page of the ballot as PNG",
+		Query: renderQuery, ResponseType: "image/png", Errors: []int{400, 409, 429, 500, 501}},
+	{Path: "/election/{id}_pamphlet.pdf", Method: "get", Tag: "render", Summary: "Voter pamphlet PDF",
+		Query: []apiParam{redrawParam}, ResponseType: "application/pdf", Errors: []int{400, 429, 500, 501}},
+
+	{Path: "/election/{id}/scan", Method: "get", Tag: "scan", Summary: "Scan upload page",
+		ResponseType: "text/html"},
+	{Path: "/election/{id}/scan", Method: "post", Tag: "scan", Summary: "Read marks from a scanned ballot (JPEG, PNG or PDF), stored with its chain of custody",
+		Query: custodyQuery, RequestType: "image/*", Response: scanMarks{}, Errors: []int{400, 409, 413, 415, 429, 500, 503}},
+	{Path: "/election/{id}/rescan", Method: "post", Tag: "scan", Summary: "Re-read stored scans with the current interpreter",
+		Query:    []apiParam{{"update", "true to store the new results", "boolean"}},
+		Response: rescanReport{}, Auth: true, Errors: []int{400, 401, 403, 409, 429}},
+	{Path: "/scan/{id}/overlay.png", Method: "get", Tag: "scan", Summary: "The stored scan with each bubble outlined and its fill percent, green marked, orange partly filled, blue empty; election owner or uploader only",
+		ResponseType: "image/png", Auth: true, Errors: []int{401, 403, 404, 429, 500, 503}},
+
+	{Path: "/election/{id}/print", Method: "get", Tag: "print", Summary: "Ballots printed on demand: queued, ready, failed and issued counts per style, and the most recent print jobs",
+		Response: printQueueJSON{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/election/{id}/print", Method: "post", Tag: "print", Summary: "Queue a ballot of one style to print with a serial number; owner, admins, and poll workers and editors in the owner's organization",
+		Request: printRequest{}, Response: printJob{}, Auth: true, Errors: []int{400, 401, 403, 404, 409, 429, 500}},
+	{Path: "/election/{id}/print.pdf", Method: "get", Tag: "print", Summary: "The final ballot imposed on press sheets for a print vendor; the same people who print on demand",
+		Query: []apiParam{
+			{"nup", "pages on each side of a sheet: 1, 2 or 4", "integer"},
+			{"duplex", "backs follow fronts, mirrored left to right", "boolean"},
+			{"repeat", "step and repeat, every cell on a side is the same page", "boolean"},
+			{"booklet", "saddle stitch booklet, 2-up and duplex in folding order", "boolean"},
+			{"bleed", "points of white around each page, at most 36", "number"},
+			{"marks", "crop marks and a slug line naming each sheet", "boolean"},
+			{"sheet", "letter, legal, tabloid, a4, a3, 12x18 or 13x19; by default just big enough", "string"},
+			{"style", "only this ballot style", "integer"},
+		},
+		ResponseType: "application/pdf", Auth: true, Errors: []int{400, 401, 403, 404, 409, 500, 503}},
+	{Path: "/print/{job}", Method: "get", Tag: "print", Summary: "A print job, to poll until it's ready",
+		Response: printJob{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/print/{job}.pdf", Method: "get", Tag: "print", Summary: "Pick up a printed ballot, once; 409 while queued or if drawing it failed, 410 after it's been picked up",
+		ResponseType: "application/pdf", Auth: true, Errors: []int{401, 403, 404, 409, 410, 500}},
+	{Path: "/election/{id}/print/runs", Method: "get", Tag: "print", Summary: "The election's numbered ballot runs, oldest first, with their batches",
+		Response: []printRun{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/election/{id}/print/runs", Method: "post", Tag: "print", Summary: "Record a run of ballots of one style with sequential stub numbers, after the election's last run unless first is given; 409 if it overlaps another run",
+		Request: printRunRequest{}, Response: printRun{}, Auth: true, Errors: []int{400, 401, 403, 404, 409, 500, 503}},
+	{Path: "/print/runs/{run}", Method: "get", Tag: "print", Summary: "A numbered ballot run, its batches, and each batch download with who made it",
+		Response: printRun{}, Auth: true, Errors: []int{401, 403, 404, 500}},
+	{Path: "/print/runs/{run}/{batch}.pdf", Method: "get", Tag: "print", Summary: "One batch of a run, each page stamped with its stub number and barcode; recorded as a download. 409 if the election changed since the run was made",
+		ResponseType: "application/pdf", Auth: true, Errors: []int{401, 403, 404, 409, 500, 503}},
+
+	{Path: "/formats", Method: "get", Tag: "formats", Summary: "Supported bubbles json versions, their media types and the default",
+		Response: formatsList{}},
+	{Path: "/formats/bubbles", Method: "post", Tag: "formats", Summary: "Convert a bubbles json layout of any supported version to version (or the one asked for by Accept)",
+		Query: []apiParam{bubblesVersionParam}, Request: map[string]interface{}{}, Response: map[string]interface{}{}, Errors: []int{400, 405}},
+
+	{Path: "/makeinvite", Method: "get", Tag: "invite", Summary: "Form to make a new invite token",
+		ResponseType: "text/html", Auth: true},
+	{Path: "/makeinvite", Method: "post", Tag: "invite", Summary: "Make a new invite token, shown on an html page",
+		ResponseType: "text/html", Auth: true},
+	{Path: "/signup/{token}", Method: "get", Tag: "invite", Summary: "Signup form for an invite token",
+		ResponseType: "text/html"},
+	{Path: "/signup/{token}", Method: "post", Tag: "invite", Summary: "Create an account with an invite token",
+		RequestType: "application/x-www-form-urlencoded", ResponseType: "text/html", Errors: []int{429}},
+}
+
+// schemaBuilder makes JSON schemas from Go types, structs go in components
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+var rawJSONType = reflect.TypeOf(json.RawMessage{})
+
+func (sb *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == rawJSONType {
+		// a JSON document as is
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return sb.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": sb.schema(t.Elem())}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return map[string]interface{}{"type": "object"}
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": sb.schema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := sb.components[name]; !ok {
+			sb.components[name] = nil // recursion guard
+			props := make(map[string]interface{})
+			sb.structProps(t, props)
+			sb.components[name] = map[string]interface{}{"type": "object", "properties": props}
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	// interface{} etc, anything goes
+	return map[string]interface{}{}
+}
+
+// structProps adds t's JSON fields to props, with embedded structs' fields
+// inline as encoding/json does
+func (sb *schemaBuilder) structProps(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		fname := f.Name
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if tag == "" && f.Anonymous && f.Type.Kind() == reflect.Struct {
+			sb.structProps(f.Type, props)
+			continue
+		}
+		if tag != "" {
+			if x := strings.Split(tag, ",")[0]; x != "" {
+				fname = x
+			}
+		}
+		props[fname] = sb.schema(f.Type)
+	}
+}
+
+func pathParams(path string) (out []interface{}) {
+	for _, part := range strings.Split(path, "{")[1:] {
+		name := strings.SplitN(part, "}", 2)[0]
+		ptype := "string"
+		if name == "id" || name == "page" || name == "user" {
+			ptype = "integer"
+		}
+		out = append(out, map[string]interface{}{
+			"name": name, "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": ptype},
+		})
+	}
+	return
+}
+
+// openAPIDoc builds the OpenAPI 3 document from apiRoutes
+func openAPIDoc() map[string]interface{} {
+	sb := schemaBuilder{components: make(map[string]interface{})}
+	paths := make(map[string]interface{})
+	for _, route := range apiRoutes {
+		op := map[string]interface{}{
+			"summary": route.Summary,
+			"tags":    []string{route.Tag},
+		}
+		params := pathParams(route.Path)
+		for _, q := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name": q.Name, "in": "query", "description": q.Description,
+				"schema": map[string]interface{}{"type": q.Type},
+			})
+		}
+		if !csrfSafeMethod(strings.ToUpper(route.Method)) {
+			params = append(params, map[string]interface{}{
+				"name": csrfHeader, "in": "header",
+				"description": "same value as the csrf cookie, not needed with an Authorization header",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) != 0 {
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": sb.schema(reflect.TypeOf(route.Request))},
+				},
+			}
+		} else if route.RequestType != "" {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					route.RequestType: map[string]interface{}{},
+				},
+			}
+		}
+		responses := make(map[string]interface{})
+		if route.Response != nil {
+			responses["200"] = map[string]interface{}{
+				"description": "ok",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": sb.schema(reflect.TypeOf(route.Response))},
+				},
+			}
+		} else {
+			responses["200"] = map[string]interface{}{
+				"description": "ok",
+				"content": map[string]interface{}{
+					route.ResponseType: map[string]interface{}{
+						"schema": map[string]interface{}{"type": "string", "format": "binary"},
+					},
+				},
+			}
+		}
+		for _, code := range route.Errors {
+			responses[strconv.Itoa(code)] = map[string]interface{}{"description": http.StatusText(code)}
+		}
+		op["responses"] = responses
+		if route.Auth {
+			// login is a session cookie from the login package
+			op["x-login-required"] = true
+		}
+		pi, ok := paths[route.Path].(map[string]interface{})
+		if !ok {
+			pi = make(map[string]interface{})
+			paths[route.Path] = pi
+		}
+		pi[route.Method] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Ballot Studio",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": sb.components,
+		},
+	}
+}
+
+// GET /openapi.json
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	doc := openAPIDoc()
+	if base := basePath(r); base != "" {
+		doc["servers"] = []map[string]interface{}{{"url": base}}
+	}
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if maybeerr(w, err, 500, "openapi json, %v", err) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(out)
+}
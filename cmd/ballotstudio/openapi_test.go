@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// every documented /election/, /elections/, /share, /trash, /digest, /admin, /webhooks, /library, /notifications and /account path must be one the StudioHandler routes
+func TestOpenAPIRoutes(t *testing.T) {
+	routeRes := []*regexp.Regexp{docPathRe, pdfPathRe, htmlPathRe, bubblesPathRe, pngPathRe, pngPagePathRe, pamphletPathRe, scanPathRe, rescanPathRe, statePathRe, districtsPathRe, readinessPathRe, resultsPathRe, mediaPathRe, fontsPathRe, exportPathRe, checksumsPathRe, importPathRe, auditPathRe, cvrPathRe, printPathRe, imposePathRe, printRunsPathRe, printRunPathRe, printJobPathRe, electionSamplePathRe, samplePathRe, templatePathRe, prerenderPathRe, testDeckPathRe, syntheticPathRe, annotationsPathRe, reviewPdfPathRe, trashPathRe, trashRestorePathRe, digestPathRe, staffPathRe, jobsPathRe, cacheAdminPathRe, calendarPathRe, quotasPathRe, revisionsPathRe, diffPathRe, clonePathRe, shareLinkPathRe, sharePathRe, searchPathRe, comparePathRe, electionTagsPathRe, tagsPathRe, webhooksPathRe, notificationsPathRe, accountPathRe, scanOverlayPathRe, libraryPathRe, electionLibraryPathRe}
+	for _, route := range apiRoutes {
+		if !strings.HasPrefix(route.Path, "/election/") && !strings.HasPrefix(route.Path, "/elections/") && !strings.HasPrefix(route.Path, "/share/") && !strings.HasPrefix(route.Path, "/trash") && !strings.HasPrefix(route.Path, "/digest") && !strings.HasPrefix(route.Path, "/admin") && !strings.HasPrefix(route.Path, "/webhooks") && !strings.HasPrefix(route.Path, "/library") && !strings.HasPrefix(route.Path, "/notifications") && !strings.HasPrefix(route.Path, "/account") {
+			continue
+		}
+		path := strings.Replace(route.Path, "{id}", "123", 1)
+		path = strings.Replace(path, "{page}", "0", 1)
+		path = strings.Replace(path, "{annotationid}", "4", 1)
+		path = strings.Replace(path, "{token}", "eyJlIjoxMjN9.c2ln", 1)
+		path = strings.Replace(path, "{tag}", "2024-general", 1)
+		path = strings.Replace(path, "{webhookid}", "5", 1)
+		path = strings.Replace(path, "{job}", "trash-purge", 1)
+		path = strings.Replace(path, "{user}", "6", 1)
+		path = strings.Replace(path, "{entry}", "7", 1)
+		found := false
+		for _, re := range routeRes {
+			if re.MatchString(path) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("documented path %s is not routed", route.Path)
+		}
+	}
+}
+
+func TestOpenAPIDoc(t *testing.T) {
+	blob, err := json.Marshal(openAPIDoc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	err = json.Unmarshal(blob, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.Paths["/election/{id}/state"]["post"]; !ok {
+		t.Errorf("missing POST /election/{id}/state")
+	}
+	ec := doc.Components.Schemas["EditContext"]
+	if _, ok := ec.Properties["itemid"]; !ok {
+		t.Errorf("EditContext schema should use json names, got %v", ec.Properties)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+// Elections with Prerender set in their electionMeta are drawn in the
+// background right after each save, so the editor's next preview comes
+// from the cache instead of waiting on the draw backend.
+
+// prerenderSet tracks background renders in progress, one per election.
+// A save while one is running asks for another pass when it finishes,
+// so a burst of saves draws at most twice.
+type prerenderSet struct {
+	l sync.Mutex
+	// itemname: true if saved again since the render started
+	m map[string]bool
+}
+
+// begin is true if the caller should render itemname now
+func (ps *prerenderSet) begin(itemname string) bool {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	if ps.m == nil {
+		ps.m = make(map[string]bool)
+	}
+	if _, running := ps.m[itemname]; running {
+		ps.m[itemname] = true
+		return false
+	}
+	ps.m[itemname] = false
+	return true
+}
+
+// again is true if itemname was saved during the last pass and should be drawn again
+func (ps *prerenderSet) again(itemname string) bool {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	if ps.m[itemname] {
+		ps.m[itemname] = false
+		return true
+	}
+	delete(ps.m, itemname)
+	return false
+}
+
+func (ps *prerenderSet) running(itemname string) bool {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	_, running := ps.m[itemname]
+	return running
+}
+
+// prerender draws the PDF and page PNGs of itemname into the cache, in the background
+func (sh *StudioHandler) prerender(itemname string) {
+	if !sh.prerenders.begin(itemname) {
+		return
+	}
+	go func() {
+		for {
+			// a pass after a save draws the new version, see renderKey
+			ctx, _ := withStaleNote(context.Background())
+			_, err := sh.getPng(ctx, itemname, draw.RenderOptions{}, false)
+			if err != nil {
+				log.Printf("election %s: prerender, %v", itemname, err)
+			}
+			if !sh.prerenders.again(itemname) {
+				return
+			}
+		}
+	}()
+}
+
+// GET /election/{id}/prerender and its response
+type electionPrerenderJSON struct {
+	ElectionId int64 `json:"itemid"`
+	Prerender  bool  `json:"prerender"`
+	Running    bool  `json:"running,omitempty"`
+}
+
+// GET /election/{id}/prerender
+// POST /election/{id}/prerender with body true|false turns drawing on save on or off, owner only
+func (sh *StudioHandler) handleElectionPrerender(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	itemname := strconv.FormatInt(electionid, 10)
+	meta := parseElectionMeta(er.Meta)
+	if r.Method == "POST" {
+		if sh.checkElectionState(w, electionid, actionSettings) {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		meta.Prerender = qbool(strings.TrimSpace(string(body)))
+		er.Meta = meta.String()
+		err = sh.edb.SetElectionMeta(electionid, er.Meta)
+		if maybeerr(w, err, 500, "db put fail") {
+			return
+		}
+		if meta.Prerender {
+			sh.prerender(itemname)
+		}
+	}
+	writeJSON(w, electionPrerenderJSON{ElectionId: electionid, Prerender: meta.Prerender, Running: sh.prerenders.running(itemname)})
+}
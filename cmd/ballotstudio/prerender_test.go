@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestPrerenderSet(t *testing.T) {
+	var ps prerenderSet
+	if !ps.begin("1") || ps.begin("1") || ps.begin("1") {
+		t.Errorf("begin")
+	}
+	if !ps.begin("2") {
+		t.Errorf("another election waited")
+	}
+	// two saves during the first pass want one more
+	if !ps.again("1") || ps.again("1") || ps.running("1") {
+		t.Errorf("again")
+	}
+	if !ps.begin("1") {
+		t.Errorf("begin after done")
+	}
+}
+
+func TestPrerender(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}}
+	doc := `{"Election": [{"BallotStyle": [{"GpUnitIds": ["g1"], "OrderedContent": []}]}]}`
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+	itemname := strconv.FormatInt(eid, 10)
+	ann := &login.User{Guid: 7, Username: "ann"}
+	save := func() {
+		rec := httptest.NewRecorder()
+		sh.handleElectionDocPOSTJson(rec, httptest.NewRequest("POST", "/election/"+itemname, nil), ann, eid, []byte(doc), editContextFinish)
+		if rec.Code != 200 {
+			t.Fatalf("save %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	waitDone := func() {
+		for i := 0; sh.prerenders.running(itemname); i++ {
+			if i > 1000 {
+				t.Fatalf("prerender still running")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	cached := func(name string) bool {
+		er, err := edb.GetElection(eid)
+		mtfail(t, err, "get election, %v", err)
+		return sh.cache.Get(renderKey(name, er.Data, draw.RenderOptions{})) != nil
+	}
+	save()
+	waitDone()
+	if cached(itemname) {
+		t.Errorf("drew without prerender set")
+	}
+
+	rec := httptest.NewRecorder()
+	sh.handleElectionPrerender(rec, httptest.NewRequest("POST", "/election/"+itemname+"/prerender", strings.NewReader("bob")), &login.User{Guid: 8, Username: "bob"}, eid)
+	if rec.Code != 403 {
+		t.Errorf("not owner %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	sh.handleElectionPrerender(rec, httptest.NewRequest("POST", "/election/"+itemname+"/prerender", strings.NewReader("true")), ann, eid)
+	var pj electionPrerenderJSON
+	json.Unmarshal(rec.Body.Bytes(), &pj)
+	if rec.Code != 200 || !pj.Prerender {
+		t.Fatalf("turn on %d %s", rec.Code, rec.Body.String())
+	}
+	waitDone()
+	sh.invalidateElection(itemname)
+
+	save()
+	waitDone()
+	if !cached(itemname) || !cached(itemname+".png") {
+		t.Errorf("not drawn after save")
+	}
+}
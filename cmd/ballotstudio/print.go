@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/synth"
+	"github.com/brianolson/login/login"
+)
+
+// Ballot on demand, for vote centers that print each voter's ballot style
+// as they check in. A poll worker asks for a style; the print-queue job
+// draws it with a serial number in the bottom margin, and the poll worker
+// picks up the PDF once. Counts of ballots issued per style are kept so
+// they can be reconciled against ballots cast.
+//
+//	POST /election/{id}/print   {"style":0}, queues a ballot of that style, returns the job
+//	GET /election/{id}/print    counts per style and the most recent jobs
+//	GET /print/{job}            the job, to poll until it's ready
+//	GET /print/{job}.pdf        the ballot, once; after that the job is picked_up
+//
+// The election owner, admins, and poll workers and editors in the owner's
+// organization may print. Only elections that could render final ballots
+// (approved, published or locked) print.
+
+const (
+	printQueued   = "queued"
+	printReady    = "ready"
+	printFailed   = "failed"
+	printPickedUp = "picked_up"
+)
+
+// at most this many of an election's ballots may be queued or waiting to be
+// picked up, so a stuck printer doesn't pile up PDFs
+const maxPendingPrints = 100
+
+// ballots drawn per run of the print-queue job
+const printBatch = 20
+
+// how many recent jobs GET /election/{id}/print lists
+const printJobsListed = 50
+
+type printJob struct {
+	Id          int64  `json:"id"`
+	ElectionId  int64  `json:"itemid"`
+	Style       int    `json:"style"`
+	Serial      string `json:"serial"`
+	RequestedBy int64  `json:"requested_by"`
+	Status      string `json:"status"`
+	Pdf         []byte `json:"-"`
+	Error       string `json:"error,omitempty"`
+	Created     int64  `json:"created"`             // unix seconds
+	Done        int64  `json:"done,omitempty"`      // drawn or failed
+	PickedUp    int64  `json:"picked_up,omitempty"` // unix seconds
+}
+
+// printSerial is stamped on the ballot. The job id alone is unique; the
+// election and style are there for whoever is holding the paper.
+func printSerial(electionid int64, style int, jobid int64) string {
+	return fmt.Sprintf("%d-%d-%06d", electionid, style, jobid)
+}
+
+// POST /election/{id}/print body
+type printRequest struct {
+	// Style is the index of the ballot style in the bubbles JSON
+	Style int `json:"style"`
+}
+
+type printStyleCounts struct {
+	Style  int `json:"style"`
+	Queued int `json:"queued"`
+	Ready  int `json:"ready"`
+	Failed int `json:"failed"`
+	Issued int `json:"issued"` // picked up
+}
+
+type printQueueJSON struct {
+	ElectionId int64              `json:"itemid"`
+	Styles     []printStyleCounts `json:"styles"`
+	Jobs       []printJob         `json:"jobs"`
+}
+
+// canPrint is whether user may queue and pick up er's ballots
+func (sh *StudioHandler) canPrint(user *login.User, er *electionRecord) (bool, error) {
+	if er.Owner == user.Guid {
+		return true, nil
+	}
+	admin, err := sh.isAdmin(user)
+	if err != nil || admin {
+		return admin, err
+	}
+	sr, err := sh.edb.StaffForUser(user.Guid)
+	if err != nil || sr == nil || (sr.Role != StaffPollWorker && sr.Role != StaffEditor) || sr.Organization == "" {
+		return false, err
+	}
+	owner, err := sh.edb.StaffForUser(er.Owner)
+	if err != nil || owner == nil {
+		return false, err
+	}
+	return owner.Organization == sr.Organization, nil
+}
+
+// printElection gets the election and checks user may print it, writing an
+// error and returning nil if not
+func (sh *StudioHandler) printElection(w http.ResponseWriter, user *login.User, electionid int64) *electionRecord {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return nil
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return nil
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return nil
+	}
+	ok, err := sh.canPrint(user, er)
+	if maybeerr(w, err, 500, "db staff, %v", err) {
+		return nil
+	}
+	if !ok {
+		texterr(w, http.StatusForbidden, "nope")
+		return nil
+	}
+	return er
+}
+
+// GET|POST /election/{id}/print
+func (sh *StudioHandler) handleElectionPrint(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if sh.printElection(w, user, electionid) == nil {
+		return
+	}
+	counts, err := sh.edb.PrintJobCounts(electionid)
+	if maybeerr(w, err, 500, "db print counts, %v", err) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		jobs, err := sh.edb.PrintJobsForElection(electionid, printJobsListed)
+		if maybeerr(w, err, 500, "db print jobs, %v", err) {
+			return
+		}
+		out := printQueueJSON{ElectionId: electionid, Styles: []printStyleCounts{}, Jobs: jobs}
+		if out.Jobs == nil {
+			out.Jobs = []printJob{}
+		}
+		for style, byStatus := range counts {
+			out.Styles = append(out.Styles, printStyleCounts{
+				Style:  style,
+				Queued: byStatus[printQueued],
+				Ready:  byStatus[printReady],
+				Failed: byStatus[printFailed],
+				Issued: byStatus[printPickedUp],
+			})
+		}
+		sort.Slice(out.Styles, func(i, j int) bool { return out.Styles[i].Style < out.Styles[j].Style })
+		writeJSON(w, out)
+	case "POST":
+		if sh.checkElectionState(w, electionid, actionFinal) {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10000))
+		if maybeerr(w, err, 400, "bad body, %v", err) {
+			return
+		}
+		var req printRequest
+		err = json.Unmarshal(body, &req)
+		if maybeerr(w, err, 400, "bad json, %v", err) {
+			return
+		}
+		if req.Style < 0 {
+			texterr(w, 400, "bad style %d", req.Style)
+			return
+		}
+		pending := 0
+		for _, byStatus := range counts {
+			pending += byStatus[printQueued] + byStatus[printReady]
+		}
+		if pending >= maxPendingPrints {
+			texterr(w, http.StatusTooManyRequests, "%d ballots are already waiting to print", pending)
+			return
+		}
+		pj := printJob{
+			ElectionId:  electionid,
+			Style:       req.Style,
+			RequestedBy: user.Guid,
+			Status:      printQueued,
+			Created:     time.Now().Unix(),
+		}
+		pj.Id, err = sh.edb.PutPrintJob(pj)
+		if maybeerr(w, err, 500, "db print job, %v", err) {
+			return
+		}
+		pj.Serial = printSerial(pj.ElectionId, pj.Style, pj.Id)
+		sh.jobs.Wake(jobPrintQueue)
+		writeJSON(w, pj)
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET or POST /election/{id}/print")
+	}
+}
+
+// GET /print/{job} and /print/{job}.pdf
+func (sh *StudioHandler) handlePrintJob(w http.ResponseWriter, r *http.Request, user *login.User, jobid int64, pdf bool) {
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET /print/{job} or /print/{job}.pdf")
+		return
+	}
+	pj, err := sh.edb.GetPrintJob(jobid)
+	if maybeerr(w, err, 500, "db print job, %v", err) {
+		return
+	}
+	if pj == nil {
+		// which jobs exist is only for those signed in
+		if user == nil {
+			texterr(w, http.StatusUnauthorized, "nope")
+		} else {
+			texterr(w, 404, "no print job %d", jobid)
+		}
+		return
+	}
+	if sh.printElection(w, user, pj.ElectionId) == nil {
+		return
+	}
+	if !pdf {
+		writeJSON(w, pj)
+		return
+	}
+	switch pj.Status {
+	case printQueued:
+		w.Header().Set("Retry-After", "5")
+		texterr(w, http.StatusConflict, "print job %d is still queued", jobid)
+		return
+	case printFailed:
+		texterr(w, http.StatusConflict, "print job %d failed, %s", jobid, pj.Error)
+		return
+	case printPickedUp:
+		texterr(w, http.StatusGone, "ballot %s was already picked up", pj.Serial)
+		return
+	}
+	// mark it issued before handing it out, so a ballot can't be printed twice
+	ok, err := sh.edb.PickUpPrintJob(jobid, time.Now().Unix())
+	if maybeerr(w, err, 500, "db print job, %v", err) {
+		return
+	}
+	if !ok {
+		texterr(w, http.StatusGone, "ballot %s was already picked up", pj.Serial)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"ballot_%s.pdf\"", pj.Serial))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(pj.Pdf)
+}
+
+// printQueued draws queued ballots, for the print-queue job. Jobs are left
+// queued for the next run if the draw backend is down.
+func (sh *StudioHandler) printQueued(ctx context.Context, now time.Time) (string, error) {
+	jobs, err := sh.edb.QueuedPrintJobs(printBatch)
+	if err != nil {
+		return "", err
+	}
+	sources := make(map[int64]*markSource)
+	drawn, failed := 0, 0
+	var unavailable error
+	for _, pj := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		pj.Pdf, err = sh.printBallot(ctx, sources, pj)
+		if he, ok := err.(*httpError); ok && he.code == http.StatusServiceUnavailable {
+			unavailable = err
+			continue
+		}
+		pj.Done = now.Unix()
+		if err != nil {
+			pj.Status = printFailed
+			pj.Error = err.Error()
+			failed++
+			log.Printf("%d: print job %d, %v", pj.ElectionId, pj.Id, err)
+		} else {
+			pj.Status = printReady
+			drawn++
+		}
+		_, err = sh.edb.PutPrintJob(pj)
+		if err != nil {
+			return fmt.Sprintf("drew %d ballots, %d failed", drawn, failed), err
+		}
+	}
+	if drawn+failed == 0 {
+		return "", unavailable
+	}
+	return fmt.Sprintf("drew %d ballots, %d failed", drawn, failed), unavailable
+}
+
+// printBallot is pj's style's pages with its serial, as a PDF. sources keeps
+// each election's render across a batch.
+func (sh *StudioHandler) printBallot(ctx context.Context, sources map[int64]*markSource, pj printJob) ([]byte, error) {
+	er, err := sh.edb.GetElection(pj.ElectionId)
+	if err != nil {
+		return nil, fmt.Errorf("election %d, %v", pj.ElectionId, err)
+	}
+	if er.Trashed != 0 {
+		return nil, fmt.Errorf("election %d is in the trash", pj.ElectionId)
+	}
+	// it may have changed since the job was queued
+	state, err := sh.edb.GetElectionState(pj.ElectionId)
+	if err != nil {
+		return nil, err
+	}
+	if !stateAllows(state, actionFinal) {
+		return nil, fmt.Errorf("election is %s, cannot %s", state, actionFinal)
+	}
+	ms := sources[pj.ElectionId]
+	if ms == nil {
+		ms, err = sh.markSource(ctx, pj.ElectionId, true)
+		if err != nil {
+			return nil, err
+		}
+		sources[pj.ElectionId] = ms
+	}
+	pages, err := ms.pages()
+	if err != nil {
+		return nil, err
+	}
+	// no votes, just copies of the style's pages to stamp
+	ims, err := synth.Ballot(ms.bubbles, pages, ms.pageWidth, ms.pageHeight, pj.Style, nil, synth.Options{})
+	if err != nil {
+		return nil, err
+	}
+	serial := printSerial(pj.ElectionId, pj.Style, pj.Id)
+	var pw draw.PdfWriter
+	catalog := pw.Alloc()
+	pdfPages := pw.Alloc()
+	var kids []string
+	for i, im := range ims {
+		b := im.Bounds()
+		dot := b.Dx() / 600
+		if dot < 1 {
+			dot = 1
+		}
+		// bottom margin, as on the test deck, clear of the scanner's border
+		draw.PutText(im, 4*dot, b.Dy()-10*dot, dot, color.Black, fmt.Sprintf("SERIAL %s  PAGE %d OF %d", serial, i+1, len(ims)))
+		page, err := addJpegPage(&pw, pdfPages, im, ms.pageWidth, ms.pageHeight)
+		if err != nil {
+			return nil, fmt.Errorf("page %d, %v", i+1, err)
+		}
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+	pw.Set(pdfPages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	pw.Set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pdfPages))
+	return pw.Bytes(catalog), nil
+}
+
+// printJobColumns follow the id in print job queries
+const printJobColumns = `election, style, requested_by, status, error, created, done, picked_up`
+
+// common to all backends, query selects id and printJobColumns
+func queryPrintJobs(db sqlDB, query string, args ...interface{}) (out []printJob, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("print jobs, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pj printJob
+		var jobError sql.NullString
+		err = rows.Scan(&pj.Id, &pj.ElectionId, &pj.Style, &pj.RequestedBy, &pj.Status, &jobError, &pj.Created, &pj.Done, &pj.PickedUp)
+		if err != nil {
+			return nil, fmt.Errorf("print job row, %v", err)
+		}
+		pj.Error = jobError.String
+		pj.Serial = printSerial(pj.ElectionId, pj.Style, pj.Id)
+		out = append(out, pj)
+	}
+	return out, rows.Err()
+}
+
+// getPrintJob returns nil if there's no such job. Common to all backends,
+// query selects id, printJobColumns and pdf.
+func getPrintJob(db sqlDB, query string, id int64) (*printJob, error) {
+	var pj printJob
+	var jobError sql.NullString
+	err := db.QueryRow(query, id).Scan(&pj.Id, &pj.ElectionId, &pj.Style, &pj.RequestedBy, &pj.Status, &jobError, &pj.Created, &pj.Done, &pj.PickedUp, &pj.Pdf)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("print job, %v", err)
+	}
+	pj.Error = jobError.String
+	pj.Serial = printSerial(pj.ElectionId, pj.Style, pj.Id)
+	return &pj, nil
+}
+
+// updatePrintJob saves a job's progress. Common to all backends, param
+// is "$" for numbered placeholders or "?".
+func updatePrintJob(db sqlDB, param, idcol string, pj printJob) error {
+	query := fmt.Sprintf(`UPDATE print_jobs SET status = $1, pdf = $2, error = $3, done = $4, picked_up = $5 WHERE %s = $6`, idcol)
+	if param == "?" {
+		query = fmt.Sprintf(`UPDATE print_jobs SET status = ?, pdf = ?, error = ?, done = ?, picked_up = ? WHERE %s = ?`, idcol)
+	}
+	_, err := db.Exec(query, pj.Status, pj.Pdf, pj.Error, pj.Done, pj.PickedUp, pj.Id)
+	if err != nil {
+		return fmt.Errorf("print job update, %v", err)
+	}
+	return nil
+}
+
+// pickUpPrintJob marks a ready job picked_up and drops its PDF, false if it
+// wasn't ready. Common to all backends.
+func pickUpPrintJob(db sqlDB, param, idcol string, id, now int64) (bool, error) {
+	query := fmt.Sprintf(`UPDATE print_jobs SET status = 'picked_up', pdf = NULL, picked_up = $1 WHERE %s = $2 AND status = 'ready'`, idcol)
+	if param == "?" {
+		query = fmt.Sprintf(`UPDATE print_jobs SET status = 'picked_up', pdf = NULL, picked_up = ? WHERE %s = ? AND status = 'ready'`, idcol)
+	}
+	result, err := db.Exec(query, now, id)
+	if err != nil {
+		return false, fmt.Errorf("print job pick up, %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("print job pick up, %v", err)
+	}
+	return n == 1, nil
+}
+
+// common to all backends, query selects style, status, count
+func printJobCounts(db sqlDB, query string, eid int64) (map[int]map[string]int, error) {
+	rows, err := db.Query(query, eid)
+	if err != nil {
+		return nil, fmt.Errorf("print job counts, %v", err)
+	}
+	defer rows.Close()
+	out := make(map[int]map[string]int)
+	for rows.Next() {
+		var style, count int
+		var status string
+		err = rows.Scan(&style, &status, &count)
+		if err != nil {
+			return nil, fmt.Errorf("print job count row, %v", err)
+		}
+		if out[style] == nil {
+			out[style] = make(map[string]int)
+		}
+		out[style][status] = count
+	}
+	return out, rows.Err()
+}
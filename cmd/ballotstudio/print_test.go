@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestPrintQueue(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}, jobs: newJobScheduler()}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	for _, sr := range []staffRecord{
+		{Email: "clerk@example.com", Role: StaffAdmin, Organization: "Kent County", UserId: 7},
+		{Email: "pw@example.com", Role: StaffPollWorker, Organization: "Kent County", UserId: 8},
+		{Email: "other@example.com", Role: StaffPollWorker, Organization: "Ottawa County", UserId: 9},
+	} {
+		err = edb.PutStaff(sr)
+		mtfail(t, err, "put staff, %v", err)
+	}
+	pw := &login.User{Guid: 8}
+
+	do := func(user *login.User, method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if m := printJobPathRe.FindStringSubmatch(path); m != nil {
+			jobid, _ := strconv.ParseInt(m[1], 10, 64)
+			sh.handlePrintJob(rec, req, user, jobid, m[2] != "")
+		} else {
+			sh.handleElectionPrint(rec, req, user, eid)
+		}
+		return rec
+	}
+	if rec := do(&login.User{Guid: 9}, "POST", "/election/1/print", `{"style":0}`); rec.Code != 403 {
+		t.Errorf("other county %d", rec.Code)
+	}
+	if rec := do(pw, "POST", "/election/1/print", `{"style":0}`); rec.Code != 409 {
+		t.Errorf("draft %d %s", rec.Code, rec.Body.String())
+	}
+	for _, step := range [][2]string{{StateDraft, StateProofing}, {StateProofing, StateApproved}} {
+		_, err = edb.SetElectionState(eid, step[0], step[1])
+		mtfail(t, err, "state, %v", err)
+	}
+	var jobs []printJob
+	for _, style := range []int{0, 0, 3} {
+		rec := do(pw, "POST", "/election/1/print", `{"style":`+strconv.Itoa(style)+`}`)
+		var pj printJob
+		json.Unmarshal(rec.Body.Bytes(), &pj)
+		if rec.Code != 200 || pj.Status != printQueued || pj.Serial != printSerial(eid, style, pj.Id) {
+			t.Fatalf("queue %d %s", rec.Code, rec.Body.String())
+		}
+		jobs = append(jobs, pj)
+	}
+	jobPath := "/print/" + strconv.FormatInt(jobs[0].Id, 10)
+	if rec := do(pw, "GET", jobPath+".pdf", ""); rec.Code != 409 {
+		t.Errorf("queued pick up %d", rec.Code)
+	}
+
+	result, err := sh.printQueued(context.Background(), time.Now())
+	if err != nil || result != "drew 2 ballots, 1 failed" {
+		t.Fatalf("print job %q %v", result, err)
+	}
+	if rec := do(&login.User{Guid: 9}, "GET", jobPath+".pdf", ""); rec.Code != 403 {
+		t.Errorf("other county pick up %d", rec.Code)
+	}
+	rec := do(pw, "GET", jobPath+".pdf", "")
+	if rec.Code != 200 || !bytes.HasPrefix(rec.Body.Bytes(), []byte("%PDF")) {
+		t.Fatalf("pick up %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(pw, "GET", jobPath+".pdf", ""); rec.Code != 410 {
+		t.Errorf("second pick up %d", rec.Code)
+	}
+	if rec := do(pw, "GET", "/print/"+strconv.FormatInt(jobs[2].Id, 10)+".pdf", ""); rec.Code != 409 || !strings.Contains(rec.Body.String(), "no ballot style 3") {
+		t.Errorf("bad style pick up %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do(&login.User{Guid: 7}, "GET", "/election/1/print", "")
+	var queue printQueueJSON
+	json.Unmarshal(rec.Body.Bytes(), &queue)
+	if rec.Code != 200 || len(queue.Jobs) != 3 || len(queue.Styles) != 2 {
+		t.Fatalf("queue %d %s", rec.Code, rec.Body.String())
+	}
+	if queue.Styles[0] != (printStyleCounts{Style: 0, Ready: 1, Issued: 1}) || queue.Styles[1] != (printStyleCounts{Style: 3, Failed: 1}) {
+		t.Errorf("counts %#v", queue.Styles)
+	}
+	pj, err := edb.GetPrintJob(jobs[0].Id)
+	mtfail(t, err, "get print job, %v", err)
+	if pj.Status != printPickedUp || pj.Pdf != nil || pj.PickedUp == 0 {
+		t.Errorf("picked up job %#v", pj)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/synth"
+	"github.com/brianolson/login/login"
+)
+
+// Numbered ballot runs, for printing a precinct's ballots ahead of time
+// rather than on demand. A run is a range of stub numbers, 1-5000 say, for
+// one ballot style. Each ballot gets the next number, printed in the bottom
+// margin of each of its pages with a Code 39 barcode of the same serial.
+//
+//	POST /election/{id}/print/runs   {"style":0,"count":5000,"batch_size":500}, records the run
+//	GET /election/{id}/print/runs    the election's runs, oldest first
+//	GET /print/runs/{run}            the run, its batches, and who downloaded which
+//	GET /print/runs/{run}/{batch}.pdf  one batch's ballots
+//
+// Stub numbers count up from 1 across all of an election's runs, and runs
+// can't overlap, so a number names one ballot. The run records the election
+// revision it was made from; its PDFs are only drawn while that is still the
+// current revision, so every ballot in a run matches. Every download is
+// recorded, so the issued range and who printed it can be audited. The same
+// people who print on demand may make and download runs.
+
+// the most ballots in a run and in one PDF of it, and the last stub number,
+// which is printed with six digits
+const (
+	maxPrintRun      = 100000
+	maxPrintRunBatch = 5000
+	maxPrintNumber   = 999999
+)
+
+// errPrintNumbers is a run that would go past maxPrintNumber
+var errPrintNumbers = fmt.Errorf("stub numbers only go to %d", maxPrintNumber)
+
+type printRun struct {
+	Id         int64 `json:"id"`
+	ElectionId int64 `json:"itemid"`
+	Style      int   `json:"style"`
+	// First and Last are the stub numbers, inclusive
+	First int64 `json:"first"`
+	Last  int64 `json:"last"`
+	// BatchSize is ballots per PDF, the whole run if 0
+	BatchSize   int   `json:"batch_size,omitempty"`
+	Rev         int   `json:"rev"` // election revision the run was made from
+	RequestedBy int64 `json:"requested_by"`
+	Created     int64 `json:"created"` // unix seconds
+
+	Batches   []printRunBatch    `json:"batches,omitempty"`
+	Downloads []printRunDownload `json:"downloads,omitempty"`
+}
+
+type printRunBatch struct {
+	Batch int    `json:"batch"` // from 1
+	First int64  `json:"first"`
+	Last  int64  `json:"last"`
+	Url   string `json:"url"`
+}
+
+type printRunDownload struct {
+	Run          int64 `json:"-"`
+	Batch        int   `json:"batch"`
+	DownloadedBy int64 `json:"downloaded_by"`
+	Downloaded   int64 `json:"downloaded"` // unix seconds
+}
+
+// POST /election/{id}/print/runs body
+type printRunRequest struct {
+	Style int   `json:"style"`
+	Count int64 `json:"count"`
+	// First stub number, by default one after the election's last run
+	First     int64 `json:"first,omitempty"`
+	BatchSize int   `json:"batch_size,omitempty"`
+}
+
+// printRunSerial is stamped on each page and in the barcode
+func printRunSerial(electionid int64, style int, number int64) string {
+	return fmt.Sprintf("%d-%d-N%06d", electionid, style, number)
+}
+
+// batches splits the run into PDFs
+func (pr printRun) batches() (out []printRunBatch) {
+	size := int64(pr.BatchSize)
+	if size <= 0 {
+		size = pr.Last - pr.First + 1
+	}
+	for first, batch := pr.First, 1; first <= pr.Last; first, batch = first+size, batch+1 {
+		last := first + size - 1
+		if last > pr.Last {
+			last = pr.Last
+		}
+		out = append(out, printRunBatch{Batch: batch, First: first, Last: last, Url: fmt.Sprintf("/print/runs/%d/%d.pdf", pr.Id, batch)})
+	}
+	return
+}
+
+// check is what's wrong with req, and fills in First after the election's other runs
+func (req *printRunRequest) check(runs []printRun) error {
+	if req.Style < 0 {
+		return fmt.Errorf("bad style %d", req.Style)
+	}
+	if req.Count < 1 || req.Count > maxPrintRun {
+		return fmt.Errorf("count %d should be 1 to %d", req.Count, maxPrintRun)
+	}
+	if req.BatchSize < 0 || req.BatchSize > maxPrintRunBatch || (req.BatchSize == 0 && req.Count > maxPrintRunBatch) {
+		return fmt.Errorf("batch_size should be 1 to %d", maxPrintRunBatch)
+	}
+	if req.First < 0 || req.First > maxPrintNumber {
+		return fmt.Errorf("bad first %d", req.First)
+	}
+	if req.First == 0 {
+		req.First = nextPrintNumber(runs)
+	}
+	if req.First+req.Count-1 > maxPrintNumber {
+		return fmt.Errorf("%d-%d, %w", req.First, req.First+req.Count-1, errPrintNumbers)
+	}
+	return nil
+}
+
+// nextPrintNumber is the stub number after all of runs
+func nextPrintNumber(runs []printRun) int64 {
+	next := int64(1)
+	for _, pr := range runs {
+		if pr.Last >= next {
+			next = pr.Last + 1
+		}
+	}
+	return next
+}
+
+// overlaps is the first of runs with any of req's numbers, nil if none
+func (req printRunRequest) overlaps(runs []printRun) *printRun {
+	last := req.First + req.Count - 1
+	for i, pr := range runs {
+		if req.First <= pr.Last && last >= pr.First {
+			return &runs[i]
+		}
+	}
+	return nil
+}
+
+// code39 is each character's bar, space, bar... widths, 1 for wide
+var code39 = map[rune]string{
+	'0': "000110100", '1': "100100001", '2': "001100001", '3': "101100000", '4': "000110001",
+	'5': "100110000", '6': "001110000", '7': "000100101", '8': "100100100", '9': "001100100",
+	'A': "100001001", 'B': "001001001", 'C': "101001000", 'D': "000011001", 'E': "100011000",
+	'F': "001011000", 'G': "000001101", 'H': "100001100", 'I': "001001100", 'J': "000011100",
+	'K': "100000011", 'L': "001000011", 'M': "101000010", 'N': "000010011", 'O': "100010010",
+	'P': "001010010", 'Q': "000000111", 'R': "100000110", 'S': "001000110", 'T': "000010110",
+	'U': "110000001", 'V': "011000001", 'W': "111000000", 'X': "010010001", 'Y': "110010000",
+	'Z': "011010000", '-': "010000101", '.': "110000100", ' ': "011000100", '*': "010010100",
+}
+
+// code39 bar widths in points
+const (
+	code39Narrow = 0.75
+	code39Wide   = 3 * code39Narrow
+)
+
+// code39Bars is the bars of s between * start and stop characters, as
+// [x, width] from the left, and the barcode's whole width
+func code39Bars(s string) (bars [][2]float64, width float64, err error) {
+	x := 0.0
+	for i, c := range "*" + strings.ToUpper(s) + "*" {
+		pattern, ok := code39[c]
+		if !ok || (c == '*' && i != 0 && i != len(s)+1) {
+			return nil, 0, fmt.Errorf("%q can't be in a Code 39 barcode", c)
+		}
+		if i != 0 {
+			// narrow space between characters
+			x += code39Narrow
+		}
+		for e, wide := range pattern {
+			w := code39Narrow
+			if wide == '1' {
+				w = code39Wide
+			}
+			if e%2 == 0 {
+				bars = append(bars, [2]float64{x, w})
+			}
+			x += w
+		}
+	}
+	return bars, x, nil
+}
+
+// printRunPdf is ballots first through last of one style, each page with its stub
+func printRunPdf(pngPages [][]byte, pageWidth, pageHeight, margin float64, pr printRun, first, last int64) ([]byte, error) {
+	if margin <= 0 {
+		margin = 36
+	}
+	// the stub sits in the bottom margin, clear of the scanner's border
+	barHeight := margin / 2
+	if barHeight > 18 {
+		barHeight = 18
+	}
+	y := (margin - barHeight) / 2
+	var pw draw.PdfWriter
+	catalog := pw.Alloc()
+	pages := pw.Alloc()
+	font := pw.Alloc()
+	pw.Set(font, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	images := make([]int, len(pngPages))
+	for i, pngb := range pngPages {
+		var err error
+		images[i], err = addPageImage(&pw, pngb)
+		if err != nil {
+			return nil, fmt.Errorf("page %d, %v", i+1, err)
+		}
+	}
+	var kids []string
+	for n := first; n <= last; n++ {
+		serial := printRunSerial(pr.ElectionId, pr.Style, n)
+		bars, width, err := code39Bars(serial)
+		if err != nil {
+			return nil, err
+		}
+		for i, imobj := range images {
+			var content bytes.Buffer
+			fmt.Fprintf(&content, "q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q\n", pageWidth, pageHeight)
+			fmt.Fprintf(&content, "BT /F1 8 Tf %.2f %.2f Td %s Tj ET\n", margin, y+2, draw.PdfLatin1String(fmt.Sprintf("BALLOT %06d  SERIAL %s  PAGE %d OF %d", n, serial, i+1, len(images))))
+			// white behind the bars and a quiet zone of 10 narrow widths
+			x := pageWidth - margin - width
+			quiet := 10 * code39Narrow
+			fmt.Fprintf(&content, "q 1 g %.2f %.2f %.2f %.2f re f 0 g\n", x-quiet, y, width+2*quiet, barHeight)
+			for _, bar := range bars {
+				fmt.Fprintf(&content, "%.2f %.2f %.2f %.2f re\n", x+bar[0], y, bar[1], barHeight)
+			}
+			content.WriteString("f Q\n")
+			contentObj := pw.Stream("", content.Bytes())
+			page := pw.Add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 %d 0 R >> /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+				pages, pageWidth, pageHeight, font, imobj, contentObj))
+			kids = append(kids, fmt.Sprintf("%d 0 R", page))
+		}
+	}
+	pw.Set(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	pw.Set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	return pw.Bytes(catalog), nil
+}
+
+// currentRev is the election's latest revision number, 0 if it has none
+func (sh *StudioHandler) currentRev(electionid int64) (int, error) {
+	revs, err := sh.edb.ElectionRevisions(electionid)
+	if err != nil || len(revs) == 0 {
+		return 0, err
+	}
+	return revs[len(revs)-1].Rev, nil
+}
+
+// GET|POST /election/{id}/print/runs
+func (sh *StudioHandler) handleElectionPrintRuns(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if sh.printElection(w, user, electionid) == nil {
+		return
+	}
+	runs, err := sh.edb.PrintRunsForElection(electionid)
+	if maybeerr(w, err, 500, "db print runs, %v", err) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		out := make([]printRun, len(runs))
+		for i, pr := range runs {
+			pr.Batches = pr.batches()
+			out[i] = pr
+		}
+		writeJSON(w, out)
+	case "POST":
+		if sh.checkElectionState(w, electionid, actionFinal) {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10000))
+		if maybeerr(w, err, 400, "bad body, %v", err) {
+			return
+		}
+		var req printRunRequest
+		err = json.Unmarshal(body, &req)
+		if maybeerr(w, err, 400, "bad json, %v", err) {
+			return
+		}
+		next := req.First == 0
+		err = req.check(runs)
+		if maybeerr(w, err, 400, "%v", err) {
+			return
+		}
+		if pr := req.overlaps(runs); pr != nil {
+			texterr(w, http.StatusConflict, "%d-%d overlaps run %d, %d-%d", req.First, req.First+req.Count-1, pr.Id, pr.First, pr.Last)
+			return
+		}
+		ms, err := sh.markSource(r.Context(), electionid, false)
+		if err != nil {
+			he := err.(*httpError)
+			if he.err == nil {
+				texterr(w, he.code, "%s", he.msg)
+			} else {
+				maybeerr(w, he.err, he.code, he.msg)
+			}
+			return
+		}
+		_, _, err = synth.StylePages(ms.bubbles, req.Style, len(ms.bubbles.Pages))
+		if maybeerr(w, err, 400, "%v", err) {
+			return
+		}
+		rev, err := sh.currentRev(electionid)
+		if maybeerr(w, err, 500, "db revisions, %v", err) {
+			return
+		}
+		pr := printRun{
+			ElectionId:  electionid,
+			Style:       req.Style,
+			First:       req.First,
+			Last:        req.First + req.Count - 1,
+			BatchSize:   req.BatchSize,
+			Rev:         rev,
+			RequestedBy: user.Guid,
+			Created:     time.Now().Unix(),
+		}
+		// another request may have numbered ballots since runs was read
+		overlap, err := sh.edb.PutPrintRun(&pr, next)
+		if errors.Is(err, errPrintNumbers) {
+			texterr(w, http.StatusConflict, "%v", err)
+			return
+		}
+		if maybeerr(w, err, 500, "db print run, %v", err) {
+			return
+		}
+		if overlap != nil {
+			texterr(w, http.StatusConflict, "%d-%d overlaps run %d, %d-%d", pr.First, pr.Last, overlap.Id, overlap.First, overlap.Last)
+			return
+		}
+		pr.Batches = pr.batches()
+		writeJSON(w, pr)
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET or POST /election/{id}/print/runs")
+	}
+}
+
+// GET /print/runs/{run} and /print/runs/{run}/{batch}.pdf; batch is 0 for the run's JSON
+func (sh *StudioHandler) handlePrintRun(w http.ResponseWriter, r *http.Request, user *login.User, runid int64, batch int) {
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	pr, err := sh.edb.GetPrintRun(runid)
+	if maybeerr(w, err, 500, "db print run, %v", err) {
+		return
+	}
+	if pr == nil {
+		// which runs exist is only for those signed in
+		if user == nil {
+			texterr(w, http.StatusUnauthorized, "nope")
+		} else {
+			texterr(w, 404, "no print run %d", runid)
+		}
+		return
+	}
+	if sh.printElection(w, user, pr.ElectionId) == nil {
+		return
+	}
+	batches := pr.batches()
+	if batch == 0 {
+		pr.Batches = batches
+		pr.Downloads, err = sh.edb.PrintRunDownloads(runid)
+		if maybeerr(w, err, 500, "db print run downloads, %v", err) {
+			return
+		}
+		writeJSON(w, pr)
+		return
+	}
+	if batch > len(batches) {
+		texterr(w, 404, "print run %d has %d batches", runid, len(batches))
+		return
+	}
+	if sh.checkElectionState(w, pr.ElectionId, actionFinal) {
+		return
+	}
+	rev, err := sh.currentRev(pr.ElectionId)
+	if maybeerr(w, err, 500, "db revisions, %v", err) {
+		return
+	}
+	if rev != pr.Rev {
+		texterr(w, http.StatusConflict, "election %d changed since print run %d was made from rev %d, make a new run", pr.ElectionId, runid, pr.Rev)
+		return
+	}
+	ms, err := sh.markSource(r.Context(), pr.ElectionId, true)
+	if err != nil {
+		he := err.(*httpError)
+		if he.err == nil {
+			texterr(w, he.code, "%s", he.msg)
+		} else {
+			maybeerr(w, he.err, he.code, he.msg)
+		}
+		return
+	}
+	first, count, err := synth.StylePages(ms.bubbles, pr.Style, len(ms.pngs))
+	if maybeerr(w, err, 500, "%v", err) {
+		return
+	}
+	var margin float64
+	if ms.bj.DrawSettings != nil {
+		margin = ms.bj.DrawSettings.PageMargin
+	}
+	b := batches[batch-1]
+	pdf, err := printRunPdf(ms.pngs[first-1:first-1+count], ms.pageWidth, ms.pageHeight, margin, *pr, b.First, b.Last)
+	if maybeerr(w, err, 500, "print run pdf, %v", err) {
+		return
+	}
+	// recorded before it's handed out, so no batch leaves unaccounted for
+	err = sh.edb.PutPrintRunDownload(printRunDownload{Run: runid, Batch: batch, DownloadedBy: user.Guid, Downloaded: time.Now().Unix()})
+	if maybeerr(w, err, 500, "db print run download, %v", err) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"ballots_%s-%06d.pdf\"", printRunSerial(pr.ElectionId, pr.Style, b.First), b.Last))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(pdf)
+}
+
+// printRunColumns follow the id in print run queries
+const printRunColumns = `election, style, first_number, last_number, batch_size, rev, requested_by, created`
+
+func scanPrintRun(row interface{ Scan(...interface{}) error }) (pr printRun, err error) {
+	err = row.Scan(&pr.Id, &pr.ElectionId, &pr.Style, &pr.First, &pr.Last, &pr.BatchSize, &pr.Rev, &pr.RequestedBy, &pr.Created)
+	return
+}
+
+// common to all backends, query selects id and printRunColumns
+func queryPrintRuns(db interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, query string, args ...interface{}) (out []printRun, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("print runs, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		pr, err := scanPrintRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("print run row, %v", err)
+		}
+		out = append(out, pr)
+	}
+	return out, rows.Err()
+}
+
+// getPrintRun returns nil if there's no such run. Common to all backends,
+// query selects id and printRunColumns.
+func getPrintRun(db sqlDB, query string, id int64) (*printRun, error) {
+	pr, err := scanPrintRun(db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("print run, %v", err)
+	}
+	return &pr, nil
+}
+
+// putPrintRun is common to all backends. It checks pr against the election's
+// runs and inserts it in one transaction so two requests can't number the same
+// ballots: lock takes a write lock on the election before runs are read, runs
+// selects id and printRunColumns, insert returns the new run's id.
+func putPrintRun(db sqlDB, lock, runs string, pr *printRun, next bool, insert func(tx *sql.Tx) (int64, error)) (overlap *printRun, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("tx err, %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(lock, pr.ElectionId)
+	if err != nil {
+		return nil, fmt.Errorf("print run lock, %v", err)
+	}
+	existing, err := queryPrintRuns(tx, runs, pr.ElectionId)
+	if err != nil {
+		return nil, err
+	}
+	if next {
+		count := pr.Last - pr.First + 1
+		pr.First = nextPrintNumber(existing)
+		pr.Last = pr.First + count - 1
+		if pr.Last > maxPrintNumber {
+			return nil, fmt.Errorf("%d-%d, %w", pr.First, pr.Last, errPrintNumbers)
+		}
+	}
+	req := printRunRequest{First: pr.First, Count: pr.Last - pr.First + 1}
+	if overlap = req.overlaps(existing); overlap != nil {
+		return overlap, nil
+	}
+	pr.Id, err = insert(tx)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("print run commit, %v", err)
+	}
+	return nil, nil
+}
+
+// common to all backends, param is "$" for numbered placeholders or "?"
+func putPrintRunDownload(db sqlDB, param string, d printRunDownload) error {
+	query := `INSERT INTO print_run_downloads (run, batch, downloaded_by, downloaded) VALUES ($1, $2, $3, $4)`
+	if param == "?" {
+		query = `INSERT INTO print_run_downloads (run, batch, downloaded_by, downloaded) VALUES (?, ?, ?, ?)`
+	}
+	_, err := db.Exec(query, d.Run, d.Batch, d.DownloadedBy, d.Downloaded)
+	if err != nil {
+		return fmt.Errorf("print run download, %v", err)
+	}
+	return nil
+}
+
+// common to all backends, query selects batch, downloaded_by, downloaded
+func printRunDownloads(db sqlDB, query string, runid int64) (out []printRunDownload, err error) {
+	rows, err := db.Query(query, runid)
+	if err != nil {
+		return nil, fmt.Errorf("print run downloads, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := printRunDownload{Run: runid}
+		err = rows.Scan(&d.Batch, &d.DownloadedBy, &d.Downloaded)
+		if err != nil {
+			return nil, fmt.Errorf("print run download row, %v", err)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestPrintRunNumbers(t *testing.T) {
+	runs := []printRun{{Id: 1, First: 1, Last: 500}, {Id: 2, First: 1001, Last: 2000}}
+	req := printRunRequest{Count: 5000, BatchSize: 2000}
+	if err := req.check(runs); err != nil || req.First != 2001 || req.overlaps(runs) != nil {
+		t.Errorf("next run %#v %v", req, err)
+	}
+	req = printRunRequest{First: 400, Count: 200, BatchSize: 100}
+	if err := req.check(runs); err != nil || req.overlaps(runs) == nil || req.overlaps(runs).Id != 1 {
+		t.Errorf("overlap %#v %v", req, err)
+	}
+	for _, bad := range []printRunRequest{{Count: 0}, {Count: maxPrintRun + 1, BatchSize: 10}, {Count: maxPrintRunBatch + 1}, {Count: 10, BatchSize: -1}, {Style: -1, Count: 1},
+		{First: maxPrintNumber + 1, Count: 1}, {First: maxPrintNumber, Count: 2}, {First: math.MaxInt64, Count: 10}} {
+		if err := bad.check(runs); err == nil {
+			t.Errorf("accepted %#v", bad)
+		}
+	}
+	req = printRunRequest{First: maxPrintNumber - 9, Count: 10}
+	if err := req.check(runs); err != nil {
+		t.Errorf("last ten numbers, %v", err)
+	}
+	full := []printRun{{Id: 3, First: 1, Last: maxPrintNumber - 5}}
+	req = printRunRequest{Count: 10}
+	if err := req.check(full); !errors.Is(err, errPrintNumbers) {
+		t.Errorf("next run past the last number %#v %v", req, err)
+	}
+	pr := printRun{Id: 9, First: 2001, Last: 7000, BatchSize: 2000}
+	batches := pr.batches()
+	if len(batches) != 3 || batches[2].First != 6001 || batches[2].Last != 7000 || batches[2].Url != "/print/runs/9/3.pdf" {
+		t.Errorf("batches %#v", batches)
+	}
+
+	bars, width, err := code39Bars("12-0-N000123")
+	// 14 characters with start and stop, 5 bars and 3 wide elements each, a gap between each
+	if err != nil || len(bars) != 14*5 || width != 14*(6*code39Narrow+3*code39Wide)+13*code39Narrow {
+		t.Errorf("code39 %d bars %g wide %v", len(bars), width, err)
+	}
+	if _, _, err := code39Bars("a*b"); err == nil {
+		t.Errorf("* inside a barcode")
+	}
+	for c, pattern := range code39 {
+		if strings.Count(pattern, "1") != 3 || len(pattern) != 9 {
+			t.Errorf("code39 %q %s", c, pattern)
+		}
+	}
+}
+
+func TestPrintRuns(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	owner := &login.User{Guid: 7}
+
+	do := func(user *login.User, method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if m := printRunPathRe.FindStringSubmatch(path); m != nil {
+			runid, _ := strconv.ParseInt(m[1], 10, 64)
+			batch, _ := strconv.Atoi(m[2])
+			sh.handlePrintRun(rec, req, user, runid, batch)
+		} else {
+			sh.handleElectionPrintRuns(rec, req, user, eid)
+		}
+		return rec
+	}
+	if rec := do(owner, "POST", "/election/1/print/runs", `{"style":0,"count":3}`); rec.Code != 409 {
+		t.Errorf("draft %d %s", rec.Code, rec.Body.String())
+	}
+	for _, step := range [][2]string{{StateDraft, StateProofing}, {StateProofing, StateApproved}} {
+		_, err = edb.SetElectionState(eid, step[0], step[1])
+		mtfail(t, err, "state, %v", err)
+	}
+	if rec := do(&login.User{Guid: 9}, "POST", "/election/1/print/runs", `{"style":0,"count":3}`); rec.Code != 403 {
+		t.Errorf("not a printer %d", rec.Code)
+	}
+	if rec := do(owner, "POST", "/election/1/print/runs", `{"style":7,"count":3}`); rec.Code != 400 {
+		t.Errorf("no such style %d %s", rec.Code, rec.Body.String())
+	}
+	rec := do(owner, "POST", "/election/1/print/runs", `{"style":0,"count":3,"batch_size":2}`)
+	var pr printRun
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &pr) != nil || pr.First != 1 || pr.Last != 3 || len(pr.Batches) != 2 || pr.Rev != 1 {
+		t.Fatalf("run %d %s", rec.Code, rec.Body.String())
+	}
+	if rec = do(owner, "POST", "/election/1/print/runs", `{"style":0,"count":5,"first":3}`); rec.Code != 409 {
+		t.Errorf("overlap %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(owner, "POST", "/election/1/print/runs", `{"style":0,"count":5}`)
+	var next printRun
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &next) != nil || next.First != 4 || next.Last != 8 {
+		t.Errorf("next run %d %s", rec.Code, rec.Body.String())
+	}
+
+	runPath := fmt.Sprintf("/print/runs/%d", pr.Id)
+	rec = do(owner, "GET", runPath+"/2.pdf", "")
+	if rec.Code != 200 || !bytes.HasPrefix(rec.Body.Bytes(), []byte("%PDF")) {
+		t.Fatalf("batch 2 %d %s", rec.Code, rec.Body.String())
+	}
+	// only ballot 3, in text and barcode
+	pdf := rec.Body.Bytes()
+	serial := printRunSerial(eid, 0, 3)
+	if !bytes.Contains(pdf, []byte("BALLOT 000003  SERIAL "+serial)) || bytes.Contains(pdf, []byte("BALLOT 000002")) {
+		t.Errorf("batch 2 stubs")
+	}
+	if rec = do(owner, "GET", runPath+"/3.pdf", ""); rec.Code != 404 {
+		t.Errorf("batch 3 %d", rec.Code)
+	}
+	rec = do(owner, "GET", runPath, "")
+	var got printRun
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &got) != nil || len(got.Downloads) != 1 || got.Downloads[0].Batch != 2 || got.Downloads[0].DownloadedBy != 7 {
+		t.Errorf("run %d %s", rec.Code, rec.Body.String())
+	}
+	rec = do(owner, "GET", "/election/1/print/runs", "")
+	var runs []printRun
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &runs) != nil || len(runs) != 2 || runs[0].Id != pr.Id {
+		t.Errorf("runs %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the ballots in a run all match the revision it was made from
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: strings.Replace(overlayTestDoc, "}", ` }`, 1)})
+	mtfail(t, err, "put election, %v", err)
+	if rec = do(owner, "GET", runPath+"/1.pdf", ""); rec.Code != 409 {
+		t.Errorf("changed election %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPutPrintRunRace(t *testing.T) {
+	// a file, as served, so concurrent runs each get a connection
+	db, err := sql.Open("sqlite3", sqliteSettings.dsn(filepath.Join(t.TempDir(), "bs.db")))
+	mtfail(t, err, "open sqlite, %v", err)
+	defer db.Close()
+	edb := NewSqliteEDB(db)
+	err = edb.Setup()
+	mtfail(t, err, "edb sqlite setup, %v", err)
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+
+	// every run numbered 1-10, as if each had been checked against no runs
+	const n = 8
+	var wg sync.WaitGroup
+	put := make([]*printRun, n)
+	overlaps := make([]*printRun, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pr := &printRun{ElectionId: eid, First: 1, Last: 10, Created: int64(i)}
+			overlaps[i], errs[i] = edb.PutPrintRun(pr, i%2 == 0)
+			put[i] = pr
+		}(i)
+	}
+	wg.Wait()
+	numbered := map[int64]bool{}
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("run %d, %v", i, errs[i])
+		}
+		if overlaps[i] != nil {
+			continue
+		}
+		for num := put[i].First; num <= put[i].Last; num++ {
+			if numbered[num] {
+				t.Errorf("ballot %d numbered twice", num)
+			}
+			numbered[num] = true
+		}
+	}
+	runs, err := edb.PrintRunsForElection(eid)
+	mtfail(t, err, "runs, %v", err)
+	// every next run, and one of the runs asking for 1-10 unless a next run got there first
+	if len(runs) < n/2 || len(runs) > n/2+1 || len(numbered) != 10*len(runs) {
+		t.Errorf("%d runs, %d numbers", len(runs), len(numbered))
+	}
+
+	overlap, err := edb.PutPrintRun(&printRun{ElectionId: eid, First: maxPrintNumber - 9, Last: maxPrintNumber}, false)
+	if err != nil || overlap != nil {
+		t.Fatalf("last ten numbers %v %v", overlap, err)
+	}
+	if _, err = edb.PutPrintRun(&printRun{ElectionId: eid, First: 1, Last: 10}, true); !errors.Is(err, errPrintNumbers) {
+		t.Errorf("next run past the last number, %v", err)
+	}
+}
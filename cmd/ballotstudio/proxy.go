@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Running behind nginx or a load balancer. Requests whose peer is in
+// -trusted-proxies have their client address taken from X-Forwarded-For and
+// their scheme from X-Forwarded-Proto, so rate limits are per client instead
+// of per proxy, the scan archive records who uploaded, and links, HSTS and
+// secure cookies know the client connected with https. The headers are
+// ignored from anyone else, since a client can send whatever it likes.
+
+type forwardedProtoKey struct{}
+
+// X-Forwarded-Prefix, see baseurl.go
+type forwardedPrefixKey struct{}
+
+// parseTrustedProxies parses the comma separated -trusted-proxies flag of IPs and CIDRs
+func parseTrustedProxies(s string) (nets []*net.IPNet, err error) {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("bad proxy address %q", part)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			part = fmt.Sprintf("%s/%d", part, bits)
+		}
+		_, ipnet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy network %q", part)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// trustedProxyHandler rewrites RemoteAddr and notes the scheme for requests
+// that came through a trusted proxy
+type trustedProxyHandler struct {
+	sub     http.Handler
+	proxies []*net.IPNet
+}
+
+func (tp *trustedProxyHandler) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range tp.proxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tp *trustedProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(tp.proxies) == 0 || !tp.trusted(clientIP(r)) {
+		tp.sub.ServeHTTP(w, r)
+		return
+	}
+	r = r.WithContext(r.Context()) // a copy to change
+	// each proxy appends who it heard from; walk back past our own proxies
+	// to the first address we didn't put there ourselves
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		r.RemoteAddr = hops[i]
+		if !tp.trusted(hops[i]) {
+			break
+		}
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if i := strings.IndexByte(proto, ','); i >= 0 {
+		// the first proxy's, the one the client connected to
+		proto = proto[:i]
+	}
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if proto == "https" || proto == "http" {
+		r = r.WithContext(context.WithValue(r.Context(), forwardedProtoKey{}, proto))
+	}
+	if prefix := r.Header.Get("X-Forwarded-Prefix"); prefix != "" {
+		r = r.WithContext(context.WithValue(r.Context(), forwardedPrefixKey{}, prefix))
+	}
+	tp.sub.ServeHTTP(w, r)
+}
+
+// requestScheme is "https" if the client connected with TLS, to us or to a trusted proxy
+func requestScheme(r *http.Request) string {
+	if proto, ok := r.Context().Value(forwardedProtoKey{}).(string); ok {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	for _, bad := range []string{"10.0.0.300", "10.0.0.0/40", "nginx"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.5,::1")
+	mtfail(t, err, "parse, %v", err)
+	if len(proxies) != 3 {
+		t.Fatalf("proxies %v", proxies)
+	}
+
+	var ip, scheme, link string
+	tp := &trustedProxyHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip = clientIP(r)
+		scheme = requestScheme(r)
+		link = serverURL(r, "/x")
+	}), proxies}
+	for _, tc := range []struct {
+		peer, xff, proto string
+		ip, scheme       string
+	}{
+		{"10.1.2.3:5000", "203.0.113.9", "https", "203.0.113.9", "https"},
+		// a client made up the first entry, the proxy appended its real address
+		{"10.1.2.3:5000", "1.1.1.1, 203.0.113.9, 10.9.9.9", "https, http", "203.0.113.9", "https"},
+		{"[::1]:5000", "203.0.113.9", "http", "203.0.113.9", "http"},
+		// not a trusted proxy, headers ignored
+		{"198.51.100.7:5000", "203.0.113.9", "https", "198.51.100.7", "http"},
+		{"10.1.2.3:5000", "", "", "10.1.2.3", "http"},
+		{"10.1.2.3:5000", "garbage", "gopher", "10.1.2.3", "http"},
+	} {
+		req := httptest.NewRequest("GET", "http://ballots.example.com/", nil)
+		req.RemoteAddr = tc.peer
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		tp.ServeHTTP(httptest.NewRecorder(), req)
+		if ip != tc.ip || scheme != tc.scheme || link != tc.scheme+"://ballots.example.com/x" {
+			t.Errorf("%#v got %s %s %s", tc, ip, scheme, link)
+		}
+		if req.RemoteAddr != tc.peer {
+			t.Errorf("original request changed")
+		}
+	}
+}
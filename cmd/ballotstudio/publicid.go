@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/brianolson/login/login"
+)
+
+// Public election ids. Elections are numbered 1, 2, 3 in the database, so
+// anyone could walk /election/1.pdf, /election/2.pdf and so on to find
+// every published document on the server. With -id-key set, each election
+// also has a 26 character public id, its number encrypted under the key,
+// and every route that takes an election number takes that instead:
+// /election/{publicid}.pdf, /edit/{publicid}, and so on. Links the server
+// makes use public ids.
+//
+// Nothing is stored; changing -id-key changes every public id and breaks
+// old links. With -require-public-ids, requests that aren't logged in get
+// 404 for election numbers, so only someone given a link can find a
+// document. Media paths are exempt; their names are content hashes.
+
+var idEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// a public id in place of an election number, and what follows it
+var publicIdPathRe = regexp.MustCompile(`^/(election|edit|trash)/([a-z2-7]{26})([._/].*)?$`)
+
+// an election number, and what follows it
+var numericIdPathRe = regexp.MustCompile(`^/(election|edit|trash)/(\d+)([._/].*)?$`)
+
+// idCodec turns election numbers into public ids and back
+type idCodec struct {
+	block cipher.Block
+}
+
+// newIdCodec takes a 16, 24 or 32 byte AES key
+func newIdCodec(key []byte) (*idCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("id key, %v", err)
+	}
+	return &idCodec{block}, nil
+}
+
+// encode encrypts one block of the election number and eight zero bytes
+func (ic *idCodec) encode(eid int64) string {
+	var plain, sealed [16]byte
+	binary.BigEndian.PutUint64(plain[:8], uint64(eid))
+	ic.block.Encrypt(sealed[:], plain[:])
+	return idEncoding.EncodeToString(sealed[:])
+}
+
+// decode is false for anything encode didn't make
+func (ic *idCodec) decode(publicid string) (int64, bool) {
+	sealed, err := idEncoding.DecodeString(publicid)
+	if err != nil || len(sealed) != 16 {
+		return 0, false
+	}
+	var plain [16]byte
+	ic.block.Decrypt(plain[:], sealed)
+	var zero [8]byte
+	eid := int64(binary.BigEndian.Uint64(plain[:8]))
+	if !bytes.Equal(plain[8:], zero[:]) || eid <= 0 || ic.encode(eid) != publicid {
+		return 0, false
+	}
+	return eid, true
+}
+
+type publicIdsKey struct{}
+
+// electionRef is how links name election eid: its public id if there's an
+// -id-key, otherwise its number
+func electionRef(r *http.Request, eid int64) string {
+	if ic, ok := r.Context().Value(publicIdsKey{}).(*idCodec); ok {
+		return ic.encode(eid)
+	}
+	return strconv.FormatInt(eid, 10)
+}
+
+// publicIdHandler rewrites public ids in paths to election numbers, so
+// routes only ever see numbers
+type publicIdHandler struct {
+	sub      http.Handler
+	codec    *idCodec
+	required bool // -require-public-ids
+	udb      login.UserDB
+	edb      electionAppDB
+}
+
+func (ph *publicIdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), publicIdsKey{}, ph.codec))
+	if m := publicIdPathRe.FindStringSubmatch(r.URL.Path); m != nil {
+		eid, ok := ph.codec.decode(m[2])
+		if !ok {
+			texterr(w, 404, "no item")
+			return
+		}
+		u := *r.URL
+		u.Path = "/" + m[1] + "/" + strconv.FormatInt(eid, 10) + m[3]
+		u.RawPath = ""
+		r.URL = &u
+	} else if m := numericIdPathRe.FindStringSubmatch(r.URL.Path); m != nil && ph.required && !strings.HasPrefix(m[3], "/media/") {
+		user := httpUser(w, r, ph.udb, ph.edb)
+		if user == nil {
+			texterr(w, 404, "no item")
+			return
+		}
+	}
+	ph.sub.ServeHTTP(w, r)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdCodec(t *testing.T) {
+	ic, err := newIdCodec([]byte("0123456789abcdef"))
+	mtfail(t, err, "codec, %v", err)
+	seen := make(map[string]bool)
+	for _, eid := range []int64{1, 2, 3, 1000, 1 << 40} {
+		pid := ic.encode(eid)
+		if len(pid) != 26 || !publicIdPathRe.MatchString("/election/"+pid) || seen[pid] {
+			t.Errorf("%d: public id %q", eid, pid)
+		}
+		seen[pid] = true
+		if got, ok := ic.decode(pid); !ok || got != eid {
+			t.Errorf("%d: decoded %d %v", eid, got, ok)
+		}
+		// one changed character is not some other election
+		flipped := []byte(pid)
+		if flipped[3] == 'a' {
+			flipped[3] = 'b'
+		} else {
+			flipped[3] = 'a'
+		}
+		if got, ok := ic.decode(string(flipped)); ok {
+			t.Errorf("%d: %s decoded to %d", eid, flipped, got)
+		}
+	}
+	other, _ := newIdCodec([]byte("fedcba9876543210"))
+	if _, ok := other.decode(ic.encode(7)); ok {
+		t.Errorf("decoded under another key")
+	}
+	if _, err := newIdCodec([]byte("short")); err == nil {
+		t.Errorf("short key")
+	}
+}
+
+func TestPublicIdHandler(t *testing.T) {
+	ic, err := newIdCodec([]byte("0123456789abcdef"))
+	mtfail(t, err, "codec, %v", err)
+	var path string
+	var ec EditContext
+	sub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		ec = EditContext{}
+		ec.set(r, 3)
+	})
+	get := func(h http.Handler, target string) int {
+		path = ""
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec.Code
+	}
+	pid := ic.encode(3)
+	h := &publicIdHandler{sub: sub, codec: ic}
+	for _, tc := range [][2]string{
+		{"/election/" + pid + ".pdf", "/election/3.pdf"},
+		{"/election/" + pid + "_bubbles.json", "/election/3_bubbles.json"},
+		{"/election/" + pid + ".2.png", "/election/3.2.png"},
+		{"/election/" + pid, "/election/3"},
+		{"/edit/" + pid, "/edit/3"},
+		{"/trash/" + pid + "/restore", "/trash/3/restore"},
+		{"/election/3.pdf", "/election/3.pdf"},
+		{"/election/import", "/election/import"},
+	} {
+		if code := get(h, tc[0]); code != 200 || path != tc[1] {
+			t.Errorf("%s: %d %q, want %q", tc[0], code, path, tc[1])
+		}
+	}
+	if ec.PublicId != pid || ec.PDFURL != "/election/"+pid+".pdf" || ec.ElectionId != 3 {
+		t.Errorf("edit context %#v", ec)
+	}
+	if code := get(h, "/election/"+strings.Repeat("a", 26)+".pdf"); code != 404 || path != "" {
+		t.Errorf("made up public id %d %q", code, path)
+	}
+
+	h.required = true
+	if code := get(h, "/election/3.pdf"); code != 404 || path != "" {
+		t.Errorf("anonymous election number %d %q", code, path)
+	}
+	media := "/election/3/media/" + strings.Repeat("0", 64) + ".png"
+	if code := get(h, media); code != 200 || path != media {
+		t.Errorf("media %d %q", code, path)
+	}
+	if code := get(h, "/election/"+pid+".pdf"); code != 200 || path != "/election/3.pdf" {
+		t.Errorf("anonymous public id %d %q", code, path)
+	}
+
+	// without -id-key links use numbers
+	sub.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/edit/3", nil))
+	if ec.PublicId != "" || ec.PDFURL != "/election/3.pdf" {
+		t.Errorf("no key edit context %#v", ec)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/brianolson/login/login"
+)
+
+// Per-user storage quotas. Anyone with an invite can sign up, so without
+// limits one account could fill the database. -quota-elections caps the
+// untrashed elections a user owns, -quota-scan-bytes the scan images stored
+// for a user's untrashed elections (charged to the election's owner, whoever
+// uploads), and -quota-revisions how many revisions each election keeps,
+// dropping the oldest. 0 is no limit.
+//
+// Going over is a JSON error with which quota, its limit and what is used:
+// 429 for elections, 413 for scan bytes. Admins have no limits. An admin
+// can give one user other limits at /admin/quotas/{user}: GET shows them
+// with the user's usage, PUT sets them (fields left out keep their value),
+// DELETE goes back to the defaults.
+
+type quotaLimits struct {
+	Elections int64 `json:"elections"`
+	ScanBytes int64 `json:"scan_bytes"`
+	Revisions int64 `json:"revisions"` // per election
+}
+
+type quotaUsage struct {
+	Elections int64 `json:"elections"`
+	ScanBytes int64 `json:"scan_bytes"`
+}
+
+// quotaError is the body of a 413 or 429
+type quotaError struct {
+	Message string `json:"error"`
+	Quota   string `json:"quota"` // elections or scan_bytes
+	Limit   int64  `json:"limit"`
+	Used    int64  `json:"used"`
+
+	code int
+}
+
+func (qe *quotaError) Error() string {
+	return qe.Message
+}
+
+func (qe *quotaError) write(w http.ResponseWriter) {
+	eb, _ := json.Marshal(qe)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(qe.code)
+	w.Write(eb)
+}
+
+// userQuota is user's limits; unlimited for admins
+func (sh *StudioHandler) userQuota(user *login.User) (q quotaLimits, unlimited bool, err error) {
+	admin, err := sh.isAdmin(user)
+	if err != nil || admin {
+		return q, admin, err
+	}
+	override, err := sh.edb.GetUserQuota(user.Guid)
+	if err != nil {
+		return q, false, err
+	}
+	if override != nil {
+		return *override, false, nil
+	}
+	return sh.quotas, false, nil
+}
+
+// checkQuota returns a *quotaError if user can't have newElections more
+// elections and scanBytes more scan image bytes
+func (sh *StudioHandler) checkQuota(user *login.User, newElections, scanBytes int64) error {
+	q, unlimited, err := sh.userQuota(user)
+	if err != nil {
+		return fmt.Errorf("quota, %v", err)
+	}
+	if unlimited || (q.Elections == 0 || newElections == 0) && (q.ScanBytes == 0 || scanBytes == 0) {
+		return nil
+	}
+	usage, err := sh.edb.UserUsage(user.Guid)
+	if err != nil {
+		return fmt.Errorf("quota usage, %v", err)
+	}
+	if q.Elections != 0 && newElections != 0 && usage.Elections+newElections > q.Elections {
+		return &quotaError{fmt.Sprintf("election quota reached, %d of %d; trash some to make room", usage.Elections, q.Elections), "elections", q.Elections, usage.Elections, http.StatusTooManyRequests}
+	}
+	if q.ScanBytes != 0 && scanBytes != 0 && usage.ScanBytes+scanBytes > q.ScanBytes {
+		return &quotaError{fmt.Sprintf("scan storage quota reached, %d of %d bytes used", usage.ScanBytes, q.ScanBytes), "scan_bytes", q.ScanBytes, usage.ScanBytes, http.StatusRequestEntityTooLarge}
+	}
+	return nil
+}
+
+// overQuota checks the quota and writes the error response, true if the request should stop
+func (sh *StudioHandler) overQuota(w http.ResponseWriter, user *login.User, newElections, scanBytes int64) bool {
+	err := sh.checkQuota(user, newElections, scanBytes)
+	if qe, ok := err.(*quotaError); ok {
+		qe.write(w)
+		return true
+	}
+	return maybeerr(w, err, 500, "quota")
+}
+
+// pruneRevisions keeps eid's newest revisions within user's quota
+func (sh *StudioHandler) pruneRevisions(user *login.User, eid int64) {
+	q, unlimited, err := sh.userQuota(user)
+	if err == nil && !unlimited && q.Revisions > 0 {
+		err = sh.edb.PruneRevisions(eid, q.Revisions)
+	}
+	if err != nil {
+		log.Printf("%d: prune revisions, %v", eid, err)
+	}
+}
+
+// quota queries common to all backends. param is "$" for numbered
+// placeholders or "?", idcol is the elections id column.
+
+func queryUsage(db sqlDB, param, idcol string, uid int64) (usage quotaUsage, err error) {
+	ph := "?"
+	if param != "?" {
+		ph = "$1"
+	}
+	err = db.QueryRow(`SELECT COUNT(*) FROM elections WHERE trashed IS NULL AND owner = `+ph, uid).Scan(&usage.Elections)
+	if err != nil {
+		return usage, fmt.Errorf("usage elections, %v", err)
+	}
+	var scanBytes sql.NullInt64
+	err = db.QueryRow(`SELECT SUM(LENGTH(s.image)) FROM scans s JOIN elections e ON e.`+idcol+` = s.election WHERE e.trashed IS NULL AND e.owner = `+ph, uid).Scan(&scanBytes)
+	if err != nil {
+		return usage, fmt.Errorf("usage scans, %v", err)
+	}
+	usage.ScanBytes = scanBytes.Int64
+	return usage, nil
+}
+
+func getUserQuota(db sqlDB, param string, uid int64) (*quotaLimits, error) {
+	ph := "?"
+	if param != "?" {
+		ph = "$1"
+	}
+	var q quotaLimits
+	err := db.QueryRow(`SELECT elections, scan_bytes, revisions FROM user_quotas WHERE owner = `+ph, uid).Scan(&q.Elections, &q.ScanBytes, &q.Revisions)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("user quota, %v", err)
+	}
+	return &q, nil
+}
+
+func setUserQuota(db sqlDB, param string, uid int64, q *quotaLimits) error {
+	ph := func(i int) string {
+		if param == "?" {
+			return "?"
+		}
+		return fmt.Sprintf("$%d", i)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("quota tx, %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM user_quotas WHERE owner = `+ph(1), uid)
+	if err != nil {
+		return fmt.Errorf("quota delete, %v", err)
+	}
+	if q != nil {
+		_, err = tx.Exec(fmt.Sprintf(`INSERT INTO user_quotas (owner, elections, scan_bytes, revisions) VALUES (%s, %s, %s, %s)`, ph(1), ph(2), ph(3), ph(4)), uid, q.Elections, q.ScanBytes, q.Revisions)
+		if err != nil {
+			return fmt.Errorf("quota insert, %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("quota commit, %v", err)
+	}
+	return nil
+}
+
+func pruneRevisions(db sqlDB, param string, eid, keep int64) error {
+	ph := func(i int) string {
+		if param == "?" {
+			return "?"
+		}
+		return fmt.Sprintf("$%d", i)
+	}
+	var latest sql.NullInt64
+	err := db.QueryRow(`SELECT MAX(rev) FROM election_revisions WHERE election = `+ph(1), eid).Scan(&latest)
+	if err != nil {
+		return fmt.Errorf("revisions max, %v", err)
+	}
+	if latest.Int64 <= keep {
+		return nil
+	}
+	// scans are re-read against the revision they were read with, keep those
+	_, err = db.Exec(fmt.Sprintf(`DELETE FROM election_revisions WHERE election = %s AND rev <= %s AND rev NOT IN (SELECT rev FROM scans WHERE election = %s AND rev IS NOT NULL)`, ph(1), ph(2), ph(3)), eid, latest.Int64-keep, eid)
+	if err != nil {
+		return fmt.Errorf("revisions prune, %v", err)
+	}
+	return nil
+}
+
+// /admin/quotas/{user}
+type userQuotaJSON struct {
+	User     int64       `json:"user"`
+	Limits   quotaLimits `json:"limits"`
+	Override bool        `json:"override"` // false if these are the defaults
+	Usage    quotaUsage  `json:"usage"`
+}
+
+// largest quota PUT body
+const maxQuotaBody = 10000
+
+func (sh *StudioHandler) handleQuotaAdmin(w http.ResponseWriter, r *http.Request, user *login.User, uid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	admin, err := sh.isAdmin(user)
+	if maybeerr(w, err, 500, "db staff") {
+		return
+	}
+	if !admin {
+		texterr(w, http.StatusForbidden, "admins only")
+		return
+	}
+	override, err := sh.edb.GetUserQuota(uid)
+	if maybeerr(w, err, 500, "db quota") {
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxQuotaBody))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		q := sh.quotas
+		if override != nil {
+			q = *override
+		}
+		err = json.Unmarshal(body, &q)
+		if maybeerr(w, err, 400, "want json {\"elections\": n, \"scan_bytes\": n, \"revisions\": n}") {
+			return
+		}
+		if q.Elections < 0 || q.ScanBytes < 0 || q.Revisions < 0 {
+			texterr(w, 400, "limits should be 0 (none) or more")
+			return
+		}
+		err = sh.edb.SetUserQuota(uid, &q)
+		if maybeerr(w, err, 500, "db quota") {
+			return
+		}
+		override = &q
+	case "DELETE":
+		err = sh.edb.SetUserQuota(uid, nil)
+		if maybeerr(w, err, 500, "db quota") {
+			return
+		}
+		override = nil
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET, PUT or DELETE")
+		return
+	}
+	uq := userQuotaJSON{User: uid, Limits: sh.quotas, Override: override != nil}
+	if override != nil {
+		uq.Limits = *override
+	}
+	uq.Usage, err = sh.edb.UserUsage(uid)
+	if maybeerr(w, err, 500, "db usage") {
+		return
+	}
+	writeJSON(w, uq)
+}
+
+// parseUserId is the {user} of /admin/quotas/{user}
+func parseUserId(s string) (int64, error) {
+	uid, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && uid <= 0 {
+		err = fmt.Errorf("bad user %s", s)
+	}
+	return uid, err
+}
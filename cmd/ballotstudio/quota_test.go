@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestQuotas(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, admins: map[string]bool{"root": true}, quotas: quotaLimits{Elections: 2, ScanBytes: 1000, Revisions: 2}}
+	ann := &login.User{Guid: 7, Username: "ann"}
+	save := func(eid int64, name string) (int, quotaError) {
+		rec := httptest.NewRecorder()
+		doc := `{"Election": [{"Name": "` + name + `"}]}`
+		sh.handleElectionDocPOSTJson(rec, httptest.NewRequest("POST", "/election", nil), ann, eid, []byte(doc), editContextFinish)
+		var qe quotaError
+		json.Unmarshal(rec.Body.Bytes(), &qe)
+		return rec.Code, qe
+	}
+	if code, _ := save(0, "one"); code != 200 {
+		t.Fatalf("first %d", code)
+	}
+	if code, _ := save(0, "two"); code != 200 {
+		t.Fatalf("second %d", code)
+	}
+	code, qe := save(0, "three")
+	if code != 429 || qe.Quota != "elections" || qe.Limit != 2 || qe.Used != 2 || !strings.Contains(qe.Message, "quota") {
+		t.Errorf("over election quota %d %#v", code, qe)
+	}
+
+	// editing is fine, and keeps only the newest revisions
+	eids, err := edb.ElectionsForUser(ann.Guid)
+	mtfail(t, err, "elections, %v", err)
+	for _, name := range []string{"one b", "one c", "one d"} {
+		if code, _ := save(eids[0], name); code != 200 {
+			t.Fatalf("edit %d", code)
+		}
+	}
+	revs, err := edb.ElectionRevisions(eids[0])
+	mtfail(t, err, "revisions, %v", err)
+	if len(revs) != 2 || revs[0].Rev != 3 || revs[1].Rev != 4 {
+		t.Errorf("revisions %#v", revs)
+	}
+
+	_, err = edb.PutScan(scanRecord{ElectionId: eids[0], Image: make([]byte, 900), ContentType: "image/png"})
+	mtfail(t, err, "put scan, %v", err)
+	if err := sh.checkQuota(ann, 0, 50); err != nil {
+		t.Errorf("under scan quota, %v", err)
+	}
+	err = sh.checkQuota(ann, 0, 200)
+	if qe, ok := err.(*quotaError); !ok || qe.code != 413 || qe.Quota != "scan_bytes" || qe.Used != 900 {
+		t.Errorf("over scan quota %#v", err)
+	}
+
+	// trashing makes room
+	err = edb.TrashElection(eids[1], time.Now())
+	mtfail(t, err, "trash, %v", err)
+	if err := sh.checkQuota(ann, 1, 0); err != nil {
+		t.Errorf("after trash, %v", err)
+	}
+
+	// staff admins have no limits
+	err = edb.PutStaff(staffRecord{Email: "bo@example.com", Role: StaffAdmin, UserId: 8})
+	mtfail(t, err, "staff, %v", err)
+	if err := sh.checkQuota(&login.User{Guid: 8, Username: "bo"}, 100, 1e9); err != nil {
+		t.Errorf("admin limited, %v", err)
+	}
+
+	root := &login.User{Guid: 1, Username: "root"}
+	admin := func(user *login.User, method, body string) (int, userQuotaJSON) {
+		rec := httptest.NewRecorder()
+		sh.handleQuotaAdmin(rec, httptest.NewRequest(method, "/admin/quotas/7", strings.NewReader(body)), user, ann.Guid)
+		var uq userQuotaJSON
+		json.Unmarshal(rec.Body.Bytes(), &uq)
+		return rec.Code, uq
+	}
+	if code, _ := admin(ann, "PUT", `{"elections": 0}`); code != 403 {
+		t.Errorf("not admin %d", code)
+	}
+	if code, _ := admin(root, "PUT", `{"elections": -1}`); code != 400 {
+		t.Errorf("negative %d", code)
+	}
+	code, uq := admin(root, "GET", "")
+	if code != 200 || uq.Override || uq.Limits != sh.quotas || uq.Usage != (quotaUsage{1, 900}) {
+		t.Errorf("get %d %#v", code, uq)
+	}
+	code, uq = admin(root, "PUT", `{"scan_bytes": 0}`)
+	if code != 200 || !uq.Override || uq.Limits != (quotaLimits{2, 0, 2}) {
+		t.Errorf("put %d %#v", code, uq)
+	}
+	if err := sh.checkQuota(ann, 0, 1e9); err != nil {
+		t.Errorf("override, %v", err)
+	}
+	if code, uq = admin(root, "DELETE", ""); code != 200 || uq.Override {
+		t.Errorf("delete %d %#v", code, uq)
+	}
+	if err := sh.checkQuota(ann, 0, 1e9); err == nil {
+		t.Errorf("back to defaults")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// RateLimiter is a set of token buckets by key (user or IP).
+// A nil *RateLimiter allows everything.
+type RateLimiter struct {
+	// Rate is tokens per second added to each bucket
+	Rate float64
+
+	// Burst is the maximum tokens a bucket can hold
+	Burst float64
+
+	buckets map[string]*tokenBucket
+	lock    sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// prune idle buckets when there are more than this many
+const rateLimitMaxBuckets = 10000
+
+// NewRateLimiter returns nil (no limit) if rate <= 0
+func NewRateLimiter(rate, burst float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the bucket for key.
+// If there isn't one, returns false and how long until there will be.
+func (rl *RateLimiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	now := time.Now()
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	tb := rl.buckets[key]
+	if tb == nil {
+		if len(rl.buckets) >= rateLimitMaxBuckets {
+			rl.prune(now)
+		}
+		tb = &tokenBucket{tokens: rl.Burst, last: now}
+		rl.buckets[key] = tb
+	} else {
+		tb.tokens = math.Min(rl.Burst, tb.tokens+(now.Sub(tb.last).Seconds()*rl.Rate))
+		tb.last = now
+	}
+	if tb.tokens >= 1 {
+		tb.tokens -= 1
+		return true, 0
+	}
+	wait := (1 - tb.tokens) / rl.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// drop buckets that would have refilled by now, they're the same as new ones
+// must be called with lock held
+func (rl *RateLimiter) prune(now time.Time) {
+	for key, tb := range rl.buckets {
+		if tb.tokens+(now.Sub(tb.last).Seconds()*rl.Rate) >= rl.Burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey is per-user if logged in, otherwise per-IP
+func rateLimitKey(r *http.Request, user *login.User) string {
+	if user != nil {
+		return fmt.Sprintf("u:%d", user.Guid)
+	}
+	return "ip:" + clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// check rate limit and write 429 response if over
+// returns true if the request should stop
+func rateLimited(w http.ResponseWriter, r *http.Request, rl *RateLimiter, user *login.User) bool {
+	ok, retryAfter := rl.Allow(rateLimitKey(r, user))
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+	texterr(w, http.StatusTooManyRequests, "too many requests, slow down")
+	return true
+}
+
+// loginRateLimitHandler limits POST (login or signup attempts) per-IP
+type loginRateLimitHandler struct {
+	limit *RateLimiter
+	sub   http.Handler
+
+	// loginForm limits only POST / where the home page's login form goes,
+	// leaving the rest of the API to the per-user limits
+	loginForm bool
+}
+
+func (lr *loginRateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && (!lr.loginForm || r.URL.Path == "/") && rateLimited(w, r, lr.limit, nil) {
+		return
+	}
+	lr.sub.ServeHTTP(w, r)
+}
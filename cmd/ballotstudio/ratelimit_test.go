@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(0.001, 3)
+	for i := 0; i < 3; i++ {
+		ok, _ := rl.Allow("a")
+		if !ok {
+			t.Errorf("burst request %d denied", i)
+		}
+	}
+	ok, retry := rl.Allow("a")
+	if ok {
+		t.Errorf("request past burst allowed")
+	}
+	if retry <= 0 {
+		t.Errorf("bad retry-after %s", retry)
+	}
+	ok, _ = rl.Allow("b")
+	if !ok {
+		t.Errorf("other key denied")
+	}
+
+	var nolimit *RateLimiter = NewRateLimiter(0, 0)
+	ok, _ = nolimit.Allow("a")
+	if !ok {
+		t.Errorf("nil limiter denied")
+	}
+}
+
+func TestLoginRateLimitHandler(t *testing.T) {
+	served := 0
+	sub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ })
+	lr := &loginRateLimitHandler{NewRateLimiter(0.001, 3), sub, true}
+	post := func(path string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{}`))
+		req.RemoteAddr = "10.1.2.3:4567"
+		lr.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// a scanning station saving documents all day from one address
+	for i := 0; i < 20; i++ {
+		if code := post("/election/1"); code != 200 {
+			t.Fatalf("document save %d got %d", i, code)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if code := post("/"); code != 200 {
+			t.Errorf("login %d got %d", i, code)
+		}
+	}
+	if code := post("/"); code != 429 || served != 23 {
+		t.Errorf("login past burst got %d, %d served", code, served)
+	}
+	if code := post("/election/1"); code != 200 {
+		t.Errorf("document save after login limit got %d", code)
+	}
+
+	// signup, OIDC and SAML are limited throughout
+	lr = &loginRateLimitHandler{NewRateLimiter(0.001, 1), sub, false}
+	post("/signup/abc")
+	if code := post("/signup/abc"); code != 429 {
+		t.Errorf("signup past burst got %d", code)
+	}
+}
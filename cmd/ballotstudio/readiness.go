@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/login/login"
+)
+
+// readiness item status, worst last
+const (
+	readyPass = "pass"
+	readyWarn = "warn"
+	readyFail = "fail"
+)
+
+var readyRank = map[string]int{readyPass: 0, readyWarn: 1, readyFail: 2}
+
+type readinessItem struct {
+	Check   string   `json:"check"`
+	Status  string   `json:"status"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+type readinessReport struct {
+	ElectionId int64           `json:"itemid"`
+	State      string          `json:"state"`
+	Status     string          `json:"status"` // worst of Items
+	Items      []readinessItem `json:"items"`
+}
+
+func (rr *readinessReport) add(item readinessItem) {
+	rr.Items = append(rr.Items, item)
+	if readyRank[item.Status] > readyRank[rr.Status] {
+		rr.Status = item.Status
+	}
+}
+
+// item is fail if there are any details, pass otherwise
+func failIfAny(check, ok, bad string, details []string) readinessItem {
+	if len(details) == 0 {
+		return readinessItem{Check: check, Status: readyPass, Message: ok}
+	}
+	return readinessItem{Check: check, Status: readyFail, Message: bad, Details: details}
+}
+
+// contest @id -> selection @ids, from every Election
+func docContests(doc map[string]interface{}) (contests map[string][]string, order []string) {
+	contests = make(map[string][]string)
+	for _, el := range mapList(doc["Election"]) {
+		for _, co := range mapList(el["Contest"]) {
+			cid, _ := co["@id"].(string)
+			var sels []string
+			for _, sel := range mapList(co["ContestSelection"]) {
+				sid, _ := sel["@id"].(string)
+				sels = append(sels, sid)
+			}
+			contests[cid] = sels
+			order = append(order, cid)
+		}
+	}
+	return
+}
+
+func mapList(v interface{}) (out []map[string]interface{}) {
+	they, _ := v.([]interface{})
+	for _, x := range they {
+		if m, ok := x.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return
+}
+
+func checkValidation(doc map[string]interface{}) readinessItem {
+	var problems []string
+	elections := mapList(doc["Election"])
+	if len(elections) == 0 {
+		problems = append(problems, "no Election")
+	}
+	for _, el := range elections {
+		candidates := make(map[string]bool)
+		for _, cand := range mapList(el["Candidate"]) {
+			id, _ := cand["@id"].(string)
+			candidates[id] = true
+		}
+		contests := mapList(el["Contest"])
+		if len(contests) == 0 {
+			problems = append(problems, "election has no contests")
+		}
+		known := make(map[string]bool)
+		for _, co := range contests {
+			cid, _ := co["@id"].(string)
+			known[cid] = true
+			sels := mapList(co["ContestSelection"])
+			if len(sels) == 0 {
+				problems = append(problems, fmt.Sprintf("contest %s has no selections", cid))
+			}
+			for _, sel := range sels {
+				ids, _ := sel["CandidateIds"].([]interface{})
+				for _, x := range ids {
+					candid, _ := x.(string)
+					if !candidates[candid] {
+						problems = append(problems, fmt.Sprintf("contest %s selection %v has unknown candidate %s", cid, sel["@id"], candid))
+					}
+				}
+			}
+		}
+		for si, bs := range mapList(el["BallotStyle"]) {
+			for _, oc := range mapList(bs["OrderedContent"]) {
+				cid, _ := oc["ContestId"].(string)
+				if cid != "" && !known[cid] {
+					problems = append(problems, fmt.Sprintf("BallotStyle[%d] has unknown contest %s", si, cid))
+				}
+			}
+		}
+	}
+	return failIfAny("validation", "election document is complete", "election document is incomplete", problems)
+}
+
+// checkLayout checks bubble geometry and, if there is a render, that every selection got a bubble
+func checkLayout(doc map[string]interface{}, bubblesJSON []byte) readinessItem {
+	problems := data.CheckBubbleGeometry(doc)
+	if len(problems) != 0 {
+		return failIfAny("layout", "", "bad BubbleGeometry", problems)
+	}
+	if bubblesJSON == nil {
+		return readinessItem{Check: "layout", Status: readyWarn, Message: "not rendered since the last change"}
+	}
+	bj, err := scan.ParseBubbles(bubblesJSON)
+	if err != nil {
+		return readinessItem{Check: "layout", Status: readyFail, Message: fmt.Sprintf("bad bubbles json, %v", err)}
+	}
+	contests, _ := docContests(doc)
+	for _, el := range mapList(doc["Election"]) {
+		styles := mapList(el["BallotStyle"])
+		if len(styles) != len(bj.Bubbles) {
+			problems = append(problems, fmt.Sprintf("%d ballot styles but %d drawn", len(styles), len(bj.Bubbles)))
+			break
+		}
+		for si, bs := range styles {
+			for _, oc := range mapList(bs["OrderedContent"]) {
+				cid, _ := oc["ContestId"].(string)
+				for _, sid := range contests[cid] {
+					if _, ok := bj.Bubbles[si][cid][sid]; !ok {
+						problems = append(problems, fmt.Sprintf("BallotStyle[%d] contest %s selection %s has no bubble", si, cid, sid))
+					}
+				}
+			}
+		}
+		// bubbles json only covers the first Election
+		break
+	}
+	return failIfAny("layout", "every selection has a bubble", "missing bubbles", problems)
+}
+
+// checkTranslations looks at every InternationalizedText ({"Text":[{"Language":"en","Content":"..."}]})
+// and reports ones missing a language used elsewhere in the document.
+func checkTranslations(doc map[string]interface{}) readinessItem {
+	var texts []map[string]bool
+	var paths []string
+	langs := make(map[string]bool)
+	var walk func(v interface{}, path string)
+	walk = func(v interface{}, path string) {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if tl, ok := x["Text"].([]interface{}); ok {
+				have := make(map[string]bool)
+				for _, t := range mapList(tl) {
+					lang, _ := t["Language"].(string)
+					content, _ := t["Content"].(string)
+					if lang != "" && content != "" {
+						have[lang] = true
+						langs[lang] = true
+					}
+				}
+				texts = append(texts, have)
+				paths = append(paths, path)
+				return
+			}
+			for k, sub := range x {
+				walk(sub, path+"."+k)
+			}
+		case []interface{}:
+			for i, sub := range x {
+				walk(sub, path+"["+strconv.Itoa(i)+"]")
+			}
+		}
+	}
+	walk(doc, "")
+	if len(langs) <= 1 {
+		return readinessItem{Check: "translation", Status: readyPass, Message: "single language document"}
+	}
+	var all []string
+	for lang := range langs {
+		all = append(all, lang)
+	}
+	sort.Strings(all)
+	var problems []string
+	for i, have := range texts {
+		var missing []string
+		for _, lang := range all {
+			if !have[lang] {
+				missing = append(missing, lang)
+			}
+		}
+		if len(missing) != 0 {
+			problems = append(problems, fmt.Sprintf("%s missing %s", strings.TrimPrefix(paths[i], "."), strings.Join(missing, ",")))
+		}
+	}
+	sort.Strings(problems)
+	if len(problems) == 0 {
+		return readinessItem{Check: "translation", Status: readyPass, Message: "all text in " + strings.Join(all, ",")}
+	}
+	return readinessItem{Check: "translation", Status: readyWarn, Message: fmt.Sprintf("%d texts not in every language (%s)", len(problems), strings.Join(all, ",")), Details: problems}
+}
+
+// issuesItem fails on any error issue and warns on any warning
+func issuesItem(check, passMsg, warnMsg, failMsg string, issues []data.DistrictIssue) readinessItem {
+	var errs, warns []string
+	for _, issue := range issues {
+		if issue.Severity == data.IssueError {
+			errs = append(errs, issue.String())
+		} else {
+			warns = append(warns, issue.String())
+		}
+	}
+	if len(errs) != 0 {
+		return readinessItem{Check: check, Status: readyFail, Message: failMsg, Details: append(errs, warns...)}
+	}
+	if len(warns) != 0 {
+		return readinessItem{Check: check, Status: readyWarn, Message: warnMsg, Details: warns}
+	}
+	return readinessItem{Check: check, Status: readyPass, Message: passMsg}
+}
+
+// checkMeasureText checks printed measure text against the election's word and type size rules
+func checkMeasureText(doc map[string]interface{}) readinessItem {
+	return issuesItem("measure-text", "measure text within the rules", "measure text warnings", "measure text breaks the election's rules", data.CheckMeasureText(doc))
+}
+
+// checkRules runs the validation rules, see data.Rules
+func checkRules(doc map[string]interface{}) readinessItem {
+	var issues []data.DistrictIssue
+	for _, ri := range data.Validate(doc) {
+		ri.Message = ri.Rule + ": " + ri.Message
+		issues = append(issues, ri.DistrictIssue)
+	}
+	return issuesItem("rules", "no validation rule problems", "validation rule warnings", "validation rule errors", issues)
+}
+
+// checkStyles checks that contests are on ballot styles and districts make sense
+func checkStyles(doc map[string]interface{}) readinessItem {
+	var errs, warns []string
+	for _, issue := range append(data.CheckDistricts(doc), data.CheckStraightParty(doc)...) {
+		if issue.Severity == data.IssueError {
+			errs = append(errs, issue.String())
+		} else {
+			warns = append(warns, issue.String())
+		}
+	}
+	onStyle := make(map[string]bool)
+	nstyles := 0
+	for _, el := range mapList(doc["Election"]) {
+		for _, bs := range mapList(el["BallotStyle"]) {
+			nstyles++
+			for _, oc := range mapList(bs["OrderedContent"]) {
+				cid, _ := oc["ContestId"].(string)
+				onStyle[cid] = true
+			}
+		}
+	}
+	if nstyles == 0 {
+		errs = append(errs, "no ballot styles")
+	}
+	_, order := docContests(doc)
+	for _, cid := range order {
+		if !onStyle[cid] {
+			errs = append(errs, fmt.Sprintf("contest %s is on no ballot style", cid))
+		}
+	}
+	if len(errs) != 0 {
+		return readinessItem{Check: "styles", Status: readyFail, Message: "contests can't all be placed on ballots", Details: append(errs, warns...)}
+	}
+	if len(warns) != 0 {
+		return readinessItem{Check: "styles", Status: readyWarn, Message: "district or style warnings", Details: warns}
+	}
+	return readinessItem{Check: "styles", Status: readyPass, Message: fmt.Sprintf("%d ballot styles cover every contest", nstyles)}
+}
+
+func checkSignoff(state string) readinessItem {
+	if state == StateApproved || state == StatePublished || state == StateLocked {
+		return readinessItem{Check: "signoff", Status: readyPass, Message: "approved"}
+	}
+	return readinessItem{Check: "signoff", Status: readyFail, Message: fmt.Sprintf("election is %s, needs approval", state)}
+}
+
+// canonical json so that key order and whitespace don't count as differences
+func sameJSON(a, b []byte) bool {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return false
+	}
+	ac, _ := json.Marshal(av)
+	bc, _ := json.Marshal(bv)
+	return bytes.Equal(ac, bc)
+}
+
+// electionReadiness builds the report. If rerender, the ballot is drawn again and compared to the current render.
+func (sh *StudioHandler) electionReadiness(ctx context.Context, electionid int64, rerender bool) (*readinessReport, error) {
+	er, err := sh.edb.GetElection(electionid)
+	if err != nil {
+		return nil, &httpError{404, "no item", err}
+	}
+	state, err := sh.edb.GetElectionState(electionid)
+	if err != nil {
+		return nil, &httpError{500, "db state", err}
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if err != nil {
+		return nil, &httpError{500, "bad election json", err}
+	}
+	rr := &readinessReport{ElectionId: electionid, State: state, Status: readyPass}
+	rr.add(checkValidation(doc))
+	rr.add(checkRules(doc))
+
+	el := strconv.FormatInt(electionid, 10)
+	var current *draw.DrawBothOb
+	var renderItem readinessItem
+	if rerender {
+		current, err = sh.getPdf(ctx, el, draw.RenderOptions{}, false)
+		if err == nil {
+			defer current.Release()
+			var again *draw.DrawBothOb
+			again, err = sh.drawClient.DrawElection(ctx, er.Data, draw.RenderOptions{})
+			if err == nil {
+				again.Release()
+			}
+			if err == nil && sameJSON(current.BubblesJson, again.BubblesJson) {
+				renderItem = readinessItem{Check: "render", Status: readyPass, Message: "a second render has the same layout"}
+			} else if err == nil {
+				renderItem = readinessItem{Check: "render", Status: readyFail, Message: "a second render has a different layout"}
+			}
+		}
+		if err != nil {
+			renderItem = readinessItem{Check: "render", Status: readyFail, Message: fmt.Sprintf("render failed, %v", err)}
+		}
+	} else {
+		current, _ = sh.cache.Get(renderKey(el, er.Data, draw.RenderOptions{})).(*draw.DrawBothOb)
+		renderItem = readinessItem{Check: "render", Status: readyWarn, Message: "not checked, use ?render=1"}
+	}
+	var bubblesJSON []byte
+	if current != nil {
+		bubblesJSON = current.BubblesJson
+	}
+	rr.add(checkLayout(doc, bubblesJSON))
+	rr.add(checkTranslations(doc))
+	rr.add(sh.checkFonts(doc))
+	rr.add(checkMeasureText(doc))
+	rr.add(checkStyles(doc))
+	rr.add(checkSignoff(state))
+	rr.add(renderItem)
+	return rr, nil
+}
+
+// GET /election/{id}/readiness[?render=1]
+func (sh *StudioHandler) handleElectionReadiness(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	rerender := qbool(r.URL.Query().Get("render"))
+	if rerender && rateLimited(w, r, sh.renderLimit, user) {
+		return
+	}
+	rr, err := sh.electionReadiness(r.Context(), electionid, rerender)
+	if err != nil {
+		he := err.(*httpError)
+		maybeerr(w, he.err, he.code, he.msg)
+		return
+	}
+	out, err := json.Marshal(rr)
+	if maybeerr(w, err, 500, "json ret prep") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(out)
+}
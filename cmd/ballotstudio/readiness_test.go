@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianolson/login/login"
+)
+
+const readinessTestDoc = `{
+  "GpUnit": [
+    {"@id": "gpunit1", "@type": "ElectionResults.ReportingUnit", "Type": "city", "ComposingGpUnitIds": ["gpunit2"]},
+    {"@id": "gpunit2", "@type": "ElectionResults.ReportingUnit", "Type": "precinct"}
+  ],
+  "Election": [{
+    "Candidate": [{"@id": "ecand1"}],
+    "Contest": [
+      {"@id": "ccont1", "ElectionDistrictId": "gpunit1",
+       "BallotTitle": {"Text": [{"Language": "en", "Content": "Mayor"}, {"Language": "es", "Content": "Alcalde"}]},
+       "ContestSelection": [{"@id": "csel1", "CandidateIds": ["ecand1"]}, {"@id": "csel2", "CandidateIds": ["ecand9"]}]},
+      {"@id": "ccont2", "ElectionDistrictId": "gpunit1",
+       "BallotTitle": {"Text": [{"Language": "en", "Content": "Dogcatcher"}]},
+       "ContestSelection": [{"@id": "csel3"}]}
+    ],
+    "BallotStyle": [{"GpUnitIds": ["gpunit2"], "OrderedContent": [{"ContestId": "ccont1"}]}]
+  }]
+}`
+
+func TestReadinessChecks(t *testing.T) {
+	var doc map[string]interface{}
+	err := json.Unmarshal([]byte(readinessTestDoc), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := checkValidation(doc)
+	if item.Status != readyFail || len(item.Details) != 1 {
+		t.Errorf("validation wanted 1 unknown candidate, got %#v", item)
+	}
+	item = checkTranslations(doc)
+	if item.Status != readyWarn || len(item.Details) != 1 || item.Details[0] != "Election[0].Contest[1].BallotTitle missing es" {
+		t.Errorf("translation got %#v", item)
+	}
+	item = checkRules(doc)
+	if item.Status != readyPass {
+		t.Errorf("rules got %#v", item)
+	}
+	item = checkStyles(doc)
+	if item.Status != readyFail || item.Details[0] != "contest ccont2 is on no ballot style" {
+		t.Errorf("styles got %#v", item)
+	}
+	item = checkLayout(doc, nil)
+	if item.Status != readyWarn {
+		t.Errorf("layout without render got %#v", item)
+	}
+	item = checkLayout(doc, []byte(`{"bubbles": [{"ccont1": {"csel1": [1, 2, 3, 4]}}]}`))
+	if item.Status != readyFail || len(item.Details) != 1 {
+		t.Errorf("layout wanted missing csel2, got %#v", item)
+	}
+	item = checkLayout(doc, []byte(`{"bubbles": [{"ccont1": {"csel1": [1, 2, 3, 4], "csel2": [1, 9, 3, 4]}}]}`))
+	if item.Status != readyPass {
+		t.Errorf("layout got %#v", item)
+	}
+	if checkSignoff(StateProofing).Status != readyFail || checkSignoff(StateApproved).Status != readyPass {
+		t.Errorf("signoff wrong")
+	}
+
+	rr := readinessReport{Status: readyPass}
+	rr.add(readinessItem{Status: readyWarn})
+	rr.add(readinessItem{Status: readyPass})
+	if rr.Status != readyWarn {
+		t.Errorf("report status %s", rr.Status)
+	}
+}
+
+func TestSameJSON(t *testing.T) {
+	if !sameJSON([]byte(`{"a": 1, "b": [2]}`), []byte(`{"b":[2],"a":1}`)) {
+		t.Errorf("same json not same")
+	}
+	if sameJSON([]byte(`{"a": 1}`), []byte(`{"a": 2}`)) {
+		t.Errorf("different json same")
+	}
+}
+
+func TestDocPostIssues(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb}
+	doc := `{"Election": [{"Contest": [
+  {"@id": "ccont1", "@type": "ElectionResults.CandidateContest", "VotesAllowed": 2, "ContestSelection": [{"@id": "csel1", "CandidateIds": ["c1"]}]},
+  {"@id": "ccont2", "@type": "ElectionResults.CandidateContest", "ContestSelection": []}
+]}]}`
+	rec := httptest.NewRecorder()
+	sh.handleElectionDocPOSTJson(rec, httptest.NewRequest("POST", "/election", nil), &login.User{Guid: 7}, 0, []byte(doc), editContextFinish)
+	if rec.Code != 200 {
+		t.Fatalf("save %d %s", rec.Code, rec.Body.String())
+	}
+	var ec EditContext
+	err := json.Unmarshal(rec.Body.Bytes(), &ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ec.ElectionId == 0 || len(ec.Errors) != 1 || ec.Errors[0].Id != "ccont2" || len(ec.Warnings) != 1 || ec.Warnings[0].Rule != "votes-allowed" {
+		t.Errorf("saved with %#v", ec)
+	}
+}
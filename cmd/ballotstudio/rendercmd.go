@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+// `ballotstudio render -in election.json -out ballot.pdf -bubbles bubbles.json`
+// draws an election document without the server or a database, through
+// the same -draw-backend (or -flask, or in process drawing) the server
+// would use. -options takes render options as the PDF URL's query does,
+// "pagesize=a4&duplex=1" or "profile=mail". Candidate photos and party
+// logos uploaded to a server are drawn if its -im-archive-dir is given.
+
+func runRenderCommand(ctx context.Context, dc *draw.Client, media MediaStore, in, out, bubbles, options string) error {
+	if in == "" || out == "" {
+		return fmt.Errorf("render needs -in and -out")
+	}
+	query, err := url.ParseQuery(options)
+	if err != nil {
+		return fmt.Errorf("-options, %v", err)
+	}
+	opts, err := draw.ParseRenderOptions(query)
+	if err != nil {
+		return fmt.Errorf("-options, %v", err)
+	}
+	var doc []byte
+	if in == "-" {
+		doc, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		doc, err = ioutil.ReadFile(in)
+	}
+	if err != nil {
+		return err
+	}
+	electionjson, err := inlineMedia(media, string(doc))
+	if err != nil {
+		return fmt.Errorf("%s: bad election json, %v", in, err)
+	}
+	bothob, err := dc.DrawElection(ctx, electionjson, opts)
+	if err != nil {
+		return err
+	}
+	defer bothob.Release()
+	for _, warning := range bothob.Warnings {
+		log.Printf("%s: %s", in, warning)
+	}
+	err = writeRenderFile(out, func(w io.Writer) error {
+		pdf, err := bothob.OpenPdf()
+		if err != nil {
+			return err
+		}
+		defer pdf.Close()
+		_, err = io.Copy(w, pdf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if bubbles == "" {
+		return nil
+	}
+	return writeRenderFile(bubbles, func(w io.Writer) error {
+		_, err := w.Write(bothob.BubblesJson)
+		return err
+	})
+}
+
+// writeRenderFile writes fname, or stdout for "-"
+func writeRenderFile(fname string, write func(io.Writer) error) error {
+	if fname == "-" {
+		return write(os.Stdout)
+	}
+	fout, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	err = write(fout)
+	if err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+func TestRenderCommand(t *testing.T) {
+	var query string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/capabilities" {
+			w.Write([]byte(`{"features": ["` + draw.FeatureRenderOptions + `"]}`))
+			return
+		}
+		query = r.URL.RawQuery
+		w.Write([]byte(`{"bubbles": {"b": 1}, "pdfb64": "JVBERg=="}`))
+	}))
+	defer backend.Close()
+	dir := t.TempDir()
+	in := filepath.Join(dir, "election.json")
+	err := ioutil.WriteFile(in, []byte(`{"Election": []}`), 0644)
+	mtfail(t, err, "write election, %v", err)
+	out := filepath.Join(dir, "ballot.pdf")
+	bubbles := filepath.Join(dir, "bubbles.json")
+	dc := &draw.Client{BackendUrl: backend.URL}
+
+	err = runRenderCommand(context.Background(), dc, nil, in, out, bubbles, "pagesize=a4")
+	mtfail(t, err, "render, %v", err)
+	pdf, _ := ioutil.ReadFile(out)
+	bj, _ := ioutil.ReadFile(bubbles)
+	if string(pdf) != "%PDF" || string(bj) != `{"b":1}` {
+		t.Errorf("wrote pdf %q bubbles %q", pdf, bj)
+	}
+	q, _ := url.ParseQuery(query)
+	if q.Get("pagesize") != "a4" || q.Get("both") != "1" {
+		t.Errorf("drew with %q", query)
+	}
+
+	if err = runRenderCommand(context.Background(), dc, nil, in, out, "", "pagesize=tabloid"); err == nil {
+		t.Errorf("bad -options drawn")
+	}
+	if err = runRenderCommand(context.Background(), dc, nil, filepath.Join(dir, "none.json"), out, "", ""); err == nil {
+		t.Errorf("missing -in drawn")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Renders of the same thing at the same time share one draw: when several
+// previews of an uncached PDF arrive together, the first draws it and the
+// rest wait for its result instead of each calling the draw backend.
+// Renders that fail on the document are kept in the cache for
+// -render-failure-ttl, so an editor polling a broken document's preview
+// gets the error back without it being drawn every time. The cache key
+// has the document's hash (see renderKey), so saving a fix draws at once.
+
+var errRenderPanic = errors.New("render panicked")
+
+// renderFlights is the draws running, by cache key
+type renderFlights struct {
+	l sync.Mutex
+	m map[string]*renderFlight
+}
+
+type renderFlight struct {
+	done     chan struct{}
+	v        interface{}
+	err      error
+	canceled bool // the request drawing it went away
+}
+
+// do returns fn's result for key, waiting on the call already running for
+// key if there is one. fn runs under the context of the request that
+// started it; if that request is canceled while ctx isn't, fn is run again
+// for this one.
+func (rf *renderFlights) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	for {
+		rf.l.Lock()
+		f := rf.m[key]
+		if f == nil {
+			f = &renderFlight{done: make(chan struct{}), err: errRenderPanic}
+			if rf.m == nil {
+				rf.m = make(map[string]*renderFlight)
+			}
+			rf.m[key] = f
+			rf.l.Unlock()
+			defer func() {
+				rf.l.Lock()
+				delete(rf.m, key)
+				rf.l.Unlock()
+				close(f.done)
+			}()
+			f.v, f.err = fn(ctx)
+			f.canceled = ctx.Err() != nil
+			return f.v, f.err
+		}
+		rf.l.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, canceled(ctx, ctx.Err())
+		}
+		if f.canceled && ctx.Err() == nil {
+			continue
+		}
+		return f.v, f.err
+	}
+}
+
+// drawnRender is a render from a flight, which may be the last good render
+// kept for when the draw backend is down (see stalerender.go)
+type drawnRender struct {
+	render interface{}
+	stale  bool
+}
+
+// renderFailed is a render's error, kept in the cache until expires
+type renderFailed struct {
+	err     *httpError
+	expires time.Time
+}
+
+// cachedFailure is key's cached error, nil if there isn't one or it expired
+func (sh *StudioHandler) cachedFailure(key string) *httpError {
+	rf, ok := sh.cache.Get(key).(*renderFailed)
+	if !ok || time.Now().After(rf.expires) {
+		return nil
+	}
+	return rf.err
+}
+
+// rememberFailure caches he as key's render for -render-failure-ttl
+func (sh *StudioHandler) rememberFailure(key string, he *httpError) *httpError {
+	if sh.renderFailureTTL > 0 {
+		sh.cache.Put(key, &renderFailed{he, time.Now().Add(sh.renderFailureTTL)}, 100+len(he.msg))
+	}
+	return he
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+func TestRenderFlights(t *testing.T) {
+	var rf renderFlights
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := rf.do(context.Background(), "k", func(ctx context.Context) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "drawn", nil
+			})
+			if v != "drawn" || err != nil {
+				t.Errorf("got %v %v", v, err)
+			}
+		}()
+	}
+	// let them all arrive before the draw finishes
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("%d draws, wanted 1", calls)
+	}
+
+	// a waiter outlives the request drawing, and draws for itself
+	leader, cf := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go rf.do(leader, "k", func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, canceled(ctx, ctx.Err())
+	})
+	<-started
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cf()
+	}()
+	v, err := rf.do(context.Background(), "k", func(ctx context.Context) (interface{}, error) {
+		return "mine", nil
+	})
+	if v != "mine" || err != nil {
+		t.Errorf("after leader canceled got %v %v", v, err)
+	}
+}
+
+func TestRenderStampede(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	var draws int32
+	broken := int32(0)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/draw" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&draws, 1)
+		time.Sleep(20 * time.Millisecond)
+		if atomic.LoadInt32(&broken) != 0 {
+			http.Error(w, "bad document", 400)
+			return
+		}
+		w.Write([]byte(`{"bubbles": {}, "pdfb64": "JVBERg=="}`))
+	}))
+	defer backend.Close()
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{BackendUrl: backend.URL}, renderFailureTTL: time.Minute}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: `{"Election": []}`})
+	mtfail(t, err, "put election, %v", err)
+	el := strconv.FormatInt(eid, 10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bothob, err := sh.getPdf(context.Background(), el, draw.RenderOptions{}, false)
+			if err != nil || string(bothob.Pdf) != "%PDF" {
+				t.Errorf("getPdf %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if draws != 1 {
+		t.Errorf("%d draws for 5 requests", draws)
+	}
+
+	// a failure is cached for its document
+	atomic.StoreInt32(&broken, 1)
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: `{"Election": [{}]}`})
+	mtfail(t, err, "put election, %v", err)
+	for i := 0; i < 3; i++ {
+		_, err = sh.getPdf(context.Background(), el, draw.RenderOptions{}, false)
+		if err == nil || err.(*httpError).code != 500 {
+			t.Errorf("broken got %v", err)
+		}
+	}
+	if draws != 2 {
+		t.Errorf("%d draws, broken document drawn again", draws)
+	}
+	// but not for a fixed one
+	atomic.StoreInt32(&broken, 0)
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: `{"Election": [{}, {}]}`})
+	mtfail(t, err, "put election, %v", err)
+	_, err = sh.getPdf(context.Background(), el, draw.RenderOptions{}, false)
+	if err != nil || draws != 3 {
+		t.Errorf("fixed got %v after %d draws", err, draws)
+	}
+}
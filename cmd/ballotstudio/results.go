@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/login/login"
+)
+
+// Public unofficial results, tallied from stored scans.
+// Off unless the election owner turns them on; meant for test decks and demos.
+
+// how long a tally is reused before re-counting the scans, also the page refresh interval
+const resultsRefreshSeconds = 15
+
+// how long results.json?since= waits for a new version before answering 304
+const resultsLongPollSeconds = 60
+
+// electionMeta is electionRecord.Meta
+type electionMeta struct {
+	PublicResults bool `json:"public_results,omitempty"`
+	// Template lets anyone make a copy with POST /election?template={id}
+	Template bool `json:"template,omitempty"`
+	// Prerender draws the ballot after each save, see prerender.go
+	Prerender bool `json:"prerender,omitempty"`
+}
+
+func parseElectionMeta(meta string) (em electionMeta) {
+	if meta != "" {
+		json.Unmarshal([]byte(meta), &em)
+	}
+	return
+}
+
+func (em electionMeta) String() string {
+	b, _ := json.Marshal(em)
+	return string(b)
+}
+
+type selectionTally struct {
+	SelectionId string `json:"id"`
+	Name        string `json:"name"`
+	Votes       int    `json:"votes"`
+}
+
+type contestTally struct {
+	ContestId  string           `json:"id"`
+	Name       string           `json:"name"`
+	Ballots    int              `json:"ballots"`
+	Overvotes  int              `json:"overvotes"`
+	Undervotes int              `json:"undervotes"`
+	Selections []selectionTally `json:"selections"`
+
+	// with ?provenance=1, the scans that voted for each selection id, and that overvoted
+	SelectionScans map[string][]int64 `json:"selection_scans,omitempty"`
+	OvervoteScans  []int64            `json:"overvote_scans,omitempty"`
+}
+
+// where a counted scan's marks came from
+type scanProvenance struct {
+	ScanId       int64  `json:"id"`
+	Interpreter  string `json:"interpreter"` // scan.InterpreterVersion that read the marks
+	Created      int64  `json:"created"`     // upload time, unix seconds
+	ResultSha256 string `json:"result_sha256"`
+}
+
+type resultsTally struct {
+	ElectionId int64          `json:"itemid"`
+	Unofficial bool           `json:"unofficial"`
+	Ballots    int            `json:"ballots"`
+	Contests   []contestTally `json:"contests"`
+	Updated    time.Time      `json:"updated"`
+
+	// Version changes when the document or any counted scan does, for ?since=
+	Version string `json:"version"`
+	// Interpreters counts scans by the interpreter version that read them
+	Interpreters map[string]int `json:"interpreters"`
+	// Scans that were counted, with ?provenance=1
+	Scans []scanProvenance `json:"scans,omitempty"`
+
+	RefreshSeconds int    `json:"-"`
+	JSONURL        string `json:"-"`
+}
+
+func docString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case map[string]interface{}:
+		// InternationalizedText, take the first
+		for _, t := range mapList(x["Text"]) {
+			if s, ok := t["Content"].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// tallyResults counts scan results (contest id -> selection id -> marked) against the election document.
+// A contest with more marks than VotesAllowed is an overvote and counts for nobody.
+func tallyResults(doc map[string]interface{}, results []map[string]map[string]bool) (out resultsTally) {
+	return tallyScans(doc, results, nil)
+}
+
+// tallyScans is tallyResults, noting which of scanids (one per result) went into each total if it isn't nil
+func tallyScans(doc map[string]interface{}, results []map[string]map[string]bool, scanids []int64) (out resultsTally) {
+	out.Unofficial = true
+	out.Ballots = len(results)
+	// straight-party and cross-endorsed marks as the votes they make
+	votes := make([]map[string]map[string]bool, len(results))
+	for ri, result := range results {
+		votes[ri] = data.EffectiveMarks(doc, result)
+	}
+	partyNames := make(map[string]string)
+	for _, party := range mapList(doc["Party"]) {
+		id, _ := party["@id"].(string)
+		partyNames[id] = docString(party["Name"])
+	}
+	for _, el := range mapList(doc["Election"]) {
+		for _, party := range mapList(el["Party"]) {
+			id, _ := party["@id"].(string)
+			partyNames[id] = docString(party["Name"])
+		}
+		candidateNames := make(map[string]string)
+		for _, cand := range mapList(el["Candidate"]) {
+			id, _ := cand["@id"].(string)
+			candidateNames[id] = docString(cand["BallotName"])
+		}
+		for _, co := range mapList(el["Contest"]) {
+			ct := contestTally{}
+			ct.ContestId, _ = co["@id"].(string)
+			ct.Name = docString(co["BallotTitle"])
+			if ct.Name == "" {
+				ct.Name = docString(co["Name"])
+			}
+			votesAllowed := 1
+			if va, ok := co["VotesAllowed"].(float64); ok && va >= 1 {
+				votesAllowed = int(va)
+			}
+			index := make(map[string]int)
+			for _, sel := range mapList(co["ContestSelection"]) {
+				st := selectionTally{}
+				st.SelectionId, _ = sel["@id"].(string)
+				if wi, _ := sel["IsWriteIn"].(bool); wi {
+					st.Name = "write-in"
+				} else if s := docString(sel["Selection"]); s != "" {
+					st.Name = s
+				} else if pids, ok := sel["PartyIds"].([]interface{}); ok {
+					var names []string
+					for _, x := range pids {
+						pid, _ := x.(string)
+						names = append(names, partyNames[pid])
+					}
+					st.Name = strings.Join(names, " / ")
+				} else {
+					var names []string
+					ids, _ := sel["CandidateIds"].([]interface{})
+					for _, x := range ids {
+						candid, _ := x.(string)
+						names = append(names, candidateNames[candid])
+					}
+					st.Name = strings.Join(names, " / ")
+				}
+				index[st.SelectionId] = len(ct.Selections)
+				ct.Selections = append(ct.Selections, st)
+			}
+			for ri, result := range votes {
+				marks, ok := result[ct.ContestId]
+				if !ok {
+					// not on this ballot
+					continue
+				}
+				ct.Ballots++
+				var marked []string
+				for sid, m := range marks {
+					if m {
+						marked = append(marked, sid)
+					}
+				}
+				if len(marked) > votesAllowed {
+					ct.Overvotes++
+					if scanids != nil {
+						ct.OvervoteScans = append(ct.OvervoteScans, scanids[ri])
+					}
+					continue
+				}
+				ct.Undervotes += votesAllowed - len(marked)
+				for _, sid := range marked {
+					if i, ok := index[sid]; ok {
+						ct.Selections[i].Votes++
+						if scanids != nil {
+							if ct.SelectionScans == nil {
+								ct.SelectionScans = make(map[string][]int64)
+							}
+							ct.SelectionScans[sid] = append(ct.SelectionScans[sid], scanids[ri])
+						}
+					}
+				}
+			}
+			out.Contests = append(out.Contests, ct)
+		}
+	}
+	return
+}
+
+// cached for resultsRefreshSeconds so page refreshes from many observers count the scans once
+func (sh *StudioHandler) getResults(electionid int64) (*resultsTally, error) {
+	key := fmt.Sprintf("%d_results", electionid)
+	if cr, ok := sh.cache.Get(key).(*resultsTally); ok && time.Since(cr.Updated) < resultsRefreshSeconds*time.Second {
+		return cr, nil
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if err != nil {
+		return nil, &httpError{404, "no item", err}
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if err != nil {
+		return nil, &httpError{500, "bad election json", err}
+	}
+	ids, err := sh.edb.ScansForElection(electionid)
+	if err != nil {
+		return nil, &httpError{500, "db scans", err}
+	}
+	results := make([]map[string]map[string]bool, 0, len(ids))
+	counted := make([]int64, 0, len(ids))
+	var provenance []scanProvenance
+	interpreters := make(map[string]int)
+	version := sha256.New()
+	version.Write([]byte(er.Data))
+	for _, id := range ids {
+		sr, err := sh.edb.GetScan(id)
+		if err != nil {
+			return nil, &httpError{500, "db scan", err}
+		}
+		var result map[string]map[string]bool
+		if json.Unmarshal([]byte(sr.Result), &result) == nil {
+			results = append(results, result)
+			counted = append(counted, id)
+			sp := scanProvenance{ScanId: id, Interpreter: sr.Interpreter, Created: sr.Created, ResultSha256: sha256Hex([]byte(sr.Result))}
+			provenance = append(provenance, sp)
+			interpreters[sr.Interpreter]++
+			fmt.Fprintf(version, "\n%d %s %s", id, sr.Interpreter, sp.ResultSha256)
+		}
+	}
+	tally := tallyScans(doc, results, counted)
+	tally.ElectionId = electionid
+	tally.Updated = time.Now()
+	tally.Version = hex.EncodeToString(version.Sum(nil)[:12])
+	tally.Interpreters = interpreters
+	tally.Scans = provenance
+	tally.RefreshSeconds = resultsRefreshSeconds
+	sh.cache.Put(key, &tally, 1000+200*len(tally.Contests)+100*len(counted))
+	return &tally, nil
+}
+
+// withoutProvenance is the tally without which scans went into it
+func (rt resultsTally) withoutProvenance() resultsTally {
+	rt.Scans = nil
+	contests := make([]contestTally, len(rt.Contests))
+	for i, ct := range rt.Contests {
+		ct.SelectionScans = nil
+		ct.OvervoteScans = nil
+		contests[i] = ct
+	}
+	rt.Contests = contests
+	return rt
+}
+
+// waitForResults returns the tally once its version isn't since, or nil
+// after resultsLongPollSeconds or when the client goes away
+func (sh *StudioHandler) waitForResults(ctx context.Context, electionid int64, since string) (*resultsTally, error) {
+	deadline := time.NewTimer(resultsLongPollSeconds * time.Second)
+	defer deadline.Stop()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		tally, err := sh.getResults(electionid)
+		if err != nil || tally.Version != since {
+			return tally, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-deadline.C:
+			return nil, nil
+		case <-tick.C:
+		}
+	}
+}
+
+// GET /election/{id}/results[.json]
+// results.json?provenance=1 adds which scans went into each total.
+// results.json?since={version} waits for a tally with a different version, or answers 304.
+// POST /election/{id}/results with body true|false turns the public page on or off, owner only
+func (sh *StudioHandler) handleElectionResults(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64, asJSON bool) {
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	meta := parseElectionMeta(er.Meta)
+	if r.Method == "POST" {
+		if user == nil {
+			texterr(w, http.StatusUnauthorized, "nope")
+			return
+		}
+		if er.Owner != user.Guid {
+			texterr(w, http.StatusForbidden, "nope")
+			return
+		}
+		if sh.checkElectionState(w, electionid, actionSettings) {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		meta.PublicResults = qbool(strings.TrimSpace(string(body)))
+		er.Meta = meta.String()
+		err = sh.edb.SetElectionMeta(electionid, er.Meta)
+		if maybeerr(w, err, 500, "db put fail") {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(er.Meta))
+		return
+	}
+	if !meta.PublicResults {
+		texterr(w, 404, "no public results for this election")
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	query := r.URL.Query()
+	var tally *resultsTally
+	if since := query.Get("since"); since != "" && asJSON {
+		tally, err = sh.waitForResults(r.Context(), electionid, since)
+	} else {
+		tally, err = sh.getResults(electionid)
+	}
+	if err != nil {
+		he := err.(*httpError)
+		maybeerr(w, he.err, he.code, he.msg)
+		return
+	}
+	if tally == nil {
+		// still the version they have, ask again
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// let a caching proxy in front absorb the refreshes too
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(resultsRefreshSeconds))
+	if asJSON {
+		rt := *tally
+		if !qbool(query.Get("provenance")) {
+			rt = tally.withoutProvenance()
+		}
+		out, err := json.Marshal(rt)
+		if maybeerr(w, err, 500, "json ret prep") {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(out)
+		return
+	}
+	rt, err := sh.templates.Lookup("results.html")
+	if maybeerr(w, err, 500, "results.html: %v", err) {
+		return
+	}
+	page := *tally
+	page.JSONURL = sitePath(r, "/election/"+electionRef(r, page.ElectionId)+"/results.json")
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(200)
+	rt.Execute(w, &page)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const resultsTestDoc = `{"Election": [{
+  "Candidate": [{"@id": "ecand1", "BallotName": "Alice"}, {"@id": "ecand2", "BallotName": "Bob"}],
+  "Contest": [
+    {"@id": "ccont1", "BallotTitle": "Mayor", "VotesAllowed": 1, "ContestSelection": [
+      {"@id": "csel1", "CandidateIds": ["ecand1"]}, {"@id": "csel2", "CandidateIds": ["ecand2"]}, {"@id": "csel3", "IsWriteIn": true}]},
+    {"@id": "bmcont1", "Name": "Measure 1", "ContestSelection": [
+      {"@id": "bmsel1", "Selection": "Yes"}, {"@id": "bmsel2", "Selection": "No"}]}
+  ]
+}]}`
+
+func TestTallyResults(t *testing.T) {
+	var doc map[string]interface{}
+	err := json.Unmarshal([]byte(resultsTestDoc), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []map[string]map[string]bool{
+		{"ccont1": {"csel1": true, "csel2": false}, "bmcont1": {"bmsel1": true}},
+		{"ccont1": {"csel1": true}, "bmcont1": {"bmsel1": false, "bmsel2": false}},
+		{"ccont1": {"csel1": true, "csel2": true}},
+	}
+	tally := tallyResults(doc, results)
+	if tally.Ballots != 3 || !tally.Unofficial || len(tally.Contests) != 2 {
+		t.Fatalf("bad tally %#v", tally)
+	}
+	mayor := tally.Contests[0]
+	if mayor.Name != "Mayor" || mayor.Ballots != 3 || mayor.Overvotes != 1 || mayor.Undervotes != 0 {
+		t.Errorf("bad mayor %#v", mayor)
+	}
+	if mayor.Selections[0].Name != "Alice" || mayor.Selections[0].Votes != 2 || mayor.Selections[1].Votes != 0 || mayor.Selections[2].Name != "write-in" {
+		t.Errorf("bad mayor selections %#v", mayor.Selections)
+	}
+	measure := tally.Contests[1]
+	if measure.Ballots != 2 || measure.Undervotes != 1 || measure.Selections[0].Votes != 1 {
+		t.Errorf("bad measure %#v", measure)
+	}
+}
+
+func TestTallyStraightParty(t *testing.T) {
+	var doc map[string]interface{}
+	err := json.Unmarshal([]byte(`{"Party": [{"@id": "party1", "Name": "Red"}], "Election": [{
+  "Candidate": [{"@id": "ecand1", "BallotName": "Alice", "PartyId": "party1"}, {"@id": "ecand2", "BallotName": "Bob"}],
+  "Contest": [
+    {"@id": "pcont1", "@type": "ElectionResults.PartyContest", "ContestSelection": [{"@id": "psel1", "PartyIds": ["party1"]}]},
+    {"@id": "ccont1", "@type": "ElectionResults.CandidateContest", "BallotTitle": "Mayor", "VotesAllowed": 1, "ContestSelection": [
+      {"@id": "csel1", "CandidateIds": ["ecand1"]}, {"@id": "csel2", "CandidateIds": ["ecand2"]}]}
+  ]
+}]}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []map[string]map[string]bool{
+		{"pcont1": {"psel1": true}, "ccont1": {}},
+		{"pcont1": {"psel1": true}, "ccont1": {"csel2": true}},
+	}
+	tally := tallyResults(doc, results)
+	party, mayor := tally.Contests[0], tally.Contests[1]
+	if party.Selections[0].Name != "Red" || party.Selections[0].Votes != 2 {
+		t.Errorf("bad straight party %#v", party)
+	}
+	if mayor.Selections[0].Votes != 1 || mayor.Selections[1].Votes != 1 || mayor.Undervotes != 0 {
+		t.Errorf("bad mayor %#v", mayor)
+	}
+}
+
+func TestElectionMeta(t *testing.T) {
+	em := parseElectionMeta("")
+	if em.PublicResults {
+		t.Errorf("empty meta has public results")
+	}
+	em.PublicResults = true
+	if !parseElectionMeta(em.String()).PublicResults {
+		t.Errorf("meta round trip lost public results")
+	}
+}
+
+func TestResultsProvenance(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: resultsTestDoc, Meta: electionMeta{PublicResults: true}.String()})
+	mtfail(t, err, "put election, %v", err)
+	var scanids []int64
+	for _, result := range []string{`{"ccont1": {"csel1": true}}`, `{"ccont1": {"csel1": true, "csel2": true}}`, `not json`} {
+		sid, err := edb.PutScan(scanRecord{ElectionId: eid, Interpreter: "test-1", Result: result, Created: 1700000000})
+		mtfail(t, err, "put scan, %v", err)
+		scanids = append(scanids, sid)
+	}
+
+	get := func(ctx context.Context, query string) (int, resultsTally) {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/election/1/results.json"+query, nil).WithContext(ctx)
+		sh.handleElectionResults(rec, r, nil, eid, true)
+		var rt resultsTally
+		json.Unmarshal(rec.Body.Bytes(), &rt)
+		return rec.Code, rt
+	}
+	code, rt := get(context.Background(), "")
+	if code != 200 || rt.Version == "" || rt.Interpreters["test-1"] != 2 || rt.Scans != nil || rt.Contests[0].SelectionScans != nil {
+		t.Fatalf("plain results %d %#v", code, rt)
+	}
+	code, rt = get(context.Background(), "?provenance=1")
+	if code != 200 || len(rt.Scans) != 2 || rt.Scans[0].ScanId != scanids[0] || rt.Scans[0].ResultSha256 != sha256Hex([]byte(`{"ccont1": {"csel1": true}}`)) {
+		t.Fatalf("provenance scans %d %#v", code, rt.Scans)
+	}
+	mayor := rt.Contests[0]
+	if len(mayor.SelectionScans["csel1"]) != 1 || mayor.SelectionScans["csel1"][0] != scanids[0] || len(mayor.OvervoteScans) != 1 || mayor.OvervoteScans[0] != scanids[1] {
+		t.Errorf("mayor provenance %#v", mayor)
+	}
+	// the cached tally keeps its provenance
+	if cached, _ := sh.getResults(eid); len(cached.Contests[0].SelectionScans["csel1"]) != 1 {
+		t.Errorf("withoutProvenance changed the cached tally")
+	}
+
+	if code, other := get(context.Background(), "?since=old"); code != 200 || other.Version != rt.Version {
+		t.Errorf("since old version %d %q", code, other.Version)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if code, _ = get(ctx, "?since="+rt.Version); code != http.StatusNotModified {
+		t.Errorf("since current version got %d", code)
+	}
+}
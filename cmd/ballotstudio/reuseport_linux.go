@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package main
+
+// the frozen syscall package lacks SO_REUSEPORT for most linux architectures
+const soReusePort = 0xf
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	a, err := listen("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := listen(a.Addr().String(), true)
+	if err != nil {
+		t.Fatalf("second listener on %s, %v", a.Addr(), err)
+	}
+	b.Close()
+}
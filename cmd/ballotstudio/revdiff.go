@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+// GET /election/{id}/revisions lists the saved versions of a document.
+//
+// GET /election/{id}/diff?from=r1&to=r2 renders both revisions and reports
+// which contests and candidates were added, removed or changed, and how
+// many pixels changed on each page. to defaults to the latest revision and
+// from to the one before it. With &page=N (from 0, as in /election/{id}.N.png)
+// it returns that page as an overlay PNG instead: ink only in `from` red,
+// ink only in `to` green, and what's the same in both faded gray.
+
+// how far apart two gray levels can be and still count as the same
+// pixel, so antialiasing noise isn't a change
+const diffThreshold = 48
+
+type objectChange struct {
+	Id     string   `json:"id"`
+	Name   string   `json:"name,omitempty"`
+	Fields []string `json:"fields,omitempty"` // changed fields, for Changed
+}
+
+type objectDiff struct {
+	Added   []objectChange `json:"added"`
+	Removed []objectChange `json:"removed"`
+	Changed []objectChange `json:"changed"`
+}
+
+type pageDiff struct {
+	Page     int     `json:"page"`
+	Changed  int     `json:"changed"`  // pixels
+	Fraction float64 `json:"fraction"` // of the page
+	Image    string  `json:"image"`    // overlay png url
+}
+
+type revisionDiff struct {
+	ElectionId int64      `json:"itemid"`
+	From       int        `json:"from"`
+	To         int        `json:"to"`
+	Contests   objectDiff `json:"contests"`
+	Candidates objectDiff `json:"candidates"`
+	Pages      []pageDiff `json:"pages"`
+}
+
+// docObjects gathers one kind of object from every Election in doc, by @id
+func docObjects(doc map[string]interface{}, kind string) (byid map[string]map[string]interface{}, order []string) {
+	byid = make(map[string]map[string]interface{})
+	for _, el := range mapList(doc["Election"]) {
+		for _, ob := range mapList(el[kind]) {
+			id, _ := ob["@id"].(string)
+			if _, dup := byid[id]; dup {
+				continue
+			}
+			byid[id] = ob
+			order = append(order, id)
+		}
+	}
+	return
+}
+
+func objectName(ob map[string]interface{}) string {
+	for _, field := range []string{"BallotName", "BallotTitle", "Name"} {
+		if s := docString(ob[field]); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// diffObjects compares the `kind` objects of two documents field by field
+func diffObjects(from, to map[string]interface{}, kind string) (od objectDiff) {
+	fromObs, fromOrder := docObjects(from, kind)
+	toObs, toOrder := docObjects(to, kind)
+	for _, id := range fromOrder {
+		if _, ok := toObs[id]; !ok {
+			od.Removed = append(od.Removed, objectChange{Id: id, Name: objectName(fromObs[id])})
+		}
+	}
+	for _, id := range toOrder {
+		a, ok := fromObs[id]
+		b := toObs[id]
+		if !ok {
+			od.Added = append(od.Added, objectChange{Id: id, Name: objectName(b)})
+			continue
+		}
+		var fields []string
+		for k, v := range b {
+			if !reflect.DeepEqual(a[k], v) {
+				fields = append(fields, k)
+			}
+		}
+		for k := range a {
+			if _, ok := b[k]; !ok {
+				fields = append(fields, k)
+			}
+		}
+		if len(fields) != 0 {
+			sort.Strings(fields)
+			od.Changed = append(od.Changed, objectChange{Id: id, Name: objectName(b), Fields: fields})
+		}
+	}
+	return
+}
+
+func grayAt(img image.Image, x, y int) uint8 {
+	if img == nil || !(image.Point{x, y}.In(img.Bounds())) {
+		return 0xff
+	}
+	return color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+}
+
+// pageOverlay compares two page images, either of which may be missing
+// (nil) when the page count changed. It returns the number of changed
+// pixels and an image marking them.
+func pageOverlay(from, to image.Image) (changed int, overlay *image.RGBA) {
+	var bounds image.Rectangle
+	if from != nil {
+		bounds = from.Bounds()
+	}
+	if to != nil {
+		bounds = bounds.Union(to.Bounds())
+	}
+	overlay = image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			a := int(grayAt(from, x, y))
+			b := int(grayAt(to, x, y))
+			switch {
+			case b < a-diffThreshold:
+				changed++
+				overlay.Set(x, y, color.RGBA{0, 160, 0, 0xff})
+			case a < b-diffThreshold:
+				changed++
+				overlay.Set(x, y, color.RGBA{220, 0, 0, 0xff})
+			default:
+				faded := uint8(0xff - (0xff-b)/3)
+				overlay.Set(x, y, color.RGBA{faded, faded, faded, 0xff})
+			}
+		}
+	}
+	return
+}
+
+// drawRevision draws one revision, cached like any other render.
+// Revisions don't change, so their cache entries never need invalidating.
+// The caller holds the render and must Release it, as with getPdf.
+func (sh *StudioHandler) drawRevision(ctx context.Context, rr *revisionRecord, opts draw.RenderOptions) (*draw.DrawBothOb, error) {
+	// revisions don't change, no need for renderKey's document hash
+	key := optionsKey(fmt.Sprintf("%d@%d", rr.ElectionId, rr.Rev), opts)
+	if bothob, ok := sh.cache.Get(key).(*draw.DrawBothOb); ok && bothob.Hold() {
+		return bothob, nil
+	}
+	doc, err := inlineMedia(sh.media, rr.Data)
+	if err != nil {
+		return nil, &httpError{500, "bad election json", err}
+	}
+	bothob, err := sh.drawClient.DrawElection(ctx, doc, opts)
+	if err != nil {
+		if ue, ok := err.(*draw.UnsupportedError); ok {
+			return nil, &httpError{501, ue.Error(), err}
+		}
+		if draw.IsUnavailable(err) {
+			return nil, &httpError{503, "draw backend unavailable", err}
+		}
+		return nil, &httpError{500, "draw fail", err}
+	}
+	size := int(bothob.PdfSize()) + len(bothob.BubblesJson)
+	for _, page := range bothob.Png {
+		size += len(page)
+	}
+	sh.cache.Put(key, bothob, size)
+	return bothob, nil
+}
+
+// revisionPng is drawRevision's pages as PNG
+func (sh *StudioHandler) revisionPng(ctx context.Context, rr *revisionRecord, opts draw.RenderOptions) (pngbytes [][]byte, err error) {
+	key := optionsKey(fmt.Sprintf("%d@%d.png", rr.ElectionId, rr.Rev), opts)
+	if pngbytes, ok := sh.cache.Get(key).([][]byte); ok {
+		return pngbytes, nil
+	}
+	bothob, err := sh.drawRevision(ctx, rr, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer bothob.Release()
+	pngbytes = bothob.Png
+	if len(pngbytes) == 0 {
+		var pdf []byte
+		pdf, err = bothob.PdfBytes()
+		if err != nil {
+			return nil, &httpError{500, "render spool", err}
+		}
+		pngbytes, err = draw.PdfToPng(ctx, pdf)
+		if err != nil {
+			return nil, pngError(ctx, err)
+		}
+	}
+	size := 0
+	for _, page := range pngbytes {
+		size += len(page)
+	}
+	sh.cache.Put(key, pngbytes, size)
+	return pngbytes, nil
+}
+
+// renderRevision is a revision's pages as images, to compare
+func (sh *StudioHandler) renderRevision(ctx context.Context, rr *revisionRecord) (pages []image.Image, err error) {
+	pngbytes, err := sh.revisionPng(ctx, rr, draw.RenderOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i, page := range pngbytes {
+		img, err := png.Decode(bytes.NewReader(page))
+		if err != nil {
+			return nil, &httpError{500, fmt.Sprintf("rev %d page %d png", rr.Rev, i), err}
+		}
+		pages = append(pages, img)
+	}
+	return pages, nil
+}
+
+// revisionParam is a rev number from the query, or def if it isn't there
+func revisionParam(query url.Values, name string, def int) (int, error) {
+	v := query.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	rev, err := strconv.Atoi(v)
+	if err != nil || rev < 1 {
+		return 0, fmt.Errorf("bad %s %q", name, v)
+	}
+	return rev, nil
+}
+
+// GET /election/{id}/revisions, readable by anyone who can read the document
+func (sh *StudioHandler) handleElectionRevisions(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	edb := sh.edb.WithContext(r.Context())
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	er, err := edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	revs, err := edb.ElectionRevisions(electionid)
+	if maybeerr(w, err, 500, "db revisions, %v", err) {
+		return
+	}
+	if revs == nil {
+		revs = []revisionRecord{}
+	}
+	writeJSON(w, revs)
+}
+
+// GET /election/{id}/diff, readable by anyone who can read the document
+func (sh *StudioHandler) handleElectionDiff(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	edb := sh.edb.WithContext(r.Context())
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	er, err := edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	revs, err := edb.ElectionRevisions(electionid)
+	if maybeerr(w, err, 500, "db revisions, %v", err) {
+		return
+	}
+	if len(revs) == 0 {
+		texterr(w, 404, "election %d has no revisions", electionid)
+		return
+	}
+	query := r.URL.Query()
+	to, err := revisionParam(query, "to", revs[len(revs)-1].Rev)
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	from, err := revisionParam(query, "from", to-1)
+	if err == nil && from < 1 {
+		err = fmt.Errorf("rev %d is the first, nothing to compare it to", to)
+	}
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	var docs [2]map[string]interface{}
+	var recs [2]*revisionRecord
+	for i, rev := range []int{from, to} {
+		recs[i], err = edb.GetElectionRevision(electionid, rev)
+		if maybeerr(w, err, 500, "db revision, %v", err) {
+			return
+		}
+		if recs[i] == nil {
+			texterr(w, 404, "election %d has no rev %d", electionid, rev)
+			return
+		}
+		err = json.Unmarshal([]byte(recs[i].Data), &docs[i])
+		if maybeerr(w, err, 500, "rev %d bad json, %v", rev, err) {
+			return
+		}
+	}
+	var pages [2][]image.Image
+	for i := range recs {
+		pages[i], err = sh.renderRevision(r.Context(), recs[i])
+		if err != nil {
+			he := err.(*httpError)
+			maybeerr(w, he.err, he.code, he.msg)
+			return
+		}
+	}
+	npages := len(pages[0])
+	if len(pages[1]) > npages {
+		npages = len(pages[1])
+	}
+	pageAt := func(i, page int) image.Image {
+		if page < len(pages[i]) {
+			return pages[i][page]
+		}
+		return nil
+	}
+	if pv := query.Get("page"); pv != "" {
+		page, err := strconv.Atoi(pv)
+		if err == nil && (page < 0 || page >= npages) {
+			err = fmt.Errorf("%d pages", npages)
+		}
+		if maybeerr(w, err, 400, "bad page, %v", err) {
+			return
+		}
+		_, overlay := pageOverlay(pageAt(0, page), pageAt(1, page))
+		var buf bytes.Buffer
+		err = png.Encode(&buf, overlay)
+		if maybeerr(w, err, 500, "png, %v", err) {
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(200)
+		w.Write(buf.Bytes())
+		return
+	}
+	rd := revisionDiff{
+		ElectionId: electionid,
+		From:       from,
+		To:         to,
+		Contests:   diffObjects(docs[0], docs[1], "Contest"),
+		Candidates: diffObjects(docs[0], docs[1], "Candidate"),
+		Pages:      []pageDiff{},
+	}
+	for page := 0; page < npages; page++ {
+		changed, overlay := pageOverlay(pageAt(0, page), pageAt(1, page))
+		size := overlay.Bounds().Size()
+		pd := pageDiff{
+			Page:    page,
+			Changed: changed,
+			Image:   sitePath(r, fmt.Sprintf("/election/%s/diff?from=%d&to=%d&page=%d", electionRef(r, electionid), from, to, page)),
+		}
+		if size.X*size.Y != 0 {
+			pd.Fraction = float64(changed) / float64(size.X*size.Y)
+		}
+		rd.Pages = append(rd.Pages, pd)
+	}
+	writeJSON(w, rd)
+}
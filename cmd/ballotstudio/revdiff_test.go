@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+func TestElectionRevisions(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+
+	v1 := `{"Election": [{"Name": "Spring", "StartDate": "2026-04-01", "Candidate": [{"@id": "c1", "BallotName": "Ann"}, {"@id": "c2", "BallotName": "Bob"}], "BallotStyle": [{"GpUnitIds": ["g1"], "OrderedContent": []}]}]}`
+	v2 := `{"Election": [{"Name": "Spring General Election", "StartDate": "2026-05-05", "Candidate": [{"@id": "c1", "BallotName": "Anne"}, {"@id": "c3", "BallotName": "Cy"}], "Contest": [{"@id": "k1", "Name": "Mayor"}], "BallotStyle": [{"GpUnitIds": ["g1"], "OrderedContent": []}]}]}`
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: v1})
+	mtfail(t, err, "put election, %v", err)
+	// saving the same document again isn't a new revision
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: v1})
+	mtfail(t, err, "put election, %v", err)
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: v2})
+	mtfail(t, err, "put election, %v", err)
+	revs, err := edb.ElectionRevisions(eid)
+	mtfail(t, err, "revisions, %v", err)
+	if len(revs) != 2 || revs[0].Rev != 1 || revs[1].Rev != 2 || revs[1].Size != len(v2) {
+		t.Fatalf("revisions %#v", revs)
+	}
+	rr, err := edb.GetElectionRevision(eid, 1)
+	mtfail(t, err, "get revision, %v", err)
+	if rr == nil || rr.Data != v1 {
+		t.Errorf("rev 1 %#v", rr)
+	}
+	rr, err = edb.GetElectionRevision(eid, 3)
+	if rr != nil || err != nil {
+		t.Errorf("rev 3 %v %v", rr, err)
+	}
+
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}, drawClient: &draw.Client{}}
+	el := strconv.FormatInt(eid, 10)
+	rec := httptest.NewRecorder()
+	sh.handleElectionDiff(rec, httptest.NewRequest("GET", "/election/"+el+"/diff", nil), nil, eid)
+	if rec.Code != 200 {
+		t.Fatalf("diff %d %s", rec.Code, rec.Body.String())
+	}
+	var rd revisionDiff
+	err = json.Unmarshal(rec.Body.Bytes(), &rd)
+	mtfail(t, err, "diff json, %v", err)
+	if rd.From != 1 || rd.To != 2 {
+		t.Errorf("from %d to %d", rd.From, rd.To)
+	}
+	if len(rd.Contests.Added) != 1 || rd.Contests.Added[0].Name != "Mayor" {
+		t.Errorf("contests %#v", rd.Contests)
+	}
+	cd := rd.Candidates
+	if len(cd.Added) != 1 || cd.Added[0].Id != "c3" || len(cd.Removed) != 1 || cd.Removed[0].Name != "Bob" {
+		t.Errorf("candidates added/removed %#v", cd)
+	}
+	if len(cd.Changed) != 1 || cd.Changed[0].Id != "c1" || len(cd.Changed[0].Fields) != 1 || cd.Changed[0].Fields[0] != "BallotName" {
+		t.Errorf("candidates changed %#v", cd.Changed)
+	}
+	if len(rd.Pages) == 0 || rd.Pages[0].Changed == 0 {
+		t.Errorf("pages %#v", rd.Pages)
+	}
+	if sh.cache.Get(el+"@1.png") == nil {
+		t.Errorf("revision render not cached")
+	}
+
+	rec = httptest.NewRecorder()
+	sh.handleElectionDiff(rec, httptest.NewRequest("GET", "/election/"+el+"/diff?from=1&to=2&page=0", nil), nil, eid)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("overlay %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	_, err = png.Decode(bytes.NewReader(rec.Body.Bytes()))
+	mtfail(t, err, "overlay png, %v", err)
+
+	for _, query := range []string{"?from=2&to=2&page=9", "?from=x", "?to=1"} {
+		rec = httptest.NewRecorder()
+		sh.handleElectionDiff(rec, httptest.NewRequest("GET", "/election/"+el+"/diff"+query, nil), nil, eid)
+		if rec.Code != 400 {
+			t.Errorf("%s got %d", query, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	sh.handleElectionDiff(rec, httptest.NewRequest("GET", "/election/"+el+"/diff?from=1&to=5", nil), nil, eid)
+	if rec.Code != 404 {
+		t.Errorf("missing rev got %d", rec.Code)
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SAML 2.0 sign in, for identity systems that can't issue OAuth or OpenID
+// Connect credentials. One identity provider is set up by -saml-json:
+//
+//	{"name": "County SSO", "idp_metadata_url": "https://idp.example.gov/metadata",
+//	 "role_attribute": "groups", "roles": {"Elections Admins": "admin", "Elections Staff": "editor"},
+//	 "organization_attribute": "department"}
+//
+// The provider is given this server's metadata from /saml/metadata. Sign
+// in starts at /saml/login, which sends an AuthnRequest by the
+// HTTP-Redirect binding, and the response is posted back to /saml/acs.
+// Responses must answer a request from the same browser; the response or
+// its assertion must be signed by a certificate in the provider's
+// metadata, and only what that signature covers is used. Encrypted
+// assertions are not supported.
+//
+// The first sign in of a NameID makes a user named saml:{email or NameID},
+// as in extlogin.go with -saml-key. When role_attribute is set, each sign
+// in updates the staff record (staff.go) for the user's email with the
+// highest staff role any of the attribute's values maps to by "roles",
+// and the organization from organization_attribute. Without "roles",
+// values that are staff role names map to themselves.
+
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlRedirect    = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPOST        = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlTransient   = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+	samlPersistent  = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	samlEmailFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	samlTimeFormat  = "2006-01-02T15:04:05Z"
+)
+
+// how long someone has to finish signing in at the identity provider
+const samlSignInTime = 10 * time.Minute
+
+// how long fetched identity provider metadata is used
+const samlMetadataTTL = 24 * time.Hour
+
+// response and assertion times may be this far off the server's clock
+const samlClockSkew = 3 * time.Minute
+
+// largest metadata document or posted response, bytes
+const maxSAMLDocument = 1000000
+
+const samlCookie = "saml"
+
+type samlConfig struct {
+	Name                  string            `json:"name"`
+	EntityId              string            `json:"entity_id"`
+	IdPMetadataURL        string            `json:"idp_metadata_url"`
+	IdPMetadataFile       string            `json:"idp_metadata_file"`
+	EmailAttribute        string            `json:"email_attribute"`
+	NameAttribute         string            `json:"name_attribute"`
+	RoleAttribute         string            `json:"role_attribute"`
+	Roles                 map[string]string `json:"roles"`
+	OrganizationAttribute string            `json:"organization_attribute"`
+}
+
+// the parts of identity provider metadata used
+type samlIdP struct {
+	EntityId string
+	SSOURL   string // HTTP-Redirect binding
+	Certs    []*x509.Certificate
+	fetched  time.Time
+}
+
+type samlEntityDescriptor struct {
+	XMLName  xml.Name `xml:"EntityDescriptor"`
+	EntityId string   `xml:"entityID,attr"`
+	IdP      []struct {
+		Keys []struct {
+			Use         string   `xml:"use,attr"`
+			Certificate []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SSO []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+// parseSAMLConfig reads -saml-json
+func parseSAMLConfig(r io.Reader) (*samlProvider, error) {
+	var sc samlConfig
+	err := json.NewDecoder(r).Decode(&sc)
+	if err != nil {
+		return nil, fmt.Errorf("bad json, %v", err)
+	}
+	if (sc.IdPMetadataURL == "") == (sc.IdPMetadataFile == "") {
+		return nil, errors.New("one of idp_metadata_url or idp_metadata_file is required")
+	}
+	if sc.Name == "" {
+		sc.Name = "SAML"
+	}
+	if sc.EmailAttribute == "" {
+		sc.EmailAttribute = "urn:oid:0.9.2342.19200300.100.1.3" // mail
+	}
+	if sc.NameAttribute == "" {
+		sc.NameAttribute = "urn:oid:2.16.840.1.113730.3.1.241" // displayName
+	}
+	for value, role := range sc.Roles {
+		if !oneOf(role, staffRoles) {
+			return nil, fmt.Errorf("roles: %q maps to %q, should be one of %s", value, role, strings.Join(staffRoles, ", "))
+		}
+	}
+	sp := &samlProvider{samlConfig: sc, client: &http.Client{Timeout: 10 * time.Second}}
+	if sc.IdPMetadataFile != "" {
+		fin, err := os.Open(sc.IdPMetadataFile)
+		if err != nil {
+			return nil, err
+		}
+		defer fin.Close()
+		sp.idp, err = parseSAMLMetadata(io.LimitReader(fin, maxSAMLDocument))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", sc.IdPMetadataFile, err)
+		}
+	}
+	return sp, nil
+}
+
+// parseSAMLMetadata reads an identity provider's EntityDescriptor
+func parseSAMLMetadata(r io.Reader) (*samlIdP, error) {
+	var ed samlEntityDescriptor
+	err := xml.NewDecoder(r).Decode(&ed)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata, %v", err)
+	}
+	if ed.XMLName.Space != samlMetadataNS || ed.EntityId == "" || len(ed.IdP) == 0 {
+		return nil, errors.New("metadata should be an EntityDescriptor with an IDPSSODescriptor")
+	}
+	idp := &samlIdP{EntityId: ed.EntityId}
+	for _, d := range ed.IdP {
+		for _, sso := range d.SSO {
+			if sso.Binding == samlRedirect && idp.SSOURL == "" {
+				idp.SSOURL = sso.Location
+			}
+		}
+		for _, k := range d.Keys {
+			if k.Use != "" && k.Use != "signing" {
+				continue
+			}
+			for _, c := range k.Certificate {
+				der, err := decodeBase64(c)
+				if err != nil {
+					return nil, fmt.Errorf("certificate, %v", err)
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, fmt.Errorf("certificate, %v", err)
+				}
+				idp.Certs = append(idp.Certs, cert)
+			}
+		}
+	}
+	if idp.SSOURL == "" {
+		return nil, errors.New("no SingleSignOnService with the HTTP-Redirect binding")
+	}
+	if len(idp.Certs) == 0 {
+		return nil, errors.New("no signing certificate")
+	}
+	return idp, nil
+}
+
+// the -saml-json identity provider
+type samlProvider struct {
+	samlConfig
+
+	client *http.Client
+
+	lock sync.Mutex
+	idp  *samlIdP
+}
+
+// StartUrl is where signing in starts, for the home and signup pages
+func (sp *samlProvider) StartUrl() string {
+	return "/saml/login"
+}
+
+// metadata is the identity provider's, fetched again when stale
+func (sp *samlProvider) metadata(r *http.Request) (*samlIdP, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.idp != nil && (sp.IdPMetadataURL == "" || time.Since(sp.idp.fetched) < samlMetadataTTL) {
+		return sp.idp, nil
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "GET", sp.IdPMetadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sp.client.Do(req)
+	if err == nil && resp.StatusCode != 200 {
+		resp.Body.Close()
+		err = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if err != nil {
+		if sp.idp != nil {
+			log.Printf("saml metadata %s, %v; using what was fetched %s", sp.IdPMetadataURL, err, sp.idp.fetched.Format(time.RFC3339))
+			return sp.idp, nil
+		}
+		return nil, fmt.Errorf("saml metadata %s, %v", sp.IdPMetadataURL, err)
+	}
+	defer resp.Body.Close()
+	idp, err := parseSAMLMetadata(io.LimitReader(resp.Body, maxSAMLDocument))
+	if err != nil {
+		return nil, fmt.Errorf("saml metadata %s, %v", sp.IdPMetadataURL, err)
+	}
+	idp.fetched = time.Now()
+	sp.idp = idp
+	return idp, nil
+}
+
+func (sp *samlProvider) entityId(r *http.Request) string {
+	if sp.EntityId != "" {
+		return sp.EntityId
+	}
+	return serverURL(r, "/saml/metadata")
+}
+
+// handles /saml/metadata, /saml/login and /saml/acs
+type samlHandler struct {
+	sp    *samlProvider
+	users *externalUsers
+	edb   electionAppDB
+}
+
+func (sh *samlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// `/saml/metadata`
+	// `/saml/login`
+	// `/saml/acs`
+	switch r.URL.Path {
+	case "/saml/metadata":
+		sh.serveMetadata(w, r)
+	case "/saml/login":
+		sh.login(w, r)
+	case "/saml/acs":
+		if r.Method != "POST" {
+			texterr(w, http.StatusMethodNotAllowed, "POST only")
+			return
+		}
+		sh.acs(w, r)
+	default:
+		texterr(w, 404, "not found")
+	}
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func (sh *samlHandler) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="%s" entityID="%s">
+  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">
+    <md:NameIDFormat>%s</md:NameIDFormat>
+    <md:NameIDFormat>%s</md:NameIDFormat>
+    <md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>
+`, samlMetadataNS, xmlEscape(sh.sp.entityId(r)), samlProtocolNS, samlPersistent, samlEmailFormat, samlPOST, xmlEscape(serverURL(r, "/saml/acs")))
+}
+
+// login sends the browser to the identity provider with an AuthnRequest
+func (sh *samlHandler) login(w http.ResponseWriter, r *http.Request) {
+	idp, err := sh.sp.metadata(r)
+	if err != nil {
+		log.Print(err)
+		texterr(w, http.StatusBadGateway, "%s sign in is unavailable", sh.sp.Name)
+		return
+	}
+	idbytes := make([]byte, 20)
+	if _, err = rand.Read(idbytes); maybeerr(w, err, 500, "random") {
+		return
+	}
+	id := "_" + hex.EncodeToString(idbytes)
+	ar := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s"><saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`,
+		samlProtocolNS, samlAssertionNS, id, time.Now().UTC().Format(samlTimeFormat), xmlEscape(idp.SSOURL), xmlEscape(serverURL(r, "/saml/acs")), samlPOST, xmlEscape(sh.sp.entityId(r)))
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write([]byte(ar))
+	fw.Close()
+	// the response is posted back from the identity provider's site, so
+	// over https the cookie has to be SameSite=None to come with it
+	cookie := &http.Cookie{
+		Name:     samlCookie,
+		Value:    id,
+		Path:     sitePath(r, "/saml/"),
+		MaxAge:   int(samlSignInTime.Seconds()),
+		HttpOnly: true,
+	}
+	if requestScheme(r) == "https" {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+	sep := "?"
+	if strings.Contains(idp.SSOURL, "?") {
+		sep = "&"
+	}
+	q := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(buf.Bytes())}}
+	http.Redirect(w, r, idp.SSOURL+sep+q.Encode(), http.StatusFound)
+}
+
+// what a checked response says about who signed in
+type samlAssertion struct {
+	NameID       string
+	NameIDFormat string
+	Attributes   map[string][]string // by Name and FriendlyName
+}
+
+func (sa *samlAssertion) first(name string) string {
+	if vs := sa.Attributes[name]; len(vs) != 0 {
+		return strings.TrimSpace(vs[0])
+	}
+	return ""
+}
+
+func samlTime(n *xmlNode, attr string) (time.Time, bool, error) {
+	v := n.attr(attr)
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, false, fmt.Errorf("%s %s, %v", n.Local, attr, err)
+	}
+	return t, true, nil
+}
+
+// parseResponse checks a Response posted to acsURL answering requestID,
+// from idp to the service provider entityId
+func parseResponse(raw []byte, idp *samlIdP, requestID, acsURL, entityId string, now time.Time) (*samlAssertion, error) {
+	root, err := parseXML(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	if !root.is(samlProtocolNS, "Response") {
+		return nil, errors.New("not a Response")
+	}
+	if d := root.attr("Destination"); d != "" && d != acsURL {
+		return nil, fmt.Errorf("Response for %q", d)
+	}
+	if root.attr("InResponseTo") != requestID {
+		return nil, errors.New("Response is not to this browser's request")
+	}
+	if iss := root.child(samlAssertionNS, "Issuer"); iss != nil && strings.TrimSpace(iss.text()) != idp.EntityId {
+		return nil, fmt.Errorf("Response from %q", iss.text())
+	}
+	var code *xmlNode
+	if st := root.child(samlProtocolNS, "Status"); st != nil {
+		code = st.child(samlProtocolNS, "StatusCode")
+	}
+	if code == nil || code.attr("Value") != samlSuccess {
+		status := ""
+		if code != nil {
+			status = code.attr("Value")
+		}
+		return nil, fmt.Errorf("status %q", status)
+	}
+	if len(root.children(samlAssertionNS, "EncryptedAssertion")) != 0 {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	as := root.children(samlAssertionNS, "Assertion")
+	if len(as) != 1 {
+		return nil, fmt.Errorf("Response has %d assertions", len(as))
+	}
+	a := as[0]
+	signed := false
+	for _, n := range []*xmlNode{root, a} {
+		if len(n.children(dsigNS, "Signature")) == 0 {
+			continue
+		}
+		if err = verifyEnveloped(root, n, idp.Certs); err != nil {
+			return nil, fmt.Errorf("%s signature, %v", n.Local, err)
+		}
+		signed = true
+	}
+	if !signed {
+		return nil, errors.New("neither Response nor Assertion is signed")
+	}
+	if iss := a.child(samlAssertionNS, "Issuer"); iss == nil || strings.TrimSpace(iss.text()) != idp.EntityId {
+		return nil, errors.New("Assertion not from the identity provider")
+	}
+
+	subject := a.child(samlAssertionNS, "Subject")
+	if subject == nil {
+		return nil, errors.New("no Subject")
+	}
+	nameID := subject.child(samlAssertionNS, "NameID")
+	if nameID == nil || strings.TrimSpace(nameID.text()) == "" {
+		return nil, errors.New("no NameID")
+	}
+	out := &samlAssertion{NameID: strings.TrimSpace(nameID.text()), NameIDFormat: nameID.attr("Format"), Attributes: make(map[string][]string)}
+	if out.NameIDFormat == samlTransient {
+		return nil, errors.New("transient NameIDs can't identify a user")
+	}
+	confirmed := false
+	for _, sc := range subject.children(samlAssertionNS, "SubjectConfirmation") {
+		scd := sc.child(samlAssertionNS, "SubjectConfirmationData")
+		if sc.attr("Method") != samlBearer || scd == nil {
+			continue
+		}
+		notAfter, ok, err := samlTime(scd, "NotOnOrAfter")
+		if err != nil || !ok || !now.Add(-samlClockSkew).Before(notAfter) {
+			continue
+		}
+		if scd.attr("Recipient") != acsURL {
+			continue
+		}
+		if irt := scd.attr("InResponseTo"); irt != "" && irt != requestID {
+			continue
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		return nil, errors.New("no current bearer SubjectConfirmation for this server")
+	}
+
+	if cond := a.child(samlAssertionNS, "Conditions"); cond != nil {
+		notBefore, ok, err := samlTime(cond, "NotBefore")
+		if err != nil {
+			return nil, err
+		}
+		if ok && now.Add(samlClockSkew).Before(notBefore) {
+			return nil, errors.New("Assertion not yet valid")
+		}
+		notAfter, ok, err := samlTime(cond, "NotOnOrAfter")
+		if err != nil {
+			return nil, err
+		}
+		if ok && !now.Add(-samlClockSkew).Before(notAfter) {
+			return nil, errors.New("Assertion expired")
+		}
+		for _, ar := range cond.children(samlAssertionNS, "AudienceRestriction") {
+			found := false
+			for _, aud := range ar.children(samlAssertionNS, "Audience") {
+				found = found || strings.TrimSpace(aud.text()) == entityId
+			}
+			if !found {
+				return nil, errors.New("Assertion is for another audience")
+			}
+		}
+	}
+
+	for _, st := range a.children(samlAssertionNS, "AttributeStatement") {
+		for _, attr := range st.children(samlAssertionNS, "Attribute") {
+			var values []string
+			for _, v := range attr.children(samlAssertionNS, "AttributeValue") {
+				values = append(values, v.text())
+			}
+			for _, name := range []string{attr.attr("Name"), attr.attr("FriendlyName")} {
+				if name != "" {
+					out.Attributes[name] = append(out.Attributes[name], values...)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// acs receives the identity provider's response
+func (sh *samlHandler) acs(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSAMLDocument)
+	c, err := r.Cookie(samlCookie)
+	if err != nil || c.Value == "" {
+		texterr(w, 400, "sign in expired or started elsewhere, try again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: samlCookie, Path: sitePath(r, "/saml/"), MaxAge: -1})
+	raw, err := base64.StdEncoding.DecodeString(r.PostFormValue("SAMLResponse"))
+	if err != nil || len(raw) == 0 {
+		texterr(w, 400, "bad SAMLResponse")
+		return
+	}
+	idp, err := sh.sp.metadata(r)
+	if err != nil {
+		log.Print(err)
+		texterr(w, http.StatusBadGateway, "%s sign in is unavailable", sh.sp.Name)
+		return
+	}
+	sa, err := parseResponse(raw, idp, c.Value, serverURL(r, "/saml/acs"), sh.sp.entityId(r), time.Now())
+	if err != nil {
+		log.Printf("saml: %v", err)
+		texterr(w, http.StatusForbidden, "%s sign in failed", sh.sp.Name)
+		return
+	}
+	ei, err := sh.identity(idp, sa)
+	if maybeerr(w, err, 500, "saml user") {
+		return
+	}
+	if err = sh.users.signIn(w, r, ei); err != nil {
+		log.Printf("saml: %v", err)
+		texterr(w, 500, "sign in failed")
+		return
+	}
+	http.Redirect(w, r, sitePath(r, "/"), http.StatusFound)
+}
+
+func (sh *samlHandler) email(sa *samlAssertion) string {
+	email := sa.first(sh.sp.EmailAttribute)
+	if email == "" && sa.NameIDFormat == samlEmailFormat {
+		email = sa.NameID
+	}
+	return email
+}
+
+// identity finds the user for sa, making one on first sign in, and
+// updates their staff role
+func (sh *samlHandler) identity(idp *samlIdP, sa *samlAssertion) (*externalIdentity, error) {
+	email := sh.email(sa)
+	usernames := []string{"saml:" + sa.NameID}
+	if email != "" && email != sa.NameID {
+		usernames = []string{"saml:" + email, usernames[0]}
+	}
+	ei, err := sh.users.user("saml", idp.EntityId, sa.NameID, usernames, sa.first(sh.sp.NameAttribute), email)
+	if err != nil {
+		return nil, err
+	}
+	if sh.sp.RoleAttribute != "" && email != "" {
+		if err = sh.mapRole(ei, sa, email); err != nil {
+			log.Printf("saml %d staff role, %v", ei.UserId, err)
+		}
+	}
+	return ei, nil
+}
+
+// role is the highest staff role values map to, or ""
+func (sp *samlProvider) role(values []string) string {
+	mapped := make(map[string]bool)
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if len(sp.Roles) == 0 && oneOf(v, staffRoles) {
+			mapped[v] = true
+		} else if role, ok := sp.Roles[v]; ok {
+			mapped[role] = true
+		}
+	}
+	for _, role := range staffRoles {
+		if mapped[role] {
+			return role
+		}
+	}
+	return ""
+}
+
+// mapRole sets the staff record for email from sa's role and organization
+// attributes. Records linked to another user are left alone.
+func (sh *samlHandler) mapRole(ei *externalIdentity, sa *samlAssertion, email string) error {
+	role := sh.sp.role(sa.Attributes[sh.sp.RoleAttribute])
+	sr, err := sh.edb.GetStaff(email)
+	if err != nil {
+		return err
+	}
+	if sr == nil {
+		if role == "" {
+			return nil
+		}
+		sr = &staffRecord{Email: email, Provisioned: time.Now().Unix()}
+	}
+	if sr.UserId != 0 && sr.UserId != ei.UserId {
+		return fmt.Errorf("%s is staff user %d", email, sr.UserId)
+	}
+	org := sr.Organization
+	if sh.sp.OrganizationAttribute != "" {
+		org = sa.first(sh.sp.OrganizationAttribute)
+	}
+	if sr.Role == role && sr.Organization == org && sr.UserId == ei.UserId && sr.Invite == "" {
+		return nil
+	}
+	sr.Role, sr.Organization, sr.UserId, sr.Invite = role, org, ei.UserId, ""
+	return sh.edb.PutStaff(*sr)
+}
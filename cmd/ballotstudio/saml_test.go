@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+func c14nString(t *testing.T, doc string, find func(*xmlNode) bool, inclusive []string) string {
+	root, err := parseXML(strings.NewReader(doc))
+	mtfail(t, err, "parse, %v", err)
+	var n *xmlNode
+	root.walk(func(e *xmlNode) {
+		if n == nil && find(e) {
+			n = e
+		}
+	})
+	var buf bytes.Buffer
+	err = canonicalize(&buf, n, inclusive, nil)
+	mtfail(t, err, "c14n, %v", err)
+	return buf.String()
+}
+
+func TestExcC14N(t *testing.T) {
+	// from the Exclusive XML Canonicalization recommendation, section 2.2
+	doc := `<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org"><n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"/>
+</n1:elem2></n0:local>`
+	got := c14nString(t, doc, func(e *xmlNode) bool { return e.Local == "elem2" }, nil)
+	want := `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+</n1:elem2>`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	// attributes sort by namespace then name, unused declarations go, and
+	// text and attribute values are escaped
+	doc = `<r xmlns="urn:d" xmlns:b="urn:b" xmlns:a="urn:a" xmlns:unused="urn:u"><e b:x="1" a:y="2" z="&quot;&#9;"/>a &gt; b &amp; c<f xmlns=""/></r>`
+	got = c14nString(t, doc, func(e *xmlNode) bool { return e.Local == "r" }, nil)
+	want = `<r xmlns="urn:d"><e xmlns:a="urn:a" xmlns:b="urn:b" z="&quot;&#x9;" a:y="2" b:x="1"></e>a &gt; b &amp; c<f xmlns=""></f></r>`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	got = c14nString(t, doc, func(e *xmlNode) bool { return e.Local == "f" }, []string{"unused"})
+	if got != `<f xmlns:unused="urn:u"></f>` {
+		t.Errorf("inclusive prefix got %s", got)
+	}
+	if _, err := parseXML(strings.NewReader(`<!DOCTYPE r [<!ENTITY a "b">]><r/>`)); err == nil {
+		t.Errorf("DTD accepted")
+	}
+}
+
+// fakeIdP signs SAML responses
+type fakeIdP struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+	idp  *samlIdP
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	mtfail(t, err, "rsa key, %v", err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	mtfail(t, err, "cert, %v", err)
+	metadata := fmt.Sprintf(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.gov">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing"><ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>
+%s
+    </ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.gov/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.gov/sso"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`, base64.StdEncoding.EncodeToString(der))
+	idp, err := parseSAMLMetadata(strings.NewReader(metadata))
+	mtfail(t, err, "metadata, %v", err)
+	if idp.EntityId != "https://idp.example.gov" || idp.SSOURL != "https://idp.example.gov/sso" || len(idp.Certs) != 1 {
+		t.Fatalf("metadata %#v", idp)
+	}
+	return &fakeIdP{key: key, cert: idp.Certs[0], idp: idp}
+}
+
+// sign puts an enveloped signature of the element with id in doc after
+// the first occurrence of after
+func (fi *fakeIdP) sign(t *testing.T, doc, id, after string) string {
+	root, err := parseXML(strings.NewReader(doc))
+	mtfail(t, err, "parse, %v", err)
+	var n *xmlNode
+	root.walk(func(e *xmlNode) {
+		if e.attr("ID") == id {
+			n = e
+		}
+	})
+	var buf bytes.Buffer
+	err = canonicalize(&buf, n, nil, nil)
+	mtfail(t, err, "c14n, %v", err)
+	digest := sha256.Sum256(buf.Bytes())
+	si := `<ds:SignedInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/><ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+		`<ds:Reference URI="#` + id + `"><ds:Transforms><ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/><ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/></ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/><ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue></ds:Reference></ds:SignedInfo>`
+	sin, err := parseXML(strings.NewReader(si))
+	mtfail(t, err, "parse SignedInfo, %v", err)
+	buf.Reset()
+	canonicalize(&buf, sin, nil, nil)
+	h := sha256.Sum256(buf.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, fi.key, crypto.SHA256, h[:])
+	mtfail(t, err, "sign, %v", err)
+	signature := `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">` + strings.Replace(si, ` xmlns:ds="http://www.w3.org/2000/09/xmldsig#"`, "", 1) +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue></ds:Signature>`
+	i := strings.Index(doc, after) + len(after)
+	return doc[:i] + signature + doc[i:]
+}
+
+const testACS = "https://studio.example/saml/acs"
+const testEntity = "https://studio.example/saml/metadata"
+
+func testAssertion(id, nameID, audience string, now time.Time) string {
+	return `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="` + id + `" Version="2.0" IssueInstant="` + now.UTC().Format(samlTimeFormat) + `">` +
+		`<saml:Issuer>https://idp.example.gov</saml:Issuer>` +
+		`<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">` + nameID + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer"><saml:SubjectConfirmationData InResponseTo="_req1" Recipient="` + testACS + `" NotOnOrAfter="` + now.Add(5*time.Minute).UTC().Format(samlTimeFormat) + `"/></saml:SubjectConfirmation></saml:Subject>` +
+		`<saml:Conditions NotBefore="` + now.Add(-time.Minute).UTC().Format(samlTimeFormat) + `" NotOnOrAfter="` + now.Add(5*time.Minute).UTC().Format(samlTimeFormat) + `"><saml:AudienceRestriction><saml:Audience>` + audience + `</saml:Audience></saml:AudienceRestriction></saml:Conditions>` +
+		`<saml:AttributeStatement>` +
+		`<saml:Attribute Name="urn:oid:0.9.2342.19200300.100.1.3" FriendlyName="mail"><saml:AttributeValue>ann@county.example.gov</saml:AttributeValue></saml:Attribute>` +
+		`<saml:Attribute Name="groups"><saml:AttributeValue>Everyone</saml:AttributeValue><saml:AttributeValue>Elections Staff</saml:AttributeValue></saml:Attribute>` +
+		`<saml:Attribute Name="department"><saml:AttributeValue>Elections</saml:AttributeValue></saml:Attribute>` +
+		`</saml:AttributeStatement></saml:Assertion>`
+}
+
+func testResponse(assertions ...string) string {
+	return `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_resp1" Version="2.0" InResponseTo="_req1" Destination="` + testACS + `">` +
+		`<saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">https://idp.example.gov</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+		strings.Join(assertions, "") + `</samlp:Response>`
+}
+
+func TestSAMLResponse(t *testing.T) {
+	fi := newFakeIdP(t)
+	now := time.Now()
+	assertionIssuer := `<saml:Issuer>https://idp.example.gov</saml:Issuer>`
+	good := fi.sign(t, testResponse(testAssertion("_a1", "ann-1", testEntity, now)), "_a1", assertionIssuer)
+	sa, err := parseResponse([]byte(good), fi.idp, "_req1", testACS, testEntity, now)
+	mtfail(t, err, "good response, %v", err)
+	if sa.NameID != "ann-1" || sa.first("mail") != "ann@county.example.gov" || len(sa.Attributes["groups"]) != 2 {
+		t.Errorf("assertion %#v", sa)
+	}
+	// a signed response rather than assertion is as good
+	whole := fi.sign(t, testResponse(testAssertion("_a1", "ann-1", testEntity, now)), "_resp1", `https://idp.example.gov</saml:Issuer>`)
+	if _, err := parseResponse([]byte(whole), fi.idp, "_req1", testACS, testEntity, now); err != nil {
+		t.Errorf("signed response, %v", err)
+	}
+
+	evil := testAssertion("_evil", "admin-1", testEntity, now)
+	bad := map[string]string{
+		"tampered":    strings.Replace(good, ">ann-1<", ">admin-1<", 1),
+		"unsigned":    testResponse(testAssertion("_a1", "ann-1", testEntity, now)),
+		"audience":    fi.sign(t, testResponse(testAssertion("_a1", "ann-1", "https://other.example", now)), "_a1", assertionIssuer),
+		"expired":     fi.sign(t, testResponse(testAssertion("_a1", "ann-1", testEntity, now.Add(-time.Hour))), "_a1", assertionIssuer),
+		"two":         strings.Replace(good, "</samlp:Response>", evil+"</samlp:Response>", 1),
+		"wrapped":     strings.Replace(good, strings.SplitN(good, "</samlp:Status>", 2)[1], evil+"<samlp:Extensions>"+strings.TrimSuffix(strings.SplitN(good, "</samlp:Status>", 2)[1], "</samlp:Response>")+"</samlp:Extensions></samlp:Response>", 1),
+		"other key":   newFakeIdP(t).sign(t, testResponse(testAssertion("_a1", "ann-1", testEntity, now)), "_a1", assertionIssuer),
+		"request":     strings.Replace(good, `InResponseTo="_req1" Destination`, `InResponseTo="_req2" Destination`, 1),
+		"duplicateID": strings.Replace(good, `<samlp:Status>`, `<samlp:Extensions ID="_a1"/><samlp:Status>`, 1),
+	}
+	for name, doc := range bad {
+		if _, err := parseResponse([]byte(doc), fi.idp, "_req1", testACS, testEntity, now); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestSAMLHandler(t *testing.T) {
+	fi := newFakeIdP(t)
+	sp, err := parseSAMLConfig(strings.NewReader(`{"name": "County SSO", "idp_metadata_url": "https://idp.example.gov/metadata", "role_attribute": "groups", "roles": {"Elections Staff": "editor", "Elections Admins": "admin"}, "organization_attribute": "department"}`))
+	mtfail(t, err, "config, %v", err)
+	sp.idp = fi.idp
+	sp.idp.fetched = time.Now()
+	if _, err := parseSAMLConfig(strings.NewReader(`{"idp_metadata_url": "x", "roles": {"a": "boss"}}`)); err == nil {
+		t.Errorf("bad role accepted")
+	}
+
+	edb, db := testSqliteEDB(t)
+	udb := login.NewSqlUserDB(db)
+	err = udb.Setup()
+	mtfail(t, err, "udb setup, %v", err)
+	sh := &samlHandler{sp, &externalUsers{edb, udb, make([]byte, 32)}, edb}
+
+	rec := httptest.NewRecorder()
+	sh.ServeHTTP(rec, httptest.NewRequest("GET", "https://studio.example/saml/metadata", nil))
+	md := rec.Body.String()
+	if _, err := parseXML(strings.NewReader(md)); err != nil || !strings.Contains(md, testACS) {
+		t.Errorf("metadata %v %s", err, md)
+	}
+
+	// login sends an AuthnRequest whose ID is kept in a cookie
+	rec = httptest.NewRecorder()
+	sh.ServeHTTP(rec, httptest.NewRequest("GET", "https://studio.example/saml/login", nil))
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != 302 || loc == nil || loc.Host != "idp.example.gov" {
+		t.Fatalf("login %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	deflated, _ := base64.StdEncoding.DecodeString(loc.Query().Get("SAMLRequest"))
+	ar, _ := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	cookie := rec.Result().Cookies()[0]
+	arn, err := parseXML(bytes.NewReader(ar))
+	mtfail(t, err, "AuthnRequest, %v", err)
+	if arn.attr("ID") != cookie.Value || arn.attr("AssertionConsumerServiceURL") != testACS || !cookie.Secure {
+		t.Errorf("AuthnRequest %s cookie %#v", ar, cookie)
+	}
+
+	// without the cookie the response is refused
+	now := time.Now()
+	good := fi.sign(t, testResponse(testAssertion("_a1", "ann-1", testEntity, now)), "_a1", `<saml:Issuer>https://idp.example.gov</saml:Issuer>`)
+	form := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(good))}}
+	req := httptest.NewRequest("POST", testACS, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	sh.ServeHTTP(rec, req)
+	if rec.Code != 400 {
+		t.Errorf("no cookie %d", rec.Code)
+	}
+
+	sa, err := parseResponse([]byte(good), fi.idp, "_req1", testACS, testEntity, now)
+	mtfail(t, err, "response, %v", err)
+	ei, err := sh.identity(fi.idp, sa)
+	mtfail(t, err, "identity, %v", err)
+	if ei.Username != "saml:ann@county.example.gov" || ei.UserId == 0 {
+		t.Errorf("identity %#v", ei)
+	}
+	sr, _ := edb.GetStaff("ann@county.example.gov")
+	if sr == nil || sr.Role != StaffEditor || sr.Organization != "Elections" || sr.UserId != ei.UserId {
+		t.Errorf("staff %#v", sr)
+	}
+	// losing the group takes the role away on the next sign in
+	sa.Attributes["groups"] = []string{"Everyone"}
+	again, err := sh.identity(fi.idp, sa)
+	mtfail(t, err, "identity again, %v", err)
+	sr, _ = edb.GetStaff("ann@county.example.gov")
+	if again.UserId != ei.UserId || sr == nil || sr.Role != "" {
+		t.Errorf("second sign in %#v staff %#v", again, sr)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+// Sample ballots: counties post what voters will see from the same document
+// the ballots are printed from. The owner picks a slug for the election and
+// once it's published (or locked) anyone can read it, no login.
+//
+//	GET /election/{id}/sample   the slug and whether the page is up, owner only
+//	POST /election/{id}/sample  body the slug, or empty to take the page down, owner only
+//	GET /sample/{slug}          the ballot as a web page
+//	GET /sample/{slug}.pdf      the ballot PDF, watermarked as a sample
+//
+// Both are sent with Cache-Control: public so a CDN or caching proxy can take
+// the traffic before an election, and an ETag to revalidate cheaply.
+
+// how long a cache may keep a sample ballot without checking back
+const sampleMaxAge = time.Hour
+
+const maxSampleSlugLen = 64
+
+var errSampleSlugTaken = errors.New("that sample ballot address is taken")
+
+type sampleSlugJSON struct {
+	ElectionId int64  `json:"itemid"`
+	Slug       string `json:"slug,omitempty"`
+	URL        string `json:"url,omitempty"`
+	// Live is whether the election's state lets the page show
+	Live bool `json:"live"`
+}
+
+// cleanSampleSlug lower cases a slug. Letters a-z, digits and '-' are
+// allowed, not at either end.
+func cleanSampleSlug(slug string) (string, error) {
+	slug = strings.ToLower(strings.TrimSpace(slug))
+	if len(slug) < 3 || len(slug) > maxSampleSlugLen {
+		return "", fmt.Errorf("sample ballot slugs must be 3 to %d characters", maxSampleSlugLen)
+	}
+	for _, c := range slug {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' {
+			return "", fmt.Errorf("bad slug %q, use letters, digits and '-'", slug)
+		}
+	}
+	if slug[0] == '-' || slug[len(slug)-1] == '-' {
+		return "", fmt.Errorf("bad slug %q, can't start or end with '-'", slug)
+	}
+	return slug, nil
+}
+
+// ballotView is an election document as a voter reads it, for web pages
+type ballotView struct {
+	Title        string // like "General Election"
+	Name         string
+	Date         string
+	Instructions []string
+	Styles       []ballotStyleView
+	PDFURL       string
+	// AllStylesURL is set when showing one of several styles
+	AllStylesURL string
+}
+
+type ballotStyleView struct {
+	Index    int
+	Name     string // its districts
+	Contests []contestView
+}
+
+type contestView struct {
+	Id           string
+	Title        string
+	Subtitle     string
+	VotesAllowed int
+	// Text is a ballot measure's full text, by paragraph
+	Text       []string
+	Selections []selectionView
+}
+
+// VoteFor is the instruction for how many to mark
+func (cv contestView) VoteFor() string {
+	if cv.VotesAllowed == 1 {
+		return "Vote for one"
+	}
+	return fmt.Sprintf("Vote for up to %d", cv.VotesAllowed)
+}
+
+type selectionView struct {
+	Id      string
+	Name    string
+	Parties string
+	WriteIn bool
+}
+
+// newBallotView reads each ballot style's contests, in ballot order, as the
+// renderer lays them out
+func newBallotView(doc map[string]interface{}) (bv ballotView) {
+	obs := make(map[string]map[string]interface{})
+	addObs := func(parent map[string]interface{}) {
+		for _, list := range parent {
+			for _, ob := range mapList(list) {
+				if id, ok := ob["@id"].(string); ok {
+					obs[id] = ob
+				}
+			}
+		}
+	}
+	addObs(doc)
+	for _, el := range mapList(doc["Election"]) {
+		addObs(el)
+		if bv.Name == "" {
+			bv.Title = draw.ElectionTypeTitle(el)
+			bv.Name = docString(el["Name"])
+			bv.Date, _ = el["StartDate"].(string)
+			if end, _ := el["EndDate"].(string); end != "" && end != bv.Date {
+				bv.Date += " - " + end
+			}
+		}
+		for _, bs := range mapList(el["BallotStyle"]) {
+			sv := ballotStyleView{Index: len(bv.Styles)}
+			var names []string
+			ids, _ := bs["GpUnitIds"].([]interface{})
+			for _, x := range ids {
+				gpid, _ := x.(string)
+				names = append(names, docString(obs[gpid]["Name"]))
+			}
+			sv.Name = strings.Join(names, ", ")
+			for _, oc := range mapList(bs["OrderedContent"]) {
+				if hid, ok := oc["HeaderId"].(string); ok {
+					if docString(obs[hid]["Name"]) == "Instructions" {
+						bv.Instructions = draw.BallotInstructions
+					}
+					continue
+				}
+				cid, _ := oc["ContestId"].(string)
+				if co := obs[cid]; co != nil {
+					sv.Contests = append(sv.Contests, newContestView(obs, co, oc))
+				}
+			}
+			bv.Styles = append(bv.Styles, sv)
+		}
+	}
+	return
+}
+
+func newContestView(obs map[string]map[string]interface{}, co, oc map[string]interface{}) contestView {
+	cv := contestView{VotesAllowed: 1}
+	cv.Id, _ = co["@id"].(string)
+	cv.Title = docString(co["BallotTitle"])
+	if cv.Title == "" {
+		cv.Title = docString(co["Name"])
+	}
+	cv.Subtitle = docString(co["BallotSubTitle"])
+	if va, ok := co["VotesAllowed"].(float64); ok && va >= 1 {
+		cv.VotesAllowed = int(va)
+	}
+	for _, para := range strings.Split(docString(co["FullText"]), "\n") {
+		if para = strings.TrimSpace(para); para != "" {
+			cv.Text = append(cv.Text, para)
+		}
+	}
+	selections := mapList(co["ContestSelection"])
+	if order, _ := oc["OrderedContestSelectionIds"].([]interface{}); len(order) != 0 {
+		byid := make(map[string]map[string]interface{}, len(selections))
+		for _, sel := range selections {
+			id, _ := sel["@id"].(string)
+			byid[id] = sel
+		}
+		selections = nil
+		for _, x := range order {
+			id, _ := x.(string)
+			if sel := byid[id]; sel != nil {
+				selections = append(selections, sel)
+			}
+		}
+	}
+	for _, sel := range selections {
+		sv := selectionView{}
+		sv.Id, _ = sel["@id"].(string)
+		sv.WriteIn, _ = sel["IsWriteIn"].(bool)
+		if s := docString(sel["Selection"]); s != "" {
+			sv.Name = s
+		} else if sv.WriteIn {
+			sv.Name = "Write-in"
+		} else {
+			var names []string
+			var parties []string
+			cids, _ := sel["CandidateIds"].([]interface{})
+			for _, x := range cids {
+				cand := obs[fmt.Sprint(x)]
+				names = append(names, docString(cand["BallotName"]))
+				pid, _ := obs[fmt.Sprint(cand["PersonId"])]["PartyId"].(string)
+				if party := obs[pid]; party != nil {
+					parties = append(parties, docString(party["Name"]))
+				}
+			}
+			if endorsed, _ := sel["EndorsementPartyIds"].([]interface{}); len(endorsed) != 0 {
+				parties = nil
+				for _, x := range endorsed {
+					parties = append(parties, docString(obs[fmt.Sprint(x)]["Name"]))
+				}
+			}
+			sv.Name = strings.Join(names, " / ")
+			sv.Parties = strings.Join(parties, ", ")
+		}
+		cv.Selections = append(cv.Selections, sv)
+	}
+	return cv
+}
+
+// GET|POST /election/{id}/sample
+func (sh *StudioHandler) handleElectionSample(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if sh.checkElectionState(w, electionid, actionSettings) {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		slug := strings.TrimSpace(string(body))
+		if slug != "" {
+			slug, err = cleanSampleSlug(slug)
+			if maybeerr(w, err, 400, "%v", err) {
+				return
+			}
+		}
+		err = sh.edb.SetSampleSlug(electionid, slug)
+		if err == errSampleSlugTaken {
+			texterr(w, http.StatusConflict, "%v", err)
+			return
+		}
+		if maybeerr(w, err, 500, "db sample slug, %v", err) {
+			return
+		}
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET or POST /election/{id}/sample")
+		return
+	}
+	out := sampleSlugJSON{ElectionId: electionid}
+	out.Slug, err = sh.edb.SampleSlug(electionid)
+	if maybeerr(w, err, 500, "db sample slug, %v", err) {
+		return
+	}
+	state, err := sh.edb.GetElectionState(electionid)
+	if maybeerr(w, err, 500, "db state, %v", err) {
+		return
+	}
+	if out.Slug != "" {
+		out.URL = sitePath(r, "/sample/"+out.Slug)
+		out.Live = er.Trashed == 0 && stateAllows(state, actionSample)
+	}
+	writeJSON(w, out)
+}
+
+// GET /sample/{slug} and /sample/{slug}.pdf
+func (sh *StudioHandler) handleSample(w http.ResponseWriter, r *http.Request, slug string, pdf bool) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	electionid, err := sh.edb.SampleElection(slug)
+	if maybeerr(w, err, 500, "db sample slug, %v", err) {
+		return
+	}
+	if electionid == 0 {
+		texterr(w, 404, "no sample ballot %s", slug)
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if err != nil || er.Trashed != 0 {
+		texterr(w, 404, "no sample ballot %s", slug)
+		return
+	}
+	state, err := sh.edb.GetElectionState(electionid)
+	if maybeerr(w, err, 500, "db state, %v", err) {
+		return
+	}
+	if !stateAllows(state, actionSample) {
+		texterr(w, 404, "no sample ballot %s", slug)
+		return
+	}
+	itemname := strconv.FormatInt(electionid, 10)
+	cacheControl := fmt.Sprintf("public, max-age=%d", int(sampleMaxAge.Seconds()))
+	if pdf {
+		ctx, note := withStaleNote(r.Context())
+		bothob, err := sh.getPdf(ctx, itemname, draw.RenderOptions{Proof: true}, false)
+		if err != nil {
+			he := err.(*httpError)
+			maybeerr(w, he.err, he.code, he.msg)
+			return
+		}
+		defer bothob.Release()
+		if note.stale {
+			// the last good render is for an older version, don't let caches keep it
+			cacheControl = "no-cache"
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.pdf\"", slug))
+		writePdfArtifact(w, r, bothob, sh.renderModified(itemname, note), cacheControl)
+		return
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if maybeerr(w, err, 500, "bad election json") {
+		return
+	}
+	bv := newBallotView(doc)
+	bv.PDFURL = sitePath(r, "/sample/"+slug+".pdf")
+	st, err := sh.templates.Lookup("sample.html")
+	if maybeerr(w, err, 500, "sample.html: %v", err) {
+		return
+	}
+	var page bytes.Buffer
+	err = st.Execute(&page, &bv)
+	if maybeerr(w, err, 500, "sample.html: %v", err) {
+		return
+	}
+	writeCachedArtifact(w, r, "text/html; charset=utf-8", page.Bytes(), sh.electionModified(itemname), cacheControl)
+}
+
+// common to all backends, param is "$" for numbered placeholders or "?"
+func setSampleSlug(db sqlDB, param string, eid int64, slug string) error {
+	p1, p2 := "$1", "$2"
+	if param == "?" {
+		p1, p2 = "?", "?"
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("sample slug tx, %v", err)
+	}
+	defer tx.Rollback()
+	if slug != "" {
+		var owner int64
+		err = tx.QueryRow("SELECT election FROM sample_ballots WHERE slug = "+p1, slug).Scan(&owner)
+		if err == nil && owner != eid {
+			return errSampleSlugTaken
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("sample slug lookup, %v", err)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM sample_ballots WHERE election = "+p1, eid)
+	if err != nil {
+		return fmt.Errorf("sample slug delete, %v", err)
+	}
+	if slug != "" {
+		_, err = tx.Exec("INSERT INTO sample_ballots (slug, election) VALUES ("+p1+", "+p2+")", slug, eid)
+		if err != nil {
+			return fmt.Errorf("sample slug insert, %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("sample slug commit, %v", err)
+	}
+	return nil
+}
+
+// common to all backends, "" if eid has no slug
+func sampleSlug(db sqlDB, query string, eid int64) (string, error) {
+	var slug string
+	err := db.QueryRow(query, eid).Scan(&slug)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("sample slug, %v", err)
+	}
+	return slug, nil
+}
+
+// common to all backends, 0 if no election has slug
+func sampleElection(db sqlDB, query string, slug string) (int64, error) {
+	var eid int64
+	err := db.QueryRow(query, slug).Scan(&eid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("sample election, %v", err)
+	}
+	return eid, nil
+}
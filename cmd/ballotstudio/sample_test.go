@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio"
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestCleanSampleSlug(t *testing.T) {
+	for in, want := range map[string]string{"Kent-County-2026": "kent-county-2026", " nov26 ": "nov26", "ab": "", "-kent": "", "kent county": "", "kent/county": ""} {
+		got, err := cleanSampleSlug(in)
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("%q -> %q %v", in, got, err)
+		}
+	}
+}
+
+func TestBallotView(t *testing.T) {
+	var doc map[string]interface{}
+	err := json.Unmarshal([]byte(overlayTestDoc), &doc)
+	mtfail(t, err, "doc, %v", err)
+	bv := newBallotView(doc)
+	if bv.Title != "General Election" || bv.Name != "Test" || bv.Date != "2026-11-03" || len(bv.Instructions) == 0 {
+		t.Errorf("header %#v", bv)
+	}
+	if len(bv.Styles) != 1 || bv.Styles[0].Name != "Springfield" || len(bv.Styles[0].Contests) != 2 {
+		t.Fatalf("styles %#v", bv.Styles)
+	}
+	mayor := bv.Styles[0].Contests[0]
+	if mayor.Title != "Mayor" || mayor.Subtitle != "Vote for one" || mayor.VotesAllowed != 1 {
+		t.Errorf("contest %#v", mayor)
+	}
+	if mayor.Selections[0] != (selectionView{Id: "csel1", Name: "Alice Argyle", Parties: "Anklebiter Assembly"}) || mayor.Selections[1].Name != "Bob Brocade" {
+		t.Errorf("selections %#v", mayor.Selections)
+	}
+	if measure := bv.Styles[0].Contests[1]; measure.Selections[1].Name != "No" {
+		t.Errorf("measure %#v", measure)
+	}
+}
+
+func TestSampleBallot(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	templates, err := HtmlTemplateFS(ballotstudio.Templates, "gotemplates/*.html")
+	mtfail(t, err, "templates, %v", err)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}, templates: templates}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	other, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	owner := &login.User{Guid: 7}
+
+	setSlug := func(user *login.User, electionid int64, slug string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sh.handleElectionSample(rec, httptest.NewRequest("POST", "/election/1/sample", strings.NewReader(slug)), user, electionid)
+		return rec
+	}
+	get := func(path string, pdf bool) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		m := samplePathRe.FindStringSubmatch(path)
+		sh.handleSample(rec, httptest.NewRequest("GET", path, nil), m[1], pdf)
+		return rec
+	}
+	if rec := setSlug(&login.User{Guid: 8}, eid, "kent-2026"); rec.Code != 403 {
+		t.Errorf("not owner %d", rec.Code)
+	}
+	if rec := setSlug(owner, eid, "Kent 2026"); rec.Code != 400 {
+		t.Errorf("bad slug %d", rec.Code)
+	}
+	rec := setSlug(owner, eid, "Kent-2026")
+	var ss sampleSlugJSON
+	json.Unmarshal(rec.Body.Bytes(), &ss)
+	if rec.Code != 200 || ss.Slug != "kent-2026" || ss.Live {
+		t.Fatalf("set slug %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := setSlug(owner, other, "kent-2026"); rec.Code != 409 {
+		t.Errorf("taken %d", rec.Code)
+	}
+	if rec := get("/sample/kent-2026", false); rec.Code != 404 {
+		t.Errorf("draft sample %d", rec.Code)
+	}
+
+	for _, step := range [][2]string{{StateDraft, StateProofing}, {StateProofing, StateApproved}, {StateApproved, StatePublished}} {
+		_, err = edb.SetElectionState(eid, step[0], step[1])
+		mtfail(t, err, "state, %v", err)
+	}
+	rec = get("/sample/kent-2026", false)
+	body := rec.Body.String()
+	if rec.Code != 200 || !strings.Contains(body, "Alice Argyle") || !strings.Contains(body, "/sample/kent-2026.pdf") {
+		t.Fatalf("sample %d %s", rec.Code, body)
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "public") || rec.Header().Get("ETag") == "" {
+		t.Errorf("cache headers %v", rec.Header())
+	}
+	rec = get("/sample/kent-2026.pdf", true)
+	if rec.Code != 200 || !bytes.HasPrefix(rec.Body.Bytes(), []byte("%PDF")) {
+		t.Errorf("sample pdf %d", rec.Code)
+	}
+
+	// moving the page
+	if rec := setSlug(owner, eid, "kent-nov-2026"); rec.Code != 200 {
+		t.Errorf("new slug %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get("/sample/kent-2026", false); rec.Code != 404 {
+		t.Errorf("old slug %d", rec.Code)
+	}
+	if rec := setSlug(owner, other, "kent-2026"); rec.Code != 200 {
+		t.Errorf("freed slug %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -2,105 +2,463 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/brianolson/ballotstudio/draw"
 	"github.com/brianolson/ballotstudio/scan"
 	"github.com/brianolson/login/login"
 )
 
 func (sh *StudioHandler) handleElectionScanPOST(w http.ResponseWriter, r *http.Request, user *login.User, itemname string) {
-	imbytes := getImage(w, r)
+	custody, err := sh.scanCustody(r)
+	if err != nil {
+		jsonerr(w, 400, "%v", err)
+		return
+	}
+	imbytes, contentType, page := sh.getImage(w, r)
 	if imbytes == nil {
 		return
 	}
-	im, format, err := image.Decode(bytes.NewReader(imbytes))
-	if maybeerr(w, err, 400, "bad image, %v", err) {
+	im, _, err := image.Decode(bytes.NewReader(page))
+	if err != nil {
+		jsonerr(w, 400, "bad image, %v", err)
 		return
 	}
-	bothob, err := sh.getPdf(r.Context(), itemname, false)
+	// scans count against the election owner's quota, whoever uploads
+	// them; only staff admins are known to be admins by id alone
+	electionid, _ := strconv.ParseInt(itemname, 10, 64)
+	if er, _ := sh.edb.GetElection(electionid); er != nil && sh.overQuota(w, &login.User{Guid: er.Owner}, 0, int64(len(imbytes))) {
+		return
+	}
+
+	if sh.archiver != nil {
+		go sh.archiver.ArchiveImage(imbytes, r)
+	}
+
+	marked, interpreter, rev, err := sh.interpretScan(r.Context(), electionid, 0, im)
 	if err != nil {
 		he := err.(*httpError)
 		maybeerr(w, he.err, he.code, he.msg)
 		return
 	}
-	var bubbles scan.BubblesJson
-	err = json.Unmarshal(bothob.BubblesJson, &bubbles)
-	if maybeerr(w, err, 500, "bubble json decode, %v", err) {
+	mjson, _ := json.Marshal(marked)
+
+	// keep the upload as sent, and the revision it was read against, so it
+	// can be re-read the same way by a later interpreter
+	sr := scanRecord{
+		ElectionId:  electionid,
+		Image:       imbytes,
+		ContentType: contentType,
+		Interpreter: interpreter,
+		Result:      string(mjson),
+		Created:     time.Now().Unix(),
+		Custody:     custody,
+		Rev:         rev,
+	}
+	if user != nil {
+		sr.Owner = user.Guid
+	}
+	scanid, err := sh.edb.PutScan(sr)
+	if err != nil {
+		log.Printf("%s: scan store failed, %v", itemname, err)
+	} else {
+		w.Header().Set("X-Scan-Id", strconv.FormatInt(scanid, 10))
+		sh.fireWebhooks(webhookScan, electionid, map[string]interface{}{"scan": scanid, "interpreter": sr.Interpreter})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(mjson)
+}
+
+// longest custody field accepted
+const maxCustodyField = 200
+
+// scanCustody is ?device=&operator=&batch=&precinct= from a scan upload,
+// all required unless -scan-custody-optional
+func (sh *StudioHandler) scanCustody(r *http.Request) (custody scanCustody, err error) {
+	query := r.URL.Query()
+	var missing []string
+	for _, f := range []struct {
+		name string
+		v    *string
+	}{
+		{"device", &custody.Device},
+		{"operator", &custody.Operator},
+		{"batch", &custody.Batch},
+		{"precinct", &custody.Precinct},
+	} {
+		*f.v = strings.TrimSpace(query.Get(f.name))
+		if len(*f.v) > maxCustodyField {
+			return custody, fmt.Errorf("%s longer than %d", f.name, maxCustodyField)
+		}
+		if *f.v == "" {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) != 0 && !sh.scanCustodyOptional {
+		return custody, fmt.Errorf("scan needs chain of custody, missing %s", strings.Join(missing, ", "))
+	}
+	return custody, nil
+}
+
+// interpretScan reads the marks from a scanned image against revision rev of
+// the election (see scanLayout), and says which interpreter read them and the
+// revision they were read against.
+// errors are *httpError
+func (sh *StudioHandler) interpretScan(ctx context.Context, electionid int64, rev int, im image.Image) (marked map[string]map[string]bool, interpreter string, readRev int, err error) {
+	result, readRev, err := sh.readScan(ctx, electionid, rev, im)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return scan.MarkedFromReadings(result.Readings), result.Interpreter, readRev, nil
+}
+
+// readScan is interpretScan with how each bubble was read, for the overlay.
+// errors are *httpError
+func (sh *StudioHandler) readScan(ctx context.Context, electionid int64, rev int, im image.Image) (result *scan.Interpretation, readRev int, err error) {
+	bubbles, orig, readRev, err := sh.scanLayout(ctx, electionid, rev)
+	if err != nil {
+		return nil, 0, err
+	}
+	interpreter := sh.scanInterpreter
+	if interpreter == nil {
+		interpreter = scan.Local{}
+	}
+	result, err = interpreter.Interpret(ctx, bubbles, orig, im)
+	if errors.Is(err, scan.ErrUnavailable) {
+		return nil, 0, &httpError{503, "scan backend unavailable", err}
+	}
+	if err != nil {
+		return nil, 0, &httpError{500, "process err", err}
+	}
+	return
+}
+
+// scanLayout is the bubbles and first page of revision rev of the election as
+// drawn, to read a scan against, and the revision drawn. rev 0 is the latest.
+// An election with no revisions is drawn as it is now, and gives rev 0.
+// errors are *httpError
+func (sh *StudioHandler) scanLayout(ctx context.Context, electionid int64, rev int) (bubbles *scan.BubblesJson, orig image.Image, readRev int, err error) {
+	itemname := strconv.FormatInt(electionid, 10)
+	if _, err = sh.renderElection(ctx, itemname); err != nil {
 		return
 	}
-	pngbytes, err := sh.getPng(r.Context(), itemname, false)
+	if rev == 0 {
+		revs, err := sh.edb.ElectionRevisions(electionid)
+		if err != nil {
+			return nil, nil, 0, &httpError{500, "db revisions", err}
+		}
+		if len(revs) == 0 {
+			return sh.currentScanLayout(ctx, itemname)
+		}
+		rev = revs[len(revs)-1].Rev
+	}
+	rr, err := sh.edb.GetElectionRevision(electionid, rev)
+	if err != nil {
+		return nil, nil, 0, &httpError{500, "db revision", err}
+	}
+	if rr == nil {
+		return nil, nil, 0, &httpError{409, fmt.Sprintf("revision %d is gone", rev), errors.New("no such revision")}
+	}
+	bothob, err := sh.drawRevision(ctx, rr, draw.RenderOptions{})
+	if err != nil {
+		return
+	}
+	// only the bubbles are needed
+	bothob.Release()
+	bubbles, err = scan.ParseBubbles(bothob.BubblesJson)
+	if err != nil {
+		return nil, nil, 0, &httpError{500, "bubble json decode", err}
+	}
+	pngbytes, err := sh.revisionPng(ctx, rr, draw.RenderOptions{})
 	if err != nil {
-		he := err.(*httpError)
-		maybeerr(w, he.err, he.code, he.msg)
 		return
 	}
 	// TODO: detect which page was scanned (by barcode, header, match quality?)
 	orig, format, err := image.Decode(bytes.NewReader(pngbytes[0]))
-	if maybeerr(w, err, 500, "orig png decode (%s), %v", format, err) {
+	if err != nil {
+		return nil, nil, 0, &httpError{500, fmt.Sprintf("orig png decode (%s)", format), err}
+	}
+	return bubbles, orig, rev, nil
+}
+
+// currentScanLayout is scanLayout of an election with no revisions
+func (sh *StudioHandler) currentScanLayout(ctx context.Context, itemname string) (bubbles *scan.BubblesJson, orig image.Image, readRev int, err error) {
+	ctx, note := withStaleNote(ctx)
+	bothob, err := sh.getPdf(ctx, itemname, draw.RenderOptions{}, false)
+	if err != nil {
 		return
 	}
+	// only the bubbles are needed
+	bothob.Release()
+	if note.stale {
+		// the document may have changed since, marks must be read against its current layout
+		return nil, nil, 0, &httpError{503, "draw backend unavailable", draw.ErrUnavailable}
+	}
+	bubbles, err = scan.ParseBubbles(bothob.BubblesJson)
+	if err != nil {
+		return nil, nil, 0, &httpError{500, "bubble json decode", err}
+	}
+	pngbytes, err := sh.getPng(ctx, itemname, draw.RenderOptions{}, false)
+	if err != nil {
+		return
+	}
+	orig, format, err := image.Decode(bytes.NewReader(pngbytes[0]))
+	if err != nil {
+		return nil, nil, 0, &httpError{500, fmt.Sprintf("orig png decode (%s)", format), err}
+	}
+	return bubbles, orig, 0, nil
+}
 
-	if sh.archiver != nil {
-		go sh.archiver.ArchiveImage(imbytes, r)
+// scanImage is a stored scan's image, the first page of a PDF upload
+func scanImage(ctx context.Context, sr *scanRecord) (image.Image, error) {
+	page := sr.Image
+	if sniffScanType(sr.Image) == "application/pdf" {
+		pages, err := draw.PdfToPng(ctx, sr.Image)
+		if err != nil {
+			return nil, fmt.Errorf("pdf to png, %v", err)
+		}
+		if len(pages) == 0 {
+			return nil, errors.New("pdf has no pages")
+		}
+		page = pages[0]
 	}
+	im, _, err := image.Decode(bytes.NewReader(page))
+	return im, err
+}
+
+// one scan whose result differs under the current interpreter
+type rescanChange struct {
+	ScanId      int64                      `json:"scan"`
+	Interpreter string                     `json:"interpreter"`
+	Before      map[string]map[string]bool `json:"before"`
+	After       map[string]map[string]bool `json:"after"`
+}
+
+type rescanReport struct {
+	ElectionId int64 `json:"election"`
+	// Interpreter is what read the scans this time, empty if none were read
+	Interpreter string         `json:"interpreter"`
+	Scans       int            `json:"scans"`
+	Changed     []rescanChange `json:"changed"`
+	Errors      []string       `json:"errors,omitempty"`
+	Updated     bool           `json:"updated"`
+}
 
-	var s scan.Scanner
-	s.Bj = bubbles
-	s.SetOrigImage(orig)
-	marked, err := s.ProcessScannedImage(im)
-	if maybeerr(w, err, 500, "process err: %v", err) {
+// POST /election/{id}/rescan[?update=1]
+// Re-read all stored scans for an election with the current interpreter,
+// each against the revision of the election it was first read against, and
+// report which results changed. With update=1 the new results are stored.
+func (sh *StudioHandler) handleElectionRescan(w http.ResponseWriter, r *http.Request, user *login.User, itemname string, electionid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 400, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	start := time.Now()
+	update := qbool(r.URL.Query().Get("update"))
+	sids, err := sh.edb.ScansForElection(electionid)
+	if maybeerr(w, err, 500, "db scans, %v", err) {
+		return
+	}
+	report := rescanReport{
+		ElectionId: electionid,
+		Scans:      len(sids),
+		Changed:    []rescanChange{},
+		Updated:    update,
+	}
+	for _, sid := range sids {
+		if r.Context().Err() != nil {
+			return
+		}
+		sr, err := sh.edb.GetScan(sid)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("scan %d: get, %v", sid, err))
+			continue
+		}
+		im, err := scanImage(r.Context(), sr)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("scan %d: bad image, %v", sid, err))
+			continue
+		}
+		marked, interpreter, _, err := sh.interpretScan(r.Context(), electionid, sr.Rev, im)
+		if err != nil {
+			he := err.(*httpError)
+			report.Errors = append(report.Errors, fmt.Sprintf("scan %d: %s, %v", sid, he.msg, he.err))
+			continue
+		}
+		report.Interpreter = interpreter
+		mjson, _ := json.Marshal(marked)
+		if string(mjson) == sr.Result {
+			if update && sr.Interpreter != interpreter {
+				err = sh.edb.UpdateScanResult(sid, interpreter, sr.Result)
+			}
+		} else {
+			var before map[string]map[string]bool
+			json.Unmarshal([]byte(sr.Result), &before)
+			report.Changed = append(report.Changed, rescanChange{
+				ScanId:      sid,
+				Interpreter: sr.Interpreter,
+				Before:      before,
+				After:       marked,
+			})
+			if update {
+				err = sh.edb.UpdateScanResult(sid, interpreter, string(mjson))
+			}
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("scan %d: update, %v", sid, err))
+		}
+	}
+	sh.notifySlow(user.Guid, time.Since(start), fmt.Sprintf("BallotStudio: rescan of election %d done", electionid),
+		fmt.Sprintf("Re-reading %d scans of election %d is done. %d results changed, %d errors.\n", report.Scans, electionid, len(report.Changed), len(report.Errors)))
+	out, err := json.Marshal(report)
+	if maybeerr(w, err, 500, "json ret prep") {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	mjson, _ := json.Marshal(marked)
-	w.Write(mjson)
+	w.Write(out)
+}
+
+// DefaultScanMaxBytes is the default for -scan-max-bytes
+const DefaultScanMaxBytes = 10000000
+
+// scan upload formats, by magic bytes
+var scanMagic = []struct {
+	magic       string
+	contentType string
+}{
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"II*\x00", "image/tiff"},
+	{"MM\x00*", "image/tiff"},
+	{"%PDF-", "application/pdf"},
+}
+
+// sniffScanType returns the content type by magic bytes, or "" if unknown
+func sniffScanType(b []byte) string {
+	for _, sm := range scanMagic {
+		if bytes.HasPrefix(b, []byte(sm.magic)) {
+			return sm.contentType
+		}
+	}
+	return ""
 }
 
-// get image whether it is main POST body or in a multipart section
-func getImage(w http.ResponseWriter, r *http.Request) (imbytes []byte) {
+// get image whether it is main POST body or in a multipart section.
+// Checks size and type. imbytes is the upload as sent, with its content type,
+// and page is it as JPEG or PNG, the first page converted if it's a PDF.
+// On error writes a JSON error response and returns nil.
+func (sh *StudioHandler) getImage(w http.ResponseWriter, r *http.Request) (imbytes []byte, contentType string, page []byte) {
+	maxBytes := sh.scanMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultScanMaxBytes
+	}
+	if r.ContentLength > maxBytes {
+		jsonerr(w, http.StatusRequestEntityTooLarge, "upload too large, max %d bytes", maxBytes)
+		return nil, "", nil
+	}
 	var err error
+	brc := http.MaxBytesReader(w, r.Body, maxBytes)
 	contenttype := r.Header.Get("Content-Type")
 	if isImage(contenttype) {
-		brc := http.MaxBytesReader(w, r.Body, 10000000)
 		imbytes, err = ioutil.ReadAll(brc)
-		if maybeerr(w, err, 400, "bad image, %v", err) {
-			return
+		if err != nil {
+			uploadReadErr(w, err, maxBytes)
+			return nil, "", nil
 		}
-		return
-	}
+	} else if strings.HasPrefix(contenttype, "multipart/") {
+		r.Body = brc
+		mpreader, err := r.MultipartReader()
+		if err != nil {
+			jsonerr(w, 400, "bad multipart, %v", err)
+			return nil, "", nil
+		}
+		for imbytes == nil {
+			part, err := mpreader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				uploadReadErr(w, err, maxBytes)
+				return nil, "", nil
+			}
 
-	mpreader, err := r.MultipartReader()
-	if maybeerr(w, err, 400, "bad multipart, %v", err) {
-		return
+			//log.Printf("got part cd=%v fn=%v form=%v", part.Header.Get("Content-Disposition"), part.FileName(), part.FormName())
+			if isImage(part.Header.Get("Content-Type")) {
+				imbytes, err = ioutil.ReadAll(part)
+				if err != nil {
+					uploadReadErr(w, err, maxBytes)
+					return nil, "", nil
+				}
+			}
+		}
+	} else {
+		jsonerr(w, http.StatusUnsupportedMediaType, "unsupported Content-Type %#v, want an image or multipart/form-data", contenttype)
+		return nil, "", nil
 	}
-	for true {
-		part, err := mpreader.NextPart()
-		if err == io.EOF {
-			break
+	if len(imbytes) == 0 {
+		jsonerr(w, 400, "no image in upload")
+		return nil, "", nil
+	}
+
+	// don't trust the declared type, check what it really is
+	contentType = sniffScanType(imbytes)
+	switch contentType {
+	case "image/jpeg", "image/png":
+		return imbytes, contentType, imbytes
+	case "application/pdf":
+		pages, err := draw.PdfToPng(r.Context(), imbytes)
+		if errors.Is(err, draw.ErrPngBusy) {
+			w.Header().Set("Retry-After", "5")
+			jsonerr(w, http.StatusServiceUnavailable, "too many PDF conversions waiting, try again soon")
+			return nil, "", nil
 		}
-		if maybeerr(w, err, 400, "bad multipart part, %v", err) {
-			return
+		if err != nil || len(pages) == 0 {
+			log.Printf("scan pdf to png, %v", err)
+			jsonerr(w, http.StatusUnprocessableEntity, "could not convert PDF upload to image")
+			return nil, "", nil
 		}
+		// TODO: multi-page PDF scans
+		return imbytes, contentType, pages[0]
+	case "image/tiff":
+		jsonerr(w, http.StatusUnsupportedMediaType, "TIFF scans are not supported, send JPEG, PNG or PDF")
+		return nil, "", nil
+	default:
+		jsonerr(w, http.StatusUnsupportedMediaType, "unrecognized image data, send JPEG, PNG or PDF")
+		return nil, "", nil
+	}
+}
 
-		//log.Printf("got part cd=%v fn=%v form=%v", part.Header.Get("Content-Disposition"), part.FileName(), part.FormName())
-		if isImage(part.Header.Get("Content-Type")) {
-			imbytes, err = ioutil.ReadAll(part)
-			if maybeerr(w, err, 400, "bad multipart image, %v", err) {
-				return
-			}
-			return
-		}
+func uploadReadErr(w http.ResponseWriter, err error, maxBytes int64) {
+	// http.MaxBytesReader doesn't have a distinct error type (yet)
+	if strings.Contains(err.Error(), "request body too large") {
+		jsonerr(w, http.StatusRequestEntityTooLarge, "upload too large, max %d bytes", maxBytes)
+		return
 	}
-	// got nothing; return nil,nil
-	return
+	jsonerr(w, 400, "bad upload, %v", err)
 }
 
 func isImage(contentType string) bool {
-	return strings.HasPrefix(contentType, "image/")
+	return strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "application/pdf")
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/login/login"
+)
+
+// votes for the first bubble it's sent, whatever the scan
+type firstBubbleInterpreter struct{}
+
+func (firstBubbleInterpreter) Interpret(ctx context.Context, bj *scan.BubblesJson, orig, scanned image.Image) (*scan.Interpretation, error) {
+	if len(bj.Bubbles) == 0 {
+		return nil, errors.New("no bubbles")
+	}
+	return &scan.Interpretation{
+		Interpreter: "external-2",
+		Readings:    []scan.BubbleReading{{ContestId: "ccont1", SelectionId: "csel1", Dark: 9, Samples: 10, Marked: true}},
+	}, nil
+}
+
+func TestScanUpload(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	backend := httptest.NewServer(&scan.Handler{Interpreter: firstBubbleInterpreter{}})
+	defer backend.Close()
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}, scanInterpreter: scan.NewClient(backend.URL)}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	itemname := strconv.FormatInt(eid, 10)
+
+	var jb bytes.Buffer
+	err = jpeg.Encode(&jb, image.NewGray(image.Rect(0, 0, 100, 130)), nil)
+	mtfail(t, err, "jpeg, %v", err)
+	custody := "?device=scanner-3&operator=pat&batch=12&precinct=Ward+4"
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/election/1/scan"+custody, bytes.NewReader(jb.Bytes()))
+		req.Header.Set("Content-Type", "image/jpeg")
+		rec := httptest.NewRecorder()
+		sh.handleElectionScanPOST(rec, req, &login.User{Guid: 8}, itemname)
+		return rec
+	}
+	rec := post()
+	if rec.Code != 200 || rec.Body.String() != `{"ccont1":{"csel1":true}}` {
+		t.Fatalf("scan %d %s", rec.Code, rec.Body.String())
+	}
+	sid, _ := strconv.ParseInt(rec.Header().Get("X-Scan-Id"), 10, 64)
+	sr, err := edb.GetScan(sid)
+	mtfail(t, err, "get scan, %v", err)
+	if sr.Interpreter != "external-2" {
+		t.Errorf("stored interpreter %q", sr.Interpreter)
+	}
+	if sr.Custody != (scanCustody{"scanner-3", "pat", "12", "Ward 4"}) {
+		t.Errorf("stored custody %#v", sr.Custody)
+	}
+
+	custody = "?device=scanner-3&batch=12"
+	if rec := post(); rec.Code != 400 || !strings.Contains(rec.Body.String(), "operator, precinct") {
+		t.Errorf("no operator or precinct %d %s", rec.Code, rec.Body.String())
+	}
+	sh.scanCustodyOptional = true
+	if rec := post(); rec.Code != 200 {
+		t.Errorf("custody optional %d %s", rec.Code, rec.Body.String())
+	}
+	custody = ""
+
+	backend.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", 503)
+	})
+	if rec := post(); rec.Code != 503 {
+		t.Errorf("backend down %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// marks every selection of the layout it's sent, so its results follow the layout
+type layoutInterpreter struct{}
+
+func (layoutInterpreter) Interpret(ctx context.Context, bj *scan.BubblesJson, orig, scanned image.Image) (*scan.Interpretation, error) {
+	result := &scan.Interpretation{Interpreter: "layout-1"}
+	for cid, selections := range bj.Bubbles[0] {
+		for sid := range selections {
+			result.Readings = append(result.Readings, scan.BubbleReading{ContestId: cid, SelectionId: sid, Marked: true})
+		}
+	}
+	return result, nil
+}
+
+func TestRescan(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}, scanInterpreter: layoutInterpreter{}, scanCustodyOptional: true}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	itemname := strconv.FormatInt(eid, 10)
+	owner := &login.User{Guid: 7}
+
+	var jb bytes.Buffer
+	err = jpeg.Encode(&jb, image.NewGray(image.Rect(0, 0, 100, 130)), nil)
+	mtfail(t, err, "jpeg, %v", err)
+	req := httptest.NewRequest("POST", "/election/1/scan", bytes.NewReader(jb.Bytes()))
+	req.Header.Set("Content-Type", "image/jpeg")
+	rec := httptest.NewRecorder()
+	sh.handleElectionScanPOST(rec, req, owner, itemname)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"csel2":true`) {
+		t.Fatalf("scan %d %s", rec.Code, rec.Body.String())
+	}
+	sid, _ := strconv.ParseInt(rec.Header().Get("X-Scan-Id"), 10, 64)
+	sr, err := edb.GetScan(sid)
+	mtfail(t, err, "get scan, %v", err)
+	if sr.Rev != 1 || sr.ContentType != "image/jpeg" || !bytes.Equal(sr.Image, jb.Bytes()) {
+		t.Errorf("stored rev %d %s, %d bytes", sr.Rev, sr.ContentType, len(sr.Image))
+	}
+
+	// a later edit doesn't change what the ballot was printed from
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: strings.Replace(overlayTestDoc, `"csel2"`, `"csel3"`, 1)})
+	mtfail(t, err, "put election, %v", err)
+	rescan := func() rescanReport {
+		rec := httptest.NewRecorder()
+		sh.handleElectionRescan(rec, httptest.NewRequest("POST", "/election/1/rescan?update=1", nil), owner, itemname, eid)
+		var report rescanReport
+		if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &report) != nil {
+			t.Fatalf("rescan %d %s", rec.Code, rec.Body.String())
+		}
+		return report
+	}
+	if report := rescan(); report.Scans != 1 || len(report.Changed) != 0 || len(report.Errors) != 0 || report.Interpreter != "layout-1" {
+		t.Errorf("rescan after edit %#v", report)
+	}
+	sr, err = edb.GetScan(sid)
+	mtfail(t, err, "get scan, %v", err)
+	if !strings.Contains(sr.Result, `"csel2":true`) {
+		t.Errorf("updated result %s", sr.Result)
+	}
+
+	// pruning keeps the scanned revision
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: strings.Replace(overlayTestDoc, `"csel2"`, `"csel4"`, 1)})
+	mtfail(t, err, "put election, %v", err)
+	err = edb.PruneRevisions(eid, 1)
+	mtfail(t, err, "prune, %v", err)
+	revs, err := edb.ElectionRevisions(eid)
+	mtfail(t, err, "revisions, %v", err)
+	if len(revs) != 2 || revs[0].Rev != 1 || revs[1].Rev != 3 {
+		t.Errorf("pruned revisions %#v", revs)
+	}
+	if report := rescan(); len(report.Changed) != 0 || len(report.Errors) != 0 {
+		t.Errorf("rescan after prune %#v", report)
+	}
+}
+
+func TestSniffScanType(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg"},
+		{"\x89PNG\r\n\x1a\n\x00\x00", "image/png"},
+		{"%PDF-1.4\n", "application/pdf"},
+		{"II*\x00\x08\x00", "image/tiff"},
+		{"MM\x00*\x00\x08", "image/tiff"},
+		{"GIF89a", ""},
+		{"\x89PNG", ""},
+		{"", ""},
+	} {
+		if got := sniffScanType([]byte(tc.data)); got != tc.want {
+			t.Errorf("sniff %q = %q, want %q", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestGetImage(t *testing.T) {
+	var jb, pb bytes.Buffer
+	err := jpeg.Encode(&jb, image.NewGray(image.Rect(0, 0, 10, 13)), nil)
+	mtfail(t, err, "jpeg, %v", err)
+	err = png.Encode(&pb, image.NewGray(image.Rect(0, 0, 10, 13)))
+	mtfail(t, err, "png, %v", err)
+	pdf := []byte("%PDF-1.4\n% not really\n")
+
+	// no pdftoppm in tests, page 1 of any PDF is pb
+	pool := draw.PngConversions
+	defer func() { draw.PngConversions = pool }()
+	draw.PngConversions = &draw.PngPool{Convert: func(ctx context.Context, data []byte) ([][]byte, error) {
+		if !bytes.HasPrefix(data, []byte("%PDF-1.4\n% not really")) {
+			return nil, errors.New("not a pdf")
+		}
+		return [][]byte{pb.Bytes(), jb.Bytes()}, nil
+	}}
+
+	multipartBody := func(contentType string, data []byte) (string, []byte) {
+		var mb bytes.Buffer
+		mw := multipart.NewWriter(&mb)
+		fw, err := mw.CreateFormField("notes")
+		mtfail(t, err, "multipart, %v", err)
+		fw.Write([]byte("first sheet"))
+		fw, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="scan"; filename="scan"`},
+			"Content-Type":        {contentType},
+		})
+		mtfail(t, err, "multipart, %v", err)
+		fw.Write(data)
+		mw.Close()
+		return mw.FormDataContentType(), mb.Bytes()
+	}
+	mpType, mpPng := multipartBody("image/png", pb.Bytes())
+	mpPdfType, mpPdf := multipartBody("application/pdf", pdf)
+
+	const maxBytes = 2000
+	big := append(append([]byte{}, jb.Bytes()...), make([]byte, maxBytes)...)
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		unsized     bool // sent chunked, no Content-Length
+		code        int  // 0 for no error written
+		errText     string
+		wantUpload  []byte // stored as sent, nil for the body
+		wantType    string
+		wantPage    []byte
+	}{
+		{name: "jpeg", contentType: "image/jpeg", body: jb.Bytes(), wantType: "image/jpeg", wantPage: jb.Bytes()},
+		{name: "png", contentType: "image/png", body: pb.Bytes(), wantType: "image/png", wantPage: pb.Bytes()},
+		{name: "png as jpeg", contentType: "image/jpeg", body: pb.Bytes(), wantType: "image/png", wantPage: pb.Bytes()},
+		{name: "multipart png", contentType: mpType, body: mpPng, wantUpload: pb.Bytes(), wantType: "image/png", wantPage: pb.Bytes()},
+		{name: "pdf", contentType: "application/pdf", body: pdf, wantType: "application/pdf", wantPage: pb.Bytes()},
+		{name: "multipart pdf", contentType: mpPdfType, body: mpPdf, wantUpload: pdf, wantType: "application/pdf", wantPage: pb.Bytes()},
+		{name: "bad pdf", contentType: "application/pdf", body: []byte("%PDF-2.0\n"), code: http.StatusUnprocessableEntity, errText: "could not convert"},
+		{name: "unknown", contentType: "image/png", body: []byte("GIF89a\x01\x00"), code: http.StatusUnsupportedMediaType, errText: "unrecognized image data"},
+		{name: "tiff", contentType: "image/tiff", body: []byte("II*\x00\x08\x00\x00\x00"), code: http.StatusUnsupportedMediaType, errText: "TIFF"},
+		{name: "not an image", contentType: "text/plain", body: []byte("hello"), code: http.StatusUnsupportedMediaType, errText: "unsupported Content-Type"},
+		{name: "oversize", contentType: "image/jpeg", body: big, code: http.StatusRequestEntityTooLarge, errText: "too large"},
+		{name: "oversize unsized", contentType: "image/jpeg", body: big, unsized: true, code: http.StatusRequestEntityTooLarge, errText: "too large"},
+		{name: "empty", contentType: "image/jpeg", body: nil, code: 400, errText: "no image"},
+		{name: "multipart no image", contentType: "multipart/form-data; boundary=x", body: []byte("--x--\r\n"), code: 400, errText: "no image"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sh := StudioHandler{scanMaxBytes: maxBytes}
+			req := httptest.NewRequest("POST", "/election/1/scan", bytes.NewReader(tc.body))
+			if tc.unsized {
+				req.ContentLength = -1
+			}
+			req.Header.Set("Content-Type", tc.contentType)
+			rec := httptest.NewRecorder()
+			imbytes, contentType, page := sh.getImage(rec, req)
+			if tc.code != 0 {
+				if imbytes != nil || rec.Code != tc.code || !strings.Contains(rec.Body.String(), tc.errText) {
+					t.Errorf("got %d %s, want %d %q", rec.Code, rec.Body.String(), tc.code, tc.errText)
+				}
+				return
+			}
+			if rec.Body.Len() != 0 {
+				t.Fatalf("error %d %s", rec.Code, rec.Body.String())
+			}
+			want := tc.wantUpload
+			if want == nil {
+				want = tc.body
+			}
+			if !bytes.Equal(imbytes, want) || contentType != tc.wantType || !bytes.Equal(page, tc.wantPage) {
+				t.Errorf("got %d bytes %q, page %d bytes; want %d bytes %q, page %d bytes", len(imbytes), contentType, len(page), len(want), tc.wantType, len(tc.wantPage))
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+// `ballotstudio scan -bubbles bubbles.json -orig ballot.pdf -img sheet1.png [more.png ...]`
+// reads marks from scanned ballot images without the server, with
+// -scan-backend if set or the built in interpreter, e.g. to check how well
+// it reads a batch of test scans. -orig is the page as drawn, a PNG or the
+// ballot PDF (its first page is used, as for uploads). Scans may be JPEG,
+// PNG or PDF. It prints the votes as cast vote records JSON, like
+// GET /election/{id}/cvr.json without the custody fields. A scan that
+// can't be read gets an error in its record, and the exit status is 1.
+
+// one scanned image's votes
+type scanFileRecord struct {
+	Ballot      int    `json:"ballot"`
+	File        string `json:"file"`
+	Interpreter string `json:"interpreter,omitempty"`
+	ImageSha256 string `json:"image_sha256,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	// contest id -> selection id -> marked
+	Votes map[string]map[string]bool `json:"votes,omitempty"`
+}
+
+type scanFileExport struct {
+	Records []scanFileRecord `json:"records"`
+}
+
+// readScanFile decodes a JPEG, PNG or the first page of a PDF
+func readScanFile(ctx context.Context, fname string) (im image.Image, imbytes []byte, err error) {
+	imbytes, err = ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	pngbytes := imbytes
+	switch sniffScanType(imbytes) {
+	case "image/jpeg", "image/png":
+	case "application/pdf":
+		pages, err := draw.PdfToPng(ctx, imbytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: pdf to png, %v", fname, err)
+		}
+		if len(pages) == 0 {
+			return nil, nil, fmt.Errorf("%s: pdf has no pages", fname)
+		}
+		pngbytes = pages[0]
+	default:
+		return nil, nil, fmt.Errorf("%s: not JPEG, PNG or PDF", fname)
+	}
+	im, _, err = image.Decode(bytes.NewReader(pngbytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: bad image, %v", fname, err)
+	}
+	return im, imbytes, nil
+}
+
+// runScanCommand reads each of images against bubblesPath and origPath and
+// writes their records to out. ok is false if any couldn't be read.
+func runScanCommand(ctx context.Context, interpreter scan.Interpreter, bubblesPath, origPath string, images []string, out io.Writer) (ok bool, err error) {
+	if bubblesPath == "" || origPath == "" || len(images) == 0 {
+		return false, fmt.Errorf("scan needs -bubbles, -orig and -img")
+	}
+	bj, err := ioutil.ReadFile(bubblesPath)
+	if err != nil {
+		return false, err
+	}
+	bubbles, err := scan.ParseBubbles(bj)
+	if err != nil {
+		return false, fmt.Errorf("%s: bad bubbles json, %v", bubblesPath, err)
+	}
+	orig, _, err := readScanFile(ctx, origPath)
+	if err != nil {
+		return false, err
+	}
+	export := scanFileExport{Records: make([]scanFileRecord, 0, len(images))}
+	ok = true
+	for i, fname := range images {
+		rec := scanFileRecord{Ballot: i + 1, File: fname}
+		im, imbytes, err := readScanFile(ctx, fname)
+		if err == nil {
+			rec.ImageSha256 = sha256Hex(imbytes)
+			var result *scan.Interpretation
+			result, err = interpreter.Interpret(ctx, bubbles, orig, im)
+			if err == nil {
+				rec.Interpreter = result.Interpreter
+				rec.Votes = scan.MarkedFromReadings(result.Readings)
+			}
+		}
+		if err != nil {
+			rec.Error = err.Error()
+			ok = false
+		}
+		export.Records = append(export.Records, rec)
+	}
+	return ok, json.NewEncoder(out).Encode(export)
+}
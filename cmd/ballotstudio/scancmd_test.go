@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanCommand(t *testing.T) {
+	dir := t.TempDir()
+	bubbles := filepath.Join(dir, "bubbles.json")
+	err := ioutil.WriteFile(bubbles, []byte(`{"bubbles": [{"ccont1": {"csel1": [1, 2, 3, 4]}}]}`), 0644)
+	mtfail(t, err, "write bubbles, %v", err)
+	var pb bytes.Buffer
+	err = png.Encode(&pb, image.NewGray(image.Rect(0, 0, 100, 130)))
+	mtfail(t, err, "png, %v", err)
+	orig := filepath.Join(dir, "orig.png")
+	sheet := filepath.Join(dir, "sheet1.png")
+	for _, fname := range []string{orig, sheet} {
+		err = ioutil.WriteFile(fname, pb.Bytes(), 0644)
+		mtfail(t, err, "write %s, %v", fname, err)
+	}
+	notImage := filepath.Join(dir, "notes.txt")
+	err = ioutil.WriteFile(notImage, []byte("hello"), 0644)
+	mtfail(t, err, "write notes, %v", err)
+
+	var out bytes.Buffer
+	ok, err := runScanCommand(context.Background(), firstBubbleInterpreter{}, bubbles, orig, []string{sheet, notImage}, &out)
+	if ok || err != nil {
+		t.Errorf("scan ok=%v, %v", ok, err)
+	}
+	var export scanFileExport
+	err = json.Unmarshal(out.Bytes(), &export)
+	mtfail(t, err, "output %s, %v", out.String(), err)
+	if len(export.Records) != 2 {
+		t.Fatalf("%d records for 2 images", len(export.Records))
+	}
+	first := export.Records[0]
+	if first.Ballot != 1 || first.Interpreter != "external-2" || !first.Votes["ccont1"]["csel1"] || first.ImageSha256 != sha256Hex(pb.Bytes()) {
+		t.Errorf("first record %#v", first)
+	}
+	if export.Records[1].Error == "" || export.Records[1].Votes != nil {
+		t.Errorf("unreadable image record %#v", export.Records[1])
+	}
+
+	if _, err = runScanCommand(context.Background(), firstBubbleInterpreter{}, bubbles, "", []string{sheet}, &out); err == nil {
+		t.Errorf("no error without -orig")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/login/login"
+)
+
+// GET /scan/{scanid}/overlay.png is the stored scan with each bubble target
+// outlined where the interpreter looked for it, colored by what it decided,
+// and labeled with the percent of sampled pixels that were dark:
+// green marked, orange partly filled but not counted, blue empty.
+// It is read again with the current interpreter and election layout; if that
+// disagrees with the stored result there's a Warning header, see /rescan.
+
+var (
+	overlayMarked   = color.RGBA{0x00, 0xb0, 0x00, 0xff}
+	overlayDoubtful = color.RGBA{0xff, 0x8c, 0x00, 0xff}
+	overlayEmpty    = color.RGBA{0x20, 0x60, 0xff, 0xff}
+)
+
+// fill fraction at or over which an unmarked bubble is drawn as doubtful
+const overlayDoubtfulFill = 0.3
+
+const overlayWarning = `299 ballotstudio "stored result differs from this reading, see /election/%d/rescan"`
+
+func (sh *StudioHandler) handleScanOverlay(w http.ResponseWriter, r *http.Request, user *login.User, scanid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	sr, err := sh.edb.GetScan(scanid)
+	if maybeerr(w, err, 404, "no scan") {
+		return
+	}
+	er, err := sh.edb.GetElection(sr.ElectionId)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	// the election owner, or whoever uploaded it
+	if er.Owner != user.Guid && (sr.Owner == 0 || sr.Owner != user.Guid) {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	im, err := scanImage(r.Context(), sr)
+	if maybeerr(w, err, 500, "bad stored image, %v", err) {
+		return
+	}
+	result, _, err := sh.readScan(r.Context(), sr.ElectionId, sr.Rev, im)
+	if err != nil {
+		he := err.(*httpError)
+		maybeerr(w, he.err, he.code, he.msg)
+		return
+	}
+	out, err := scanOverlay(im, result.Readings)
+	if maybeerr(w, err, 500, "png, %v", err) {
+		return
+	}
+	mjson, _ := json.Marshal(scan.MarkedFromReadings(result.Readings))
+	if string(mjson) != sr.Result {
+		w.Header().Set("Warning", fmt.Sprintf(overlayWarning, sr.ElectionId))
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Scan-Interpreter", result.Interpreter)
+	w.WriteHeader(200)
+	w.Write(out)
+}
+
+// scanOverlay draws readings over a copy of im, as PNG
+func scanOverlay(im image.Image, readings []scan.BubbleReading) ([]byte, error) {
+	b := im.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out.Set(x, y, im.At(x, y))
+		}
+	}
+	for _, br := range readings {
+		c := overlayEmpty
+		if br.Marked {
+			c = overlayMarked
+		} else if br.Fill() >= overlayDoubtfulFill {
+			c = overlayDoubtful
+		}
+		for i := range br.Corners {
+			overlayLine(out, br.Corners[i], br.Corners[(i+1)%4], c)
+		}
+		// label to the right of the box, about as tall as it
+		height := math.Hypot(br.Corners[3].X-br.Corners[0].X, br.Corners[3].Y-br.Corners[0].Y)
+		scale := int(height / 8)
+		if scale < 1 {
+			scale = 1
+		}
+		label := fmt.Sprintf("%d%%", int(math.Round(br.Fill()*100)))
+		x := int(br.Corners[1].X) + 2*scale
+		y := int(br.Corners[1].Y)
+		labelBox := image.Rect(x-scale, y-scale, x+(6*len(label)+1)*scale, y+8*scale)
+		for ly := labelBox.Min.Y; ly < labelBox.Max.Y; ly++ {
+			for lx := labelBox.Min.X; lx < labelBox.Max.X; lx++ {
+				out.Set(lx, ly, color.White)
+			}
+		}
+		draw.PutText(out, x, y, scale, c, label)
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, out)
+	return buf.Bytes(), err
+}
+
+// overlayLine draws a two pixel wide line from a to b
+func overlayLine(im *image.RGBA, a, b scan.FPoint, c color.Color) {
+	steps := int(math.Ceil(math.Max(math.Abs(b.X-a.X), math.Abs(b.Y-a.Y))))
+	if steps == 0 {
+		steps = 1
+	}
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		x := int(math.Round(a.X + (b.X-a.X)*t))
+		y := int(math.Round(a.Y + (b.Y-a.Y)*t))
+		im.Set(x, y, c)
+		im.Set(x+1, y, c)
+		im.Set(x, y+1, c)
+		im.Set(x+1, y+1, c)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/login/login"
+)
+
+// enough on the page for the scanner to line up the scan, like draw's goRenderTestDoc
+const overlayTestDoc = `{
+  "GpUnit": [{"@id": "gpunit1", "Name": "Springfield"}],
+  "Party": [{"@id": "party1", "Name": "Anklebiter Assembly"}],
+  "Header": [{"@id": "hdr1", "Name": "Instructions"}],
+  "Election": [{
+    "Name": "Test", "Type": "general", "StartDate": "2026-11-03", "EndDate": "2026-11-03",
+    "Candidate": [{"@id": "cand1", "BallotName": "Alice Argyle"}, {"@id": "cand2", "BallotName": "Bob Brocade"}],
+    "Contest": [
+      {"@id": "ccont1", "@type": "ElectionResults.CandidateContest", "BallotTitle": "Mayor", "BallotSubTitle": "Vote for one", "VotesAllowed": 1, "ElectionDistrictId": "gpunit1",
+       "ContestSelection": [
+         {"@id": "csel1", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["cand1"], "EndorsementPartyIds": ["party1"]},
+         {"@id": "csel2", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["cand2"]}
+       ]},
+      {"@id": "bmc1", "@type": "ElectionResults.BallotMeasureContest", "BallotTitle": "Measure A: a rather long title that has to wrap", "ElectionDistrictId": "gpunit1",
+       "ContestSelection": [
+         {"@id": "bms1", "@type": "ElectionResults.BallotMeasureSelection", "Selection": "Yes"},
+         {"@id": "bms2", "@type": "ElectionResults.BallotMeasureSelection", "Selection": "No"}
+       ]}
+    ],
+    "BallotStyle": [{"GpUnitIds": ["gpunit1"], "OrderedContent": [
+      {"@type": "ElectionResults.OrderedHeader", "HeaderId": "hdr1"},
+      {"@type": "ElectionResults.OrderedContest", "ContestId": "ccont1"},
+      {"@type": "ElectionResults.OrderedContest", "ContestId": "bmc1"}
+    ]}]
+  }]
+}`
+
+func TestScanOverlay(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	itemname := strconv.FormatInt(eid, 10)
+
+	// mark Bob on the rendered page, as a scanner would send it
+	bothob, err := sh.getPdf(context.Background(), itemname, draw.RenderOptions{}, false)
+	mtfail(t, err, "render, %v", err)
+	var bj scan.BubblesJson
+	json.Unmarshal(bothob.BubblesJson, &bj)
+	pages, err := sh.getPng(context.Background(), itemname, draw.RenderOptions{}, false)
+	mtfail(t, err, "png, %v", err)
+	orig, _, err := image.Decode(bytes.NewReader(pages[0]))
+	mtfail(t, err, "decode, %v", err)
+	marked := image.NewRGBA(orig.Bounds())
+	for y := 0; y < marked.Rect.Dy(); y++ {
+		for x := 0; x < marked.Rect.Dx(); x++ {
+			marked.Set(x, y, orig.At(x, y))
+		}
+	}
+	scale := float64(marked.Rect.Dx()) / bj.DrawSettings.PageSize[0]
+	pageHeight := bj.DrawSettings.PageSize[1]
+	xywh := bj.Bubbles[0]["ccont1"]["csel2"]
+	for y := int((pageHeight - xywh[1] - xywh[3]) * scale); y < int((pageHeight-xywh[1])*scale); y++ {
+		for x := int(xywh[0] * scale); x < int((xywh[0]+xywh[2])*scale); x++ {
+			marked.Set(x, y, color.Black)
+		}
+	}
+	var jb bytes.Buffer
+	err = jpeg.Encode(&jb, marked, &jpeg.Options{Quality: 90})
+	mtfail(t, err, "jpeg, %v", err)
+	good, err := edb.PutScan(scanRecord{ElectionId: eid, Owner: 8, Image: jb.Bytes(), ContentType: "image/jpeg",
+		Interpreter: scan.InterpreterVersion, Result: `{"bmc1":{},"ccont1":{"csel2":true}}`})
+	mtfail(t, err, "put scan, %v", err)
+	old, err := edb.PutScan(scanRecord{ElectionId: eid, Image: jb.Bytes(), ContentType: "image/jpeg",
+		Interpreter: "0", Result: `{"bmc1":{},"ccont1":{}}`})
+	mtfail(t, err, "put scan, %v", err)
+
+	get := func(user *login.User, scanid int64) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sh.handleScanOverlay(rec, httptest.NewRequest("GET", "/scan/1/overlay.png", nil), user, scanid)
+		return rec
+	}
+	if rec := get(&login.User{Guid: 9, Username: "cat"}, good); rec.Code != 403 {
+		t.Errorf("someone else's scan %d", rec.Code)
+	}
+	if rec := get(&login.User{Guid: 8, Username: "bob"}, old); rec.Code != 403 {
+		t.Errorf("uploader of another scan %d", rec.Code)
+	}
+	if rec := get(&login.User{Guid: 8, Username: "bob"}, good); rec.Code != 200 || rec.Header().Get("Warning") != "" {
+		t.Errorf("uploader %d %s", rec.Code, rec.Header().Get("Warning"))
+	}
+	if rec := get(&login.User{Guid: 7, Username: "ann"}, old); rec.Code != 200 || rec.Header().Get("Warning") == "" {
+		t.Errorf("differing result %d %v", rec.Code, rec.Header())
+	}
+
+	rec := get(&login.User{Guid: 7, Username: "ann"}, good)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("owner %d %s", rec.Code, rec.Body.String())
+	}
+	overlay, err := png.Decode(rec.Body)
+	mtfail(t, err, "overlay png, %v", err)
+	scanned, _, err := image.Decode(bytes.NewReader(jb.Bytes()))
+	mtfail(t, err, "decode scan, %v", err)
+	result, _, err := sh.readScan(context.Background(), eid, 0, scanned)
+	mtfail(t, err, "read scan, %v", err)
+	readings := result.Readings
+	if got := scan.MarkedFromReadings(readings); len(readings) != 4 || len(got["ccont1"]) != 1 || !got["ccont1"]["csel2"] {
+		t.Fatalf("readings %#v", readings)
+	}
+	// alignment picks random spots, so just look for one marked and three empty outlines
+	counts := make(map[color.RGBA]int)
+	b := overlay.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			counts[color.RGBAModel.Convert(overlay.At(x, y)).(color.RGBA)]++
+		}
+	}
+	if counts[overlayMarked] == 0 || counts[overlayEmpty] < 2*counts[overlayMarked] {
+		t.Errorf("outlines marked %d empty %d", counts[overlayMarked], counts[overlayEmpty])
+	}
+
+	rec = httptest.NewRecorder()
+	sh.handleScanOverlay(rec, httptest.NewRequest("GET", "/scan/999/overlay.png", nil), &login.User{Guid: 7}, 999)
+	if rec.Code != 404 {
+		t.Errorf("no scan %d", rec.Code)
+	}
+}
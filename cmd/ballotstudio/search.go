@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/brianolson/login/login"
+)
+
+// Search over election titles, contest names and candidate names.
+// GET /elections/search?q=smith+mayor finds elections with words starting
+// with every term, among those the caller may read: their own, and anyone's
+// published ones. The text is kept in election_search, updated by every
+// PutElection along with the facts in calendar.go, and indexed with a
+// tsvector GIN index in Postgres, FULLTEXT in MySQL, and FTS5 in sqlite when
+// the driver has it (mattn/go-sqlite3 needs -tags sqlite_fts5). Without FTS5 sqlite falls back to LIKE, which
+// is fine for a few hundred elections.
+
+const defaultSearchLimit = 50
+const maxSearchLimit = 200
+
+// searchable text of one election, names one per line
+type searchRecord struct {
+	ElectionId int64
+	Owner      int64
+	Title      string
+	Contests   string
+	Candidates string
+}
+
+// one election in GET /elections/search
+type searchHit struct {
+	ElectionId int64    `json:"itemid"`
+	Title      string   `json:"title"`
+	State      string   `json:"state"`
+	Mine       bool     `json:"mine"`
+	Contests   []string `json:"contests,omitempty"`   // names that matched a term
+	Candidates []string `json:"candidates,omitempty"` // names that matched a term
+	EditURL    string   `json:"edit"`
+}
+
+// searchTerms splits a query into lower case words of letters and digits.
+// Everything else is dropped, so terms are safe in any backend's query syntax.
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// searchFields pulls the searchable names out of an election document
+func searchFields(data string) (title, contests, candidates string) {
+	var doc map[string]interface{}
+	if json.Unmarshal([]byte(data), &doc) != nil {
+		return
+	}
+	var titles []string
+	for _, el := range mapList(doc["Election"]) {
+		if s := docString(el["Name"]); s != "" {
+			titles = append(titles, s)
+		}
+	}
+	names := func(kind string) string {
+		obs, order := docObjects(doc, kind)
+		var out []string
+		for _, id := range order {
+			if s := objectName(obs[id]); s != "" {
+				out = append(out, s)
+			}
+		}
+		return strings.Join(out, "\n")
+	}
+	return strings.Join(titles, "\n"), names("Contest"), names("Candidate")
+}
+
+// indexElection updates election eid's row in election_search. Common to all
+// backends, param is "$" for numbered placeholders or "?".
+func indexElection(db sqlDB, param string, eid int64, data string) error {
+	ph := func(i int) string {
+		if param == "?" {
+			return "?"
+		}
+		return fmt.Sprintf("$%d", i)
+	}
+	title, contests, candidates := searchFields(data)
+	facts := docFacts(data)
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("search index tx, %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM election_search WHERE election = "+ph(1), eid)
+	if err != nil {
+		return fmt.Errorf("search index delete, %v", err)
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO election_search (election, title, contests, candidates, election_date, jurisdiction, election_type) VALUES (%s, %s, %s, %s, %s, %s, %s)`, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7)),
+		eid, title, contests, candidates, facts.Date, facts.Jurisdiction, facts.Type)
+	if err != nil {
+		return fmt.Errorf("search index insert, %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("search index commit, %v", err)
+	}
+	return nil
+}
+
+// indexUnindexed indexes elections that have no election_search row, those
+// from before search existed. query selects their id and data.
+func indexUnindexed(db sqlDB, param, query string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("search unindexed, %v", err)
+	}
+	type pending struct {
+		id   int64
+		data sql.NullString
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		err = rows.Scan(&p.id, &p.data)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("search unindexed row, %v", err)
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+	if len(todo) != 0 {
+		log.Printf("indexing %d elections for search", len(todo))
+	}
+	for _, p := range todo {
+		err = indexElection(db, param, p.id, p.data.String)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteFTS makes election_fts if this sqlite has FTS5, and refills it from
+// election_search. It's rebuilt at every start so that a binary without FTS5
+// having run in between can't leave it stale.
+func sqliteFTS(db sqlDB) bool {
+	_, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS election_fts USING fts5(title, contests, candidates)`)
+	if err != nil {
+		log.Printf("sqlite has no FTS5 (%v), election search will use LIKE", err)
+		return false
+	}
+	_, err = db.Exec(`DELETE FROM election_fts`)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO election_fts (rowid, title, contests, candidates) SELECT election, title, contests, candidates FROM election_search`)
+	}
+	if err != nil {
+		log.Printf("sqlite election_fts rebuild, %v; election search will use LIKE", err)
+		return false
+	}
+	return true
+}
+
+// common to all backends, query and args differ
+func querySearch(db sqlDB, query string, args ...interface{}) (out []searchRecord, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("search, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sr searchRecord
+		var title, contests, candidates sql.NullString
+		err = rows.Scan(&sr.ElectionId, &sr.Owner, &title, &contests, &candidates)
+		if err != nil {
+			return nil, fmt.Errorf("search row, %v", err)
+		}
+		sr.Title, sr.Contests, sr.Candidates = title.String, contests.String, candidates.String
+		out = append(out, sr)
+	}
+	return out, rows.Err()
+}
+
+// likeArgs are %term% patterns for the LIKE fallback. searchTerms leaves no % or _ to escape.
+func likeArgs(terms []string) []interface{} {
+	out := make([]interface{}, len(terms))
+	for i, t := range terms {
+		out[i] = "%" + t + "%"
+	}
+	return out
+}
+
+// matchingNames are the lines of names with a word starting with one of terms
+func matchingNames(names string, terms []string) (out []string) {
+	for _, name := range strings.Split(names, "\n") {
+		words := searchTerms(name)
+	match:
+		for _, w := range words {
+			for _, t := range terms {
+				if strings.HasPrefix(w, t) {
+					out = append(out, name)
+					break match
+				}
+			}
+		}
+	}
+	return
+}
+
+// GET /elections/search?q=&limit=
+func (sh *StudioHandler) handleElectionSearch(w http.ResponseWriter, r *http.Request, user *login.User) {
+	edb := sh.edb.WithContext(r.Context())
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	query := r.URL.Query()
+	terms := searchTerms(query.Get("q"))
+	if len(terms) == 0 {
+		texterr(w, 400, "q= wants some words to search for")
+		return
+	}
+	limit := defaultSearchLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			texterr(w, 400, "limit wants 1 to %d", maxSearchLimit)
+			return
+		}
+	}
+	uid := int64(-1) // no one's
+	if user != nil {
+		uid = user.Guid
+	}
+	found, err := edb.SearchElections(terms, uid, limit)
+	if maybeerr(w, err, 500, "db search, %v", err) {
+		return
+	}
+	hits := []searchHit{}
+	for _, sr := range found {
+		state, _ := edb.GetElectionState(sr.ElectionId)
+		hit := searchHit{
+			ElectionId: sr.ElectionId,
+			Title:      strings.Replace(sr.Title, "\n", " / ", -1),
+			State:      state,
+			Mine:       sr.Owner == uid,
+			Contests:   matchingNames(sr.Contests, terms),
+			Candidates: matchingNames(sr.Candidates, terms),
+			EditURL:    sitePath(r, "/edit/"+electionRef(r, sr.ElectionId)),
+		}
+		hits = append(hits, hit)
+	}
+	writeJSON(w, hits)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestElectionSearch(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	mtfail(t, err, "open sqlite mem, %v", err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	edb := NewSqliteEDB(db)
+	// an election from before search existed
+	err = edb.Migrator().migrate(8)
+	mtfail(t, err, "migrate 8, %v", err)
+	_, err = db.Exec(`INSERT INTO elections (data, owner, meta) VALUES ($1, 1, '')`, `{"Election": [{"Name": "Old Primary", "Candidate": [{"@id": "c1", "BallotName": "Zed Zimmer"}]}]}`)
+	mtfail(t, err, "old election, %v", err)
+	err = edb.Setup()
+	mtfail(t, err, "edb sqlite setup, %v", err)
+
+	mine, err := edb.PutElection(electionRecord{Owner: 1, Data: `{"Election": [{"Name": {"Text": [{"Content": "Spring General", "Language": "en"}]},
+"Contest": [{"@id": "k1", "Name": "Mayor"}, {"@id": "k2", "BallotTitle": "Measure 12: Library Levy"}],
+"Candidate": [{"@id": "c1", "BallotName": "Ann Smith"}, {"@id": "c2", "BallotName": "Bob Jones"}]}]}`})
+	mtfail(t, err, "put, %v", err)
+	theirs, err := edb.PutElection(electionRecord{Owner: 2, Data: `{"Election": [{"Name": "Fall General", "Candidate": [{"@id": "c1", "BallotName": "Carol Smithson"}]}]}`})
+	mtfail(t, err, "put, %v", err)
+	published, err := edb.PutElection(electionRecord{Owner: 2, Data: `{"Election": [{"Name": "County General", "Candidate": [{"@id": "c1", "BallotName": "Dee Smith"}]}]}`})
+	mtfail(t, err, "put, %v", err)
+	for _, step := range [][2]string{{StateDraft, StateProofing}, {StateProofing, StateApproved}, {StateApproved, StatePublished}} {
+		_, err = edb.SetElectionState(published, step[0], step[1])
+		mtfail(t, err, "state, %v", err)
+	}
+
+	sh := StudioHandler{edb: edb}
+	search := func(user *login.User, q string) (code int, hits []searchHit) {
+		rec := httptest.NewRecorder()
+		sh.handleElectionSearch(rec, httptest.NewRequest("GET", "/elections/search?q="+q, nil), user)
+		json.Unmarshal(rec.Body.Bytes(), &hits)
+		return rec.Code, hits
+	}
+	ids := func(hits []searchHit) (out []int64) {
+		for _, h := range hits {
+			out = append(out, h.ElectionId)
+		}
+		return
+	}
+	ann := &login.User{Guid: 1}
+	check := func(mode string) {
+		code, hits := search(ann, "smith")
+		if code != 200 || len(hits) != 2 {
+			t.Fatalf("%s: smith %d %v", mode, code, ids(hits))
+		}
+		for _, h := range hits {
+			if h.ElectionId == theirs {
+				t.Errorf("%s: someone else's draft found", mode)
+			}
+			if h.ElectionId == mine && (h.Title != "Spring General" || !h.Mine || len(h.Candidates) != 1 || h.Candidates[0] != "Ann Smith") {
+				t.Errorf("%s: hit %#v", mode, h)
+			}
+		}
+		if _, hits = search(ann, "LIBRARY+lev"); len(hits) != 1 || hits[0].ElectionId != mine || hits[0].Contests[0] != "Measure 12: Library Levy" {
+			t.Errorf("%s: contest search %#v", mode, hits)
+		}
+		if _, hits = search(ann, "zimmer"); len(hits) != 1 {
+			t.Errorf("%s: old election not indexed, %v", mode, ids(hits))
+		}
+		if _, hits = search(nil, "smith"); len(hits) != 1 || hits[0].ElectionId != published || hits[0].Mine {
+			t.Errorf("%s: anonymous %#v", mode, hits)
+		}
+		if _, hits = search(ann, "smith+mayor"); len(hits) != 1 || hits[0].ElectionId != mine {
+			t.Errorf("%s: all terms %v", mode, ids(hits))
+		}
+		if _, hits = search(ann, `"%25)`); hits != nil {
+			t.Errorf("%s: punctuation only %v", mode, hits)
+		}
+	}
+	if !edb.(*sqliteedb).fts {
+		t.Logf("sqlite has no FTS5, only testing LIKE")
+	} else {
+		check("fts5")
+	}
+	edb.(*sqliteedb).fts = false
+	check("like")
+
+	// a saved edit is searchable right away
+	_, err = edb.PutElection(electionRecord{Id: mine, Owner: 1, Data: `{"Election": [{"Name": "Spring General", "Candidate": [{"@id": "c1", "BallotName": "Ann Smythe"}]}]}`})
+	mtfail(t, err, "put, %v", err)
+	if _, hits := search(ann, "smythe"); len(hits) != 1 {
+		t.Errorf("after edit %v", ids(hits))
+	}
+	if code, _ := search(ann, "+"); code != 400 {
+		t.Errorf("empty query %d", code)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Security headers on every response. The Content-Security-Policy only lets
+// scripts load from this server, and the editor pages' script tags carry a
+// per-request nonce so an injected <script> won't run even if it got past
+// template escaping. Styles stay 'unsafe-inline' because the templates and
+// index.js use style attributes. Pages may be framed by this site (PDF
+// previews) but not by others.
+
+// {nonce} is replaced per request
+const defaultCSP = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; object-src 'self'; frame-ancestors 'self'; base-uri 'self'"
+
+const hstsValue = "max-age=31536000"
+
+type cspNonceKey struct{}
+
+func newCSPNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(nonce)
+}
+
+// cspNonce is the nonce for script tags in the page being served to r, "" if
+// securityHeaders isn't in front of it
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// securityHeaders wraps h to set CSP and the other browser hardening
+// headers. csp may have {nonce} in it, empty sends no CSP.
+func securityHeaders(h http.Handler, csp string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		if csp != "" {
+			nonce := newCSPNonce()
+			hdr.Set("Content-Security-Policy", strings.ReplaceAll(csp, "{nonce}", nonce))
+			r = r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce))
+		}
+		hdr.Set("X-Frame-Options", "SAMEORIGIN")
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		hdr.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		if requestScheme(r) == "https" {
+			hdr.Set("Strict-Transport-Security", hstsValue)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	templates, err := HtmlTemplateFS(ballotstudio.Templates, "gotemplates/*.html")
+	mtfail(t, err, "templates, %v", err)
+	h := securityHeaders(&editHandler{ts: templates}, defaultCSP)
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/edit", nil))
+		if rec.Code != 200 {
+			t.Fatalf("edit %d %s", rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+	rec := get()
+	for hk, hv := range map[string]string{
+		"X-Frame-Options":        "SAMEORIGIN",
+		"X-Content-Type-Options": "nosniff",
+		"Referrer-Policy":        "strict-origin-when-cross-origin",
+	} {
+		if rec.Header().Get(hk) != hv {
+			t.Errorf("%s: %q", hk, rec.Header().Get(hk))
+		}
+	}
+	if rec.Header().Get("Strict-Transport-Security") != "" {
+		t.Errorf("HSTS without TLS")
+	}
+	csp := rec.Header().Get("Content-Security-Policy")
+	start := strings.Index(csp, "'nonce-")
+	if start < 0 {
+		t.Fatalf("no nonce in CSP %q", csp)
+	}
+	nonce := csp[start+7:]
+	nonce = nonce[:strings.IndexByte(nonce, '\'')]
+	if len(nonce) < 16 || !strings.Contains(rec.Body.String(), `nonce="`+nonce+`"`) {
+		t.Errorf("page doesn't have CSP nonce %q", nonce)
+	}
+	if strings.Contains(get().Header().Get("Content-Security-Policy"), nonce) {
+		t.Errorf("nonce reused")
+	}
+
+	req := httptest.NewRequest("GET", "/edit", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("Strict-Transport-Security") != hstsValue {
+		t.Errorf("HSTS %q", rec.Header().Get("Strict-Transport-Security"))
+	}
+
+	rec = httptest.NewRecorder()
+	securityHeaders(&editHandler{ts: templates}, "").ServeHTTP(rec, httptest.NewRequest("GET", "/edit", nil))
+	if rec.Header().Get("Content-Security-Policy") != "" {
+		t.Errorf("-csp= still sent %q", rec.Header().Get("Content-Security-Policy"))
+	}
+}
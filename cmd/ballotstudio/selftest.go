@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/ballotstudio/synth"
+)
+
+// `ballotstudio selftest -draw-backend URL` checks a deployment's whole
+// ballot pipeline in one go: it draws a built in election through the
+// draw backend (or -flask, or in process drawing, as the server would),
+// gets the page as PNG, marks known votes on it as a scanner would see
+// them, reads them back with -scan-backend or the built in interpreter,
+// and checks the votes read are the ones marked. It prints a report like
+// GET /election/{id}/readiness, one item per step, and exits 1 if any
+// step failed. Steps after a failure are skipped.
+
+const selftestDoc = `{
+  "@type": "ElectionResults.ElectionReport",
+  "GpUnit": [{"@id": "gpunit1", "@type": "ElectionResults.ReportingUnit", "Type": "city", "Name": "Selftest City"}],
+  "Party": [{"@id": "party1", "@type": "ElectionResults.Party", "Name": "Blue Party"}],
+  "Header": [{"@id": "header1", "@type": "ElectionResults.Header", "Name": "Instructions"}],
+  "Election": [{
+    "@type": "ElectionResults.Election",
+    "Name": "Self Test", "Type": "general", "StartDate": "2026-11-03", "EndDate": "2026-11-03",
+    "Candidate": [
+      {"@id": "candidate1", "@type": "ElectionResults.Candidate", "BallotName": "Alice Argyle", "PartyId": "party1"},
+      {"@id": "candidate2", "@type": "ElectionResults.Candidate", "BallotName": "Bob Brocade"},
+      {"@id": "candidate3", "@type": "ElectionResults.Candidate", "BallotName": "Carol Chenille"}
+    ],
+    "Contest": [
+      {"@id": "ccont1", "@type": "ElectionResults.CandidateContest", "Name": "Mayor", "BallotTitle": "Mayor", "BallotSubTitle": "Vote for one", "VotesAllowed": 1, "ElectionDistrictId": "gpunit1",
+       "ContestSelection": [
+         {"@id": "csel1", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["candidate1"]},
+         {"@id": "csel2", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["candidate2"]},
+         {"@id": "csel3", "@type": "ElectionResults.CandidateSelection", "IsWriteIn": true}
+       ]},
+      {"@id": "ccont2", "@type": "ElectionResults.CandidateContest", "Name": "Council", "BallotTitle": "City Council", "BallotSubTitle": "Vote for up to two", "VotesAllowed": 2, "ElectionDistrictId": "gpunit1",
+       "ContestSelection": [
+         {"@id": "csel4", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["candidate1"]},
+         {"@id": "csel5", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["candidate2"]},
+         {"@id": "csel6", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["candidate3"]}
+       ]},
+      {"@id": "bmcont1", "@type": "ElectionResults.BallotMeasureContest", "Name": "Measure A", "BallotTitle": "Measure A", "ElectionDistrictId": "gpunit1",
+       "ContestSelection": [
+         {"@id": "bmsel1", "@type": "ElectionResults.BallotMeasureSelection", "Selection": "Yes"},
+         {"@id": "bmsel2", "@type": "ElectionResults.BallotMeasureSelection", "Selection": "No"}
+       ]}
+    ],
+    "BallotStyle": [{"@type": "ElectionResults.BallotStyle", "GpUnitIds": ["gpunit1"], "OrderedContent": [
+      {"@type": "ElectionResults.OrderedHeader", "HeaderId": "header1"},
+      {"@type": "ElectionResults.OrderedContest", "ContestId": "ccont1"},
+      {"@type": "ElectionResults.OrderedContest", "ContestId": "ccont2"},
+      {"@type": "ElectionResults.OrderedContest", "ContestId": "bmcont1"}
+    ]}]
+  }]
+}`
+
+// selftestVotes are marked on the selftest ballot, every other bubble is left blank
+var selftestVotes = map[string]map[string]bool{
+	"ccont1":  {"csel2": true},
+	"ccont2":  {"csel4": true, "csel6": true},
+	"bmcont1": {"bmsel1": true},
+}
+
+// runSelftest runs each step, stopping at the first that fails
+func runSelftest(ctx context.Context, dc *draw.Client, interpreter scan.Interpreter) readinessReport {
+	rr := readinessReport{Status: readyPass}
+	fail := func(check, format string, args ...interface{}) readinessReport {
+		rr.add(readinessItem{Check: check, Status: readyFail, Message: fmt.Sprintf(format, args...)})
+		return rr
+	}
+
+	start := time.Now()
+	bothob, err := dc.DrawElection(ctx, selftestDoc, draw.RenderOptions{})
+	if err != nil {
+		return fail("render", "draw, %v", err)
+	}
+	defer bothob.Release()
+	bj, err := scan.ParseBubbles(bothob.BubblesJson)
+	if err != nil {
+		return fail("render", "bad bubbles json, %v", err)
+	}
+	if bj.DrawSettings == nil || len(bj.DrawSettings.PageSize) != 2 {
+		return fail("render", "no page size in the bubbles json")
+	}
+	render := readinessItem{Check: "render", Status: readyPass, Message: fmt.Sprintf("drawn in %s", time.Since(start).Round(time.Millisecond))}
+	if len(bothob.Warnings) != 0 {
+		render.Status = readyWarn
+		render.Details = bothob.Warnings
+	}
+	rr.add(render)
+
+	start = time.Now()
+	pngs := bothob.Png
+	if len(pngs) == 0 {
+		pdf, err := bothob.PdfBytes()
+		if err != nil {
+			return fail("png", "%v", err)
+		}
+		pngs, err = draw.PdfToPng(ctx, pdf)
+		if err != nil {
+			return fail("png", "pdf to png, %v", err)
+		}
+	}
+	pages := make([]image.Image, len(pngs))
+	for i, pngbytes := range pngs {
+		pages[i], _, err = image.Decode(bytes.NewReader(pngbytes))
+		if err != nil {
+			return fail("png", "page %d png, %v", i+1, err)
+		}
+	}
+	if len(pages) == 0 {
+		return fail("png", "no pages")
+	}
+	rr.add(readinessItem{Check: "png", Status: readyPass, Message: fmt.Sprintf("%d page(s) in %s", len(pages), time.Since(start).Round(time.Millisecond))})
+
+	bv := bj.V2()
+	marked, err := synth.Ballot(bv, pages, bj.DrawSettings.PageSize[0], bj.DrawSettings.PageSize[1], 0, selftestVotes, synth.Options{Seed: 1})
+	if err != nil {
+		return fail("mark", "%v", err)
+	}
+	// as a scanner would send it
+	var jb bytes.Buffer
+	err = jpeg.Encode(&jb, marked[0], &jpeg.Options{Quality: 90})
+	if err != nil {
+		return fail("mark", "jpeg, %v", err)
+	}
+	scanned, err := jpeg.Decode(&jb)
+	if err != nil {
+		return fail("mark", "jpeg, %v", err)
+	}
+	rr.add(readinessItem{Check: "mark", Status: readyPass, Message: fmt.Sprintf("marked %d votes", countVotes(selftestVotes))})
+
+	start = time.Now()
+	result, err := interpreter.Interpret(ctx, bj, pages[0], scanned)
+	if err != nil {
+		return fail("interpret", "%v", err)
+	}
+	rr.add(readinessItem{Check: "interpret", Status: readyPass, Message: fmt.Sprintf("read %d bubbles in %s, interpreter %s", len(result.Readings), time.Since(start).Round(time.Millisecond), result.Interpreter)})
+
+	rr.add(checkSelftestVotes(result.Readings, bv))
+	return rr
+}
+
+// checkSelftestVotes compares what was read with selftestVotes, over every
+// bubble on the first page of the first ballot style
+func checkSelftestVotes(readings []scan.BubbleReading, bv *scan.BubblesV2) readinessItem {
+	read := make(map[string]bool)
+	for _, br := range readings {
+		if br.Style == 0 {
+			read[scan.BubbleTargetId(br.ContestId, br.SelectionId)] = br.Marked
+		}
+	}
+	var problems []string
+	drawn := make(map[string]bool)
+	for _, page := range bv.Pages {
+		if page.Style != 0 || page.StylePage > 1 {
+			continue
+		}
+		for _, t := range page.Targets {
+			drawn[t.Id] = true
+			want := selftestVotes[t.ContestId][t.SelectionId]
+			got, ok := read[t.Id]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("%s not read", t.Id))
+			case got && !want:
+				problems = append(problems, fmt.Sprintf("%s read marked, was blank", t.Id))
+			case want && !got:
+				problems = append(problems, fmt.Sprintf("%s read blank, was marked", t.Id))
+			}
+		}
+	}
+	for contest, sels := range selftestVotes {
+		for sel := range sels {
+			if id := scan.BubbleTargetId(contest, sel); !drawn[id] {
+				problems = append(problems, fmt.Sprintf("%s has no bubble on the first page", id))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return failIfAny("cvr", "votes read are the votes marked", "votes read don't match the marks", problems)
+}
+
+func countVotes(votes map[string]map[string]bool) (n int) {
+	for _, sels := range votes {
+		for _, on := range sels {
+			if on {
+				n++
+			}
+		}
+	}
+	return
+}
+
+// runSelftestCommand writes the report to out, ok is false if a step failed
+func runSelftestCommand(ctx context.Context, dc *draw.Client, interpreter scan.Interpreter, out io.Writer) (ok bool, err error) {
+	rr := runSelftest(ctx, dc, interpreter)
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return rr.Status != readyFail, enc.Encode(rr)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+func TestSelftest(t *testing.T) {
+	var out bytes.Buffer
+	ok, err := runSelftestCommand(context.Background(), &draw.Client{}, scan.Local{}, &out)
+	if !ok || err != nil {
+		t.Fatalf("in process selftest failed, %v\n%s", err, out.String())
+	}
+	var rr readinessReport
+	err = json.Unmarshal(out.Bytes(), &rr)
+	mtfail(t, err, "report json, %v", err)
+	var checks []string
+	for _, item := range rr.Items {
+		checks = append(checks, item.Check)
+	}
+	if len(checks) != 5 || checks[4] != "cvr" {
+		t.Errorf("checks %v", checks)
+	}
+
+	// a mark the interpreter misses shows up in the cvr check
+	read := []scan.BubbleReading{{ContestId: "ccont1", SelectionId: "csel1"}, {ContestId: "ccont1", SelectionId: "csel2"}}
+	bv := &scan.BubblesV2{Pages: []scan.BubblesV2Page{{Targets: []scan.BubblesV2Target{
+		{Id: "ccont1/csel1", ContestId: "ccont1", SelectionId: "csel1"},
+		{Id: "ccont1/csel2", ContestId: "ccont1", SelectionId: "csel2"},
+	}}}}
+	item := checkSelftestVotes(read, bv)
+	if item.Status != readyFail || len(item.Details) != 4 || item.Details[0] != "bmcont1/bmsel1 has no bubble on the first page" {
+		t.Errorf("cvr %#v", item)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", 500)
+	}))
+	defer backend.Close()
+	out.Reset()
+	ok, err = runSelftestCommand(context.Background(), &draw.Client{BackendUrl: backend.URL}, scan.Local{}, &out)
+	if ok || err != nil {
+		t.Fatalf("broken backend passed, %v", err)
+	}
+	rr = readinessReport{}
+	json.Unmarshal(out.Bytes(), &rr)
+	if len(rr.Items) != 1 || rr.Items[0].Check != "render" || rr.Items[0].Status != readyFail {
+		t.Errorf("broken backend report %s", out.String())
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+// Share links. POST /election/{id}/sharelink (owner only) returns URLs
+// that serve the ballot PDF and page PNGs to anyone, without logging in,
+// until they expire. That way a proof can go to a print vendor or a
+// candidate who has no account. A link is for the revision that was current
+// when it was made, so later edits don't change what was sent.
+//
+// Nothing is stored. The URL carries the election, revision, expiry and
+// proof setting, signed with HMAC-SHA256 under -share-key, so links can't
+// be revoked one at a time; changing -share-key revokes them all.
+
+const defaultShareTTL = 7 * 24 * time.Hour
+const maxShareTTL = 90 * 24 * time.Hour
+
+var errShareSignature = errors.New("bad share link")
+var errShareExpired = errors.New("share link expired")
+
+// what a share link grants
+type shareClaims struct {
+	ElectionId int64 `json:"e"`
+	Rev        int   `json:"r"`
+	Expires    int64 `json:"x"` // unix seconds
+	Proof      bool  `json:"p,omitempty"`
+}
+
+type shareLinkJSON struct {
+	ElectionId int64     `json:"itemid"`
+	Rev        int       `json:"rev"`
+	Expires    time.Time `json:"expires"`
+	Proof      bool      `json:"proof"`
+	PDFURL     string    `json:"pdf"`
+	PNGURL     string    `json:"png"`                // page 0, change .0.png for other pages
+	Notified   []string  `json:"notified,omitempty"` // users emailed the link, see notify.go
+}
+
+func shareMAC(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signShare makes the token that goes in /share/{token}.pdf
+func signShare(key []byte, sc shareClaims) string {
+	claims, _ := json.Marshal(sc)
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(shareMAC(key, payload))
+}
+
+// verifyShare checks a token's signature and expiry
+func verifyShare(key []byte, token string, now time.Time) (sc shareClaims, err error) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return sc, errShareSignature
+	}
+	payload := token[:dot]
+	sig, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil || !hmac.Equal(sig, shareMAC(key, payload)) {
+		return sc, errShareSignature
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return sc, errShareSignature
+	}
+	err = json.Unmarshal(claims, &sc)
+	if err != nil {
+		return sc, errShareSignature
+	}
+	if now.Unix() >= sc.Expires {
+		return sc, errShareExpired
+	}
+	return sc, nil
+}
+
+// POST /election/{id}/sharelink?ttl=72h&proof=1&notify=name1,name2, owner only
+func (sh *StudioHandler) handleElectionShareLink(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	query := r.URL.Query()
+	ttl := defaultShareTTL
+	if v := query.Get("ttl"); v != "" {
+		ttl, err = time.ParseDuration(v)
+		if err == nil && (ttl <= 0 || ttl > maxShareTTL) {
+			err = fmt.Errorf("want more than 0 and at most %s", maxShareTTL)
+		}
+		if maybeerr(w, err, 400, "bad ttl, %v", err) {
+			return
+		}
+	}
+	revs, err := sh.edb.ElectionRevisions(electionid)
+	if maybeerr(w, err, 500, "db revisions, %v", err) {
+		return
+	}
+	if len(revs) == 0 {
+		texterr(w, 404, "election %d has no revisions", electionid)
+		return
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	sc := shareClaims{
+		ElectionId: electionid,
+		Rev:        revs[len(revs)-1].Rev,
+		Expires:    expires.Unix(),
+		Proof:      qbool(query.Get("proof")),
+	}
+	token := signShare(sh.shareKey, sc)
+	link := shareLinkJSON{
+		ElectionId: electionid,
+		Rev:        sc.Rev,
+		Expires:    expires.UTC(),
+		Proof:      sc.Proof,
+		PDFURL:     serverURL(r, "/share/"+token+".pdf"),
+		PNGURL:     serverURL(r, "/share/"+token+".0.png"),
+	}
+	if v := query.Get("notify"); v != "" {
+		link.Notified = sh.notifyShare(user, strings.Split(v, ","), electionid, link)
+	}
+	writeJSON(w, link)
+}
+
+// GET /share/{token}.pdf (page "") and /share/{token}.{page}.png, no login
+func (sh *StudioHandler) handleShare(w http.ResponseWriter, r *http.Request, token, page string) {
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	sc, err := verifyShare(sh.shareKey, token, time.Now())
+	if err == errShareExpired {
+		texterr(w, http.StatusGone, "%v", err)
+		return
+	}
+	if err != nil {
+		texterr(w, http.StatusForbidden, "%v", err)
+		return
+	}
+	er, err := sh.edb.GetElection(sc.ElectionId)
+	if err != nil || er.Trashed != 0 {
+		texterr(w, 404, "no item")
+		return
+	}
+	rr, err := sh.edb.GetElectionRevision(sc.ElectionId, sc.Rev)
+	if maybeerr(w, err, 500, "db revision, %v", err) {
+		return
+	}
+	if rr == nil {
+		texterr(w, 404, "no item")
+		return
+	}
+	opts := draw.RenderOptions{Proof: sc.Proof}
+	// links get forwarded; keep them out of search engines
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if page == "" {
+		bothob, err := sh.drawRevision(r.Context(), rr, opts)
+		if err != nil {
+			he := err.(*httpError)
+			maybeerr(w, he.err, he.code, he.msg)
+			return
+		}
+		defer bothob.Release()
+		writePdfArtifact(w, r, bothob, revisionTime(*rr), "no-cache")
+		return
+	}
+	pagenum, err := strconv.Atoi(page)
+	if maybeerr(w, err, 400, "bad page") {
+		return
+	}
+	pngbytes, err := sh.revisionPng(r.Context(), rr, opts)
+	if err != nil {
+		he := err.(*httpError)
+		maybeerr(w, he.err, he.code, he.msg)
+		return
+	}
+	if pagenum >= len(pngbytes) {
+		texterr(w, 404, "no page %d, %d pages", pagenum, len(pngbytes))
+		return
+	}
+	writeArtifact(w, r, "image/png", pngbytes[pagenum], revisionTime(*rr))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/login/login"
+)
+
+func TestShareToken(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+	sc := shareClaims{ElectionId: 3, Rev: 2, Expires: now.Unix() + 60, Proof: true}
+	token := signShare(key, sc)
+	got, err := verifyShare(key, token, now)
+	if err != nil || got != sc {
+		t.Errorf("verify %#v %v", got, err)
+	}
+	if _, err = verifyShare(key, token, now.Add(time.Minute)); err != errShareExpired {
+		t.Errorf("expired got %v", err)
+	}
+	if _, err = verifyShare([]byte("other key"), token, now); err != errShareSignature {
+		t.Errorf("other key got %v", err)
+	}
+	// a different election with the same signature
+	forged := signShare(key, shareClaims{ElectionId: 4, Rev: 2, Expires: sc.Expires})
+	forged = forged[:strings.IndexByte(forged, '.')] + token[strings.IndexByte(token, '.'):]
+	if _, err = verifyShare(key, forged, now); err != errShareSignature {
+		t.Errorf("forged got %v", err)
+	}
+	if !sharePathRe.MatchString("/share/"+token+".pdf") || !sharePathRe.MatchString("/share/"+token+".1.png") {
+		t.Errorf("token %s not routed", token)
+	}
+}
+
+func TestShareLink(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}, drawClient: &draw.Client{}, shareKey: []byte("test share key")}
+	doc := `{"Election": [{"BallotStyle": [{"GpUnitIds": ["g1"], "OrderedContent": []}]}]}`
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+
+	makeLink := func(user *login.User, query string) (int, shareLinkJSON) {
+		rec := httptest.NewRecorder()
+		sh.handleElectionShareLink(rec, httptest.NewRequest("POST", "/election/1/sharelink"+query, nil), user, eid)
+		var sl shareLinkJSON
+		json.Unmarshal(rec.Body.Bytes(), &sl)
+		return rec.Code, sl
+	}
+	if code, _ := makeLink(&login.User{Guid: 8}, ""); code != 403 {
+		t.Errorf("not owner got %d", code)
+	}
+	if code, _ := makeLink(&login.User{Guid: 7}, "?ttl=9999h"); code != 400 {
+		t.Errorf("long ttl got %d", code)
+	}
+	code, sl := makeLink(&login.User{Guid: 7}, "?ttl=1h&proof=1")
+	if code != 200 || sl.Rev != 1 || !sl.Proof || time.Until(sl.Expires) > time.Hour {
+		t.Fatalf("share link %d %#v", code, sl)
+	}
+
+	// later edits don't change a shared link
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: `{"Election": [{"RenderOptions": {"PageSize": "legal"}, "BallotStyle": [{"GpUnitIds": ["g1"], "OrderedContent": []}]}]}`})
+	mtfail(t, err, "put election, %v", err)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		m := sharePathRe.FindStringSubmatch(strings.TrimPrefix(url, "http://example.com"))
+		if m == nil {
+			t.Fatalf("%s not routed", url)
+		}
+		sh.handleShare(rec, httptest.NewRequest("GET", url, nil), m[1], m[2])
+		return rec
+	}
+	rec := get(sl.PDFURL)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "612 792") || rec.Header().Get("X-Robots-Tag") != "noindex" {
+		t.Errorf("pdf %d, want letter size from rev 1", rec.Code)
+	}
+	if rec = get(sl.PNGURL); rec.Code != 200 || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("png %d", rec.Code)
+	}
+	if rec = get(strings.Replace(sl.PNGURL, ".0.png", ".5.png", 1)); rec.Code != 404 {
+		t.Errorf("missing page %d", rec.Code)
+	}
+	if rec = get(strings.Replace(sl.PDFURL, "/share/e", "/share/f", 1)); rec.Code != 403 {
+		t.Errorf("tampered %d", rec.Code)
+	}
+	err = edb.TrashElection(eid, time.Now())
+	mtfail(t, err, "trash, %v", err)
+	if rec = get(sl.PDFURL); rec.Code != 404 {
+		t.Errorf("trashed %d", rec.Code)
+	}
+}
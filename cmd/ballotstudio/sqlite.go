@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlitePragmas are per connection sqlite settings. They go in the
+// go-sqlite3 connect string, so every connection database/sql opens gets
+// them, not just the first.
+type sqlitePragmas struct {
+	// JournalMode WAL lets readers carry on while one connection writes
+	JournalMode string
+
+	// BusyTimeout is how long to wait on another connection's lock
+	// before failing with "database is locked"
+	BusyTimeout time.Duration
+
+	// Synchronous NORMAL is safe with WAL and doesn't fsync every commit
+	Synchronous string
+}
+
+// sqliteSettings are set by the -sqlite-* flags and apply to -sqlite and -login-db sqlite:
+var sqliteSettings = sqlitePragmas{
+	JournalMode: "WAL",
+	BusyTimeout: 5 * time.Second,
+	Synchronous: "NORMAL",
+}
+
+var sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+var sqliteSynchronousModes = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+
+func oneOf(v string, choices []string) bool {
+	for _, c := range choices {
+		if strings.EqualFold(v, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// problems returns what's wrong with sp, in the style of serverConfigProblems
+func (sp sqlitePragmas) problems() (problems []string) {
+	if !oneOf(sp.JournalMode, sqliteJournalModes) {
+		problems = append(problems, fmt.Sprintf("sqlite-journal-mode: %#v should be one of %s", sp.JournalMode, strings.Join(sqliteJournalModes, ", ")))
+	}
+	if sp.BusyTimeout < 0 {
+		problems = append(problems, "sqlite-busy-timeout: must not be negative")
+	}
+	if !oneOf(sp.Synchronous, sqliteSynchronousModes) {
+		problems = append(problems, fmt.Sprintf("sqlite-synchronous: %#v should be one of %s", sp.Synchronous, strings.Join(sqliteSynchronousModes, ", ")))
+	}
+	return
+}
+
+// dsn adds the pragmas to a sqlite path. Any the path already sets win.
+// In-memory databases are left alone; WAL needs a file.
+func (sp sqlitePragmas) dsn(path string) string {
+	base, rawQuery := path, ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		base, rawQuery = path[:i], path[i+1:]
+	}
+	if base == ":memory:" || strings.Contains(rawQuery, "mode=memory") {
+		return path
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// let the driver complain about it
+		return path
+	}
+	add := url.Values{}
+	set := func(names []string, value string) {
+		for _, name := range names {
+			if q.Get(name) != "" {
+				return
+			}
+		}
+		add.Set(names[0], value)
+	}
+	set([]string{"_journal_mode", "_journal"}, strings.ToUpper(sp.JournalMode))
+	set([]string{"_busy_timeout", "_timeout"}, strconv.FormatInt(sp.BusyTimeout.Milliseconds(), 10))
+	set([]string{"_synchronous", "_sync"}, strings.ToUpper(sp.Synchronous))
+	if rawQuery != "" {
+		return path + "&" + add.Encode()
+	}
+	return path + "?" + add.Encode()
+}
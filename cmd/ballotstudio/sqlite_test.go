@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSqliteDSN(t *testing.T) {
+	sp := sqlitePragmas{JournalMode: "wal", BusyTimeout: 2500 * time.Millisecond, Synchronous: "normal"}
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"bs.sqlite", "bs.sqlite?_busy_timeout=2500&_journal_mode=WAL&_synchronous=NORMAL"},
+		{"file:bs.sqlite?cache=shared", "file:bs.sqlite?cache=shared&_busy_timeout=2500&_journal_mode=WAL&_synchronous=NORMAL"},
+		// the path's own settings win
+		{"bs.sqlite?_sync=FULL&_timeout=100", "bs.sqlite?_sync=FULL&_timeout=100&_journal_mode=WAL"},
+		{":memory:", ":memory:"},
+		{"file:x?mode=memory", "file:x?mode=memory"},
+	}
+	for _, tc := range cases {
+		got := sp.dsn(tc.path)
+		if got != tc.want {
+			t.Errorf("dsn(%#v) = %#v, want %#v", tc.path, got, tc.want)
+		}
+	}
+	if p := sp.problems(); len(p) != 0 {
+		t.Errorf("unexpected problems %v", p)
+	}
+	bad := sqlitePragmas{JournalMode: "sideways", BusyTimeout: -time.Second, Synchronous: "sometimes"}
+	if p := bad.problems(); len(p) != 3 {
+		t.Errorf("want 3 problems, got %v", p)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Bulk provisioning of election office staff.
+//
+// An admin (a -admin username, or staff with role admin who has signed up)
+// uploads a CSV of email,role,organization. Each new address gets a signup
+// invite by email; when they sign up with it their account is linked to the
+// staff record. Addresses already provisioned have their role and
+// organization updated, and a new invite if theirs expired unused. A file
+// with any bad row changes nothing.
+
+const (
+	StaffAdmin      = "admin"
+	StaffEditor     = "editor"
+	StaffViewer     = "viewer"
+	StaffPollWorker = "pollworker" // may print ballots on demand, see print.go
+)
+
+var staffRoles = []string{StaffAdmin, StaffEditor, StaffViewer, StaffPollWorker}
+
+// how long a provisioning invite is good for
+const staffInviteTTL = 14 * 24 * time.Hour
+
+// largest staff CSV accepted, bytes
+const maxStaffCSVBytes = 1000000
+
+// one CSV row and what became of it
+type staffRow struct {
+	Line         int    `json:"line"`
+	Email        string `json:"email"`
+	Role         string `json:"role"`
+	Organization string `json:"organization"`
+	Status       string `json:"status,omitempty"` // invited or updated
+	Error        string `json:"error,omitempty"`
+	Invite       string `json:"invite,omitempty"` // signup path for a new invite
+}
+
+type staffReport struct {
+	Rows    []staffRow `json:"rows"`
+	Invited int        `json:"invited"`
+	Updated int        `json:"updated"`
+	Errors  int        `json:"errors"`
+}
+
+// parseStaffCSV reads email,role,organization rows. A first row with an
+// "email" column is a header, and then columns may be in any order.
+// Bad rows come back with Error set.
+func parseStaffCSV(r io.Reader) (rows []staffRow, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	columns := map[string]int{"email": 0, "role": 1, "organization": 2}
+	seen := make(map[string]int)
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && oneOf("email", trimAll(record)) {
+			columns = make(map[string]int)
+			for i, name := range record {
+				columns[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+			for _, name := range []string{"email", "role", "organization"} {
+				if _, ok := columns[name]; !ok {
+					return nil, fmt.Errorf("header has no %s column", name)
+				}
+			}
+			continue
+		}
+		field := func(name string) string {
+			i := columns[name]
+			if i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		row := staffRow{
+			Line:         line,
+			Email:        strings.ToLower(field("email")),
+			Role:         strings.ToLower(field("role")),
+			Organization: field("organization"),
+		}
+		if row.Email == "" && row.Role == "" && row.Organization == "" {
+			continue
+		}
+		switch {
+		case !strings.Contains(row.Email, "@") || !headerSafe(row.Email):
+			row.Error = fmt.Sprintf("bad email %q", row.Email)
+		case !oneOf(row.Role, staffRoles):
+			row.Error = fmt.Sprintf("role %q should be one of %s", row.Role, strings.Join(staffRoles, ", "))
+		case row.Organization == "":
+			row.Error = "organization is required"
+		case seen[row.Email] != 0:
+			row.Error = fmt.Sprintf("%s is also on line %d", row.Email, seen[row.Email])
+		}
+		seen[row.Email] = line
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func trimAll(fields []string) []string {
+	out := make([]string, len(fields))
+	for i, f := range fields {
+		out[i] = strings.TrimSpace(f)
+	}
+	return out
+}
+
+// isAdmin is true for -admin users and signed up staff with role admin
+func (sh *StudioHandler) isAdmin(user *login.User) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if sh.admins[user.Username] {
+		return true, nil
+	}
+	sr, err := sh.edb.StaffForUser(user.Guid)
+	if err != nil {
+		return false, err
+	}
+	return sr != nil && sr.Role == StaffAdmin, nil
+}
+
+// signupURL is where an invite is used, on the server r came to
+func signupURL(r *http.Request, token string) string {
+	return serverURL(r, "/signup/"+token)
+}
+
+// provisionStaff applies rows that all parsed cleanly
+func (sh *StudioHandler) provisionStaff(r *http.Request, rows []staffRow) (report staffReport, err error) {
+	now := time.Now()
+	for _, row := range rows {
+		sr, err := sh.edb.GetStaff(row.Email)
+		if err != nil {
+			return report, err
+		}
+		if sr != nil {
+			pending := false
+			if sr.UserId == 0 {
+				pending, _, err = sh.edb.PeekInviteToken(sr.Invite)
+				if err != nil && err != sql.ErrNoRows {
+					return report, err
+				}
+			}
+			if sr.UserId != 0 || pending {
+				sr.Role = row.Role
+				sr.Organization = row.Organization
+				err = sh.edb.PutStaff(*sr)
+				if err != nil {
+					return report, err
+				}
+				row.Status = "updated"
+				report.Updated++
+				report.Rows = append(report.Rows, row)
+				continue
+			}
+			// never signed up and the invite expired, invite them again
+		}
+		token := randomInviteToken(2)
+		err = sh.edb.MakeInviteToken(token, now.Add(staffInviteTTL))
+		if err != nil {
+			return report, err
+		}
+		err = sh.edb.PutStaff(staffRecord{Email: row.Email, Role: row.Role, Organization: row.Organization, Invite: token, Provisioned: now.Unix()})
+		if err != nil {
+			return report, err
+		}
+		if sh.mailer != nil {
+			body := fmt.Sprintf("You have been added to %s on BallotStudio as %s.\n\nSign up here within %d days:\n%s\n", row.Organization, row.Role, int(staffInviteTTL.Hours()/24), signupURL(r, token))
+			err = sh.mailer.SendMail(row.Email, "BallotStudio account for "+row.Organization, body)
+			if err != nil {
+				// the invite is still in the report for the admin to pass on
+				log.Printf("staff invite %s, %v", row.Email, err)
+			}
+		}
+		row.Status = "invited"
+		row.Invite = sitePath(r, "/signup/"+token)
+		report.Invited++
+		report.Rows = append(report.Rows, row)
+	}
+	return report, nil
+}
+
+// GET /admin/staff lists staff, POST /admin/staff provisions a CSV of them
+func (sh *StudioHandler) handleStaff(w http.ResponseWriter, r *http.Request, user *login.User) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	admin, err := sh.isAdmin(user)
+	if maybeerr(w, err, 500, "db staff, %v", err) {
+		return
+	}
+	if !admin {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		staff, err := sh.edb.StaffList()
+		if maybeerr(w, err, 500, "db staff, %v", err) {
+			return
+		}
+		if staff == nil {
+			staff = []staffRecord{}
+		}
+		writeJSON(w, staff)
+	case "POST":
+		rows, err := parseStaffCSV(http.MaxBytesReader(w, r.Body, maxStaffCSVBytes))
+		if maybeerr(w, err, 400, "bad csv, %v", err) {
+			return
+		}
+		report := staffReport{Rows: rows}
+		for _, row := range rows {
+			if row.Error != "" {
+				report.Errors++
+			}
+		}
+		if report.Errors != 0 {
+			// nothing is provisioned until every row is good
+			out, _ := json.Marshal(report)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(400)
+			w.Write(out)
+			return
+		}
+		report, err = sh.provisionStaff(r, rows)
+		if maybeerr(w, err, 500, "provisioning staff, %v", err) {
+			return
+		}
+		writeJSON(w, report)
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET or POST")
+	}
+}
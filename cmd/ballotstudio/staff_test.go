@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestParseStaffCSV(t *testing.T) {
+	rows, err := parseStaffCSV(strings.NewReader("Organization,Email,Role\nSpringfield County, Ann@Example.com ,Editor\nShelbyville,bob,viewer\nShelbyville,cat@example.com,boss\n,dan@example.com,viewer\nX,ann@example.com,admin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("rows %#v", rows)
+	}
+	if r := rows[0]; r.Email != "ann@example.com" || r.Role != StaffEditor || r.Organization != "Springfield County" || r.Error != "" || r.Line != 2 {
+		t.Errorf("row %#v", r)
+	}
+	for i, want := range []string{"bad email", "role", "organization", "also on line 2"} {
+		if !strings.Contains(rows[i+1].Error, want) {
+			t.Errorf("line %d error %q, want %q", rows[i+1].Line, rows[i+1].Error, want)
+		}
+	}
+	// no header, email,role,organization
+	rows, err = parseStaffCSV(strings.NewReader("ed@example.com,admin,State\n"))
+	if err != nil || len(rows) != 1 || rows[0].Organization != "State" || rows[0].Error != "" {
+		t.Errorf("headerless %#v %v", rows, err)
+	}
+	if _, err = parseStaffCSV(strings.NewReader("email,role\n")); err == nil {
+		t.Error("header missing organization should fail")
+	}
+}
+
+func TestProvisionStaff(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	mail := &testMailer{}
+	sh := StudioHandler{edb: edb, mailer: mail, admins: map[string]bool{"root": true}}
+	root := &login.User{Guid: 1, Username: "root"}
+
+	post := func(user *login.User, csv string) (int, staffReport) {
+		rec := httptest.NewRecorder()
+		sh.handleStaff(rec, httptest.NewRequest("POST", "http://bs.example.com/admin/staff", strings.NewReader(csv)), user)
+		var report staffReport
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		return rec.Code, report
+	}
+	if code, _ := post(nil, ""); code != 401 {
+		t.Errorf("no user %d", code)
+	}
+	if code, _ := post(&login.User{Guid: 2, Username: "ann"}, ""); code != 403 {
+		t.Errorf("not admin %d", code)
+	}
+	code, report := post(root, "ann@example.com,admin,County\nbob@example.com,nope,County\n")
+	if code != 400 || report.Errors != 1 || len(mail.sent) != 0 {
+		t.Errorf("bad row %d %#v", code, report)
+	}
+	if staff, _ := edb.StaffList(); len(staff) != 0 {
+		t.Errorf("nothing should be provisioned with a bad row, %v", staff)
+	}
+
+	code, report = post(root, "ann@example.com,admin,County\nbob@example.com,viewer,County\n")
+	if code != 200 || report.Invited != 2 || len(mail.sent) != 2 {
+		t.Fatalf("provision %d %#v", code, report)
+	}
+	if m := mail.sent[0]; m.to != "ann@example.com" || !strings.Contains(m.body, "http://bs.example.com"+report.Rows[0].Invite) {
+		t.Errorf("invite mail %#v", m)
+	}
+	ann, err := edb.GetStaff("ann@example.com")
+	mtfail(t, err, "get staff, %v", err)
+	if ok, _, _ := edb.PeekInviteToken(ann.Invite); !ok || report.Rows[0].Invite != "/signup/"+ann.Invite {
+		t.Errorf("ann's invite %#v", ann)
+	}
+
+	// ann signs up and is an admin from then on
+	ann.UserId = 2
+	ann.Invite = ""
+	err = edb.PutStaff(*ann)
+	mtfail(t, err, "put staff, %v", err)
+	code, report = post(&login.User{Guid: 2, Username: "ann"}, "bob@example.com,editor,City\n")
+	if code != 200 || report.Updated != 1 || len(mail.sent) != 2 {
+		t.Errorf("update %d %#v", code, report)
+	}
+	if bob, _ := edb.GetStaff("bob@example.com"); bob.Role != StaffEditor || bob.Organization != "City" {
+		t.Errorf("bob %#v", bob)
+	}
+
+	// an expired invite is sent again
+	bob, _ := edb.GetStaff("bob@example.com")
+	err = edb.MakeInviteToken("OLD", time.Now().Add(-time.Hour))
+	mtfail(t, err, "make token, %v", err)
+	bob.Invite = "OLD"
+	edb.PutStaff(*bob)
+	code, report = post(root, "bob@example.com,editor,City\n")
+	if code != 200 || report.Invited != 1 || len(mail.sent) != 3 {
+		t.Errorf("re-invite %d %#v", code, report)
+	}
+
+	rec := httptest.NewRecorder()
+	sh.handleStaff(rec, httptest.NewRequest("GET", "/admin/staff", nil), root)
+	var staff []staffRecord
+	json.Unmarshal(rec.Body.Bytes(), &staff)
+	if rec.Code != 200 || len(staff) != 2 {
+		t.Errorf("list %d %s", rec.Code, rec.Body.String())
+	}
+}
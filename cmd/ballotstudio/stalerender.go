@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// When the draw backend is down (draw.IsUnavailable), getPdf and getPamphlet
+// fall back to the last good render of the election from sh.stale, which editing
+// doesn't invalidate. Responses built from one carry a Warning header.
+// Stale renders are never put back in sh.cache, so the next request after the
+// backend recovers draws the current document.
+
+const staleWarning = `110 ballotstudio "draw backend unavailable, this is an older render"`
+
+type staleNoteKey struct{}
+
+// staleNote records whether a request was answered from a stale render,
+// and any warnings about what the render left out (draw.Degradable)
+type staleNote struct {
+	stale    bool
+	warnings []string
+}
+
+// withStaleNote returns ctx's staleNote, adding one if needed
+func withStaleNote(ctx context.Context) (context.Context, *staleNote) {
+	if sn, ok := ctx.Value(staleNoteKey{}).(*staleNote); ok {
+		return ctx, sn
+	}
+	sn := &staleNote{}
+	return context.WithValue(ctx, staleNoteKey{}, sn), sn
+}
+
+func markStale(ctx context.Context) {
+	if sn, ok := ctx.Value(staleNoteKey{}).(*staleNote); ok {
+		sn.stale = true
+	}
+}
+
+func noteWarnings(ctx context.Context, warnings []string) {
+	if sn, ok := ctx.Value(staleNoteKey{}).(*staleNote); ok {
+		sn.warnings = warnings
+	}
+}
+
+func (sn *staleNote) setHeader(w http.ResponseWriter) {
+	if sn.stale {
+		w.Header().Set("Warning", staleWarning)
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	for _, warning := range sn.warnings {
+		w.Header().Add("Warning", fmt.Sprintf("299 ballotstudio %q", warning))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+func TestStaleRender(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{BackendUrl: down.URL}}
+	doc := `{"Election": []}`
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+	el := strconv.FormatInt(eid, 10)
+
+	_, err = sh.getPdf(context.Background(), el, draw.RenderOptions{}, false)
+	if err == nil || err.(*httpError).code != 503 {
+		t.Errorf("no stale render got %v", err)
+	}
+
+	old := &draw.DrawBothOb{Pdf: []byte("%PDF old"), BubblesJson: []byte(`{}`)}
+	sh.stale.Put(el, old, 10)
+	ctx, note := withStaleNote(context.Background())
+	bothob, err := sh.getPdf(ctx, el, draw.RenderOptions{}, false)
+	if err != nil || bothob != old || !note.stale {
+		t.Errorf("stale got %v %v stale=%v", bothob, err, note.stale)
+	}
+	if sh.cache.Get(renderKey(el, doc, draw.RenderOptions{})) != nil {
+		t.Errorf("stale render cached as current")
+	}
+	rec := httptest.NewRecorder()
+	note.setHeader(rec)
+	if rec.Header().Get("Warning") == "" {
+		t.Errorf("no Warning header")
+	}
+}
+
+func TestRenderWarnings(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	// in process renderer, no photos
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}, drawClient: &draw.Client{}}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: `{"Election": [{"Candidate": [{"@id": "c1", "PhotoUri": "data:image/png;base64,AAAA"}], "BallotStyle": [{"GpUnitIds": ["g1"], "OrderedContent": []}]}]}`})
+	mtfail(t, err, "put election, %v", err)
+	el := strconv.FormatInt(eid, 10)
+
+	for _, pass := range []string{"drawn", "cached"} {
+		ctx, note := withStaleNote(context.Background())
+		_, err = sh.getPdf(ctx, el, draw.RenderOptions{}, false)
+		mtfail(t, err, "%s getPdf, %v", pass, err)
+		rec := httptest.NewRecorder()
+		note.setHeader(rec)
+		if w := rec.Header().Get("Warning"); !strings.HasPrefix(w, "299 ") || !strings.Contains(w, "photos") {
+			t.Errorf("%s Warning %q", pass, w)
+		}
+	}
+
+	eid, err = edb.PutElection(electionRecord{Owner: 7, Data: `{"Election": [{"Name": "亀"}]}`})
+	mtfail(t, err, "put election, %v", err)
+	_, err = sh.getPdf(context.Background(), strconv.FormatInt(eid, 10), draw.RenderOptions{}, false)
+	if err == nil || err.(*httpError).code != 501 {
+		t.Errorf("unsupported got %v", err)
+	}
+}
+
+func TestRenderOptionsCache(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}, drawClient: &draw.Client{}}
+	doc := `{"Election": [{"RenderOptions": {"PageSize": "legal"}, "BallotStyle": [{"GpUnitIds": ["g1"], "OrderedContent": []}]}]}`
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+	el := strconv.FormatInt(eid, 10)
+
+	plain, err := sh.getPdf(context.Background(), el, draw.RenderOptions{}, false)
+	mtfail(t, err, "getPdf, %v", err)
+	a4 := draw.RenderOptions{PageSize: "a4"}
+	other, err := sh.getPdf(context.Background(), el, a4, false)
+	mtfail(t, err, "getPdf a4, %v", err)
+	if !strings.Contains(string(plain.Pdf), "612 1008") || !strings.Contains(string(other.Pdf), "595.28 841.89") {
+		t.Errorf("document legal, query a4")
+	}
+	_, err = sh.getPng(context.Background(), el, a4, false)
+	mtfail(t, err, "getPng a4, %v", err)
+	if sh.cache.Get(renderKey(el, doc, a4)) != other || sh.cache.Get(renderKey(el+".png", doc, a4)) == nil {
+		t.Errorf("a4 renders not cached")
+	}
+
+	// a new version misses the cache with nothing invalidated
+	_, err = edb.PutElection(electionRecord{Id: eid, Owner: 7, Data: strings.Replace(doc, "legal", "letter", 1)})
+	mtfail(t, err, "put election, %v", err)
+	again, err := sh.getPdf(context.Background(), el, draw.RenderOptions{}, false)
+	mtfail(t, err, "getPdf new version, %v", err)
+	if again == plain || !strings.Contains(string(again.Pdf), "612 792") {
+		t.Errorf("new version drew the old one")
+	}
+
+	sh.invalidateElection(el)
+	if sh.cache.Get(renderKey(el, doc, draw.RenderOptions{})) != nil || sh.cache.Get(renderKey(el, doc, a4)) != nil || sh.cache.Get(renderKey(el+".png", doc, a4)) != nil {
+		t.Errorf("renders with options not invalidated")
+	}
+}
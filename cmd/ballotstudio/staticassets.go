@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Static files under fingerprinted names. Each file in static/ is also
+// served as its name with a hash of its content before the extension,
+// /static/index.3f2a1b9c0d4e.js, which can be cached for good since a
+// changed file gets a new name. Templates link to those names with
+// {{ .Asset "index.js" }}, so a deploy's new editor JS and CSS are picked
+// up at once. Plain names still work, revalidated with an ETag each time,
+// for what the editor's JS loads by name. With -dev the files may change
+// under a running server, so they are served plain and uncached.
+
+// staticFiles are the fingerprinted files, nil with -dev
+var staticFiles *staticAssets
+
+type staticAssets struct {
+	files  http.Handler
+	hashed map[string]string // name -> fingerprinted name
+	names  map[string]string // fingerprinted name -> name
+	etags  map[string]string // name -> ETag
+}
+
+func newStaticAssets(fsys fs.FS) (*staticAssets, error) {
+	sa := &staticAssets{
+		files:  http.FileServer(http.FS(fsys)),
+		hashed: make(map[string]string),
+		names:  make(map[string]string),
+		etags:  make(map[string]string),
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		ext := path.Ext(name)
+		hashed := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:6]) + ext
+		sa.hashed[name] = hashed
+		sa.names[hashed] = name
+		sa.etags[name] = sumETag(sum[:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sa, nil
+}
+
+// fingerprinted is name's fingerprinted name, or name if there's no such file
+func (sa *staticAssets) fingerprinted(name string) string {
+	if sa == nil {
+		return name
+	}
+	if hashed, ok := sa.hashed[strings.TrimPrefix(name, "/")]; ok {
+		return hashed
+	}
+	return name
+}
+
+// ServeHTTP serves a file by its name relative to static/, under http.StripPrefix
+func (sa *staticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	if name, ok := sa.names[r.URL.Path]; ok {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		r = r.Clone(r.Context())
+		r.URL.Path = name
+		r.URL.RawPath = ""
+	} else if etag, ok := sa.etags[r.URL.Path]; ok {
+		h.Set("Cache-Control", "no-cache")
+		h.Set("ETag", etag)
+	}
+	sa.files.ServeHTTP(w, r)
+}
+
+// Asset is the URL of static file name, fingerprinted if it can be
+func (ec EditContext) Asset(name string) string {
+	return ec.StaticRoot + "/" + staticFiles.fingerprinted(name)
+}
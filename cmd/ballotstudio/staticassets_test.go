@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStaticAssets(t *testing.T) {
+	sa, err := newStaticAssets(fstest.MapFS{
+		"index.js":     {Data: []byte("var x = 1;")},
+		"img/delx.svg": {Data: []byte("<svg/>")},
+	})
+	mtfail(t, err, "static assets, %v", err)
+	hashed := sa.fingerprinted("index.js")
+	if !strings.HasPrefix(hashed, "index.") || !strings.HasSuffix(hashed, ".js") || hashed == "index.js" {
+		t.Fatalf("fingerprinted %q", hashed)
+	}
+	if svg := sa.fingerprinted("img/delx.svg"); !strings.HasPrefix(svg, "img/delx.") {
+		t.Errorf("fingerprinted svg %q", svg)
+	}
+	if sa.fingerprinted("nope.css") != "nope.css" {
+		t.Errorf("missing file fingerprinted")
+	}
+	h := http.StripPrefix("/static/", sa)
+	get := func(path, inm string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	rec := get("/static/"+hashed, "")
+	if rec.Code != 200 || rec.Body.String() != "var x = 1;" || !strings.Contains(rec.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("fingerprinted %d %v", rec.Code, rec.Header())
+	}
+	rec = get("/static/index.js", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 200 || rec.Header().Get("Cache-Control") != "no-cache" || etag == "" {
+		t.Errorf("plain %d %v", rec.Code, rec.Header())
+	}
+	if rec = get("/static/index.js", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("revalidate %d", rec.Code)
+	}
+	if rec = get("/static/index.000000000000.js", ""); rec.Code != 404 {
+		t.Errorf("wrong fingerprint %d", rec.Code)
+	}
+
+	defer func() { staticFiles = nil }()
+	staticFiles = sa
+	ec := EditContext{StaticRoot: "/ballotstudio/static"}
+	if got := ec.Asset("index.js"); got != "/ballotstudio/static/"+hashed {
+		t.Errorf("Asset %q", got)
+	}
+	staticFiles = nil
+	if got := ec.Asset("index.js"); got != "/ballotstudio/static/index.js" {
+		t.Errorf("dev Asset %q", got)
+	}
+}
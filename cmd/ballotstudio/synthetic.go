@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/ballotstudio/synth"
+	"github.com/brianolson/login/login"
+)
+
+// Synthetic marked ballots, to benchmark the scanner without paper.
+//
+//	POST /election/{id}/synthetic.jpg  body syntheticBallotRequest, one marked page as a scanner would send it
+//	POST /election/{id}/synthetic.png  the same, lossless
+
+// markSource is an election's current render, for drawing marks on
+type markSource struct {
+	bj      *scan.BubblesJson
+	bubbles *scan.BubblesV2
+	pngs    [][]byte
+	decoded []image.Image // pngs, once something needs them
+	// points
+	pageWidth, pageHeight float64
+}
+
+// withPages also gets the page PNGs.
+// errors are *httpError
+func (sh *StudioHandler) markSource(ctx context.Context, electionid int64, withPages bool) (*markSource, error) {
+	itemname := strconv.FormatInt(electionid, 10)
+	ctx, note := withStaleNote(ctx)
+	bothob, err := sh.getPdf(ctx, itemname, draw.RenderOptions{}, false)
+	if err != nil {
+		return nil, err
+	}
+	// only the bubbles are needed
+	bothob.Release()
+	if note.stale {
+		// marks must land where the current layout puts the bubbles
+		return nil, &httpError{503, "draw backend unavailable", draw.ErrUnavailable}
+	}
+	bj, err := scan.ParseBubbles(bothob.BubblesJson)
+	if err != nil {
+		return nil, &httpError{500, "bubble json decode", err}
+	}
+	if bj.DrawSettings == nil || len(bj.DrawSettings.PageSize) != 2 {
+		return nil, &httpError{500, "no page size from the draw backend", nil}
+	}
+	ms := &markSource{
+		bj:         bj,
+		bubbles:    bj.V2(),
+		pageWidth:  bj.DrawSettings.PageSize[0],
+		pageHeight: bj.DrawSettings.PageSize[1],
+	}
+	if withPages {
+		ms.pngs, err = sh.getPng(ctx, itemname, draw.RenderOptions{}, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// pages decodes the page PNGs the first time they're needed
+func (ms *markSource) pages() ([]image.Image, error) {
+	if ms.decoded != nil {
+		return ms.decoded, nil
+	}
+	decoded := make([]image.Image, len(ms.pngs))
+	for i, pngbytes := range ms.pngs {
+		var err error
+		decoded[i], _, err = image.Decode(bytes.NewReader(pngbytes))
+		if err != nil {
+			return nil, fmt.Errorf("page %d png, %v", i+1, err)
+		}
+	}
+	ms.decoded = decoded
+	return decoded, nil
+}
+
+// syntheticBallotRequest is what to mark and how the scan should look
+type syntheticBallotRequest struct {
+	// Style is the index of the ballot style in the bubbles JSON
+	Style int `json:"style"`
+
+	// Page of the style, from 1, 0 for 1
+	Page int `json:"page,omitempty"`
+
+	// Votes is contest id -> selection id -> marked, like a scan result
+	Votes map[string]map[string]bool `json:"votes"`
+
+	synth.Options
+}
+
+// limits on perturbation, past these nothing could read the page
+const (
+	maxSynthFill   = 1.5
+	maxSynthJitter = 0.5
+	maxSynthRotate = 10
+	maxSynthNoise  = 100
+)
+
+func (req *syntheticBallotRequest) check() error {
+	if req.Fill < 0 || req.Fill > maxSynthFill {
+		return fmt.Errorf("fill %v not in 0-%v", req.Fill, maxSynthFill)
+	}
+	if req.Jitter < 0 || req.Jitter > maxSynthJitter {
+		return fmt.Errorf("jitter %v not in 0-%v", req.Jitter, maxSynthJitter)
+	}
+	if req.Rotate < -maxSynthRotate || req.Rotate > maxSynthRotate {
+		return fmt.Errorf("rotate %v not in -%d-%d degrees", req.Rotate, maxSynthRotate, maxSynthRotate)
+	}
+	if req.Noise < 0 || req.Noise > maxSynthNoise {
+		return fmt.Errorf("noise %v not in 0-%d", req.Noise, maxSynthNoise)
+	}
+	if req.Page < 0 {
+		return fmt.Errorf("page %d", req.Page)
+	}
+	return nil
+}
+
+func (sh *StudioHandler) handleSyntheticBallot(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64, format string) {
+	if r.Method != "POST" {
+		http.Error(w, "nope", http.StatusMethodNotAllowed)
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, sh.maxDocBytes()))
+	if maybeerr(w, err, 400, "bad body") {
+		return
+	}
+	var req syntheticBallotRequest
+	err = json.Unmarshal(body, &req)
+	if maybeerr(w, err, 400, "bad json, %v", err) {
+		return
+	}
+	err = req.check()
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	ms, err := sh.markSource(r.Context(), electionid, true)
+	if err != nil {
+		he := err.(*httpError)
+		if he.err == nil {
+			texterr(w, he.code, "%s", he.msg)
+		} else {
+			maybeerr(w, he.err, he.code, he.msg)
+		}
+		return
+	}
+	first, count, err := synth.StylePages(ms.bubbles, req.Style, len(ms.pngs))
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	page := req.Page
+	if page == 0 {
+		page = 1
+	}
+	if page > count {
+		texterr(w, 400, "ballot style %d has %d pages", req.Style, count)
+		return
+	}
+	pages, err := ms.pages()
+	if maybeerr(w, err, 500, "%v", err) {
+		return
+	}
+	// the whole style, so a seed draws the same page alone or in a set
+	marked, err := synth.Ballot(ms.bubbles, pages, ms.pageWidth, ms.pageHeight, req.Style, req.Votes, req.Options)
+	if maybeerr(w, err, 500, "%v", err) {
+		return
+	}
+	im := marked[page-1]
+	var out bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&out, im)
+	} else {
+		err = jpeg.Encode(&out, im, &jpeg.Options{Quality: 90})
+		format = "jpeg"
+	}
+	if maybeerr(w, err, 500, "encode, %v", err) {
+		return
+	}
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Header().Set("X-Ballot-Page", strconv.Itoa(first+page-1))
+	w.WriteHeader(200)
+	w.Write(out.Bytes())
+}
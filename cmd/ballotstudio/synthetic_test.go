@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"image"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/login/login"
+)
+
+func TestSyntheticBallot(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}}
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	bob := &login.User{Guid: 8, Username: "bob"}
+
+	post := func(user *login.User, format, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sh.handleSyntheticBallot(rec, httptest.NewRequest("POST", "/election/1/synthetic."+format, strings.NewReader(body)), user, eid, format)
+		return rec
+	}
+	if rec := post(nil, "jpg", `{}`); rec.Code != 401 {
+		t.Errorf("no user %d", rec.Code)
+	}
+	for _, bad := range []string{`{"style": 1}`, `{"page": 2}`, `{"rotate": 45}`, `{"fill": -1}`, `{"noise": 1000}`} {
+		if rec := post(bob, "jpg", bad); rec.Code != 400 {
+			t.Errorf("%s %d", bad, rec.Code)
+		}
+	}
+
+	want := map[string]map[string]bool{"ccont1": {"csel2": true}, "bmc1": {"bms1": true}}
+	body := `{"votes": {"ccont1": {"csel2": true}, "bmc1": {"bms1": true}}, "seed": 3, "jitter": 0.05, "rotate": 0.3, "noise": 6}`
+	rec := post(bob, "jpg", body)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/jpeg" || rec.Header().Get("X-Ballot-Page") != "1" {
+		t.Fatalf("jpg %d %v %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	first := rec.Body.String()
+	if again := post(bob, "jpg", body); again.Body.String() != first {
+		t.Errorf("same seed drew a different page")
+	}
+	im, _, err := image.Decode(rec.Body)
+	mtfail(t, err, "decode, %v", err)
+	result, _, err := sh.readScan(context.Background(), eid, 0, im)
+	mtfail(t, err, "read, %v", err)
+	got := scan.MarkedFromReadings(result.Readings)
+	for cid, sels := range got {
+		for sid, marked := range sels {
+			if !marked {
+				delete(sels, sid)
+			}
+		}
+		if len(sels) == 0 {
+			delete(got, cid)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, marked %v", got, want)
+	}
+
+	if rec := post(bob, "png", `{"votes": {}}`); rec.Code != 200 || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("png %d %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/brianolson/login/login"
+)
+
+// Tags are an owner's labels on their elections, like "2024-general" or a
+// county name, for sorting many ballot designs into folders by cycle and
+// jurisdiction. They're private to the owner and aren't part of the document,
+// so they can change in any lifecycle state.
+//
+//	GET /election/{id}/tags              ["2024-general", "king county"]
+//	PUT /election/{id}/tags              ["a", "b"] replaces them all
+//	PUT /election/{id}/tags/{tag}        adds one
+//	DELETE /election/{id}/tags/{tag}     removes one
+//	GET /elections/tags                  [{"tag":"2024-general","count":3}, ...]
+//	GET /elections/tags/{tag}            your elections with that tag
+//	GET /?tag=2024-general               the home page list, filtered
+//
+// The changes all return the election's tags after.
+
+// most bytes in a tag
+const maxTagLen = 64
+
+// most tags on one election
+const maxElectionTags = 32
+
+// one folder in GET /elections/tags
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// one election in GET /elections/tags/{tag}
+type taggedElection struct {
+	ElectionId int64    `json:"itemid"`
+	State      string   `json:"state"`
+	Tags       []string `json:"tags"`
+	EditURL    string   `json:"edit"`
+}
+
+// cleanTag lower cases a tag and squeezes its spaces. Letters, digits, space,
+// '-', '_' and '.' are allowed.
+func cleanTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+	if tag == "" || len(tag) > maxTagLen {
+		return "", fmt.Errorf("tags must be 1 to %d bytes", maxTagLen)
+	}
+	for _, c := range tag {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune(" -_.", c) {
+			return "", fmt.Errorf("bad tag %q, use letters, digits, space, '-', '_' and '.'", tag)
+		}
+	}
+	return tag, nil
+}
+
+// cleanTags cleans each tag, dropping duplicates, and sorts them
+func cleanTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	out := []string{}
+	for _, tag := range tags {
+		tag, err := cleanTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	if len(out) > maxElectionTags {
+		return nil, fmt.Errorf("at most %d tags on an election", maxElectionTags)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// countTags makes the folder list from TagsForUser, most used first
+func countTags(byElection map[int64][]string) []tagCount {
+	counts := make(map[string]int)
+	for _, tags := range byElection {
+		for _, tag := range tags {
+			counts[tag]++
+		}
+	}
+	out := []tagCount{}
+	for tag, n := range counts {
+		out = append(out, tagCount{tag, n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Tag < out[j].Tag
+	})
+	return out
+}
+
+// GET|PUT /election/{id}/tags, PUT|DELETE /election/{id}/tags/{tag}
+func (sh *StudioHandler) handleElectionTags(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64, tag string) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	tags, err := sh.edb.ElectionTags(electionid)
+	if maybeerr(w, err, 500, "db tags") {
+		return
+	}
+	var next []string
+	switch {
+	case r.Method == "GET" && tag == "":
+		if tags == nil {
+			tags = []string{}
+		}
+		writeJSON(w, tags)
+		return
+	case r.Method == "PUT" && tag == "":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxElectionTags*(maxTagLen+10)))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		err = json.Unmarshal(body, &next)
+		if maybeerr(w, err, 400, "want a json list of tags") {
+			return
+		}
+	case r.Method == "PUT":
+		next = append(tags, tag)
+	case r.Method == "DELETE" && tag != "":
+		tag, err = cleanTag(tag)
+		if maybeerr(w, err, 400, "%v", err) {
+			return
+		}
+		for _, t := range tags {
+			if t != tag {
+				next = append(next, t)
+			}
+		}
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET or PUT tags, PUT or DELETE a tag")
+		return
+	}
+	next, err = cleanTags(next)
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	err = sh.edb.SetElectionTags(electionid, next)
+	if maybeerr(w, err, 500, "db set tags") {
+		return
+	}
+	writeJSON(w, next)
+}
+
+// GET /elections/tags, GET /elections/tags/{tag}
+func (sh *StudioHandler) handleTags(w http.ResponseWriter, r *http.Request, user *login.User, tag string) {
+	if r.Method != "GET" {
+		texterr(w, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	byElection, err := sh.edb.TagsForUser(user.Guid)
+	if maybeerr(w, err, 500, "db tags") {
+		return
+	}
+	if tag == "" {
+		writeJSON(w, countTags(byElection))
+		return
+	}
+	tag, err = cleanTag(tag)
+	if maybeerr(w, err, 400, "%v", err) {
+		return
+	}
+	out := []taggedElection{}
+	for eid, tags := range byElection {
+		if !hasTag(tags, tag) {
+			continue
+		}
+		state, _ := sh.edb.GetElectionState(eid)
+		out = append(out, taggedElection{eid, state, tags, sitePath(r, "/edit/"+electionRef(r, eid))})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ElectionId < out[j].ElectionId })
+	writeJSON(w, out)
+}
+
+// queryTags maps election to its sorted tags. Common to all backends, query
+// selects election, tag.
+func queryTags(db sqlDB, query string, arg interface{}) (map[int64][]string, error) {
+	rows, err := db.Query(query, arg)
+	if err != nil {
+		return nil, fmt.Errorf("tags, %v", err)
+	}
+	defer rows.Close()
+	out := make(map[int64][]string)
+	for rows.Next() {
+		var eid int64
+		var tag string
+		err = rows.Scan(&eid, &tag)
+		if err != nil {
+			return nil, fmt.Errorf("tags row, %v", err)
+		}
+		out[eid] = append(out[eid], tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("tags rows, %v", err)
+	}
+	for _, tags := range out {
+		sort.Strings(tags)
+	}
+	return out, nil
+}
+
+// setElectionTags replaces election eid's tags. Common to all backends, param
+// is "$" for numbered placeholders or "?".
+func setElectionTags(db sqlDB, param string, eid int64, tags []string) error {
+	p1, p2 := "$1", "$2"
+	if param == "?" {
+		p1, p2 = "?", "?"
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("tags tx, %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM election_tags WHERE election = "+p1, eid)
+	if err != nil {
+		return fmt.Errorf("tags delete, %v", err)
+	}
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT INTO election_tags (election, tag) VALUES ("+p1+", "+p2+")", eid, tag)
+		if err != nil {
+			return fmt.Errorf("tags insert, %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("tags commit, %v", err)
+	}
+	return nil
+}
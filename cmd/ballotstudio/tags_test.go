@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestCleanTags(t *testing.T) {
+	got, err := cleanTags([]string{" King   County ", "2024-General", "king county", "v1.2_final"})
+	if err != nil || !reflect.DeepEqual(got, []string{"2024-general", "king county", "v1.2_final"}) {
+		t.Errorf("got %v %v", got, err)
+	}
+	for _, bad := range []string{"", "   ", "a/b", "<b>", strings.Repeat("x", maxTagLen+1)} {
+		if _, err := cleanTag(bad); err == nil {
+			t.Errorf("%q should be bad", bad)
+		}
+	}
+	many := make([]string, maxElectionTags+1)
+	for i := range many {
+		many[i] = strings.Repeat("t", i+1)
+	}
+	if _, err := cleanTags(many); err == nil {
+		t.Errorf("too many tags allowed")
+	}
+}
+
+func TestElectionTags(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	var eids []int64
+	for _, owner := range []int64{1, 1, 1, 2} {
+		eid, err := edb.PutElection(electionRecord{Owner: owner, Data: `{"Election": []}`})
+		mtfail(t, err, "put, %v", err)
+		eids = append(eids, eid)
+	}
+	sh := StudioHandler{edb: edb}
+	ann := &login.User{Guid: 1}
+	do := func(user *login.User, method, path, body string, out interface{}) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if m := electionTagsPathRe.FindStringSubmatch(r.URL.Path); m != nil {
+			eid, _ := strconv.ParseInt(m[1], 10, 64)
+			sh.handleElectionTags(rec, r, user, eid, m[2])
+		} else {
+			m = tagsPathRe.FindStringSubmatch(r.URL.Path)
+			sh.handleTags(rec, r, user, m[1])
+		}
+		if out != nil && rec.Code == 200 {
+			err := json.Unmarshal(rec.Body.Bytes(), out)
+			mtfail(t, err, "%s %s json, %v", method, path, err)
+		}
+		return rec.Code
+	}
+	var tags []string
+	if code := do(ann, "GET", "/election/1/tags", "", &tags); code != 200 || tags == nil || len(tags) != 0 {
+		t.Errorf("no tags %d %v", code, tags)
+	}
+	if code := do(ann, "PUT", "/election/1/tags", `["2024-General", "draft", "draft"]`, &tags); code != 200 || !reflect.DeepEqual(tags, []string{"2024-general", "draft"}) {
+		t.Errorf("put tags %d %v", code, tags)
+	}
+	if code := do(ann, "PUT", "/election/1/tags/King%20County", "", &tags); code != 200 || !reflect.DeepEqual(tags, []string{"2024-general", "draft", "king county"}) {
+		t.Errorf("add tag %d %v", code, tags)
+	}
+	if code := do(ann, "DELETE", "/election/1/tags/draft", "", &tags); code != 200 || !reflect.DeepEqual(tags, []string{"2024-general", "king county"}) {
+		t.Errorf("remove tag %d %v", code, tags)
+	}
+	do(ann, "PUT", "/election/2/tags/2024-general", "", nil)
+	do(ann, "PUT", "/election/3/tags/2024-general", "", nil)
+	if code := do(ann, "PUT", "/election/1/tags", `"draft"`, nil); code != 400 {
+		t.Errorf("not a list %d", code)
+	}
+	if code := do(ann, "PUT", "/election/1/tags/a.b,c", "", nil); code != 400 {
+		t.Errorf("bad tag %d", code)
+	}
+	if code := do(ann, "PUT", "/election/4/tags/mine", "", nil); code != 403 {
+		t.Errorf("someone else's election %d", code)
+	}
+	if code := do(nil, "GET", "/election/1/tags", "", nil); code != 401 {
+		t.Errorf("anonymous %d", code)
+	}
+
+	// trashed elections drop out of the folders, and come back with their tags
+	err := edb.TrashElection(eids[2], time.Now())
+	mtfail(t, err, "trash, %v", err)
+	var folders []tagCount
+	if code := do(ann, "GET", "/elections/tags", "", &folders); code != 200 || !reflect.DeepEqual(folders, []tagCount{{"2024-general", 2}, {"king county", 1}}) {
+		t.Errorf("folders %d %v", code, folders)
+	}
+	var tagged []taggedElection
+	if code := do(ann, "GET", "/elections/tags/2024-General", "", &tagged); code != 200 || len(tagged) != 2 || tagged[0].ElectionId != eids[0] || tagged[1].ElectionId != eids[1] || tagged[0].State != StateDraft || tagged[0].EditURL != "/edit/1" {
+		t.Errorf("tagged %d %#v", code, tagged)
+	}
+	err = edb.UntrashElection(eids[2])
+	mtfail(t, err, "untrash, %v", err)
+	if code := do(ann, "GET", "/elections/tags/2024-general", "", &tagged); code != 200 || len(tagged) != 3 {
+		t.Errorf("after untrash %d %v", code, tagged)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/login/login"
+)
+
+// Election templates. Any string in an election document may hold {{name}}
+// placeholders, e.g. "{{jurisdiction}} General Election" or a Party LogoUri of
+// "{{seal}}". The owner marks the election as a template with
+// POST /election/{id}/template (body true|false), then anyone logged in can
+// make their own copy with POST /election?template={id} and a body of
+// {"name": "value", ...} filling in every placeholder. A value that is a
+// data:image/... URI is stored as uploaded media and replaced with its URL,
+// for seals and logos.
+
+var templatePlaceholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z][A-Za-z0-9_]*)\s*\}\}`)
+
+type electionTemplateJSON struct {
+	ElectionId int64    `json:"itemid"`
+	Template   bool     `json:"template"`
+	Params     []string `json:"params"`
+}
+
+// templateParams lists the placeholder names in a document, sorted
+func templateParams(doc string) []string {
+	seen := make(map[string]bool)
+	params := []string{}
+	for _, m := range templatePlaceholderRe.FindAllStringSubmatch(doc, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			params = append(params, m[1])
+		}
+	}
+	sort.Strings(params)
+	return params
+}
+
+// fillTemplate replaces placeholders in every string in ob, returning any names params doesn't have
+func fillTemplate(ob interface{}, params map[string]string) (out interface{}, missing []string) {
+	missed := make(map[string]bool)
+	var fill func(v interface{}) interface{}
+	fill = func(v interface{}) interface{} {
+		switch xv := v.(type) {
+		case map[string]interface{}:
+			for k, sub := range xv {
+				xv[k] = fill(sub)
+			}
+		case []interface{}:
+			for i, sub := range xv {
+				xv[i] = fill(sub)
+			}
+		case string:
+			return templatePlaceholderRe.ReplaceAllStringFunc(xv, func(ph string) string {
+				name := templatePlaceholderRe.FindStringSubmatch(ph)[1]
+				value, ok := params[name]
+				if !ok {
+					missed[name] = true
+					return ph
+				}
+				return value
+			})
+		}
+		return v
+	}
+	out = fill(ob)
+	for name := range missed {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	return
+}
+
+// storeDataURIParams replaces data:image/... parameter values with uploaded media URLs
+func (sh *StudioHandler) storeDataURIParams(params map[string]string) error {
+	for name, value := range params {
+		if !strings.HasPrefix(value, "data:") {
+			continue
+		}
+		comma := strings.IndexByte(value, ',')
+		if comma < 0 || !strings.HasSuffix(value[:comma], ";base64") {
+			return fmt.Errorf("%s: want a base64 data: URI", name)
+		}
+		mdata, err := base64.StdEncoding.DecodeString(value[comma+1:])
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if int64(len(mdata)) > sh.mediaMaxBytes {
+			return fmt.Errorf("%s: image over %d bytes", name, sh.mediaMaxBytes)
+		}
+		contentType, _, _, err := checkMedia(mdata)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		mediaid, err := sh.media.PutMedia(mdata, contentType)
+		if err != nil {
+			return &httpError{500, "media put", err}
+		}
+		// election id fixed up after the new election has one
+		params[name] = "/election/0/media/" + mediaid
+	}
+	return nil
+}
+
+// instantiateTemplate makes a new draft election for owner from template election templateid
+func (sh *StudioHandler) instantiateTemplate(templateid int64, owner int64, params map[string]string) (newid int64, err error) {
+	er, err := sh.edb.GetElection(templateid)
+	if err != nil || er.Trashed != 0 {
+		return 0, &httpError{404, "no such template", err}
+	}
+	if !parseElectionMeta(er.Meta).Template && er.Owner != owner {
+		return 0, &httpError{403, fmt.Sprintf("election %d is not a template", templateid), nil}
+	}
+	var ob map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &ob)
+	if err != nil {
+		return 0, &httpError{500, "bad template json", err}
+	}
+	err = sh.storeDataURIParams(params)
+	if err != nil {
+		if he, ok := err.(*httpError); ok {
+			return 0, he
+		}
+		return 0, &httpError{400, err.Error(), nil}
+	}
+	filled, missing := fillTemplate(ob, params)
+	if len(missing) != 0 {
+		return 0, &httpError{400, "missing template parameters: " + strings.Join(missing, ", "), nil}
+	}
+	ob = data.Fixup(filled.(map[string]interface{}))
+	doc, err := json.Marshal(ob)
+	if err != nil {
+		return 0, &httpError{500, "re-json", err}
+	}
+	newid, err = sh.edb.PutElection(electionRecord{Owner: owner, Data: string(doc)})
+	if err != nil {
+		return 0, &httpError{500, "db put fail", err}
+	}
+	// point media references, the template's own and the new ones, at the new election
+	rewritten := mediaRefAnyRe.ReplaceAllString(string(doc), fmt.Sprintf("/election/%d/media/$1", newid))
+	if rewritten != string(doc) {
+		_, err = sh.edb.PutElection(electionRecord{Id: newid, Owner: owner, Data: rewritten})
+		if err != nil {
+			return newid, &httpError{500, "db put fail", err}
+		}
+	}
+	return newid, nil
+}
+
+// POST /election?template={id}, body {"param": "value", ...}
+func (sh *StudioHandler) handleElectionFromTemplate(w http.ResponseWriter, r *http.Request, user *login.User, template string) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	templateid, err := strconv.ParseInt(template, 10, 64)
+	if maybeerr(w, err, 400, "bad template") {
+		return
+	}
+	limit := sh.maxDocBytes() + 2*sh.mediaMaxBytes
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		texterr(w, http.StatusRequestEntityTooLarge, "template parameters too large or broken, limit %d bytes", limit)
+		return
+	}
+	params := make(map[string]string)
+	if len(strings.TrimSpace(string(body))) != 0 {
+		err = json.Unmarshal(body, &params)
+		if maybeerr(w, err, 400, "template parameters want a json object of strings") {
+			return
+		}
+	}
+	if sh.overQuota(w, user, 1, 0) {
+		return
+	}
+	newid, err := sh.instantiateTemplate(templateid, user.Guid, params)
+	if err != nil {
+		he := err.(*httpError)
+		if he.err != nil {
+			maybeerr(w, he.err, he.code, he.msg)
+		} else {
+			texterr(w, he.code, "%s", he.msg)
+		}
+		return
+	}
+	editContextFinish(w, r, newid, nil)
+}
+
+// GET /election/{id}/template lists the placeholders
+// POST /election/{id}/template with body true|false makes it a template or not, owner only
+func (sh *StudioHandler) handleElectionTemplate(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	meta := parseElectionMeta(er.Meta)
+	if r.Method == "POST" {
+		if user == nil {
+			texterr(w, http.StatusUnauthorized, "nope")
+			return
+		}
+		if er.Owner != user.Guid {
+			texterr(w, http.StatusForbidden, "nope")
+			return
+		}
+		if sh.checkElectionState(w, electionid, actionSettings) {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		meta.Template = qbool(strings.TrimSpace(string(body)))
+		er.Meta = meta.String()
+		err = sh.edb.SetElectionMeta(electionid, er.Meta)
+		if maybeerr(w, err, 500, "db put fail") {
+			return
+		}
+	}
+	writeJSON(w, electionTemplateJSON{ElectionId: electionid, Template: meta.Template, Params: templateParams(er.Data)})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTemplateInstantiate(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, media: &memMediaStore{}, mediaMaxBytes: DefaultMediaMaxBytes}
+
+	doc := `{"Election": [{"Name": {"Text": [{"Content": "{{jurisdiction}} General Election", "Language": "en"}]}, "StartDate": "{{ date }}"}], "Party": [{"@id": "p1", "LogoUri": "{{seal}}"}]}`
+	if got := strings.Join(templateParams(doc), ","); got != "date,jurisdiction,seal" {
+		t.Errorf("params got %s", got)
+	}
+	tid, err := edb.PutElection(electionRecord{Owner: 1, Data: doc})
+	mtfail(t, err, "put election, %v", err)
+
+	_, err = sh.instantiateTemplate(tid, 2, map[string]string{})
+	if err == nil || err.(*httpError).code != 403 {
+		t.Errorf("not yet a template got %v", err)
+	}
+	_, err = edb.PutElection(electionRecord{Id: tid, Owner: 1, Data: doc, Meta: electionMeta{Template: true}.String()})
+	mtfail(t, err, "put election, %v", err)
+
+	_, err = sh.instantiateTemplate(tid, 2, map[string]string{"jurisdiction": "Kent County"})
+	if err == nil || !strings.Contains(err.(*httpError).msg, "date, seal") {
+		t.Errorf("missing params got %v", err)
+	}
+
+	seal := "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPng(t, 4, 4))
+	newid, err := sh.instantiateTemplate(tid, 2, map[string]string{"jurisdiction": `Kent "County"`, "date": "2026-11-03", "seal": seal})
+	mtfail(t, err, "instantiate, %v", err)
+	er, err := edb.GetElection(newid)
+	mtfail(t, err, "get new, %v", err)
+	if er.Owner != 2 || er.Meta != "" {
+		t.Errorf("new election owner %d meta %s", er.Owner, er.Meta)
+	}
+	if !strings.Contains(er.Data, `Kent \"County\" General Election`) || !strings.Contains(er.Data, `"2026-11-03"`) || strings.Contains(er.Data, "{{") {
+		t.Errorf("not filled in, %s", er.Data)
+	}
+	if !strings.Contains(er.Data, "/election/"+strconv.FormatInt(newid, 10)+"/media/") {
+		t.Errorf("seal not stored as media, %s", er.Data)
+	}
+}
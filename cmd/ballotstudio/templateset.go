@@ -2,9 +2,10 @@ package main
 
 import (
 	"html/template"
-	"io/ioutil"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"path"
+	"sync"
 	"time"
 )
 
@@ -15,65 +16,93 @@ type tse struct {
 }
 
 type TemplateSet struct {
+	// Reloading re-reads a template on Lookup if its file has changed,
+	// and picks up new files matching Glob. For development.
 	Reloading bool
 
 	Glob string
 
+	fsys fs.FS
+
+	lock sync.Mutex
 	they map[string]tse
 }
 
-func HtmlTemplateGlob(pat string) (out TemplateSet, err error) {
-	out.Glob = pat
-	matches, err := filepath.Glob(pat)
+func HtmlTemplateGlob(pat string) (out *TemplateSet, err error) {
+	return HtmlTemplateFS(os.DirFS("."), pat)
+}
+
+// HtmlTemplateFS loads templates matching pat from fsys.
+// Reloading only has an effect if fsys reports modification times, as os.DirFS does and embed.FS does not.
+func HtmlTemplateFS(fsys fs.FS, pat string) (out *TemplateSet, err error) {
+	out = &TemplateSet{Glob: pat, fsys: fsys}
+	matches, err := fs.Glob(fsys, pat)
 	if err != nil {
 		return
 	}
 	out.they = make(map[string]tse, len(matches))
 	for _, fpath := range matches {
-		_, fname := filepath.Split(fpath)
-		finfo, err := os.Stat(fpath)
-		if err != nil {
-			return out, err
-		}
-		nt := template.New(fname)
-		b, err := ioutil.ReadFile(fpath)
+		ent, err := out.load(fpath)
 		if err != nil {
 			return out, err
 		}
-		nt, err = nt.Parse(string(b))
-		if err != nil {
-			return out, err
-		}
-		out.they[fname] = tse{nt, finfo.ModTime(), fpath}
+		out.they[path.Base(fpath)] = ent
 	}
 	return out, nil
 }
 
+func (ts *TemplateSet) load(fpath string) (ent tse, err error) {
+	finfo, err := fs.Stat(ts.fsys, fpath)
+	if err != nil {
+		return
+	}
+	b, err := fs.ReadFile(ts.fsys, fpath)
+	if err != nil {
+		return
+	}
+	nt, err := template.New(path.Base(fpath)).Parse(string(b))
+	if err != nil {
+		return
+	}
+	return tse{nt, finfo.ModTime(), fpath}, nil
+}
+
 func (ts *TemplateSet) Lookup(name string) (t *template.Template, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
 	ent, ok := ts.they[name]
+	if !ts.Reloading {
+		if !ok {
+			return
+		}
+		return ent.t, nil
+	}
 	if !ok {
-		return
+		// maybe a new file
+		fpath := path.Join(path.Dir(ts.Glob), name)
+		if match, _ := path.Match(ts.Glob, fpath); !match {
+			return
+		}
+		if _, err := fs.Stat(ts.fsys, fpath); err != nil {
+			return nil, nil
+		}
+		ent, err = ts.load(fpath)
+		if err != nil {
+			return nil, err
+		}
+		ts.they[name] = ent
+		return ent.t, nil
 	}
-	if ts.Reloading {
-		finfo, err := os.Stat(ent.path)
+	finfo, err := fs.Stat(ts.fsys, ent.path)
+	if err != nil {
+		return t, err
+	}
+	if !finfo.ModTime().Equal(ent.lastmod) {
+		ent, err = ts.load(ent.path)
 		if err != nil {
 			return t, err
 		}
-		mtime := finfo.ModTime()
-		if mtime.After(ent.lastmod) {
-			nt := template.New(name)
-			b, err := ioutil.ReadFile(ent.path)
-			if err != nil {
-				return t, err
-			}
-			nt, err = nt.Parse(string(b))
-			if err != nil {
-				return t, err
-			}
-			ent.t = nt
-			ent.lastmod = mtime
-			ts.they[name] = ent
-		}
+		ts.they[name] = ent
 	}
 	return ent.t, nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brianolson/ballotstudio"
+)
+
+func TestEmbeddedTemplates(t *testing.T) {
+	templates, err := HtmlTemplateFS(ballotstudio.Templates, "gotemplates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"edit.html", "home.html", "scanform.html", "signup.html", "invitetoken.html", "results.html", "sample.html", "ballot.html"} {
+		tmpl, err := templates.Lookup(name)
+		if err != nil || tmpl == nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	_, err = ballotstudio.Static.ReadFile("static/index.js")
+	if err != nil {
+		t.Errorf("static/index.js, %v", err)
+	}
+}
+
+func TestTemplateReloading(t *testing.T) {
+	dir := t.TempDir()
+	tdir := filepath.Join(dir, "gotemplates")
+	err := os.Mkdir(tdir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(ts *TemplateSet, name string) string {
+		tmpl, err := ts.Lookup(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if tmpl == nil {
+			return ""
+		}
+		var buf bytes.Buffer
+		tmpl.Execute(&buf, nil)
+		return buf.String()
+	}
+	write := func(name, text string, mtime time.Time) {
+		fpath := filepath.Join(tdir, name)
+		err := ioutil.WriteFile(fpath, []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fpath, mtime, mtime)
+	}
+	start := time.Now().Add(-time.Hour)
+	write("a.html", "one", start)
+
+	ts, err := HtmlTemplateFS(os.DirFS(dir), "gotemplates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("a.html", "two", start.Add(time.Minute))
+	write("b.html", "bee", start)
+	if render(ts, "a.html") != "one" || render(ts, "b.html") != "" {
+		t.Errorf("templates changed without Reloading")
+	}
+	ts.Reloading = true
+	if got := render(ts, "a.html"); got != "two" {
+		t.Errorf("a.html got %#v after change", got)
+	}
+	if got := render(ts, "b.html"); got != "bee" {
+		t.Errorf("new b.html got %#v", got)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/ballotstudio/synth"
+	"github.com/brianolson/login/login"
+)
+
+// Logic and accuracy test decks, election owner only.
+//
+//	GET /election/{id}/testdeck.pdf   pre-marked ballots to feed the scanner
+//	GET /election/{id}/testdeck.json  what is marked on each, and the totals a correct count gives
+//
+// For each ballot style, the Nth selection of every contest is marked on N
+// ballots, so every voting position gets a different total and a swapped or
+// dead position shows up in the count. ?once=1 marks each position on just
+// one ballot instead, for contests too long for that. Then one ballot
+// overvotes every contest that can be, and one is blank. The expected totals
+// are in the same form as /election/{id}/results.json.
+
+// most ballots in a deck
+const maxTestDeckBallots = 300
+
+const (
+	testDeckPositions = "positions"
+	testDeckOvervote  = "overvote"
+	testDeckBlank     = "blank"
+)
+
+// one pre-marked ballot
+type testDeckBallot struct {
+	// Number is printed on each page, from 1
+	Number int `json:"number"`
+	// Style is the index into the document's BallotStyle list
+	Style   int    `json:"style"`
+	Pattern string `json:"pattern"`
+	// Marks is contest id -> selection id -> marked, like a scan result
+	Marks map[string]map[string]bool `json:"marks"`
+}
+
+type testDeck struct {
+	ElectionId int64            `json:"itemid"`
+	Ballots    []testDeckBallot `json:"ballots"`
+	Expected   resultsTally     `json:"expected"`
+}
+
+// docContestOrder is contest id -> selection ids in document order, and votes allowed
+func docContestOrder(doc map[string]interface{}) (selections map[string][]string, votesAllowed map[string]int) {
+	selections = make(map[string][]string)
+	votesAllowed = make(map[string]int)
+	for _, el := range mapList(doc["Election"]) {
+		for _, co := range mapList(el["Contest"]) {
+			cid, _ := co["@id"].(string)
+			for _, sel := range mapList(co["ContestSelection"]) {
+				if sid, ok := sel["@id"].(string); ok {
+					selections[cid] = append(selections[cid], sid)
+				}
+			}
+			votesAllowed[cid] = 1
+			if va, ok := co["VotesAllowed"].(float64); ok && va >= 1 {
+				votesAllowed[cid] = int(va)
+			}
+		}
+	}
+	return
+}
+
+// planTestDeck lays out the ballots for bj's styles; selections with a
+// bubble are marked in document order
+func planTestDeck(doc map[string]interface{}, bj *scan.BubblesJson, once bool) (ballots []testDeckBallot) {
+	docSelections, votesAllowed := docContestOrder(doc)
+	blank := func(contests scan.Contest) map[string]map[string]bool {
+		marks := make(map[string]map[string]bool, len(contests))
+		for cid := range contests {
+			marks[cid] = map[string]bool{}
+		}
+		return marks
+	}
+	for si, contests := range bj.Bubbles {
+		// selection ids per contest, then the positions marked on each ballot
+		order := make(map[string][]string, len(contests))
+		ladders := make(map[string][]int, len(contests))
+		length := 0
+		for cid, bubbles := range contests {
+			for _, sid := range docSelections[cid] {
+				if _, ok := bubbles[sid]; ok {
+					order[cid] = append(order[cid], sid)
+				}
+			}
+			if len(order[cid]) != len(bubbles) {
+				// not in the document's selections, shouldn't happen
+				order[cid] = order[cid][:0]
+				for sid := range bubbles {
+					order[cid] = append(order[cid], sid)
+				}
+				sort.Strings(order[cid])
+			}
+			var ladder []int
+			for pos := range order[cid] {
+				count := pos + 1
+				if once {
+					count = 1
+				}
+				for n := 0; n < count; n++ {
+					ladder = append(ladder, pos)
+				}
+			}
+			ladders[cid] = ladder
+			if len(ladder) > length {
+				length = len(ladder)
+			}
+		}
+		for b := 0; b < length; b++ {
+			marks := blank(contests)
+			for cid, ladder := range ladders {
+				if b < len(ladder) {
+					marks[cid][order[cid][ladder[b]]] = true
+				}
+			}
+			ballots = append(ballots, testDeckBallot{Style: si, Pattern: testDeckPositions, Marks: marks})
+		}
+		over := blank(contests)
+		for cid, sids := range order {
+			if len(sids) > votesAllowed[cid] {
+				for _, sid := range sids[:votesAllowed[cid]+1] {
+					over[cid][sid] = true
+				}
+			}
+		}
+		ballots = append(ballots, testDeckBallot{Style: si, Pattern: testDeckOvervote, Marks: over})
+		ballots = append(ballots, testDeckBallot{Style: si, Pattern: testDeckBlank, Marks: blank(contests)})
+	}
+	for i := range ballots {
+		ballots[i].Number = i + 1
+	}
+	return
+}
+
+// testDeckSource is an election's render and plan, shared by the PDF and JSON
+type testDeckSource struct {
+	*markSource
+	deck testDeck
+}
+
+// withPages also gets the page PNGs, for the PDF.
+// errors are *httpError
+func (sh *StudioHandler) testDeckSource(ctx context.Context, electionid int64, doc map[string]interface{}, once, withPages bool) (*testDeckSource, error) {
+	ms, err := sh.markSource(ctx, electionid, withPages)
+	if err != nil {
+		return nil, err
+	}
+	for _, style := range ms.bubbles.Styles {
+		if style.Pages == 0 && len(ms.bubbles.Styles) > 1 {
+			return nil, &httpError{501, "the draw backend doesn't say which pages each ballot style is on", nil}
+		}
+	}
+	ts := &testDeckSource{markSource: ms}
+	ts.deck.ElectionId = electionid
+	ts.deck.Ballots = planTestDeck(doc, ms.bj, once)
+	if len(ts.deck.Ballots) > maxTestDeckBallots {
+		return nil, &httpError{400, fmt.Sprintf("test deck would be %d ballots, more than %d; try once=1", len(ts.deck.Ballots), maxTestDeckBallots), nil}
+	}
+	results := make([]map[string]map[string]bool, len(ts.deck.Ballots))
+	for i, b := range ts.deck.Ballots {
+		results[i] = b.Marks
+	}
+	ts.deck.Expected = tallyResults(doc, results)
+	ts.deck.Expected.ElectionId = electionid
+	ts.deck.Expected.Updated = time.Now().UTC()
+	return ts, nil
+}
+
+// ballotPages draws ballot's marks and label on its style's pages
+func (ts *testDeckSource) ballotPages(ballot testDeckBallot) ([]*image.RGBA, error) {
+	pages, err := ts.pages()
+	if err != nil {
+		return nil, err
+	}
+	// clean full marks, the deck tests the count and not the marker
+	out, err := synth.Ballot(ts.bubbles, pages, ts.pageWidth, ts.pageHeight, ballot.Style, ballot.Marks, synth.Options{Seed: int64(ballot.Number)})
+	if err != nil {
+		return nil, err
+	}
+	for i, im := range out {
+		b := im.Bounds()
+		label := fmt.Sprintf("TEST BALLOT %d OF %d, %s, PAGE %d OF %d - NOT FOR ELECTION USE", ballot.Number, len(ts.deck.Ballots), strings.ToUpper(ballot.Pattern), i+1, len(out))
+		dot := b.Dx() / 600
+		if dot < 1 {
+			dot = 1
+		}
+		// in the bottom margin, the scanner finds the page by its top border
+		draw.PutText(im, 4*dot, b.Dy()-10*dot, dot, color.Black, label)
+	}
+	return out, nil
+}
+
+// pdf is every ballot's pages, as JPEGs
+func (ts *testDeckSource) pdf() ([]byte, error) {
+	var pw draw.PdfWriter
+	catalog := pw.Alloc()
+	pages := pw.Alloc()
+	var kids []string
+	for _, ballot := range ts.deck.Ballots {
+		ims, err := ts.ballotPages(ballot)
+		if err != nil {
+			return nil, err
+		}
+		for _, im := range ims {
+			page, err := addJpegPage(&pw, pages, im, ts.pageWidth, ts.pageHeight)
+			if err != nil {
+				return nil, fmt.Errorf("ballot %d, %v", ballot.Number, err)
+			}
+			kids = append(kids, fmt.Sprintf("%d 0 R", page))
+		}
+	}
+	pw.Set(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	pw.Set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	return pw.Bytes(catalog), nil
+}
+
+// addJpegPage adds a page under pages that is all im, pageWidth by pageHeight points
+func addJpegPage(pw *draw.PdfWriter, pages int, im *image.RGBA, pageWidth, pageHeight float64) (page int, err error) {
+	var jb bytes.Buffer
+	err = jpeg.Encode(&jb, im, &jpeg.Options{Quality: 90})
+	if err != nil {
+		return 0, fmt.Errorf("jpeg, %v", err)
+	}
+	imobj := pw.Stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode", im.Rect.Dx(), im.Rect.Dy()), jb.Bytes())
+	content := pw.Stream("", []byte(fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q\n", pageWidth, pageHeight)))
+	page = pw.Add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		pages, pageWidth, pageHeight, imobj, content))
+	return page, nil
+}
+
+// GET /election/{id}/testdeck.pdf and /election/{id}/testdeck.json
+func (sh *StudioHandler) handleElectionTestDeck(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64, asJSON bool) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Trashed != 0 {
+		texterr(w, 404, "election %d is in the trash", electionid)
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(er.Data), &doc)
+	if maybeerr(w, err, 500, "bad election json") {
+		return
+	}
+	ts, err := sh.testDeckSource(r.Context(), electionid, doc, qbool(r.URL.Query().Get("once")), !asJSON)
+	if err != nil {
+		he := err.(*httpError)
+		if he.err == nil {
+			texterr(w, he.code, "%s", he.msg)
+		} else {
+			maybeerr(w, he.err, he.code, he.msg)
+		}
+		return
+	}
+	if asJSON {
+		writeJSON(w, ts.deck)
+		return
+	}
+	pdf, err := ts.pdf()
+	if maybeerr(w, err, 500, "test deck pdf, %v", err) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%d_testdeck.pdf\"", electionid))
+	w.WriteHeader(200)
+	w.Write(pdf)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/draw"
+	"github.com/brianolson/ballotstudio/scan"
+	"github.com/brianolson/login/login"
+)
+
+func TestTestDeck(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	sh := StudioHandler{edb: edb, drawClient: &draw.Client{}}
+	// overlayTestDoc has two contests of two selections, vote for one
+	eid, err := edb.PutElection(electionRecord{Owner: 7, Data: overlayTestDoc})
+	mtfail(t, err, "put election, %v", err)
+	ann := &login.User{Guid: 7, Username: "ann"}
+
+	get := func(user *login.User, path string, asJSON bool) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sh.handleElectionTestDeck(rec, httptest.NewRequest("GET", path, nil), user, eid, asJSON)
+		return rec
+	}
+	if rec := get(&login.User{Guid: 8, Username: "bob"}, "/election/1/testdeck.json", true); rec.Code != 403 {
+		t.Errorf("not owner %d", rec.Code)
+	}
+	rec := get(ann, "/election/1/testdeck.json", true)
+	var deck testDeck
+	json.Unmarshal(rec.Body.Bytes(), &deck)
+	if rec.Code != 200 || len(deck.Ballots) != 5 {
+		t.Fatalf("deck %d %s", rec.Code, rec.Body.String())
+	}
+	patterns := []string{}
+	for _, b := range deck.Ballots {
+		patterns = append(patterns, b.Pattern)
+	}
+	if !reflect.DeepEqual(patterns, []string{"positions", "positions", "positions", "overvote", "blank"}) {
+		t.Errorf("patterns %v", patterns)
+	}
+	// the Nth selection gets N votes, the overvote and blank ballots none
+	for _, ct := range deck.Expected.Contests {
+		if ct.Ballots != 5 || ct.Overvotes != 1 || ct.Undervotes != 1 || len(ct.Selections) != 2 || ct.Selections[0].Votes != 1 || ct.Selections[1].Votes != 2 {
+			t.Errorf("expected %#v", ct)
+		}
+	}
+	if ct := deck.Expected.Contests[0]; ct.ContestId != "ccont1" || ct.Selections[0].SelectionId != "csel1" {
+		t.Errorf("document order %#v", ct)
+	}
+
+	rec = get(ann, "/election/1/testdeck.json?once=1", true)
+	json.Unmarshal(rec.Body.Bytes(), &deck)
+	if len(deck.Ballots) != 4 || deck.Expected.Contests[0].Selections[1].Votes != 1 {
+		t.Errorf("once %s", rec.Body.String())
+	}
+
+	rec = get(ann, "/election/1/testdeck.pdf", false)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/pdf" || !bytes.Contains(rec.Body.Bytes(), []byte("/Count 5 ")) {
+		t.Fatalf("pdf %d %q", rec.Code, rec.Body.Bytes()[:20])
+	}
+
+	// the scanner reads the ballots as planned
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(overlayTestDoc), &doc)
+	ts, err := sh.testDeckSource(context.Background(), eid, doc, false, true)
+	mtfail(t, err, "source, %v", err)
+	for _, ballot := range ts.deck.Ballots {
+		pages, err := ts.ballotPages(ballot)
+		if err != nil || len(pages) != 1 {
+			t.Fatalf("ballot %d pages %d, %v", ballot.Number, len(pages), err)
+		}
+		var jb bytes.Buffer
+		jpeg.Encode(&jb, pages[0], &jpeg.Options{Quality: 90})
+		scanned, _, _ := image.Decode(&jb)
+		result, _, err := sh.readScan(context.Background(), eid, 0, scanned)
+		mtfail(t, err, "read ballot %d, %v", ballot.Number, err)
+		if got := scan.MarkedFromReadings(result.Readings); !reflect.DeepEqual(got, ballot.Marks) {
+			t.Errorf("ballot %d read %v, marked %v", ballot.Number, got, ballot.Marks)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Per-route request timeouts. Every request's context gets a deadline by
+// what the route does: drawing ballots gets -render-timeout, requests with
+// a body to read (POST and PUT) get -upload-timeout, and everything else
+// -request-timeout; a route that both renders and takes an upload gets the
+// longer. Handlers pass the context on to the draw backend, pdftoppm, scan
+// interpretation and database queries (see dbctx.go), so when the deadline
+// passes or the client goes away that work stops too.
+
+type routeTimeouts struct {
+	Request time.Duration
+	Render  time.Duration
+	Upload  time.Duration
+}
+
+// renderRoutes are the paths that may draw a ballot. A function because
+// the patterns are compiled in main.go's init.
+func renderRoutes() []*regexp.Regexp {
+	return []*regexp.Regexp{
+		pdfPathRe, bubblesPathRe, pngPathRe, pngPagePathRe, pamphletPathRe,
+		scanPathRe, rescanPathRe, scanOverlayPathRe, readinessPathRe, exportPathRe,
+		checksumsPathRe, printPathRe, printJobPathRe, electionSamplePathRe, samplePathRe,
+		prerenderPathRe, testDeckPathRe, syntheticPathRe, reviewPdfPathRe, diffPathRe,
+	}
+}
+
+// timeout is how long r may take, 0 for no limit
+func (rt routeTimeouts) timeout(r *http.Request) time.Duration {
+	timeout := rt.Request
+	longer := func(d time.Duration) {
+		if timeout > 0 && (d <= 0 || d > timeout) {
+			timeout = d
+		}
+	}
+	if r.Method == "POST" || r.Method == "PUT" {
+		longer(rt.Upload)
+	}
+	for _, re := range renderRoutes() {
+		if re.MatchString(r.URL.Path) {
+			longer(rt.Render)
+			break
+		}
+	}
+	return timeout
+}
+
+// timeoutHandler gives each request to sub a context with its route's deadline
+type timeoutHandler struct {
+	sub      http.Handler
+	timeouts routeTimeouts
+}
+
+func (th *timeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d := th.timeouts.timeout(r); d > 0 {
+		ctx, cf := context.WithTimeout(r.Context(), d)
+		defer cf()
+		r = r.WithContext(ctx)
+	}
+	th.sub.ServeHTTP(w, r)
+}
+
+// canceled is the error for work stopped because ctx is done, nil while
+// it isn't. A render abandoned this way says nothing about the election
+// or the draw backend.
+func canceled(ctx context.Context, err error) *httpError {
+	switch {
+	case ctx.Err() == nil:
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &httpError{http.StatusGatewayTimeout, "timed out", err}
+	default:
+		return &httpError{http.StatusServiceUnavailable, "canceled", err}
+	}
+}
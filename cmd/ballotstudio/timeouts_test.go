@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	rt := routeTimeouts{Request: time.Second, Render: time.Minute, Upload: time.Hour}
+	for _, tc := range []struct {
+		method, path string
+		want         time.Duration
+	}{
+		{"GET", "/election/3", time.Second},
+		{"GET", "/election/3.pdf", time.Minute},
+		{"GET", "/election/3.1.png", time.Minute},
+		{"POST", "/election/3", time.Hour},
+		{"POST", "/election/3/scan", time.Hour},
+	} {
+		if got := rt.timeout(httptest.NewRequest(tc.method, tc.path, nil)); got != tc.want {
+			t.Errorf("%s %s: %v, want %v", tc.method, tc.path, got, tc.want)
+		}
+	}
+	rt.Render = 0
+	if got := rt.timeout(httptest.NewRequest("GET", "/election/3.pdf", nil)); got != 0 {
+		t.Errorf("unlimited render %v", got)
+	}
+
+	var deadline time.Time
+	th := &timeoutHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+	}), routeTimeouts{Request: time.Second}}
+	th.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/election/3", nil))
+	if d := time.Until(deadline); d <= 0 || d > time.Second {
+		t.Errorf("deadline in %v", d)
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cf()
+	<-ctx.Done()
+	if he := canceled(ctx, errors.New("x")); he == nil || he.code != http.StatusGatewayTimeout {
+		t.Errorf("deadline %#v", he)
+	}
+	if he := canceled(context.Background(), errors.New("x")); he != nil {
+		t.Errorf("live context %#v", he)
+	}
+
+	// queries stop with their context
+	edb, _ := testSqliteEDB(t)
+	eid, err := edb.PutElection(electionRecord{Owner: 1, Data: `{}`})
+	mtfail(t, err, "put election, %v", err)
+	if _, err := edb.WithContext(ctx).GetElection(eid); err == nil {
+		t.Errorf("query under a done context succeeded")
+	}
+	if er, err := edb.WithContext(context.Background()).GetElection(eid); err != nil || er == nil {
+		t.Errorf("query under a live context, %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Trash. DELETE /election/{id} moves an election to the trash instead of deleting it.
+// Trashed elections are left out of the home page listing, won't render, and
+// can't be edited. GET /trash lists them, POST /trash/{id}/restore brings one back,
+// and the trash-purge job deletes them for good -gc-trash-retention after they were trashed.
+
+// how long an election sits in the trash before it's purged, unless -gc-trash-retention says otherwise
+const TrashRetention = 30 * 24 * time.Hour
+
+var errTrashed = errors.New("election is in the trash")
+
+type trashedElection struct {
+	Id      int64     `json:"itemid"`
+	State   string    `json:"state"`
+	Trashed time.Time `json:"trashed"`
+	Purge   time.Time `json:"purge"`
+}
+
+type TrashContext struct {
+	User      *login.User
+	Elections []trashedElection
+	CSRF      string
+	Base      string
+}
+
+// invalidateElection drops an election's renders. Renders of an older
+// version would miss anyway (see renderKey), this frees their space sooner.
+func (sh *StudioHandler) invalidateElection(itemname string) {
+	sh.cache.InvalidatePrefix(itemname + "#")
+	sh.cache.InvalidatePrefix(itemname + ".png#")
+	sh.cache.InvalidatePrefix(itemname + "_pamphlet.pdf#")
+	sh.cache.Invalidate(itemname + "_results")
+}
+
+// forgetElection drops every render of an election, including the last good
+// ones kept for when the draw backend is down
+func (sh *StudioHandler) forgetElection(itemname string) {
+	sh.invalidateElection(itemname)
+	sh.stale.Invalidate(itemname)
+	sh.stale.InvalidatePrefix(itemname + "?")
+	sh.stale.Invalidate(itemname + "_pamphlet.pdf")
+}
+
+// DELETE /election/{id}, owner only
+func (sh *StudioHandler) handleElectionDelete(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	if er.Trashed == 0 {
+		if sh.checkElectionState(w, electionid, actionTrash) {
+			return
+		}
+		err = sh.edb.TrashElection(electionid, time.Now())
+		if maybeerr(w, err, 500, "db trash") {
+			return
+		}
+		sh.forgetElection(strconv.FormatInt(electionid, 10))
+	}
+	sh.trashListing(w, r, user, true)
+}
+
+// GET /trash[.json]
+func (sh *StudioHandler) handleTrash(w http.ResponseWriter, r *http.Request, user *login.User, asJSON bool) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	sh.trashListing(w, r, user, asJSON)
+}
+
+// POST /trash/{id}/restore, owner only
+func (sh *StudioHandler) handleTrashRestore(w http.ResponseWriter, r *http.Request, user *login.User, electionid int64) {
+	if r.Method != "POST" {
+		texterr(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	er, err := sh.edb.GetElection(electionid)
+	if maybeerr(w, err, 404, "no item") {
+		return
+	}
+	if er.Owner != user.Guid {
+		texterr(w, http.StatusForbidden, "nope")
+		return
+	}
+	if er.Trashed == 0 {
+		texterr(w, http.StatusConflict, "election %d is not in the trash", electionid)
+		return
+	}
+	err = sh.edb.UntrashElection(electionid)
+	if maybeerr(w, err, 500, "db untrash") {
+		return
+	}
+	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		// from the trash.html button
+		http.Redirect(w, r, sitePath(r, "/edit/"+electionRef(r, electionid)), http.StatusSeeOther)
+		return
+	}
+	editContextFinish(w, r, electionid, nil)
+}
+
+func (sh *StudioHandler) trashListing(w http.ResponseWriter, r *http.Request, user *login.User, asJSON bool) {
+	ids, err := sh.edb.TrashedForUser(user.Guid)
+	if maybeerr(w, err, 500, "db trash list") {
+		return
+	}
+	tc := TrashContext{User: user, Elections: []trashedElection{}, CSRF: csrfToken(r), Base: basePath(r)}
+	for _, eid := range ids {
+		er, err := sh.edb.GetElection(eid)
+		if err != nil {
+			continue
+		}
+		state, _ := sh.edb.GetElectionState(eid)
+		trashed := time.Unix(er.Trashed, 0).UTC()
+		tc.Elections = append(tc.Elections, trashedElection{eid, state, trashed, trashed.Add(sh.trashRetention())})
+	}
+	if asJSON {
+		out, err := json.Marshal(tc.Elections)
+		if maybeerr(w, err, 500, "json ret prep") {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(out)
+		return
+	}
+	tt, err := sh.templates.Lookup("trash.html")
+	if maybeerr(w, err, 500, "trash.html: %v", err) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(200)
+	tt.Execute(w, tc)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// UploadLimiter caps simultaneous uploads and the bytes they may hold in memory.
+// A per-route limiter can have a Parent (global) limiter which must also admit the upload.
+// A nil *UploadLimiter allows everything.
+type UploadLimiter struct {
+	// MaxUploads in flight at once, 0 for unlimited
+	MaxUploads int
+
+	// MaxBytes of uploads in flight at once, 0 for unlimited
+	MaxBytes int64
+
+	Parent *UploadLimiter
+
+	uploads int
+	bytes   int64
+	lock    sync.Mutex
+}
+
+// seconds clients are told to wait when uploads are full
+const uploadRetryAfterSeconds = 5
+
+// NewUploadLimiter returns nil (no limit) if both limits are <= 0 and there is no parent
+func NewUploadLimiter(maxUploads int, maxBytes int64, parent *UploadLimiter) *UploadLimiter {
+	if maxUploads <= 0 && maxBytes <= 0 && parent == nil {
+		return nil
+	}
+	return &UploadLimiter{
+		MaxUploads: maxUploads,
+		MaxBytes:   maxBytes,
+		Parent:     parent,
+	}
+}
+
+// Acquire reserves room for an upload of size bytes.
+// If ok, release() must be called when the upload is no longer in memory.
+func (ul *UploadLimiter) Acquire(size int64) (release func(), ok bool) {
+	if ul == nil {
+		return func() {}, true
+	}
+	ul.lock.Lock()
+	if (ul.MaxUploads > 0 && ul.uploads >= ul.MaxUploads) || (ul.MaxBytes > 0 && ul.bytes+size > ul.MaxBytes) {
+		ul.lock.Unlock()
+		return nil, false
+	}
+	ul.uploads++
+	ul.bytes += size
+	ul.lock.Unlock()
+
+	parentRelease, ok := ul.Parent.Acquire(size)
+	if !ok {
+		ul.release(size)
+		return nil, false
+	}
+	return func() {
+		parentRelease()
+		ul.release(size)
+	}, true
+}
+
+func (ul *UploadLimiter) release(size int64) {
+	ul.lock.Lock()
+	defer ul.lock.Unlock()
+	ul.uploads--
+	ul.bytes -= size
+}
+
+// uploadLimited reserves room for the request body, up to maxBytes.
+// If there isn't room it writes a 503 and returns stop=true.
+// Otherwise the caller must call release() when done with the upload.
+func uploadLimited(w http.ResponseWriter, r *http.Request, ul *UploadLimiter, maxBytes int64) (release func(), stop bool) {
+	size := maxBytes
+	if r.ContentLength >= 0 && r.ContentLength < maxBytes {
+		size = r.ContentLength
+	}
+	release, ok := ul.Acquire(size)
+	if ok {
+		return release, false
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", uploadRetryAfterSeconds))
+	texterr(w, http.StatusServiceUnavailable, "too many uploads in progress, try again shortly")
+	return nil, true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUploadLimiter(t *testing.T) {
+	global := NewUploadLimiter(3, 1000, nil)
+	route := NewUploadLimiter(2, 0, global)
+
+	r1, ok := route.Acquire(100)
+	if !ok {
+		t.Fatalf("first upload denied")
+	}
+	r2, ok := route.Acquire(100)
+	if !ok {
+		t.Fatalf("second upload denied")
+	}
+	_, ok = route.Acquire(100)
+	if ok {
+		t.Errorf("route count limit not enforced")
+	}
+	// global still has room for one more from elsewhere, but not enough bytes
+	_, ok = global.Acquire(900)
+	if ok {
+		t.Errorf("global byte limit not enforced")
+	}
+	r3, ok := global.Acquire(800)
+	if !ok {
+		t.Fatalf("global upload denied")
+	}
+	r1()
+	_, ok = route.Acquire(1)
+	if !ok {
+		t.Errorf("upload denied after release")
+	}
+	r2()
+	r3()
+	if global.uploads != 1 || global.bytes != 1 {
+		t.Errorf("global accounting off, uploads=%d bytes=%d", global.uploads, global.bytes)
+	}
+
+	var nolimit *UploadLimiter = NewUploadLimiter(0, 0, nil)
+	release, ok := nolimit.Acquire(1 << 40)
+	if !ok {
+		t.Errorf("nil limiter denied")
+	}
+	release()
+}
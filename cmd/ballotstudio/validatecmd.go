@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/brianolson/ballotstudio/data"
+	"github.com/brianolson/ballotstudio/draw"
+)
+
+// `ballotstudio validate election.json ...` checks documents the way saving
+// and the readiness report would, without a server: what would make an
+// upload be refused, then the readiness checks that don't need a render or
+// sign off, validation rules included. Each file's report is a line of JSON
+// on stdout; the exit status is 1 if any file failed a check. Warnings
+// don't fail, but are in the report.
+
+type validateReport struct {
+	File   string          `json:"file"`
+	Status string          `json:"status"` // worst of Items
+	Items  []readinessItem `json:"items"`
+}
+
+// checkSchema is what handleElectionDocPOSTJson refuses a document for
+func checkSchema(doc map[string]interface{}) readinessItem {
+	problems := data.CheckBubbleGeometry(doc)
+	nbody, err := json.Marshal(doc)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		if _, err = draw.DocRenderOptions(string(nbody)); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if _, err = draw.DocRenderProfiles(string(nbody)); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return failIfAny("schema", "document would be accepted", "document would be refused", problems)
+}
+
+// validateDocument checks one election document, read from file name
+func validateDocument(name string, body []byte) validateReport {
+	rr := readinessReport{Status: readyPass}
+	var doc map[string]interface{}
+	err := json.Unmarshal(body, &doc)
+	if err != nil {
+		rr.add(readinessItem{Check: "json", Status: readyFail, Message: fmt.Sprintf("bad json, %v", err)})
+		return validateReport{name, rr.Status, rr.Items}
+	}
+	doc = data.Fixup(doc)
+	rr.add(checkSchema(doc))
+	rr.add(checkValidation(doc))
+	rr.add(checkRules(doc))
+	rr.add(checkTranslations(doc))
+	rr.add(checkMeasureText(doc))
+	rr.add(checkStyles(doc))
+	return validateReport{name, rr.Status, rr.Items}
+}
+
+// runValidateCommand writes a report for each file, - for stdin, to out.
+// ok is false if any failed.
+func runValidateCommand(files []string, out io.Writer) (ok bool, err error) {
+	if len(files) == 0 {
+		return false, fmt.Errorf("validate needs election json files")
+	}
+	enc := json.NewEncoder(out)
+	ok = true
+	for _, fname := range files {
+		var body []byte
+		if fname == "-" {
+			body, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			body, err = ioutil.ReadFile(fname)
+		}
+		var report validateReport
+		if err != nil {
+			report = validateReport{fname, readyFail, []readinessItem{{Check: "read", Status: readyFail, Message: err.Error()}}}
+		} else {
+			report = validateDocument(fname, body)
+		}
+		if report.Status == readyFail {
+			ok = false
+		}
+		err = enc.Encode(report)
+		if err != nil {
+			return false, err
+		}
+	}
+	return ok, nil
+}
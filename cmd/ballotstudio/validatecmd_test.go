@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateCommand(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	err := ioutil.WriteFile(good, []byte(`{
+  "GpUnit": [{"@id": "gpunit1", "Type": "precinct"}],
+  "Election": [{
+    "Candidate": [{"@id": "ecand1", "BallotName": "Ann"}, {"@id": "ecand2", "BallotName": "Bob"}],
+    "Contest": [{"@id": "ccont1", "ElectionDistrictId": "gpunit1", "VotesAllowed": 1,
+      "ContestSelection": [{"@id": "csel1", "CandidateIds": ["ecand1"]}, {"@id": "csel2", "CandidateIds": ["ecand2"]}]}],
+    "BallotStyle": [{"GpUnitIds": ["gpunit1"], "OrderedContent": [{"ContestId": "ccont1"}]}]
+  }]
+}`), 0644)
+	mtfail(t, err, "write, %v", err)
+	bad := filepath.Join(dir, "bad.json")
+	err = ioutil.WriteFile(bad, []byte(readinessTestDoc), 0644)
+	mtfail(t, err, "write, %v", err)
+	broken := filepath.Join(dir, "broken.json")
+	err = ioutil.WriteFile(broken, []byte(`{"Election": [{"RenderOptions": {"PageSize": "tabloid"}}]}`), 0644)
+	mtfail(t, err, "write, %v", err)
+
+	var out bytes.Buffer
+	ok, err := runValidateCommand([]string{good}, &out)
+	if !ok || err != nil {
+		t.Errorf("good document failed, %v\n%s", err, out.String())
+	}
+
+	out.Reset()
+	ok, err = runValidateCommand([]string{good, bad, broken, filepath.Join(dir, "none.json")}, &out)
+	if ok || err != nil {
+		t.Errorf("bad documents passed, %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("%d reports for 4 files\n%s", len(lines), out.String())
+	}
+	want := map[string]string{good: "", bad: "styles", broken: "schema", filepath.Join(dir, "none.json"): "read"}
+	for _, line := range lines {
+		var report validateReport
+		err = json.Unmarshal([]byte(line), &report)
+		mtfail(t, err, "report %s, %v", line, err)
+		if want[report.File] == "" && report.Status == readyFail {
+			t.Errorf("%s failed %s", report.File, line)
+		} else if want[report.File] != "" && !strings.Contains(line, `"check":"`+want[report.File]+`","status":"fail"`) {
+			t.Errorf("%s wanted %s to fail, got %s", report.File, want[report.File], line)
+		}
+	}
+}
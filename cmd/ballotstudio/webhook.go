@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+// Webhooks tell downstream systems (an EMS, a print vendor's intake) when
+// something happens to an election, so they can fetch the new version
+// without polling. A user registers a URL for all their elections or for
+// one, and the events they want:
+//
+//	save      the election document was saved
+//	publish   the election moved to published
+//	render    a ballot PDF was drawn (not served from cache)
+//	scan      a scanned ballot was uploaded
+//	ping      POST /webhooks/{id}/ping, to test a receiver
+//
+// Each event is queued in webhook_deliveries and POSTed by the webhooks job as
+// JSON, signed with the webhook's secret: X-BallotStudio-Signature is
+// "sha256=" and the hex HMAC-SHA256 of the body. A delivery that doesn't get
+// a 2xx is tried again after webhookRetries, then marked failed.
+//
+//	GET /webhooks                        yours, without secrets
+//	POST /webhooks                       {"url":..., "election":12, "events":["save"]}, returns the secret once
+//	DELETE /webhooks/{id}
+//	GET /webhooks/{id}/deliveries        the most recent deliveries
+//	POST /webhooks/{id}/ping
+//
+// Receivers on loopback, private and link local addresses are refused unless
+// -webhook-private, so a webhook can't be used to reach inside the server's
+// network.
+
+const (
+	webhookSave    = "save"
+	webhookPublish = "publish"
+	webhookRender  = "render"
+	webhookScan    = "scan"
+	webhookPing    = "ping"
+)
+
+var webhookEvents = []string{webhookSave, webhookPublish, webhookRender, webhookScan}
+
+// delivery Status
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// waits between tries of a delivery, after which it has failed
+var webhookRetries = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+// most webhooks one user may have
+const maxUserWebhooks = 20
+
+// how long finished deliveries are kept for GET /webhooks/{id}/deliveries
+const webhookDeliveryRetention = 7 * 24 * time.Hour
+
+const webhookTimeout = 15 * time.Second
+
+// bytes of the generated secret
+const webhookSecretBytes = 32
+
+type webhookRecord struct {
+	Id         int64    `json:"id"`
+	Owner      int64    `json:"owner"`
+	ElectionId int64    `json:"election,omitempty"` // 0 for all the owner's elections
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret,omitempty"` // only in the POST /webhooks response
+	Events     []string `json:"events"`
+	Created    int64    `json:"created"` // unix seconds
+}
+
+func (wh *webhookRecord) wants(event string) bool {
+	if event == webhookPing {
+		return true
+	}
+	for _, ev := range wh.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validWebhookEvent(event string) bool {
+	for _, ev := range webhookEvents {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+// one queued POST of an event to a webhook
+type webhookDelivery struct {
+	Id        int64  `json:"id"`
+	WebhookId int64  `json:"webhook"`
+	Event     string `json:"event"`
+	Payload   string `json:"-"`
+	Status    string `json:"status"` // pending, delivered or failed
+	Attempts  int    `json:"attempts"`
+	NextTry   int64  `json:"next_try,omitempty"` // unix seconds, while pending
+	LastError string `json:"last_error,omitempty"`
+	Created   int64  `json:"created"`
+}
+
+// the body POSTed to a webhook
+type webhookPayload struct {
+	Event      string      `json:"event"`
+	ElectionId int64       `json:"election"`
+	Time       time.Time   `json:"time"` // receivers can refuse old ones
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// POST /webhooks body
+type webhookRequest struct {
+	URL        string   `json:"url"`
+	ElectionId int64    `json:"election,omitempty"`
+	Events     []string `json:"events,omitempty"` // default all
+}
+
+// webhookSignature is the X-BallotStudio-Signature of body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkWebhookURL wants an absolute http or https URL
+func checkWebhookURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return fmt.Errorf("bad webhook url %q, want http(s)://host/path", s)
+	}
+	return nil
+}
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "100.64.0.0/10", "0.0.0.0/8", "::1/128", "fc00::/7", "fe80::/10", "::/128"} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		privateNets = append(privateNets, ipnet)
+	}
+}
+
+func privateIP(ip net.IP) bool {
+	for _, ipnet := range privateNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newWebhookClient posts deliveries. Unless allowPrivate it refuses to
+// connect to private addresses, checked on the address actually dialed so a
+// DNS name can't point somewhere else after the check. Then it doesn't use
+// the environment's proxy either, as the proxy would dial the receiver
+// without the check.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	if allowPrivate {
+		transport.Proxy = http.ProxyFromEnvironment
+	} else {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+				return fmt.Errorf("webhook to private address %s refused", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// fireWebhooks queues event for every webhook on election electionid that
+// wants it, and wakes the webhooks job. Errors are logged, they shouldn't fail
+// the request that caused the event.
+func (sh *StudioHandler) fireWebhooks(event string, electionid int64, data interface{}) {
+	hooks, err := sh.edb.WebhooksForElection(electionid)
+	if err != nil {
+		log.Printf("%d: webhooks, %v", electionid, err)
+		return
+	}
+	var payload []byte
+	queued := 0
+	now := time.Now()
+	for _, wh := range hooks {
+		if !wh.wants(event) {
+			continue
+		}
+		if payload == nil {
+			payload, err = json.Marshal(webhookPayload{event, electionid, now.UTC(), data})
+			if err != nil {
+				log.Printf("%d: webhook payload, %v", electionid, err)
+				return
+			}
+		}
+		_, err = sh.edb.PutWebhookDelivery(webhookDelivery{
+			WebhookId: wh.Id,
+			Event:     event,
+			Payload:   string(payload),
+			Status:    deliveryPending,
+			NextTry:   now.Unix(),
+			Created:   now.Unix(),
+		})
+		if err != nil {
+			log.Printf("%d: webhook %d queue, %v", electionid, wh.Id, err)
+			continue
+		}
+		queued++
+	}
+	if queued != 0 {
+		sh.jobs.Wake(jobWebhooks)
+	}
+}
+
+// deliverWebhook POSTs one delivery, returning why it didn't take
+func deliverWebhook(ctx context.Context, client *http.Client, wh *webhookRecord, d *webhookDelivery) error {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ballotstudio-webhook")
+	req.Header.Set("X-BallotStudio-Event", d.Event)
+	req.Header.Set("X-BallotStudio-Delivery", strconv.FormatInt(d.Id, 10))
+	req.Header.Set("X-BallotStudio-Signature", webhookSignature(wh.Secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 10000))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// deliverDueWebhooks sends every pending delivery whose time has come,
+// returning how many it tried
+func (sh *StudioHandler) deliverDueWebhooks(ctx context.Context, now time.Time) int {
+	due, err := sh.edb.DueWebhookDeliveries(now.Unix(), 100)
+	if err != nil {
+		log.Printf("webhook deliveries, %v", err)
+		return 0
+	}
+	hooks := make(map[int64]*webhookRecord)
+	for _, d := range due {
+		wh, ok := hooks[d.WebhookId]
+		if !ok {
+			wh, err = sh.edb.GetWebhook(d.WebhookId)
+			if err != nil {
+				log.Printf("webhook %d, %v", d.WebhookId, err)
+				continue
+			}
+			hooks[d.WebhookId] = wh
+		}
+		d.Attempts++
+		if wh == nil {
+			err = fmt.Errorf("webhook deleted")
+			d.Attempts = len(webhookRetries) + 1
+		} else {
+			err = deliverWebhook(ctx, sh.webhookClient, wh, &d)
+		}
+		if err == nil {
+			d.Status = deliveryDelivered
+			d.NextTry = 0
+			d.LastError = ""
+		} else if d.Attempts > len(webhookRetries) {
+			d.Status = deliveryFailed
+			d.NextTry = 0
+			d.LastError = err.Error()
+			log.Printf("webhook %d delivery %d failed, %v", d.WebhookId, d.Id, err)
+		} else {
+			d.NextTry = now.Add(webhookRetries[d.Attempts-1]).Unix()
+			d.LastError = err.Error()
+		}
+		_, err = sh.edb.PutWebhookDelivery(d)
+		if err != nil {
+			log.Printf("webhook delivery %d, %v", d.Id, err)
+		}
+	}
+	return len(due)
+}
+
+// GET|POST /webhooks, DELETE /webhooks/{id}, GET /webhooks/{id}/deliveries, POST /webhooks/{id}/ping
+func (sh *StudioHandler) handleWebhooks(w http.ResponseWriter, r *http.Request, user *login.User, webhookid int64, sub string) {
+	if user == nil {
+		texterr(w, http.StatusUnauthorized, "nope")
+		return
+	}
+	if webhookid != 0 {
+		wh, err := sh.edb.GetWebhook(webhookid)
+		if maybeerr(w, err, 500, "db webhook, %v", err) {
+			return
+		}
+		if wh == nil || wh.Owner != user.Guid {
+			texterr(w, 404, "no webhook %d", webhookid)
+			return
+		}
+		sh.handleWebhook(w, r, wh, sub)
+		return
+	}
+	hooks, err := sh.edb.WebhooksForUser(user.Guid)
+	if maybeerr(w, err, 500, "db webhooks, %v", err) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		if hooks == nil {
+			hooks = []webhookRecord{}
+		}
+		writeJSON(w, hooks)
+	case "POST":
+		if len(hooks) >= maxUserWebhooks {
+			texterr(w, http.StatusConflict, "at most %d webhooks", maxUserWebhooks)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10000))
+		if maybeerr(w, err, 400, "bad body") {
+			return
+		}
+		var req webhookRequest
+		err = json.Unmarshal(body, &req)
+		if maybeerr(w, err, 400, "bad webhook json") {
+			return
+		}
+		err = checkWebhookURL(req.URL)
+		if maybeerr(w, err, 400, "%v", err) {
+			return
+		}
+		if req.ElectionId != 0 {
+			er, err := sh.edb.GetElection(req.ElectionId)
+			if maybeerr(w, err, 404, "no election %d", req.ElectionId) {
+				return
+			}
+			if er.Owner != user.Guid {
+				texterr(w, http.StatusForbidden, "nope")
+				return
+			}
+		}
+		if len(req.Events) == 0 {
+			req.Events = webhookEvents
+		}
+		for _, ev := range req.Events {
+			if !validWebhookEvent(ev) {
+				texterr(w, 400, "unknown event %q, want some of %s", ev, strings.Join(webhookEvents, ", "))
+				return
+			}
+		}
+		secret := make([]byte, webhookSecretBytes)
+		rand.Read(secret)
+		wh := webhookRecord{
+			Owner:      user.Guid,
+			ElectionId: req.ElectionId,
+			URL:        req.URL,
+			Secret:     base64.RawURLEncoding.EncodeToString(secret),
+			Events:     req.Events,
+			Created:    time.Now().Unix(),
+		}
+		wh.Id, err = sh.edb.PutWebhook(wh)
+		if maybeerr(w, err, 500, "db webhook put, %v", err) {
+			return
+		}
+		writeJSON(w, wh)
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "GET or POST")
+	}
+}
+
+func (sh *StudioHandler) handleWebhook(w http.ResponseWriter, r *http.Request, wh *webhookRecord, sub string) {
+	switch {
+	case sub == "" && r.Method == "DELETE":
+		err := sh.edb.DeleteWebhook(wh.Id)
+		if maybeerr(w, err, 500, "db webhook delete, %v", err) {
+			return
+		}
+		hooks, err := sh.edb.WebhooksForUser(wh.Owner)
+		if maybeerr(w, err, 500, "db webhooks, %v", err) {
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		if hooks == nil {
+			hooks = []webhookRecord{}
+		}
+		writeJSON(w, hooks)
+	case sub == "/deliveries" && r.Method == "GET":
+		deliveries, err := sh.edb.WebhookDeliveries(wh.Id, 50)
+		if maybeerr(w, err, 500, "db webhook deliveries, %v", err) {
+			return
+		}
+		if deliveries == nil {
+			deliveries = []webhookDelivery{}
+		}
+		writeJSON(w, deliveries)
+	case sub == "/ping" && r.Method == "POST":
+		payload, _ := json.Marshal(webhookPayload{webhookPing, wh.ElectionId, time.Now().UTC(), nil})
+		now := time.Now().Unix()
+		d := webhookDelivery{WebhookId: wh.Id, Event: webhookPing, Payload: string(payload), Status: deliveryPending, Created: now}
+		var err error
+		d.Id, err = sh.edb.PutWebhookDelivery(d)
+		if maybeerr(w, err, 500, "db webhook queue, %v", err) {
+			return
+		}
+		// right now and once, so the caller sees how it went
+		d.Attempts = 1
+		err = deliverWebhook(r.Context(), sh.webhookClient, wh, &d)
+		d.Status = deliveryDelivered
+		if err != nil {
+			d.Status = deliveryFailed
+			d.LastError = err.Error()
+		}
+		_, err = sh.edb.PutWebhookDelivery(d)
+		if maybeerr(w, err, 500, "db webhook delivery, %v", err) {
+			return
+		}
+		writeJSON(w, d)
+	default:
+		texterr(w, http.StatusMethodNotAllowed, "DELETE /webhooks/{id}, GET /webhooks/{id}/deliveries or POST /webhooks/{id}/ping")
+	}
+}
+
+// common to all backends, query selects id, owner, election, url, secret, events, created
+func queryWebhooks(db sqlDB, query string, args ...interface{}) (out []webhookRecord, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("webhooks, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var wh webhookRecord
+		var events string
+		err = rows.Scan(&wh.Id, &wh.Owner, &wh.ElectionId, &wh.URL, &wh.Secret, &events, &wh.Created)
+		if err != nil {
+			return nil, fmt.Errorf("webhook row, %v", err)
+		}
+		wh.Events = strings.Split(events, ",")
+		out = append(out, wh)
+	}
+	return out, rows.Err()
+}
+
+// common to all backends, query selects id, webhook, event, payload, status, attempts, next_try, last_error, created
+func queryDeliveries(db sqlDB, query string, args ...interface{}) (out []webhookDelivery, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("webhook deliveries, %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d webhookDelivery
+		var lastError sql.NullString
+		err = rows.Scan(&d.Id, &d.WebhookId, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextTry, &lastError, &d.Created)
+		if err != nil {
+			return nil, fmt.Errorf("webhook delivery row, %v", err)
+		}
+		d.LastError = lastError.String
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// getWebhook returns nil if there's no such webhook. Common to all backends, query as queryWebhooks.
+func getWebhook(db sqlDB, query string, id int64) (*webhookRecord, error) {
+	hooks, err := queryWebhooks(db, query, id)
+	if err != nil || len(hooks) == 0 {
+		return nil, err
+	}
+	return &hooks[0], nil
+}
+
+// updateDelivery saves a delivery's progress. Common to all backends, param
+// is "$" for numbered placeholders or "?".
+func updateDelivery(db sqlDB, param, idcol string, d webhookDelivery) error {
+	query := fmt.Sprintf(`UPDATE webhook_deliveries SET status = $1, attempts = $2, next_try = $3, last_error = $4 WHERE %s = $5`, idcol)
+	if param == "?" {
+		query = fmt.Sprintf(`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_try = ?, last_error = ? WHERE %s = ?`, idcol)
+	}
+	_, err := db.Exec(query, d.Status, d.Attempts, d.NextTry, d.LastError, d.Id)
+	if err != nil {
+		return fmt.Errorf("webhook delivery update, %v", err)
+	}
+	return nil
+}
+
+// deleteWebhook deletes a webhook and its deliveries. Common to all backends.
+func deleteWebhook(db sqlDB, param, idcol string, id int64) error {
+	p := "$1"
+	if param == "?" {
+		p = "?"
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("webhook delete tx, %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM webhook_deliveries WHERE webhook = "+p, id)
+	if err != nil {
+		return fmt.Errorf("webhook deliveries delete, %v", err)
+	}
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM webhooks WHERE %s = %s", idcol, p), id)
+	if err != nil {
+		return fmt.Errorf("webhook delete, %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("webhook delete commit, %v", err)
+	}
+	return nil
+}
+
+// purgeDeliveries deletes finished deliveries created before `before`, unix
+// seconds. Common to all backends.
+func purgeDeliveries(db sqlDB, param string, before int64) (purged int64, err error) {
+	query := `DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created < $1`
+	if param == "?" {
+		query = `DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created < ?`
+	}
+	result, err := db.Exec(query, before)
+	if err != nil {
+		return 0, fmt.Errorf("webhook deliveries purge, %v", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+)
+
+func TestWebhooks(t *testing.T) {
+	edb, _ := testSqliteEDB(t)
+	mine, err := edb.PutElection(electionRecord{Owner: 1, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+	theirs, err := edb.PutElection(electionRecord{Owner: 2, Data: `{}`})
+	mtfail(t, err, "put, %v", err)
+
+	var mu sync.Mutex
+	var got []*http.Request
+	var bodies [][]byte
+	status := 500
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	sh := StudioHandler{edb: edb, webhookClient: newWebhookClient(true), jobs: newJobScheduler()}
+	ann := &login.User{Guid: 1}
+	do := func(method, path, body string, out interface{}) int {
+		rec := httptest.NewRecorder()
+		m := webhooksPathRe.FindStringSubmatch(path)
+		var whid int64
+		if m[1] != "" {
+			json.Unmarshal([]byte(m[1]), &whid)
+		}
+		sh.handleWebhooks(rec, httptest.NewRequest(method, path, strings.NewReader(body)), ann, whid, m[2])
+		if out != nil && rec.Code == 200 {
+			json.Unmarshal(rec.Body.Bytes(), out)
+		}
+		return rec.Code
+	}
+	for _, bad := range []string{`{"url": "ftp://x/"}`, `{"url": "/relative"}`, `{"url": "http://x/", "events": ["delete"]}`} {
+		if code := do("POST", "/webhooks", bad, nil); code != 400 {
+			t.Errorf("%s: %d", bad, code)
+		}
+	}
+	if code := do("POST", "/webhooks", `{"url": "http://x/", "election": `+strconv.FormatInt(theirs, 10)+`}`, nil); code != 403 {
+		t.Errorf("someone else's election %d", code)
+	}
+	var all, publishOnly webhookRecord
+	if code := do("POST", "/webhooks", `{"url": "`+receiver.URL+`/all"}`, &all); code != 200 || all.Secret == "" || len(all.Events) != len(webhookEvents) {
+		t.Fatalf("post %d %#v", code, all)
+	}
+	do("POST", "/webhooks", `{"url": "`+receiver.URL+`/one", "election": `+strconv.FormatInt(mine, 10)+`, "events": ["publish"]}`, &publishOnly)
+	var list []webhookRecord
+	if code := do("GET", "/webhooks", "", &list); code != 200 || len(list) != 2 || list[0].Secret != "" {
+		t.Errorf("list %d %#v", code, list)
+	}
+
+	sh.fireWebhooks(webhookSave, theirs, nil) // no one's listening
+	sh.fireWebhooks(webhookSave, mine, map[string]interface{}{"new": false})
+	now := time.Now()
+	sh.deliverDueWebhooks(context.Background(), now)
+	if len(got) != 1 {
+		t.Fatalf("%d requests", len(got))
+	}
+	r := got[0]
+	if r.URL.Path != "/all" || r.Header.Get("X-BallotStudio-Event") != webhookSave || r.Header.Get("X-BallotStudio-Signature") != webhookSignature(all.Secret, bodies[0]) {
+		t.Errorf("request %s %v", r.URL.Path, r.Header)
+	}
+	var payload webhookPayload
+	json.Unmarshal(bodies[0], &payload)
+	if payload.Event != webhookSave || payload.ElectionId != mine {
+		t.Errorf("payload %s", bodies[0])
+	}
+	var deliveries []webhookDelivery
+	do("GET", "/webhooks/"+strconv.FormatInt(all.Id, 10)+"/deliveries", "", &deliveries)
+	if len(deliveries) != 1 || deliveries[0].Status != deliveryPending || deliveries[0].Attempts != 1 || deliveries[0].LastError != "500 Internal Server Error" || deliveries[0].NextTry != now.Add(webhookRetries[0]).Unix() {
+		t.Errorf("after a 500 %#v", deliveries)
+	}
+	// not due yet
+	sh.deliverDueWebhooks(context.Background(), now)
+	if len(got) != 1 {
+		t.Errorf("retried early")
+	}
+	status = 204
+	sh.fireWebhooks(webhookPublish, mine, nil)
+	sh.deliverDueWebhooks(context.Background(), now.Add(2*time.Minute))
+	if len(got) != 4 {
+		t.Errorf("%d requests, want the retry and two publishes", len(got))
+	}
+	do("GET", "/webhooks/"+strconv.FormatInt(all.Id, 10)+"/deliveries", "", &deliveries)
+	if len(deliveries) != 2 || deliveries[0].Status != deliveryDelivered || deliveries[1].Status != deliveryDelivered || deliveries[1].Attempts != 2 {
+		t.Errorf("delivered %#v", deliveries)
+	}
+
+	// give up after the last retry
+	status = 404
+	sh.fireWebhooks(webhookRender, mine, nil)
+	when := time.Now()
+	for i := 0; i <= len(webhookRetries); i++ {
+		sh.deliverDueWebhooks(context.Background(), when)
+		when = when.Add(25 * time.Hour)
+	}
+	do("GET", "/webhooks/"+strconv.FormatInt(all.Id, 10)+"/deliveries", "", &deliveries)
+	if deliveries[0].Status != deliveryFailed || deliveries[0].Attempts != len(webhookRetries)+1 {
+		t.Errorf("failed %#v", deliveries[0])
+	}
+
+	var ping webhookDelivery
+	status = 200
+	if code := do("POST", "/webhooks/"+strconv.FormatInt(publishOnly.Id, 10)+"/ping", "", &ping); code != 200 || ping.Status != deliveryDelivered {
+		t.Errorf("ping %d %#v", code, ping)
+	}
+	sh.webhookClient = newWebhookClient(false)
+	if code := do("POST", "/webhooks/"+strconv.FormatInt(publishOnly.Id, 10)+"/ping", "", &ping); code != 200 || ping.Status != deliveryFailed || !strings.Contains(ping.LastError, "private address") {
+		t.Errorf("private ping %d %#v", code, ping)
+	}
+	if newWebhookClient(false).Transport.(*http.Transport).Proxy != nil {
+		t.Errorf("proxy past the private address check")
+	}
+
+	if code := do("DELETE", "/webhooks/"+strconv.FormatInt(all.Id, 10), "", &list); code != 200 || len(list) != 1 {
+		t.Errorf("delete %d %v", code, list)
+	}
+	if code := do("GET", "/webhooks/"+strconv.FormatInt(all.Id, 10)+"/deliveries", "", nil); code != 404 {
+		t.Errorf("deleted webhook %d", code)
+	}
+}
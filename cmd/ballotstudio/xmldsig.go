@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Just enough XML Signature to check SAML responses (saml.go): enveloped
+// signatures over an element referenced by its ID, exclusive XML
+// canonicalization without comments, and RSA with SHA-256 or SHA-512.
+// SHA-1, other transforms and DTDs are refused.
+
+const (
+	xmlNS         = "http://www.w3.org/XML/1998/namespace"
+	dsigNS        = "http://www.w3.org/2000/09/xmldsig#"
+	excC14N       = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSig  = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	digestSHA256  = "http://www.w3.org/2001/04/xmlenc#sha256"
+	digestSHA512  = "http://www.w3.org/2001/04/xmlenc#sha512"
+	rsaSHA256     = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	rsaSHA512     = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	maxXMLDepth   = 100
+	maxXMLElement = 100000
+)
+
+type xmlAttr struct {
+	Prefix string
+	Local  string
+	Value  string
+}
+
+// an element, keeping the prefixes and declarations canonicalization needs
+type xmlNode struct {
+	Prefix   string
+	Local    string
+	Attrs    []xmlAttr         // not namespace declarations
+	NS       map[string]string // declared here, prefix ("" for default) -> uri
+	Children []interface{}     // *xmlNode or string
+	Parent   *xmlNode
+}
+
+// parseXML reads one document element. Comments and processing
+// instructions are dropped; DTDs are refused.
+func parseXML(r io.Reader) (*xmlNode, error) {
+	d := xml.NewDecoder(r)
+	var root, cur *xmlNode
+	depth, count := 0, 0
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root != nil && cur == nil {
+				return nil, errors.New("more than one document element")
+			}
+			depth++
+			count++
+			if depth > maxXMLDepth || count > maxXMLElement {
+				return nil, errors.New("document too big")
+			}
+			n := &xmlNode{Prefix: t.Name.Space, Local: t.Name.Local, NS: make(map[string]string), Parent: cur}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					n.NS[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					n.NS[""] = a.Value
+				default:
+					n.Attrs = append(n.Attrs, xmlAttr{a.Name.Space, a.Name.Local, a.Value})
+				}
+			}
+			if cur == nil {
+				root = n
+			} else {
+				cur.Children = append(cur.Children, n)
+			}
+			cur = n
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.Prefix || t.Name.Local != cur.Local {
+				return nil, fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			depth--
+			cur = cur.Parent
+		case xml.CharData:
+			if cur != nil {
+				cur.Children = append(cur.Children, string(t))
+			} else if len(bytes.TrimSpace(t)) != 0 {
+				return nil, errors.New("text outside the document element")
+			}
+		case xml.Directive:
+			return nil, errors.New("DTDs are not allowed")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("incomplete document")
+	}
+	return root, nil
+}
+
+// lookup finds the namespace bound to prefix where n is
+func (n *xmlNode) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNS, true
+	}
+	for e := n; e != nil; e = e.Parent {
+		if uri, ok := e.NS[prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", prefix == ""
+}
+
+// Space is n's namespace
+func (n *xmlNode) Space() string {
+	uri, _ := n.lookup(n.Prefix)
+	return uri
+}
+
+func (n *xmlNode) is(space, local string) bool {
+	return n.Local == local && n.Space() == space
+}
+
+// children are n's child elements named space local
+func (n *xmlNode) children(space, local string) []*xmlNode {
+	var out []*xmlNode
+	for _, c := range n.Children {
+		if e, ok := c.(*xmlNode); ok && e.is(space, local) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// child is n's only child element named space local, or nil
+func (n *xmlNode) child(space, local string) *xmlNode {
+	cs := n.children(space, local)
+	if len(cs) != 1 {
+		return nil
+	}
+	return cs[0]
+}
+
+// attr is the value of n's unprefixed attribute local
+func (n *xmlNode) attr(local string) string {
+	for _, a := range n.Attrs {
+		if a.Prefix == "" && a.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// text is n's character data, without that of child elements
+func (n *xmlNode) text() string {
+	var sb strings.Builder
+	for _, c := range n.Children {
+		if s, ok := c.(string); ok {
+			sb.WriteString(s)
+		}
+	}
+	return sb.String()
+}
+
+// walk calls f on n and every element under it
+func (n *xmlNode) walk(f func(*xmlNode)) {
+	f(n)
+	for _, c := range n.Children {
+		if e, ok := c.(*xmlNode); ok {
+			e.walk(f)
+		}
+	}
+}
+
+var c14nAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+var c14nTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+// canonicalize writes the exclusive canonical form of n, leaving out skip.
+// inclusive are prefixes ("#default" for the default namespace) rendered
+// as in inclusive canonicalization.
+func canonicalize(out *bytes.Buffer, n *xmlNode, inclusive []string, skip *xmlNode) error {
+	return c14nElement(out, n, inclusive, skip, map[string]string{})
+}
+
+func c14nElement(out *bytes.Buffer, n *xmlNode, inclusive []string, skip *xmlNode, rendered map[string]string) error {
+	used := map[string]bool{n.Prefix: true}
+	for _, a := range n.Attrs {
+		if a.Prefix != "" && a.Prefix != "xml" {
+			used[a.Prefix] = true
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if _, ok := n.lookup(p); ok {
+			used[p] = true
+		}
+	}
+	var prefixes []string
+	for p := range used {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	inScope := make(map[string]string, len(rendered)+len(prefixes))
+	for p, uri := range rendered {
+		inScope[p] = uri
+	}
+	name := n.Local
+	if n.Prefix != "" {
+		name = n.Prefix + ":" + n.Local
+	}
+	out.WriteString("<" + name)
+	for _, p := range prefixes {
+		uri, ok := n.lookup(p)
+		if !ok {
+			return fmt.Errorf("unbound prefix %q", p)
+		}
+		if prev, ok := rendered[p]; (ok && prev == uri) || (!ok && p == "" && uri == "") {
+			continue
+		}
+		if p == "" {
+			out.WriteString(` xmlns="`)
+		} else {
+			out.WriteString(" xmlns:" + p + `="`)
+		}
+		out.WriteString(c14nAttrEscaper.Replace(uri) + `"`)
+		inScope[p] = uri
+	}
+	type sortAttr struct {
+		space string
+		xmlAttr
+	}
+	attrs := make([]sortAttr, len(n.Attrs))
+	for i, a := range n.Attrs {
+		attrs[i].xmlAttr = a
+		if a.Prefix != "" {
+			uri, ok := n.lookup(a.Prefix)
+			if !ok {
+				return fmt.Errorf("unbound prefix %q", a.Prefix)
+			}
+			attrs[i].space = uri
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return attrs[i].Local < attrs[j].Local
+	})
+	for _, a := range attrs {
+		out.WriteString(" ")
+		if a.Prefix != "" {
+			out.WriteString(a.Prefix + ":")
+		}
+		out.WriteString(a.Local + `="` + c14nAttrEscaper.Replace(a.Value) + `"`)
+	}
+	out.WriteString(">")
+	for _, c := range n.Children {
+		switch v := c.(type) {
+		case string:
+			out.WriteString(c14nTextEscaper.Replace(v))
+		case *xmlNode:
+			if v == skip {
+				continue
+			}
+			if err := c14nElement(out, v, inclusive, skip, inScope); err != nil {
+				return err
+			}
+		}
+	}
+	out.WriteString("</" + name + ">")
+	return nil
+}
+
+// inclusivePrefixes is the PrefixList of an exclusive canonicalization
+// transform or method element
+func inclusivePrefixes(n *xmlNode) []string {
+	in := n.child(excC14N, "InclusiveNamespaces")
+	if in == nil {
+		return nil
+	}
+	return strings.Fields(in.attr("PrefixList"))
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// verifyEnveloped checks the signature inside n, which must sign all of n
+// by its ID attribute with one of certs. doc is the whole document n is in,
+// where the ID must be unique.
+func verifyEnveloped(doc, n *xmlNode, certs []*x509.Certificate) error {
+	sigs := n.children(dsigNS, "Signature")
+	if len(sigs) != 1 {
+		return fmt.Errorf("%s has %d signatures", n.Local, len(sigs))
+	}
+	sig := sigs[0]
+	id := n.attr("ID")
+	if id == "" {
+		return fmt.Errorf("%s has no ID", n.Local)
+	}
+	count := 0
+	doc.walk(func(e *xmlNode) {
+		if e.attr("ID") == id {
+			count++
+		}
+	})
+	if count != 1 {
+		return fmt.Errorf("ID %q used %d times", id, count)
+	}
+	si := sig.child(dsigNS, "SignedInfo")
+	if si == nil {
+		return errors.New("no SignedInfo")
+	}
+	cm := si.child(dsigNS, "CanonicalizationMethod")
+	if cm == nil || cm.attr("Algorithm") != excC14N {
+		return errors.New("canonicalization must be exclusive c14n")
+	}
+	sm := si.child(dsigNS, "SignatureMethod")
+	var hash crypto.Hash
+	switch {
+	case sm != nil && sm.attr("Algorithm") == rsaSHA256:
+		hash = crypto.SHA256
+	case sm != nil && sm.attr("Algorithm") == rsaSHA512:
+		hash = crypto.SHA512
+	default:
+		return errors.New("signature method must be rsa-sha256 or rsa-sha512")
+	}
+	refs := si.children(dsigNS, "Reference")
+	if len(refs) != 1 || refs[0].attr("URI") != "#"+id {
+		return fmt.Errorf("signature must reference only #%s", id)
+	}
+	ref := refs[0]
+	var prefixes []string
+	enveloped := false
+	if ts := ref.child(dsigNS, "Transforms"); ts != nil {
+		for _, t := range ts.children(dsigNS, "Transform") {
+			switch t.attr("Algorithm") {
+			case envelopedSig:
+				enveloped = true
+			case excC14N:
+				prefixes = inclusivePrefixes(t)
+			default:
+				return fmt.Errorf("unsupported transform %q", t.attr("Algorithm"))
+			}
+		}
+	}
+	if !enveloped {
+		return errors.New("signature is not enveloped")
+	}
+	var digestHash crypto.Hash
+	dm := ref.child(dsigNS, "DigestMethod")
+	switch {
+	case dm != nil && dm.attr("Algorithm") == digestSHA256:
+		digestHash = crypto.SHA256
+	case dm != nil && dm.attr("Algorithm") == digestSHA512:
+		digestHash = crypto.SHA512
+	default:
+		return errors.New("digest must be sha256 or sha512")
+	}
+	dv := ref.child(dsigNS, "DigestValue")
+	if dv == nil {
+		return errors.New("no DigestValue")
+	}
+	want, err := decodeBase64(dv.text())
+	if err != nil {
+		return fmt.Errorf("DigestValue, %v", err)
+	}
+	var buf bytes.Buffer
+	if err = canonicalize(&buf, n, prefixes, sig); err != nil {
+		return err
+	}
+	h := digestHash.New()
+	h.Write(buf.Bytes())
+	if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+		return errors.New("digest mismatch")
+	}
+	sv := sig.child(dsigNS, "SignatureValue")
+	if sv == nil {
+		return errors.New("no SignatureValue")
+	}
+	sigBytes, err := decodeBase64(sv.text())
+	if err != nil {
+		return fmt.Errorf("SignatureValue, %v", err)
+	}
+	buf.Reset()
+	if err = canonicalize(&buf, si, inclusivePrefixes(cm), nil); err != nil {
+		return err
+	}
+	h = hash.New()
+	h.Write(buf.Bytes())
+	digest := h.Sum(nil)
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(key, hash, digest, sigBytes) == nil {
+			return nil
+		}
+	}
+	return errors.New("bad signature")
+}
@@ -0,0 +1,93 @@
+// Convert a VIP (Voting Information Project) feed to an election report
+//
+// Reads VIP 5 XML from a file, or VIP 5 CSV from a directory of .txt files,
+// writes election report json to stdout.
+// With -into, only the feed's precincts and districts are merged into that
+// election report json, and its ballot styles are generated from them.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/brianolson/ballotstudio/data"
+)
+
+func maybefail(err error, format string, args ...interface{}) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(1)
+}
+
+func main() {
+	verbose := flag.Bool("v", false, "more logging to stderr")
+	into := flag.String("into", "", "election json to merge the feed's precincts and districts into")
+	flag.Parse()
+	if *verbose {
+		data.DebugOut = os.Stderr
+	}
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: vipimport [-into election.json] {feed.xml|csv dir}\n")
+		os.Exit(1)
+	}
+	path := flag.Arg(0)
+	fi, err := os.Stat(path)
+	maybefail(err, "%s: %v\n", path, err)
+	var er map[string]interface{}
+	if *into != "" {
+		er, err = mergeInto(*into, path, fi.IsDir())
+	} else if fi.IsDir() {
+		er, err = data.ImportVIPCSV(path)
+	} else {
+		var fin *os.File
+		fin, err = os.Open(path)
+		maybefail(err, "%s: %v\n", path, err)
+		er, err = data.ImportVIPXML(fin)
+		fin.Close()
+	}
+	maybefail(err, "%s: %v\n", path, err)
+	for _, issue := range data.CheckDistricts(er) {
+		fmt.Fprintf(os.Stderr, "%s\n", issue)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(er)
+	maybefail(err, "json encode, %v\n", err)
+}
+
+// mergeInto reads election json and merges the precincts and districts of the feed at path into it
+func mergeInto(electionPath, path string, isDir bool) (map[string]interface{}, error) {
+	blob, err := ioutil.ReadFile(electionPath)
+	if err != nil {
+		return nil, err
+	}
+	var er map[string]interface{}
+	err = json.Unmarshal(blob, &er)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", electionPath, err)
+	}
+	var units []interface{}
+	if isDir {
+		units, err = data.ImportVIPCSVDistricts(path)
+	} else {
+		var fin *os.File
+		fin, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		units, err = data.ImportVIPXMLDistricts(fin)
+		fin.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	added, updated := data.MergeGpUnits(er, units)
+	styles := data.GenerateBallotStyles(er)
+	fmt.Fprintf(os.Stderr, "%d GpUnits added, %d updated, %d ballot styles\n", added, updated, styles)
+	return er, nil
+}
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Contest extension field "BubbleGeometry" overrides the default bubble
+// target shape for every selection in that contest. All values are in
+// points (1/72 inch), the same units as bubbles json.
+//
+// {"Width": 22.7, "Height": 8.5, "LeftPad": 7.2, "RightPad": 7.2, "OffsetX": 0, "OffsetY": 0, "Spacing": 7.2}
+const BubbleGeometryField = "BubbleGeometry"
+
+// Minimums that a BubbleGeometry override may not go below.
+// Smaller targets are unreliable to mark and to scan.
+var (
+	MinBubbleWidth   = 10.0
+	MinBubbleHeight  = 5.0
+	MinBubblePad     = 0.0
+	MinBubbleSpacing = 0.0
+	MaxBubbleOffset  = 72.0
+)
+
+var bubbleGeometryKeys = []string{"Width", "Height", "LeftPad", "RightPad", "OffsetX", "OffsetY", "Spacing"}
+
+// CheckBubbleGeometry finds every "BubbleGeometry" in an election document and checks it against minimums.
+// Returns a list of human readable problems, empty if everything is ok.
+func CheckBubbleGeometry(er map[string]interface{}) (problems []string) {
+	path := make([]string, 0, 20)
+	return checkBubbleGeometryInner(er, path, problems)
+}
+
+func checkBubbleGeometryInner(er map[string]interface{}, path []string, problems []string) []string {
+	plen := len(path)
+	for k, iv := range er {
+		switch v := iv.(type) {
+		case map[string]interface{}:
+			if k == BubbleGeometryField {
+				problems = checkOneBubbleGeometry(v, pathstr(path, k), problems)
+				continue
+			}
+			path = append(path, k)
+			problems = checkBubbleGeometryInner(v, path, problems)
+			path = path[:plen]
+		case []interface{}:
+			ap := append(path, k)
+			aplen := len(ap)
+			for i, av := range v {
+				amv, ok := av.(map[string]interface{})
+				if ok {
+					ap = append(ap, strconv.Itoa(i))
+					problems = checkBubbleGeometryInner(amv, ap, problems)
+					ap = ap[:aplen]
+				}
+			}
+			path = path[:plen]
+		default:
+			if k == BubbleGeometryField {
+				problems = append(problems, fmt.Sprintf("%s: should be an object but is %T", pathstr(path, k), iv))
+			}
+		}
+	}
+	return problems
+}
+
+func checkOneBubbleGeometry(bg map[string]interface{}, where string, problems []string) []string {
+	for k := range bg {
+		known := false
+		for _, bk := range bubbleGeometryKeys {
+			if k == bk {
+				known = true
+				break
+			}
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("%s: unknown field %#v, want one of %s", where, k, strings.Join(bubbleGeometryKeys, ", ")))
+		}
+	}
+	num := func(name string) (float64, bool) {
+		iv, ok := bg[name]
+		if !ok {
+			return 0, false
+		}
+		v, ok := iv.(float64)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s: should be a number but is %T", where, name, iv))
+			return 0, false
+		}
+		return v, true
+	}
+	atLeast := func(name string, min float64) {
+		v, ok := num(name)
+		if ok && v < min {
+			problems = append(problems, fmt.Sprintf("%s.%s: %g is less than minimum %g", where, name, v, min))
+		}
+	}
+	atMostAbs := func(name string, max float64) {
+		v, ok := num(name)
+		if ok && (v > max || v < -max) {
+			problems = append(problems, fmt.Sprintf("%s.%s: %g is more than %g from default position", where, name, v, max))
+		}
+	}
+	atLeast("Width", MinBubbleWidth)
+	atLeast("Height", MinBubbleHeight)
+	atLeast("LeftPad", MinBubblePad)
+	atLeast("RightPad", MinBubblePad)
+	atLeast("Spacing", MinBubbleSpacing)
+	atMostAbs("OffsetX", MaxBubbleOffset)
+	atMostAbs("OffsetY", MaxBubbleOffset)
+	return problems
+}
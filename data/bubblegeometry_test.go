@@ -0,0 +1,31 @@
+package data
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckBubbleGeometry(t *testing.T) {
+	doc := `{"Election":[{"Contest":[
+{"@type":"ElectionResults.CandidateContest","@id":"co1","BubbleGeometry":{"Width":24,"Height":9,"Spacing":3}},
+{"@type":"ElectionResults.CandidateContest","@id":"co2","BubbleGeometry":{"Width":4,"OffsetX":-100,"Bogus":1}}
+]}]}`
+	var er map[string]interface{}
+	err := json.Unmarshal([]byte(doc), &er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := CheckBubbleGeometry(er)
+	if len(problems) != 3 {
+		t.Errorf("wanted 3 problems, got %d: %#v", len(problems), problems)
+	}
+	for _, p := range problems {
+		t.Log(p)
+	}
+
+	ok := map[string]interface{}{"BubbleGeometry": map[string]interface{}{"Width": 12.0}}
+	problems = CheckBubbleGeometry(ok)
+	if len(problems) != 0 {
+		t.Errorf("wanted no problems, got %#v", problems)
+	}
+}
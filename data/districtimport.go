@@ -0,0 +1,308 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Importing precincts and districts into an existing election, and making
+// its ballot styles from them. Precincts and districts come from a VIP feed
+// (ImportVIPXMLDistricts) or from GeoJSON feature attributes
+// (ImportGeoJSONDistricts), are merged into the document's GpUnits by
+// MergeGpUnits, and GenerateBallotStyles gives every distinct set of
+// contests the precincts vote on its own ballot style.
+
+// GeoJSONFields names the feature properties to read. Each feature is a precinct.
+type GeoJSONFields struct {
+	Precinct string // property holding the precinct's code, required
+	Name     string // property holding the precinct's name, default the code
+
+	// property -> ReportingUnit Type of the districts it assigns, e.g. "CONG_DIST" -> "congressional"
+	Districts map[string]string
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string `json:"type"`
+	Features []struct {
+		Properties map[string]interface{} `json:"properties"`
+	} `json:"features"`
+}
+
+func geoJSONValue(props map[string]interface{}, key string) string {
+	switch v := props[key].(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
+
+// geoUnitId is the @id of an imported unit, from the property that names it and its value
+func geoUnitId(property, value string) string {
+	return strings.ToLower(property) + "-" + strings.Join(strings.Fields(value), "-")
+}
+
+// ImportGeoJSONDistricts reads a GeoJSON FeatureCollection of precincts and
+// returns them and the districts their properties assign them to, as
+// GpUnits. Geometry is ignored. Each unit gets an ExternalIdentifier
+// "property:value", lowercase property, which MergeGpUnits matches on.
+// Features with the same precinct code (split shapes) are one precinct.
+func ImportGeoJSONDistricts(r io.Reader, fields GeoJSONFields) ([]interface{}, error) {
+	if fields.Precinct == "" {
+		return nil, fmt.Errorf("no precinct property given")
+	}
+	var fc geoJSONFeatureCollection
+	err := json.NewDecoder(r).Decode(&fc)
+	if err != nil {
+		return nil, fmt.Errorf("geojson, %v", err)
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("geojson type %q, want FeatureCollection", fc.Type)
+	}
+	var dprops []string
+	for prop := range fields.Districts {
+		dprops = append(dprops, prop)
+	}
+	sort.Strings(dprops)
+	var precincts []interface{}
+	precinctIds := make(map[string]bool)
+	districts := make(map[string]map[string]interface{})
+	var districtOrder []string
+	for i, feature := range fc.Features {
+		code := geoJSONValue(feature.Properties, fields.Precinct)
+		if code == "" {
+			return nil, fmt.Errorf("feature %d has no %s", i, fields.Precinct)
+		}
+		pid := geoUnitId(fields.Precinct, code)
+		if !precinctIds[pid] {
+			precinctIds[pid] = true
+			name := geoJSONValue(feature.Properties, fields.Name)
+			if name == "" {
+				name = code
+			}
+			precincts = append(precincts, map[string]interface{}{
+				"@id":                pid,
+				"@type":              "ElectionResults.ReportingUnit",
+				"Type":               "precinct",
+				"Name":               name,
+				"ExternalIdentifier": []interface{}{strings.ToLower(fields.Precinct) + ":" + code},
+			})
+		}
+		for _, prop := range dprops {
+			value := geoJSONValue(feature.Properties, prop)
+			if value == "" {
+				continue
+			}
+			did := geoUnitId(prop, value)
+			district := districts[did]
+			if district == nil {
+				dtype := fields.Districts[prop]
+				district = map[string]interface{}{
+					"@id":                did,
+					"@type":              "ElectionResults.ReportingUnit",
+					"Type":               reportingUnitType(dtype),
+					"Name":               titleWords(dtype) + " " + value,
+					"ExternalIdentifier": []interface{}{strings.ToLower(prop) + ":" + value},
+					"ComposingGpUnitIds": []interface{}{},
+				}
+				districts[did] = district
+				districtOrder = append(districtOrder, did)
+			}
+			composing := district["ComposingGpUnitIds"].([]interface{})
+			if !containsString(composing, pid) {
+				district["ComposingGpUnitIds"] = append(composing, pid)
+			}
+		}
+	}
+	var out []interface{}
+	for _, did := range districtOrder {
+		out = append(out, districts[did])
+	}
+	return append(out, precincts...), nil
+}
+
+// titleWords is "state-house" as "State House"
+func titleWords(s string) string {
+	words := strings.FieldsFunc(s, func(r rune) bool { return r == '-' || r == '_' || r == ' ' })
+	for i, w := range words {
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// contestSetKey is the same for the same contests in any order
+func contestSetKey(cids []string) string {
+	sorted := append([]string(nil), cids...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+func containsString(they []interface{}, s string) bool {
+	for _, x := range they {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeGpUnits adds imported GpUnits to the document. An imported unit with
+// the @id or a geography code (see Districts) of one already there updates
+// it, keeping the old @id so contests and ballot styles still point at it:
+// its ComposingGpUnitIds and Type are replaced, and its Name is kept.
+// Units in the document that weren't imported are left alone.
+func MergeGpUnits(er map[string]interface{}, units []interface{}) (added, updated int) {
+	existing := getList(er, "GpUnit")
+	byId := make(map[string]map[string]interface{}, len(existing))
+	byCode := make(map[GeoCode]map[string]interface{})
+	for _, gpunit := range existing {
+		byId[getString(gpunit, "@id")] = gpunit
+		for _, gc := range geoCodes(gpunit) {
+			byCode[gc] = gpunit
+		}
+	}
+	// imported @id -> document @id
+	rename := make(map[string]string)
+	matched := make(map[string]map[string]interface{})
+	for _, u := range units {
+		unit, ok := u.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id := getString(unit, "@id")
+		old := byId[id]
+		if old == nil {
+			for _, gc := range geoCodes(unit) {
+				if old = byCode[gc]; old != nil {
+					break
+				}
+			}
+		}
+		if old != nil {
+			rename[id] = getString(old, "@id")
+			matched[id] = old
+		}
+	}
+	gpunits, _ := er["GpUnit"].([]interface{})
+	for _, u := range units {
+		unit, ok := u.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if composing := getStringList(unit, "ComposingGpUnitIds"); len(composing) != 0 {
+			ids := make([]interface{}, len(composing))
+			for i, cid := range composing {
+				if to, ok := rename[cid]; ok {
+					cid = to
+				}
+				ids[i] = cid
+			}
+			unit["ComposingGpUnitIds"] = ids
+		}
+		old := matched[getString(unit, "@id")]
+		if old == nil {
+			gpunits = append(gpunits, unit)
+			added++
+			continue
+		}
+		if composing, ok := unit["ComposingGpUnitIds"]; ok {
+			old["ComposingGpUnitIds"] = composing
+		}
+		if t := getString(unit, "Type"); t != "" {
+			old["Type"] = t
+		}
+		if old["Name"] == nil {
+			old["Name"] = unit["Name"]
+		}
+		if _, ok := old["ExternalIdentifier"]; !ok && unit["ExternalIdentifier"] != nil {
+			old["ExternalIdentifier"] = unit["ExternalIdentifier"]
+		}
+		updated++
+	}
+	er["GpUnit"] = gpunits
+	return added, updated
+}
+
+// GenerateBallotStyles replaces each Election's BallotStyles with one per
+// distinct set of contests a precinct votes on, found by intersecting the
+// precincts' districts with the contests' ElectionDistrictIds. Contests are
+// in the Election's Contest order. A new style with the same contests as an
+// old one keeps the old one's contest order and other fields
+// (ExternalIdentifier, PageHeader and such). Returns the number of styles made.
+func GenerateBallotStyles(er map[string]interface{}) (styles int) {
+	dc := newDistrictContext(er)
+	for _, el := range getList(er, "Election") {
+		// precinct -> contests held there, in order
+		precinctContests := make(map[string][]string)
+		for _, co := range getList(el, "Contest") {
+			cid := getString(co, "@id")
+			did := getString(co, "ElectionDistrictId")
+			gpunit, ok := dc.gpunits[did]
+			if cid == "" || !ok {
+				continue
+			}
+			var precincts []string
+			if dc.isPrecinct(gpunit) {
+				precincts = []string{did}
+			} else {
+				precincts = dc.resolve(did, make(map[string]bool))
+			}
+			for _, p := range precincts {
+				precinctContests[p] = append(precinctContests[p], cid)
+			}
+		}
+		oldByKey := make(map[string]map[string]interface{})
+		for _, bs := range getList(el, "BallotStyle") {
+			var cids []string
+			for _, oc := range getList(bs, "OrderedContent") {
+				if cid := getString(oc, "ContestId"); cid != "" {
+					cids = append(cids, cid)
+				}
+			}
+			oldByKey[contestSetKey(cids)] = bs
+		}
+		styleByKey := make(map[string]map[string]interface{})
+		var keys []string
+		for _, pid := range dc.order {
+			cids := precinctContests[pid]
+			if !dc.isPrecinct(dc.gpunits[pid]) || len(cids) == 0 {
+				continue
+			}
+			key := strings.Join(cids, " ")
+			style := styleByKey[key]
+			if style == nil {
+				style = make(map[string]interface{})
+				for k, v := range oldByKey[contestSetKey(cids)] {
+					style[k] = v
+				}
+				if style["OrderedContent"] == nil {
+					var content []interface{}
+					for _, cid := range cids {
+						content = append(content, map[string]interface{}{
+							"@type":     "ElectionResults.OrderedContest",
+							"ContestId": cid,
+						})
+					}
+					style["OrderedContent"] = content
+				}
+				style["@type"] = "ElectionResults.BallotStyle"
+				style["GpUnitIds"] = []interface{}{}
+				styleByKey[key] = style
+				keys = append(keys, key)
+			}
+			style["GpUnitIds"] = append(style["GpUnitIds"].([]interface{}), pid)
+		}
+		sort.Strings(keys)
+		out := make([]interface{}, len(keys))
+		for i, key := range keys {
+			out[i] = styleByKey[key]
+		}
+		el["BallotStyle"] = out
+		styles += len(out)
+	}
+	return styles
+}
@@ -0,0 +1,90 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testGeoJSON = `{"type": "FeatureCollection", "features": [
+  {"type": "Feature", "properties": {"PCT": "101", "PCT_NAME": "North", "CITY": "Springfield", "WARD": 1}, "geometry": null},
+  {"type": "Feature", "properties": {"PCT": "102", "PCT_NAME": "South", "CITY": "Springfield", "WARD": 2}, "geometry": null},
+  {"type": "Feature", "properties": {"PCT": "102", "PCT_NAME": "South", "CITY": "Springfield", "WARD": 2}, "geometry": null},
+  {"type": "Feature", "properties": {"PCT": "201", "PCT_NAME": "Rural", "CITY": "", "WARD": null}, "geometry": null}
+]}`
+
+// an election with a city contest, a ward 2 contest and a county contest, whose city district is already there
+const testImportElection = `{
+  "GpUnit": [
+    {"@id": "gp-county", "@type": "ElectionResults.ReportingUnit", "Type": "county", "Name": "Lane"},
+    {"@id": "gp-city", "@type": "ElectionResults.ReportingUnit", "Type": "city", "Name": "City of Springfield", "ExternalIdentifier": ["city:Springfield"]}
+  ],
+  "Election": [{
+    "Contest": [
+      {"@id": "c-county", "ElectionDistrictId": "gp-county"},
+      {"@id": "c-mayor", "ElectionDistrictId": "gp-city"},
+      {"@id": "c-ward2", "ElectionDistrictId": "ward-2"}
+    ],
+    "BallotStyle": [
+      {"GpUnitIds": ["old"], "ExternalIdentifier": ["style-a"], "OrderedContent": [{"ContestId": "c-mayor"}, {"ContestId": "c-county"}]}
+    ]
+  }]
+}`
+
+func TestImportGeoJSONDistricts(t *testing.T) {
+	units, err := ImportGeoJSONDistricts(strings.NewReader(testGeoJSON), GeoJSONFields{
+		Precinct:  "PCT",
+		Name:      "PCT_NAME",
+		Districts: map[string]string{"CITY": "city", "WARD": "ward"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// city, ward 1, ward 2, then 3 precincts
+	if len(units) != 6 {
+		t.Fatalf("got %d units", len(units))
+	}
+	ward2 := units[2].(map[string]interface{})
+	if ward2["@id"] != "ward-2" || ward2["Type"] != "ward" || ward2["Name"] != "Ward 2" || len(ward2["ComposingGpUnitIds"].([]interface{})) != 1 {
+		t.Errorf("ward 2 %#v", ward2)
+	}
+
+	var er map[string]interface{}
+	err = json.Unmarshal([]byte(testImportElection), &er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the county is every precinct
+	units = append(units, map[string]interface{}{"@id": "gp-county", "ComposingGpUnitIds": []interface{}{"pct-101", "pct-102", "pct-201"}})
+	added, updated := MergeGpUnits(er, units)
+	if added != 5 || updated != 2 {
+		t.Errorf("added %d updated %d", added, updated)
+	}
+	city := er["GpUnit"].([]interface{})[1].(map[string]interface{})
+	if city["Name"] != "City of Springfield" || len(city["ComposingGpUnitIds"].([]interface{})) != 2 {
+		t.Errorf("city %#v", city)
+	}
+	if n := GenerateBallotStyles(er); n != 3 {
+		t.Errorf("%d styles", n)
+	}
+	styles := er["Election"].([]interface{})[0].(map[string]interface{})["BallotStyle"].([]interface{})
+	// by contest set: county+mayor (101, kept from the old style), county+mayor+ward2 (102), county (201)
+	var got []string
+	for _, s := range styles {
+		style := s.(map[string]interface{})
+		var ids []string
+		for _, id := range getStringList(style, "GpUnitIds") {
+			ids = append(ids, id)
+		}
+		got = append(got, strings.Join(ids, ","))
+		if len(ids) == 1 && ids[0] == "pct-101" && style["ExternalIdentifier"] == nil {
+			t.Errorf("style for the same contests lost its fields, %#v", style)
+		}
+	}
+	if strings.Join(got, " ") != "pct-201 pct-101 pct-102" {
+		t.Errorf("styles %v", got)
+	}
+	if issues := CheckDistricts(er); len(issues) != 0 {
+		t.Errorf("issues %v", issues)
+	}
+}
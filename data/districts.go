@@ -0,0 +1,366 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Districts are ReportingUnit GpUnits that contests are held in.
+// A district is made of precincts, directly or through other units in ComposingGpUnitIds.
+// Geography codes come from ExternalIdentifier, as "fips:41039" or "ocd-id:ocd-division/country:us/state:or" strings
+// or as NIST {"Type":..., "OtherType":..., "Value":...} objects.
+
+const (
+	IssueError   = "error"
+	IssueWarning = "warning"
+)
+
+// GpUnit types that are voted as a whole on one ballot style
+var precinctTypes = map[string]bool{
+	"precinct":          true,
+	"split-precinct":    true,
+	"combined-precinct": true,
+	"ballot-style-area": true,
+}
+
+// GeoCode is a geography code for a GpUnit, e.g. {"fips", "41039"}
+type GeoCode struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func (gc GeoCode) String() string {
+	return gc.Type + ":" + gc.Value
+}
+
+// District is a GpUnit with its precincts resolved
+type District struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	GeoCodes  []GeoCode `json:"geocodes,omitempty"`
+	Precincts []string  `json:"precincts"`
+	Contests  []string  `json:"contests,omitempty"`
+}
+
+// DistrictIssue is a problem found by CheckDistricts
+type DistrictIssue struct {
+	Severity string `json:"severity"` // IssueError or IssueWarning
+	Id       string `json:"id"`       // @id of the contest, GpUnit or ballot style
+	Message  string `json:"message"`
+}
+
+func (di DistrictIssue) String() string {
+	return fmt.Sprintf("%s %s: %s", di.Severity, di.Id, di.Message)
+}
+
+func geoCodes(gpunit map[string]interface{}) (out []GeoCode) {
+	eis, _ := gpunit["ExternalIdentifier"].([]interface{})
+	for _, ei := range eis {
+		switch v := ei.(type) {
+		case string:
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			parts := strings.SplitN(v, ":", 2)
+			if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+				out = append(out, GeoCode{strings.ToLower(parts[0]), parts[1]})
+			} else {
+				out = append(out, GeoCode{"other", v})
+			}
+		case map[string]interface{}:
+			gc := GeoCode{Type: strings.ToLower(getString(v, "Type")), Value: getString(v, "Value")}
+			if gc.Type == "other" && getString(v, "OtherType") != "" {
+				gc.Type = getString(v, "OtherType")
+			}
+			if gc.Value != "" {
+				out = append(out, gc)
+			}
+		}
+	}
+	return
+}
+
+func getString(ob map[string]interface{}, key string) string {
+	v, _ := ob[key].(string)
+	return v
+}
+
+func getList(ob map[string]interface{}, key string) (out []map[string]interface{}) {
+	they, _ := ob[key].([]interface{})
+	for _, x := range they {
+		if m, ok := x.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return
+}
+
+func getStringList(ob map[string]interface{}, key string) (out []string) {
+	they, _ := ob[key].([]interface{})
+	for _, x := range they {
+		if s, ok := x.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return
+}
+
+type districtContext struct {
+	gpunits map[string]map[string]interface{}
+	order   []string
+
+	// true if any GpUnit has a precinct type, otherwise units with no
+	// ComposingGpUnitIds are taken to be the precincts
+	typedPrecincts bool
+
+	precincts map[string][]string // memo, @id -> precinct @ids
+	issues    []DistrictIssue
+}
+
+func (dc *districtContext) issue(severity, id, format string, args ...interface{}) {
+	dc.issues = append(dc.issues, DistrictIssue{severity, id, fmt.Sprintf(format, args...)})
+}
+
+func (dc *districtContext) isPrecinct(gpunit map[string]interface{}) bool {
+	if dc.typedPrecincts {
+		return precinctTypes[getString(gpunit, "Type")]
+	}
+	return len(getStringList(gpunit, "ComposingGpUnitIds")) == 0
+}
+
+// resolve returns the sorted precinct @ids that make up a GpUnit
+func (dc *districtContext) resolve(id string, visiting map[string]bool) []string {
+	if ps, ok := dc.precincts[id]; ok {
+		return ps
+	}
+	gpunit := dc.gpunits[id]
+	if dc.isPrecinct(gpunit) {
+		dc.precincts[id] = []string{id}
+		return dc.precincts[id]
+	}
+	visiting[id] = true
+	set := make(map[string]bool)
+	for _, sub := range getStringList(gpunit, "ComposingGpUnitIds") {
+		if _, ok := dc.gpunits[sub]; !ok {
+			dc.issue(IssueError, id, "ComposingGpUnitIds has unknown GpUnit %s", sub)
+			continue
+		}
+		if visiting[sub] {
+			dc.issue(IssueError, id, "GpUnit %s is part of itself", sub)
+			continue
+		}
+		for _, p := range dc.resolve(sub, visiting) {
+			set[p] = true
+		}
+	}
+	delete(visiting, id)
+	ps := make([]string, 0, len(set))
+	for p := range set {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	dc.precincts[id] = ps
+	return ps
+}
+
+// Districts returns every GpUnit that is not a precinct with its precincts and the contests held in it.
+// Problems with GpUnits themselves (unknown or circular ComposingGpUnitIds) are also returned.
+func Districts(er map[string]interface{}) ([]District, []DistrictIssue) {
+	dc := newDistrictContext(er)
+	districts := dc.districts(er)
+	return districts, dc.issues
+}
+
+func newDistrictContext(er map[string]interface{}) *districtContext {
+	dc := &districtContext{
+		gpunits:   make(map[string]map[string]interface{}),
+		precincts: make(map[string][]string),
+	}
+	for _, gpunit := range getList(er, "GpUnit") {
+		id := getString(gpunit, "@id")
+		if id == "" {
+			continue
+		}
+		if _, dup := dc.gpunits[id]; dup {
+			dc.issue(IssueError, id, "duplicate GpUnit @id")
+			continue
+		}
+		dc.gpunits[id] = gpunit
+		dc.order = append(dc.order, id)
+		if precinctTypes[getString(gpunit, "Type")] {
+			dc.typedPrecincts = true
+		}
+	}
+	return dc
+}
+
+func (dc *districtContext) districts(er map[string]interface{}) []District {
+	contests := make(map[string][]string)
+	for _, el := range getList(er, "Election") {
+		for _, co := range getList(el, "Contest") {
+			did := getString(co, "ElectionDistrictId")
+			if did != "" {
+				contests[did] = append(contests[did], getString(co, "@id"))
+			}
+		}
+	}
+	var out []District
+	for _, id := range dc.order {
+		gpunit := dc.gpunits[id]
+		if dc.isPrecinct(gpunit) {
+			continue
+		}
+		out = append(out, District{
+			Id:        id,
+			Name:      getString(gpunit, "Name"),
+			Type:      getString(gpunit, "Type"),
+			GeoCodes:  geoCodes(gpunit),
+			Precincts: dc.resolve(id, make(map[string]bool)),
+			Contests:  contests[id],
+		})
+	}
+	return out
+}
+
+// CheckDistricts finds contests that can't be placed on a ballot and
+// district definitions that overlap, so they can be fixed before ballot
+// styles are generated or drawn.
+func CheckDistricts(er map[string]interface{}) []DistrictIssue {
+	dc := newDistrictContext(er)
+	districts := dc.districts(er)
+	byId := make(map[string]*District, len(districts))
+	for i := range districts {
+		byId[districts[i].Id] = &districts[i]
+	}
+
+	// every contest needs a district with precincts in it
+	inContestDistrict := make(map[string]bool)
+	contestDistrict := make(map[string]string)
+	anyContests := false
+	for _, el := range getList(er, "Election") {
+		for _, co := range getList(el, "Contest") {
+			anyContests = true
+			cid := getString(co, "@id")
+			did := getString(co, "ElectionDistrictId")
+			contestDistrict[cid] = did
+			if did == "" {
+				dc.issue(IssueError, cid, "contest is not assigned to a district")
+				continue
+			}
+			gpunit, ok := dc.gpunits[did]
+			if !ok {
+				dc.issue(IssueError, cid, "contest district %s is not a known GpUnit", did)
+				continue
+			}
+			var precincts []string
+			if d := byId[did]; d != nil {
+				precincts = d.Precincts
+			} else if dc.isPrecinct(gpunit) {
+				precincts = []string{did}
+			}
+			if len(precincts) == 0 {
+				dc.issue(IssueError, cid, "contest district %s has no precincts", did)
+			}
+			for _, p := range precincts {
+				inContestDistrict[p] = true
+			}
+		}
+	}
+
+	// the same geography code on two units
+	codeOwner := make(map[GeoCode]string)
+	for _, id := range dc.order {
+		for _, gc := range geoCodes(dc.gpunits[id]) {
+			if prev, ok := codeOwner[gc]; ok && prev != id {
+				dc.issue(IssueError, id, "geography code %s is also on %s", gc, prev)
+				continue
+			}
+			codeOwner[gc] = id
+		}
+	}
+
+	// districts of the same type should not share precincts (two wards, two school districts...)
+	byType := make(map[string][]*District)
+	var types []string
+	for i := range districts {
+		d := &districts[i]
+		if d.Type == "" || d.Type == "other" {
+			continue
+		}
+		if byType[d.Type] == nil {
+			types = append(types, d.Type)
+		}
+		byType[d.Type] = append(byType[d.Type], d)
+	}
+	for _, dtype := range types {
+		ds := byType[dtype]
+		for i, a := range ds {
+			have := make(map[string]bool, len(a.Precincts))
+			for _, p := range a.Precincts {
+				have[p] = true
+			}
+			for _, b := range ds[i+1:] {
+				var shared []string
+				for _, p := range b.Precincts {
+					if have[p] {
+						shared = append(shared, p)
+					}
+				}
+				if len(shared) != 0 {
+					dc.issue(IssueWarning, b.Id, "%s district overlaps %s on precincts %s", dtype, a.Id, strings.Join(shared, " "))
+				}
+			}
+		}
+	}
+
+	if anyContests {
+		for _, id := range dc.order {
+			if dc.isPrecinct(dc.gpunits[id]) && !inContestDistrict[id] {
+				dc.issue(IssueWarning, id, "precinct is in no contest's district")
+			}
+		}
+	}
+
+	// existing ballot styles should only hold contests their precincts are eligible for
+	for _, el := range getList(er, "Election") {
+		for si, bs := range getList(el, "BallotStyle") {
+			sid := fmt.Sprintf("BallotStyle[%d]", si)
+			var precincts []string
+			for _, gid := range getStringList(bs, "GpUnitIds") {
+				if _, ok := dc.gpunits[gid]; !ok {
+					dc.issue(IssueError, sid, "unknown GpUnit %s", gid)
+					continue
+				}
+				precincts = append(precincts, dc.resolve(gid, make(map[string]bool))...)
+			}
+			for _, oc := range getList(bs, "OrderedContent") {
+				cid := getString(oc, "ContestId")
+				did, ok := contestDistrict[cid]
+				if cid == "" || !ok || did == "" {
+					continue
+				}
+				eligible := make(map[string]bool)
+				if d := byId[did]; d != nil {
+					for _, p := range d.Precincts {
+						eligible[p] = true
+					}
+				} else {
+					eligible[did] = true
+				}
+				var outside []string
+				for _, p := range precincts {
+					if !eligible[p] {
+						outside = append(outside, p)
+					}
+				}
+				if len(outside) != 0 {
+					dc.issue(IssueWarning, sid, "contest %s is not held in precincts %s", cid, strings.Join(outside, " "))
+				}
+			}
+		}
+	}
+	return dc.issues
+}
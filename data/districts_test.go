@@ -0,0 +1,85 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testDistrictsJSON = `{
+  "GpUnit": [
+    {"@id": "gpunit1", "@type": "ElectionResults.ReportingUnit", "Type": "city", "Name": "Springfield", "ExternalIdentifier": ["fips:4169600"], "ComposingGpUnitIds": ["gpunit3", "gpunit4"]},
+    {"@id": "gpunit2", "@type": "ElectionResults.ReportingUnit", "Type": "ward", "Name": "Ward 1", "ComposingGpUnitIds": ["gpunit3"]},
+    {"@id": "gpunit3", "@type": "ElectionResults.ReportingUnit", "Type": "precinct", "Name": "P1"},
+    {"@id": "gpunit4", "@type": "ElectionResults.ReportingUnit", "Type": "precinct", "Name": "P2"},
+    {"@id": "gpunit5", "@type": "ElectionResults.ReportingUnit", "Type": "ward", "Name": "Ward 2", "ExternalIdentifier": ["fips:4169600"], "ComposingGpUnitIds": ["gpunit3", "gpunit4"]},
+    {"@id": "gpunit6", "@type": "ElectionResults.ReportingUnit", "Type": "school", "Name": "Empty"},
+    {"@id": "gpunit7", "@type": "ElectionResults.ReportingUnit", "Type": "precinct", "Name": "P3"}
+  ],
+  "Election": [{
+    "Contest": [
+      {"@id": "ccont1", "@type": "ElectionResults.CandidateContest", "ElectionDistrictId": "gpunit1"},
+      {"@id": "ccont2", "@type": "ElectionResults.CandidateContest"},
+      {"@id": "ccont3", "@type": "ElectionResults.CandidateContest", "ElectionDistrictId": "gpunit6"},
+      {"@id": "ccont4", "@type": "ElectionResults.CandidateContest", "ElectionDistrictId": "gpunit2"}
+    ],
+    "BallotStyle": [
+      {"GpUnitIds": ["gpunit4"], "OrderedContent": [{"ContestId": "ccont1"}, {"ContestId": "ccont4"}]}
+    ]
+  }]
+}`
+
+func TestCheckDistricts(t *testing.T) {
+	var er map[string]interface{}
+	err := json.Unmarshal([]byte(testDistrictsJSON), &er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	districts, issues := Districts(er)
+	if len(issues) != 0 {
+		t.Errorf("unexpected issues %v", issues)
+	}
+	if len(districts) != 4 {
+		t.Fatalf("wanted 4 districts, got %#v", districts)
+	}
+	city := districts[0]
+	if city.Id != "gpunit1" || strings.Join(city.Precincts, " ") != "gpunit3 gpunit4" || len(city.GeoCodes) != 1 || city.GeoCodes[0].Value != "4169600" {
+		t.Errorf("bad city %#v", city)
+	}
+
+	issues = CheckDistricts(er)
+	want := []string{
+		"error ccont2: contest is not assigned",
+		"error ccont3: contest district gpunit6 has no precincts",
+		"error gpunit5: geography code fips:4169600 is also on gpunit1",
+		"warning gpunit5: ward district overlaps gpunit2 on precincts gpunit3",
+		"warning gpunit7: precinct is in no contest's district",
+		"warning BallotStyle[0]: contest ccont4 is not held in precincts gpunit4",
+	}
+	if len(issues) != len(want) {
+		t.Errorf("wanted %d issues, got %d: %v", len(want), len(issues), issues)
+	}
+	for i, w := range want {
+		if i < len(issues) && !strings.HasPrefix(issues[i].String(), w) {
+			t.Errorf("issue %d wanted %#v got %#v", i, w, issues[i].String())
+		}
+	}
+}
+
+func TestDistrictsUntypedPrecincts(t *testing.T) {
+	// no precinct types, leaf units are the precincts
+	er := map[string]interface{}{
+		"GpUnit": []interface{}{
+			map[string]interface{}{"@id": "a", "ComposingGpUnitIds": []interface{}{"b", "c"}},
+			map[string]interface{}{"@id": "b"},
+			map[string]interface{}{"@id": "c", "ComposingGpUnitIds": []interface{}{"a"}},
+		},
+	}
+	districts, issues := Districts(er)
+	if len(districts) != 2 {
+		t.Errorf("wanted 2 districts, got %#v", districts)
+	}
+	if len(issues) != 1 || !strings.Contains(issues[0].Message, "part of itself") {
+		t.Errorf("wanted cycle issue, got %v", issues)
+	}
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A BallotMeasureContest with "PrintFullText": true has its standard
+// "FullText" printed on the ballot ahead of its choices, flowed across
+// columns and pages. Blank lines separate paragraphs, and a paragraph
+// starting "# " is a bold heading.
+//
+// Many states set a minimum type size for measure text, or a word limit
+// past which the text goes in the pamphlet instead. The Election's
+// "MeasureText" extension field holds those rules:
+//
+// {"MeasureText": {"FontSize": 10, "MinFontSize": 10, "MaxWords": 1500}}
+//
+// FontSize is what the text is printed in (default DefaultMeasureFontSize,
+// raised by RenderOptions MinFontSize like all ballot text). MinFontSize
+// and MaxWords, if set, are checked by CheckMeasureText.
+
+const (
+	PrintFullTextField = "PrintFullText"
+	MeasureTextField   = "MeasureText"
+)
+
+// DefaultMeasureFontSize is the point size of printed measure text
+const DefaultMeasureFontSize = 10.0
+
+// MaxMeasureFontSize is as big as FontSize and MinFontSize go
+const MaxMeasureFontSize = 36.0
+
+// MeasureTextRules is an Election's "MeasureText" field
+type MeasureTextRules struct {
+	FontSize    float64
+	MinFontSize float64
+	MaxWords    int
+}
+
+func measureTextRules(el map[string]interface{}) (rules MeasureTextRules, problems []string) {
+	rules.FontSize = DefaultMeasureFontSize
+	mt, _ := el[MeasureTextField].(map[string]interface{})
+	for _, key := range []string{"FontSize", "MinFontSize", "MaxWords"} {
+		v, ok := mt[key]
+		if !ok {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok || f < 0 {
+			problems = append(problems, fmt.Sprintf("MeasureText %s %v should be a positive number", key, v))
+			continue
+		}
+		if key != "MaxWords" && f > MaxMeasureFontSize {
+			problems = append(problems, fmt.Sprintf("MeasureText %s %g should be at most %g", key, f, MaxMeasureFontSize))
+			continue
+		}
+		switch key {
+		case "FontSize":
+			if f != 0 {
+				rules.FontSize = f
+			}
+		case "MinFontSize":
+			rules.MinFontSize = f
+		case "MaxWords":
+			rules.MaxWords = int(f)
+		}
+	}
+	return
+}
+
+// textString is a plain string or an InternationalizedText's first text
+func textString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case map[string]interface{}:
+		for _, t := range getList(x, "Text") {
+			if s := getString(t, "Content"); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// CheckMeasureText finds printed measure texts over the Election's word
+// limit or in type smaller than its minimum, and printed measures with no
+// text. The type size is FontSize, or the RenderOptions MinFontSize if that
+// is larger.
+func CheckMeasureText(er map[string]interface{}) (issues []DistrictIssue) {
+	for _, el := range getList(er, "Election") {
+		rules, problems := measureTextRules(el)
+		for _, p := range problems {
+			issues = append(issues, DistrictIssue{IssueError, MeasureTextField, p})
+		}
+		size := rules.FontSize
+		ro, _ := el["RenderOptions"].(map[string]interface{})
+		if mfs, ok := ro["MinFontSize"].(float64); ok && mfs > size {
+			size = mfs
+		}
+		printed := 0
+		for _, co := range getList(el, "Contest") {
+			if p, _ := co[PrintFullTextField].(bool); !p {
+				continue
+			}
+			printed++
+			cid := getString(co, "@id")
+			text := textString(co["FullText"])
+			words := len(strings.Fields(strings.ReplaceAll(text, "# ", " ")))
+			if words == 0 {
+				issues = append(issues, DistrictIssue{IssueWarning, cid, "PrintFullText but no FullText"})
+			} else if rules.MaxWords != 0 && words > rules.MaxWords {
+				issues = append(issues, DistrictIssue{IssueError, cid, fmt.Sprintf("FullText is %d words, more than the %d allowed on the ballot", words, rules.MaxWords)})
+			}
+		}
+		if printed != 0 && size < rules.MinFontSize {
+			issues = append(issues, DistrictIssue{IssueError, MeasureTextField, fmt.Sprintf("measure text is %gpt, smaller than the %gpt minimum", size, rules.MinFontSize)})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,50 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCheckMeasureText(t *testing.T) {
+	check := func(doc string) (got []string) {
+		var er map[string]interface{}
+		err := json.Unmarshal([]byte(doc), &er)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, issue := range CheckMeasureText(er) {
+			got = append(got, issue.String())
+		}
+		return
+	}
+	const doc = `{"Election": [{%s "Contest": [
+  {"@id": "bmc1", "@type": "ElectionResults.BallotMeasureContest", "PrintFullText": true, "FullText": {"Text": [{"Language": "en", "Content": "# Section 1\n\nThe city shall build a bridge."}]}},
+  {"@id": "bmc2", "@type": "ElectionResults.BallotMeasureContest", "PrintFullText": true},
+  {"@id": "bmc3", "@type": "ElectionResults.BallotMeasureContest", "FullText": "not printed, so no limit on it"}
+]}]}`
+	for _, tc := range []struct {
+		rules string
+		want  []string
+	}{
+		{"", []string{"warning bmc2: PrintFullText but no FullText"}},
+		{`"MeasureText": {"MaxWords": 8, "MinFontSize": 10},`, []string{"warning bmc2: PrintFullText but no FullText"}},
+		{`"MeasureText": {"MaxWords": 6, "MinFontSize": 12},`, []string{
+			"error bmc1: FullText is 8 words, more than the 6 allowed on the ballot",
+			"warning bmc2: PrintFullText but no FullText",
+			"error MeasureText: measure text is 10pt, smaller than the 12pt minimum",
+		}},
+		// RenderOptions MinFontSize raises the measure text too
+		{`"MeasureText": {"MinFontSize": 12}, "RenderOptions": {"MinFontSize": 12},`, []string{"warning bmc2: PrintFullText but no FullText"}},
+		{`"MeasureText": {"FontSize": 99, "MaxWords": "lots"},`, []string{
+			"error MeasureText: MeasureText FontSize 99 should be at most 36",
+			"error MeasureText: MeasureText MaxWords lots should be a positive number",
+			"warning bmc2: PrintFullText but no FullText",
+		}},
+	} {
+		got := check(strings.Replace(doc, "%s", tc.rules, 1))
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s: got %q", tc.rules, got)
+		}
+	}
+}
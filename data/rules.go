@@ -0,0 +1,229 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Validation rules catch common legal and layout mistakes in an election
+// document. Each rule has a default severity; an Election can change it, or
+// turn the rule off, in its "ValidationRules" extension field:
+//
+// {"ValidationRules": {"votes-allowed": "error", "duplicate-candidate": "off"}}
+//
+// The "required-languages" rule checks text against the Election's
+// "RequiredLanguages", e.g. ["en", "es"]. With none it checks nothing.
+
+const (
+	ValidationRulesField   = "ValidationRules"
+	RequiredLanguagesField = "RequiredLanguages"
+
+	// a rule set to this is not checked
+	RuleOff = "off"
+)
+
+// Rule is one validation rule
+type Rule struct {
+	Name     string
+	Severity string // IssueError or IssueWarning, unless the Election says otherwise
+	Doc      string
+
+	// check finds problems in one Election of er
+	check func(er, el map[string]interface{}) []DistrictIssue
+}
+
+// Rules are all the validation rules, in the order they are checked
+var Rules = []Rule{
+	{"no-candidates", IssueError, "a contest has no selections, or a candidate contest only write-ins", checkNoCandidates},
+	{"votes-allowed", IssueWarning, "a contest's VotesAllowed is more than its candidates", checkVotesAllowed},
+	{"duplicate-candidate", IssueError, "two selections in a contest have the same candidate name", checkDuplicateCandidates},
+	{"required-languages", IssueError, "text is missing one of the Election's RequiredLanguages", checkRequiredLanguages},
+}
+
+// RuleIssue is a problem found by a validation rule
+type RuleIssue struct {
+	DistrictIssue
+	Rule string `json:"rule"`
+}
+
+// Validate checks er against Rules, at the severities its Elections set.
+// A bad ValidationRules field is itself an error.
+func Validate(er map[string]interface{}) (issues []RuleIssue) {
+	for _, el := range getList(er, "Election") {
+		severity := make(map[string]string, len(Rules))
+		for _, rule := range Rules {
+			severity[rule.Name] = rule.Severity
+		}
+		vr, _ := el[ValidationRulesField].(map[string]interface{})
+		names := make([]string, 0, len(vr))
+		for name := range vr {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			level, _ := vr[name].(string)
+			if _, ok := severity[name]; !ok {
+				issues = append(issues, RuleIssue{DistrictIssue{IssueError, ValidationRulesField, "unknown rule " + name}, ValidationRulesField})
+			} else if level != IssueError && level != IssueWarning && level != RuleOff {
+				issues = append(issues, RuleIssue{DistrictIssue{IssueError, ValidationRulesField, fmt.Sprintf("rule %s %v should be %s, %s or %s", name, vr[name], IssueError, IssueWarning, RuleOff)}, ValidationRulesField})
+			} else {
+				severity[name] = level
+			}
+		}
+		for _, rule := range Rules {
+			if severity[rule.Name] == RuleOff {
+				continue
+			}
+			for _, di := range rule.check(er, el) {
+				di.Severity = severity[rule.Name]
+				issues = append(issues, RuleIssue{di, rule.Name})
+			}
+		}
+	}
+	return issues
+}
+
+func isWriteIn(sel map[string]interface{}) bool {
+	wi, _ := sel["IsWriteIn"].(bool)
+	return wi
+}
+
+func checkNoCandidates(er, el map[string]interface{}) (out []DistrictIssue) {
+	for _, co := range getList(el, "Contest") {
+		cid := getString(co, "@id")
+		sels := getList(co, "ContestSelection")
+		if len(sels) == 0 {
+			out = append(out, DistrictIssue{Id: cid, Message: "contest has no selections"})
+			continue
+		}
+		if getString(co, "@type") != CandidateContestType {
+			continue
+		}
+		candidates := 0
+		for _, sel := range sels {
+			if !isWriteIn(sel) {
+				candidates++
+			}
+		}
+		if candidates == 0 {
+			out = append(out, DistrictIssue{Id: cid, Message: "contest has no candidates, only write-ins"})
+		}
+	}
+	return
+}
+
+func checkVotesAllowed(er, el map[string]interface{}) (out []DistrictIssue) {
+	for _, co := range getList(el, "Contest") {
+		va, ok := co["VotesAllowed"].(float64)
+		if !ok || getString(co, "@type") != CandidateContestType {
+			continue
+		}
+		// cross-endorsed candidates on more than one line count once
+		candidates := make(map[string]bool)
+		for _, sel := range getList(co, "ContestSelection") {
+			if key := candidateKey(sel); key != "" && !isWriteIn(sel) {
+				candidates[key] = true
+			}
+		}
+		if len(candidates) != 0 && int(va) > len(candidates) {
+			out = append(out, DistrictIssue{Id: getString(co, "@id"), Message: fmt.Sprintf("vote for %d but only %d candidates", int(va), len(candidates))})
+		}
+	}
+	return
+}
+
+func checkDuplicateCandidates(er, el map[string]interface{}) (out []DistrictIssue) {
+	names := make(map[string]string)
+	for _, cand := range getList(el, "Candidate") {
+		names[getString(cand, "@id")] = strings.ToLower(strings.Join(strings.Fields(textString(cand["BallotName"])), " "))
+	}
+	for _, co := range getList(el, "Contest") {
+		// name -> candidateKey of the first selection with it
+		seen := make(map[string]string)
+		for _, sel := range getList(co, "ContestSelection") {
+			key := candidateKey(sel)
+			var sn []string
+			for _, cid := range getStringList(sel, "CandidateIds") {
+				sn = append(sn, names[cid])
+			}
+			name := strings.Join(sn, " / ")
+			if name == "" {
+				continue
+			}
+			first, dup := seen[name]
+			if !dup {
+				seen[name] = key
+			} else if first != key {
+				// the same candidates listed again are a cross-endorsement, not a duplicate
+				out = append(out, DistrictIssue{Id: getString(co, "@id"), Message: fmt.Sprintf("%q is on the ballot twice, selection %s", name, getString(sel, "@id"))})
+			}
+		}
+	}
+	return
+}
+
+func checkRequiredLanguages(er, el map[string]interface{}) (out []DistrictIssue) {
+	required := getStringList(el, RequiredLanguagesField)
+	if len(required) == 0 {
+		return nil
+	}
+	// text anywhere in the document; id is the nearest enclosing @id
+	var walk func(v interface{}, id, field string)
+	walk = func(v interface{}, id, field string) {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if texts, ok := x["Text"].([]interface{}); ok {
+				have := make(map[string]bool)
+				for _, t := range texts {
+					tm, _ := t.(map[string]interface{})
+					if getString(tm, "Content") != "" {
+						have[getString(tm, "Language")] = true
+					}
+				}
+				var missing []string
+				for _, lang := range required {
+					if !have[lang] {
+						missing = append(missing, lang)
+					}
+				}
+				if len(missing) != 0 {
+					out = append(out, DistrictIssue{Id: id, Message: fmt.Sprintf("%s missing %s", field, strings.Join(missing, ","))})
+				}
+				return
+			}
+			if sid := getString(x, "@id"); sid != "" {
+				id = sid
+			}
+			keys := make([]string, 0, len(x))
+			for k := range x {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(x[k], id, k)
+			}
+		case []interface{}:
+			for _, sub := range x {
+				walk(sub, id, field)
+			}
+		case string:
+			// a plain string is in no particular language
+			if x != "" && textFields[field] {
+				out = append(out, DistrictIssue{Id: id, Message: fmt.Sprintf("%s is not translated", field)})
+			}
+		}
+	}
+	walk(er, "", "")
+	return
+}
+
+// InternationalizedText fields voters read, which may be given as plain strings
+var textFields = map[string]bool{
+	"BallotName":     true,
+	"BallotTitle":    true,
+	"BallotSubTitle": true,
+	"Selection":      true,
+	"FullText":       true,
+	"SummaryText":    true,
+}
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testRulesJSON = `{"Election": [{
+  %s
+  "Candidate": [
+    {"@id": "cand1", "BallotName": "Ann Smith"},
+    {"@id": "cand2", "BallotName": {"Text": [{"Language": "en", "Content": "ann  smith"}, {"Language": "es", "Content": "Ann Smith"}]}},
+    {"@id": "cand3", "BallotName": "Bob"}
+  ],
+  "Contest": [
+    {"@id": "ccont1", "@type": "ElectionResults.CandidateContest", "VotesAllowed": 3, "ContestSelection": [
+      {"@id": "csel1", "CandidateIds": ["cand1"], "EndorsementPartyIds": ["party1"]},
+      {"@id": "csel2", "CandidateIds": ["cand1"], "EndorsementPartyIds": ["party2"]},
+      {"@id": "csel3", "CandidateIds": ["cand2"]},
+      {"@id": "csel4", "IsWriteIn": true}
+    ]},
+    {"@id": "ccont2", "@type": "ElectionResults.CandidateContest", "ContestSelection": [{"@id": "csel5", "IsWriteIn": true}]},
+    {"@id": "bmcont1", "@type": "ElectionResults.BallotMeasureContest", "BallotTitle": {"Text": [{"Language": "en", "Content": "Measure 1"}]}}
+  ]
+}]}`
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		want   []string
+	}{
+		{"", []string{
+			"no-candidates error ccont2: contest has no candidates, only write-ins",
+			"no-candidates error bmcont1: contest has no selections",
+			"votes-allowed warning ccont1: vote for 3 but only 2 candidates",
+			`duplicate-candidate error ccont1: "ann smith" is on the ballot twice, selection csel3`,
+		}},
+		{`"ValidationRules": {"no-candidates": "off", "votes-allowed": "error", "duplicate-candidate": "warning"}, "RequiredLanguages": ["en", "es"],`, []string{
+			"votes-allowed error ccont1: vote for 3 but only 2 candidates",
+			`duplicate-candidate warning ccont1: "ann smith" is on the ballot twice, selection csel3`,
+			"required-languages error cand1: BallotName is not translated",
+			"required-languages error cand3: BallotName is not translated",
+			"required-languages error bmcont1: BallotTitle missing es",
+		}},
+		{`"ValidationRules": {"votes-allowed": "sometimes", "spelling": "error", "no-candidates": "off", "duplicate-candidate": "off"},`, []string{
+			"ValidationRules error ValidationRules: unknown rule spelling",
+			"ValidationRules error ValidationRules: rule votes-allowed sometimes should be error, warning or off",
+			"votes-allowed warning ccont1: vote for 3 but only 2 candidates",
+		}},
+	} {
+		var er map[string]interface{}
+		err := json.Unmarshal([]byte(strings.Replace(testRulesJSON, "%s", tc.config, 1)), &er)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, issue := range Validate(er) {
+			got = append(got, issue.Rule+" "+issue.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s: got\n%s", tc.config, strings.Join(got, "\n"))
+		}
+	}
+}
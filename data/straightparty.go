@@ -0,0 +1,298 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Straight-party voting is a PartyContest with one PartySelection per party
+// ("PartyIds": [party @id]). A mark for a party is a vote for that party's
+// candidates in every CandidateContest on the same ballot, following the
+// Election's "StraightParty" extension field:
+//
+// {"StraightParty": {"ExplicitVotes": "replace", "CrossEndorsed": "count", "ExcludedContestIds": ["ccont9"]}}
+//
+// ExplicitVotes "replace" (the default): any mark in a contest replaces the
+// straight-party vote there. "add": the party's candidates fill the votes
+// left over, if they all fit.
+//
+// CrossEndorsed "count" (the default): a candidate endorsed by the party and
+// others gets the party's vote. "skip": only candidates of that party alone do.
+//
+// Contests in ExcludedContestIds, nonpartisan races for example, never get
+// straight-party votes. Neither do ballot measures.
+//
+// A cross-endorsed candidate can be listed once per party, as a selection
+// for each with the same CandidateIds, which party-column ballots need.
+// Marks for the candidate on more than one of those lines are one vote.
+
+const (
+	PartyContestType     = "ElectionResults.PartyContest"
+	CandidateContestType = "ElectionResults.CandidateContest"
+
+	StraightPartyField = "StraightParty"
+
+	ExplicitVotesReplace = "replace"
+	ExplicitVotesAdd     = "add"
+	CrossEndorsedCount   = "count"
+	CrossEndorsedSkip    = "skip"
+)
+
+// StraightPartyRules is an Election's "StraightParty" field with defaults filled in
+type StraightPartyRules struct {
+	ExplicitVotes      string
+	CrossEndorsed      string
+	ExcludedContestIds []string
+}
+
+func straightPartyRules(el map[string]interface{}) (rules StraightPartyRules, problems []string) {
+	rules = StraightPartyRules{ExplicitVotes: ExplicitVotesReplace, CrossEndorsed: CrossEndorsedCount}
+	sp, _ := el[StraightPartyField].(map[string]interface{})
+	if v := getString(sp, "ExplicitVotes"); v == ExplicitVotesReplace || v == ExplicitVotesAdd {
+		rules.ExplicitVotes = v
+	} else if v != "" {
+		problems = append(problems, fmt.Sprintf("StraightParty ExplicitVotes %q should be %s or %s", v, ExplicitVotesReplace, ExplicitVotesAdd))
+	}
+	if v := getString(sp, "CrossEndorsed"); v == CrossEndorsedCount || v == CrossEndorsedSkip {
+		rules.CrossEndorsed = v
+	} else if v != "" {
+		problems = append(problems, fmt.Sprintf("StraightParty CrossEndorsed %q should be %s or %s", v, CrossEndorsedCount, CrossEndorsedSkip))
+	}
+	rules.ExcludedContestIds = getStringList(sp, "ExcludedContestIds")
+	return
+}
+
+// partyIndex finds selections' parties
+type partyIndex struct {
+	obs map[string]map[string]interface{} // by @id
+}
+
+func newPartyIndex(er map[string]interface{}) partyIndex {
+	pi := partyIndex{obs: make(map[string]map[string]interface{})}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if id := getString(x, "@id"); id != "" {
+				pi.obs[id] = x
+			}
+			for _, sub := range x {
+				walk(sub)
+			}
+		case []interface{}:
+			for _, sub := range x {
+				walk(sub)
+			}
+		}
+	}
+	walk(er)
+	return pi
+}
+
+// parties of a selection: a PartySelection's PartyIds, a
+// CandidateSelection's EndorsementPartyIds, or failing that its
+// candidates' own parties
+func (pi partyIndex) parties(sel map[string]interface{}) []string {
+	if pids := getStringList(sel, "PartyIds"); len(pids) != 0 {
+		return pids
+	}
+	if pids := getStringList(sel, "EndorsementPartyIds"); len(pids) != 0 {
+		return pids
+	}
+	var out []string
+	for _, cid := range getStringList(sel, "CandidateIds") {
+		cand := pi.obs[cid]
+		pid := getString(cand, "PartyId")
+		if pid == "" {
+			pid = getString(pi.obs[getString(cand, "PersonId")], "PartyId")
+		}
+		if pid != "" {
+			out = append(out, pid)
+		}
+	}
+	return out
+}
+
+// candidateKey is the same for selections of the same candidates, "" for none
+func candidateKey(sel map[string]interface{}) string {
+	cids := getStringList(sel, "CandidateIds")
+	sort.Strings(cids)
+	return strings.Join(cids, " ")
+}
+
+// EffectiveMarks returns a ballot's marks (contest @id -> selection @id ->
+// marked, for the contests on its ballot style) as votes: cross-endorsed
+// candidates marked on more than one line are marked once, on the first,
+// and a straight-party mark is spread to the party's candidates. marks is
+// not changed.
+func EffectiveMarks(er map[string]interface{}, marks map[string]map[string]bool) map[string]map[string]bool {
+	out := make(map[string]map[string]bool, len(marks))
+	for cid, sels := range marks {
+		out[cid] = sels
+	}
+	// copy a contest's marks before changing them
+	changing := func(cid string) map[string]bool {
+		sels := make(map[string]bool, len(out[cid]))
+		for sid, m := range out[cid] {
+			sels[sid] = m
+		}
+		out[cid] = sels
+		return sels
+	}
+	pi := newPartyIndex(er)
+	for _, el := range getList(er, "Election") {
+		contests := getList(el, "Contest")
+		for _, co := range contests {
+			cid := getString(co, "@id")
+			if _, ok := out[cid]; !ok {
+				continue
+			}
+			seen := make(map[string]bool)
+			var sels map[string]bool
+			for _, sel := range getList(co, "ContestSelection") {
+				sid := getString(sel, "@id")
+				key := candidateKey(sel)
+				if !out[cid][sid] || key == "" {
+					continue
+				}
+				if seen[key] {
+					if sels == nil {
+						sels = changing(cid)
+					}
+					sels[sid] = false
+				}
+				seen[key] = true
+			}
+		}
+
+		rules, _ := straightPartyRules(el)
+		party := ""
+		for _, co := range contests {
+			if getString(co, "@type") != PartyContestType {
+				continue
+			}
+			var marked [][]string
+			for _, sel := range getList(co, "ContestSelection") {
+				if out[getString(co, "@id")][getString(sel, "@id")] {
+					marked = append(marked, getStringList(sel, "PartyIds"))
+				}
+			}
+			// an overvoted straight-party contest counts for nobody
+			if len(marked) == 1 && len(marked[0]) == 1 {
+				party = marked[0][0]
+			}
+			break
+		}
+		if party == "" {
+			continue
+		}
+		excluded := make(map[string]bool)
+		for _, cid := range rules.ExcludedContestIds {
+			excluded[cid] = true
+		}
+		for _, co := range contests {
+			cid := getString(co, "@id")
+			if getString(co, "@type") != CandidateContestType || excluded[cid] {
+				continue
+			}
+			cmarks, ok := out[cid]
+			if !ok {
+				// not on this ballot
+				continue
+			}
+			votesAllowed := 1
+			if va, ok := co["VotesAllowed"].(float64); ok && va >= 1 {
+				votesAllowed = int(va)
+			}
+			explicit := 0
+			have := make(map[string]bool)
+			for _, sel := range getList(co, "ContestSelection") {
+				if cmarks[getString(sel, "@id")] {
+					explicit++
+					have[candidateKey(sel)] = true
+				}
+			}
+			if explicit != 0 && rules.ExplicitVotes == ExplicitVotesReplace {
+				continue
+			}
+			var add []string
+			for _, sel := range getList(co, "ContestSelection") {
+				if wi, _ := sel["IsWriteIn"].(bool); wi {
+					continue
+				}
+				key := candidateKey(sel)
+				if key == "" || have[key] {
+					continue
+				}
+				parties := pi.parties(sel)
+				if rules.CrossEndorsed == CrossEndorsedSkip && len(parties) != 1 {
+					continue
+				}
+				for _, pid := range parties {
+					if pid == party {
+						add = append(add, getString(sel, "@id"))
+						have[key] = true
+						break
+					}
+				}
+			}
+			// more party candidates than votes left is no straight-party vote here
+			if len(add) == 0 || explicit+len(add) > votesAllowed {
+				continue
+			}
+			sels := changing(cid)
+			for _, sid := range add {
+				sels[sid] = true
+			}
+		}
+	}
+	return out
+}
+
+// CheckStraightParty finds problems with PartyContests and StraightParty rules
+func CheckStraightParty(er map[string]interface{}) (issues []DistrictIssue) {
+	parties := make(map[string]bool)
+	for _, party := range getList(er, "Party") {
+		parties[getString(party, "@id")] = true
+	}
+	for _, el := range getList(er, "Election") {
+		for _, party := range getList(el, "Party") {
+			parties[getString(party, "@id")] = true
+		}
+		rules, problems := straightPartyRules(el)
+		for _, p := range problems {
+			issues = append(issues, DistrictIssue{IssueError, StraightPartyField, p})
+		}
+		contests := make(map[string]bool)
+		partyContests := 0
+		for _, co := range getList(el, "Contest") {
+			cid := getString(co, "@id")
+			contests[cid] = true
+			if getString(co, "@type") != PartyContestType {
+				continue
+			}
+			partyContests++
+			if partyContests == 2 {
+				issues = append(issues, DistrictIssue{IssueError, cid, "more than one PartyContest, only the first is counted"})
+			}
+			for _, sel := range getList(co, "ContestSelection") {
+				pids := getStringList(sel, "PartyIds")
+				if len(pids) != 1 {
+					issues = append(issues, DistrictIssue{IssueError, getString(sel, "@id"), "PartySelection should have one party in PartyIds"})
+				}
+				for _, pid := range pids {
+					if !parties[pid] {
+						issues = append(issues, DistrictIssue{IssueError, getString(sel, "@id"), "unknown party " + pid})
+					}
+				}
+			}
+		}
+		for _, cid := range rules.ExcludedContestIds {
+			if !contests[cid] {
+				issues = append(issues, DistrictIssue{IssueWarning, StraightPartyField, "ExcludedContestIds has unknown contest " + cid})
+			}
+		}
+	}
+	return issues
+}
@@ -0,0 +1,138 @@
+package data
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Ann is cross-endorsed by both parties, on a line for each
+const testStraightPartyJSON = `{
+  "Party": [{"@id": "party1", "Name": "Red"}, {"@id": "party2", "Name": "Blue"}],
+  "Person": [{"@id": "person1", "PartyId": "party2"}],
+  "Election": [{
+    "Candidate": [
+      {"@id": "cand1", "BallotName": "Ann"},
+      {"@id": "cand2", "BallotName": "Bob", "PartyId": "party1"},
+      {"@id": "cand3", "BallotName": "Cy", "PersonId": "person1"},
+      {"@id": "cand4", "BallotName": "Di", "PartyId": "party1"},
+      {"@id": "cand5", "BallotName": "Ed", "PartyId": "party2"}
+    ],
+    "Contest": [
+      {"@id": "pcont1", "@type": "ElectionResults.PartyContest", "ContestSelection": [
+        {"@id": "psel1", "PartyIds": ["party1"]},
+        {"@id": "psel2", "PartyIds": ["party2"]}
+      ]},
+      {"@id": "ccont1", "@type": "ElectionResults.CandidateContest", "VotesAllowed": 1, "ContestSelection": [
+        {"@id": "csel1", "CandidateIds": ["cand1"], "EndorsementPartyIds": ["party1"]},
+        {"@id": "csel2", "CandidateIds": ["cand1"], "EndorsementPartyIds": ["party2"]},
+        {"@id": "csel3", "IsWriteIn": true}
+      ]},
+      {"@id": "ccont2", "@type": "ElectionResults.CandidateContest", "VotesAllowed": 2, "ContestSelection": [
+        {"@id": "csel5", "CandidateIds": ["cand2"]},
+        {"@id": "csel6", "CandidateIds": ["cand4"]},
+        {"@id": "csel7", "CandidateIds": ["cand5"], "EndorsementPartyIds": ["party1", "party2"]}
+      ]},
+      {"@id": "ccont3", "@type": "ElectionResults.CandidateContest", "ContestSelection": [
+        {"@id": "csel8", "CandidateIds": ["cand3"]},
+        {"@id": "csel9", "IsWriteIn": true}
+      ]},
+      {"@id": "bmcont1", "@type": "ElectionResults.BallotMeasureContest", "ContestSelection": [{"@id": "bmsel1", "Selection": "Yes"}]}
+    ]
+  }]
+}`
+
+func straightPartyDoc(t *testing.T, rules string) map[string]interface{} {
+	doc := testStraightPartyJSON
+	if rules != "" {
+		doc = strings.Replace(doc, `"Candidate": [`, `"StraightParty": `+rules+`, "Candidate": [`, 1)
+	}
+	var er map[string]interface{}
+	err := json.Unmarshal([]byte(doc), &er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return er
+}
+
+// marked selection ids, sorted
+func markedIds(marks map[string]map[string]bool) string {
+	var out []string
+	for _, sels := range marks {
+		for sid, m := range sels {
+			if m {
+				out = append(out, sid)
+			}
+		}
+	}
+	sort.Strings(out)
+	return strings.Join(out, " ")
+}
+
+func TestEffectiveMarks(t *testing.T) {
+	ballot := func(marked ...string) map[string]map[string]bool {
+		marks := map[string]map[string]bool{"pcont1": {}, "ccont1": {}, "ccont2": {}, "ccont3": {}, "bmcont1": {}}
+		for _, sid := range marked {
+			for cid, sels := range map[string]string{"pcont1": "psel1 psel2", "ccont1": "csel1 csel2 csel3", "ccont2": "csel5 csel6 csel7", "ccont3": "csel8 csel9", "bmcont1": "bmsel1"} {
+				if strings.Contains(sels, sid) {
+					marks[cid][sid] = true
+				}
+			}
+		}
+		return marks
+	}
+	for _, tc := range []struct {
+		rules  string
+		marked []string
+		want   string
+	}{
+		// party1 is Ann's first line; Bob, Di and cross-endorsed Ed are too many for ccont2's 2 votes
+		{"", []string{"psel1"}, "csel1 psel1"},
+		// Ann on both lines is one vote
+		{"", []string{"csel1", "csel2"}, "csel1"},
+		// party2 is Ann's second line, Ed, and Cy through his person's party
+		{"", []string{"psel2"}, "csel2 csel7 csel8 psel2"},
+		// an explicit mark replaces the straight-party vote
+		{"", []string{"psel2", "csel1"}, "csel1 csel7 csel8 psel2"},
+		// overvoted straight party counts for nobody
+		{"", []string{"psel1", "psel2"}, "psel1 psel2"},
+		{`{"CrossEndorsed": "skip"}`, []string{"psel1"}, "csel1 csel5 csel6 psel1"},
+		{`{"CrossEndorsed": "skip"}`, []string{"psel2"}, "csel2 csel8 psel2"},
+		{`{"ExplicitVotes": "add"}`, []string{"psel2", "csel5"}, "csel2 csel5 csel7 csel8 psel2"},
+		{`{"ExcludedContestIds": ["ccont2"]}`, []string{"psel2"}, "csel2 csel8 psel2"},
+	} {
+		er := straightPartyDoc(t, tc.rules)
+		marks := ballot(tc.marked...)
+		before := markedIds(marks)
+		got := markedIds(EffectiveMarks(er, marks))
+		if got != tc.want {
+			t.Errorf("%s %v: got %q, want %q", tc.rules, tc.marked, got, tc.want)
+		}
+		if markedIds(marks) != before {
+			t.Errorf("%s %v: changed the marks", tc.rules, tc.marked)
+		}
+	}
+}
+
+func TestCheckStraightParty(t *testing.T) {
+	if issues := CheckStraightParty(straightPartyDoc(t, "")); len(issues) != 0 {
+		t.Errorf("unexpected issues %v", issues)
+	}
+	er := straightPartyDoc(t, `{"ExplicitVotes": "sometimes", "ExcludedContestIds": ["ccont9"]}`)
+	el := getList(er, "Election")[0]
+	pc := getList(el, "Contest")[0]
+	getList(pc, "ContestSelection")[1]["PartyIds"] = []interface{}{"party3"}
+	var got []string
+	for _, issue := range CheckStraightParty(er) {
+		got = append(got, issue.String())
+	}
+	want := []string{
+		`error StraightParty: StraightParty ExplicitVotes "sometimes" should be replace or add`,
+		"error psel2: unknown party party3",
+		"warning StraightParty: ExcludedContestIds has unknown contest ccont9",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,482 @@
+package data
+
+// Import Voting Information Project (VIP 5) feeds.
+// https://vip-specification.readthedocs.io/
+//
+// Both the XML and the CSV (directory of .txt files) forms are read into the
+// same vipFeed, keyed by XML element names, and converted to a NIST
+// 1500-100 ElectionReport from there.
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// one VIP element; field name -> text
+type vipRecord map[string]string
+
+// element name (e.g. "CandidateContest") -> records
+type vipFeed map[string][]vipRecord
+
+func (vr vipRecord) ids(field string) []string {
+	return strings.Fields(vr[field])
+}
+
+func (feed vipFeed) byId(elem string) map[string]vipRecord {
+	out := make(map[string]vipRecord, len(feed[elem]))
+	for _, vr := range feed[elem] {
+		out[vr["Id"]] = vr
+	}
+	return out
+}
+
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+// text of a VIP field. InternationalizedText fields hold one <Text> per language, prefer English.
+func (xn *xmlNode) text() string {
+	var out string
+	found := false
+	for _, sub := range xn.Nodes {
+		if sub.XMLName.Local != "Text" {
+			continue
+		}
+		lang := ""
+		for _, a := range sub.Attrs {
+			if a.Name.Local == "language" {
+				lang = a.Value
+			}
+		}
+		if !found || lang == "en" {
+			out = sub.Content
+			found = true
+		}
+	}
+	if found {
+		return strings.TrimSpace(out)
+	}
+	return strings.TrimSpace(xn.Content)
+}
+
+// ImportVIPXML reads a VIP 5 XML feed and returns an ElectionReport
+func ImportVIPXML(r io.Reader) (map[string]interface{}, error) {
+	feed, err := readVIPXML(r)
+	if err != nil {
+		return nil, err
+	}
+	return feed.electionReport()
+}
+
+// ImportVIPXMLDistricts reads just the states, localities, districts and precincts of a VIP 5 XML feed, as GpUnits
+func ImportVIPXMLDistricts(r io.Reader) ([]interface{}, error) {
+	feed, err := readVIPXML(r)
+	if err != nil {
+		return nil, err
+	}
+	return feed.gpUnits(), nil
+}
+
+func readVIPXML(r io.Reader) (vipFeed, error) {
+	var root xmlNode
+	err := xml.NewDecoder(r).Decode(&root)
+	if err != nil {
+		return nil, fmt.Errorf("vip xml, %v", err)
+	}
+	if root.XMLName.Local != "VipObject" {
+		return nil, fmt.Errorf("vip xml, root element is %s, not VipObject", root.XMLName.Local)
+	}
+	feed := make(vipFeed)
+	for _, elem := range root.Nodes {
+		vr := make(vipRecord)
+		for _, a := range elem.Attrs {
+			if a.Name.Local == "id" {
+				vr["Id"] = a.Value
+			}
+		}
+		for _, field := range elem.Nodes {
+			vr[field.XMLName.Local] = field.text()
+		}
+		feed[elem.XMLName.Local] = append(feed[elem.XMLName.Local], vr)
+	}
+	return feed, nil
+}
+
+// VIP CSV file name -> XML element name
+var vipCSVFiles = map[string]string{
+	"ballot_measure_contest.txt":   "BallotMeasureContest",
+	"ballot_measure_selection.txt": "BallotMeasureSelection",
+	"candidate.txt":                "Candidate",
+	"candidate_contest.txt":        "CandidateContest",
+	"candidate_selection.txt":      "CandidateSelection",
+	"election.txt":                 "Election",
+	"electoral_district.txt":       "ElectoralDistrict",
+	"locality.txt":                 "Locality",
+	"office.txt":                   "Office",
+	"party.txt":                    "Party",
+	"person.txt":                   "Person",
+	"precinct.txt":                 "Precinct",
+	"state.txt":                    "State",
+}
+
+// ImportVIPCSV reads a directory of VIP 5 CSV files and returns an ElectionReport.
+// Files not used for ballots are ignored.
+func ImportVIPCSV(dir string) (map[string]interface{}, error) {
+	feed, err := readVIPCSVDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return feed.electionReport()
+}
+
+// ImportVIPCSVDistricts reads just the states, localities, districts and precincts of a directory of VIP 5 CSV files, as GpUnits
+func ImportVIPCSVDistricts(dir string) ([]interface{}, error) {
+	feed, err := readVIPCSVDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return feed.gpUnits(), nil
+}
+
+func readVIPCSVDir(dir string) (vipFeed, error) {
+	feed := make(vipFeed)
+	for fname, elem := range vipCSVFiles {
+		fin, err := os.Open(filepath.Join(dir, fname))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records, err := readVIPCSV(fin)
+		fin.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fname, err)
+		}
+		feed[elem] = records
+	}
+	return feed, nil
+}
+
+func readVIPCSV(r io.Reader) (out []vipRecord, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, len(header))
+	for i, h := range header {
+		fields[i] = vipCSVFieldName(strings.TrimPrefix(h, "\ufeff"))
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		vr := make(vipRecord, len(row))
+		for i, v := range row {
+			if i < len(fields) {
+				vr[fields[i]] = strings.TrimSpace(v)
+			}
+		}
+		out = append(out, vr)
+	}
+	return out, nil
+}
+
+// ballot_selection_ids -> BallotSelectionIds
+func vipCSVFieldName(h string) string {
+	parts := strings.Split(strings.TrimSpace(h), "_")
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		parts[i] = strings.ToUpper(p[:1]) + p[1:]
+	}
+	return strings.Join(parts, "")
+}
+
+func setIf(ob map[string]interface{}, key, value string) {
+	if value != "" {
+		ob[key] = value
+	}
+}
+
+func setIntIf(ob map[string]interface{}, key, value string) {
+	if value == "" {
+		return
+	}
+	v, err := strconv.Atoi(value)
+	if err == nil {
+		ob[key] = v
+	}
+}
+
+func stringList(they []string) []interface{} {
+	out := make([]interface{}, len(they))
+	for i, x := range they {
+		out[i] = x
+	}
+	return out
+}
+
+// VIP ReportingUnit-ish types that NIST 1500-100 also has
+var nistReportingUnitTypes = map[string]bool{
+	"ballot-batch": true, "ballot-style-area": true, "borough": true, "city": true,
+	"city-council": true, "combined-precinct": true, "congressional": true, "country": true,
+	"county": true, "county-council": true, "drop-box": true, "judicial": true,
+	"municipality": true, "polling-place": true, "precinct": true, "school": true,
+	"special": true, "split-precinct": true, "state": true, "state-house": true,
+	"state-senate": true, "town": true, "township": true, "utility": true, "village": true,
+	"vote-center": true, "ward": true, "water": true,
+}
+
+func reportingUnitType(vipType string) string {
+	t := strings.ToLower(strings.ReplaceAll(vipType, "_", "-"))
+	if nistReportingUnitTypes[t] {
+		return t
+	}
+	return "other"
+}
+
+// gpUnits are the feed's states, localities, districts and precincts as ReportingUnits.
+// Districts are composed of the precincts that list them.
+func (feed vipFeed) gpUnits() []interface{} {
+	var gpunits []interface{}
+	for _, vs := range feed["State"] {
+		gpunits = append(gpunits, map[string]interface{}{
+			"@id":   vs["Id"],
+			"@type": "ElectionResults.ReportingUnit",
+			"Type":  "state",
+			"Name":  vs["Name"],
+		})
+	}
+	for _, vl := range feed["Locality"] {
+		gpunits = append(gpunits, map[string]interface{}{
+			"@id":   vl["Id"],
+			"@type": "ElectionResults.ReportingUnit",
+			"Type":  reportingUnitType(vl["Type"]),
+			"Name":  vl["Name"],
+		})
+	}
+
+	districtPrecincts := make(map[string][]string)
+	for _, vp := range feed["Precinct"] {
+		for _, did := range vp.ids("ElectoralDistrictIds") {
+			districtPrecincts[did] = append(districtPrecincts[did], vp["Id"])
+		}
+	}
+	for _, vd := range feed["ElectoralDistrict"] {
+		ru := map[string]interface{}{
+			"@id":   vd["Id"],
+			"@type": "ElectionResults.ReportingUnit",
+			"Type":  reportingUnitType(vd["Type"]),
+			"Name":  vd["Name"],
+		}
+		if precincts := districtPrecincts[vd["Id"]]; len(precincts) != 0 {
+			ru["ComposingGpUnitIds"] = stringList(precincts)
+		}
+		gpunits = append(gpunits, ru)
+	}
+	for _, vp := range feed["Precinct"] {
+		gpunits = append(gpunits, map[string]interface{}{
+			"@id":   vp["Id"],
+			"@type": "ElectionResults.ReportingUnit",
+			"Type":  "precinct",
+			"Name":  vp["Name"],
+		})
+	}
+	return gpunits
+}
+
+func (feed vipFeed) electionReport() (map[string]interface{}, error) {
+	if len(feed["Election"]) == 0 {
+		return nil, fmt.Errorf("vip feed has no Election")
+	}
+	if len(feed["Election"]) > 1 {
+		debug("vip feed has %d Election records, using the first\n", len(feed["Election"]))
+	}
+	velection := feed["Election"][0]
+
+	gpunits := feed.gpUnits()
+
+	var parties []interface{}
+	for _, vp := range feed["Party"] {
+		party := map[string]interface{}{
+			"@id":   vp["Id"],
+			"@type": "ElectionResults.Party",
+			"Name":  vp["Name"],
+		}
+		setIf(party, "Abbreviation", vp["Abbreviation"])
+		parties = append(parties, party)
+	}
+
+	var persons []interface{}
+	for _, vp := range feed["Person"] {
+		person := map[string]interface{}{
+			"@id":   vp["Id"],
+			"@type": "ElectionResults.Person",
+		}
+		fullname := vp["FullName"]
+		if fullname == "" {
+			var parts []string
+			for _, k := range []string{"Prefix", "FirstName", "MiddleName", "LastName", "Suffix"} {
+				if vp[k] != "" {
+					parts = append(parts, vp[k])
+				}
+			}
+			fullname = strings.Join(parts, " ")
+		}
+		setIf(person, "FullName", fullname)
+		setIf(person, "FirstName", vp["FirstName"])
+		setIf(person, "LastName", vp["LastName"])
+		setIf(person, "PartyId", vp["PartyId"])
+		setIf(person, "Profession", vp["Profession"])
+		persons = append(persons, person)
+	}
+
+	var candidates []interface{}
+	for _, vc := range feed["Candidate"] {
+		cand := map[string]interface{}{
+			"@id":        vc["Id"],
+			"@type":      "ElectionResults.Candidate",
+			"BallotName": vc["BallotName"],
+		}
+		setIf(cand, "PartyId", vc["PartyId"])
+		setIf(cand, "PersonId", vc["PersonId"])
+		candidates = append(candidates, cand)
+	}
+
+	var offices []interface{}
+	for _, vo := range feed["Office"] {
+		offices = append(offices, map[string]interface{}{
+			"@id":   vo["Id"],
+			"@type": "ElectionResults.Office",
+			"Name":  vo["Name"],
+		})
+	}
+
+	// contests
+	candSels := feed.byId("CandidateSelection")
+	bmSels := feed.byId("BallotMeasureSelection")
+	var contests []interface{}
+	for _, vc := range feed["CandidateContest"] {
+		contest := map[string]interface{}{
+			"@id":                vc["Id"],
+			"@type":              "ElectionResults.CandidateContest",
+			"Name":               vc["Name"],
+			"ElectionDistrictId": vc["ElectoralDistrictId"],
+			"VoteVariation":      "plurality",
+			"VotesAllowed":       1,
+		}
+		if vc["VoteVariation"] != "" {
+			contest["VoteVariation"] = strings.ToLower(vc["VoteVariation"])
+		}
+		setIntIf(contest, "VotesAllowed", vc["VotesAllowed"])
+		setIntIf(contest, "NumberElected", vc["NumberElected"])
+		setIntIf(contest, "SequenceOrder", vc["SequenceOrder"])
+		setIf(contest, "BallotTitle", vc["BallotTitle"])
+		setIf(contest, "BallotSubTitle", vc["BallotSubTitle"])
+		if oids := vc.ids("OfficeIds"); len(oids) != 0 {
+			contest["OfficeIds"] = stringList(oids)
+		}
+		var sels []interface{}
+		for _, sid := range vc.ids("BallotSelectionIds") {
+			vs, ok := candSels[sid]
+			if !ok {
+				return nil, fmt.Errorf("CandidateContest %s: unknown CandidateSelection %s", vc["Id"], sid)
+			}
+			sel := map[string]interface{}{
+				"@id":          sid,
+				"@type":        "ElectionResults.CandidateSelection",
+				"CandidateIds": stringList(vs.ids("CandidateIds")),
+			}
+			setIntIf(sel, "SequenceOrder", vs["SequenceOrder"])
+			if strings.ToLower(vs["IsWriteIn"]) == "true" {
+				sel["IsWriteIn"] = true
+			}
+			sels = append(sels, sel)
+		}
+		contest["ContestSelection"] = sels
+		contests = append(contests, contest)
+	}
+	for _, vc := range feed["BallotMeasureContest"] {
+		contest := map[string]interface{}{
+			"@id":                vc["Id"],
+			"@type":              "ElectionResults.BallotMeasureContest",
+			"Name":               vc["Name"],
+			"ElectionDistrictId": vc["ElectoralDistrictId"],
+		}
+		for _, k := range []string{"BallotTitle", "BallotSubTitle", "ConStatement", "ProStatement", "FullText", "SummaryText", "InfoUri", "EffectOfAbstain"} {
+			setIf(contest, k, vc[k])
+		}
+		setIntIf(contest, "SequenceOrder", vc["SequenceOrder"])
+		if vc["Type"] != "" {
+			contest["Type"] = strings.ToLower(vc["Type"])
+		}
+		var sels []interface{}
+		for _, sid := range vc.ids("BallotSelectionIds") {
+			vs, ok := bmSels[sid]
+			if !ok {
+				return nil, fmt.Errorf("BallotMeasureContest %s: unknown BallotMeasureSelection %s", vc["Id"], sid)
+			}
+			sel := map[string]interface{}{
+				"@id":       sid,
+				"@type":     "ElectionResults.BallotMeasureSelection",
+				"Selection": vs["Selection"],
+			}
+			setIntIf(sel, "SequenceOrder", vs["SequenceOrder"])
+			sels = append(sels, sel)
+		}
+		contest["ContestSelection"] = sels
+		contests = append(contests, contest)
+	}
+
+	election := map[string]interface{}{
+		"@type":           "ElectionResults.Election",
+		"Name":            velection["Name"],
+		"Type":            "general",
+		"ElectionScopeId": velection["StateId"],
+		"StartDate":       velection["Date"],
+		"EndDate":         velection["Date"],
+		"Candidate":       candidates,
+		"Contest":         contests,
+	}
+	if velection["ElectionType"] != "" {
+		election["Type"] = strings.ToLower(velection["ElectionType"])
+	}
+
+	er := map[string]interface{}{
+		"@type":               "ElectionReport",
+		"Format":              "summary-contest",
+		"GeneratedDate":       time.Now().Format("2006-01-02 15:04:05 -0700"),
+		"Issuer":              "VIP import",
+		"IssuerAbbreviation":  "VIP",
+		"SequenceStart":       1,
+		"SequenceEnd":         1,
+		"Status":              "pre-election",
+		"VendorApplicationId": "ballotstudio VIP import",
+		"Election":            []interface{}{election},
+		"GpUnit":              gpunits,
+		"Office":              offices,
+		"Party":               parties,
+		"Person":              persons,
+	}
+	// one BallotStyle per distinct set of contests a precinct votes on
+	GenerateBallotStyles(er)
+	return Fixup(er), nil
+}
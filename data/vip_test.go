@@ -0,0 +1,97 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testVIPXML = `<?xml version="1.0" encoding="UTF-8"?>
+<VipObject xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" schemaVersion="5.1">
+  <Election id="e1"><Name><Text language="es">Elección</Text><Text language="en">General Election</Text></Name><Date>2022-11-08</Date><ElectionType><Text language="en">General</Text></ElectionType><StateId>st1</StateId></Election>
+  <State id="st1"><Name>Oregon</Name></State>
+  <ElectoralDistrict id="ed1"><Name>Springfield</Name><Type>city</Type></ElectoralDistrict>
+  <ElectoralDistrict id="ed2"><Name>Ward 2</Name><Type>ward</Type></ElectoralDistrict>
+  <Precinct id="pr1"><Name>P1</Name><ElectoralDistrictIds>ed1</ElectoralDistrictIds></Precinct>
+  <Precinct id="pr2"><Name>P2</Name><ElectoralDistrictIds>ed1 ed2</ElectoralDistrictIds></Precinct>
+  <Party id="pa1"><Name><Text language="en">Woot</Text></Name></Party>
+  <Person id="pe1"><FirstName>Alice</FirstName><LastName>Argyle</LastName></Person>
+  <Candidate id="ca1"><BallotName><Text language="en">Alice Argyle</Text></BallotName><PartyId>pa1</PartyId><PersonId>pe1</PersonId></Candidate>
+  <Candidate id="ca2"><BallotName><Text language="en">Bob Brocade</Text></BallotName></Candidate>
+  <Office id="of1"><Name><Text language="en">Mayor</Text></Name></Office>
+  <CandidateContest id="cc1"><Name>Mayor</Name><BallotTitle><Text language="en">Mayor</Text></BallotTitle><ElectoralDistrictId>ed1</ElectoralDistrictId><VotesAllowed>1</VotesAllowed><OfficeIds>of1</OfficeIds><BallotSelectionIds>cs1 cs2</BallotSelectionIds></CandidateContest>
+  <CandidateSelection id="cs1"><CandidateIds>ca1</CandidateIds></CandidateSelection>
+  <CandidateSelection id="cs2"><CandidateIds>ca2</CandidateIds></CandidateSelection>
+  <BallotMeasureContest id="bm1"><Name>Measure 2</Name><ElectoralDistrictId>ed2</ElectoralDistrictId><FullText><Text language="en">Shall we?</Text></FullText><BallotSelectionIds>bs1 bs2</BallotSelectionIds><Type>referendum</Type></BallotMeasureContest>
+  <BallotMeasureSelection id="bs1"><Selection><Text language="en">Yes</Text></Selection><SequenceOrder>1</SequenceOrder></BallotMeasureSelection>
+  <BallotMeasureSelection id="bs2"><Selection><Text language="en">No</Text></Selection><SequenceOrder>2</SequenceOrder></BallotMeasureSelection>
+</VipObject>
+`
+
+func checkVIPElection(t *testing.T, er map[string]interface{}) {
+	election := er["Election"].([]interface{})[0].(map[string]interface{})
+	if election["Name"] != "General Election" || election["Type"] != "general" || election["StartDate"] != "2022-11-08" {
+		t.Errorf("bad election %#v", election)
+	}
+	contests := election["Contest"].([]interface{})
+	if len(contests) != 2 {
+		t.Fatalf("wanted 2 contests, got %d", len(contests))
+	}
+	cc := contests[0].(map[string]interface{})
+	if cc["@type"] != "ElectionResults.CandidateContest" || len(cc["ContestSelection"].([]interface{})) != 2 {
+		t.Errorf("bad candidate contest %#v", cc)
+	}
+	// pr1 votes on cc1, pr2 votes on cc1 and bm1
+	styles := election["BallotStyle"].([]interface{})
+	if len(styles) != 2 {
+		t.Errorf("wanted 2 ballot styles, got %d", len(styles))
+	}
+	persons := er["Person"].([]interface{})
+	if persons[0].(map[string]interface{})["FullName"] != "Alice Argyle" {
+		t.Errorf("bad person %#v", persons[0])
+	}
+}
+
+func TestImportVIPXML(t *testing.T) {
+	er, err := ImportVIPXML(strings.NewReader(testVIPXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVIPElection(t, er)
+}
+
+var testVIPCSV = map[string]string{
+	"election.txt":                 "id,date,name,election_type,state_id\ne1,2022-11-08,General Election,General,st1\n",
+	"state.txt":                    "id,name\nst1,Oregon\n",
+	"electoral_district.txt":       "id,name,type\ned1,Springfield,city\ned2,Ward 2,ward\n",
+	"precinct.txt":                 "id,name,electoral_district_ids\npr1,P1,ed1\npr2,P2,ed1 ed2\n",
+	"party.txt":                    "id,name\npa1,Woot\n",
+	"person.txt":                   "id,first_name,last_name\npe1,Alice,Argyle\n",
+	"candidate.txt":                "id,ballot_name,party_id,person_id\nca1,Alice Argyle,pa1,pe1\nca2,Bob Brocade,,\n",
+	"office.txt":                   "id,name\nof1,Mayor\n",
+	"candidate_contest.txt":        "id,name,ballot_title,electoral_district_id,votes_allowed,office_ids,ballot_selection_ids\ncc1,Mayor,Mayor,ed1,1,of1,cs1 cs2\n",
+	"candidate_selection.txt":      "id,candidate_ids\ncs1,ca1\ncs2,ca2\n",
+	"ballot_measure_contest.txt":   "id,name,electoral_district_id,full_text,ballot_selection_ids,type\nbm1,Measure 2,ed2,Shall we?,bs1 bs2,referendum\n",
+	"ballot_measure_selection.txt": "id,selection,sequence_order\nbs1,Yes,1\nbs2,No,2\n",
+}
+
+func TestImportVIPCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vipcsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for fname, text := range testVIPCSV {
+		err = ioutil.WriteFile(filepath.Join(dir, fname), []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	er, err := ImportVIPCSV(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVIPElection(t, er)
+}
@@ -7,6 +7,7 @@ import logging
 import os
 import sqlite3
 import subprocess
+import threading
 import time
 
 from flask import Flask, render_template, request, g, url_for
@@ -183,6 +184,31 @@ def edit(electionid):
     }
     return render_template('index.html', **ctx)
 
+# what /draw can do, the Go server checks documents against this before sending them
+CAPABILITIES = ['pamphlet', 'images', 'unicode', 'bubble-geometry', 'render-options', 'watermark', 'high-contrast', 'fonts']
+
+@app.route('/capabilities')
+def capabilities():
+    return {'features': CAPABILITIES}, 200
+
+# draw.gs is swapped for requests with render options, one draw at a time
+_drawLock = threading.Lock()
+
+def _renderSettings(args):
+    "draw.Settings for pagesize, duplex, columns, minfont, highcontrast and proof query args"
+    pagesize = args.get('pagesize', '').lower()
+    if pagesize and pagesize not in draw.PAGE_SIZES:
+        raise ValueError('bad pagesize {!r}'.format(pagesize))
+    columns = int(args.get('columns') or 0)
+    if columns < 0 or columns > 6:
+        raise ValueError('bad columns {!r}'.format(columns))
+    minfont = float(args.get('minfont') or 0)
+    truth = ('1', 't', 'T', 'true', 'TRUE', 'True')
+    duplex = args.get('duplex', '') in truth
+    proof = args.get('proof', '') in truth
+    highcontrast = args.get('highcontrast', '') in truth
+    return draw.gs.withOptions(pagesize=pagesize, duplex=duplex, columns=columns, minfont=minfont, proof=proof, highcontrast=highcontrast)
+
 @app.route('/draw', methods=['POST'])
 def drawHandler():
     if request.content_type != 'application/json':
@@ -190,15 +216,38 @@ def drawHandler():
     er = request.get_json()
     elections = er.get('Election', [])
     el = elections[0]
+    if request.args.get('mode') == 'pamphlet':
+        pdfbytes = io.BytesIO()
+        with _drawLock:
+            defaults = draw.gs
+            draw.gs = defaults.withFonts(el)
+            try:
+                draw.PamphletPrinter(er, el).drawToFile(pdfbytes)
+            finally:
+                draw.gs = defaults
+        return pdfbytes.getvalue(), 200, {"Content-Type":"application/pdf"}
+    try:
+        settings = _renderSettings(request.args)
+    except ValueError as e:
+        return str(e), 400
+    with _drawLock:
+        settings = settings.withFonts(el)
     ep = ElectionPrinter(er, el)
     pdfbytes = io.BytesIO()
-    ep.drawToFile(outfile=pdfbytes)
+    with _drawLock:
+        defaults = draw.gs
+        draw.gs = settings
+        try:
+            ep.drawToFile(outfile=pdfbytes)
+            bubbles = ep.getBubbles()
+        finally:
+            draw.gs = defaults
     pdfbytes = pdfbytes.getvalue()
     if len(pdfbytes) == 0:
         app.logger.warning('zero byte pdf /draw')
     bothob = {
         'pdfb64': base64.b64encode(pdfbytes).decode(),
-        'bubbles': ep.getBubbles(),
+        'bubbles': bubbles,
     }
     if request.args.get('both'):
         return bothob, 200
@@ -207,7 +256,7 @@ def drawHandler():
         if not itemid:
             itemid = '{:08x}'.format(int(time.time()-1588036000))
         mc().set(itemid, bothob, time=3600)
-        return {'bubbles':ep.getBubbles(),'item':itemid}, 200
+        return {'bubbles':bubbles,'item':itemid}, 200
     # otherwise just pdf
     return pdfbytes, 200, {"Content-Type":"application/pdf"}
 
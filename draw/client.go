@@ -0,0 +1,305 @@
+package draw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable is returned without calling the backend while the circuit breaker is open
+var ErrUnavailable = errors.New("draw backend unavailable")
+
+// Client calls a draw backend with its own connection pool, a limit on
+// requests in flight, retries with backoff when the backend looks briefly
+// unreachable, and a circuit breaker that stops calling it for a while
+// after repeated failures.
+// The zero value (plus BackendUrl) works, on http.DefaultClient with no limits and no retries.
+// With no BackendUrl it draws in process with RenderElection.
+// Documents are checked against the backend's Features before drawing.
+type Client struct {
+	BackendUrl string
+
+	// Timeout is for one attempt, 0 for none
+	Timeout time.Duration
+
+	// MaxConcurrent requests in flight to the backend, 0 for unlimited
+	MaxConcurrent int
+
+	// Retries after a transient failure (connection refused, 502, 503, 504),
+	// waiting Backoff, then twice that, and so on
+	Retries int
+	Backoff time.Duration
+
+	// BreakerFailures consecutive transient failures open the breaker for
+	// BreakerCooldown, 0 for no breaker
+	BreakerFailures int
+	BreakerCooldown time.Duration
+
+	// Strict refuses to draw without a Degradable feature the document needs
+	Strict bool
+
+	// Spool is a directory the backend's PDFs are written into as they
+	// arrive, instead of being held in memory; "" for memory. See DrawBothOb.Hold.
+	Spool string
+
+	initOnce sync.Once
+	client   *http.Client
+	sem      chan struct{}
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+
+	features      map[string]bool
+	featuresUntil time.Time
+}
+
+// NewClient has the defaults ballotstudio uses, and its own connection pool
+func NewClient(backendUrl string) *Client {
+	const maxConcurrent = 4
+	return &Client{
+		BackendUrl:      backendUrl,
+		Timeout:         60 * time.Second,
+		MaxConcurrent:   maxConcurrent,
+		Retries:         2,
+		Backoff:         250 * time.Millisecond,
+		BreakerFailures: 5,
+		BreakerCooldown: 30 * time.Second,
+
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				MaxIdleConnsPerHost: maxConcurrent,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+}
+
+func (c *Client) init() {
+	c.initOnce.Do(func() {
+		if c.client == nil {
+			c.client = http.DefaultClient
+		}
+		if c.MaxConcurrent > 0 {
+			c.sem = make(chan struct{}, c.MaxConcurrent)
+		}
+	})
+}
+
+// Open is true while the circuit breaker is refusing calls
+func (c *Client) Open() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Now().Before(c.openUntil)
+}
+
+func (c *Client) result(transientFailure bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !transientFailure {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.BreakerFailures > 0 && c.failures >= c.BreakerFailures {
+		c.openUntil = time.Now().Add(c.BreakerCooldown)
+		c.failures = 0
+	}
+}
+
+// transientError is a failure where the backend might be fine again soon,
+// as opposed to it failing on this particular document
+type transientError struct {
+	err error
+}
+
+func (te *transientError) Error() string {
+	return te.err.Error()
+}
+
+func (te *transientError) Unwrap() error {
+	return te.err
+}
+
+// IsUnavailable is true for errors from the backend being down or unreachable,
+// rather than from the document it was asked to draw
+func IsUnavailable(err error) bool {
+	var te *transientError
+	return errors.Is(err, ErrUnavailable) || errors.As(err, &te)
+}
+
+// POST election json to the draw backend, passing the 200 response body to
+// read. read is called again for each retry, so it should start over.
+func (c *Client) post(ctx context.Context, query string, electionjson string, read func(io.Reader) error) (err error) {
+	c.init()
+	baseurl, err := url.Parse(c.BackendUrl)
+	if err != nil {
+		return fmt.Errorf("bad url, %v", err)
+	}
+	nurl := *baseurl
+	nurl.Path = path.Join(baseurl.Path, "/draw")
+	nurl.RawQuery = query
+	drawurl := nurl.String()
+
+	if c.Open() {
+		return ErrUnavailable
+	}
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err = c.postOnce(ctx, drawurl, electionjson, read)
+		var te *transientError
+		transient := errors.As(err, &te)
+		if ctx.Err() == nil {
+			// a caller giving up says nothing about the backend
+			c.result(transient)
+		}
+		if !transient || attempt >= c.Retries || c.Open() {
+			return
+		}
+		debug("draw retry %d after %v\n", attempt+1, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) postOnce(ctx context.Context, drawurl string, electionjson string, read func(io.Reader) error) (err error) {
+	if c.Timeout > 0 {
+		var cf context.CancelFunc
+		ctx, cf = context.WithTimeout(ctx, c.Timeout)
+		defer cf()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", drawurl, strings.NewReader(electionjson))
+	if err != nil {
+		return fmt.Errorf("draw POST, %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &transientError{fmt.Errorf("draw POST, %v", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if len(body) > 50 {
+			body = body[:50]
+		}
+		err = fmt.Errorf("draw POST %d %#v", resp.StatusCode, string(body))
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			err = &transientError{err}
+		}
+		return err
+	}
+	body := &bodyReader{r: resp.Body}
+	err = read(body)
+	if body.err != nil {
+		// the connection failed, not the response
+		return &transientError{fmt.Errorf("draw POST read, %v", body.err)}
+	}
+	return err
+}
+
+// bodyReader keeps the error reading a response body, if there was one,
+// apart from what's made of the body
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (n int, err error) {
+	n, err = br.r.Read(p)
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return
+}
+
+// DrawPamphlet renders the voter pamphlet companion PDF for an election.
+// There's nowhere to put warnings, so pamphlets never degrade.
+func (c *Client) DrawPamphlet(ctx context.Context, electionjson string) (pdf []byte, err error) {
+	if c.BackendUrl == "" {
+		return nil, ErrNoPamphlet
+	}
+	_, err = c.check(ctx, electionjson, true, FeaturePamphlet)
+	if err != nil {
+		return nil, err
+	}
+	err = c.post(ctx, "mode=pamphlet", electionjson, func(body io.Reader) (err error) {
+		pdf, err = ioutil.ReadAll(body)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pdf, nil
+}
+
+// DrawElection draws the ballots, PDF and bubbles json.
+// opts override the document's own RenderOptions; the zero value is none.
+// With opts.Profile, that profile's options go between the two and only the
+// ballot styles offered in it are drawn.
+// The caller holds the result, and Releases it when done with a spooled PDF.
+func (c *Client) DrawElection(ctx context.Context, electionjson string, opts RenderOptions) (both *DrawBothOb, err error) {
+	docOpts, err := DocRenderOptions(electionjson)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Profile != "" {
+		var profileOpts RenderOptions
+		electionjson, profileOpts, err = profileDoc(electionjson, opts.Profile)
+		if err != nil {
+			return nil, err
+		}
+		docOpts = docOpts.Override(profileOpts)
+	}
+	opts = docOpts.Override(opts)
+	warnings, err := c.check(ctx, electionjson, c.Strict, opts.features()...)
+	if err != nil {
+		return nil, err
+	}
+	if c.BackendUrl == "" {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		both, err = RenderElection(electionjson, opts)
+	} else {
+		query := opts.Query()
+		query.Set("both", "1")
+		err = c.post(ctx, query.Encode(), electionjson, func(body io.Reader) (err error) {
+			if c.Spool != "" {
+				both, err = spoolDrawBoth(c.Spool, body)
+			} else {
+				both, err = parseDrawBoth(body)
+			}
+			return
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	both.Warnings = warnings
+	return both, nil
+}
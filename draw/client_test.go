@@ -0,0 +1,145 @@
+package draw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testClient(url string) *Client {
+	return &Client{
+		BackendUrl:      url,
+		Retries:         2,
+		Backoff:         time.Millisecond,
+		BreakerFailures: 3,
+		BreakerCooldown: time.Minute,
+	}
+}
+
+// drawOnly is a backend from before /capabilities, h only sees draw requests
+func drawOnly(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/capabilities" {
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r)
+	})
+}
+
+func TestClientRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(drawOnly(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("%PDF"))
+	}))
+	defer server.Close()
+	c := testClient(server.URL)
+	pdf, err := c.DrawPamphlet(context.Background(), "{}")
+	if err != nil || string(pdf) != "%PDF" {
+		t.Fatalf("got %#v %v", string(pdf), err)
+	}
+	if calls != 3 {
+		t.Errorf("%d calls, wanted 3", calls)
+	}
+}
+
+func TestClientNoRetryOnDocumentError(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(drawOnly(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	c := testClient(server.URL)
+	_, err := c.DrawPamphlet(context.Background(), "{}")
+	if err == nil || IsUnavailable(err) {
+		t.Errorf("got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("%d calls, wanted 1", calls)
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(drawOnly(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	c := testClient(server.URL)
+	_, err := c.DrawPamphlet(context.Background(), "{}")
+	if !IsUnavailable(err) {
+		t.Errorf("got %v", err)
+	}
+	if !c.Open() {
+		t.Fatalf("breaker not open after %d failures", calls)
+	}
+	before := calls
+	_, err = c.DrawPamphlet(context.Background(), "{}")
+	if err != ErrUnavailable || calls != before {
+		t.Errorf("open breaker called backend, %v, %d calls", err, calls-before)
+	}
+}
+
+func TestClientFeatures(t *testing.T) {
+	var draws int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/capabilities" {
+			w.Write([]byte(`{"features": ["bubble-geometry"]}`))
+			return
+		}
+		atomic.AddInt32(&draws, 1)
+		w.Write([]byte(`{"pdfb64": "JVBERg==", "bubbles": {}}`))
+	}))
+	defer server.Close()
+	c := testClient(server.URL)
+	photo := `{"Election": [{"Candidate": [{"@id": "c1", "PhotoUri": [{"Content": "data:image/png;base64,AAAA"}]}]}]}`
+	both, err := c.DrawElection(context.Background(), photo, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(both.Warnings) != 1 || both.Warnings[0] != Degradable[FeatureImages] {
+		t.Errorf("warnings %v", both.Warnings)
+	}
+
+	c.Strict = true
+	_, err = c.DrawElection(context.Background(), photo, RenderOptions{})
+	if ue, ok := err.(*UnsupportedError); !ok || len(ue.Missing) != 1 || ue.Missing[0] != FeatureImages {
+		t.Errorf("strict got %v", err)
+	}
+	c.Strict = false
+	_, err = c.DrawElection(context.Background(), `{"Election": [{"Name": "亀"}]}`, RenderOptions{})
+	if _, ok := err.(*UnsupportedError); !ok {
+		t.Errorf("unicode got %v", err)
+	}
+	_, err = c.DrawPamphlet(context.Background(), "{}")
+	if _, ok := err.(*UnsupportedError); !ok {
+		t.Errorf("pamphlet got %v", err)
+	}
+	if draws != 1 {
+		t.Errorf("%d draws, unsupported documents shouldn't be sent", draws)
+	}
+}
+
+func TestNeededFeatures(t *testing.T) {
+	got := NeededFeatures(`{"Party": [{"LogoUri": ""}], "Election": [{"Name": "Élection", "Contest": [{"BubbleGeometry": {"Width": 20}}]}]}`)
+	if len(got) != 1 || got[0] != FeatureBubbleGeometry {
+		t.Errorf("got %v", got)
+	}
+	got = NeededFeatures(`{"Election": [{"BallotImages": [{"Uri": "/election/1/media/x.png", "Placement": "header-left"}]}]}`)
+	if len(got) != 1 || got[0] != FeatureImages {
+		t.Errorf("ballot images got %v", got)
+	}
+	got = NeededFeatures(`{"Election": [{"Fonts": [{"Uri": "/election/1/media/x.ttf", "Style": "regular"}]}]}`)
+	if len(got) != 1 || got[0] != FeatureFonts {
+		t.Errorf("fonts got %v", got)
+	}
+}
@@ -2,23 +2,28 @@
 # -*- mode: Python; coding: utf-8 -*-
 #
 
+import base64
+import copy
 import glob
+import hashlib
 import io
 import json
 import logging
+import math
 import os
 import time
 import statistics
 import sys
+from xml.sax.saxutils import escape as xmlescape
 
 from PIL import Image
 import fontTools.ttLib
 from reportlab.pdfgen import canvas
-from reportlab.lib.pagesizes import letter, A4
+from reportlab.lib.pagesizes import letter, legal, A4
 from reportlab.lib.units import inch, mm, cm
 from reportlab.pdfbase import pdfmetrics
 from reportlab.pdfbase.ttfonts import TTFont
-from reportlab.platypus import Paragraph
+from reportlab.platypus import Paragraph, SimpleDocTemplate, Spacer, PageBreak
 #from reportlab.platypus import Image
 from reportlab.lib.styles import ParagraphStyle
 from reportlab.lib.utils import ImageReader
@@ -30,24 +35,34 @@ class TodoException(Exception):
 
 
 class Bfont:
-    def __init__(self, path, name=None):
+    def __init__(self, path, name=None, data=None):
+        # data is the font file's bytes, for a font that isn't in a file
         self.name = name
         self.path = path
+        self.data = data
         self.capHeightPerPt = None
         self._measureCapheight()
-        lfont = TTFont(self.name, self.path)
+        lfont = TTFont(self.name, self._open())
         pdfmetrics.registerFont(lfont)
 
+    def _open(self):
+        if self.data is not None:
+            return io.BytesIO(self.data)
+        return self.path
+
     def _measureCapheight(self):
-        ftt = fontTools.ttLib.TTFont(self.path)
+        ftt = fontTools.ttLib.TTFont(self._open())
+        cmap = ftt.getBestCmap() or {}
         caps = [chr(x) for x in range(ord('A'), ord('Z')+1)]
         caps.remove('Q') # outlier descender
-        glyfminmax = [(ftt['glyf'][glyc].yMax, ftt['glyf'][glyc].yMin, glyc) for glyc in caps]
-        gmaxes = [x[0] for x in glyfminmax]
-        gmins = [x[1] for x in glyfminmax]
-        capmin = statistics.median(gmins)
-        capmax = statistics.median(gmaxes)
-        self.capHeightPerPt = (capmax - capmin) / 2048
+        glyfminmax = [(ftt['glyf'][cmap[ord(cap)]].yMax, ftt['glyf'][cmap[ord(cap)]].yMin) for cap in caps if ord(cap) in cmap]
+        if glyfminmax:
+            capmin = statistics.median([x[1] for x in glyfminmax])
+            capmax = statistics.median([x[0] for x in glyfminmax])
+        else:
+            # no Latin capitals, as the font says
+            capmin, capmax = 0, getattr(ftt['OS/2'], 'sCapHeight', 0) or ftt['head'].unitsPerEm * 0.7
+        self.capHeightPerPt = (capmax - capmin) / ftt['head'].unitsPerEm
         if self.name is None:
             for xn in ftt['name'].names:
                 if xn.nameID == 4:
@@ -70,6 +85,21 @@ def _ensure_fonts():
 
         logger.info('fonts: ' + ', '.join([repr(n) for n in fonts.keys()]))
 
+def _dataFont(uri):
+    "Bfont from a data: URI, an uploaded election font the Go server inlined. Registered once per distinct font."
+    if not uri or not uri.startswith('data:'):
+        return None
+    try:
+        _, b64 = uri.split(',', 1)
+        data = base64.b64decode(b64)
+        name = 'election-' + hashlib.sha256(data).hexdigest()[:16]
+        if name not in fonts:
+            fonts[name] = Bfont(None, name, data=data)
+        return fonts[name]
+    except Exception as e:
+        logger.warning('bad font uri %.40s..., %s', uri, e)
+        return None
+
 fontsans = 'Liberation Sans'
 fontsansbold = 'Liberation Sans Bold'
 #fontsans = 'Noto Sans Regular'
@@ -87,7 +117,7 @@ class Settings:
         self.titleLeading = self.titleFontSize * 1.4
         self.subtitleFontName = fontsansbold
         self.subtitleFontSize = 12
-        self.subtitleBGColor = ()
+        self.subtitleBGCMYK = (.1, 0, 0, 0)
         self.subtitleLeading = self.subtitleFontSize * 1.4
         self.candidateFontName = fontsansbold
         self.candidateFontSize = 12
@@ -96,6 +126,17 @@ class Settings:
         self.candsubFontSize = 12
         self.candsubLeading = 13
         self.writeInHeight = 0.3 * inch # TODO: check spec
+        self.candidateImageHeight = 0.5 * inch # candidate photo and party symbol
+        self.candidateImageGap = 2
+        self.ballotImageHeight = 0.75 * inch # Election.BallotImages seal and signatures, unless they have a Height
+        self.ballotImageMaxHeight = 2 * inch
+        self.ballotImageGap = 0.1 * inch
+        self.captionFontName = fontsans
+        self.captionFontSize = 8
+        self.captionLeading = 9
+        self.footerFontName = fontsans
+        self.footerFontSize = 10
+        self.footerLeading = 12
         self.bubbleLeftPad = 0.1 * inch
         self.bubbleRightPad = 0.1 * inch
         self.bubbleWidth = 8 * mm
@@ -107,10 +148,192 @@ class Settings:
         self.nowstrFontName = fontsans
         self.pageMargin = 0.5 * inch # inset from paper edge
         self.pagesize = letter
+        self.columns = 3
+        self.duplex = False # blank back page after a ballot style with an odd number of pages
+        self.watermark = None # text diagonally across every page, PROOF_WATERMARK for proofs
+
+    def withOptions(self, pagesize=None, duplex=False, columns=None, minfont=None, proof=False, highcontrast=False):
+        "copy with the /draw query options, see RenderOptions in options.go"
+        out = copy.copy(self)
+        if proof:
+            out.watermark = PROOF_WATERMARK
+        if highcontrast:
+            # black on white, no shaded title bars
+            out.titleBGColor = (1, 1, 1)
+            out.subtitleBGCMYK = (0, 0, 0, 0)
+        if pagesize:
+            out.pagesize = PAGE_SIZES[pagesize]
+        out.duplex = duplex
+        if columns:
+            out.columns = columns
+        if minfont:
+            # smaller text grows to minfont, and its line spacing with it
+            for name in list(out.__dict__):
+                if not name.endswith('FontSize'):
+                    continue
+                size = getattr(out, name)
+                if size >= minfont:
+                    continue
+                setattr(out, name, minfont)
+                leading = name[:-len('FontSize')] + 'Leading'
+                if hasattr(out, leading):
+                    setattr(out, leading, getattr(out, leading) * minfont / size)
+        return out
 
+    def withFonts(self, election):
+        "copy drawing with the Election Fonts (extension field), regular text in the regular font and bold in the bold one"
+        _ensure_fonts()
+        regular = bold = None
+        for ob in election.get('Fonts', []):
+            bf = _dataFont(_uriString(ob.get('Uri')))
+            if bf is None:
+                continue
+            if ob.get('Style') == 'bold':
+                bold = bold or bf.name
+            else:
+                regular = regular or bf.name
+        if regular is None and bold is None:
+            return self
+        regular = regular or bold
+        bold = bold or regular
+        out = copy.copy(self)
+        for name in list(out.__dict__):
+            if name.endswith('FontName'):
+                setattr(out, name, bold if getattr(out, name) == fontsansbold else regular)
+        return out
+
+PAGE_SIZES = {'letter': letter, 'legal': legal, 'a4': A4}
+
+PROOF_WATERMARK = 'SAMPLE / PROOF'
+
+def drawWatermark(c, pagesize):
+    "gs.watermark diagonally across the page, under anything drawn after it"
+    if not gs.watermark:
+        return
+    widthpt, heightpt = pagesize
+    size = 0.8 * math.hypot(widthpt, heightpt) / pdfmetrics.stringWidth(gs.watermark, gs.headerFontName, 1)
+    c.saveState()
+    c.setFillGray(0.8)
+    c.translate(widthpt / 2, heightpt / 2)
+    c.rotate(math.degrees(math.atan2(heightpt, widthpt)))
+    c.setFont(gs.headerFontName, size)
+    c.drawCentredString(0, -size * 0.35, gs.watermark)
+    c.restoreState()
 
 gs = Settings()
 
+class BubbleGeometry:
+    "Contest extension field BubbleGeometry, overrides of bubble target shape in pt. Validated on upload by data.CheckBubbleGeometry()"
+    def __init__(self, ob=None):
+        ob = ob or {}
+        self.width = ob.get('Width', gs.bubbleWidth)
+        self.height = ob.get('Height') # None for default fit to cap height
+        self.leftPad = ob.get('LeftPad', gs.bubbleLeftPad)
+        self.rightPad = ob.get('RightPad', gs.bubbleRightPad)
+        self.offsetX = ob.get('OffsetX', 0)
+        self.offsetY = ob.get('OffsetY', 0)
+        self.spacing = ob.get('Spacing', 0.1 * inch)
+    def bubbleCoords(self, x, y):
+        "x,y is top,left of a selection. returns (left, bottom, width, height)"
+        capHeight = fonts[gs.candidateFontName].capHeightPerPt * gs.candidateFontSize
+        bubbleHeight = self.height
+        if bubbleHeight is None:
+            bubbleHeight = min(gs.bubbleMaxHeight, capHeight)
+        bubbleYShim = (capHeight - bubbleHeight) / 2.0
+        bubbleBottom = y - gs.candidateFontSize + bubbleYShim + self.offsetY
+        return (x + self.leftPad + self.offsetX, bubbleBottom, self.width, bubbleHeight)
+    def textx(self, x):
+        return x + self.leftPad + self.width + self.rightPad
+
+_defaultGeometry = None
+
+def defaultGeometry():
+    global _defaultGeometry
+    if _defaultGeometry is None:
+        _defaultGeometry = BubbleGeometry()
+    return _defaultGeometry
+
+def _setGeometry(draw_selections, geom):
+    for ds in draw_selections:
+        if hasattr(ds, 'geom'):
+            ds.geom = geom
+
+def _uriString(v):
+    "plain string, or NIST AnnotatedUri {'Content': uri}, or a list of those (first wins)"
+    if isinstance(v, list):
+        v = v[0] if v else None
+    if isinstance(v, dict):
+        v = v.get('Content')
+    if isinstance(v, str):
+        return v
+    return None
+
+def _imageReader(uri):
+    "data: URI to ImageReader. The Go server inlines uploaded media as data: URIs before sending the document here; other URIs are not fetched."
+    if not uri or not uri.startswith('data:'):
+        return None
+    try:
+        _, b64 = uri.split(',', 1)
+        return ImageReader(io.BytesIO(base64.b64decode(b64)))
+    except Exception as e:
+        logger.warning('bad image uri %.40s..., %s', uri, e)
+        return None
+
+class BallotImage:
+    "Election.BallotImages extension entry, a county seal, official's signature or such printed on every page"
+    placements = ('header-left', 'header-right', 'footer-left', 'footer-right')
+    def __init__(self, ob):
+        self.im = _imageReader(_uriString(ob.get('Uri')))
+        self.placement = ob.get('Placement') or 'header-left'
+        if self.placement not in self.placements:
+            logger.warning('unknown BallotImages Placement %r', self.placement)
+            self.placement = 'header-left'
+        self._height = ob.get('Height')
+        self.caption = ob.get('Caption')
+    def imageHeight(self):
+        if not self._height:
+            return gs.ballotImageHeight
+        return max(1, min(float(self._height), gs.ballotImageMaxHeight))
+    def imageWidth(self):
+        iw, ih = self.im.getSize()
+        return self.imageHeight() * iw / ih
+    def width(self):
+        out = self.imageWidth()
+        if self.caption:
+            out = max(out, pdfmetrics.stringWidth(self.caption, gs.captionFontName, gs.captionFontSize))
+        return out
+    def height(self):
+        out = self.imageHeight()
+        if self.caption:
+            out += gs.captionLeading
+        return out
+    def draw(self, c, x, top):
+        "top left at x,top; image centered over its caption"
+        w = self.width()
+        imh = self.imageHeight()
+        imw = self.imageWidth()
+        c.drawImage(self.im, x + (w - imw) / 2, top - imh, width=imw, height=imh, mask='auto')
+        if self.caption:
+            c.setFillColorRGB(0,0,0)
+            c.setFont(gs.captionFontName, gs.captionFontSize)
+            c.drawCentredString(x + w / 2, top - imh - gs.captionFontSize, self.caption)
+
+def _drawBallotImages(c, images, left, right, top):
+    "left placed images from left, right placed from right, tops at top. Returns the height used."
+    height = 0
+    x = left
+    for bi in images[0]:
+        bi.draw(c, x, top)
+        x += bi.width() + gs.ballotImageGap
+        height = max(height, bi.height())
+    x = right
+    for bi in images[1]:
+        x -= bi.width()
+        bi.draw(c, x, top)
+        x -= gs.ballotImageGap
+        height = max(height, bi.height())
+    return height
+
 def setOptionalFields(self, ob):
     for field_name, default_value in self._optional_fields:
         setattr(self, field_name, ob.get(field_name, default_value))
@@ -140,7 +363,7 @@ class Choice:
         c.setLineWidth(1)
         c.setFillColorRGB(1,1,1)
         self._bubbleCoords = (x + gs.bubbleLeftPad, bubbleBottom, gs.bubbleWidth, bubbleHeight)
-        c.roundRect(*self._bubbleCoords, radius=bubbleHeight/2)
+        c.roundRect(*self._bubbleCoords, radius=bubbleHeight/2, fill=1)
         textx = x + gs.bubbleLeftPad + gs.bubbleWidth + gs.bubbleRightPad
         # TODO: assumes one line
         c.setFillColorRGB(0,0,0)
@@ -204,8 +427,8 @@ class Contest:
         c.drawText(txto)
         pos -= gs.titleLeading
         # subtitle
-        c.setStrokeColorCMYK(.1,0,0,0)
-        c.setFillColorCMYK(.1,0,0,0)
+        c.setStrokeColorCMYK(*gs.subtitleBGCMYK)
+        c.setFillColorCMYK(*gs.subtitleBGCMYK)
         c.rect(x, pos - gs.subtitleLeading, width, gs.subtitleLeading, fill=1, stroke=0)
         c.setFillColorRGB(0,0,0)
         c.setStrokeColorRGB(0,0,0)
@@ -308,21 +531,19 @@ class BallotMeasureSelection:
         self.selection = self.cs['Selection']
         setOptionalFields(self, self.cs)
         self._bubbleCoords = None
+        # set by containing contest
+        self.geom = defaultGeometry()
     def height(self, width):
         out = gs.candidateLeading
-        out += 0.1 * inch
+        out += self.geom.spacing
         return out
     def draw(self, c, x, y, width):
-        capHeight = fonts[gs.candidateFontName].capHeightPerPt * gs.candidateFontSize
-        bubbleHeight = min(3*mm, capHeight)
-        bubbleYShim = (capHeight - bubbleHeight) / 2.0
-        bubbleBottom = y - gs.candidateFontSize + bubbleYShim
         c.setStrokeColorRGB(0,0,0)
         c.setLineWidth(1)
         c.setFillColorRGB(1,1,1)
-        self._bubbleCoords = (x + gs.bubbleLeftPad, bubbleBottom, gs.bubbleWidth, bubbleHeight)
-        c.roundRect(*self._bubbleCoords, radius=bubbleHeight/2)
-        textx = x + gs.bubbleLeftPad + gs.bubbleWidth + gs.bubbleRightPad
+        self._bubbleCoords = self.geom.bubbleCoords(x, y)
+        c.roundRect(*self._bubbleCoords, radius=self._bubbleCoords[3]/2, fill=1)
+        textx = self.geom.textx(x)
         # TODO: assumes one line
         c.setFillColorRGB(0,0,0)
         txto = c.beginText(textx, y - gs.candidateFontSize)
@@ -333,7 +554,7 @@ class BallotMeasureSelection:
         # separator line
         c.setStrokeColorRGB(0,0,0)
         c.setLineWidth(0.25)
-        sepy = ypos - (0.1 * inch)
+        sepy = ypos - self.geom.spacing
         c.line(textx, sepy, x+width, sepy)
         return
 
@@ -372,7 +593,22 @@ class CandidateSelection:
             self.subtext = ', '.join(peopleparties)
         else:
             self.subtext = None
+        # candidate photo (extension field Candidate.PhotoUri) and party symbol (Party.LogoUri)
+        self.images = []
+        for cand in self.candidates[:1]:
+            im = _imageReader(_uriString(cand.get('PhotoUri')))
+            if im:
+                self.images.append(im)
+        parties = self.parties or list(filter(None, self.peopleparties))
+        if not parties:
+            parties = [erctx.getRawOb(cand['PartyId']) for cand in self.candidates if cand.get('PartyId')]
+        for party in parties[:1]:
+            im = _imageReader(_uriString(party.get('LogoUri')))
+            if im:
+                self.images.append(im)
         self._bubbleCoords = None
+        # set by containing contest
+        self.geom = defaultGeometry()
     def height(self, width):
         # TODO: actually check render for width with party and subtitle and all that
         out = gs.candidateLeading * len(self.candidates)
@@ -381,19 +617,17 @@ class CandidateSelection:
         if self.IsWriteIn:
             out += gs.candsubLeading
             out += gs.writeInHeight
-        out += 0.1 * inch
+        if self.images:
+            out = max(out, gs.candidateImageHeight)
+        out += self.geom.spacing
         return out
     def draw(self, c, x, y, width):
-        capHeight = fonts[gs.candidateFontName].capHeightPerPt * gs.candidateFontSize
-        bubbleHeight = min(3*mm, capHeight)
-        bubbleYShim = (capHeight - bubbleHeight) / 2.0
-        bubbleBottom = y - gs.candidateFontSize + bubbleYShim
         c.setStrokeColorRGB(0,0,0)
         c.setLineWidth(1)
         c.setFillColorRGB(1,1,1)
-        self._bubbleCoords = (x + gs.bubbleLeftPad, bubbleBottom, gs.bubbleWidth, bubbleHeight)
-        c.roundRect(*self._bubbleCoords, radius=bubbleHeight/2)
-        textx = x + gs.bubbleLeftPad + gs.bubbleWidth + gs.bubbleRightPad
+        self._bubbleCoords = self.geom.bubbleCoords(x, y)
+        c.roundRect(*self._bubbleCoords, radius=self._bubbleCoords[3]/2, fill=1)
+        textx = self.geom.textx(x)
         # TODO: assumes one line
         c.setFillColorRGB(0,0,0)
         ballotName = None
@@ -429,10 +663,21 @@ class CandidateSelection:
             c.setLineWidth(0.5)
             c.line(textx, ypos, x+width, ypos)
             c.setDash()
+        if self.images:
+            # right aligned, photo then symbol
+            imx = x + width
+            for im in reversed(self.images):
+                iw, ih = im.getSize()
+                imh = gs.candidateImageHeight
+                imw = imh * iw / ih
+                imx -= imw
+                c.drawImage(im, imx, y - imh, width=imw, height=imh, mask='auto')
+                imx -= gs.candidateImageGap
+            ypos = min(ypos, y - gs.candidateImageHeight)
         # separator line
         c.setStrokeColorRGB(0,0,0)
         c.setLineWidth(0.25)
-        sepy = ypos - (0.1 * inch)
+        sepy = ypos - self.geom.spacing
         c.line(textx, sepy, x+width, sepy)
         return
 
@@ -470,6 +715,8 @@ class BallotMeasureContest:
         self.ElectionDistrictId = co['ElectionDistrictId'] # reference to a ReportingUnit gpunit
         setOptionalFields(self, self.co)
         self.draw_selections = [erctx.makeDrawOb(x) for x in self.ContestSelection]
+        self.geom = BubbleGeometry(co.get('BubbleGeometry')) # extension field
+        _setGeometry(self.draw_selections, self.geom)
     def draw(self, c, x, y, width, draw_selections=None):
         if draw_selections is None:
             draw_selections = self.draw_selections
@@ -486,8 +733,8 @@ class BallotMeasureContest:
         c.drawText(txto)
         pos -= gs.titleLeading
         # subtitle
-        c.setStrokeColorCMYK(.1,0,0,0)
-        c.setFillColorCMYK(.1,0,0,0)
+        c.setStrokeColorCMYK(*gs.subtitleBGCMYK)
+        c.setFillColorCMYK(*gs.subtitleBGCMYK)
         c.rect(x, pos - gs.subtitleLeading, width, gs.subtitleLeading, fill=1, stroke=0)
         c.setFillColorRGB(0,0,0)
         c.setStrokeColorRGB(0,0,0)
@@ -573,6 +820,8 @@ class CandidateContest:
         else:
             self.offices = []
         self.draw_selections = [erctx.makeDrawOb(x) for x in self.ContestSelection]
+        self.geom = BubbleGeometry(co.get('BubbleGeometry')) # extension field
+        _setGeometry(self.draw_selections, self.geom)
     def draw(self, c, x, y, width, draw_selections=None):
         if draw_selections is None:
             draw_selections = self.draw_selections
@@ -589,8 +838,8 @@ class CandidateContest:
         c.drawText(txto)
         pos -= gs.titleLeading
         # subtitle
-        c.setStrokeColorCMYK(.1,0,0,0)
-        c.setFillColorCMYK(.1,0,0,0)
+        c.setStrokeColorCMYK(*gs.subtitleBGCMYK)
+        c.setFillColorCMYK(*gs.subtitleBGCMYK)
         c.rect(x, pos - gs.subtitleLeading, width, gs.subtitleLeading, fill=1, stroke=0)
         c.setFillColorRGB(0,0,0)
         c.setStrokeColorRGB(0,0,0)
@@ -647,6 +896,45 @@ class CandidateContest:
         out += 0.1 * inch # bottom padding
         return out
 
+# Text around the contests, from Election and BallotStyle extension fields
+# PageHeader, PageFooter, TurnNotice and Instructions; see draw/pagetext.go
+DEFAULT_PAGE_HEADER = 'Ballot for {TYPE}\n{JURISDICTION}\n{DATE} - page {PAGE} of {PAGES}'
+DEFAULT_TURN_NOTICE = 'Vote both sides'
+
+def fillPageText(template, fields, page, pages):
+    "fill in a header or footer template; {TURN} is empty on the last page"
+    out = template
+    for name, value in fields.items():
+        if name == 'TURN' and str(pages) == str(page):
+            value = ''
+        out = out.replace('{' + name + '}', value)
+    return out.replace('{PAGES}', str(pages)).replace('{PAGE}', str(page))
+
+def parseInstructions(text):
+    "Instructions rich text to [(kind, text), ...], kind 'heading', 'para' or 'bullet'"
+    out = []
+    para = []
+    def flush():
+        if not para:
+            return
+        joined = ' '.join(para)
+        if joined.startswith('# '):
+            out.append(('heading', joined[2:]))
+        else:
+            out.append(('para', joined))
+        para.clear()
+    for line in text.split('\n'):
+        line = line.strip()
+        if not line:
+            flush()
+        elif line.startswith('- '):
+            flush()
+            out.append(('bullet', line[2:]))
+        else:
+            para.append(line)
+    flush()
+    return out
+
 class InstructionsHeader:
     header1 = 'Making selections'
     image1 = 'filled bubble.png'
@@ -657,7 +945,7 @@ class InstructionsHeader:
     instruction2 = 'To add a candidate, fill in the oval to the left of “or write-in” and print the name clearly on the dotted line.'
 
     @classmethod
-    def height(self, width, draw_selections=None):
+    def height(self, width, draw_selections=None, text=None):
         # y = 0
         # x = 0
         # pos = y - 3 # leave room for 3pt top border
@@ -670,14 +958,31 @@ class InstructionsHeader:
         # pos -= imHeight
 
         # return 3.0 * inch
-        h = self._draw(None,0,0,width,draw_selections, enable=False)
+        h = self._draw(None,0,0,width,draw_selections, enable=False, text=text)
         logger.debug("instructions height %r", h)
         return h
     @classmethod
-    def draw(self, c, x, y, width, draw_selections=None):
-        self._draw(c,x,y,width,draw_selections, enable=True)
+    def draw(self, c, x, y, width, draw_selections=None, text=None):
+        self._draw(c,x,y,width,draw_selections, enable=True, text=text)
+    @classmethod
+    def _drawText(self, c, x, y, width, text, enable):
+        "the style's own Instructions rich text, returns the bottom"
+        pos = y
+        styles = {
+            'heading': ParagraphStyle('instructionHeading', fontName=gs.candidateFontName, spaceAfter=2),
+            'para': ParagraphStyle('instructionParagraph', spaceAfter=4),
+            'bullet': ParagraphStyle('instructionBullet', leftIndent=10, bulletIndent=0),
+        }
+        for kind, btext in parseInstructions(text):
+            ps = styles[kind]
+            par = Paragraph(xmlescape(btext), ps, bulletText='\u2022' if kind == 'bullet' else None)
+            ww, wh = par.wrap(width, 1000)
+            if enable:
+                par.drawOn(c, x, pos-wh)
+            pos -= wh + ps.spaceAfter
+        return pos
     @classmethod
-    def _draw(self, c, x, y, width, draw_selections=None, enable=False):
+    def _draw(self, c, x, y, width, draw_selections=None, enable=False, text=None):
         pos = y - 3 # leave room for 3pt top border
         # title
         if enable:
@@ -695,6 +1000,12 @@ class InstructionsHeader:
         # TODO: configurable style instead of borrowing candsub style
         textx = x + 1 + (0.1 * inch)
         availableWidth = width - (1 + (0.1 * inch))
+        if text:
+            pos -= 0.05 * inch
+            pos = self._drawText(c, textx, pos, availableWidth, text, enable)
+            pos -= 0.1 * inch # bottom padding
+            self._borders(c, x, y, width, pos, enable)
+            return 0-pos
 
         bubbleImage = ImageReader(os.path.join(resources, self.image1))
         imw, imh = bubbleImage.getSize()
@@ -732,7 +1043,10 @@ class InstructionsHeader:
         pos -= wh
 
         pos -= 0.1 * inch # bottom padding
-
+        self._borders(c, x, y, width, pos, enable)
+        return 0-pos
+    @classmethod
+    def _borders(self, c, x, y, width, pos, enable):
         # top border
         if enable:
             c.setStrokeColorRGB(0,0,0)
@@ -745,7 +1059,6 @@ class InstructionsHeader:
             path.lineTo(x+0.5, pos-0.5)
             path.lineTo(x+width, pos-0.5)
             c.drawPath(path, stroke=1)
-        return 0-pos
 
 _COLUMN_BREAK_HEIGHT = 999999997
 _PAGE_BREAK_HEIGHT = 999999999
@@ -759,6 +1072,7 @@ class Header:
         co = header_json_object
         self.co = co
         self.Name = co['Name']
+        self.erctx = erctx
         setOptionalFields(self, self.co)
         self.impl = None
         if self.Name == 'Instructions':
@@ -766,7 +1080,7 @@ class Header:
         # TODO: header Name "ColumnBreak" and "PageBreak"
     def height(self, width, draw_selections=None):
         if self.impl:
-            return self.impl.height(width, draw_selections)
+            return self.impl.height(width, draw_selections, text=self.erctx.styleText('Instructions'))
         if self.Name == 'ColumnBreak':
             return _COLUMN_BREAK_HEIGHT
         if self.Name == 'PageBreak':
@@ -774,7 +1088,7 @@ class Header:
         return 0
     def draw(self, c, x, y, width, draw_selections=None):
         if self.impl:
-            return self.impl.draw(c,x,y,width,draw_selections)
+            return self.impl.draw(c,x,y,width,draw_selections, text=self.erctx.styleText('Instructions'))
 
 def rehydrateContest(election, contest_json_object):
     co = contest_json_object
@@ -805,6 +1119,7 @@ class OrderedContest:
         else:
             self.ordered_selections = raw_selections
         self.draw_selections = [erctx.makeDrawOb(x) for x in self.ordered_selections]
+        _setGeometry(self.draw_selections, self.contest.geom)
     def _maxheight(self, width):
         return self.contest._maxheight(width, draw_selections=self.draw_selections)
     def height(self, width):
@@ -834,9 +1149,10 @@ class OrderedHeader:
 
 
 class BallotStyle:
-    def __init__(self, erctx, ballotstyle_json_object):
+    def __init__(self, erctx, ballotstyle_json_object, styleNum=1):
         bs = ballotstyle_json_object
         self.bs = bs
+        self.styleNum = styleNum # from 1, for {STYLE}
         self.erctx = erctx
         self.gpunits = [erctx.getRawOb(x) for x in bs['GpUnitIds']]
         self.ext = bs.get('ExternalIdentifier', [])
@@ -847,8 +1163,8 @@ class BallotStyle:
         self.parties = [erctx.getRawOb(x) for x in bs.get('PartyIds', [])]
         # _numPages gets filled in on a first rendering pass and used on second pass
         self._numPages = 'X'
-        self._pageHeader = bs.get('PageHeader') # extension field
         self._bubbles = None
+        self._bubblePages = {}
         self._headerBoxes = {}
         self.contenttop = None
         self.contentbottom = None
@@ -861,6 +1177,33 @@ class BallotStyle:
             if sel in self.image_uri:
                 return True
         return False
+    def styleText(self, field):
+        "this style's PageHeader, PageFooter, TurnNotice or Instructions (extension fields), or else the election's"
+        v = self.bs.get(field)
+        if isinstance(v, str):
+            return v
+        v = self.erctx.eprinter.el.get(field)
+        if isinstance(v, str):
+            return v
+        return None
+    def pageFields(self):
+        "template fields that are the same on every page, see pagetext.go"
+        election = self.erctx.eprinter
+        datepart = election.startdate
+        if election.startdate != election.enddate:
+            datepart += ' - ' + election.enddate
+        style = str(self.styleNum)
+        if self.ext and isinstance(self.ext[0], str):
+            style = self.ext[0]
+        turn = self.styleText('TurnNotice')
+        return {
+            'ELECTION': election.name if isinstance(election.name, str) else '',
+            'TYPE': election.electionTypeTitle(),
+            'JURISDICTION': ', '.join([gpunitName(x) for x in self.gpunits]),
+            'DATE': datepart,
+            'STYLE': style,
+            'TURN': DEFAULT_TURN_NOTICE if turn is None else turn,
+        }
     def pageHeaderText(self, page):
         """Create PageHeader text
         e.g.
@@ -868,37 +1211,56 @@ class BallotStyle:
         City of Springfield
         Tuesday, November 8, 2022, page 1 of 5
         """
-        pht = self.pageHeaderTemplate()
-        return pht.format(PAGE=page, PAGES=self._numPages)
-    def pageHeaderTemplate(self):
-        if self._pageHeader is not None:
-            return self._pageHeader
-        election = self.erctx.eprinter
-        datepart = election.startdate
-        if election.startdate != election.enddate:
-            datepart += ' - ' + election.enddate
-        gpunitnames = ', '.join([gpunitName(x) for x in self.gpunits])
-        text = "Ballot for {}\n{}\n{}".format(
-            election.electionTypeTitle(), gpunitnames, datepart) + ' - page {PAGE} of {PAGES}'
-        self._pageHeader = text
-        return self._pageHeader
+        return fillPageText(self.styleText('PageHeader') or DEFAULT_PAGE_HEADER, self.pageFields(), page, self._numPages)
+    def ballotImages(self, where):
+        "(left, right) Election.BallotImages placed in the header or footer"
+        images = getattr(self.erctx.eprinter, 'ballotImages', [])
+        return ([bi for bi in images if bi.placement == where + '-left'],
+                [bi for bi in images if bi.placement == where + '-right'])
     def drawPageHeader(self, c, page):
         c.setStrokeColorRGB(0,0,0)
         c.setLineWidth(1.0)
         c.line(self.contentleft, self.contenttop, self.contentright, self.contenttop)
-        txto = c.beginText(self.contentleft + 0.1*inch, self.contenttop - gs.headerFontSize)
+        images = self.ballotImages('header')
+        textx = self.contentleft + 0.1*inch
+        for bi in images[0]:
+            textx += bi.width() + gs.ballotImageGap
+        imagesHeight = _drawBallotImages(c, images, self.contentleft + 0.1*inch, self.contentright, self.contenttop - 0.05*inch)
+        if imagesHeight:
+            imagesHeight += 0.05*inch
+        txto = c.beginText(textx, self.contenttop - gs.headerFontSize)
         txto.setFont(gs.headerFontName, gs.headerFontSize, gs.headerLeading)
         headerText = self.pageHeaderText(page)
         nlines = len(headerText.splitlines())
         txto.textLines(headerText)
         c.drawText(txto)
-        pageHeaderHeight = gs.headerLeading * nlines + 0.1*inch
+        pageHeaderHeight = max(gs.headerLeading * nlines, imagesHeight) + 0.1*inch
         #self._pageHeaderHeight = max(pageHeaderHeight, self._pageHeaderHeight)
         box = (self.contentleft + 0.1*inch, self.contenttop,
                self.contentright, self.contenttop - pageHeaderHeight)
         logger.debug('bs (%r) page %s box %r', self.bs['GpUnitIds'], page, box)
         self._headerBoxes[page] = box
         self.contenttop -= pageHeaderHeight
+    def drawPageFooter(self, c, page):
+        template = self.styleText('PageFooter')
+        if template:
+            lines = fillPageText(template, self.pageFields(), page, self._numPages).splitlines()
+            c.setFillColorRGB(0,0,0)
+            txto = c.beginText(self.contentleft + 0.1*inch, self.contentbottom + gs.footerLeading * (len(lines) - 1) + gs.footerFontSize * 0.2)
+            txto.setFont(gs.footerFontName, gs.footerFontSize, gs.footerLeading)
+            txto.textLines(lines)
+            c.drawText(txto)
+            self.contentbottom += gs.footerLeading * len(lines) + 0.05*inch
+            c.setStrokeColorRGB(0,0,0)
+            c.setLineWidth(1.0)
+            c.line(self.contentleft, self.contentbottom, self.contentright, self.contentbottom)
+            self.contentbottom += 0.05*inch
+        images = self.ballotImages('footer')
+        height = max([bi.height() for bi in images[0] + images[1]] or [0])
+        if not height:
+            return
+        _drawBallotImages(c, images, self.contentleft, self.contentright, self.contentbottom + height)
+        self.contentbottom += height + 0.1*inch
 
     def name(self):
         return ','.join([gpunitName(gpu) for gpu in self.gpunits])
@@ -911,6 +1273,7 @@ class BallotStyle:
         y = self.contenttop
         x = self.contentleft
         page = 1
+        drawWatermark(c, pagesize)
         if gs.debugPageOutline:
             # draw page outline debug, a red border at content limit
             c.setLineWidth(0.2)
@@ -919,7 +1282,6 @@ class BallotStyle:
             c.rect(self.contentleft, self.contentbottom, widthpt - (2 * gs.pageMargin), heightpt - (2 * gs.pageMargin), stroke=1, fill=0)
             c.setLineWidth(1)
         nowstr = 'generated ' + time.strftime('%Y-%m-%d %H:%M:%S UTC', time.gmtime())
-        c.setTitle('ballot test ' + nowstr)
         if gs.nowstrEnabled:
             c.setFillColorRGB(0,0,0)
             c.setStrokeColorRGB(0,0,0)
@@ -928,14 +1290,17 @@ class BallotStyle:
             c.drawString(self.contentright - dtw, self.contentbottom + (gs.nowstrFontSize * 0.2), nowstr)
             self.contentbottom += (gs.nowstrFontSize * 1.2)
 
+        self.erctx.currentStyle = self
         self.drawPageHeader(c, page)
+        self.drawPageFooter(c, page)
         # TODO: instruction box
         y = self.contenttop
 
         # (columnwidth * columns) + (gs.columnMargin * (columns - 1)) == width
-        columns = 3
+        columns = gs.columns
         columnwidth = (self.contentright - self.contentleft - (gs.columnMargin * (columns - 1))) / columns
         bubbles = {}
+        bubblePages = {}
         # content, 2 columns
         colnum = 1
         for xc in self.content:
@@ -948,12 +1313,14 @@ class BallotStyle:
                     # start a new page
                     c.showPage()
                     page += 1
+                    drawWatermark(c, pagesize)
                     colnum = 1
                     # reset contenttop for prior header
                     self.contenttop = heightpt - gs.pageMargin
                     # reset contentbottom in case of debug string
                     self.contentbottom = gs.pageMargin
                     self.drawPageHeader(c, page)
+                    self.drawPageFooter(c, page)
                     x = self.contentleft
                     y = self.contenttop
                 else:
@@ -970,11 +1337,21 @@ class BallotStyle:
                 #logger.info('xc %r %s bubbles %r', xc, xc.atid, xb)
                 #bubbles.append(xb)
                 bubbles[xc.atid] = xb
+                bubblePages[xc.atid] = page
         c.showPage()
         self._numPages = page
         self._bubbles = bubbles
+        self._bubblePages = bubblePages
     def getBubbles(self):
         return self._bubbles
+    def getBubblePages(self):
+        "{contest id: page number within this ballot style, from 1}"
+        return self._bubblePages
+    def getNumPages(self):
+        "0 if not drawn"
+        if isinstance(self._numPages, int):
+            return self._numPages
+        return 0
     def getHeaderBoxes(self):
         return self._headerBoxes
 
@@ -1028,6 +1405,13 @@ class ElectionResultsContext:
         self.obids = gatherIds(self.er)
         # draw objects by id, same key as obids
         self.dobs = {}
+        # the BallotStyle being drawn
+        self.currentStyle = None
+    def styleText(self, field):
+        "the current style's setting of an extension field, see BallotStyle.styleText"
+        if self.currentStyle is None:
+            return None
+        return self.currentStyle.styleText(field)
     def getRawOb(self, id_string):
         return self.obids[id_string]
     def getDrawOb(self, id_string):
@@ -1084,10 +1468,12 @@ class ElectionPrinter:
         self.ext = er.get('ExternalIdentifier', [])
         self.contests = el.get('Contest', [])
         self.candidates = el.get('Candidate', [])
+        # seal, signatures and such on every page (extension field)
+        self.ballotImages = [bi for bi in (BallotImage(ob) for ob in el.get('BallotImages', [])) if bi.im]
         # ballot_styles is local BallotStyle objects
         self.ballot_styles = []
-        for bstyle in el.get('BallotStyle', []):
-            self.ballot_styles.append(BallotStyle(erctx,bstyle))
+        for i, bstyle in enumerate(el.get('BallotStyle', [])):
+            self.ballot_styles.append(BallotStyle(erctx, bstyle, i+1))
         return
     def electionTypeTitle(self):
         # TODO: i18n
@@ -1128,10 +1514,14 @@ class ElectionPrinter:
         _ensure_fonts()
         any = False
         c = canvas.Canvas(outfile, pagesize=gs.pagesize) # pageCompression=1
+        c.setTitle(self.name)
+        c.setCreator('BallotStudio')
+        styles = []
         for i, bs in enumerate(self.ballot_styles):
             if (selectors is not None) and not bs.select(selectors):
                 continue
             any = True
+            styles.append(bs.name())
             # dummy draw for pagination
             outdummy = io.BytesIO()
             dc = canvas.Canvas(outdummy, pagesize=gs.pagesize)
@@ -1140,12 +1530,18 @@ class ElectionPrinter:
             dc = None
             # real draw
             bs.draw(c, gs.pagesize)
+            if gs.duplex and bs.getNumPages() % 2 == 1:
+                # blank back, so the next style starts on a new sheet
+                drawWatermark(c, gs.pagesize)
+                c.showPage()
         if any:
+            c.setSubject('Ballot styles: ' + '; '.join(styles))
             c.save()
         else:
             raise Exception('No BallotStyles drawn for selectors {!r}'.format(selectors))
     def getBubbles(self):
         """{
+"version": 1,
 "pagesize": (width pt, height pt),
 "bubbles": [
   // entry per ballot style
@@ -1162,10 +1558,14 @@ class ElectionPrinter:
             ob = {
                 'GpUnitIds': bs.bs['GpUnitIds'],
                 'bubbles': bs.getBubbles(),
+                'bubble_pages': bs.getBubblePages(),
+                'pages': bs.getNumPages() + (bs.getNumPages() % 2 if gs.duplex else 0),
                 'headers': bs.getHeaderBoxes(),
             }
             bsdata.append(ob)
         return {
+            # bubbles json version, see scan.BubblesVersion1
+            'version': 1,
             'draw_settings': gs.__dict__,
             # bsdata is the way
             'bsdata': bsdata,
@@ -1174,6 +1574,119 @@ class ElectionPrinter:
             'headers': [bs.getHeaderBoxes() for bs in self.ballot_styles],
         }
 
+_pamphlet_placeholder_pro = '[argument in favor not yet submitted]'
+_pamphlet_placeholder_con = '[argument against not yet submitted]'
+_pamphlet_placeholder_statement = '[candidate statement not yet submitted]'
+
+def _paragraphs(text, style):
+    "blank line separated text to Paragraph list"
+    out = []
+    for para in (text or '').split('\n\n'):
+        para = para.strip()
+        if para:
+            out.append(Paragraph(xmlescape(para).replace('\n', '<br/>'), style))
+    return out
+
+class PamphletPrinter:
+    """Voter pamphlet companion to the ballot: measure text and arguments, candidate statements.
+    Same document as ElectionPrinter, flowing text layout instead of ballot columns."""
+    def __init__(self, election_report, election):
+        self.er = election_report
+        self.el = election
+        self.erctx = ElectionResultsContext(election_report, self)
+        self.ep = ElectionPrinter(election_report, election)
+    def _styles(self):
+        return {
+            'title': ParagraphStyle('title', fontName=gs.headerFontName, fontSize=gs.headerFontSize*1.5, leading=gs.headerLeading*1.5, spaceAfter=12),
+            'contest': ParagraphStyle('contest', fontName=gs.titleFontName, fontSize=gs.titleFontSize*1.25, leading=gs.titleLeading*1.25, spaceBefore=12, spaceAfter=6),
+            'section': ParagraphStyle('section', fontName=gs.subtitleFontName, fontSize=gs.subtitleFontSize, leading=gs.subtitleLeading, spaceBefore=6, spaceAfter=3),
+            'body': ParagraphStyle('body', fontName=gs.candsubFontName, fontSize=gs.candsubFontSize*0.9, leading=gs.candsubLeading, spaceAfter=4),
+            'placeholder': ParagraphStyle('placeholder', fontName=gs.candsubFontName, fontSize=gs.candsubFontSize*0.9, leading=gs.candsubLeading, textColor=(.4,.4,.4), spaceAfter=4),
+        }
+    def _contestOrder(self):
+        "contests in ballot order, each once"
+        seen = set()
+        out = []
+        for bs in self.el.get('BallotStyle', []):
+            for oc in bs.get('OrderedContent', []):
+                cid = oc.get('ContestId')
+                if cid and cid not in seen:
+                    seen.add(cid)
+                    out.append(self.erctx.getRawOb(cid))
+        for co in self.el.get('Contest', []):
+            if co['@id'] not in seen:
+                seen.add(co['@id'])
+                out.append(co)
+        return out
+    def _measureStory(self, co, st):
+        story = [Paragraph(xmlescape(co.get('BallotTitle') or co['Name']), st['contest'])]
+        if co.get('BallotSubTitle'):
+            story.append(Paragraph(xmlescape(co['BallotSubTitle']), st['section']))
+        if co.get('SummaryText'):
+            story.append(Paragraph('Summary', st['section']))
+            story += _paragraphs(co['SummaryText'], st['body'])
+        if co.get('FullText'):
+            story.append(Paragraph('Full Text', st['section']))
+            story += _paragraphs(co['FullText'], st['body'])
+        if co.get('EffectOfAbstain'):
+            story.append(Paragraph('Effect of Abstaining', st['section']))
+            story += _paragraphs(co['EffectOfAbstain'], st['body'])
+        story.append(Paragraph('Argument in Favor', st['section']))
+        story += _paragraphs(co.get('ProStatement'), st['body']) or [Paragraph(_pamphlet_placeholder_pro, st['placeholder'])]
+        story.append(Paragraph('Argument Against', st['section']))
+        story += _paragraphs(co.get('ConStatement'), st['body']) or [Paragraph(_pamphlet_placeholder_con, st['placeholder'])]
+        return story
+    def _candidateStory(self, co, st):
+        story = [Paragraph(xmlescape(co.get('BallotTitle') or co['Name']), st['contest'])]
+        if co.get('BallotSubTitle'):
+            story.append(Paragraph(xmlescape(co['BallotSubTitle']), st['section']))
+        for csel in co.get('ContestSelection', []):
+            if csel.get('IsWriteIn'):
+                continue
+            for cid in csel.get('CandidateIds', []):
+                cand = self.erctx.getRawOb(cid)
+                name = cand.get('BallotName') or ''
+                party = None
+                if cand.get('PartyId'):
+                    party = self.erctx.getRawOb(cand['PartyId']).get('Name')
+                elif cand.get('PersonId'):
+                    pp = self.erctx.getRawOb(cand['PersonId']).get('PartyId')
+                    party = pp and self.erctx.getRawOb(pp).get('Name')
+                if party:
+                    name = '{} ({})'.format(name, party)
+                story.append(Paragraph(xmlescape(name), st['section']))
+                # "Statement" is an extension field on Candidate
+                story += _paragraphs(cand.get('Statement'), st['body']) or [Paragraph(_pamphlet_placeholder_statement, st['placeholder'])]
+        return story
+    def drawToFile(self, outfile):
+        _ensure_fonts()
+        st = self._styles()
+        story = [
+            Paragraph(xmlescape(self.el['Name']), st['title']),
+            Paragraph(xmlescape('{} {}'.format(self.ep.electionTypeTitle() or '', self.el['StartDate'])), st['section']),
+            Paragraph('Voter Information Pamphlet', st['section']),
+            PageBreak(),
+        ]
+        measures = []
+        candidates = []
+        for co in self._contestOrder():
+            if co['@type'] == 'ElectionResults.BallotMeasureContest':
+                measures.append(co)
+            elif co['@type'] == 'ElectionResults.CandidateContest':
+                candidates.append(co)
+        if candidates:
+            story.append(Paragraph('Candidates', st['title']))
+            for co in candidates:
+                story += self._candidateStory(co, st)
+        if measures:
+            if candidates:
+                story.append(PageBreak())
+            story.append(Paragraph('Measures', st['title']))
+            for co in measures:
+                story += self._measureStory(co, st)
+        doc = SimpleDocTemplate(outfile, pagesize=gs.pagesize, leftMargin=gs.pageMargin, rightMargin=gs.pageMargin, topMargin=gs.pageMargin, bottomMargin=gs.pageMargin, title=self.el['Name'])
+        doc.build(story)
+
 # for a list of NIST-1500-100 v2 json/dict objects with "@id" keys, return one
 def byId(they, x):
     for y in they:
@@ -1189,6 +1702,7 @@ def main():
     ap.add_argument('--verbose', default=False, action='store_true')
     ap.add_argument('--outdir', default=None)
     ap.add_argument('--prefix', default='')
+    ap.add_argument('--pamphlet', default=None, help='path to write voter pamphlet pdf to')
     args = ap.parse_args()
     if args.verbose:
         logging.basicConfig(level=logging.DEBUG)
@@ -1211,6 +1725,8 @@ def main():
             json.dump(ep.getBubbles(), bout)
             bout.write('\n')
             bout.close()
+        if args.pamphlet:
+            PamphletPrinter(er, el).drawToFile(args.pamphlet)
     return
 
 if __name__ == '__main__':
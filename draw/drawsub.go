@@ -4,22 +4,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
-	"path"
 	"strconv"
-	"strings"
 )
 
 type DrawBothOb struct {
 	Pdf         []byte
 	BubblesJson []byte
+
+	// Png pages, if the renderer made them (RenderElection does), otherwise PdfToPng(Pdf)
+	Png [][]byte
+
+	// PdfPath is the file the PDF was spooled to, with Pdf nil (see Client.Spool).
+	// The file is removed when its last holder calls Release.
+	PdfPath string
+	pdfSize int64
+	pdfSum  []byte
+	holds   int32 // atomic, 0 once the spool file is removed
+
+	// Warnings about what was left out, see Degradable
+	Warnings []string
 }
 
 type DrawBothResponse struct {
@@ -71,60 +78,23 @@ func (ds *DrawServer) Stop() error {
 	return nil
 }
 
+// DrawPamphlet renders the voter pamphlet companion PDF for an election
+func DrawPamphlet(backendUrl string, electionjson string) (pdf []byte, err error) {
+	return (&Client{BackendUrl: backendUrl}).DrawPamphlet(context.Background(), electionjson)
+}
+
 func DrawElection(backendUrl string, electionjson string) (both *DrawBothOb, err error) {
-	baseurl, err := url.Parse(backendUrl)
-	if err != nil {
-		return nil, fmt.Errorf("bad url, %v", err)
-	}
-	newpath := path.Join(baseurl.Path, "/draw")
-	nurl := baseurl
-	nurl.Path = newpath
-	nurl.RawQuery = "both=1"
-	drawurl := nurl.String()
-	postbody := strings.NewReader(electionjson)
-	resp, err := http.DefaultClient.Post(drawurl, "application/json", postbody)
-	if err != nil {
-		return nil, fmt.Errorf("draw POST, %v", err)
-	}
-	if resp.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		if len(body) > 50 {
-			body = body[:50]
-		}
-		return nil, fmt.Errorf("draw POST %d %#v", resp.StatusCode, string(body))
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	//dec := json.NewDecoder(resp.Body)
-	var dbr DrawBothResponse
-	//err = dec.Decode(&dbr)
-	err = json.Unmarshal(body, &dbr)
-	if err != nil {
-		dbb := body
-		if len(dbb) > 50 {
-			dbb = dbb[:50]
-		}
-		return nil, fmt.Errorf("draw POST bad response, %v, %#v", err, string(dbb))
-	}
-	// json.Unmarshal helpfully converts "base64 content" unpacked into []byte
-	/*
-		pdf := make([]byte, base64.StdEncoding.DecodedLen(len(dbr.PdfB64)))
-		actual, err := base64.StdEncoding.Decode(pdf, dbr.PdfB64)
-		if err != nil {
-			dp := dbr.PdfB64
-			if len(dp) > 50 {
-				dp = dp[:50]
-			}
-			return nil, fmt.Errorf("draw POST bad response b64, %v, %#v", err, string(dp))
-		}
-		if actual < len(pdf) {
-			pdf = pdf[:actual]
-		}
-	*/
-	bj, err := json.Marshal(dbr.Bubbles)
+	return (&Client{BackendUrl: backendUrl}).DrawElection(context.Background(), electionjson, RenderOptions{})
+}
+
+// parseDrawBoth reads the backend's response, the PDF into memory
+func parseDrawBoth(body io.Reader) (both *DrawBothOb, err error) {
+	var pdf bytes.Buffer
+	bj, err := readDrawBoth(body, &pdf)
 	if err != nil {
-		return nil, fmt.Errorf("draw POST bad response bj, %v", err)
+		return nil, err
 	}
-	return &DrawBothOb{Pdf: dbr.PdfB64, BubblesJson: bj}, nil
+	return &DrawBothOb{Pdf: pdf.Bytes(), BubblesJson: bj}, nil
 }
 
 type errorOrPngbytes struct {
@@ -168,8 +138,14 @@ func pngPageReader(reader io.Reader, out chan errorOrPngbytes) {
 	}
 }
 
-// uses subprocess `pdftoppm`
+// PdfToPng renders each page of pdf to PNG, waiting for a turn in
+// PngConversions
 func PdfToPng(ctx context.Context, pdf []byte) (pngbytes [][]byte, err error) {
+	return PngConversions.PdfToPng(ctx, pdf)
+}
+
+// uses subprocess `pdftoppm`
+func pdfToPng(ctx context.Context, pdf []byte) (pngbytes [][]byte, err error) {
 	if len(pdf) == 0 {
 		return nil, fmt.Errorf("pdftopng but empty pdf")
 	}
@@ -0,0 +1,248 @@
+package draw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Features a draw backend can have. A backend lists the ones it has at
+// GET /capabilities as {"features": [...]}. Before drawing, Client checks the
+// document against them: a missing Degradable feature is drawn without and
+// noted in DrawBothOb.Warnings, anything else missing is an *UnsupportedError
+// without calling the backend.
+const (
+	FeaturePamphlet       = "pamphlet"        // mode=pamphlet voter pamphlets
+	FeatureImages         = "images"          // Candidate PhotoUri, Party LogoUri and Election BallotImages
+	FeatureUnicode        = "unicode"         // text outside Latin-1
+	FeatureBubbleGeometry = "bubble-geometry" // Contest BubbleGeometry extension
+	FeatureRenderOptions  = "render-options"  // pagesize, duplex, columns and minfont, see RenderOptions
+	FeaturePdfA           = "pdfa"            // RenderOptions.PdfA
+	FeatureWatermark      = "watermark"       // RenderOptions.Proof
+	FeatureHighContrast   = "high-contrast"   // RenderOptions.HighContrast
+	FeaturePartyColumn    = "party-column"    // RenderOptions.Layout party-column
+	FeatureStraightParty  = "straight-party"  // PartyContest, straight-party voting
+	FeatureMeasureText    = "measure-text"    // ballot measure "PrintFullText"
+	FeatureFonts          = "fonts"           // Election Fonts, embedded uploaded fonts
+)
+
+// Degradable features, and what is left out of a ballot drawn without them
+var Degradable = map[string]string{
+	FeatureImages: "candidate photos, party logos, seals and signatures are left out",
+	FeatureFonts:  "the election's fonts are not used",
+}
+
+// what draw.py could do before it had /capabilities
+var legacyFeatures = []string{FeaturePamphlet, FeatureImages, FeatureUnicode, FeatureBubbleGeometry}
+
+// what RenderElection can do
+var goFeatures = []string{FeatureBubbleGeometry, FeatureRenderOptions, FeaturePdfA, FeatureWatermark, FeatureHighContrast, FeaturePartyColumn, FeatureStraightParty, FeatureMeasureText}
+
+// how long a backend's /capabilities answer is kept, it may be upgraded underneath us
+const featuresTTL = 5 * time.Minute
+
+// UnsupportedError is a document needing features the backend doesn't have
+type UnsupportedError struct {
+	Missing []string
+}
+
+func (ue *UnsupportedError) Error() string {
+	return "draw backend can't do " + strings.Join(ue.Missing, ", ")
+}
+
+func featureSet(features []string) map[string]bool {
+	out := make(map[string]bool, len(features))
+	for _, f := range features {
+		out[f] = true
+	}
+	return out
+}
+
+// Features the backend has. If the backend can't be asked, the last answer
+// it gave is used, or failing that what draw.py has always done; drawing
+// will fail anyway if it is down.
+func (c *Client) Features(ctx context.Context) map[string]bool {
+	if c.BackendUrl == "" {
+		return featureSet(goFeatures)
+	}
+	c.lock.Lock()
+	features, fresh := c.features, time.Now().Before(c.featuresUntil)
+	c.lock.Unlock()
+	if fresh {
+		return features
+	}
+	if !c.Open() {
+		got, err := c.getFeatures(ctx)
+		if err == nil {
+			c.lock.Lock()
+			c.features, c.featuresUntil = got, time.Now().Add(featuresTTL)
+			c.lock.Unlock()
+			return got
+		}
+		debug("draw capabilities, %v\n", err)
+	}
+	if features == nil {
+		features = featureSet(legacyFeatures)
+	}
+	return features
+}
+
+func (c *Client) getFeatures(ctx context.Context) (map[string]bool, error) {
+	c.init()
+	baseurl, err := url.Parse(c.BackendUrl)
+	if err != nil {
+		return nil, fmt.Errorf("bad url, %v", err)
+	}
+	nurl := *baseurl
+	nurl.Path = path.Join(baseurl.Path, "/capabilities")
+	if c.Timeout > 0 {
+		var cf context.CancelFunc
+		ctx, cf = context.WithTimeout(ctx, c.Timeout)
+		defer cf()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", nurl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return featureSet(legacyFeatures), nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET capabilities %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var caps struct {
+		Features []string `json:"features"`
+	}
+	err = json.Unmarshal(body, &caps)
+	if err != nil {
+		return nil, fmt.Errorf("bad capabilities, %v", err)
+	}
+	return featureSet(caps.Features), nil
+}
+
+// NeededFeatures lists what drawing the election document takes, sorted
+func NeededFeatures(electionjson string) []string {
+	var doc interface{}
+	json.Unmarshal([]byte(electionjson), &doc)
+	need := make(map[string]bool)
+	neededFeatures(doc, need)
+	out := make([]string, 0, len(need))
+	for f := range need {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func neededFeatures(v interface{}, need map[string]bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range x {
+			switch k {
+			case "PhotoUri", "LogoUri":
+				if hasUri(sub) {
+					need[FeatureImages] = true
+				}
+				continue
+			case "BallotImages":
+				if list, ok := sub.([]interface{}); ok {
+					for _, bi := range list {
+						if bim, ok := bi.(map[string]interface{}); ok && hasUri(bim["Uri"]) {
+							need[FeatureImages] = true
+						}
+					}
+				}
+				continue
+			case "Fonts":
+				if list, ok := sub.([]interface{}); ok {
+					for _, font := range list {
+						if fm, ok := font.(map[string]interface{}); ok && hasUri(fm["Uri"]) {
+							need[FeatureFonts] = true
+						}
+					}
+				}
+				continue
+			case "BubbleGeometry":
+				if sub != nil {
+					need[FeatureBubbleGeometry] = true
+				}
+			case "@type":
+				if sub == "ElectionResults.PartyContest" {
+					need[FeatureStraightParty] = true
+				}
+			case "PrintFullText":
+				if sub == true {
+					need[FeatureMeasureText] = true
+				}
+			}
+			neededFeatures(sub, need)
+		}
+	case []interface{}:
+		for _, sub := range x {
+			neededFeatures(sub, need)
+		}
+	case string:
+		for _, r := range x {
+			if r > 0xff {
+				need[FeatureUnicode] = true
+				break
+			}
+		}
+	}
+}
+
+// hasUri is true for a non empty string, NIST AnnotatedUri {"Content": uri}, or a list with one
+func hasUri(v interface{}) bool {
+	switch x := v.(type) {
+	case string:
+		return x != ""
+	case map[string]interface{}:
+		return hasUri(x["Content"])
+	case []interface{}:
+		for _, sub := range x {
+			if hasUri(sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check the document against the backend's features, before drawing.
+// extra is needed beyond what is in the document, like FeaturePamphlet;
+// strict doesn't allow degrading.
+func (c *Client) check(ctx context.Context, electionjson string, strict bool, extra ...string) (warnings []string, err error) {
+	need := append(NeededFeatures(electionjson), extra...)
+	have := c.Features(ctx)
+	var missing []string
+	for _, f := range need {
+		if have[f] {
+			continue
+		}
+		if why, ok := Degradable[f]; ok && !strict {
+			warnings = append(warnings, why)
+			continue
+		}
+		missing = append(missing, f)
+	}
+	if len(missing) != 0 {
+		return nil, &UnsupportedError{missing}
+	}
+	return warnings, nil
+}
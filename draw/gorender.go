@@ -0,0 +1,1368 @@
+package draw
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RenderElection draws ballots without a draw backend. It is the fallback
+// when ballotstudio runs with no -draw-backend, so the editor preview,
+// bubbles json and the scan demo work with nothing else installed.
+//
+// It follows draw.py's layout (page header, columns of contests,
+// bubble to the left of each selection, the same bubbles json) but is
+// lower fidelity: all text is Courier so it can be measured without font
+// metrics, text wraps by character count, there are no candidate photos or
+// party logos, and only ASCII is drawn in the page PNGs. It draws the page
+// PNGs itself (DrawBothOb.Png) so pdftoppm isn't needed either.
+// opts are used as they are, Client.DrawElection merges in the document's.
+func RenderElection(electionjson string, opts RenderOptions) (both *DrawBothOb, err error) {
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(electionjson), &doc)
+	if err != nil {
+		return nil, fmt.Errorf("election json, %v", err)
+	}
+	elections := jsonList(doc, "Election")
+	if len(elections) == 0 {
+		return nil, errors.New("no Election in document")
+	}
+	// printed measure text size, see data.MeasureTextRules
+	measureSize := goMeasureFontSize
+	if mt, ok := elections[0]["MeasureText"].(map[string]interface{}); ok {
+		if fs, ok := mt["FontSize"].(float64); ok && fs > 0 {
+			measureSize = fs
+		}
+	}
+	gr := goRenderer{
+		obs:      make(map[string]map[string]interface{}),
+		election: elections[0],
+		created:  time.Now().UTC(),
+		gs:       newGoSettings(opts, measureSize),
+	}
+	gr.now = "generated " + gr.created.Format("2006-01-02 15:04:05 UTC")
+	gatherIds(gr.obs, doc)
+	if gr.gs.partyColumn {
+		gr.partyColumns(doc)
+	}
+	styles := jsonList(gr.election, "BallotStyle")
+	if len(styles) == 0 {
+		return nil, errors.New("no BallotStyle to draw")
+	}
+
+	canvas := goCanvas{width: gr.gs.pageWidth, height: gr.gs.pageHeight, watermark: gr.gs.watermark}
+	bj := goBubbles{
+		Version: 1,
+		DrawSettings: goDrawSettings{
+			PageSize:   []float64{gr.gs.pageWidth, gr.gs.pageHeight},
+			PageMargin: goPageMargin,
+			Columns:    gr.gs.columns,
+			Duplex:     gr.gs.duplex,
+			Layout:     gr.layout(),
+			Renderer:   "go",
+		},
+	}
+	for i, bs := range styles {
+		// first pass to count pages for "page N of M"
+		pages, _ := gr.drawStyle(nil, bs, i+1, "X")
+		pages, sd := gr.drawStyle(&canvas, bs, i+1, strconv.Itoa(pages))
+		if gr.gs.duplex && pages%2 == 1 {
+			// blank back, so the next style starts on a new sheet
+			canvas.showPage()
+			sd.Pages++
+		}
+		bj.BallotStyles = append(bj.BallotStyles, sd)
+		bj.Bubbles = append(bj.Bubbles, sd.Bubbles)
+		bj.Headers = append(bj.Headers, sd.Headers)
+	}
+
+	var meta *pdfMeta
+	if gr.gs.pdfa {
+		meta = gr.pdfMeta(styles)
+	}
+	both = &DrawBothOb{Pdf: canvas.pdf(meta)}
+	both.BubblesJson, err = json.Marshal(bj)
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range canvas.pages {
+		var pb bytes.Buffer
+		err = png.Encode(&pb, page.raster())
+		if err != nil {
+			return nil, err
+		}
+		both.Png = append(both.Png, pb.Bytes())
+	}
+	return both, nil
+}
+
+// ErrNoPamphlet is from Client.DrawPamphlet with no backend, only draw.py makes pamphlets
+var ErrNoPamphlet = errors.New("voter pamphlets need a draw backend")
+
+// all in points, the defaults for US Letter
+const (
+	goPageWidth    = 612.0
+	goPageHeight   = 792.0
+	goPageMargin   = 36.0
+	goColumnMargin = 7.2
+
+	// pdftoppm's default, so the PNGs match what draw.py's would be
+	goPngDPI = 150
+
+	goHeaderFontSize      = 12.0
+	goHeaderLeading       = 14.0
+	goTitleFontSize       = 11.0
+	goTitleLeading        = 15.0
+	goCandidateFontSize   = 10.0
+	goCandidateLeading    = 12.0
+	goInstructionFontSize = 8.0
+	goInstructionLeading  = 9.6
+	goNowFontSize         = 8.0
+	goFooterFontSize      = 10.0
+	goFooterLeading       = 12.0
+	goMeasureFontSize     = 10.0
+	goMeasureLeading      = 1.2 // times the measure text size
+	goWriteInHeight       = 21.6
+	goTitleGray           = 0.85
+	goSubtitleGray        = 0.93
+
+	// light enough to read the ballot through and not look marked to a scanner
+	goWatermarkGray = 0.8
+
+	// Courier: every character is 0.6 em wide, capitals about 0.57 em tall
+	courierAdvance   = 0.6
+	courierCapHeight = 0.57
+)
+
+var electionTypeTitles = map[string]string{
+	"general":                 "General Election",
+	"partisan-primary-closed": "Primary Election",
+	"partisan-primary-open":   "Primary Election",
+	"primary":                 "Primary Election",
+	"runoff":                  "Runoff Election",
+	"special":                 "Special Election",
+}
+
+// BallotInstructions are the paragraphs under a ballot style's Instructions header
+var BallotInstructions = []string{
+	"Fill in the oval to the left of the name of your choice. You must blacken the oval completely, and do not make any marks outside of the oval. You do not have to vote in every race.",
+	"Do not cross out or erase, or your vote may not count. If you make a mistake or a stray mark, ask for a new ballot from the poll workers.",
+	"To add a candidate, fill in the oval to the left of \"write-in\" and print the name clearly on the dotted line.",
+}
+
+// bubbles json, as draw.py's ElectionPrinter.getBubbles() makes it
+type goBubbles struct {
+	// scan.BubblesVersion1
+	Version      int                               `json:"version"`
+	DrawSettings goDrawSettings                    `json:"draw_settings"`
+	BallotStyles []goStyleData                     `json:"bsdata"`
+	Bubbles      []map[string]map[string][]float64 `json:"bubbles"`
+	Headers      []map[string][]float64            `json:"headers"`
+}
+
+type goDrawSettings struct {
+	PageSize   []float64 `json:"pagesize"`
+	PageMargin float64   `json:"pageMargin"`
+	Columns    int       `json:"columns"`
+	Duplex     bool      `json:"duplex"`
+	Layout     string    `json:"layout,omitempty"`
+	Renderer   string    `json:"renderer"`
+}
+
+// goSettings is the page size, columns and font sizes of one RenderElection
+type goSettings struct {
+	pageWidth, pageHeight float64
+	columns               int
+	duplex                bool
+	pdfa                  bool
+	watermark             string // across every page, for proofs
+	partyColumn           bool   // LayoutPartyColumn
+
+	// title and subtitle bar fills, white for high contrast
+	titleGray, subtitleGray float64
+
+	headerSize, headerLeading           float64
+	titleSize, titleLeading             float64
+	candidateSize, candidateLeading     float64
+	instructionSize, instructionLeading float64
+	footerSize, footerLeading           float64
+	measureSize, measureLeading         float64
+	nowSize                             float64
+}
+
+func newGoSettings(opts RenderOptions, measureSize float64) *goSettings {
+	gs := &goSettings{columns: opts.columns(), duplex: opts.Duplex, pdfa: opts.PdfA, partyColumn: opts.Layout == LayoutPartyColumn, titleGray: goTitleGray, subtitleGray: goSubtitleGray}
+	if opts.Proof {
+		gs.watermark = ProofWatermark
+	}
+	if opts.HighContrast {
+		gs.titleGray, gs.subtitleGray = 1, 1
+	}
+	gs.pageWidth, gs.pageHeight = opts.pageSize()
+	// text under MinFontSize grows to it, and its line spacing with it
+	font := func(size, leading float64) (float64, float64) {
+		if size >= opts.MinFontSize {
+			return size, leading
+		}
+		return opts.MinFontSize, leading * opts.MinFontSize / size
+	}
+	gs.headerSize, gs.headerLeading = font(goHeaderFontSize, goHeaderLeading)
+	gs.titleSize, gs.titleLeading = font(goTitleFontSize, goTitleLeading)
+	gs.candidateSize, gs.candidateLeading = font(goCandidateFontSize, goCandidateLeading)
+	gs.instructionSize, gs.instructionLeading = font(goInstructionFontSize, goInstructionLeading)
+	gs.footerSize, gs.footerLeading = font(goFooterFontSize, goFooterLeading)
+	gs.measureSize, gs.measureLeading = font(measureSize, measureSize*goMeasureLeading)
+	gs.nowSize, _ = font(goNowFontSize, goNowFontSize)
+	return gs
+}
+
+type goStyleData struct {
+	GpUnitIds   []string                        `json:"GpUnitIds"`
+	Bubbles     map[string]map[string][]float64 `json:"bubbles"`
+	BubblePages map[string]int                  `json:"bubble_pages"`
+	Pages       int                             `json:"pages"`
+	Headers     map[string][]float64            `json:"headers"`
+}
+
+// Contest extension field BubbleGeometry, see data.CheckBubbleGeometry
+type bubbleGeometry struct {
+	Width, Height, LeftPad, RightPad, OffsetX, OffsetY, Spacing float64
+}
+
+func contestGeometry(contest map[string]interface{}) bubbleGeometry {
+	g := bubbleGeometry{Width: 8 * 72 / 25.4, Height: 3 * 72 / 25.4, LeftPad: 7.2, RightPad: 7.2, Spacing: 7.2}
+	bg, _ := contest["BubbleGeometry"].(map[string]interface{})
+	for key, dest := range map[string]*float64{
+		"Width": &g.Width, "Height": &g.Height, "LeftPad": &g.LeftPad, "RightPad": &g.RightPad,
+		"OffsetX": &g.OffsetX, "OffsetY": &g.OffsetY, "Spacing": &g.Spacing,
+	} {
+		if v, ok := bg[key].(float64); ok {
+			*dest = v
+		}
+	}
+	return g
+}
+
+// coords is [left, bottom, width, height] of the bubble for a selection with
+// top left x,y and text of size
+func (g bubbleGeometry) coords(x, y, size float64) []float64 {
+	capHeight := courierCapHeight * size
+	shim := (capHeight - g.Height) / 2
+	bottom := y - size + shim + g.OffsetY
+	return []float64{x + g.LeftPad + g.OffsetX, bottom, g.Width, g.Height}
+}
+
+func (g bubbleGeometry) textx(x float64) float64 {
+	return x + g.LeftPad + g.Width + g.RightPad
+}
+
+type goRenderer struct {
+	obs      map[string]map[string]interface{} // by @id
+	election map[string]interface{}
+	created  time.Time
+	now      string
+	gs       *goSettings
+
+	// for LayoutPartyColumn, the party @ids that have a column, "" for the
+	// column of everyone else
+	parties []string
+}
+
+func (gr *goRenderer) layout() string {
+	if gr.gs.partyColumn {
+		return LayoutPartyColumn
+	}
+	return LayoutOfficeBlock
+}
+
+// partyColumns sets gr.parties to the document's parties that have
+// selections on the ballot, in document order, then "" if any selection has
+// no party
+func (gr *goRenderer) partyColumns(doc map[string]interface{}) {
+	used := make(map[string]bool)
+	for _, contest := range jsonList(gr.election, "Contest") {
+		if !partisan(contest) {
+			continue
+		}
+		for _, cs := range jsonList(contest, "ContestSelection") {
+			used[gr.selection(cs).party] = true
+		}
+	}
+	gr.parties = nil
+	for _, party := range append(jsonList(doc, "Party"), jsonList(gr.election, "Party")...) {
+		if id, _ := party["@id"].(string); used[id] {
+			gr.parties = append(gr.parties, id)
+			delete(used, id)
+		}
+	}
+	if len(used) != 0 {
+		gr.parties = append(gr.parties, "")
+	}
+}
+
+// partisan contests are party-column rows, ballot measures and the rest
+// span the ballot
+func partisan(contest map[string]interface{}) bool {
+	switch contest["@type"] {
+	case "ElectionResults.CandidateContest", "ElectionResults.PartyContest":
+		return true
+	}
+	return false
+}
+
+func gatherIds(out map[string]map[string]interface{}, v interface{}) {
+	switch xv := v.(type) {
+	case map[string]interface{}:
+		if id, ok := xv["@id"].(string); ok {
+			out[id] = xv
+		}
+		for _, sub := range xv {
+			gatherIds(out, sub)
+		}
+	case []interface{}:
+		for _, sub := range xv {
+			gatherIds(out, sub)
+		}
+	}
+}
+
+func jsonList(ob map[string]interface{}, key string) (out []map[string]interface{}) {
+	they, _ := ob[key].([]interface{})
+	for _, x := range they {
+		if m, ok := x.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return
+}
+
+func jsonStringList(ob map[string]interface{}, key string) []string {
+	out := []string{}
+	they, _ := ob[key].([]interface{})
+	for _, x := range they {
+		if s, ok := x.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// jsonText is a plain string or an InternationalizedText, preferring English
+func jsonText(v interface{}) string {
+	switch xv := v.(type) {
+	case string:
+		return xv
+	case map[string]interface{}:
+		texts, _ := xv["Text"].([]interface{})
+		first := ""
+		for i, t := range texts {
+			tm, _ := t.(map[string]interface{})
+			content, _ := tm["Content"].(string)
+			if i == 0 {
+				first = content
+			}
+			if lang, _ := tm["Language"].(string); lang == "en" {
+				return content
+			}
+		}
+		return first
+	}
+	return ""
+}
+
+// ElectionTypeTitle is what the page header calls an election, like
+// "General Election", from its Type or OtherType
+func ElectionTypeTitle(election map[string]interface{}) string {
+	etype, _ := election["Type"].(string)
+	if title, ok := electionTypeTitles[etype]; ok {
+		return title
+	}
+	return jsonText(election["OtherType"])
+}
+
+// pageTemplate is bs's PageHeader or PageFooter, see pagetext.go
+func (gr *goRenderer) pageTemplate(bs map[string]interface{}, field string) string {
+	if text, ok := StyleText(gr.election, bs, field); ok {
+		return text
+	}
+	if field == "PageHeader" {
+		return DefaultPageHeader
+	}
+	return ""
+}
+
+// goContent is one OrderedContent entry. layout draws it at x,y (top
+// left) if c isn't nil, and returns its height either way.
+type goContent interface {
+	layout(c *goCanvas, x, y, width float64) (height float64, bubbles map[string][]float64)
+}
+
+type goContest struct {
+	gs         *goSettings
+	id         string
+	title      string
+	subtitle   string
+	selections []goSelection
+	geom       bubbleGeometry
+	parties    []string // goRenderer.parties, for a party-column row
+}
+
+type goSelection struct {
+	id      string
+	name    string
+	subtext string
+	writeIn bool
+	party   string // @id of the first party, for party-column layout
+}
+
+type goInstructionsHeader struct {
+	gs *goSettings
+	// the style's Instructions, "" for BallotInstructions
+	text string
+}
+
+// goBreak is a ColumnBreak or PageBreak header
+type goBreak struct {
+	page bool
+}
+
+func (gr *goRenderer) content(oc map[string]interface{}) goContent {
+	if hid, ok := oc["HeaderId"].(string); ok {
+		switch jsonText(gr.obs[hid]["Name"]) {
+		case "Instructions":
+			return goInstructionsHeader{gs: gr.gs}
+		case "ColumnBreak":
+			return goBreak{page: false}
+		case "PageBreak":
+			return goBreak{page: true}
+		}
+		return nil
+	}
+	cid, _ := oc["ContestId"].(string)
+	contest := gr.obs[cid]
+	if contest == nil {
+		return nil
+	}
+	gc := &goContest{
+		gs:       gr.gs,
+		id:       cid,
+		title:    jsonText(contest["BallotTitle"]),
+		subtitle: jsonText(contest["BallotSubTitle"]),
+		geom:     contestGeometry(contest),
+	}
+	if partisan(contest) {
+		gc.parties = gr.parties
+	}
+	if gc.title == "" {
+		gc.title = jsonText(contest["Name"])
+	}
+	selections := jsonList(contest, "ContestSelection")
+	if order := jsonStringList(oc, "OrderedContestSelectionIds"); len(order) != 0 {
+		byid := make(map[string]map[string]interface{}, len(selections))
+		for _, cs := range selections {
+			id, _ := cs["@id"].(string)
+			byid[id] = cs
+		}
+		selections = nil
+		for _, id := range order {
+			if cs := byid[id]; cs != nil {
+				selections = append(selections, cs)
+			}
+		}
+	}
+	for _, cs := range selections {
+		gc.selections = append(gc.selections, gr.selection(cs))
+	}
+	return gc
+}
+
+// measureText is the contest's FullText if it has "PrintFullText", nil otherwise
+func (gr *goRenderer) measureText(oc map[string]interface{}) *goMeasureText {
+	cid, _ := oc["ContestId"].(string)
+	contest := gr.obs[cid]
+	if p, _ := contest["PrintFullText"].(bool); !p {
+		return nil
+	}
+	text := jsonText(contest["FullText"])
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	title := jsonText(contest["BallotTitle"])
+	if title == "" {
+		title = jsonText(contest["Name"])
+	}
+	return &goMeasureText{gs: gr.gs, title: title + ", full text", text: text}
+}
+
+func (gr *goRenderer) selection(cs map[string]interface{}) goSelection {
+	sel := goSelection{}
+	sel.id, _ = cs["@id"].(string)
+	if _, ok := cs["Selection"]; ok {
+		// BallotMeasureSelection
+		sel.name = jsonText(cs["Selection"])
+		return sel
+	}
+	if pids := jsonStringList(cs, "PartyIds"); len(pids) != 0 {
+		// PartySelection, straight-party
+		var names []string
+		for _, pid := range pids {
+			names = append(names, jsonText(gr.obs[pid]["Name"]))
+		}
+		sel.name = strings.Join(names, ", ")
+		sel.party = pids[0]
+		return sel
+	}
+	sel.writeIn, _ = cs["IsWriteIn"].(bool)
+	cids := jsonStringList(cs, "CandidateIds")
+	if len(cids) != 0 {
+		sel.name = jsonText(gr.obs[cids[0]]["BallotName"])
+		if sel.name == "" {
+			sel.name = "error: Ballot Name is required in csel for " + strings.Join(cids, " ")
+		}
+	} else if !sel.writeIn {
+		sel.name = "error: no candidates in selection"
+	}
+	var parties []string
+	for _, pid := range jsonStringList(cs, "EndorsementPartyIds") {
+		if sel.party == "" {
+			sel.party = pid
+		}
+		parties = append(parties, jsonText(gr.obs[pid]["Name"]))
+	}
+	if len(parties) == 0 {
+		for _, cid := range cids {
+			pid := jsonText(gr.obs[cid]["PartyId"])
+			if pid == "" {
+				pid = jsonText(gr.obs[jsonText(gr.obs[cid]["PersonId"])]["PartyId"])
+			}
+			if party := gr.obs[pid]; party != nil {
+				if sel.party == "" {
+					sel.party = pid
+				}
+				parties = append(parties, jsonText(party["Name"]))
+			}
+		}
+	}
+	sel.subtext = strings.Join(parties, ", ")
+	return sel
+}
+
+func (sel goSelection) layout(c *goCanvas, gs *goSettings, geom bubbleGeometry, x, y, width float64) (height float64, bubble []float64) {
+	bubble = geom.coords(x, y, gs.candidateSize)
+	c.bubble(bubble, false)
+	textx := geom.textx(x)
+	textw := x + width - textx
+	pos := y
+	for _, line := range wrapColumns(sel.name, gs.candidateSize, textw) {
+		c.text(textx, pos-gs.candidateSize, gs.candidateSize, true, line)
+		pos -= gs.candidateLeading
+	}
+	for _, line := range wrapColumns(sel.subtext, gs.candidateSize, textw) {
+		c.text(textx, pos-gs.candidateSize, gs.candidateSize, false, line)
+		pos -= gs.candidateLeading
+	}
+	if sel.writeIn {
+		c.text(textx, pos-gs.candidateSize, gs.candidateSize, false, "write-in:")
+		pos -= gs.candidateLeading + goWriteInHeight
+		c.line(textx, pos, x+width, pos, 0.5, true)
+	}
+	pos -= geom.Spacing
+	c.line(textx, pos, x+width, pos, 0.25, false)
+	return y - pos, bubble
+}
+
+// titleBars draws the gray title and blue subtitle bars, returning the y below them
+func titleBars(c *goCanvas, gs *goSettings, x, y, width float64, title, subtitle string) float64 {
+	textx := x + 1 + 7.2
+	textw := width - 1 - 7.2 - 2
+	for _, bar := range []struct {
+		text string
+		gray float64
+	}{{title, gs.titleGray}, {subtitle, gs.subtitleGray}} {
+		for _, line := range wrapColumns(bar.text, gs.titleSize, textw) {
+			if bar.gray < 1 {
+				c.fillRect(x, y-gs.titleLeading, width, gs.titleLeading, bar.gray)
+			}
+			c.textTag("H2", textx, y-gs.titleSize, gs.titleSize, true, line)
+			y -= gs.titleLeading
+		}
+	}
+	return y
+}
+
+// borders draws the heavy top line and the left and bottom lines of a box from top to bottom
+func borders(c *goCanvas, x, top, bottom, width float64) {
+	c.line(x, top-1.5, x+width, top-1.5, 3, false)
+	c.line(x+0.5, top-1.5, x+0.5, bottom-0.5, 1, false)
+	c.line(x, bottom-0.5, x+width, bottom-0.5, 1, false)
+}
+
+func (gc *goContest) layout(c *goCanvas, x, y, width float64) (height float64, bubbles map[string][]float64) {
+	if gc.parties != nil {
+		return gc.rowLayout(c, x, y, width)
+	}
+	// room for the 3pt top border
+	pos := titleBars(c, gc.gs, x, y-3, width, gc.title, gc.subtitle)
+	pos -= 7.2
+	// every selection gets the height of the tallest, except a taller write-in
+	maxheight := 0.0
+	for _, sel := range gc.selections {
+		if sel.writeIn {
+			continue
+		}
+		if h, _ := sel.layout(nil, gc.gs, gc.geom, 0, 0, width-1); h > maxheight {
+			maxheight = h
+		}
+	}
+	bubbles = make(map[string][]float64, len(gc.selections))
+	for _, sel := range gc.selections {
+		h, bubble := sel.layout(c, gc.gs, gc.geom, x+1, pos, width-1)
+		bubbles[sel.id] = bubble
+		pos -= math.Max(h, maxheight)
+	}
+	pos -= 7.2
+	borders(c, x, y, pos, width)
+	return y - pos + 1, bubbles
+}
+
+// party-column layout: the contest title takes this much of a row, the
+// party columns share the rest
+const goPartyTitleFraction = 0.25
+
+// partyCells is the x and width of each party column of a row
+func partyCells(x, width float64, parties []string) (titleWidth, cellWidth float64, cellx []float64) {
+	titleWidth = width * goPartyTitleFraction
+	cellWidth = (width - titleWidth) / float64(len(parties))
+	for i := range parties {
+		cellx = append(cellx, x+titleWidth+cellWidth*float64(i))
+	}
+	return
+}
+
+// rowLayout draws the contest as a party-column row: its title at the left,
+// then each selection under its party's column
+func (gc *goContest) rowLayout(c *goCanvas, x, y, width float64) (height float64, bubbles map[string][]float64) {
+	titleWidth, cellWidth, cellx := partyCells(x, width, gc.parties)
+	bottom := titleBars(c, gc.gs, x, y-3, titleWidth, gc.title, gc.subtitle)
+	column := make(map[string]int, len(gc.parties))
+	for i, pid := range gc.parties {
+		column[pid] = i
+	}
+	other := len(gc.parties) - 1
+	cellpos := make([]float64, len(gc.parties))
+	for i := range cellpos {
+		cellpos[i] = y - 3 - 7.2
+	}
+	bubbles = make(map[string][]float64, len(gc.selections))
+	for _, sel := range gc.selections {
+		i, ok := column[sel.party]
+		if !ok {
+			i = other
+		}
+		h, bubble := sel.layout(c, gc.gs, gc.geom, cellx[i]+1, cellpos[i], cellWidth-1)
+		bubbles[sel.id] = bubble
+		cellpos[i] -= h
+	}
+	for _, pos := range cellpos {
+		bottom = math.Min(bottom, pos)
+	}
+	bottom -= 7.2
+	for _, cx := range cellx {
+		c.line(cx, y-1.5, cx, bottom, 0.5, false)
+	}
+	borders(c, x, y, bottom, width)
+	return y - bottom + 1, bubbles
+}
+
+// goMeasureText is a ballot measure's full text, flowed across columns and
+// pages ahead of the measure. Blank lines separate paragraphs and a
+// paragraph starting "# " is a bold heading.
+type goMeasureText struct {
+	gs    *goSettings
+	title string
+	text  string
+}
+
+// a wrapped line of measure text
+type goTextLine struct {
+	text        string
+	bold        bool
+	first, last bool    // of its paragraph
+	height      float64 // leading, and the space after a paragraph's last line
+}
+
+// widow and orphan control: a paragraph broken across columns leaves at
+// least this many lines on each side
+const (
+	goOrphanLines = 2
+	goWidowLines  = 2
+)
+
+// lines wraps the text to width
+func (mt *goMeasureText) lines(width float64) (out []goTextLine) {
+	gs := mt.gs
+	add := func(para string, bold bool) {
+		wrapped := wrapColumns(para, gs.measureSize, width-7.2)
+		for i, line := range wrapped {
+			tl := goTextLine{text: line, bold: bold, first: i == 0, last: i == len(wrapped)-1, height: gs.measureLeading}
+			if tl.last {
+				tl.height += gs.measureLeading / 2
+			}
+			out = append(out, tl)
+		}
+	}
+	add(mt.title, true)
+	var para []string
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		text := strings.Join(para, "\n")
+		if strings.HasPrefix(text, "# ") {
+			add(strings.TrimPrefix(text, "# "), true)
+		} else {
+			add(text, false)
+		}
+		para = nil
+	}
+	for _, line := range strings.Split(mt.text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		para = append(para, line)
+	}
+	flush()
+	return out
+}
+
+// breakLines is how many of lines to put in height: as many as fit, but
+// not a heading alone at the bottom, nor fewer than goOrphanLines of a
+// paragraph at the bottom or goWidowLines at the top of the next column.
+// At the top of a column it is always at least one.
+func breakLines(lines []goTextLine, height float64, top bool) int {
+	fit := 0
+	for used := 0.0; fit < len(lines) && used+lines[fit].height <= height; fit++ {
+		used += lines[fit].height
+	}
+	n := fit
+	if n < len(lines) && !lines[n].first {
+		start, end := n, n
+		// lines may start partway through a paragraph, continued from the last column
+		for start > 0 && !lines[start].first {
+			start--
+		}
+		for !lines[end].last {
+			end++
+		}
+		if after := end + 1 - n; after < goWidowLines {
+			n -= goWidowLines - after
+		}
+		if n-start < goOrphanLines {
+			n = start
+		}
+	}
+	// keep headings with what follows
+	for n > 0 && n < len(lines) && lines[n-1].bold {
+		n--
+	}
+	if n == 0 && top {
+		n = fit
+		if n == 0 {
+			n = 1
+		}
+	}
+	return n
+}
+
+// drawLines draws lines of measure text, returning their height
+func (mt *goMeasureText) drawLines(c *goCanvas, lines []goTextLine, x, y float64) float64 {
+	gs := mt.gs
+	pos := y
+	for _, line := range lines {
+		tag := "P"
+		if line.bold {
+			tag = "H3"
+		}
+		c.textTag(tag, x+3.6, pos-gs.measureSize, gs.measureSize, line.bold, line.text)
+		pos -= line.height
+	}
+	return y - pos
+}
+
+// partyHeadings draws the party names over the party columns, returning their height
+func (gr *goRenderer) partyHeadings(c *goCanvas, x, y, width float64) float64 {
+	gs := gr.gs
+	_, cellWidth, cellx := partyCells(x, width, gr.parties)
+	bottom := y
+	for i, pid := range gr.parties {
+		name := "Other"
+		if pid != "" {
+			name = jsonText(gr.obs[pid]["Name"])
+		}
+		pos := y - 3.6
+		for _, line := range wrapColumns(name, gs.titleSize, cellWidth-7.2) {
+			c.textTag("TH", cellx[i]+3.6, pos-gs.titleSize, gs.titleSize, true, line)
+			pos -= gs.titleLeading
+		}
+		bottom = math.Min(bottom, pos)
+	}
+	return y - bottom + 3.6
+}
+
+func (ih goInstructionsHeader) layout(c *goCanvas, x, y, width float64) (height float64, bubbles map[string][]float64) {
+	gs := ih.gs
+	pos := titleBars(c, gs, x, y-3, width, "Instructions", "")
+	textx := x + 1 + 7.2
+	textw := width - 1 - 7.2 - 2
+	pos -= 7.2
+	if ih.text != "" {
+		pos = ih.layoutText(c, textx, pos, textw)
+		borders(c, x, y, pos, width)
+		return y - pos + 1, nil
+	}
+	geom := contestGeometry(nil)
+	for i, para := range BallotInstructions {
+		if i != 1 {
+			// an example of a filled in bubble
+			example := geom.coords(textx-geom.LeftPad, pos, gs.candidateSize)
+			c.bubble(example, i == 0)
+			pos -= gs.candidateLeading
+		}
+		for _, line := range wrapColumns(para, gs.instructionSize, textw) {
+			c.text(textx, pos-gs.instructionSize, gs.instructionSize, false, line)
+			pos -= gs.instructionLeading
+		}
+		pos -= gs.instructionLeading
+	}
+	borders(c, x, y, pos, width)
+	return y - pos + 1, nil
+}
+
+// layoutText draws Instructions rich text from x,y, returning the bottom
+func (ih goInstructionsHeader) layoutText(c *goCanvas, x, y, width float64) float64 {
+	gs := ih.gs
+	pos := y
+	bulletIndent := 2 * courierAdvance * gs.instructionSize
+	for _, block := range ParseInstructions(ih.text) {
+		textx, textw := x, width
+		if block.Bullet {
+			c.text(x, pos-gs.instructionSize, gs.instructionSize, false, "-")
+			textx += bulletIndent
+			textw -= bulletIndent
+		}
+		for _, line := range wrapColumns(block.Text, gs.instructionSize, textw) {
+			c.text(textx, pos-gs.instructionSize, gs.instructionSize, block.Heading, line)
+			pos -= gs.instructionLeading
+		}
+		if !block.Bullet {
+			pos -= gs.instructionLeading / 2
+		}
+	}
+	return pos - gs.instructionLeading/2
+}
+
+func (goBreak) layout(c *goCanvas, x, y, width float64) (height float64, bubbles map[string][]float64) {
+	return 0, nil
+}
+
+// drawStyle lays out one ballot style, number styleNum from 1, onto c unless
+// it is nil. numPages fills in {PAGES} in the page header and footer.
+func (gr *goRenderer) drawStyle(c *goCanvas, bs map[string]interface{}, styleNum int, numPages string) (pages int, sd goStyleData) {
+	sd = goStyleData{
+		GpUnitIds:   jsonStringList(bs, "GpUnitIds"),
+		Bubbles:     make(map[string]map[string][]float64),
+		BubblePages: make(map[string]int),
+		Headers:     make(map[string][]float64),
+	}
+	gs := gr.gs
+	headerTemplate := gr.pageTemplate(bs, "PageHeader")
+	footerTemplate := gr.pageTemplate(bs, "PageFooter")
+	fields := PageFields(gr.obs, gr.election, bs, styleNum)
+	instructions, _ := StyleText(gr.election, bs, "Instructions")
+	left := goPageMargin
+	right := gs.pageWidth - goPageMargin
+	bottom := goPageMargin
+	page := 1
+	// pageHeader draws the header and returns the top of the content below it
+	pageHeader := func() float64 {
+		top := gs.pageHeight - goPageMargin
+		c.line(left, top, right, top, 1, false)
+		text := FillPageText(headerTemplate, fields, page, numPages)
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			c.textTag("H1", left+7.2, top-gs.headerSize-float64(i)*gs.headerLeading, gs.headerSize, true, line)
+		}
+		height := gs.headerLeading*float64(len(lines)) + 7.2
+		sd.Headers[strconv.Itoa(page)] = []float64{left + 7.2, top, right, top - height}
+		if gs.partyColumn {
+			// party names over their columns on every page
+			height += gr.partyHeadings(c, left, top-height, right-left)
+		}
+		return top - height
+	}
+	// pageFooter draws the footer above bottom and returns the bottom of the content above it
+	pageFooter := func(bottom float64) float64 {
+		if footerTemplate == "" {
+			return bottom
+		}
+		lines := strings.Split(FillPageText(footerTemplate, fields, page, numPages), "\n")
+		for i, line := range lines {
+			y := bottom + float64(len(lines)-1-i)*gs.footerLeading
+			c.textTag("P", left+7.2, y+gs.footerSize*0.2, gs.footerSize, false, line)
+		}
+		bottom += gs.footerLeading*float64(len(lines)) + 3.6
+		c.line(left, bottom, right, bottom, 1, false)
+		return bottom
+	}
+
+	// header first, it is first in a tagged PDF's reading order
+	top := pageHeader()
+	nowWidth := float64(len(gr.now)) * courierAdvance * gs.nowSize
+	c.text(right-nowWidth, bottom+gs.nowSize*0.2, gs.nowSize, false, gr.now)
+	bottom += gs.nowSize * 1.2
+	bottom = pageFooter(bottom)
+
+	columnWidth := (right - left - goColumnMargin*float64(gs.columns-1)) / float64(gs.columns)
+	x := left
+	y := top
+	column := 1
+	// nextColumn moves to the top of the next column, or of a new page
+	nextColumn := func(newPage bool) {
+		y = top
+		column++
+		if column > gs.columns || newPage {
+			c.showPage()
+			page++
+			column = 1
+			top = pageHeader()
+			bottom = pageFooter(goPageMargin)
+			x = left
+			y = top
+		} else {
+			x += columnWidth + goColumnMargin
+		}
+	}
+	for _, oc := range jsonList(bs, "OrderedContent") {
+		item := gr.content(oc)
+		if item == nil {
+			continue
+		}
+		if ih, ok := item.(goInstructionsHeader); ok {
+			ih.text = instructions
+			item = ih
+		}
+		if mt := gr.measureText(oc); mt != nil {
+			lines := mt.lines(columnWidth)
+			for {
+				n := breakLines(lines, y-bottom, y == top)
+				y -= mt.drawLines(c, lines[:n], x, y)
+				lines = lines[n:]
+				if len(lines) == 0 {
+					break
+				}
+				nextColumn(false)
+			}
+		}
+		brk, isBreak := item.(goBreak)
+		height, _ := item.layout(nil, 0, 0, columnWidth)
+		if isBreak || y-height < bottom {
+			nextColumn(brk.page)
+		}
+		if isBreak {
+			continue
+		}
+		_, bubbles := item.layout(c, x, y, columnWidth)
+		y -= height
+		y += 1 // bottom border and top border may overlap
+		if gc, ok := item.(*goContest); ok {
+			sd.Bubbles[gc.id] = bubbles
+			sd.BubblePages[gc.id] = page
+		}
+	}
+	c.showPage()
+	sd.Pages = page
+	return page, sd
+}
+
+// wrapColumns breaks s into lines that fit width points of Courier at size
+func wrapColumns(s string, size, width float64) (lines []string) {
+	if s == "" {
+		return nil
+	}
+	cols := int(width / (courierAdvance * size))
+	if cols < 1 {
+		cols = 1
+	}
+	for _, para := range strings.Split(s, "\n") {
+		line := []rune{}
+		for _, word := range strings.Fields(para) {
+			w := []rune(word)
+			for len(w) > cols {
+				if len(line) != 0 {
+					lines = append(lines, string(line))
+					line = line[:0]
+				}
+				lines = append(lines, string(w[:cols]))
+				w = w[cols:]
+			}
+			if len(line) == 0 {
+				line = append(line, w...)
+			} else if len(line)+1+len(w) <= cols {
+				line = append(append(line, ' '), w...)
+			} else {
+				lines = append(lines, string(line))
+				line = append([]rune{}, w...)
+			}
+		}
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+// goCanvas records drawing per page, to write out as PDF and as PNG.
+// Methods on a nil *goCanvas do nothing, for measuring.
+type goCanvas struct {
+	width, height float64 // page size in points
+	watermark     string  // drawn first on every page, under everything else
+
+	pages []*goPage
+	cur   *goPage
+}
+
+type goPage struct {
+	width, height float64
+	ops           []goOp
+}
+
+// goOp is one drawing operation, in points from the bottom left of the page
+type goOp struct {
+	kind byte // 'r' filled rectangle, 'l' line x,y to x2,y2, 'b' bubble, 't' text with baseline at y, 'w' watermark centered on x,y
+
+	x, y, w, h float64
+	x2, y2     float64
+	width      float64 // of lines
+	gray       float64 // rectangle fill, 0 black to 1 white
+	dashed     bool
+	filled     bool // bubble
+	bold       bool
+	size       float64 // font
+	text       string
+	tag        string  // structure type of text in a tagged PDF
+	angle      float64 // of watermark text, radians counterclockwise
+}
+
+func (c *goCanvas) add(op goOp) {
+	if c == nil {
+		return
+	}
+	if c.cur == nil {
+		c.newPage()
+	}
+	c.cur.ops = append(c.cur.ops, op)
+}
+
+func (c *goCanvas) newPage() {
+	c.cur = &goPage{width: c.width, height: c.height}
+	if c.watermark != "" {
+		// corner to corner, 80% of the diagonal
+		size := 0.8 * math.Hypot(c.width, c.height) / (float64(len(c.watermark)) * courierAdvance)
+		c.cur.ops = append(c.cur.ops, goOp{kind: 'w', x: c.width / 2, y: c.height / 2, size: size, bold: true, gray: goWatermarkGray, text: c.watermark, angle: math.Atan2(c.height, c.width)})
+	}
+}
+
+func (c *goCanvas) showPage() {
+	if c == nil {
+		return
+	}
+	if c.cur == nil {
+		c.newPage()
+	}
+	c.pages = append(c.pages, c.cur)
+	c.cur = nil
+}
+
+func (c *goCanvas) fillRect(x, y, w, h, gray float64) {
+	c.add(goOp{kind: 'r', x: x, y: y, w: w, h: h, gray: gray})
+}
+
+func (c *goCanvas) line(x, y, x2, y2, width float64, dashed bool) {
+	c.add(goOp{kind: 'l', x: x, y: y, x2: x2, y2: y2, width: width, dashed: dashed})
+}
+
+func (c *goCanvas) bubble(xywh []float64, filled bool) {
+	c.add(goOp{kind: 'b', x: xywh[0], y: xywh[1], w: xywh[2], h: xywh[3], filled: filled})
+}
+
+func (c *goCanvas) text(x, y, size float64, bold bool, text string) {
+	c.textTag("P", x, y, size, bold, text)
+}
+
+// textTag is text that is a tag (H1, H2, P) in the structure of a tagged PDF
+func (c *goCanvas) textTag(tag string, x, y, size float64, bold bool, text string) {
+	c.add(goOp{kind: 't', x: x, y: y, size: size, bold: bold, text: text, tag: tag})
+}
+
+// pdf writes the pages out, as PDF/A if meta isn't nil
+func (c *goCanvas) pdf(meta *pdfMeta) []byte {
+	var pw PdfWriter
+	catalog := pw.Alloc()
+	pagesObj := pw.Alloc()
+	var pdfa *pdfaWriter
+	var bold, regular int
+	if meta != nil {
+		pdfa = newPdfaWriter(&pw, meta)
+		bold, regular = pdfa.fonts()
+	} else {
+		bold = pw.Add("<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>")
+		regular = pw.Add("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	}
+	var kids []string
+	for _, page := range c.pages {
+		content, tags := page.pdfContent(pdfa != nil)
+		contentObj := pw.Stream("", content)
+		pageObj := pw.Alloc()
+		resources := fmt.Sprintf("/Font << /F1 %d 0 R /F2 %d 0 R >>", bold, regular)
+		var extra string
+		if pdfa != nil {
+			resources += pdfa.colorSpace()
+			extra = pdfa.page(pageObj, tags)
+		}
+		pw.Set(pageObj, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %g %g] /Resources << %s >> /Contents %d 0 R%s >>",
+			pagesObj, page.width, page.height, resources, contentObj, extra))
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageObj))
+	}
+	pw.Set(pagesObj, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	if pdfa != nil {
+		pw.Set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R%s >>", pagesObj, pdfa.catalog()))
+	} else {
+		pw.Set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesObj))
+	}
+	return pw.Bytes(catalog)
+}
+
+// pdfGray sets the fill (or stroke) gray to v, as DeviceGray, or for PDF/A
+// as the device independent /CS0 from pdfaWriter.colorSpace
+func pdfGray(v string, stroke, pdfa bool) string {
+	switch {
+	case pdfa && stroke:
+		return "/CS0 CS " + v + " SC"
+	case pdfa:
+		return "/CS0 cs " + v + " sc"
+	case stroke:
+		return v + " G"
+	}
+	return v + " g"
+}
+
+// pdfContent is the page's content stream. For PDF/A, each text op is
+// marked content numbered in order (MCID) and tags are their structure
+// types; everything else is marked as an artifact, decoration a screen
+// reader skips.
+func (p *goPage) pdfContent(pdfa bool) (content []byte, tags []string) {
+	var b bytes.Buffer
+	for _, op := range p.ops {
+		if pdfa && op.kind == 't' {
+			fmt.Fprintf(&b, "/%s << /MCID %d >> BDC\n", op.tag, len(tags))
+			tags = append(tags, op.tag)
+		} else if pdfa {
+			b.WriteString("/Artifact BMC\n")
+		}
+		switch op.kind {
+		case 'r':
+			fmt.Fprintf(&b, "%s %.2f %.2f %.2f %.2f re f\n", pdfGray(fmt.Sprintf("%.3f", op.gray), false, pdfa), op.x, op.y, op.w, op.h)
+		case 'l':
+			dash := "[] 0 d"
+			if op.dashed {
+				dash = "[4 4] 0 d"
+			}
+			fmt.Fprintf(&b, "%s %.2f w %s %.2f %.2f m %.2f %.2f l S\n", pdfGray("0", true, pdfa), op.width, dash, op.x, op.y, op.x2, op.y2)
+		case 'b':
+			inside := "1"
+			if op.filled {
+				inside = "0"
+			}
+			fmt.Fprintf(&b, "%s %s 1 w [] 0 d %s B\n", pdfGray(inside, false, pdfa), pdfGray("0", true, pdfa), stadiumPath(op.x, op.y, op.w, op.h))
+		case 't':
+			font := "/F2"
+			if op.bold {
+				font = "/F1"
+			}
+			text := PdfLatin1String(op.text)
+			if pdfa {
+				text = pdfASCIIString(op.text)
+			}
+			fmt.Fprintf(&b, "%s BT %s %g Tf %.2f %.2f Td %s Tj ET\n", pdfGray("0", false, pdfa), font, op.size, op.x, op.y, text)
+		case 'w':
+			text := PdfLatin1String(op.text)
+			if pdfa {
+				text = pdfASCIIString(op.text)
+			}
+			cos, sin := math.Cos(op.angle), math.Sin(op.angle)
+			x, y := op.watermarkOrigin()
+			fmt.Fprintf(&b, "%s BT /F1 %.2f Tf %.4f %.4f %.4f %.4f %.2f %.2f Tm %s Tj ET\n", pdfGray(fmt.Sprintf("%.3f", op.gray), false, pdfa), op.size, cos, sin, -sin, cos, x, y, text)
+		}
+		if pdfa {
+			b.WriteString("EMC\n")
+		}
+	}
+	return b.Bytes(), tags
+}
+
+// stadiumPath is a rectangle with fully rounded ends, draw.py's bubble shape
+func stadiumPath(x, y, w, h float64) string {
+	r := math.Min(w, h) / 2
+	k := r * 0.5523 // bezier control distance for a quarter circle
+	return fmt.Sprintf("%.2f %.2f m %.2f %.2f l %.2f %.2f %.2f %.2f %.2f %.2f c %.2f %.2f %.2f %.2f %.2f %.2f c %.2f %.2f l %.2f %.2f %.2f %.2f %.2f %.2f c %.2f %.2f %.2f %.2f %.2f %.2f c h",
+		x+r, y, x+w-r, y,
+		x+w-r+k, y, x+w, y+r-k, x+w, y+r,
+		x+w, y+r+k, x+w-r+k, y+h, x+w-r, y+h,
+		x+r, y+h,
+		x+r-k, y+h, x, y+r+k, x, y+r,
+		x, y+r-k, x+r-k, y, x+r, y)
+}
+
+// raster draws the page at goPngDPI, grayscale
+func (p *goPage) raster() *image.Gray {
+	const scale = goPngDPI / 72.0
+	im := image.NewGray(image.Rect(0, 0, int(p.width*scale), int(p.height*scale)))
+	for i := range im.Pix {
+		im.Pix[i] = 0xff
+	}
+	// fill fills the rectangle between two corners in points, at least one pixel each way
+	fill := func(x0, y0, x1, y1 float64, v uint8) {
+		px0, px1 := math.Round(math.Min(x0, x1)*scale), math.Round(math.Max(x0, x1)*scale)
+		py0, py1 := math.Round((p.height-math.Max(y0, y1))*scale), math.Round((p.height-math.Min(y0, y1))*scale)
+		if px1 == px0 {
+			px1++
+		}
+		if py1 == py0 {
+			py1++
+		}
+		r := image.Rect(int(px0), int(py0), int(px1), int(py1)).Intersect(im.Rect)
+		for py := r.Min.Y; py < r.Max.Y; py++ {
+			for px := r.Min.X; px < r.Max.X; px++ {
+				im.Pix[im.PixOffset(px, py)] = v
+			}
+		}
+	}
+	for _, op := range p.ops {
+		switch op.kind {
+		case 'r':
+			fill(op.x, op.y, op.x+op.w, op.y+op.h, uint8(op.gray*255))
+		case 'l':
+			// only horizontal and vertical lines get drawn
+			half := op.width / 2
+			if op.y == op.y2 {
+				if !op.dashed {
+					fill(op.x, op.y-half, op.x2, op.y+half, 0)
+					continue
+				}
+				for x := math.Min(op.x, op.x2); x < math.Max(op.x, op.x2); x += 8 {
+					fill(x, op.y-half, math.Min(x+4, math.Max(op.x, op.x2)), op.y+half, 0)
+				}
+			} else {
+				fill(op.x-half, op.y, op.x+half, op.y2, 0)
+			}
+		case 'b':
+			rasterBubble(im, scale, p.height, op)
+		case 't':
+			rasterText(op, fill)
+		case 'w':
+			rasterWatermark(op, fill)
+		}
+	}
+	return im
+}
+
+func rasterBubble(im *image.Gray, scale, pageHeight float64, op goOp) {
+	r := math.Min(op.w, op.h) / 2
+	cy := op.y + op.h/2
+	bounds := image.Rect(int((op.x-1)*scale), int((pageHeight-op.y-op.h-1)*scale), int((op.x+op.w+1)*scale)+1, int((pageHeight-op.y+1)*scale)+1).Intersect(im.Rect)
+	for py := bounds.Min.Y; py < bounds.Max.Y; py++ {
+		for px := bounds.Min.X; px < bounds.Max.X; px++ {
+			x := (float64(px) + 0.5) / scale
+			y := pageHeight - (float64(py)+0.5)/scale
+			// distance from the segment between the two end circles' centers, less the radius
+			sx := math.Max(op.x+r, math.Min(x, op.x+op.w-r))
+			d := math.Hypot(x-sx, y-cy) - r
+			if (op.filled && d <= 0.5) || math.Abs(d) <= 0.5 {
+				im.SetGray(px, py, color.Gray{0})
+			} else if d < 0 {
+				// clear of any watermark, as the PDF's bubbles are filled white
+				im.SetGray(px, py, color.Gray{0xff})
+			}
+		}
+	}
+}
+
+// rasterText draws Courier-sized cells of font5x7, so text lines up with the PDF
+func rasterText(op goOp, fill func(x0, y0, x1, y1 float64, v uint8)) {
+	advance := courierAdvance * op.size
+	dotw := advance / 6
+	doth := courierCapHeight * op.size / 7
+	if op.bold {
+		dotw *= 1.4
+	}
+	x := op.x
+	for _, r := range op.text {
+		if r < ' ' || r > '~' {
+			r = '?'
+		}
+		glyph := font5x7[r-' ']
+		for col, bits := range glyph {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<uint(row)) == 0 {
+					continue
+				}
+				dx := x + float64(col)*advance/6
+				dy := op.y + float64(6-row)*doth
+				fill(dx, dy, dx+dotw, dy+doth, 0)
+			}
+		}
+		x += advance
+	}
+}
+
+// watermarkOrigin is where the baseline of op's rotated text starts, so that the text is centered on op.x, op.y
+func (op goOp) watermarkOrigin() (x, y float64) {
+	cos, sin := math.Cos(op.angle), math.Sin(op.angle)
+	dx := float64(len([]rune(op.text))) * courierAdvance * op.size / 2
+	dy := courierCapHeight * op.size / 2
+	return op.x - dx*cos + dy*sin, op.y - dx*sin - dy*cos
+}
+
+// rasterWatermark is rasterText turned by op.angle, each dot drawn as an upright square
+func rasterWatermark(op goOp, fill func(x0, y0, x1, y1 float64, v uint8)) {
+	advance := courierAdvance * op.size
+	doth := courierCapHeight * op.size / 7
+	half := math.Max(advance/6*1.4, doth) / 2
+	cos, sin := math.Cos(op.angle), math.Sin(op.angle)
+	ox, oy := op.watermarkOrigin()
+	v := uint8(op.gray * 255)
+	for i, r := range []rune(op.text) {
+		if r < ' ' || r > '~' {
+			r = '?'
+		}
+		for col, bits := range font5x7[r-' '] {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<uint(row)) == 0 {
+					continue
+				}
+				// dot center in the text's own coordinates, then on the page
+				lx := float64(i)*advance + (float64(col)+0.5)*advance/6
+				ly := (float64(6-row) + 0.5) * doth
+				cx, cy := ox+lx*cos-ly*sin, oy+lx*sin+ly*cos
+				fill(cx-half, cy-half, cx+half, cy+half, v)
+			}
+		}
+	}
+}
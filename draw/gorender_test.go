@@ -0,0 +1,311 @@
+package draw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+const goRenderTestDoc = `{
+  "@type": "ElectionResults.ElectionReport",
+  "GpUnit": [{"@id": "gpunit1", "@type": "ElectionResults.ReportingUnit", "Name": "Springfield"}],
+  "Party": [{"@id": "party1", "@type": "ElectionResults.Party", "Name": "Anklebiter Assembly"}],
+  "Header": [{"@id": "hdr1", "@type": "ElectionResults.Header", "Name": "Instructions"}],
+  "Election": [{
+    "@type": "ElectionResults.Election",
+    "Name": "Test", "Type": "general", "StartDate": "2026-11-03", "EndDate": "2026-11-03",
+    "Candidate": [
+      {"@id": "cand1", "@type": "ElectionResults.Candidate", "BallotName": "Alice Argyle"},
+      {"@id": "cand2", "@type": "ElectionResults.Candidate", "BallotName": {"Text": [{"Language": "en", "Content": "Bob Brocade"}]}}
+    ],
+    "Contest": [
+      {"@id": "ccont1", "@type": "ElectionResults.CandidateContest", "Name": "Mayor", "BallotTitle": "Mayor", "BallotSubTitle": "Vote for one", "VotesAllowed": 1, "ElectionDistrictId": "gpunit1",
+       "ContestSelection": [
+         {"@id": "csel1", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["cand1"], "EndorsementPartyIds": ["party1"]},
+         {"@id": "csel2", "@type": "ElectionResults.CandidateSelection", "CandidateIds": ["cand2"]},
+         {"@id": "csel3", "@type": "ElectionResults.CandidateSelection", "IsWriteIn": true}
+       ]},
+      {"@id": "bmc1", "@type": "ElectionResults.BallotMeasureContest", "Name": "Measure A", "BallotTitle": "Measure A: a rather long title that has to wrap", "ElectionDistrictId": "gpunit1",
+       "ContestSelection": [
+         {"@id": "bms1", "@type": "ElectionResults.BallotMeasureSelection", "Selection": "Yes"},
+         {"@id": "bms2", "@type": "ElectionResults.BallotMeasureSelection", "Selection": "No"}
+       ]}
+    ],
+    "BallotStyle": [{"@type": "ElectionResults.BallotStyle", "GpUnitIds": ["gpunit1"], "OrderedContent": [
+      {"@type": "ElectionResults.OrderedHeader", "HeaderId": "hdr1"},
+      {"@type": "ElectionResults.OrderedContest", "ContestId": "ccont1"},
+      {"@type": "ElectionResults.OrderedContest", "ContestId": "bmc1", "OrderedContestSelectionIds": ["bms2", "bms1"]}
+    ]}]
+  }]
+}`
+
+var xrefEntryRe = regexp.MustCompile(`(\d{10}) 00000 n `)
+
+func TestRenderElection(t *testing.T) {
+	both, err := (&Client{}).DrawElection(context.Background(), goRenderTestDoc, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(both.Pdf, []byte("%PDF-1.4")) || !bytes.Contains(both.Pdf, []byte("(Alice Argyle) Tj")) {
+		t.Errorf("pdf %q...", both.Pdf[:20])
+	}
+	for i, m := range xrefEntryRe.FindAllSubmatch(both.Pdf, -1) {
+		off, _ := strconv.Atoi(string(m[1]))
+		if want := strconv.Itoa(i+1) + " 0 obj"; !bytes.HasPrefix(both.Pdf[off:], []byte(want)) {
+			t.Errorf("xref %d points at %q", i+1, both.Pdf[off:off+10])
+		}
+	}
+
+	var bj scan.BubblesJson
+	err = json.Unmarshal(both.BubblesJson, &bj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bj.BallotStyles) != 1 || bj.BallotStyles[0].Pages != 1 || len(both.Png) != 1 {
+		t.Fatalf("bubbles %s, %d png pages", both.BubblesJson, len(both.Png))
+	}
+	bubbles := bj.BallotStyles[0].Bubbles
+	if len(bubbles["ccont1"]) != 3 || len(bubbles["bmc1"]) != 2 {
+		t.Errorf("bubbles %v", bubbles)
+	}
+	// selections in OrderedContestSelectionIds order, top to bottom
+	if bubbles["bmc1"]["bms2"][1] <= bubbles["bmc1"]["bms1"][1] {
+		t.Errorf("No %v should be above Yes %v", bubbles["bmc1"]["bms2"], bubbles["bmc1"]["bms1"])
+	}
+
+	orig, err := png.Decode(bytes.NewReader(both.Png[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := orig.Bounds(); b.Dx() != 1275 || b.Dy() != 1650 {
+		t.Errorf("png %v", b)
+	}
+
+	// fill in Bob's bubble, the scanner should find it and nothing else
+	marked := image.NewRGBA(orig.Bounds())
+	for y := 0; y < marked.Rect.Dy(); y++ {
+		for x := 0; x < marked.Rect.Dx(); x++ {
+			marked.Set(x, y, orig.At(x, y))
+		}
+	}
+	const scale = goPngDPI / 72.0
+	xywh := bubbles["ccont1"]["csel2"]
+	for y := int((goPageHeight - xywh[1] - xywh[3]) * scale); y < int((goPageHeight-xywh[1])*scale); y++ {
+		for x := int(xywh[0] * scale); x < int((xywh[0]+xywh[2])*scale); x++ {
+			marked.Set(x, y, color.Black)
+		}
+	}
+	// as a scanner would send it
+	var jb bytes.Buffer
+	err = jpeg.Encode(&jb, marked, &jpeg.Options{Quality: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := jpeg.Decode(&jb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s scan.Scanner
+	s.Bj = bj
+	err = s.SetOrigImage(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	votes, err := s.ProcessScannedImage(scanned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for contest, sels := range votes {
+		for sel, on := range sels {
+			if on {
+				got = append(got, contest+"/"+sel)
+			}
+		}
+	}
+	if strings.Join(got, ",") != "ccont1/csel2" {
+		t.Errorf("scanned %v", votes)
+	}
+}
+
+func TestRenderElectionNoPamphlet(t *testing.T) {
+	_, err := (&Client{}).DrawPamphlet(context.Background(), goRenderTestDoc)
+	if err != ErrNoPamphlet {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestWrapColumns(t *testing.T) {
+	// 10pt Courier is 6pt per character
+	lines := wrapColumns("one two three "+strings.Repeat("x", 25), 10, 60)
+	if strings.Join(lines, "|") != "one two|three|xxxxxxxxxx|xxxxxxxxxx|xxxxx" {
+		t.Errorf("wrap got %q", lines)
+	}
+}
+
+// goRenderTestDoc with a straight-party contest
+var partyColumnTestDoc = strings.Replace(goRenderTestDoc, `"Contest": [`, `"Contest": [
+      {"@id": "pcont1", "@type": "ElectionResults.PartyContest", "Name": "Straight Party",
+       "ContestSelection": [{"@id": "psel1", "@type": "ElectionResults.PartySelection", "PartyIds": ["party1"]}]},`, 1)
+
+func TestRenderPartyColumn(t *testing.T) {
+	doc := strings.Replace(partyColumnTestDoc, `{"@type": "ElectionResults.OrderedContest", "ContestId": "ccont1"}`,
+		`{"@type": "ElectionResults.OrderedContest", "ContestId": "pcont1"}, {"@type": "ElectionResults.OrderedContest", "ContestId": "ccont1"}`, 1)
+	both, err := (&Client{}).DrawElection(context.Background(), doc, RenderOptions{Layout: LayoutPartyColumn, Columns: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bj struct {
+		DrawSettings goDrawSettings `json:"draw_settings"`
+		scan.BubblesJson
+	}
+	err = json.Unmarshal(both.BubblesJson, &bj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bj.DrawSettings.Layout != LayoutPartyColumn || bj.DrawSettings.Columns != 1 {
+		t.Errorf("draw settings %#v", bj.DrawSettings)
+	}
+	if !bytes.Contains(both.Pdf, []byte("(Anklebiter Assembly) Tj")) {
+		t.Error("no party heading")
+	}
+	bubbles := bj.BallotStyles[0].Bubbles
+	if len(bubbles["pcont1"]) != 1 || len(bubbles["ccont1"]) != 3 || len(bubbles["bmc1"]) != 2 {
+		t.Fatalf("bubbles %v", bubbles)
+	}
+	// party1's column, then everyone else's
+	alice, bob, writein := bubbles["ccont1"]["csel1"], bubbles["ccont1"]["csel2"], bubbles["ccont1"]["csel3"]
+	if bubbles["pcont1"]["psel1"][0] != alice[0] || bob[0] <= alice[0] || writein[0] != bob[0] || writein[1] >= bob[1] {
+		t.Errorf("party1 %v, Alice %v, Bob %v, write-in %v", bubbles["pcont1"]["psel1"], alice, bob, writein)
+	}
+	// the straight-party row is above the Mayor row
+	if bubbles["pcont1"]["psel1"][1] <= alice[1] {
+		t.Errorf("straight party %v should be above Mayor %v", bubbles["pcont1"]["psel1"], alice)
+	}
+	// the ballot measure spans the page
+	if bubbles["bmc1"]["bms1"][0] >= alice[0] {
+		t.Errorf("measure %v should be at the left", bubbles["bmc1"]["bms1"])
+	}
+
+	if got := NeededFeatures(partyColumnTestDoc); len(got) != 1 || got[0] != FeatureStraightParty {
+		t.Errorf("features %v", got)
+	}
+}
+
+func TestBreakLines(t *testing.T) {
+	// a two line title, then paragraphs of 3 and 5 lines
+	var lines []goTextLine
+	for _, para := range []struct {
+		n    int
+		bold bool
+	}{{2, true}, {3, false}, {5, false}} {
+		for i := 0; i < para.n; i++ {
+			lines = append(lines, goTextLine{bold: para.bold, first: i == 0, last: i == para.n-1, height: 10})
+		}
+	}
+	for _, tc := range []struct {
+		height float64
+		top    bool
+		want   int
+	}{
+		{200, false, 10},
+		// the title alone is held back
+		{25, false, 0},
+		// only one line of the first paragraph fits, no orphans
+		{30, false, 0},
+		// two and one of a three line paragraph leaves a widow and an orphan
+		{40, false, 0},
+		{50, false, 5},
+		// one line of the second paragraph is an orphan
+		{60, false, 5},
+		{70, false, 7},
+		// one line left over is a widow, so break a line earlier
+		{90, false, 8},
+		// nothing fits by the rules, but the top of a column has to take something
+		{25, true, 2},
+		{5, true, 1},
+	} {
+		if got := breakLines(lines, tc.height, tc.top); got != tc.want {
+			t.Errorf("%g %v: %d lines, want %d", tc.height, tc.top, got, tc.want)
+		}
+	}
+}
+
+func TestRenderMeasureText(t *testing.T) {
+	var para []string
+	for i := 0; i < 150; i++ {
+		para = append(para, "whereas")
+	}
+	fullText := `"PrintFullText": true, "FullText": "# Section 1\n\n` + strings.Join(para, " ") + `\n\nThe end.",`
+	doc := strings.Replace(goRenderTestDoc, `"Name": "Measure A",`, `"Name": "Measure A", `+fullText, 1)
+	both, err := (&Client{}).DrawElection(context.Background(), doc, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bj scan.BubblesJson
+	err = json.Unmarshal(both.BubblesJson, &bj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(both.Pdf, []byte("(Section 1) Tj")) || !bytes.Contains(both.Pdf, []byte("(The end.) Tj")) {
+		t.Error("full text not drawn")
+	}
+	// the text fills the first column and runs into the second, then the measure
+	yes := bj.BallotStyles[0].Bubbles["bmc1"]["bms1"]
+	if len(yes) != 4 || yes[0] < goPageMargin+100 {
+		t.Errorf("measure %v should be after the text, in a later column", yes)
+	}
+	if got := NeededFeatures(doc); len(got) != 1 || got[0] != FeatureMeasureText {
+		t.Errorf("features %v", got)
+	}
+}
+
+func TestRenderPageText(t *testing.T) {
+	pageText := `"PageFooter": "{JURISDICTION} style {STYLE}, {TURN}", "Instructions": "# Read first\n\nUse a pen.\n- blue ink\n- or black",`
+	doc := strings.Replace(goRenderTestDoc, `"Name": "Test",`, `"Name": "Test", `+pageText, 1)
+	doc = strings.Replace(doc, `"Header": [`, `"Header": [{"@id": "brk", "@type": "ElectionResults.Header", "Name": "PageBreak"}, `, 1)
+	doc = strings.Replace(doc, `{"@type": "ElectionResults.OrderedContest", "ContestId": "bmc1"`, `{"@type": "ElectionResults.OrderedHeader", "HeaderId": "brk"}, {"@type": "ElectionResults.OrderedContest", "ContestId": "bmc1"`, 1)
+	doc = strings.Replace(doc, `"GpUnitIds": ["gpunit1"], "OrderedContent"`, `"GpUnitIds": ["gpunit1"], "PageHeader": "{ELECTION} {PAGE}/{PAGES}", "OrderedContent"`, 1)
+	both, err := (&Client{}).DrawElection(context.Background(), doc, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"(Test 1/2) Tj", "(Test 2/2) Tj", "(Springfield style 1, Vote both sides) Tj", "(Springfield style 1, ) Tj", "(Read first) Tj", "(Use a pen.) Tj", "(blue ink) Tj"} {
+		if !bytes.Contains(both.Pdf, []byte(text)) {
+			t.Errorf("no %s", text)
+		}
+	}
+	if bytes.Contains(both.Pdf, []byte("(Fill in the oval")) {
+		t.Error("default instructions drawn too")
+	}
+}
+
+func TestParseInstructions(t *testing.T) {
+	got := ParseInstructions("# How to vote\n\nFill in\nthe oval.\n- one\n- two\n\nThanks")
+	want := []InstructionBlock{{"How to vote", true, false}, {"Fill in the oval.", false, false}, {"one", false, true}, {"two", false, true}, {"Thanks", false, false}}
+	if len(got) != len(want) {
+		t.Fatalf("got %#v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%d: got %#v want %#v", i, got[i], want[i])
+		}
+	}
+	fields := map[string]string{"TURN": "Over", "STYLE": "3"}
+	if s := FillPageText("{STYLE} {PAGE}/{PAGES} {TURN}", fields, 1, "2"); s != "3 1/2 Over" {
+		t.Errorf("page 1 %q", s)
+	}
+	if s := FillPageText("{STYLE} {PAGE}/{PAGES} {TURN}", fields, 2, "2"); s != "3 2/2 " {
+		t.Errorf("page 2 %q", s)
+	}
+}
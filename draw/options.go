@@ -0,0 +1,260 @@
+package draw
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RenderOptions are print format requirements: paper size, duplex, contest
+// columns, the smallest text allowed, contrast, layout and PDF/A output. They come from the Election's
+// "RenderOptions" extension field, each overridable by a query parameter,
+// and go to the draw backend as /draw query parameters. The zero value is
+// draw.py's defaults: Letter, simplex, 3 columns, its own font sizes.
+//
+// {"PageSize": "A4", "Duplex": true, "Columns": 2, "MinFontSize": 10, "PdfA": true}
+type RenderOptions struct {
+	PageSize     string  `json:"PageSize,omitempty"`     // letter, legal or a4
+	Duplex       bool    `json:"Duplex,omitempty"`       // pad each ballot style to an even number of pages
+	Columns      int     `json:"Columns,omitempty"`      // contest columns per page
+	MinFontSize  float64 `json:"MinFontSize,omitempty"`  // pt, smaller text is enlarged to this
+	HighContrast bool    `json:"HighContrast,omitempty"` // black on white, no shaded title bars
+	Layout       string  `json:"Layout,omitempty"`       // office-block (the default) or party-column
+	PdfA         bool    `json:"PdfA,omitempty"`         // PDF/A-2b, tagged, fonts embedded, with document metadata
+
+	// Proof stamps ProofWatermark across every page. It is only a query
+	// parameter, never from the document.
+	Proof bool `json:"-"`
+
+	// Profile names a render profile, see profiles.go. It is only a query
+	// parameter; Client.DrawElection applies it under the other options.
+	Profile string `json:"-"`
+}
+
+// ProofWatermark is drawn diagonally across each page of a RenderOptions.Proof render
+const ProofWatermark = "SAMPLE / PROOF"
+
+// Election extension field with the RenderOptions for its ballots
+const RenderOptionsField = "RenderOptions"
+
+// Layouts: office-block is a box per contest with its candidates listed
+// down it; party-column is a row per contest with a column per party
+const (
+	LayoutOfficeBlock = "office-block"
+	LayoutPartyColumn = "party-column"
+)
+
+// PageSizes in points, width and height
+var PageSizes = map[string][2]float64{
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+	"a4":     {595.28, 841.89},
+}
+
+const (
+	DefaultColumns = 3
+	MaxColumns     = 6
+	MaxMinFontSize = 24.0
+)
+
+// Check returns a human readable problem, or nil
+func (ro RenderOptions) Check() error {
+	if _, ok := PageSizes[strings.ToLower(ro.PageSize)]; ro.PageSize != "" && !ok {
+		return fmt.Errorf("PageSize %q should be letter, legal or a4", ro.PageSize)
+	}
+	if ro.Columns < 0 || ro.Columns > MaxColumns {
+		return fmt.Errorf("Columns %d should be 1 to %d", ro.Columns, MaxColumns)
+	}
+	if ro.MinFontSize < 0 || ro.MinFontSize > MaxMinFontSize {
+		return fmt.Errorf("MinFontSize %g should be 0 to %g", ro.MinFontSize, MaxMinFontSize)
+	}
+	if ro.Layout != "" && ro.Layout != LayoutOfficeBlock && ro.Layout != LayoutPartyColumn {
+		return fmt.Errorf("Layout %q should be %s or %s", ro.Layout, LayoutOfficeBlock, LayoutPartyColumn)
+	}
+	if ro.Profile != "" && !profileNameRe.MatchString(ro.Profile) {
+		return fmt.Errorf("profile %q should be lower case letters, digits and -", ro.Profile)
+	}
+	return nil
+}
+
+// Override returns ro with anything set in over replacing it
+func (ro RenderOptions) Override(over RenderOptions) RenderOptions {
+	if over.PageSize != "" {
+		ro.PageSize = over.PageSize
+	}
+	if over.Duplex {
+		ro.Duplex = true
+	}
+	if over.Columns != 0 {
+		ro.Columns = over.Columns
+	}
+	if over.MinFontSize != 0 {
+		ro.MinFontSize = over.MinFontSize
+	}
+	if over.HighContrast {
+		ro.HighContrast = true
+	}
+	if over.Layout != "" {
+		ro.Layout = over.Layout
+	}
+	if over.PdfA {
+		ro.PdfA = true
+	}
+	if over.Proof {
+		ro.Proof = true
+	}
+	if over.Profile != "" {
+		ro.Profile = over.Profile
+	}
+	return ro
+}
+
+// Query is the options that are set, as /draw query parameters.
+// Encode() of it is stable, for cache keys.
+func (ro RenderOptions) Query() url.Values {
+	q := url.Values{}
+	if ro.PageSize != "" {
+		q.Set("pagesize", strings.ToLower(ro.PageSize))
+	}
+	if ro.Duplex {
+		q.Set("duplex", "1")
+	}
+	if ro.Columns != 0 {
+		q.Set("columns", strconv.Itoa(ro.Columns))
+	}
+	if ro.MinFontSize != 0 {
+		q.Set("minfont", strconv.FormatFloat(ro.MinFontSize, 'g', -1, 64))
+	}
+	if ro.HighContrast {
+		q.Set("highcontrast", "1")
+	}
+	if ro.Layout != "" {
+		q.Set("layout", ro.Layout)
+	}
+	if ro.PdfA {
+		q.Set("pdfa", "1")
+	}
+	if ro.Proof {
+		q.Set("proof", "1")
+	}
+	if ro.Profile != "" {
+		q.Set("profile", ro.Profile)
+	}
+	return q
+}
+
+// ParseRenderOptions reads pagesize, duplex, columns, minfont, highcontrast, layout, pdfa, proof and profile query parameters
+func ParseRenderOptions(q url.Values) (ro RenderOptions, err error) {
+	ro.PageSize = strings.ToLower(q.Get("pagesize"))
+	if v := q.Get("duplex"); v != "" {
+		ro.Duplex, err = strconv.ParseBool(v)
+		if err != nil {
+			return ro, fmt.Errorf("bad duplex %q", v)
+		}
+	}
+	if v := q.Get("columns"); v != "" {
+		ro.Columns, err = strconv.Atoi(v)
+		if err != nil {
+			return ro, fmt.Errorf("bad columns %q", v)
+		}
+	}
+	if v := q.Get("minfont"); v != "" {
+		ro.MinFontSize, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return ro, fmt.Errorf("bad minfont %q", v)
+		}
+	}
+	if v := q.Get("highcontrast"); v != "" {
+		ro.HighContrast, err = strconv.ParseBool(v)
+		if err != nil {
+			return ro, fmt.Errorf("bad highcontrast %q", v)
+		}
+	}
+	if v := q.Get("pdfa"); v != "" {
+		ro.PdfA, err = strconv.ParseBool(v)
+		if err != nil {
+			return ro, fmt.Errorf("bad pdfa %q", v)
+		}
+	}
+	if v := q.Get("proof"); v != "" {
+		ro.Proof, err = strconv.ParseBool(v)
+		if err != nil {
+			return ro, fmt.Errorf("bad proof %q", v)
+		}
+	}
+	ro.Layout = strings.ToLower(q.Get("layout"))
+	ro.Profile = q.Get("profile")
+	return ro, ro.Check()
+}
+
+// DocRenderOptions reads the first Election's RenderOptions field.
+// A document that isn't NIST election json has none.
+func DocRenderOptions(electionjson string) (ro RenderOptions, err error) {
+	var doc struct {
+		Election []struct {
+			RenderOptions json.RawMessage
+		}
+	}
+	if json.Unmarshal([]byte(electionjson), &doc) != nil || len(doc.Election) == 0 {
+		return RenderOptions{}, nil
+	}
+	raw := doc.Election[0].RenderOptions
+	if len(raw) == 0 || string(raw) == "null" {
+		return RenderOptions{}, nil
+	}
+	err = json.Unmarshal(raw, &ro)
+	if err != nil {
+		return RenderOptions{}, fmt.Errorf("bad RenderOptions, %v", err)
+	}
+	ro.PageSize = strings.ToLower(ro.PageSize)
+	ro.Layout = strings.ToLower(ro.Layout)
+	return ro, ro.Check()
+}
+
+// pageSize in points, Letter by default
+func (ro RenderOptions) pageSize() (width, height float64) {
+	wh, ok := PageSizes[strings.ToLower(ro.PageSize)]
+	if !ok {
+		return goPageWidth, goPageHeight
+	}
+	return wh[0], wh[1]
+}
+
+// features a backend needs to draw with ro
+func (ro RenderOptions) features() (need []string) {
+	layout := ro
+	layout.HighContrast = false
+	layout.Layout = ""
+	layout.PdfA = false
+	layout.Proof = false
+	layout.Profile = ""
+	if layout != (RenderOptions{}) {
+		need = append(need, FeatureRenderOptions)
+	}
+	if ro.HighContrast {
+		need = append(need, FeatureHighContrast)
+	}
+	if ro.Layout == LayoutPartyColumn {
+		need = append(need, FeaturePartyColumn)
+	}
+	if ro.PdfA {
+		need = append(need, FeaturePdfA)
+	}
+	if ro.Proof {
+		need = append(need, FeatureWatermark)
+	}
+	return need
+}
+
+func (ro RenderOptions) columns() int {
+	if ro.Layout == LayoutPartyColumn {
+		// party columns go across the page
+		return 1
+	}
+	if ro.Columns <= 0 {
+		return DefaultColumns
+	}
+	return ro.Columns
+}
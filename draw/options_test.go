@@ -0,0 +1,124 @@
+package draw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+func TestParseRenderOptions(t *testing.T) {
+	q, _ := url.ParseQuery("pagesize=A4&duplex=true&columns=2&minfont=10.5&highcontrast=1&layout=Party-Column&pdfa=1&proof=true&profile=large-print")
+	ro, err := ParseRenderOptions(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ro != (RenderOptions{PageSize: "a4", Duplex: true, Columns: 2, MinFontSize: 10.5, HighContrast: true, Layout: LayoutPartyColumn, PdfA: true, Proof: true, Profile: "large-print"}) {
+		t.Errorf("parsed %#v", ro)
+	}
+	if got := ro.Query().Encode(); got != "columns=2&duplex=1&highcontrast=1&layout=party-column&minfont=10.5&pagesize=a4&pdfa=1&profile=large-print&proof=1" {
+		t.Errorf("query %s", got)
+	}
+	for _, bad := range []string{"pagesize=tabloid", "columns=7", "columns=x", "minfont=100", "duplex=maybe", "pdfa=x", "proof=y", "highcontrast=z", "layout=diagonal", "profile=Large_Print"} {
+		q, _ = url.ParseQuery(bad)
+		if _, err = ParseRenderOptions(q); err == nil {
+			t.Errorf("%s should fail", bad)
+		}
+	}
+
+	ro, err = DocRenderOptions(`{"Election": [{"RenderOptions": {"PageSize": "Legal", "Columns": 4}}]}`)
+	if err != nil || ro != (RenderOptions{PageSize: "legal", Columns: 4}) {
+		t.Errorf("doc %#v %v", ro, err)
+	}
+	if ro = ro.Override(RenderOptions{Columns: 1}); ro != (RenderOptions{PageSize: "legal", Columns: 1}) {
+		t.Errorf("override %#v", ro)
+	}
+	if _, err = DocRenderOptions(`{"Election": [{"RenderOptions": {"Columns": "two"}}]}`); err == nil {
+		t.Error("bad doc RenderOptions should fail")
+	}
+	if ro, _ = DocRenderOptions(`{"Election": [{"RenderOptions": {"Proof": true}}]}`); ro.Proof {
+		t.Error("Proof should only come from the query")
+	}
+}
+
+func TestRenderElectionOptions(t *testing.T) {
+	doc := strings.Replace(goRenderTestDoc, `"Name": "Test",`, `"Name": "Test", "RenderOptions": {"PageSize": "A4", "Duplex": true},`, 1)
+	both, err := (&Client{}).DrawElection(context.Background(), doc, RenderOptions{Columns: 1, MinFontSize: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(both.Pdf, []byte("/MediaBox [0 0 595.28 841.89]")) || !bytes.Contains(both.Pdf, []byte("/F1 12 Tf")) {
+		t.Errorf("pdf not A4 with 12pt text")
+	}
+	var bj scan.BubblesJson
+	err = json.Unmarshal(both.BubblesJson, &bj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one page of ballot and a blank back
+	if len(bj.BallotStyles) != 1 || bj.BallotStyles[0].Pages != 2 || len(both.Png) != 2 {
+		t.Fatalf("bubbles %s, %d png pages", both.BubblesJson, len(both.Png))
+	}
+	// one column: both contests' bubbles line up
+	bubbles := bj.BallotStyles[0].Bubbles
+	if bubbles["ccont1"]["csel1"][0] != bubbles["bmc1"]["bms1"][0] {
+		t.Errorf("bubbles not in one column %v", bubbles)
+	}
+	im, err := png.Decode(bytes.NewReader(both.Png[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := im.Bounds(); b.Dx() != 1240 || b.Dy() != 1753 {
+		t.Errorf("png %v", b)
+	}
+
+	// a backend from before render options
+	server := httptest.NewServer(drawOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"pdfb64": "JVBERg==", "bubbles": {}}`))
+	}))
+	defer server.Close()
+	_, err = testClient(server.URL).DrawElection(context.Background(), doc, RenderOptions{})
+	if ue, ok := err.(*UnsupportedError); !ok || ue.Missing[0] != FeatureRenderOptions {
+		t.Errorf("legacy backend got %v", err)
+	}
+}
+
+func TestRenderElectionProof(t *testing.T) {
+	plain, err := RenderElection(goRenderTestDoc, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := (&Client{}).DrawElection(context.Background(), goRenderTestDoc, RenderOptions{Proof: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(plain.Pdf, []byte(ProofWatermark)) || !bytes.Contains(proof.Pdf, []byte("(SAMPLE / PROOF) Tj")) {
+		t.Error("watermark should be in the proof PDF only")
+	}
+	if !bytes.Equal(plain.BubblesJson, proof.BubblesJson) {
+		t.Errorf("proof bubbles differ\n%s\n%s", plain.BubblesJson, proof.BubblesJson)
+	}
+	im, err := png.Decode(bytes.NewReader(proof.Png[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray := 0
+	b := im.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if v, _, _, _ := im.At(x, y).RGBA(); v>>8 == uint32(goWatermarkGray*255) {
+				gray++
+			}
+		}
+	}
+	if gray < 1000 {
+		t.Errorf("only %d watermark pixels", gray)
+	}
+}
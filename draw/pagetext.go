@@ -0,0 +1,119 @@
+package draw
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Text around the contests, from Election and BallotStyle extension fields.
+// A ballot style's own setting wins over its election's.
+//
+//	"PageHeader"    top of every page, default DefaultPageHeader
+//	"PageFooter"    bottom of every page, default none
+//	"TurnNotice"    what {TURN} says, default DefaultTurnNotice
+//	"Instructions"  under the Instructions header instead of BallotInstructions
+//
+// Header and footer templates fill in {ELECTION} (the election's name),
+// {TYPE} ("General Election"), {JURISDICTION} (the style's GpUnit names),
+// {DATE}, {STYLE} (the style's first ExternalIdentifier, or its number in the
+// election from 1), {PAGE}, {PAGES}, and {TURN}, which is the turn notice on
+// every page but a style's last and nothing on that one. draw.py does the same.
+//
+// Instructions are rich text: blank lines separate paragraphs, a paragraph
+// starting "# " is a bold heading, and lines starting "- " are bullets.
+
+const DefaultPageHeader = "Ballot for {TYPE}\n{JURISDICTION}\n{DATE} - page {PAGE} of {PAGES}"
+
+const DefaultTurnNotice = "Vote both sides"
+
+// StyleText is ballot style bs's setting of field, or else its election's
+func StyleText(election, bs map[string]interface{}, field string) (string, bool) {
+	if v, ok := bs[field].(string); ok {
+		return v, true
+	}
+	v, ok := election[field].(string)
+	return v, ok
+}
+
+// PageFields are the template fields that are the same on every page of
+// ballot style bs, number styleNum from 1. obs are the document's objects by @id.
+func PageFields(obs map[string]map[string]interface{}, election, bs map[string]interface{}, styleNum int) map[string]string {
+	var names []string
+	for _, id := range jsonStringList(bs, "GpUnitIds") {
+		names = append(names, jsonText(obs[id]["Name"]))
+	}
+	start, _ := election["StartDate"].(string)
+	end, _ := election["EndDate"].(string)
+	date := start
+	if start != end {
+		date += " - " + end
+	}
+	style := strconv.Itoa(styleNum)
+	if ext := jsonStringList(bs, "ExternalIdentifier"); len(ext) != 0 {
+		style = ext[0]
+	}
+	turn, ok := StyleText(election, bs, "TurnNotice")
+	if !ok {
+		turn = DefaultTurnNotice
+	}
+	return map[string]string{
+		"ELECTION":     jsonText(election["Name"]),
+		"TYPE":         ElectionTypeTitle(election),
+		"JURISDICTION": strings.Join(names, ", "),
+		"DATE":         date,
+		"STYLE":        style,
+		"TURN":         turn,
+	}
+}
+
+// FillPageText fills in a header or footer template for page of pages.
+// pages may be "X" before they're counted.
+func FillPageText(template string, fields map[string]string, page int, pages string) string {
+	pairs := make([]string, 0, 2*len(fields)+4)
+	for name, value := range fields {
+		if name == "TURN" && pages == strconv.Itoa(page) {
+			value = ""
+		}
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	pairs = append(pairs, "{PAGES}", pages, "{PAGE}", strconv.Itoa(page))
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// InstructionBlock is a paragraph, heading or bullet of Instructions
+type InstructionBlock struct {
+	Text    string
+	Heading bool
+	Bullet  bool
+}
+
+// ParseInstructions splits Instructions rich text into blocks
+func ParseInstructions(text string) (out []InstructionBlock) {
+	var para []string
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		joined := strings.Join(para, " ")
+		if strings.HasPrefix(joined, "# ") {
+			out = append(out, InstructionBlock{Text: strings.TrimPrefix(joined, "# "), Heading: true})
+		} else {
+			out = append(out, InstructionBlock{Text: joined})
+		}
+		para = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "- "):
+			flush()
+			out = append(out, InstructionBlock{Text: strings.TrimPrefix(line, "- "), Bullet: true})
+		default:
+			para = append(para, line)
+		}
+	}
+	flush()
+	return out
+}
@@ -0,0 +1,108 @@
+package draw
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// PdfWriter collects numbered objects and writes them out with an xref table
+type PdfWriter struct {
+	objs [][]byte // objs[i] is object i+1
+
+	// Version in the header, default 1.4
+	Version string
+
+	// Info is the document information dictionary object, 0 for none.
+	// A document with one also gets a trailer /ID.
+	Info int
+}
+
+// Alloc reserves an object number to Set later
+func (pw *PdfWriter) Alloc() int {
+	pw.objs = append(pw.objs, nil)
+	return len(pw.objs)
+}
+
+func (pw *PdfWriter) Set(num int, body string) {
+	pw.objs[num-1] = []byte(body)
+}
+
+func (pw *PdfWriter) Add(body string) int {
+	num := pw.Alloc()
+	pw.Set(num, body)
+	return num
+}
+
+// Stream adds a stream object, dict is the entries besides /Length
+func (pw *PdfWriter) Stream(dict string, data []byte) int {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<< %s /Length %d >>\nstream\n", dict, len(data))
+	b.Write(data)
+	b.WriteString("\nendstream")
+	num := pw.Alloc()
+	pw.objs[num-1] = b.Bytes()
+	return num
+}
+
+func (pw *PdfWriter) Bytes(root int) []byte {
+	var out bytes.Buffer
+	version := pw.Version
+	if version == "" {
+		version = "1.4"
+	}
+	fmt.Fprintf(&out, "%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", version)
+	offsets := make([]int, len(pw.objs))
+	for i, body := range pw.objs {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		out.Write(body)
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(pw.objs)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	var info string
+	if pw.Info != 0 {
+		id := md5.Sum(out.Bytes())
+		info = fmt.Sprintf(" /Info %d 0 R /ID [<%x> <%x>]", pw.Info, id, id)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R%s >>\nstartxref\n%d\n%%%%EOF\n", len(pw.objs)+1, root, info, xref)
+	return out.Bytes()
+}
+
+// PdfLatin1String is a literal string for a WinAnsi encoded standard font, other characters become '?'
+func PdfLatin1String(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			sb.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&sb, "\\%03o", r)
+		default:
+			sb.WriteByte('?')
+		}
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
+
+// PdfTextString is a UTF-16BE hex string, for document metadata outside of content streams
+func PdfTextString(s string) string {
+	var sb strings.Builder
+	sb.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&sb, "%04X", u)
+	}
+	sb.WriteByte('>')
+	return sb.String()
+}
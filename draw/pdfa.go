@@ -0,0 +1,206 @@
+package draw
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PDF/A output of RenderElection, for RenderOptions.PdfA. It is PDF/A-2b
+// and also tagged for screen readers:
+//
+//   - fonts are embedded, as Type 3 fonts drawn from font5x7 so the PDF
+//     matches the page PNGs and needs no font files
+//   - colors are CalGray rather than device gray, so no ICC output intent is needed
+//   - document metadata (election name, ballot styles, when it was
+//     generated) goes in both the Info dictionary and XMP
+//   - text is marked content in a structure tree: page headers H1,
+//     contest titles H2, everything else P; lines, shading and bubbles
+//     are artifacts
+
+// pdfMeta is document metadata for a PDF/A
+type pdfMeta struct {
+	Title   string // election name
+	Subject string // ballot styles
+	Lang    string
+	Created time.Time
+}
+
+func (gr *goRenderer) pdfMeta(styles []map[string]interface{}) *pdfMeta {
+	meta := &pdfMeta{Title: jsonText(gr.election["Name"]), Lang: "en", Created: gr.created}
+	if meta.Title == "" {
+		meta.Title = "Ballot"
+	}
+	var names []string
+	for _, bs := range styles {
+		var units []string
+		for _, id := range jsonStringList(bs, "GpUnitIds") {
+			units = append(units, jsonText(gr.obs[id]["Name"]))
+		}
+		names = append(names, strings.Join(units, ", "))
+	}
+	meta.Subject = "Ballot styles: " + strings.Join(names, "; ")
+	return meta
+}
+
+type pdfaWriter struct {
+	pw   *PdfWriter
+	meta *pdfMeta
+
+	colorSpaceObj int
+	structRoot    int
+	document      int      // the Document structure element, parent of all the others
+	elems         []string // Document's kids
+	parents       []string // ParentTree entries, a page's StructParents key and its elements by MCID
+}
+
+func newPdfaWriter(pw *PdfWriter, meta *pdfMeta) *pdfaWriter {
+	pw.Version = "1.7"
+	pa := &pdfaWriter{pw: pw, meta: meta}
+	pa.colorSpaceObj = pw.Add("[/CalGray << /WhitePoint [0.9505 1 1.089] /Gamma 2.2 >>]")
+	pa.structRoot = pw.Alloc()
+	pa.document = pw.Alloc()
+	return pa
+}
+
+// page resources entry for /CS0, see pdfGray
+func (pa *pdfaWriter) colorSpace() string {
+	return fmt.Sprintf(" /ColorSpace << /CS0 %d 0 R >>", pa.colorSpaceObj)
+}
+
+// page adds structure elements for a page's marked content, tags by MCID.
+// It returns entries for the page dictionary.
+func (pa *pdfaWriter) page(pageObj int, tags []string) string {
+	key := len(pa.parents)
+	refs := make([]string, len(tags))
+	for mcid, tag := range tags {
+		elem := pa.pw.Add(fmt.Sprintf("<< /Type /StructElem /S /%s /P %d 0 R /Pg %d 0 R /K %d >>", tag, pa.document, pageObj, mcid))
+		refs[mcid] = fmt.Sprintf("%d 0 R", elem)
+	}
+	pa.elems = append(pa.elems, refs...)
+	pa.parents = append(pa.parents, fmt.Sprintf("%d [%s]", key, strings.Join(refs, " ")))
+	return fmt.Sprintf(" /StructParents %d /Tabs /S", key)
+}
+
+// catalog finishes the structure tree and metadata after the last page,
+// returning entries for the document catalog
+func (pa *pdfaWriter) catalog() string {
+	pw := pa.pw
+	pw.Set(pa.document, fmt.Sprintf("<< /Type /StructElem /S /Document /P %d 0 R /K [%s] >>", pa.structRoot, strings.Join(pa.elems, " ")))
+	parentTree := pw.Add(fmt.Sprintf("<< /Nums [%s] >>", strings.Join(pa.parents, " ")))
+	pw.Set(pa.structRoot, fmt.Sprintf("<< /Type /StructTreeRoot /K %d 0 R /ParentTree %d 0 R /ParentTreeNextKey %d >>", pa.document, parentTree, len(pa.parents)))
+
+	date := "D:" + pa.meta.Created.UTC().Format("20060102150405") + "Z"
+	pw.Info = pw.Add(fmt.Sprintf("<< /Title %s /Subject %s /Creator (BallotStudio) /Producer (ballotstudio draw) /CreationDate (%s) /ModDate (%s) >>",
+		PdfTextString(pa.meta.Title), PdfTextString(pa.meta.Subject), date, date))
+	metadata := pw.Stream("/Type /Metadata /Subtype /XML", pa.xmp())
+	return fmt.Sprintf(" /Metadata %d 0 R /MarkInfo << /Marked true >> /StructTreeRoot %d 0 R /Lang %s /ViewerPreferences << /DisplayDocTitle true >>",
+		metadata, pa.structRoot, PdfLatin1String(pa.meta.Lang))
+}
+
+func xmlText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xmp metadata, which PDF/A wants to agree with the Info dictionary
+func (pa *pdfaWriter) xmp() []byte {
+	date := pa.meta.Created.UTC().Format("2006-01-02T15:04:05Z")
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:pdf="http://ns.adobe.com/pdf/1.3/" xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/">
+<dc:format>application/pdf</dc:format>
+`)
+	fmt.Fprintf(&b, "<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n", xmlText(pa.meta.Title))
+	fmt.Fprintf(&b, "<dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n", xmlText(pa.meta.Subject))
+	fmt.Fprintf(&b, "<xmp:CreateDate>%s</xmp:CreateDate>\n<xmp:ModifyDate>%s</xmp:ModifyDate>\n<xmp:CreatorTool>BallotStudio</xmp:CreatorTool>\n", date, date)
+	b.WriteString(`<pdf:Producer>ballotstudio draw</pdf:Producer>
+<pdfaid:part>2</pdfaid:part>
+<pdfaid:conformance>B</pdfaid:conformance>
+</rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`)
+	return b.Bytes()
+}
+
+// character codes 32-126 are ASCII
+const asciiToUnicodeCMap = `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def
+/CMapName /Adobe-Identity-UCS def
+/CMapType 2 def
+1 begincodespacerange
+<00> <FF>
+endcodespacerange
+1 beginbfrange
+<20> <7E> <0020>
+endbfrange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`
+
+// fonts embeds bold and regular Type 3 fonts for /F1 and /F2
+func (pa *pdfaWriter) fonts() (bold, regular int) {
+	toUnicode := pa.pw.Stream("", []byte(asciiToUnicodeCMap))
+	return pa.type3Font(1.4, toUnicode), pa.type3Font(1, toUnicode)
+}
+
+// type3Font draws font5x7 in Courier sized cells, as rasterText does.
+// weight widens the dots for bold.
+func (pa *pdfaWriter) type3Font(weight float64, toUnicode int) int {
+	// 1000 units per em
+	advance := courierAdvance * 1000
+	dotw := advance / 6
+	doth := courierCapHeight * 1000 / 7
+	procs := make([]string, len(font5x7))
+	names := make([]string, len(font5x7))
+	for i, glyph := range font5x7 {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%g 0 d0\n", advance)
+		dots := 0
+		for col, bits := range glyph {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<uint(row)) == 0 {
+					continue
+				}
+				fmt.Fprintf(&b, "%.2f %.2f %.2f %.2f re\n", float64(col)*dotw, float64(6-row)*doth, dotw*weight, doth)
+				dots++
+			}
+		}
+		if dots != 0 {
+			b.WriteString("f\n")
+		}
+		names[i] = fmt.Sprintf("/g%d", i+' ')
+		procs[i] = fmt.Sprintf("%s %d 0 R", names[i], pa.pw.Stream("", b.Bytes()))
+	}
+	widths := strings.TrimSpace(strings.Repeat(fmt.Sprintf("%g ", advance), len(font5x7)))
+	return pa.pw.Add(fmt.Sprintf("<< /Type /Font /Subtype /Type3 /FontBBox [0 0 %.0f %.0f] /FontMatrix [0.001 0 0 0.001 0 0] /CharProcs << %s >> /Encoding << /Type /Encoding /Differences [32 %s] >> /FirstChar 32 /LastChar %d /Widths [%s] /Resources << >> /ToUnicode %d 0 R >>",
+		4*dotw+dotw*weight, 7*doth, strings.Join(procs, " "), strings.Join(names, " "), ' '+len(font5x7)-1, widths, toUnicode))
+}
+
+// pdfASCIIString is a literal string for the Type 3 fonts, other characters become '?'
+func pdfASCIIString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('?')
+		}
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
@@ -0,0 +1,66 @@
+package draw
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+var deviceGrayRe = regexp.MustCompile(`(?m)(^| )[0-9.]+ [gG] `)
+
+func TestRenderElectionPdfA(t *testing.T) {
+	both, err := (&Client{}).DrawElection(context.Background(), goRenderTestDoc, RenderOptions{PdfA: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdf := both.Pdf
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.7\n")) {
+		t.Errorf("header %q", pdf[:10])
+	}
+	for i, m := range xrefEntryRe.FindAllSubmatch(pdf, -1) {
+		off, _ := strconv.Atoi(string(m[1]))
+		if want := strconv.Itoa(i+1) + " 0 obj"; !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Errorf("xref %d points at %q", i+1, pdf[off:off+10])
+		}
+	}
+	for _, want := range []string{
+		"/Subtype /Type3",
+		"<pdfaid:part>2</pdfaid:part>",
+		"<rdf:li xml:lang=\"x-default\">Test</rdf:li>",
+		"/Title " + PdfTextString("Test"),
+		"/Subject " + PdfTextString("Ballot styles: Springfield"),
+		"/MarkInfo << /Marked true >>",
+		"/StructTreeRoot",
+		"/S /H2",
+		"/H1 << /MCID 0 >> BDC",
+		"/Artifact BMC",
+		"(Alice Argyle) Tj",
+		"/ID [<",
+	} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("PDF/A missing %q", want)
+		}
+	}
+	if bytes.Contains(pdf, []byte("/Courier")) {
+		t.Error("PDF/A uses a font that isn't embedded")
+	}
+	if m := deviceGrayRe.Find(pdf); m != nil {
+		t.Errorf("PDF/A uses device gray %q", m)
+	}
+
+	// a backend that can lay out to options but not write PDF/A
+	c := &Client{BackendUrl: "http://127.0.0.1:0/", features: featureSet([]string{FeatureRenderOptions})}
+	c.featuresUntil = c.featuresUntil.AddDate(1000, 0, 0)
+	_, err = c.DrawElection(context.Background(), goRenderTestDoc, RenderOptions{PdfA: true})
+	if ue, ok := err.(*UnsupportedError); !ok || len(ue.Missing) != 1 || ue.Missing[0] != FeaturePdfA {
+		t.Errorf("backend without pdfa got %v", err)
+	}
+}
+
+func TestPdfTextString(t *testing.T) {
+	if got := PdfTextString("Aé亀"); got != "<FEFF004100E94E80>" {
+		t.Errorf("got %s", got)
+	}
+}
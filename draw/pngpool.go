@@ -0,0 +1,132 @@
+package draw
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrPngBusy is returned without converting when a PngPool's queue is full
+var ErrPngBusy = errors.New("too many PNG conversions waiting")
+
+// PngPool limits how many pdftoppm processes run at once. Conversions
+// beyond Max wait their turn, and past MaxQueue waiting they're refused
+// with ErrPngBusy, so a burst of preview requests can't swamp the host.
+// The zero value has no limits.
+type PngPool struct {
+	// Max conversions running at once, 0 for unlimited
+	Max int
+
+	// MaxQueue conversions waiting for a turn, 0 for unlimited
+	MaxQueue int
+
+	// Convert is PdfToPng's work, nil for pdftoppm. Tests without
+	// pdftoppm replace it.
+	Convert func(ctx context.Context, pdf []byte) ([][]byte, error)
+
+	lock    sync.Mutex
+	turn    *sync.Cond
+	running int
+	waiting int
+	stats   PngPoolStats
+}
+
+// PngPoolStats is how busy a PngPool is and has been
+type PngPoolStats struct {
+	Max      int `json:"max"`
+	MaxQueue int `json:"max_queue"`
+	Running  int `json:"running"`
+	Waiting  int `json:"waiting"`
+
+	// totals since start
+	Conversions int64   `json:"conversions"`
+	Queued      int64   `json:"queued"`    // had to wait for a turn
+	Rejected    int64   `json:"rejected"`  // ErrPngBusy
+	Abandoned   int64   `json:"abandoned"` // context done while waiting
+	WaitSeconds float64 `json:"wait_seconds"`
+	PeakWaiting int     `json:"peak_waiting"`
+}
+
+// PngConversions is the pool PdfToPng uses
+var PngConversions = &PngPool{Max: runtime.NumCPU(), MaxQueue: 100}
+
+// Stats is a snapshot of the pool's use
+func (p *PngPool) Stats() PngPoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := p.stats
+	s.Max, s.MaxQueue, s.Running, s.Waiting = p.Max, p.MaxQueue, p.running, p.waiting
+	return s
+}
+
+// acquire waits for a turn to convert
+func (p *PngPool) acquire(ctx context.Context) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.Max <= 0 || p.running < p.Max {
+		p.running++
+		return nil
+	}
+	if p.MaxQueue > 0 && p.waiting >= p.MaxQueue {
+		p.stats.Rejected++
+		return ErrPngBusy
+	}
+	if p.turn == nil {
+		p.turn = sync.NewCond(&p.lock)
+	}
+	p.waiting++
+	p.stats.Queued++
+	if p.waiting > p.stats.PeakWaiting {
+		p.stats.PeakWaiting = p.waiting
+	}
+	start := time.Now()
+	// wake waiters when ctx is done so they can give up
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.lock.Lock()
+			p.turn.Broadcast()
+			p.lock.Unlock()
+		case <-stop:
+		}
+	}()
+	for p.running >= p.Max && ctx.Err() == nil {
+		p.turn.Wait()
+	}
+	p.waiting--
+	p.stats.WaitSeconds += time.Since(start).Seconds()
+	if err := ctx.Err(); err != nil {
+		p.stats.Abandoned++
+		return err
+	}
+	p.running++
+	return nil
+}
+
+func (p *PngPool) release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.running--
+	p.stats.Conversions++
+	if p.turn != nil {
+		// all, as a waiter that has given up may be the one woken
+		p.turn.Broadcast()
+	}
+}
+
+// PdfToPng converts pdf once the pool gives it a turn
+func (p *PngPool) PdfToPng(ctx context.Context, pdf []byte) (pngbytes [][]byte, err error) {
+	if err = p.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer p.release()
+	convert := p.Convert
+	if convert == nil {
+		convert = pdfToPng
+	}
+	return convert(ctx, pdf)
+}
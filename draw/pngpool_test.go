@@ -0,0 +1,68 @@
+package draw
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPngPool(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	p := &PngPool{Max: 2, MaxQueue: 1, Convert: func(ctx context.Context, pdf []byte) ([][]byte, error) {
+		started <- struct{}{}
+		<-release
+		return [][]byte{pdf}, nil
+	}}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.PdfToPng(ctx, []byte("x")); err != nil {
+				t.Errorf("convert, %v", err)
+			}
+		}()
+	}
+	<-started
+	<-started
+	for p.Stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// two running and one waiting, so the next is refused
+	if _, err := p.PdfToPng(ctx, []byte("x")); err != ErrPngBusy {
+		t.Errorf("full queue, %v", err)
+	}
+	st := p.Stats()
+	if st.Running != 2 || st.Waiting != 1 || st.Rejected != 1 || st.Queued != 1 {
+		t.Errorf("busy stats %#v", st)
+	}
+	close(release)
+	wg.Wait()
+	st = p.Stats()
+	if st.Running != 0 || st.Waiting != 0 || st.Conversions != 3 || st.PeakWaiting != 1 {
+		t.Errorf("done stats %#v", st)
+	}
+
+	// a waiter whose context ends gives up its place
+	p = &PngPool{Max: 1, Convert: func(ctx context.Context, pdf []byte) ([][]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+	busy, cf := context.WithCancel(ctx)
+	go p.PdfToPng(busy, nil)
+	for p.Stats().Running != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	wctx, wcf := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer wcf()
+	if _, err := p.PdfToPng(wctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("abandoned wait, %v", err)
+	}
+	cf()
+	if st := p.Stats(); st.Abandoned != 1 || st.Waiting != 0 {
+		t.Errorf("abandoned stats %#v", st)
+	}
+}
@@ -0,0 +1,129 @@
+package draw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Render profiles are named alternate formats, like large print. A profile
+// is RenderOptions drawn over the document's own and under any given with
+// the render, so a large print ballot is always drawn from the same document
+// as the standard one and can't fall out of step with it.
+//
+// An election can add profiles, or redefine the built in ones, in its
+// "RenderProfiles" extension field:
+//
+// {"RenderProfiles": {"large-print": {"MinFontSize": 20, "Columns": 1}, "a4-large": {"PageSize": "A4", "MinFontSize": 18}}}
+//
+// A BallotStyle lists the profiles it is offered in with "AlternateFormats",
+// e.g. ["large-print"]. A profile render draws only the styles that list the
+// profile; if no style lists any, every style is drawn in every profile.
+
+// Election extension field with its own render profiles
+const RenderProfilesField = "RenderProfiles"
+
+// BallotStyle extension field naming the profiles the style is offered in
+const AlternateFormatsField = "AlternateFormats"
+
+// RenderProfiles are the built in profiles
+var RenderProfiles = map[string]RenderOptions{
+	"large-print":   {MinFontSize: 18, Columns: 1},
+	"high-contrast": {HighContrast: true},
+	"single-column": {Columns: 1},
+}
+
+var profileNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ErrNoProfile is wrapped by DrawElection errors for a profile the election doesn't have
+var ErrNoProfile = errors.New("no such render profile")
+
+// DocRenderProfiles is RenderProfiles with the first Election's own added
+func DocRenderProfiles(electionjson string) (map[string]RenderOptions, error) {
+	out := make(map[string]RenderOptions, len(RenderProfiles))
+	for name, ro := range RenderProfiles {
+		out[name] = ro
+	}
+	var doc struct {
+		Election []struct {
+			RenderProfiles json.RawMessage
+		}
+	}
+	if json.Unmarshal([]byte(electionjson), &doc) != nil || len(doc.Election) == 0 {
+		return out, nil
+	}
+	raw := doc.Election[0].RenderProfiles
+	if len(raw) == 0 || string(raw) == "null" {
+		return out, nil
+	}
+	var theirs map[string]RenderOptions
+	err := json.Unmarshal(raw, &theirs)
+	if err != nil {
+		return nil, fmt.Errorf("bad RenderProfiles, %v", err)
+	}
+	for name, ro := range theirs {
+		if !profileNameRe.MatchString(name) {
+			return nil, fmt.Errorf("RenderProfiles %q should be lower case letters, digits and -", name)
+		}
+		ro.PageSize = strings.ToLower(ro.PageSize)
+		ro.Layout = strings.ToLower(ro.Layout)
+		if err = ro.Check(); err != nil {
+			return nil, fmt.Errorf("RenderProfiles %q, %v", name, err)
+		}
+		out[name] = ro
+	}
+	return out, nil
+}
+
+// profileDoc returns profile's options and the document with only the ballot
+// styles offered in it
+func profileDoc(electionjson, profile string) (string, RenderOptions, error) {
+	profiles, err := DocRenderProfiles(electionjson)
+	if err != nil {
+		return "", RenderOptions{}, err
+	}
+	ro, ok := profiles[profile]
+	if !ok {
+		return "", RenderOptions{}, fmt.Errorf("%w %q", ErrNoProfile, profile)
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal([]byte(electionjson), &doc)
+	if err != nil {
+		return "", RenderOptions{}, fmt.Errorf("election json, %v", err)
+	}
+	elections := jsonList(doc, "Election")
+	if len(elections) == 0 {
+		return electionjson, ro, nil
+	}
+	styles := jsonList(elections[0], "BallotStyle")
+	var offered []interface{}
+	listed := false
+	for _, bs := range styles {
+		formats, ok := bs[AlternateFormatsField]
+		if !ok {
+			continue
+		}
+		listed = true
+		list, _ := formats.([]interface{})
+		for _, f := range list {
+			if f == profile {
+				offered = append(offered, bs)
+				break
+			}
+		}
+	}
+	if !listed {
+		return electionjson, ro, nil
+	}
+	if len(offered) == 0 {
+		return "", RenderOptions{}, fmt.Errorf("%w, no ballot style is offered in %q", ErrNoProfile, profile)
+	}
+	elections[0]["BallotStyle"] = offered
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return "", RenderOptions{}, err
+	}
+	return string(out), ro, nil
+}
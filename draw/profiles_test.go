@@ -0,0 +1,83 @@
+package draw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+// goRenderTestDoc with a second ballot style, only the first offered in large print
+var profileTestDoc = strings.Replace(goRenderTestDoc, `"BallotStyle": [{"@type": "ElectionResults.BallotStyle", "GpUnitIds": ["gpunit1"],`,
+	`"RenderProfiles": {"big-a4": {"PageSize": "A4", "MinFontSize": 20}},
+    "BallotStyle": [{"@type": "ElectionResults.BallotStyle", "GpUnitIds": ["gpunit2"], "OrderedContent": [{"@type": "ElectionResults.OrderedContest", "ContestId": "ccont1"}]},
+    {"@type": "ElectionResults.BallotStyle", "GpUnitIds": ["gpunit1"], "AlternateFormats": ["large-print", "big-a4"],`, 1)
+
+func TestDocRenderProfiles(t *testing.T) {
+	profiles, err := DocRenderProfiles(profileTestDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profiles["big-a4"] != (RenderOptions{PageSize: "a4", MinFontSize: 20}) || profiles["large-print"] != RenderProfiles["large-print"] {
+		t.Errorf("profiles %#v", profiles)
+	}
+	for _, bad := range []string{
+		`{"Election": [{"RenderProfiles": {"Big": {"Columns": 1}}}]}`,
+		`{"Election": [{"RenderProfiles": {"big": {"Columns": 9}}}]}`,
+		`{"Election": [{"RenderProfiles": ["big"]}]}`,
+	} {
+		if _, err = DocRenderProfiles(bad); err == nil {
+			t.Errorf("%s should fail", bad)
+		}
+	}
+}
+
+func TestDrawProfile(t *testing.T) {
+	c := &Client{}
+	both, err := c.DrawElection(context.Background(), profileTestDoc, RenderOptions{Profile: "large-print"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bj scan.BubblesJson
+	err = json.Unmarshal(both.BubblesJson, &bj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bj.BallotStyles) != 1 || bj.BallotStyles[0].GpUnitIds[0] != "gpunit1" {
+		t.Errorf("large print should only draw the style offered in it, %s", both.BubblesJson)
+	}
+	if !bytes.Contains(both.Pdf, []byte("/F1 18 Tf")) {
+		t.Error("large print not 18pt")
+	}
+
+	// the query overrides the profile
+	both, err = c.DrawElection(context.Background(), profileTestDoc, RenderOptions{Profile: "big-a4", MinFontSize: 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(both.Pdf, []byte("/MediaBox [0 0 595.28 841.89]")) || !bytes.Contains(both.Pdf, []byte("/F1 14 Tf")) {
+		t.Error("big-a4 with minfont=14 not A4 and 14pt")
+	}
+
+	_, err = c.DrawElection(context.Background(), profileTestDoc, RenderOptions{Profile: "high-contrast"})
+	if !errors.Is(err, ErrNoProfile) {
+		t.Errorf("no style offered in high-contrast, got %v", err)
+	}
+	_, err = c.DrawElection(context.Background(), profileTestDoc, RenderOptions{Profile: "braille"})
+	if !errors.Is(err, ErrNoProfile) {
+		t.Errorf("unknown profile, got %v", err)
+	}
+
+	// with no AlternateFormats anywhere every style is in every profile
+	both, err = c.DrawElection(context.Background(), goRenderTestDoc, RenderOptions{Profile: "high-contrast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(both.Pdf, []byte("0.850 g")) {
+		t.Error("high contrast has shaded title bars")
+	}
+}
@@ -0,0 +1,298 @@
+package draw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Reading the backend's {"pdfb64":..., "bubbles":...} response a piece at
+// a time. The PDF is base64 decoded as it arrives, into memory or into a
+// file in Client.Spool, so a multi-megabyte render is never held as the
+// whole response body, its base64 string and its bytes all at once.
+
+const spoolPattern = "render-*.pdf"
+
+// readDrawBoth reads a DrawBothResponse from r, writing the PDF to pdf as
+// it's decoded, and returns the bubbles json
+func readDrawBoth(r io.Reader, pdf io.Writer) (bubbles []byte, err error) {
+	dec := json.NewDecoder(r)
+	if err = expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	sawPdf := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("draw POST bad response, %v", err)
+		}
+		switch tok {
+		case "bubbles":
+			var bm map[string]interface{}
+			if err = dec.Decode(&bm); err != nil {
+				return nil, fmt.Errorf("draw POST bad response bj, %v", err)
+			}
+			bubbles, err = json.Marshal(bm)
+			if err != nil {
+				return nil, fmt.Errorf("draw POST bad response bj, %v", err)
+			}
+		case "pdfb64":
+			// the decoder would want the whole string, read it here instead
+			br := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+			if err = skipColon(br); err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(pdf, base64.NewDecoder(base64.StdEncoding, &jsonStringReader{r: br}))
+			if err != nil {
+				return nil, fmt.Errorf("draw POST bad response b64, %v", err)
+			}
+			sawPdf = true
+			// what's left is the rest of the object, starting after a comma
+			c, err := nextByte(br)
+			if err != nil {
+				return nil, fmt.Errorf("draw POST bad response, %v", err)
+			}
+			if c != ',' {
+				br.UnreadByte()
+			}
+			dec = json.NewDecoder(io.MultiReader(strings.NewReader("{"), br))
+			if err = expectDelim(dec, '{'); err != nil {
+				return nil, err
+			}
+		default:
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return nil, fmt.Errorf("draw POST bad response, %v", err)
+			}
+		}
+	}
+	if err = expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	if !sawPdf {
+		return nil, fmt.Errorf("draw POST bad response, no pdfb64")
+	}
+	return bubbles, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("draw POST bad response, %v", err)
+	}
+	if tok != delim {
+		return fmt.Errorf("draw POST bad response, %v where %v belongs", tok, delim)
+	}
+	return nil
+}
+
+// nextByte skips json whitespace
+func nextByte(br *bufio.Reader) (c byte, err error) {
+	for {
+		c, err = br.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return
+		}
+	}
+}
+
+// skipColon reads up to the opening quote of an object's string value
+func skipColon(br *bufio.Reader) error {
+	for _, want := range []byte{':', '"'} {
+		c, err := nextByte(br)
+		if err != nil {
+			return fmt.Errorf("draw POST bad response, %v", err)
+		}
+		if c != want {
+			return fmt.Errorf("draw POST bad response, %q where %q belongs", c, want)
+		}
+	}
+	return nil
+}
+
+// jsonStringReader reads the rest of a json string up to its closing
+// quote. Base64 only needs the one escape, \/.
+type jsonStringReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (jr *jsonStringReader) Read(p []byte) (n int, err error) {
+	for n < len(p) && !jr.done {
+		c, err := jr.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return n, err
+		}
+		switch c {
+		case '"':
+			jr.done = true
+		case '\\':
+			c, err = jr.r.ReadByte()
+			if err != nil {
+				return n, io.ErrUnexpectedEOF
+			}
+			if c != '/' {
+				return n, fmt.Errorf("unexpected escape \\%c in base64", c)
+			}
+			p[n] = c
+			n++
+		default:
+			p[n] = c
+			n++
+		}
+		if n > 0 && jr.r.Buffered() == 0 {
+			// hand over what there is rather than wait on the network
+			break
+		}
+	}
+	if n == 0 && jr.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// spoolDrawBoth reads the backend's response with the PDF going to a new
+// file in dir
+func spoolDrawBoth(dir string, body io.Reader) (both *DrawBothOb, err error) {
+	f, err := ioutil.TempFile(dir, spoolPattern)
+	if err != nil {
+		return nil, fmt.Errorf("render spool, %v", err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	sum := sha256.New()
+	counter := &countWriter{}
+	bj, err := readDrawBoth(body, io.MultiWriter(f, sum, counter))
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// held by the caller of DrawElection
+	both = &DrawBothOb{BubblesJson: bj, PdfPath: f.Name(), pdfSize: counter.n, pdfSum: sum.Sum(nil), holds: 1}
+	return both, nil
+}
+
+// Hold keeps a spooled render's file until a matching Release. The caller
+// of DrawElection already holds what it returns. Hold is false, and holds
+// nothing, if the last holder has already let go and the file is gone.
+// Renders in memory are always there.
+func (b *DrawBothOb) Hold() bool {
+	if b.PdfPath == "" {
+		return true
+	}
+	for {
+		holds := atomic.LoadInt32(&b.holds)
+		if holds <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&b.holds, holds, holds+1) {
+			return true
+		}
+	}
+}
+
+// Release lets go of a hold, removing the spool file after the last one
+func (b *DrawBothOb) Release() {
+	if b.PdfPath == "" {
+		return
+	}
+	if atomic.AddInt32(&b.holds, -1) == 0 {
+		os.Remove(b.PdfPath)
+	}
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// ClearSpool creates dir if need be and removes renders a previous run
+// left in it
+func ClearSpool(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, spoolPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range old {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// PdfSize is the length of the PDF, wherever it is
+func (b *DrawBothOb) PdfSize() int64 {
+	if b.PdfPath != "" {
+		return b.pdfSize
+	}
+	return int64(len(b.Pdf))
+}
+
+// PdfSum is the sha256 of the PDF
+func (b *DrawBothOb) PdfSum() []byte {
+	if b.PdfPath != "" {
+		return b.pdfSum
+	}
+	sum := sha256.Sum256(b.Pdf)
+	return sum[:]
+}
+
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
+// OpenPdf reads the PDF from its spool file, or from memory. Hold b until
+// it is open.
+func (b *DrawBothOb) OpenPdf() (io.ReadSeekCloser, error) {
+	if b.PdfPath == "" {
+		return bytesReadCloser{bytes.NewReader(b.Pdf)}, nil
+	}
+	f, err := os.Open(b.PdfPath)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// PdfBytes is the whole PDF, read from its spool file if it's there, for a
+// holder of b
+func (b *DrawBothOb) PdfBytes() ([]byte, error) {
+	if b.PdfPath == "" {
+		return b.Pdf, nil
+	}
+	return ioutil.ReadFile(b.PdfPath)
+}
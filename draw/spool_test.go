@@ -0,0 +1,99 @@
+package draw
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadDrawBoth(t *testing.T) {
+	pdf := bytes.Repeat([]byte("%PDF-1.4 \xff\xfe\x00 stream"), 1000)
+	b64 := base64.StdEncoding.EncodeToString(pdf)
+	for name, body := range map[string]string{
+		"bubbles first": `{"bubbles": {"b": [1, 2]}, "pdfb64": "` + b64 + `"}`,
+		"pdf first":     `{"pdfb64":"` + b64 + `" , "bubbles":{"b":[1,2]},"x":null}`,
+		"escaped":       `{"x":[], "pdfb64": "` + strings.ReplaceAll(b64, "/", `\/`) + `", "bubbles": {"b": [1,2]}}`,
+	} {
+		var out bytes.Buffer
+		// a byte at a time, as if off a slow connection
+		bj, err := readDrawBoth(iotest.OneByteReader(strings.NewReader(body)), &out)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), pdf) {
+			t.Errorf("%s: pdf %d bytes, wanted %d", name, out.Len(), len(pdf))
+		}
+		if string(bj) != `{"b":[1,2]}` {
+			t.Errorf("%s: bubbles %s", name, bj)
+		}
+	}
+	for _, bad := range []string{
+		`{"bubbles": {}}`,
+		`{"pdfb64": "AAAA`,
+		`{"pdfb64": "A\u0041AA"}`,
+		`{"pdfb64": 3}`,
+		`["pdfb64"]`,
+	} {
+		if _, err := readDrawBoth(strings.NewReader(bad), ioutil.Discard); err == nil {
+			t.Errorf("no error reading %#v", bad)
+		}
+	}
+
+	dir := t.TempDir()
+	server := httptest.NewServer(drawOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"bubbles": {}, "pdfb64": "` + b64 + `"}`))
+	}))
+	defer server.Close()
+	c := testClient(server.URL)
+	c.Spool = dir
+	both, err := c.DrawElection(context.Background(), `{}`, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if both.Pdf != nil || both.PdfPath == "" {
+		t.Errorf("not spooled, %#v", both.PdfPath)
+	}
+	got, err := both.PdfBytes()
+	if err != nil || !bytes.Equal(got, pdf) {
+		t.Errorf("spooled pdf %d bytes, %v", len(got), err)
+	}
+	sum := sha256.Sum256(pdf)
+	if both.PdfSize() != int64(len(pdf)) || !bytes.Equal(both.PdfSum(), sum[:]) {
+		t.Errorf("spooled size %d sum %x", both.PdfSize(), both.PdfSum())
+	}
+	// the file stays while anything holds it
+	if !both.Hold() {
+		t.Fatalf("hold failed")
+	}
+	both.Release()
+	if _, err = os.Stat(both.PdfPath); err != nil {
+		t.Errorf("spool file gone while held, %v", err)
+	}
+	both.Release()
+	if _, err = os.Stat(both.PdfPath); !os.IsNotExist(err) {
+		t.Errorf("spool file left after release, %v", err)
+	}
+	if both.Hold() {
+		t.Errorf("held a released render")
+	}
+
+	both, err = c.DrawElection(context.Background(), `{}`, RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ClearSpool(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = both.OpenPdf(); err == nil {
+		t.Errorf("spool file left after ClearSpool")
+	}
+}
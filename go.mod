@@ -1,10 +1,11 @@
 module github.com/brianolson/ballotstudio
 
-go 1.14
+go 1.16
 
 require (
 	github.com/brianolson/cbor_go v1.0.0
 	github.com/brianolson/login/login v0.0.0
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/lib/pq v1.7.0
 	github.com/mattn/go-sqlite3 v1.14.0
 	go.etcd.io/bbolt v1.3.5
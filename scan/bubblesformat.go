@@ -0,0 +1,163 @@
+package scan
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Bubbles JSON versions. Renders carry "version"; a layout without one is
+// version 1, as everything rendered before versions were added. Scanners
+// built against one version can keep asking for it (or convert with
+// ConvertBubbles) when the renderer moves on.
+const (
+	BubblesVersion1 = 1
+	BubblesVersion2 = 2
+
+	// BubblesVersionLatest is the newest version this build reads and writes
+	BubblesVersionLatest = BubblesVersion2
+
+	// BubblesVersionDefault is served when a client doesn't ask for one
+	BubblesVersionDefault = BubblesVersion1
+)
+
+// BubblesV1MediaType asks for version 1 explicitly; it is served as application/json.
+const BubblesV1MediaType = "application/vnd.ballotstudio.bubbles.v1+json"
+
+// BubblesFormat describes one version for /formats
+type BubblesFormat struct {
+	Version int `json:"version"`
+	// MediaType is the Content-Type it is served with
+	MediaType string `json:"media_type"`
+	// Accept is the Accept header value that asks for it
+	Accept      string `json:"accept"`
+	Description string `json:"description"`
+}
+
+// BubblesFormats lists the versions this build can read, write and convert between, oldest first.
+var BubblesFormats = []BubblesFormat{
+	{BubblesVersion1, "application/json", BubblesV1MediaType, "per ballot style contest → selection → [left, bottom, width, height], with pagination in bsdata"},
+	{BubblesVersion2, BubblesV2MediaType, BubblesV2MediaType, "ballot styles with their PDF page ranges, and targets grouped by page"},
+}
+
+// BubblesVersionOf returns the "version" of a bubbles layout, 1 if it has none.
+func BubblesVersionOf(raw []byte) (int, error) {
+	var head struct {
+		Version *int `json:"version"`
+	}
+	err := json.Unmarshal(raw, &head)
+	if err != nil {
+		return 0, err
+	}
+	if head.Version == nil {
+		return BubblesVersion1, nil
+	}
+	if *head.Version < BubblesVersion1 || *head.Version > BubblesVersionLatest {
+		return 0, fmt.Errorf("bubbles version %d not supported, want %d to %d", *head.Version, BubblesVersion1, BubblesVersionLatest)
+	}
+	return *head.Version, nil
+}
+
+// ParseBubbles reads a bubbles layout of any supported version.
+func ParseBubbles(raw []byte) (*BubblesJson, error) {
+	version, err := BubblesVersionOf(raw)
+	if err != nil {
+		return nil, err
+	}
+	if version == BubblesVersion2 {
+		var bv BubblesV2
+		err = json.Unmarshal(raw, &bv)
+		if err != nil {
+			return nil, err
+		}
+		return bv.V1(), nil
+	}
+	bj := new(BubblesJson)
+	err = json.Unmarshal(raw, bj)
+	if err != nil {
+		return nil, err
+	}
+	bj.Version = BubblesVersion1
+	return bj, nil
+}
+
+// ConvertBubbles rewrites a bubbles layout of any supported version as
+// version. A layout already at that version keeps all its fields (headers,
+// renderer settings) and only gets "version" added.
+func ConvertBubbles(raw []byte, version int) ([]byte, error) {
+	if version < BubblesVersion1 || version > BubblesVersionLatest {
+		return nil, fmt.Errorf("bubbles version %d not supported, want %d to %d", version, BubblesVersion1, BubblesVersionLatest)
+	}
+	from, err := BubblesVersionOf(raw)
+	if err != nil {
+		return nil, err
+	}
+	if from == version {
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(raw, &fields)
+		if err != nil {
+			return nil, err
+		}
+		fields["version"], _ = json.Marshal(version)
+		return json.Marshal(fields)
+	}
+	bj, err := ParseBubbles(raw)
+	if err != nil {
+		return nil, err
+	}
+	if version == BubblesVersion2 {
+		return json.Marshal(bj.V2())
+	}
+	bj.Version = BubblesVersion1
+	return json.Marshal(bj)
+}
+
+// V1 puts bubbles back in per ballot style maps, the inverse of BubblesJson.V2.
+func (bv *BubblesV2) V1() *BubblesJson {
+	nstyles := len(bv.Styles)
+	for _, style := range bv.Styles {
+		if style.Index >= nstyles {
+			nstyles = style.Index + 1
+		}
+	}
+	for _, page := range bv.Pages {
+		if page.Style >= nstyles {
+			nstyles = page.Style + 1
+		}
+	}
+	out := &BubblesJson{
+		Version:      BubblesVersion1,
+		DrawSettings: bv.DrawSettings,
+		Bubbles:      make([]Contest, nstyles),
+		BallotStyles: make([]BallotStyleData, nstyles),
+	}
+	for si := range out.Bubbles {
+		out.Bubbles[si] = Contest{}
+		out.BallotStyles[si] = BallotStyleData{Bubbles: out.Bubbles[si], BubblePages: map[string]int{}}
+	}
+	for _, style := range bv.Styles {
+		if style.Index < 0 {
+			continue
+		}
+		bsd := &out.BallotStyles[style.Index]
+		bsd.GpUnitIds = style.GpUnitIds
+		bsd.Pages = style.Pages
+	}
+	for _, page := range bv.Pages {
+		if page.Style < 0 {
+			continue
+		}
+		contests := out.Bubbles[page.Style]
+		for _, target := range page.Targets {
+			selections := contests[target.ContestId]
+			if selections == nil {
+				selections = ContestSelections{}
+				contests[target.ContestId] = selections
+			}
+			selections[target.SelectionId] = append([]float64(nil), target.Box[:]...)
+			if page.StylePage > 0 {
+				out.BallotStyles[page.Style].BubblePages[target.ContestId] = page.StylePage
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package scan
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertBubbles(t *testing.T) {
+	if v, err := BubblesVersionOf([]byte(bubblesV1Test)); err != nil || v != 1 {
+		t.Errorf("unversioned layout %d %v", v, err)
+	}
+	if _, err := BubblesVersionOf([]byte(`{"version": 3}`)); err == nil {
+		t.Errorf("accepted version 3")
+	}
+	if _, err := ConvertBubbles([]byte(bubblesV1Test), 0); err == nil {
+		t.Errorf("converted to version 0")
+	}
+
+	// same version keeps fields BubblesJson doesn't know
+	withHeaders := strings.Replace(bubblesV1Test, `"bubbles": [`, `"headers": [{"ccont1": [1, 2, 3, 4]}], "bubbles": [`, 1)
+	v1, err := ConvertBubbles([]byte(withHeaders), 1)
+	if err != nil || !strings.Contains(string(v1), `"version":1`) || !strings.Contains(string(v1), `"headers"`) {
+		t.Errorf("v1 stamp %s %v", v1, err)
+	}
+
+	v2, err := ConvertBubbles([]byte(bubblesV1Test), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bv BubblesV2
+	if err = json.Unmarshal(v2, &bv); err != nil || bv.Version != 2 || len(bv.Pages) != 4 {
+		t.Fatalf("v2 %s %v", v2, err)
+	}
+
+	// and back, for a scanner that only reads v1
+	back, err := ConvertBubbles(v2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseBubbles(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want BubblesJson
+	if err = json.Unmarshal([]byte(bubblesV1Test), &want); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 1 || !reflect.DeepEqual(got.Bubbles, want.Bubbles) {
+		t.Errorf("round trip bubbles %v\nwant %v", got.Bubbles, want.Bubbles)
+	}
+	for si, bsd := range want.BallotStyles {
+		gsd := got.BallotStyles[si]
+		if gsd.Pages != bsd.Pages || !reflect.DeepEqual(gsd.BubblePages, bsd.BubblePages) || !reflect.DeepEqual(gsd.GpUnitIds, bsd.GpUnitIds) || !reflect.DeepEqual(gsd.Bubbles, want.Bubbles[si]) {
+			t.Errorf("round trip style %d %#v", si, gsd)
+		}
+	}
+
+	// a v2 layout reads as v1 directly
+	if bj, err := ParseBubbles(v2); err != nil || len(bj.Bubbles) != 2 || bj.Bubbles[0]["ccont2"]["csel3"][3] != 8 {
+		t.Errorf("parse v2 %#v %v", bj, err)
+	}
+}
@@ -0,0 +1,121 @@
+package scan
+
+import (
+	"sort"
+)
+
+// Bubbles JSON v2, served for `Accept: BubblesV2MediaType` (or ?version=2).
+// Same bubble positions as BubblesJson, chunked by PDF page, so a scanner
+// looking at one sheet of a long ballot only has to consider that page.
+//
+//	{"version": 2,
+//	 "styles": [{"index": 0, "gpunits": ["gpu1"], "first_page": 1, "pages": 2}],
+//	 "pages": [{"page": 1, "style": 0, "style_page": 1, "targets": [
+//	   {"id": "ccont1/csel1", "contest": "ccont1", "selection": "csel1", "box": [44.2, 491.4, 22.7, 8.3]}]}]}
+
+const BubblesV2MediaType = "application/vnd.ballotstudio.bubbles.v2+json"
+
+type BubblesV2 struct {
+	Version      int              `json:"version"`
+	DrawSettings *DrawSettings    `json:"draw_settings,omitempty"`
+	Styles       []BubblesV2Style `json:"styles"`
+	Pages        []BubblesV2Page  `json:"pages"`
+}
+
+type BubblesV2Style struct {
+	// Index into the document's BallotStyle list
+	Index     int      `json:"index"`
+	GpUnitIds []string `json:"gpunits,omitempty"`
+
+	// FirstPage is the PDF page number (from 1) this style starts on.
+	// FirstPage and Pages are 0 if the renderer didn't report pagination.
+	FirstPage int `json:"first_page"`
+	Pages     int `json:"pages"`
+}
+
+type BubblesV2Page struct {
+	// Page is the PDF page number from 1, 0 if unknown
+	Page int `json:"page"`
+	// Style is BubblesV2Style.Index
+	Style int `json:"style"`
+	// StylePage is the page within the ballot style from 1, 0 if unknown
+	StylePage int `json:"style_page"`
+
+	Targets []BubblesV2Target `json:"targets"`
+}
+
+type BubblesV2Target struct {
+	// Id is "{contest @id}/{selection @id}" from the election document,
+	// stable across re-renders as long as the document ids don't change.
+	Id          string `json:"id"`
+	ContestId   string `json:"contest"`
+	SelectionId string `json:"selection"`
+
+	// Box is [left, bottom, width, height] in points from the page's lower left
+	Box [4]float64 `json:"box"`
+}
+
+func BubbleTargetId(contestId, selectionId string) string {
+	return contestId + "/" + selectionId
+}
+
+// V2 rearranges bubbles by page.
+func (bj *BubblesJson) V2() *BubblesV2 {
+	out := &BubblesV2{
+		Version:      2,
+		DrawSettings: bj.DrawSettings,
+		Styles:       []BubblesV2Style{},
+		Pages:        []BubblesV2Page{},
+	}
+	nextPage := 1
+	for si, contests := range bj.Bubbles {
+		style := BubblesV2Style{Index: si}
+		var bubblePages map[string]int
+		if si < len(bj.BallotStyles) {
+			bsd := bj.BallotStyles[si]
+			style.GpUnitIds = bsd.GpUnitIds
+			style.Pages = bsd.Pages
+			bubblePages = bsd.BubblePages
+		}
+		if style.Pages > 0 {
+			style.FirstPage = nextPage
+			nextPage += style.Pages
+		}
+		out.Styles = append(out.Styles, style)
+
+		// style page -> targets; all pages get an entry even if they have no bubbles
+		pages := make(map[int][]BubblesV2Target, style.Pages)
+		for p := 1; p <= style.Pages; p++ {
+			pages[p] = []BubblesV2Target{}
+		}
+		for cid, selections := range contests {
+			stylePage := 0
+			if style.Pages > 0 {
+				stylePage = bubblePages[cid]
+			}
+			for sid, box := range selections {
+				if len(box) != 4 {
+					continue
+				}
+				target := BubblesV2Target{Id: BubbleTargetId(cid, sid), ContestId: cid, SelectionId: sid}
+				copy(target.Box[:], box)
+				pages[stylePage] = append(pages[stylePage], target)
+			}
+		}
+		stylePages := make([]int, 0, len(pages))
+		for p := range pages {
+			stylePages = append(stylePages, p)
+		}
+		sort.Ints(stylePages)
+		for _, p := range stylePages {
+			targets := pages[p]
+			sort.Slice(targets, func(i, j int) bool { return targets[i].Id < targets[j].Id })
+			page := BubblesV2Page{Style: si, StylePage: p, Targets: targets}
+			if p > 0 {
+				page.Page = style.FirstPage + p - 1
+			}
+			out.Pages = append(out.Pages, page)
+		}
+	}
+	return out
+}
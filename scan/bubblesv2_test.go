@@ -0,0 +1,56 @@
+package scan
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const bubblesV1Test = `{
+ "draw_settings": {"pagesize": [612, 792], "pageMargin": 36},
+ "bubbles": [
+  {"ccont1": {"csel1": [1, 2, 3, 4], "csel2": [1, 12, 3, 4]}, "ccont2": {"csel3": [5, 6, 7, 8]}},
+  {"ccont1": {"csel1": [9, 9, 9, 9]}}
+ ],
+ "bsdata": [
+  {"GpUnitIds": ["gpu1"], "pages": 3, "bubble_pages": {"ccont1": 1, "ccont2": 3}},
+  {"GpUnitIds": ["gpu2"], "pages": 1, "bubble_pages": {"ccont1": 1}}
+ ]
+}`
+
+func TestBubblesV2(t *testing.T) {
+	var bj BubblesJson
+	err := json.Unmarshal([]byte(bubblesV1Test), &bj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := bj.V2()
+	if v2.Version != 2 || len(v2.Styles) != 2 {
+		t.Fatalf("got %#v", v2)
+	}
+	if v2.Styles[1].FirstPage != 4 || v2.Styles[1].Pages != 1 {
+		t.Errorf("second style %#v", v2.Styles[1])
+	}
+	if len(v2.Pages) != 4 {
+		t.Fatalf("wanted 4 pages, got %d", len(v2.Pages))
+	}
+	p1 := v2.Pages[0]
+	if p1.Page != 1 || len(p1.Targets) != 2 || p1.Targets[0].Id != "ccont1/csel1" || p1.Targets[1].Box != [4]float64{1, 12, 3, 4} {
+		t.Errorf("page 1 %#v", p1)
+	}
+	if len(v2.Pages[1].Targets) != 0 {
+		t.Errorf("page 2 should be empty, %#v", v2.Pages[1])
+	}
+	if v2.Pages[2].Page != 3 || v2.Pages[2].Targets[0].SelectionId != "csel3" {
+		t.Errorf("page 3 %#v", v2.Pages[2])
+	}
+	if v2.Pages[3].Page != 4 || v2.Pages[3].Style != 1 || v2.Pages[3].StylePage != 1 {
+		t.Errorf("page 4 %#v", v2.Pages[3])
+	}
+
+	// older renders without pagination are one chunk per style
+	bj.BallotStyles = nil
+	v2 = bj.V2()
+	if len(v2.Pages) != 2 || v2.Pages[0].Page != 0 || len(v2.Pages[0].Targets) != 3 {
+		t.Errorf("unpaged %#v", v2.Pages)
+	}
+}
@@ -0,0 +1,280 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Interpreter reads the marks on scanned ballots. Local runs Scanner in
+// process; Client sends scans to an external service, so a heavier
+// computer vision interpreter can be swapped in.
+type Interpreter interface {
+	// Interpret reads every bubble in bj from scanned, a scan of the page drawn as orig
+	Interpret(ctx context.Context, bj *BubblesJson, orig, scanned image.Image) (*Interpretation, error)
+}
+
+// Interpretation is the bubbles read from one scanned page, and what read them
+type Interpretation struct {
+	// Interpreter is stored with the result, so scans read by an older one can be re-read
+	Interpreter string          `json:"interpreter"`
+	Readings    []BubbleReading `json:"readings"`
+}
+
+// Local interprets scans in process with Scanner
+type Local struct{}
+
+// Interpret reads scanned with Scanner
+func (Local) Interpret(ctx context.Context, bj *BubblesJson, orig, scanned image.Image) (*Interpretation, error) {
+	var s Scanner
+	s.Bj = *bj
+	err := s.SetOrigImage(orig)
+	if err != nil {
+		return nil, err
+	}
+	readings, err := s.ReadBubbles(toYCbCr(scanned))
+	if err != nil {
+		return nil, err
+	}
+	return &Interpretation{Interpreter: InterpreterVersion, Readings: readings}, nil
+}
+
+// toYCbCr converts PNG and other scans to what the scanner reads, as JPEGs decode
+func toYCbCr(im image.Image) image.Image {
+	if _, ok := im.(*image.YCbCr); ok {
+		return im
+	}
+	b := im.Bounds()
+	out := image.NewYCbCr(b, image.YCbCrSubsampleRatio444)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.YCbCrModel.Convert(im.At(x, y)).(color.YCbCr)
+			out.Y[out.YOffset(x, y)] = c.Y
+			ci := out.COffset(x, y)
+			out.Cb[ci] = c.Cb
+			out.Cr[ci] = c.Cr
+		}
+	}
+	return out
+}
+
+// Client sends scans to an external interpreter, so a heavier one can run
+// as its own service. The protocol is POST {BackendUrl}/interpret with a
+// multipart/form-data body of "bubbles" (bubbles JSON), "orig" (the page
+// as drawn, PNG) and "scan" (PNG); the response is Interpretation JSON.
+// Handler serves that for any interpreter.
+type Client struct {
+	BackendUrl string
+
+	// Timeout is for one request, 0 for none
+	Timeout time.Duration
+
+	client *http.Client
+}
+
+// NewClient has the defaults ballotstudio uses
+func NewClient(backendUrl string) *Client {
+	return &Client{
+		BackendUrl: backendUrl,
+		Timeout:    60 * time.Second,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				DialContext:     (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				IdleConnTimeout: 90 * time.Second,
+			},
+		},
+	}
+}
+
+// ErrUnavailable wraps errors from the backend being down or overloaded,
+// rather than from the scan it was sent
+var ErrUnavailable = errors.New("scan backend unavailable")
+
+type unavailableError struct {
+	err error
+}
+
+func (ue *unavailableError) Error() string {
+	return ue.err.Error()
+}
+
+func (ue *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+func (ue *unavailableError) Unwrap() error {
+	return ue.err
+}
+
+// Interpret sends the scan to the backend
+func (c *Client) Interpret(ctx context.Context, bj *BubblesJson, orig, scanned image.Image) (*Interpretation, error) {
+	baseurl, err := url.Parse(c.BackendUrl)
+	if err != nil {
+		return nil, fmt.Errorf("bad scan backend url, %v", err)
+	}
+	baseurl.Path = path.Join(baseurl.Path, "interpret")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	bjson, err := json.Marshal(bj)
+	if err != nil {
+		return nil, err
+	}
+	err = writePart(mw, "bubbles", "application/json", bjson)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []struct {
+		name string
+		im   image.Image
+	}{{"orig", orig}, {"scan", scanned}} {
+		var pb bytes.Buffer
+		err = png.Encode(&pb, p.im)
+		if err != nil {
+			return nil, fmt.Errorf("%s png, %v", p.name, err)
+		}
+		err = writePart(mw, p.name, "image/png", pb.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", baseurl.String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &unavailableError{err}
+	}
+	defer resp.Body.Close()
+	rbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &unavailableError{err}
+	}
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("scan backend %d: %s", resp.StatusCode, strings.TrimSpace(string(rbody)))
+		switch resp.StatusCode {
+		case 502, 503, 504:
+			return nil, &unavailableError{err}
+		}
+		return nil, err
+	}
+	var out Interpretation
+	err = json.Unmarshal(rbody, &out)
+	if err != nil {
+		return nil, fmt.Errorf("scan backend response, %v", err)
+	}
+	if out.Interpreter == "" {
+		return nil, errors.New("scan backend didn't say what it is")
+	}
+	return &out, nil
+}
+
+func writePart(mw *multipart.Writer, name, contentType string, data []byte) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, name, name))
+	h.Set("Content-Type", contentType)
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = pw.Write(data)
+	return err
+}
+
+// Handler serves POST /interpret for Client, so an interpreter written in
+// Go can run as its own service
+type Handler struct {
+	Interpreter Interpreter
+
+	// MaxBytes of request body, 0 for 50MB
+	MaxBytes int64
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	maxBytes := h.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 50000000
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("want multipart, %v", err), 400)
+		return
+	}
+	var bj *BubblesJson
+	var orig, scanned image.Image
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad multipart, %v", err), 400)
+			return
+		}
+		switch part.FormName() {
+		case "bubbles":
+			// any bubbles version, so scanners and renderers can upgrade separately
+			var raw []byte
+			raw, err = io.ReadAll(part)
+			if err == nil {
+				bj, err = ParseBubbles(raw)
+			}
+		case "orig":
+			orig, _, err = image.Decode(part)
+		case "scan":
+			scanned, _, err = image.Decode(part)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad %s, %v", part.FormName(), err), 400)
+			return
+		}
+	}
+	if bj == nil || orig == nil || scanned == nil {
+		http.Error(w, "want bubbles, orig and scan", 400)
+		return
+	}
+	result, err := h.Interpreter.Interpret(r.Context(), bj, orig, scanned)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,70 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeInterpreter marks one bubble if the scan's top left pixel is dark
+type fakeInterpreter struct{}
+
+func (fakeInterpreter) Interpret(ctx context.Context, bj *BubblesJson, orig, scanned image.Image) (*Interpretation, error) {
+	if orig.Bounds() != scanned.Bounds() {
+		return nil, errors.New("sizes differ")
+	}
+	r, _, _, _ := scanned.At(0, 0).RGBA()
+	return &Interpretation{
+		Interpreter: fmt.Sprintf("fake-%v", bj.DrawSettings.PageMargin),
+		Readings:    []BubbleReading{{ContestId: "c1", SelectionId: "s1", Dark: 1, Samples: 1, Marked: r < 0x8000}},
+	}, nil
+}
+
+func TestClientHandler(t *testing.T) {
+	server := httptest.NewServer(&Handler{Interpreter: fakeInterpreter{}})
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	bj := &BubblesJson{DrawSettings: &DrawSettings{PageMargin: 9}}
+	orig := image.NewGray(image.Rect(0, 0, 20, 30))
+	scanned := image.NewGray(image.Rect(0, 0, 20, 30))
+	scanned.SetGray(0, 0, color.Gray{10})
+	result, err := client.Interpret(context.Background(), bj, orig, scanned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Interpreter != "fake-9" || len(result.Readings) != 1 || !result.Readings[0].Marked {
+		t.Errorf("result %#v", result)
+	}
+
+	_, err = client.Interpret(context.Background(), bj, orig, image.NewGray(image.Rect(0, 0, 5, 5)))
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		t.Errorf("interpreter error %v", err)
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", 503)
+	}))
+	defer down.Close()
+	_, err = NewClient(down.URL).Interpret(context.Background(), bj, orig, scanned)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("503 %v", err)
+	}
+}
+
+func TestToYCbCr(t *testing.T) {
+	im := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	im.Set(1, 2, color.White)
+	yc, ok := toYCbCr(im).(*image.YCbCr)
+	if !ok {
+		t.Fatalf("not YCbCr")
+	}
+	if yc.Y[yc.YOffset(1, 2)] != 0xff || yc.Y[yc.YOffset(0, 0)] != 0 {
+		t.Errorf("luma wrong")
+	}
+}
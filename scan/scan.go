@@ -287,6 +287,10 @@ func colorY(c color.Color) uint8 {
 	return y
 }
 
+// InterpreterVersion is stored with each scan result.
+// Bump it with any change that could change how a ballot is read.
+const InterpreterVersion = "1"
+
 type Scanner struct {
 	Bj BubblesJson
 
@@ -788,8 +792,17 @@ func (s *Scanner) translateWholeScanToOrig(it *image.YCbCr) (dboi image.Image, e
 }
 
 func (s *Scanner) processYCbCr(it *image.YCbCr) (marked map[string]map[string]bool, err error) {
+	err = s.alignYCbCr(it)
+	if err != nil {
+		return nil, err
+	}
+	return s.measureScannedBubbles(it), nil
+}
+
+// alignYCbCr finds the transform from the original to the scanned image
+func (s *Scanner) alignYCbCr(it *image.YCbCr) (err error) {
 	if it.Rect.Min.X != 0 || it.Rect.Min.Y != 0 {
-		return nil, fmt.Errorf("image origin not 0,0 but %d,%d", it.Rect.Min.X, it.Rect.Min.Y)
+		return fmt.Errorf("image origin not 0,0 but %d,%d", it.Rect.Min.X, it.Rect.Min.Y)
 	}
 	s.debug("it YStride %d CStride %d SubsampleRatio %v Rect %v\n", it.YStride, it.CStride, it.SubsampleRatio, it.Rect)
 	// pxy(it, 0, 0)
@@ -825,30 +838,30 @@ func (s *Scanner) processYCbCr(it *image.YCbCr) (marked map[string]map[string]bo
 
 	err = s.topLineYCbCr(it)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	s.refineTransform(it)
 	if s.DebugPngPath != "" {
 		dbimg, err := s.translateWholeScanToOrig(it)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		dbfout, err := os.Create(s.DebugPngPath)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		err = png.Encode(dbfout, dbimg)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 	if s.BubblesPngPath != "" {
 		err = s.debugScannedBubbles(it)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return s.measureScannedBubbles(it), nil
+	return nil
 }
 
 func (s *Scanner) measureBubble(it *image.YCbCr, xywh []float64) (darkCount, pxCount int) {
@@ -909,18 +922,102 @@ func (s *Scanner) measureBubble(it *image.YCbCr, xywh []float64) (darkCount, pxC
 }
 
 func (s *Scanner) measureScannedBubbles(it *image.YCbCr) (marked map[string]map[string]bool) {
-	marked = make(map[string]map[string]bool)
-	for _, ballotType := range s.Bj.Bubbles {
-		for contestName, csels := range ballotType {
-			conout := make(map[string]bool)
-			for cselName, xywh := range csels {
+	return MarkedFromReadings(s.readScannedBubbles(it))
+}
+
+// BubbleReading is how one bubble target was read from a scan
+type BubbleReading struct {
+	// Style is the index into BubblesJson.Bubbles
+	Style       int    `json:"style"`
+	ContestId   string `json:"contest"`
+	SelectionId string `json:"selection"`
+
+	// Dark of Samples sampled pixels were darker than the scan's threshold
+	Dark    int  `json:"dark"`
+	Samples int  `json:"samples"`
+	Marked  bool `json:"marked"`
+
+	// Corners of the target in the scanned image, in pixels:
+	// top left, top right, bottom right, bottom left
+	Corners [4]FPoint `json:"corners"`
+}
+
+// Fill is the fraction of sampled pixels that were dark
+func (br BubbleReading) Fill() float64 {
+	if br.Samples == 0 {
+		return 0
+	}
+	return float64(br.Dark) / float64(br.Samples)
+}
+
+// ReadBubbles is ProcessScannedImage with the detail of how each target was read,
+// in order of style, contest and selection
+func (s *Scanner) ReadBubbles(im image.Image) ([]BubbleReading, error) {
+	it, ok := im.(*image.YCbCr)
+	if !ok {
+		return nil, fmt.Errorf("unknown image type %T", im)
+	}
+	err := s.alignYCbCr(it)
+	if err != nil {
+		return nil, err
+	}
+	return s.readScannedBubbles(it), nil
+}
+
+func (s *Scanner) readScannedBubbles(it *image.YCbCr) (readings []BubbleReading) {
+	opngMaxY := float64(s.orig.Bounds().Max.Y)
+	for style, ballotType := range s.Bj.Bubbles {
+		contestNames := make([]string, 0, len(ballotType))
+		for contestName := range ballotType {
+			contestNames = append(contestNames, contestName)
+		}
+		sort.Strings(contestNames)
+		for _, contestName := range contestNames {
+			csels := ballotType[contestName]
+			cselNames := make([]string, 0, len(csels))
+			for cselName := range csels {
+				cselNames = append(cselNames, cselName)
+			}
+			sort.Strings(cselNames)
+			for _, cselName := range cselNames {
+				xywh := csels[cselName]
 				darkCount, pxCount := s.measureBubble(it, xywh)
 				s.debug("%s\t%s\t%d/%d dark/all px\n", contestName, cselName, darkCount, pxCount)
-				if darkCount > ((pxCount * 7) / 10) {
-					conout[cselName] = true
+				br := BubbleReading{
+					Style:       style,
+					ContestId:   contestName,
+					SelectionId: cselName,
+					Dark:        darkCount,
+					Samples:     pxCount,
+					Marked:      darkCount > ((pxCount * 7) / 10),
+				}
+				// box corners in the orig png, then in the scan
+				left := xywh[0] * s.origPxPerPt
+				right := (xywh[0] + xywh[2]) * s.origPxPerPt
+				bottom := opngMaxY - (xywh[1] * s.origPxPerPt)
+				top := opngMaxY - ((xywh[1] + xywh[3]) * s.origPxPerPt)
+				for i, c := range [4][2]float64{{left, top}, {right, top}, {right, bottom}, {left, bottom}} {
+					br.Corners[i].X, br.Corners[i].Y = s.origToScanned.Transform(c[0], c[1])
 				}
+				readings = append(readings, br)
 			}
-			marked[contestName] = conout
+		}
+	}
+	return
+}
+
+// MarkedFromReadings is contest id -> selection id -> true for the marked ones.
+// Every contest read has an entry, empty if nothing in it was marked.
+func MarkedFromReadings(readings []BubbleReading) (marked map[string]map[string]bool) {
+	marked = make(map[string]map[string]bool)
+	for _, br := range readings {
+		conout := marked[br.ContestId]
+		if conout == nil {
+			conout = make(map[string]bool)
+			marked[br.ContestId] = conout
+		}
+		if br.Marked {
+			conout[br.SelectionId] = true
 		}
 	}
 	return
@@ -1056,8 +1153,25 @@ type ContestSelections map[string][]float64
 type Contest map[string]ContestSelections
 
 type BubblesJson struct {
+	// Version is BubblesVersion1, 0 in renders from before versions, see ParseBubbles
+	Version int `json:"version,omitempty"`
+
 	DrawSettings *DrawSettings `json:"draw_settings"`
 
 	// Bubbles is a list per ballot style, indexed in the same order as the source document ballot styles.
 	Bubbles []Contest `json:"bubbles"`
+
+	// BallotStyles ("bsdata") is per ballot style like Bubbles, with pagination
+	BallotStyles []BallotStyleData `json:"bsdata,omitempty"`
+}
+
+type BallotStyleData struct {
+	GpUnitIds []string `json:"GpUnitIds"`
+	Bubbles   Contest  `json:"bubbles"`
+
+	// BubblePages is contest id -> page within this ballot style, from 1
+	BubblePages map[string]int `json:"bubble_pages"`
+
+	// Pages in this ballot style, 0 if it wasn't drawn
+	Pages int `json:"pages"`
 }
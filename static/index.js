@@ -24,6 +24,8 @@
   };
   var electionid = null;
   var urls = null;
+  // urls is replaced after a save, keep the page's CSRF token
+  var csrf = null;
   (function() {
     var eidd = document.getElementById('electionid');
     if (eidd) {
@@ -32,6 +34,7 @@
     var urlsd = document.getElementById('urls');
     if (urlsd) {
       urls = JSON.parse(decodeURIComponent(urlsd.getAttribute("data-urls")));
+      csrf = urls.csrf;
     }
   })();
 
@@ -857,7 +860,7 @@
 
   var demobutton = document.getElementById("demobutton");
   demobutton.onclick = function() {
-    GET('/static/demoelection.json', loadElectionHandler);
+    GET(urls.staticroot + '/demoelection.json', loadElectionHandler);
   };
 
     var saveResultHandler = function(buttonelem, http) {
@@ -881,7 +884,15 @@
 		}
 		if (dbt) {
 		    if (http.status == 200) {
-			dbt.innerHTML = "saved <a href=\"/edit/" + electionid + "\">election " + electionid + "</a> at " + Date();
+			var editurl = (urls && urls.edit) || ("/edit/" + electionid);
+			dbt.innerHTML = "saved <a href=\"" + editurl + "\">election " + electionid + "</a> at " + Date();
+			var saved = JSON.parse(http.responseText);
+			var issues = (saved.errors || []).concat(saved.warnings || []);
+			for (var i = 0, issue; issue = issues[i]; i++) {
+			    var line = document.createElement("div");
+			    line.textContent = issue.severity + " " + issue.id + ": " + issue.message;
+			    dbt.appendChild(line);
+			}
 		    } else {
 			var msg = "error: " + http.status + " " + http.statusText;
 			dbt.innerHTML = msg;
@@ -930,6 +941,9 @@
 	http.onreadystatechange = handler;
 	http.open("POST",url,true);
 	http.setRequestHeader('Content-Type', contentType);
+	if (csrf) {
+	  http.setRequestHeader('X-CSRF-Token', csrf);
+	}
 	http.send(data);
     };
     //pushOb(document.body, savedObj);
@@ -14,10 +14,23 @@
     }
   })();
   var imf = document.getElementById("imf");
+  // chain of custody goes with every scan; keep it for the next one from the same batch
+  var custody = imf.querySelectorAll("input.custody");
+  for (var i = 0, ci; ci = custody[i]; i++) {
+    ci.value = localStorage.getItem("custody." + ci.name) || "";
+  }
   imf.addEventListener('submit', function(e){
     e.preventDefault();
     var fi = imf.elements[0].files[0];
     var url = (urls && urls.scan) || ('/scan/' + electionid);
+    var q = [];
+    for (var i = 0, ci; ci = custody[i]; i++) {
+      localStorage.setItem("custody." + ci.name, ci.value);
+      q.push(encodeURIComponent(ci.name) + "=" + encodeURIComponent(ci.value));
+    }
+    if (q.length) {
+      url += (url.indexOf("?") < 0 ? "?" : "&") + q.join("&");
+    }
     POST(url, fi, fi.type, function(){imageuploadHandler(this);});
   });
   var imageuploadHandler = function(http) {
@@ -28,11 +41,17 @@
 	  dbg.innerHTML = "<span style=\"background-color:#ffa;font-weight:bolt;font-size:120%;\">saving...</span>";
 	}
       } else if (http.readyState == 4) {
-	scanresult = JSON.parse(http.responseText);
 	if (http.status == 200){
+	  scanresult = JSON.parse(http.responseText);
 	  dbg.innerHTML = JSON.stringify(scanresult);
+	  maybeShowResults();
+	} else {
+	  var msg = http.responseText;
+	  try {
+	    msg = JSON.parse(http.responseText).error || msg;
+	  } catch (e) {}
+	  dbg.innerText = "error: " + msg;
 	}
-	maybeShowResults();
       }
     }
   };
@@ -90,6 +109,9 @@
     http.onreadystatechange = handler;
     http.open("POST",url,true);
     http.setRequestHeader('Content-Type', contentType);
+    if (urls.csrf) {
+      http.setRequestHeader('X-CSRF-Token', urls.csrf);
+    }
     http.send(data);
   };
   var GET = function(url, handler) {
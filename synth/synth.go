@@ -0,0 +1,229 @@
+// Package synth makes marked ballot images from rendered pages and their
+// bubbles JSON, for testing the scanner without paper: logic and accuracy
+// test decks, and accuracy benchmarks across interpreter versions.
+package synth
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+// Options for how the marks and the "scan" look. The zero value makes
+// clean, dark, fully filled marks on a straight page.
+type Options struct {
+	// Seed for everything random, the same seed draws the same image
+	Seed int64 `json:"seed"`
+
+	// Fill is how much of each bubble's area the mark covers, 0 for 0.9.
+	// Marks are ellipses, so over about 0.8 they spill out of the bubble.
+	Fill float64 `json:"fill,omitempty"`
+
+	// Ink is the gray level of the mark, 0 black to 255 white, 0 for 40
+	Ink uint8 `json:"ink,omitempty"`
+
+	// Jitter moves each mark up to this fraction of the bubble's size
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// Rotate turns the page this many degrees clockwise about its center
+	Rotate float64 `json:"rotate,omitempty"`
+
+	// Noise is the standard deviation of gray noise added to every pixel
+	Noise float64 `json:"noise,omitempty"`
+}
+
+const (
+	defaultFill = 0.9
+	defaultInk  = 40
+)
+
+// StylePages is the pages of a ballot style, as 1 based first page and count.
+// A renderer that didn't report pagination drew one style on all npages.
+func StylePages(bv *scan.BubblesV2, style, npages int) (first, count int, err error) {
+	if style < 0 || style >= len(bv.Styles) {
+		return 0, 0, fmt.Errorf("no ballot style %d", style)
+	}
+	st := bv.Styles[style]
+	if st.Pages == 0 {
+		if len(bv.Styles) > 1 {
+			return 0, 0, fmt.Errorf("renderer didn't report which pages ballot style %d is on", style)
+		}
+		return 1, npages, nil
+	}
+	if st.FirstPage+st.Pages-1 > npages {
+		return 0, 0, fmt.Errorf("ballot style %d page %d not rendered", style, st.FirstPage+st.Pages-1)
+	}
+	return st.FirstPage, st.Pages, nil
+}
+
+// Ballot marks votes (contest id -> selection id -> marked, like a scan
+// result) on the pages of one ballot style. pages are all of the
+// election's rendered pages in order, and pageWidth and pageHeight their
+// size in points from the bubbles JSON draw settings.
+func Ballot(bv *scan.BubblesV2, pages []image.Image, pageWidth, pageHeight float64, style int, votes map[string]map[string]bool, opts Options) ([]*image.RGBA, error) {
+	first, count, err := StylePages(bv, style, len(pages))
+	if err != nil {
+		return nil, err
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	out := make([]*image.RGBA, 0, count)
+	for p := first; p < first+count; p++ {
+		var boxes [][4]float64
+		for _, page := range bv.Pages {
+			// page 0 is unknown, only with one style on unpaginated pages
+			if page.Style != style || (page.Page != p && !(page.Page == 0 && p == first)) {
+				continue
+			}
+			for _, target := range page.Targets {
+				if votes[target.ContestId][target.SelectionId] {
+					boxes = append(boxes, target.Box)
+				}
+			}
+		}
+		out = append(out, MarkPage(pages[p-1], pageWidth, pageHeight, boxes, opts, rng))
+	}
+	return out, nil
+}
+
+// MarkPage draws a mark in each box ([left, bottom, width, height] in
+// points from the lower left, as in bubbles JSON) on a copy of page, then
+// rotates and adds noise as opts say.
+func MarkPage(page image.Image, pageWidth, pageHeight float64, boxes [][4]float64, opts Options, rng *rand.Rand) *image.RGBA {
+	b := page.Bounds()
+	im := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			im.Set(x, y, page.At(x, y))
+		}
+	}
+	scale := float64(b.Dx()) / pageWidth
+	fill := opts.Fill
+	if fill <= 0 {
+		fill = defaultFill
+	}
+	ink := opts.Ink
+	if ink == 0 {
+		ink = defaultInk
+	}
+	// an ellipse of area fill * width * height
+	radius := math.Sqrt(4 * fill / math.Pi)
+	for _, box := range boxes {
+		w := box[2] * scale
+		h := box[3] * scale
+		cx := float64(b.Min.X) + (box[0]+box[2]/2)*scale
+		cy := float64(b.Min.Y) + (pageHeight-box[1]-box[3]/2)*scale
+		if opts.Jitter > 0 {
+			cx += (rng.Float64()*2 - 1) * opts.Jitter * w
+			cy += (rng.Float64()*2 - 1) * opts.Jitter * h
+		}
+		rx := radius * w / 2
+		ry := radius * h / 2
+		// a pixel of soft edge, as pens leave
+		edge := 1 / math.Min(rx, ry)
+		for y := int(cy - ry - 2); y <= int(cy+ry+2); y++ {
+			for x := int(cx - rx - 2); x <= int(cx+rx+2); x++ {
+				dx := (float64(x) + 0.5 - cx) / rx
+				dy := (float64(y) + 0.5 - cy) / ry
+				d := math.Sqrt(dx*dx + dy*dy)
+				if d >= 1+edge {
+					continue
+				}
+				cover := 1.0
+				if d > 1-edge {
+					cover = (1 + edge - d) / (2 * edge)
+				}
+				if !(image.Point{x, y}.In(b)) {
+					continue
+				}
+				old := im.RGBAAt(x, y)
+				im.SetRGBA(x, y, color.RGBA{
+					blend(old.R, ink, cover),
+					blend(old.G, ink, cover),
+					blend(old.B, ink, cover),
+					0xff,
+				})
+			}
+		}
+	}
+	if opts.Rotate != 0 {
+		im = rotate(im, opts.Rotate)
+	}
+	if opts.Noise > 0 {
+		for i := 0; i < len(im.Pix); i += 4 {
+			n := rng.NormFloat64() * opts.Noise
+			im.Pix[i] = clamp(float64(im.Pix[i]) + n)
+			im.Pix[i+1] = clamp(float64(im.Pix[i+1]) + n)
+			im.Pix[i+2] = clamp(float64(im.Pix[i+2]) + n)
+		}
+	}
+	return im
+}
+
+func blend(under, ink uint8, cover float64) uint8 {
+	// ink darkens, it doesn't lighten what's already printed
+	v := float64(under)*(1-cover) + float64(ink)*cover
+	if v > float64(under) {
+		return under
+	}
+	return uint8(v)
+}
+
+func clamp(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// rotate turns im degrees clockwise about its center, white where there was no page
+func rotate(im *image.RGBA, degrees float64) *image.RGBA {
+	b := im.Bounds()
+	out := image.NewRGBA(b)
+	th := degrees * math.Pi / 180
+	cos, sin := math.Cos(th), math.Sin(th)
+	cx := float64(b.Min.X+b.Max.X) / 2
+	cy := float64(b.Min.Y+b.Max.Y) / 2
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// where this pixel came from, turning back the other way
+			dx := float64(x) + 0.5 - cx
+			dy := float64(y) + 0.5 - cy
+			sx := cx + dx*cos + dy*sin - 0.5
+			sy := cy - dx*sin + dy*cos - 0.5
+			out.SetRGBA(x, y, bilinear(im, sx, sy))
+		}
+	}
+	return out
+}
+
+var white = color.RGBA{0xff, 0xff, 0xff, 0xff}
+
+func bilinear(im *image.RGBA, x, y float64) color.RGBA {
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+	at := func(x, y int) color.RGBA {
+		if !(image.Point{x, y}.In(im.Rect)) {
+			return white
+		}
+		return im.RGBAAt(x, y)
+	}
+	c00, c10, c01, c11 := at(x0, y0), at(x0+1, y0), at(x0, y0+1), at(x0+1, y0+1)
+	mix := func(a, b, c, d uint8) uint8 {
+		top := float64(a)*(1-fx) + float64(b)*fx
+		bottom := float64(c)*(1-fx) + float64(d)*fx
+		return clamp(top*(1-fy) + bottom*fy)
+	}
+	return color.RGBA{
+		mix(c00.R, c10.R, c01.R, c11.R),
+		mix(c00.G, c10.G, c01.G, c11.G),
+		mix(c00.B, c10.B, c01.B, c11.B),
+		0xff,
+	}
+}
@@ -0,0 +1,79 @@
+package synth
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/brianolson/ballotstudio/scan"
+)
+
+func whitePage(w, h int) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range im.Pix {
+		im.Pix[i] = 0xff
+	}
+	return im
+}
+
+func TestMarkPage(t *testing.T) {
+	// 100x200 points at 2 pixels per point, one bubble 10pt square at (20, 150) from the bottom left
+	page := whitePage(200, 400)
+	box := [4]float64{20, 150, 10, 10}
+	im := MarkPage(page, 100, 200, [][4]float64{box}, Options{}, rand.New(rand.NewSource(1)))
+	// center of the bubble is pixel (50, 90)
+	if c := im.RGBAAt(50, 90); c.R != defaultInk {
+		t.Errorf("center %v", c)
+	}
+	if c := im.RGBAAt(10, 10); c != white {
+		t.Errorf("away from the mark %v", c)
+	}
+	if page.RGBAAt(50, 90) != white {
+		t.Errorf("marked the original")
+	}
+	dark := 0
+	for i := 0; i < len(im.Pix); i += 4 {
+		if im.Pix[i] < 128 {
+			dark++
+		}
+	}
+	// 20x20 pixels at fill 0.9
+	if dark < 320 || dark > 400 {
+		t.Errorf("dark pixels %d", dark)
+	}
+
+	opts := Options{Seed: 5, Jitter: 0.1, Rotate: 2, Noise: 10}
+	a := MarkPage(page, 100, 200, [][4]float64{box}, opts, rand.New(rand.NewSource(opts.Seed)))
+	b := MarkPage(page, 100, 200, [][4]float64{box}, opts, rand.New(rand.NewSource(opts.Seed)))
+	if !bytes.Equal(a.Pix, b.Pix) {
+		t.Errorf("same seed, different image")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	im := whitePage(100, 100)
+	im.SetRGBA(90, 50, color.RGBA{0, 0, 0, 0xff})
+	out := rotate(im, 90)
+	// clockwise, the right edge goes to the bottom; the center is between pixels
+	if c := out.RGBAAt(49, 90); c.R > 128 {
+		t.Errorf("rotated dot %v", c)
+	}
+	if c := out.RGBAAt(90, 50); c.R < 128 {
+		t.Errorf("left behind %v", c)
+	}
+}
+
+func TestStylePages(t *testing.T) {
+	bv := &scan.BubblesV2{Styles: []scan.BubblesV2Style{{FirstPage: 1, Pages: 2}, {FirstPage: 3, Pages: 1}}}
+	if first, count, err := StylePages(bv, 1, 3); err != nil || first != 3 || count != 1 {
+		t.Errorf("style 1 %d %d %v", first, count, err)
+	}
+	if _, _, err := StylePages(bv, 1, 2); err == nil {
+		t.Errorf("page past the render")
+	}
+	if _, _, err := StylePages(bv, 2, 3); err == nil {
+		t.Errorf("no such style")
+	}
+}